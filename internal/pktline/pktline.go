@@ -0,0 +1,277 @@
+// Package pktline implements the pkt-line framing used by every git wire
+// protocol: a four hex digit length prefix followed by the payload, plus the
+// special 0000 (flush), 0001 (delim) and 0002 (response-end) packets.
+package pktline
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+const (
+	// MaxPacketSize is the largest packet allowed on the wire, header included.
+	MaxPacketSize = 65520
+	// MaxDataSize is the largest payload that fits in a single packet.
+	MaxDataSize = MaxPacketSize - 4
+)
+
+// Type identifies what kind of packet was read.
+type Type int
+
+const (
+	Data Type = iota
+	Flush
+	Delim
+	ResponseEnd
+)
+
+func (t Type) String() string {
+	switch t {
+	case Data:
+		return "data"
+	case Flush:
+		return "flush"
+	case Delim:
+		return "delim"
+	case ResponseEnd:
+		return "response-end"
+	default:
+		return fmt.Sprintf("Type(%d)", int(t))
+	}
+}
+
+var (
+	ErrInvalidLength = errors.New("invalid pkt-line length")
+	ErrTooLarge      = errors.New("pkt-line exceeds maximum size")
+	ErrUnexpected    = errors.New("unexpected pkt-line")
+)
+
+// FormatError describes a malformed frame, keeping the raw header bytes so
+// protocol errors can be reported precisely.
+type FormatError struct {
+	Header []byte
+	Err    error
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Err, e.Header)
+}
+
+func (e *FormatError) Unwrap() error {
+	return e.Err
+}
+
+// Reader reads pkt-line framed packets from an underlying stream.
+type Reader struct {
+	// MaxListSize bounds the payload bytes ReadUntilFlush and ReadSection
+	// collect, so that a peer cannot grow a list without end. Zero means
+	// no bound.
+	MaxListSize int
+
+	r      io.Reader
+	header [4]byte
+	buf    []byte
+	peeked bool
+	ptype  Type
+	pdata  []byte
+	perr   error
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, buf: make([]byte, MaxDataSize)}
+}
+
+// ReadPacket returns the next packet. The returned slice is only valid until
+// the next call to ReadPacket or Peek.
+func (r *Reader) ReadPacket() (Type, []byte, error) {
+	if r.peeked {
+		r.peeked = false
+		return r.ptype, r.pdata, r.perr
+	}
+	return r.read()
+}
+
+// Peek returns the next packet without consuming it.
+func (r *Reader) Peek() (Type, []byte, error) {
+	if !r.peeked {
+		r.ptype, r.pdata, r.perr = r.read()
+		r.peeked = true
+	}
+	return r.ptype, r.pdata, r.perr
+}
+
+func (r *Reader) read() (Type, []byte, error) {
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, &FormatError{Header: bytes.Clone(r.header[:]), Err: ErrInvalidLength}
+		}
+		return 0, nil, err
+	}
+
+	n, err := ParseLength(r.header[:])
+	if err != nil {
+		return 0, nil, err
+	}
+
+	switch n {
+	case 0:
+		return Flush, nil, nil
+	case 1:
+		return Delim, nil, nil
+	case 2:
+		return ResponseEnd, nil, nil
+	}
+
+	data := r.buf[:n-4]
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return 0, nil, fmt.Errorf("failed to read pkt-line payload: %w", err)
+	}
+	return Data, data, nil
+}
+
+// ReadLine reads a data packet and strips a single trailing newline. Any
+// special packet is returned with an empty line.
+func (r *Reader) ReadLine() (Type, string, error) {
+	t, data, err := r.ReadPacket()
+	if err != nil || t != Data {
+		return t, "", err
+	}
+	return t, string(bytes.TrimSuffix(data, []byte("\n"))), nil
+}
+
+// ReadUntilFlush collects every data line up to the next flush packet.
+func (r *Reader) ReadUntilFlush() ([]string, error) {
+	var lines []string
+	size := 0
+	for {
+		t, line, err := r.ReadLine()
+		if err != nil {
+			return nil, err
+		}
+		switch t {
+		case Data:
+			if size += len(line); r.MaxListSize > 0 && size > r.MaxListSize {
+				return nil, fmt.Errorf("%w: list of more than %d bytes", ErrTooLarge, r.MaxListSize)
+			}
+			lines = append(lines, line)
+		case Flush:
+			return lines, nil
+		default:
+			return nil, fmt.Errorf("%w: %s before flush", ErrUnexpected, t)
+		}
+	}
+}
+
+// ReadSection reads data lines until a flush or delimiter packet, as used
+// to separate the sections of a protocol v2 response, and reports which of
+// the two ended the section.
+func (r *Reader) ReadSection() ([]string, Type, error) {
+	var lines []string
+	size := 0
+	for {
+		t, line, err := r.ReadLine()
+		if err != nil {
+			return nil, t, err
+		}
+		switch t {
+		case Data:
+			if size += len(line); r.MaxListSize > 0 && size > r.MaxListSize {
+				return nil, t, fmt.Errorf("%w: list of more than %d bytes", ErrTooLarge, r.MaxListSize)
+			}
+			lines = append(lines, line)
+		case Flush, Delim:
+			return lines, t, nil
+		default:
+			return nil, t, fmt.Errorf("%w: %s in section", ErrUnexpected, t)
+		}
+	}
+}
+
+// ParseLength decodes a four byte hex header into the total packet length.
+// Values 1 to 3 are only valid as special packets and 4 is an empty data
+// packet; anything above MaxPacketSize is rejected.
+func ParseLength(header []byte) (int, error) {
+	if len(header) != 4 {
+		return 0, &FormatError{Header: bytes.Clone(header), Err: ErrInvalidLength}
+	}
+	for _, c := range header {
+		if !isHex(c) {
+			return 0, &FormatError{Header: bytes.Clone(header), Err: ErrInvalidLength}
+		}
+	}
+
+	n, err := strconv.ParseUint(string(header), 16, 16)
+	if err != nil {
+		return 0, &FormatError{Header: bytes.Clone(header), Err: ErrInvalidLength}
+	}
+	if n == 3 {
+		return 0, &FormatError{Header: bytes.Clone(header), Err: ErrInvalidLength}
+	}
+	if n > MaxPacketSize {
+		return 0, &FormatError{Header: bytes.Clone(header), Err: ErrTooLarge}
+	}
+	return int(n), nil
+}
+
+func isHex(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F'
+}
+
+// Writer writes pkt-line framed packets.
+type Writer struct {
+	w io.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write sends data as a single packet.
+func (w *Writer) Write(data []byte) (int, error) {
+	if len(data) > MaxDataSize {
+		return 0, ErrTooLarge
+	}
+
+	packet := make([]byte, 4+len(data))
+	copy(packet, fmt.Sprintf("%04x", len(data)+4))
+	copy(packet[4:], data)
+	if _, err := w.w.Write(packet); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// WriteString sends s as a single packet.
+func (w *Writer) WriteString(s string) error {
+	_, err := w.Write([]byte(s))
+	return err
+}
+
+// Writef formats a line and sends it as a single packet.
+func (w *Writer) Writef(format string, args ...any) error {
+	return w.WriteString(fmt.Sprintf(format, args...))
+}
+
+// Flush writes a 0000 flush packet.
+func (w *Writer) Flush() error {
+	_, err := io.WriteString(w.w, "0000")
+	return err
+}
+
+// Delim writes a 0001 delimiter packet.
+func (w *Writer) Delim() error {
+	_, err := io.WriteString(w.w, "0001")
+	return err
+}
+
+// ResponseEnd writes a 0002 response-end packet.
+func (w *Writer) ResponseEnd() error {
+	_, err := io.WriteString(w.w, "0002")
+	return err
+}
@@ -0,0 +1,357 @@
+package mygit
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// addOptions select what add stages.
+type addOptions struct {
+	// trackedOnly leaves untracked files out, and keepRemoved leaves
+	// deleted files in the index.
+	trackedOnly bool
+	keepRemoved bool
+	// force adds ignored files too.
+	force   bool
+	dryRun  bool
+	verbose bool
+}
+
+// pathspecDir reports whether a directory can hold files that paths
+// match.
+func pathspecDir(dir string, paths []string) bool {
+	if matchPathspec(dir, paths) {
+		return true
+	}
+	for _, p := range paths {
+		if strings.HasPrefix(filepath.ToSlash(filepath.Clean(p)), dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// listUntracked returns the files in the working tree below paths that
+// the index does not track, and those the rules ignore: files, and
+// directories with a trailing slash that are not looked into unless
+// expandIgnored is set. Nil rules ignore nothing.
+func listUntracked(entries []indexEntry, paths []string, rules *ignoreRules, expandIgnored bool) (untracked, ignored []string, err error) {
+	tracked := make(map[string]bool)
+	for _, e := range entries {
+		tracked[e.path] = true
+	}
+	// Once in an ignored directory, everything below is ignored.
+	ignoredDir := ""
+	err = filepath.WalkDir(".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		path = filepath.ToSlash(path)
+		if path == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if d.Name() == ".git" || !pathspecDir(path, paths) {
+				return filepath.SkipDir
+			}
+			// Nested repositories are not looked into.
+			if _, err := os.Stat(filepath.Join(path, ".git")); err == nil {
+				return filepath.SkipDir
+			}
+			if ignoredDir != "" && strings.HasPrefix(path, ignoredDir) {
+				return nil
+			}
+			if rules != nil {
+				if skip, err := rules.match(path, true); err != nil {
+					return err
+				} else if skip && expandIgnored {
+					ignoredDir = path + "/"
+				} else if skip {
+					ignored = append(ignored, path+"/")
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		// A linked worktree has a .git file instead.
+		if d.Name() == ".git" || tracked[path] || !matchPathspec(path, paths) {
+			return nil
+		}
+		if ignoredDir != "" && strings.HasPrefix(path, ignoredDir) {
+			ignored = append(ignored, path)
+			return nil
+		}
+		if rules != nil {
+			if skip, err := rules.match(path, false); err != nil {
+				return err
+			} else if skip {
+				ignored = append(ignored, path)
+				return nil
+			}
+		}
+		untracked = append(untracked, path)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list untracked files: %w", err)
+	}
+	return untracked, ignored, nil
+}
+
+// readWorktreeFile returns the content of a file in the working tree.
+func readWorktreeFile(path string) (diffEntry, error) {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return diffEntry{}, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	var data []byte
+	mode := worktreeMode(fi)
+	if mode == modeSymlink {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return diffEntry{}, fmt.Errorf("failed to read link %s: %w", path, err)
+		}
+		data = []byte(target)
+	} else if data, err = os.ReadFile(path); err != nil {
+		return diffEntry{}, fmt.Errorf("failed to read %s: %w", path, err)
+	} else if data, err = convertToGit(path, data); err != nil {
+		return diffEntry{}, err
+	}
+	return diffEntry{mode: mode, hash: hashObjectData(blobObject, data), data: data}, nil
+}
+
+func tracksPathspec(entries []indexEntry, p string) bool {
+	for _, e := range entries {
+		if matchPathspec(e.path, []string{p}) {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoredPathspecs returns the paths naming untracked files or directories
+// that are ignored, which add refuses unless forced.
+func ignoredPathspecs(entries []indexEntry, paths []string, rules *ignoreRules) ([]string, error) {
+	var ignored []string
+	for _, p := range paths {
+		clean := filepath.ToSlash(filepath.Clean(p))
+		fi, err := os.Lstat(clean)
+		if err != nil || clean == "." || tracksPathspec(entries, clean) {
+			continue
+		}
+		if skip, err := rules.ignored(clean, fi.IsDir()); err != nil {
+			return nil, err
+		} else if skip {
+			ignored = append(ignored, p)
+		}
+	}
+	return ignored, nil
+}
+
+// addPaths stages the working tree state of the files below paths, as
+// opts select. It reports whether ignored files were named, which are
+// left out while the other paths are still added.
+func addPaths(cfg *config, entries []indexEntry, paths []string, opts addOptions) ([]indexEntry, bool, error) {
+	for _, p := range paths {
+		if _, err := os.Lstat(p); err != nil && !tracksPathspec(entries, p) {
+			return nil, false, fmt.Errorf("pathspec '%s' did not match any files", p)
+		}
+	}
+	report := func(action, path string) {
+		if opts.dryRun || opts.verbose {
+			fmt.Printf("%s '%s'\n", action, path)
+		}
+	}
+
+	var tracked []indexEntry
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if !seen[e.path] && matchPathspec(e.path, paths) {
+			// Unmerged paths are resolved with whatever is in the working
+			// tree.
+			tracked = append(tracked, indexEntry{path: e.path, mode: e.mode, hash: e.hash, mtime: e.mtime, size: e.size})
+		}
+		seen[e.path] = true
+	}
+	_, unmerged := indexFiles(entries)
+	work, err := worktreeFiles(cfg, tracked)
+	if err != nil {
+		return nil, false, err
+	}
+	updates := make(map[string]diffEntry)
+	for _, e := range tracked {
+		file, ok := work[e.path]
+		switch {
+		case !ok && opts.keepRemoved:
+		case !ok:
+			report("remove", e.path)
+			updates[e.path] = diffEntry{}
+		case unmerged[e.path] || !sameFile(file, diffEntry{mode: e.mode, hash: e.hash}):
+			report("add", e.path)
+			updates[e.path] = file
+		case file.data != nil:
+			// Files that were read get fresh stat data.
+			updates[e.path] = file
+		}
+	}
+
+	ignoredNamed := false
+	if !opts.trackedOnly {
+		var rules *ignoreRules
+		if !opts.force {
+			if rules, err = loadIgnoreRules(cfg); err != nil {
+				return nil, false, err
+			}
+			ignored, err := ignoredPathspecs(entries, paths, rules)
+			if err != nil {
+				return nil, false, err
+			}
+			if len(ignored) > 0 {
+				ignoredNamed = true
+				fmt.Fprintln(os.Stderr, "The following paths are ignored by one of your .gitignore files:")
+				for _, p := range ignored {
+					fmt.Fprintln(os.Stderr, p)
+				}
+				if advise, err := cfg.getBool("advice.addIgnoredFile", true); err != nil {
+					return nil, false, err
+				} else if advise {
+					fmt.Fprintln(os.Stderr, "hint: Use -f if you really want to add them.")
+					fmt.Fprintln(os.Stderr, "hint: Turn this message off by running")
+					fmt.Fprintln(os.Stderr, "hint: \"git config advice.addIgnoredFile false\"")
+				}
+			}
+		}
+		untracked, _, err := listUntracked(entries, paths, rules, false)
+		if err != nil {
+			return nil, false, err
+		}
+		sort.Strings(untracked)
+		for _, path := range untracked {
+			report("add", path)
+			if updates[path], err = readWorktreeFile(path); err != nil {
+				return nil, false, err
+			}
+		}
+	}
+
+	if opts.dryRun {
+		return entries, ignoredNamed, nil
+	}
+	// The blobs are flushed to disk together, before the index names
+	// them.
+	beginObjectBatch()
+	for _, file := range updates {
+		if file.data != nil {
+			if _, err := storeObject(blobObject, file.data); err != nil {
+				endObjectBatch()
+				return nil, false, err
+			}
+		}
+	}
+	if err := endObjectBatch(); err != nil {
+		return nil, false, err
+	}
+	entries, err = updateIndexPaths(entries, updates)
+	return entries, ignoredNamed, err
+}
+
+// addPatch stages the hunks of the changes to tracked files that the user
+// picks.
+func addPatch(cfg *config, entries []indexEntry, paths []string) ([]indexEntry, error) {
+	indexed, unmerged := indexFiles(entries)
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return nil, err
+	}
+	results, err := runPatchMode(cfg, patchModeStage, diffFiles(indexed, work, unmerged, paths))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range results {
+		if file.data != nil {
+			if _, err := storeObject(blobObject, file.data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return updateIndexPaths(entries, results)
+}
+
+func runAdd(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	safeCRLFCheck = safeCRLFDie
+	var opts addOptions
+	var paths []string
+	patch, all := false, false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case arg == "-p" || arg == "--patch":
+			patch = true
+		case arg == "-u" || arg == "--update":
+			opts.trackedOnly = true
+		case arg == "-A" || arg == "--all" || arg == "--no-ignore-removal":
+			all, opts.keepRemoved = true, false
+		case arg == "--no-all" || arg == "--ignore-removal":
+			all, opts.keepRemoved = false, true
+		case arg == "-n" || arg == "--dry-run":
+			opts.dryRun = true
+		case arg == "-v" || arg == "--verbose":
+			opts.verbose = true
+		case arg == "-f" || arg == "--force":
+			opts.force = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if all && opts.trackedOnly {
+		return fmt.Errorf("options '-A' and '-u' cannot be used together")
+	}
+	// -u and -A without paths work on the whole tree.
+	if len(paths) == 0 && !patch && !all && !opts.trackedOnly {
+		fmt.Fprintln(os.Stderr, "Nothing specified, nothing added.")
+		if advise, err := cfg.getBool("advice.addEmptyPathspec", true); err != nil {
+			return err
+		} else if advise {
+			fmt.Fprintln(os.Stderr, "hint: Maybe you wanted to say 'git add .'?")
+			fmt.Fprintln(os.Stderr, "hint: Turn this message off by running")
+			fmt.Fprintln(os.Stderr, "hint: \"git config advice.addEmptyPathspec false\"")
+		}
+		return nil
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	if patch {
+		if entries, err = addPatch(cfg, entries, paths); err != nil {
+			return err
+		}
+		return writeIndex(entries)
+	}
+	entries, ignoredNamed, err := addPaths(cfg, entries, paths, opts)
+	if err != nil {
+		return err
+	}
+	if !opts.dryRun {
+		if err := writeIndex(entries); err != nil {
+			return err
+		}
+	}
+	if ignoredNamed {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,796 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// patchEditFile is where a hunk is edited by hand.
+var patchEditFile = ".git/addp-hunk-edit.diff"
+
+// patchMode describes what the hunks picked in an interactive patch
+// session are for: staging them, discarding them and so on. Reverse modes
+// undo the picked hunks on the new side of the diff instead of applying
+// them to the old side.
+type patchMode struct {
+	// verb is what is done to a hunk, as in "stage this hunk", and where
+	// says to what, as in "discard this hunk from worktree".
+	verb    string
+	where   string
+	reverse bool
+	// editing names the verb in the hunk editing guide, as in "marked
+	// for staging".
+	editing string
+}
+
+var (
+	patchModeStage   = &patchMode{verb: "stage", editing: "staging"}
+	patchModeStash   = &patchMode{verb: "stash", editing: "stashing"}
+	patchModeUnstage = &patchMode{verb: "unstage", reverse: true, editing: "unstaging"}
+	patchModeDiscard = &patchMode{verb: "discard", where: " from worktree", reverse: true, editing: "discarding"}
+)
+
+// prompt returns the question asked about a hunk, as in "Stage this hunk".
+func (m *patchMode) prompt(what string) string {
+	return strings.ToUpper(m.verb[:1]) + m.verb[1:] + " " + what + m.where
+}
+
+type hunkUse int
+
+const (
+	hunkUndecided hunkUse = iota
+	hunkUsed
+	hunkSkipped
+)
+
+type hunkKind int
+
+const (
+	// hunkText is a hunk of changed lines.
+	hunkText hunkKind = iota
+	// hunkMode is a change of the file's mode.
+	hunkMode
+	// hunkWhole is the creation or the deletion of the whole file.
+	hunkWhole
+)
+
+// patchHunk is a hunk of a file's diff. lines keep their ' ', '-' or
+// '+' prefix, and oldStart and newStart are where the hunk starts on each
+// side, counting from 0.
+type patchHunk struct {
+	kind     hunkKind
+	header   string
+	lines    []string
+	oldStart int
+	newStart int
+	use      hunkUse
+}
+
+// patchFile is a file's diff cut into hunks.
+type patchFile struct {
+	pair   diffPair
+	header []string
+	hunks  []*patchHunk
+}
+
+// patchSession goes through the hunks of a diff, asking which ones to
+// pick.
+type patchSession struct {
+	mode *patchMode
+	cfg  *config
+	in   *bufio.Reader
+	quit bool
+}
+
+// writeHunkLine prints a line of a hunk, marking a missing newline at the
+// end of the file like diffs do.
+func writeHunkLine(w io.Writer, line string) {
+	io.WriteString(w, line)
+	if !strings.HasSuffix(line, "\n") {
+		io.WriteString(w, "\n\\ No newline at end of file\n")
+	}
+}
+
+// countHunkLines returns how many lines a hunk spans on each side.
+func countHunkLines(lines []string) (old, new int) {
+	for _, line := range lines {
+		if line[0] != '+' {
+			old++
+		}
+		if line[0] != '-' {
+			new++
+		}
+	}
+	return old, new
+}
+
+// recountHunk rewrites the header of a hunk that was split or edited.
+func recountHunk(h *patchHunk) {
+	old, new := countHunkLines(h.lines)
+	h.header = fmt.Sprintf("@@ -%s +%s @@\n", hunkRange(h.oldStart, old), hunkRange(h.newStart, new))
+}
+
+// parseHunkStarts reads where a hunk starts on each side from its
+// "@@ -a,b +c,d @@" header.
+func parseHunkStarts(header string) (oldStart, newStart int, err error) {
+	fields := strings.Fields(header)
+	if len(fields) < 3 || !strings.HasPrefix(fields[1], "-") || !strings.HasPrefix(fields[2], "+") {
+		return 0, 0, fmt.Errorf("could not parse hunk header '%s'", strings.TrimSpace(header))
+	}
+	start := func(r string) (int, error) {
+		first, count, hasCount := strings.Cut(r[1:], ",")
+		n, err := strconv.Atoi(first)
+		if err != nil {
+			return 0, fmt.Errorf("could not parse hunk header '%s'", strings.TrimSpace(header))
+		}
+		// Empty ranges name the line before them.
+		if hasCount && count == "0" {
+			return n, nil
+		}
+		return n - 1, nil
+	}
+	if oldStart, err = start(fields[1]); err != nil {
+		return 0, 0, err
+	}
+	newStart, err = start(fields[2])
+	return oldStart, newStart, err
+}
+
+// parsePatchFile cuts the diff of a pair into hunks. Binary files have
+// none.
+func parsePatchFile(p diffPair, opts *diffOptions) (*patchFile, bool, error) {
+	var patch bytes.Buffer
+	if err := writePatch(&patch, p, opts); err != nil {
+		return nil, false, err
+	}
+	f := &patchFile{pair: p}
+	var mode *patchHunk
+	var hunk *patchHunk
+	for _, line := range splitLines(patch.Bytes()) {
+		switch {
+		case hunk == nil && strings.HasPrefix(line, "Binary files "):
+			return nil, false, nil
+		case hunk == nil && (strings.HasPrefix(line, "old mode ") || strings.HasPrefix(line, "new mode ")):
+			if mode == nil {
+				mode = &patchHunk{kind: hunkMode}
+			}
+			mode.lines = append(mode.lines, line)
+		case strings.HasPrefix(line, "@@ "):
+			oldStart, newStart, err := parseHunkStarts(line)
+			if err != nil {
+				return nil, false, err
+			}
+			hunk = &patchHunk{header: line, oldStart: oldStart, newStart: newStart}
+			f.hunks = append(f.hunks, hunk)
+		case hunk == nil:
+			f.header = append(f.header, line)
+		case strings.HasPrefix(line, "\\"):
+			last := &hunk.lines[len(hunk.lines)-1]
+			*last = strings.TrimSuffix(*last, "\n")
+		default:
+			hunk.lines = append(hunk.lines, line)
+		}
+	}
+
+	// Creating or deleting a file is all or nothing.
+	if p.old.mode == 0 || p.new.mode == 0 {
+		whole := &patchHunk{kind: hunkWhole}
+		for _, h := range f.hunks {
+			whole.lines = append(whole.lines, h.header)
+			whole.lines = append(whole.lines, h.lines...)
+		}
+		f.hunks = []*patchHunk{whole}
+	} else if mode != nil {
+		f.hunks = append([]*patchHunk{mode}, f.hunks...)
+	}
+	return f, len(f.hunks) > 0, nil
+}
+
+// applyHunks applies hunks, sorted by position, to the lines of the old
+// side of a diff, or undoes them on the new side if reverse is set. Hunks
+// that were split off the same one can share context lines.
+func applyHunks(base []string, hunks []*patchHunk, reverse bool) ([]byte, error) {
+	from, to := byte('-'), byte('+')
+	if reverse {
+		from, to = to, from
+	}
+	var out strings.Builder
+	pos := 0
+	for _, h := range hunks {
+		i := h.oldStart
+		if reverse {
+			i = h.newStart
+		}
+		for ; pos < i && pos < len(base); pos++ {
+			out.WriteString(base[pos])
+		}
+		for _, line := range h.lines {
+			op, text := line[0], line[1:]
+			switch op {
+			case ' ', from:
+				if i >= len(base) || base[i] != text {
+					return nil, errors.New("patch does not apply")
+				}
+				if op == ' ' && i >= pos {
+					out.WriteString(text)
+				}
+				i++
+			case to:
+				out.WriteString(text)
+			}
+		}
+		pos = max(pos, i)
+	}
+	for ; pos < len(base); pos++ {
+		out.WriteString(base[pos])
+	}
+	return []byte(out.String()), nil
+}
+
+// splitHunk cuts a hunk into hunks of one run of changes each, with all
+// the context around it. It returns nil if the hunk has a single run.
+func splitHunk(h *patchHunk) []*patchHunk {
+	type run struct{ start, end int }
+	var runs []run
+	for i := 0; i < len(h.lines); i++ {
+		if h.lines[i][0] == ' ' {
+			continue
+		}
+		start := i
+		for i < len(h.lines) && h.lines[i][0] != ' ' {
+			i++
+		}
+		runs = append(runs, run{start, i})
+	}
+	if len(runs) < 2 {
+		return nil
+	}
+
+	var hunks []*patchHunk
+	oldPos, newPos, linePos := h.oldStart, h.newStart, 0
+	for n := range runs {
+		start := 0
+		if n > 0 {
+			start = runs[n-1].end
+		}
+		end := len(h.lines)
+		if n+1 < len(runs) {
+			end = runs[n+1].start
+		}
+		// Move to the start of the leading context.
+		for ; linePos < start; linePos++ {
+			if h.lines[linePos][0] != '+' {
+				oldPos++
+			}
+			if h.lines[linePos][0] != '-' {
+				newPos++
+			}
+		}
+		sub := &patchHunk{lines: h.lines[start:end:end], oldStart: oldPos, newStart: newPos}
+		recountHunk(sub)
+		hunks = append(hunks, sub)
+	}
+	return hunks
+}
+
+func (s *patchSession) readAnswer() (string, bool) {
+	line, err := s.in.ReadString('\n')
+	if err != nil && line == "" {
+		return "", false
+	}
+	return strings.TrimSpace(line), true
+}
+
+// editHunk lets the user edit a hunk by hand. It returns the edited hunk,
+// or nil if the edit was abandoned or the edited hunk discarded.
+func (s *patchSession) editHunk(f *patchFile, h *patchHunk) (*patchHunk, error) {
+	removed, added := '-', '+'
+	if s.mode.reverse {
+		removed, added = added, removed
+	}
+	for {
+		var b strings.Builder
+		b.WriteString("# Manual hunk edit mode -- see bottom for a quick guide.\n")
+		b.WriteString(h.header)
+		for _, line := range h.lines {
+			writeHunkLine(&b, line)
+		}
+		fmt.Fprintf(&b, "# ---\n"+
+			"# To remove '%c' lines, make them ' ' lines (context).\n"+
+			"# To remove '%c' lines, delete them.\n"+
+			"# Lines starting with # will be removed.\n", removed, added)
+		fmt.Fprintf(&b, "# If the patch applies cleanly, the edited hunk will immediately be marked for %s.\n"+
+			"# If it does not apply cleanly, you will be given an opportunity to\n"+
+			"# edit again.  If all lines of the hunk are removed, then the edit is\n"+
+			"# aborted and the hunk is left unchanged.\n", s.mode.editing)
+		text, err := editMessage(s.cfg, patchEditFile, b.String())
+		if err != nil {
+			return nil, err
+		}
+
+		edited := &patchHunk{oldStart: h.oldStart, newStart: h.newStart}
+		for _, line := range splitLines([]byte(text)) {
+			switch {
+			case strings.HasPrefix(line, "#"):
+			case strings.HasPrefix(line, "@@ ") && len(edited.lines) == 0:
+			case strings.HasPrefix(line, "\\"):
+				if len(edited.lines) > 0 {
+					last := &edited.lines[len(edited.lines)-1]
+					*last = strings.TrimSuffix(*last, "\n")
+				}
+			case line == "\n":
+				edited.lines = append(edited.lines, " \n")
+			default:
+				edited.lines = append(edited.lines, line)
+			}
+		}
+		if len(edited.lines) == 0 {
+			return nil, nil
+		}
+		applies := true
+		for _, line := range edited.lines {
+			if !strings.ContainsRune(" -+", rune(line[0])) {
+				applies = false
+			}
+		}
+		if applies {
+			base, err := f.baseLines(s.mode.reverse)
+			if err != nil {
+				return nil, err
+			}
+			_, err = applyHunks(base, []*patchHunk{edited}, s.mode.reverse)
+			applies = err == nil
+		}
+		if applies {
+			recountHunk(edited)
+			return edited, nil
+		}
+
+		for {
+			fmt.Print(`Your edited hunk does not apply. Edit again (saying "no" discards!) [y/n]? `)
+			answer, ok := s.readAnswer()
+			if !ok || strings.HasPrefix(strings.ToLower(answer), "n") {
+				return nil, nil
+			}
+			if strings.HasPrefix(strings.ToLower(answer), "y") {
+				break
+			}
+		}
+	}
+}
+
+// baseLines returns the lines of the side of a file that hunks are
+// applied to, the new one if they are undone.
+func (f *patchFile) baseLines(reverse bool) ([]string, error) {
+	side := f.pair.old
+	if reverse {
+		side = f.pair.new
+	}
+	data, err := side.content()
+	if err != nil {
+		return nil, err
+	}
+	return splitLines(data), nil
+}
+
+// pickHunks asks about each hunk of a file until all are decided or the
+// user quits.
+func (s *patchSession) pickHunks(f *patchFile) error {
+	for _, line := range f.header {
+		fmt.Print(line)
+	}
+	index := 0
+	for {
+		if index >= len(f.hunks) {
+			index = 0
+		}
+		h := f.hunks[index]
+		previous, next := -1, -1
+		for i := index - 1; i >= 0; i-- {
+			if f.hunks[i].use == hunkUndecided {
+				previous = i
+				break
+			}
+		}
+		for i := index + 1; i < len(f.hunks); i++ {
+			if f.hunks[i].use == hunkUndecided {
+				next = i
+				break
+			}
+		}
+		if previous < 0 && next < 0 && h.use != hunkUndecided {
+			return nil
+		}
+
+		permitted := ""
+		if previous >= 0 {
+			permitted += "k"
+		}
+		if index > 0 {
+			permitted += "K"
+		}
+		if next >= 0 {
+			permitted += "j"
+		}
+		if index+1 < len(f.hunks) {
+			permitted += "J"
+		}
+		if len(f.hunks) > 1 {
+			permitted += "g/"
+		}
+		if h.kind == hunkText && splitHunk(h) != nil {
+			permitted += "s"
+		}
+		if h.kind == hunkText {
+			permitted += "e"
+		}
+
+		what := "this hunk"
+		switch {
+		case h.kind == hunkMode:
+			what = "mode change"
+		case h.kind == hunkWhole && f.pair.new.mode == 0:
+			what = "deletion"
+		case h.kind == hunkWhole:
+			what = "addition"
+		}
+		if h.kind == hunkText {
+			fmt.Print(h.header)
+		}
+		for _, line := range h.lines {
+			writeHunkLine(os.Stdout, line)
+		}
+		var options strings.Builder
+		for _, c := range permitted {
+			options.WriteString("," + string(c))
+		}
+		fmt.Printf("(%d/%d) %s [y,n,q,a,d%s,?]? ", index+1, len(f.hunks), s.mode.prompt(what), options.String())
+
+		answer, ok := s.readAnswer()
+		if !ok {
+			s.quit = true
+			return nil
+		}
+		if answer == "" {
+			continue
+		}
+		decide := func(use hunkUse) {
+			h.use = use
+			index = len(f.hunks)
+			if next >= 0 {
+				index = next
+			}
+		}
+		switch c := answer[0]; {
+		case c == 'y' || c == 'Y':
+			decide(hunkUsed)
+		case c == 'n' || c == 'N':
+			decide(hunkSkipped)
+		case c == 'a' || c == 'A' || c == 'd' || c == 'D':
+			use := hunkUsed
+			if c == 'd' || c == 'D' {
+				use = hunkSkipped
+			}
+			for ; index < len(f.hunks); index++ {
+				if f.hunks[index].use == hunkUndecided {
+					f.hunks[index].use = use
+				}
+			}
+		case c == 'q' || c == 'Q':
+			s.quit = true
+			return nil
+		case c == 'K':
+			if index > 0 {
+				index--
+			} else {
+				fmt.Println("No previous hunk")
+			}
+		case c == 'J':
+			if index+1 < len(f.hunks) {
+				index++
+			} else {
+				fmt.Println("No next hunk")
+			}
+		case c == 'k':
+			if previous >= 0 {
+				index = previous
+			} else {
+				fmt.Println("No previous hunk")
+			}
+		case c == 'j':
+			if next >= 0 {
+				index = next
+			} else {
+				fmt.Println("No next hunk")
+			}
+		case c == 'g':
+			if !strings.Contains(permitted, "g") {
+				fmt.Println("No other hunks to goto")
+				continue
+			}
+			if index, ok = s.gotoHunk(f, index, strings.TrimSpace(answer[1:])); !ok {
+				s.quit = true
+				return nil
+			}
+		case c == '/':
+			if !strings.Contains(permitted, "/") {
+				fmt.Println("No other hunks to search")
+				continue
+			}
+			if index, ok = s.searchHunk(f, index, answer[1:]); !ok {
+				s.quit = true
+				return nil
+			}
+		case c == 's' || c == 'S':
+			if !strings.Contains(permitted, "s") {
+				fmt.Println("Sorry, cannot split this hunk")
+				continue
+			}
+			split := splitHunk(h)
+			fmt.Printf("Split into %d hunks.\n", len(split))
+			f.hunks = append(f.hunks[:index], append(split, f.hunks[index+1:]...)...)
+		case c == 'e' || c == 'E':
+			if !strings.Contains(permitted, "e") {
+				fmt.Println("Sorry, cannot edit this hunk")
+				continue
+			}
+			edited, err := s.editHunk(f, h)
+			if err != nil {
+				return err
+			}
+			if edited != nil {
+				f.hunks[index] = edited
+				h = edited
+				decide(hunkUsed)
+			}
+		default:
+			s.printHelp(permitted)
+		}
+	}
+}
+
+// summarizeHunk returns the line listing a hunk to go to: its header and
+// first changed line.
+func summarizeHunk(h *patchHunk) string {
+	old, new := countHunkLines(h.lines)
+	// Empty ranges name the line before them.
+	oldStart, newStart := h.oldStart, h.newStart
+	if old > 0 {
+		oldStart++
+	}
+	if new > 0 {
+		newStart++
+	}
+	summary := fmt.Sprintf(" -%d,%d +%d,%d ", oldStart, old, newStart, new)
+	if h.kind != hunkText {
+		summary = " -0,0 +0,0 "
+	}
+	summary = fmt.Sprintf("%-20s", summary)
+	for _, line := range h.lines {
+		if line[0] != ' ' {
+			summary += line
+			break
+		}
+	}
+	if len(summary) > summaryLineWidth {
+		summary = summary[:summaryLineWidth]
+	}
+	return strings.TrimSuffix(summary, "\n") + "\n"
+}
+
+// summaryLineWidth caps the lines listing hunks to go to.
+const summaryLineWidth = 80
+
+// gotoHunk asks which hunk to go to unless the answer named it, listing
+// them 20 at a time. It returns false if the input ended.
+func (s *patchSession) gotoHunk(f *patchFile, index int, answer string) (int, bool) {
+	i := max(index-10, 0)
+	for answer == "" {
+		end := min(i+20, len(f.hunks))
+		for ; i < end; i++ {
+			mark := ' '
+			switch f.hunks[i].use {
+			case hunkUsed:
+				mark = '+'
+			case hunkSkipped:
+				mark = '-'
+			}
+			fmt.Printf("%c%2d: %s", mark, i+1, summarizeHunk(f.hunks[i]))
+		}
+		if i < len(f.hunks) {
+			fmt.Print("go to which hunk (<ret> to see more)? ")
+		} else {
+			fmt.Print("go to which hunk? ")
+		}
+		var ok bool
+		if answer, ok = s.readAnswer(); !ok {
+			return index, false
+		}
+	}
+	n, err := strconv.Atoi(answer)
+	switch {
+	case err != nil:
+		fmt.Printf("Invalid number: '%s'\n", answer)
+	case n < 1 || n > len(f.hunks):
+		fmt.Printf("Sorry, only %d hunks available.\n", len(f.hunks))
+	default:
+		index = n - 1
+	}
+	return index, true
+}
+
+// searchHunk goes to the next hunk matching a regular expression, asking
+// for it unless the answer gave it. It returns false if the input ended.
+func (s *patchSession) searchHunk(f *patchFile, index int, answer string) (int, bool) {
+	if answer == "" {
+		fmt.Print("search for regex? ")
+		var ok bool
+		if answer, ok = s.readAnswer(); !ok {
+			return index, false
+		}
+		if answer == "" {
+			return index, true
+		}
+	}
+	re, err := regexp.Compile("(?m)" + answer)
+	if err != nil {
+		fmt.Printf("Malformed search regexp %s: %v\n", answer, err)
+		return index, true
+	}
+	for i := index; ; {
+		var b strings.Builder
+		b.WriteString(f.hunks[i].header)
+		for _, line := range f.hunks[i].lines {
+			writeHunkLine(&b, line)
+		}
+		if re.MatchString(b.String()) {
+			return i, true
+		}
+		if i = (i + 1) % len(f.hunks); i == index {
+			fmt.Println("No hunk matches the given pattern")
+			return index, true
+		}
+	}
+}
+
+func (s *patchSession) printHelp(permitted string) {
+	verb := s.mode.verb
+	fmt.Printf("y - %s this hunk%s\n", verb, s.mode.where)
+	fmt.Printf("n - do not %s this hunk%s\n", verb, s.mode.where)
+	fmt.Printf("q - quit; do not %s this hunk or any of the remaining ones\n", verb)
+	fmt.Printf("a - %s this hunk and all later hunks in the file\n", verb)
+	fmt.Printf("d - do not %s this hunk or any of the later hunks in the file\n", verb)
+	for _, line := range []string{
+		"j - leave this hunk undecided, see next undecided hunk",
+		"J - leave this hunk undecided, see next hunk",
+		"k - leave this hunk undecided, see previous undecided hunk",
+		"K - leave this hunk undecided, see previous hunk",
+		"g - select a hunk to go to",
+		"/ - search for a hunk matching the given regex",
+		"s - split the current hunk into smaller hunks",
+		"e - manually edit the current hunk",
+	} {
+		if strings.IndexByte(permitted, line[0]) >= 0 {
+			fmt.Println(line)
+		}
+	}
+	fmt.Println("? - print help")
+}
+
+// apply returns the new state of a file once its picked hunks are
+// applied to the old side, or undone on the new side if reverse is set,
+// and false if none were picked.
+func (f *patchFile) apply(reverse bool) (diffEntry, bool, error) {
+	old, new := f.pair.old, f.pair.new
+	if reverse {
+		old, new = new, old
+	}
+	var text []*patchHunk
+	mode, picked := old.mode, false
+	for _, h := range f.hunks {
+		if h.use != hunkUsed {
+			continue
+		}
+		picked = true
+		switch h.kind {
+		case hunkWhole:
+			return new, true, nil
+		case hunkMode:
+			mode = new.mode
+		default:
+			text = append(text, h)
+		}
+	}
+	if !picked {
+		return diffEntry{}, false, nil
+	}
+	base, err := f.baseLines(reverse)
+	if err != nil {
+		return diffEntry{}, false, err
+	}
+	data, err := applyHunks(base, text, reverse)
+	if err != nil {
+		return diffEntry{}, false, fmt.Errorf("could not apply patch to '%s': %w", f.pair.path, err)
+	}
+	return diffEntry{mode: mode, hash: hashObjectData(blobObject, data), data: data}, true, nil
+}
+
+// patchResults returns the new state of the files whose hunks were
+// picked, as given by apply. A zero mode means the file is gone.
+func patchResults(files []*patchFile, reverse bool) (map[string]diffEntry, error) {
+	results := make(map[string]diffEntry)
+	for _, f := range files {
+		file, ok, err := f.apply(reverse)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			results[f.pair.path] = file
+		}
+	}
+	return results, nil
+}
+
+// runPatchSession goes through the hunks of pairs interactively, asking
+// which ones to pick, and returns the files with their decisions.
+func runPatchSession(cfg *config, mode *patchMode, pairs []diffPair) ([]*patchFile, error) {
+	opts, err := configDiffOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var files []*patchFile
+	binary := false
+	for _, p := range pairs {
+		// Submodules and changes of file type cannot be cut into hunks.
+		if p.unmerged || p.old.mode == modeGitlink || p.new.mode == modeGitlink ||
+			p.old.mode != 0 && p.new.mode != 0 && p.old.mode&modeTypeMask != p.new.mode&modeTypeMask {
+			continue
+		}
+		f, ok, err := parsePatchFile(p, opts)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			files = append(files, f)
+		} else {
+			binary = true
+		}
+	}
+	if len(files) == 0 {
+		if binary {
+			fmt.Fprintln(os.Stderr, "Only binary files changed.")
+		} else {
+			fmt.Fprintln(os.Stderr, "No changes.")
+		}
+		return nil, nil
+	}
+
+	s := &patchSession{mode: mode, cfg: cfg, in: bufio.NewReader(os.Stdin)}
+	for _, f := range files {
+		if err := s.pickHunks(f); err != nil {
+			return nil, err
+		}
+		fmt.Println()
+		if s.quit {
+			break
+		}
+	}
+	return files, nil
+}
+
+// runPatchMode runs a patch session and returns what the picked hunks
+// make of the files for the mode.
+func runPatchMode(cfg *config, mode *patchMode, pairs []diffPair) (map[string]diffEntry, error) {
+	files, err := runPatchSession(cfg, mode, pairs)
+	if err != nil {
+		return nil, err
+	}
+	return patchResults(files, mode.reverse)
+}
@@ -0,0 +1,139 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// maxAlternateDepth is how deep alternates may borrow from alternates of
+// their own, as in git.
+const maxAlternateDepth = 5
+
+// alternatesMu guards the object directories borrowed from, which are
+// read on first use.
+var alternatesMu sync.Mutex
+var loadedAlternates []string
+var alternatesLoaded bool
+
+// alternateObjectDirs returns the object directories objects are also
+// read from: those in GIT_ALTERNATE_OBJECT_DIRECTORIES, then those listed
+// in objects/info/alternates, each followed by the ones it borrows from
+// in turn.
+func alternateObjectDirs() []string {
+	alternatesMu.Lock()
+	defer alternatesMu.Unlock()
+	if alternatesLoaded {
+		return loadedAlternates
+	}
+	alternatesLoaded = true
+
+	local, err := filepath.Abs(objDir)
+	if err != nil {
+		return nil
+	}
+	seen := map[string]bool{local: true}
+	var dirs []string
+	var add func(entries []string, base string, depth int)
+	add = func(entries []string, base string, depth int) {
+		for _, entry := range entries {
+			if entry == "" || entry[0] == '#' {
+				continue
+			}
+			dir := filepath.Clean(entry)
+			if !filepath.IsAbs(dir) {
+				dir = filepath.Join(base, dir)
+			}
+			if seen[dir] {
+				continue
+			}
+			if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+				fmt.Fprintf(os.Stderr, "error: object directory %s does not exist; check .git/objects/info/alternates\n", dir)
+				continue
+			}
+			seen[dir] = true
+			dirs = append(dirs, dir)
+			if depth >= maxAlternateDepth {
+				fmt.Fprintf(os.Stderr, "error: %s: ignoring alternate object stores, nesting too deep\n", dir)
+				continue
+			}
+			add(readAlternatesFile(dir), dir, depth+1)
+		}
+	}
+
+	if env := os.Getenv("GIT_ALTERNATE_OBJECT_DIRECTORIES"); env != "" {
+		cwd, _ := os.Getwd()
+		add(filepath.SplitList(env), cwd, 1)
+	}
+	add(readAlternatesFile(local), local, 1)
+	loadedAlternates = dirs
+	return dirs
+}
+
+// readAlternatesFile returns the lines of the alternates file of the
+// object directory dir.
+func readAlternatesFile(dir string) []string {
+	data, err := os.ReadFile(filepath.Join(dir, "info", "alternates"))
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: unable to read alternates file: %v\n", err)
+		}
+		return nil
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+}
+
+// reloadAlternates forgets the alternates read so far, e.g. after the
+// object directory moved.
+func reloadAlternates() {
+	alternatesMu.Lock()
+	defer alternatesMu.Unlock()
+	loadedAlternates, alternatesLoaded = nil, false
+}
+
+// looseObjectPath returns the path of the loose object hash: the local one
+// unless only an alternate has it.
+func looseObjectPath(hash objectID) string {
+	path := objectPath(hash)
+	if _, err := os.Stat(path); err == nil {
+		return path
+	}
+	hexHash := hash.String()
+	for _, dir := range alternateObjectDirs() {
+		alt := filepath.Join(dir, hexHash[:2], hexHash[2:])
+		if _, err := os.Stat(alt); err == nil {
+			return alt
+		}
+	}
+	return path
+}
+
+// addAlternate records dir as an object directory to borrow objects from.
+func addAlternate(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(abs); err != nil || !fi.IsDir() {
+		return fmt.Errorf("object directory %s does not exist", abs)
+	}
+	path := filepath.Join(objDir, "info", "alternates")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open alternates file: %w", err)
+	}
+	defer f.Close()
+	if _, err := fmt.Fprintln(f, abs); err != nil {
+		return fmt.Errorf("failed to write alternates file: %w", err)
+	}
+	reloadAlternates()
+	reloadPacks()
+	return nil
+}
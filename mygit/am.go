@@ -0,0 +1,529 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// amDir keeps the mails of an am session in progress, one numbered file
+// each, with the number of the next one to apply and of the last one.
+var amDir = ".git/rebase-apply"
+
+func amFile(name string) string {
+	return filepath.Join(amDir, name)
+}
+
+// mailPatch is what a mail carries: the commit message and author, and
+// the patch itself.
+type mailPatch struct {
+	author  string
+	message string
+	patch   []byte
+}
+
+// isMboxFromLine reports whether line starts a message of a mailbox. Mail
+// bodies may well start lines with "From ", so like git this requires the
+// time of day that mailbox separators end with.
+func isMboxFromLine(line string) bool {
+	return strings.HasPrefix(line, "From ") && strings.Count(line, ":") >= 2
+}
+
+// splitMailbox splits a mailbox into its messages, without their "From "
+// separator lines. Input that does not start with one is a single mail.
+func splitMailbox(data []byte) [][]byte {
+	var mails [][]byte
+	var cur []byte
+	started := false
+	for _, line := range splitLines(data) {
+		if isMboxFromLine(line) {
+			if started {
+				mails = append(mails, cur)
+			}
+			cur, started = nil, true
+			continue
+		}
+		cur = append(cur, line...)
+	}
+	if started || len(bytes.TrimSpace(cur)) > 0 {
+		mails = append(mails, cur)
+	}
+	return mails
+}
+
+// cleanSubject drops what mailers and format-patch put before the subject
+// of a patch: "Re:" and bracketed tags such as "[PATCH 1/2]".
+func cleanSubject(subject string) string {
+	for {
+		subject = strings.TrimSpace(subject)
+		switch {
+		case len(subject) >= 3 && strings.EqualFold(subject[:3], "re:"):
+			subject = subject[3:]
+		case strings.HasPrefix(subject, "["):
+			end := strings.IndexByte(subject, ']')
+			if end < 0 {
+				return subject
+			}
+			subject = subject[end+1:]
+		default:
+			return strings.Join(strings.Fields(subject), " ")
+		}
+	}
+}
+
+// isPatchStart reports whether a line of a mail body ends the message and
+// starts the patch.
+func isPatchStart(line string) bool {
+	return strings.TrimSpace(strings.TrimPrefix(line, "---")) == "" && strings.HasPrefix(line, "---") ||
+		strings.HasPrefix(line, "diff -") || strings.HasPrefix(line, "Index: ")
+}
+
+// parseMail reads the author, the message and the patch of a mail.
+func parseMail(data []byte) (*mailPatch, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse mail: %w", err)
+	}
+	from, err := mail.ParseAddress(msg.Header.Get("From"))
+	if err != nil {
+		return nil, fmt.Errorf("Patch does not have a valid e-mail address.")
+	}
+	when := time.Now()
+	if date := msg.Header.Get("Date"); date != "" {
+		if when, err = mail.ParseDate(date); err != nil {
+			return nil, fmt.Errorf("invalid date %q", date)
+		}
+	}
+	subject := msg.Header.Get("Subject")
+	if decoded, err := new(mime.WordDecoder).DecodeHeader(subject); err == nil {
+		subject = decoded
+	}
+
+	body := msg.Body
+	switch strings.ToLower(msg.Header.Get("Content-Transfer-Encoding")) {
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	}
+	content, err := io.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode mail: %w", err)
+	}
+
+	var text strings.Builder
+	lines := splitLines(content)
+	i := 0
+	for ; i < len(lines) && !isPatchStart(lines[i]); i++ {
+		text.WriteString(lines[i])
+	}
+	var patch []byte
+	for _, line := range lines[i:] {
+		patch = append(patch, line...)
+	}
+
+	message := cleanSubject(subject) + "\n"
+	if rest := strings.TrimSpace(text.String()); rest != "" {
+		message += "\n" + rest + "\n"
+	}
+	return &mailPatch{
+		author:  fmt.Sprintf("%s <%s> %s", from.Name, from.Address, formatIdentDate(when)),
+		message: cleanupMessage(message, false),
+		patch:   patch,
+	}, nil
+}
+
+// amState is where an am session stands: the number of the next mail to
+// apply and of the last one.
+type amState struct {
+	next, last int
+}
+
+func readAmState() (*amState, error) {
+	s := &amState{}
+	for name, value := range map[string]*int{"next": &s.next, "last": &s.last} {
+		data, err := os.ReadFile(amFile(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read am state: %w", err)
+		}
+		if *value, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil {
+			return nil, fmt.Errorf("invalid am state in %s", amFile(name))
+		}
+	}
+	return s, nil
+}
+
+// advance moves on to the next mail.
+func (s *amState) advance() error {
+	s.next++
+	if err := os.WriteFile(amFile("next"), []byte(fmt.Sprintf("%d\n", s.next)), 0644); err != nil {
+		return fmt.Errorf("failed to write am state: %w", err)
+	}
+	return nil
+}
+
+// run applies the mails left and ends the session.
+func (s *amState) run(cfg *config) error {
+	for s.next <= s.last {
+		if err := s.apply(cfg); err != nil {
+			return err
+		}
+		if err := s.advance(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(amDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", amDir, err)
+	}
+	return nil
+}
+
+// apply applies the patch of the next mail to the index and the working
+// tree and commits it. What continuing needs to commit it is recorded
+// first, in case it does not apply.
+func (s *amState) apply(cfg *config) error {
+	data, err := os.ReadFile(amFile(fmt.Sprintf("%04d", s.next)))
+	if err != nil {
+		return fmt.Errorf("failed to read am state: %w", err)
+	}
+	m, err := parseMail(data)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(amFile("msg"), []byte(m.message), 0644); err != nil {
+		return fmt.Errorf("failed to write am state: %w", err)
+	}
+	if err := writeAuthorScript(amFile("author-script"), m.author); err != nil {
+		return err
+	}
+	subject := commitSubject(m.message)
+	fmt.Printf("Applying: %s\n", subject)
+
+	patches, err := parsePatch(m.patch)
+	if err != nil {
+		return err
+	}
+	if len(patches) == 0 {
+		s.stop(subject, "Patch is empty.", nil)
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	if err := checkIndexMatches(cfg, entries, patches); err != nil {
+		s.stop(subject, "", err)
+	}
+	indexed, _ := indexFiles(entries)
+	results, err := applyPatches(patches, indexed, "index", &applyOptions{minContext: -1})
+	if err != nil {
+		s.stop(subject, "", err)
+	}
+
+	updates := make(map[string]pathUpdate)
+	for path, file := range results {
+		if file.mode != 0 {
+			if _, err := storeObject(blobObject, file.data); err != nil {
+				return err
+			}
+			indexed[path] = file
+		} else {
+			delete(indexed, path)
+		}
+		updates[path] = pathUpdate{file: file}
+	}
+	if entries, err = applyUpdates(entries, updates); err != nil {
+		return err
+	}
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+	return commitMail(cfg, indexed, m.author, m.message)
+}
+
+// commitMail commits files on top of HEAD with the author and message of
+// a mail.
+func commitMail(cfg *config, files map[string]diffEntry, author, message string) error {
+	head, err := resolveRef("HEAD")
+	if err != nil && !errors.Is(err, errRefNotFound) {
+		return err
+	}
+	var parents []objectID
+	if head != (objectID{}) {
+		parents = []objectID{head}
+	}
+	committer, err := identity(cfg, "committer")
+	if err != nil {
+		return err
+	}
+	tree, err := writeFilesTree(files)
+	if err != nil {
+		return err
+	}
+	hash, err := storeObject(commitObject, serializeCommit(&commit{
+		tree:      tree,
+		parents:   parents,
+		author:    author,
+		committer: committer,
+		message:   message,
+	}))
+	if err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	tx.updateFrom("HEAD", head, hash, "am: "+commitSubject(message))
+	return tx.commit()
+}
+
+// stop leaves the mail that did not apply for the user to deal with,
+// saying why with problem, or err.
+func (s *amState) stop(subject, problem string, err error) {
+	if err != nil {
+		for _, line := range strings.Split(err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "error: %s\n", line)
+		}
+	}
+	if problem != "" {
+		fmt.Println(problem)
+	} else {
+		fmt.Printf("Patch failed at %04d %s\n", s.next, subject)
+	}
+	fmt.Println(`When you have resolved this problem, run "mygit am --continue".`)
+	fmt.Println(`If you prefer to skip this patch, run "mygit am --skip" instead.`)
+	fmt.Println(`To restore the original branch and stop patching, run "mygit am --abort".`)
+	os.Exit(1)
+}
+
+// continueAm commits what the user staged for the mail the session stopped
+// at and applies the rest.
+func (s *amState) continueAm(cfg *config) error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	indexed, unmerged := indexFiles(entries)
+	if len(unmerged) > 0 {
+		return fmt.Errorf("You still have unmerged paths in your index.\nYou should 'mygit add' each file with resolved conflicts to mark them as such.")
+	}
+	head, err := headFiles()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(amFile("msg"))
+	if err != nil {
+		return fmt.Errorf("failed to read am state: %w", err)
+	}
+	message := string(data)
+	subject := commitSubject(message)
+	fmt.Printf("Applying: %s\n", subject)
+	if len(diffFiles(head, indexed, nil, nil)) == 0 {
+		s.stop(subject, "No changes - did you forget to use 'mygit add'?\n"+
+			"If there is nothing left to stage, chances are that something else\n"+
+			"already introduced the same changes; you might want to skip this patch.", nil)
+	}
+	author, err := readAuthorScript(amFile("author-script"))
+	if err != nil {
+		return err
+	}
+	if err := commitMail(cfg, indexed, author, message); err != nil {
+		return err
+	}
+	if err := s.advance(); err != nil {
+		return err
+	}
+	return s.run(cfg)
+}
+
+// skip drops the mail the session stopped at and applies the rest.
+func (s *amState) skip(cfg *config) error {
+	head, err := headFiles()
+	if err != nil {
+		return err
+	}
+	if err := resetWorktree(cfg, head); err != nil {
+		return err
+	}
+	if err := s.advance(); err != nil {
+		return err
+	}
+	return s.run(cfg)
+}
+
+// abortAm returns HEAD, the index and the working tree to where they were
+// before the session.
+func abortAm(cfg *config) error {
+	data, err := os.ReadFile(amFile("orig-head"))
+	if err != nil {
+		return fmt.Errorf("failed to read am state: %w", err)
+	}
+	files := map[string]diffEntry{}
+	var orig objectID
+	if value := strings.TrimSpace(string(data)); value != "" {
+		if orig, err = parseHash(value); err != nil {
+			return fmt.Errorf("invalid am state in %s", amFile("orig-head"))
+		}
+		if files, err = commitFiles(orig); err != nil {
+			return err
+		}
+	}
+	if err := resetWorktree(cfg, files); err != nil {
+		return err
+	}
+
+	tx := newRefTransaction()
+	if orig != (objectID{}) {
+		tx.update("HEAD", orig, "am --abort")
+	} else if _, err := resolveRef("HEAD"); err == nil {
+		// The session started on an unborn branch, which it is again.
+		branch, err := symrefTarget("HEAD")
+		if err != nil {
+			return err
+		}
+		tx.delete(branch)
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(amDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", amDir, err)
+	}
+	return nil
+}
+
+// startAm records the mails of the mailboxes in amDir, and where HEAD is
+// for aborting, refusing to start over staged changes.
+func startAm(cfg *config, mailboxes []string) (*amState, error) {
+	var mails [][]byte
+	for _, name := range mailboxes {
+		var data []byte
+		var err error
+		if name == "-" {
+			data, err = io.ReadAll(bufio.NewReader(os.Stdin))
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not open mailbox '%s': %w", name, err)
+		}
+		mails = append(mails, splitMailbox(data)...)
+	}
+	if len(mails) == 0 {
+		return nil, fmt.Errorf("empty mailbox")
+	}
+
+	head, err := resolveRef("HEAD")
+	if err != nil && !errors.Is(err, errRefNotFound) {
+		return nil, err
+	}
+	committed, err := headFiles()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	indexed, unmerged := indexFiles(entries)
+	var dirty []string
+	for _, p := range diffFiles(committed, indexed, nil, nil) {
+		dirty = append(dirty, p.path)
+	}
+	for path := range unmerged {
+		dirty = append(dirty, path)
+	}
+	if len(dirty) > 0 {
+		return nil, fmt.Errorf("Dirty index: cannot apply patches (dirty: %s)", strings.Join(dirty, " "))
+	}
+
+	if err := os.MkdirAll(amDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", amDir, err)
+	}
+	origHead := ""
+	if head != (objectID{}) {
+		origHead = head.String()
+		if err := writeOrigHead(head); err != nil {
+			return nil, err
+		}
+	}
+	files := map[string]string{
+		"orig-head": origHead + "\n",
+		"next":      "1\n",
+		"last":      fmt.Sprintf("%d\n", len(mails)),
+	}
+	for i, m := range mails {
+		files[fmt.Sprintf("%04d", i+1)] = string(m)
+	}
+	for name, content := range files {
+		if err := os.WriteFile(amFile(name), []byte(content), 0644); err != nil {
+			return nil, fmt.Errorf("failed to write am state: %w", err)
+		}
+	}
+	return &amState{next: 1, last: len(mails)}, nil
+}
+
+func runAm(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	var action string
+	var mailboxes []string
+	for _, arg := range args {
+		switch {
+		case arg == "--continue" || arg == "-r" || arg == "--resolved":
+			action = "--continue"
+		case arg == "--skip" || arg == "--abort":
+			action = arg
+		case arg != "-" && strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			mailboxes = append(mailboxes, arg)
+		}
+	}
+
+	_, err = os.Stat(amDir)
+	inProgress := !errors.Is(err, fs.ErrNotExist)
+	if action == "" {
+		if inProgress {
+			return fmt.Errorf("previous rebase directory %s still exists but mbox given.", amDir)
+		}
+		if len(mailboxes) == 0 {
+			mailboxes = []string{"-"}
+		}
+		s, err := startAm(cfg, mailboxes)
+		if err != nil {
+			return err
+		}
+		return s.run(cfg)
+	}
+
+	if len(mailboxes) > 0 {
+		return fmt.Errorf("%s takes no mailboxes", action)
+	}
+	if !inProgress {
+		return fmt.Errorf("Resolve operation not in progress, we are not resuming.")
+	}
+	if action == "--abort" {
+		return abortAm(cfg)
+	}
+	s, err := readAmState()
+	if err != nil {
+		return err
+	}
+	if action == "--skip" {
+		return s.skip(cfg)
+	}
+	return s.continueAm(cfg)
+}
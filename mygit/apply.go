@@ -0,0 +1,693 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// filePatch is the change a patch makes to one file. For a created file
+// only newPath counts, and for a deleted one only oldPath; both are set
+// and differ for renames and copies. Zero modes are left as they are.
+type filePatch struct {
+	oldPath, newPath string
+	oldMode, newMode uint32
+	isNew, isDelete  bool
+	isCopy           bool
+	binary           bool
+	hunks            []*patchHunk
+}
+
+// hunkLengths reads how many lines a hunk spans on each side from its
+// "@@ -a,b +c,d @@" header; a missing count means one line.
+func hunkLengths(header string) (old, new int, err error) {
+	fields := strings.Fields(header)
+	length := func(r string) (int, error) {
+		_, count, ok := strings.Cut(r, ",")
+		if !ok {
+			return 1, nil
+		}
+		return strconv.Atoi(count)
+	}
+	if old, err = length(fields[1]); err != nil {
+		return 0, 0, fmt.Errorf("could not parse hunk header '%s'", strings.TrimSpace(header))
+	}
+	if new, err = length(fields[2]); err != nil {
+		return 0, 0, fmt.Errorf("could not parse hunk header '%s'", strings.TrimSpace(header))
+	}
+	return old, new, nil
+}
+
+// patchPath reads a path of a "---" or "+++" line, without its leading
+// directory; "" stands for /dev/null.
+func patchPath(name string) string {
+	// Traditional diffs may follow the name with a timestamp.
+	name, _, _ = strings.Cut(strings.TrimSuffix(name, "\n"), "\t")
+	if name == "/dev/null" {
+		return ""
+	}
+	if unquoted, err := strconv.Unquote(name); err == nil {
+		name = unquoted
+	}
+	if _, rest, ok := strings.Cut(name, "/"); ok {
+		return rest
+	}
+	return name
+}
+
+// gitDiffPaths reads the paths of a "diff --git a/<old> b/<new>" line. The
+// names are told apart by trying each " b/" in turn for one that makes
+// them equal, since only renames change them and those say so again.
+func gitDiffPaths(line string) (string, string) {
+	rest := strings.TrimSuffix(strings.TrimPrefix(line, "diff --git "), "\n")
+	if strings.HasPrefix(rest, `"`) {
+		if end := strings.Index(rest[1:], `" `); end >= 0 {
+			return patchPath(rest[:end+2]), patchPath(strings.TrimSpace(rest[end+2:]))
+		}
+	}
+	first := -1
+	for i := 0; i+3 < len(rest); i++ {
+		if rest[i:i+3] != " b/" {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		if old, new := patchPath(rest[:i]), patchPath(rest[i+1:]); old == new {
+			return old, new
+		}
+	}
+	if first < 0 {
+		return "", ""
+	}
+	return patchPath(rest[:first]), patchPath(rest[first+1:])
+}
+
+// parseMode reads an octal file mode from the end of a header line.
+func parseMode(line, prefix string) (uint32, error) {
+	value := strings.TrimSpace(strings.TrimPrefix(line, prefix))
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid mode on line '%s'", strings.TrimSpace(line))
+	}
+	return uint32(mode), nil
+}
+
+// parsePatch reads the file patches of a unified diff, as written by diff
+// or git diff. Lines outside of them, such as the message of a mail, are
+// skipped.
+func parsePatch(data []byte) ([]*filePatch, error) {
+	lines := splitLines(data)
+	var patches []*filePatch
+	var cur *filePatch
+	// header is set while reading the extended header lines of a git diff.
+	header := false
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		var err error
+		switch {
+		case strings.HasPrefix(line, "diff --git "):
+			cur = &filePatch{}
+			cur.oldPath, cur.newPath = gitDiffPaths(line)
+			patches = append(patches, cur)
+			header = true
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			if !header {
+				cur = &filePatch{}
+				patches = append(patches, cur)
+			}
+			oldPath, newPath := patchPath(line[4:]), patchPath(lines[i+1][4:])
+			switch {
+			case oldPath == "":
+				cur.isNew, cur.newPath = true, newPath
+			case newPath == "":
+				cur.isDelete, cur.oldPath = true, oldPath
+			default:
+				cur.oldPath, cur.newPath = oldPath, newPath
+			}
+			header = false
+			i++
+		case strings.HasPrefix(line, "@@ ") && cur != nil:
+			var hunk *patchHunk
+			if hunk, i, err = parseHunk(lines, i); err != nil {
+				return nil, err
+			}
+			cur.hunks = append(cur.hunks, hunk)
+			header = false
+		case !header:
+		case strings.HasPrefix(line, "new file mode "):
+			cur.isNew = true
+			cur.newMode, err = parseMode(line, "new file mode ")
+		case strings.HasPrefix(line, "deleted file mode "):
+			cur.isDelete = true
+			cur.oldMode, err = parseMode(line, "deleted file mode ")
+		case strings.HasPrefix(line, "old mode "):
+			cur.oldMode, err = parseMode(line, "old mode ")
+		case strings.HasPrefix(line, "new mode "):
+			cur.newMode, err = parseMode(line, "new mode ")
+		case strings.HasPrefix(line, "rename from "), strings.HasPrefix(line, "copy from "):
+			_, name, _ := strings.Cut(line, " from ")
+			cur.oldPath = patchPath("a/" + name)
+			cur.isCopy = strings.HasPrefix(line, "copy ")
+		case strings.HasPrefix(line, "rename to "), strings.HasPrefix(line, "copy to "):
+			_, name, _ := strings.Cut(line, " to ")
+			cur.newPath = patchPath("b/" + name)
+		case strings.HasPrefix(line, "index "):
+			fields := strings.Fields(line)
+			if len(fields) == 3 && cur.oldMode == 0 && cur.newMode == 0 {
+				cur.oldMode, err = parseMode(fields[2], "")
+				cur.newMode = cur.oldMode
+			}
+		case strings.HasPrefix(line, "similarity index "), strings.HasPrefix(line, "dissimilarity index "):
+		case strings.HasPrefix(line, "Binary files "), strings.HasPrefix(line, "GIT binary patch"):
+			cur.binary = true
+		default:
+			header = false
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, p := range patches {
+		if p.isNew {
+			p.oldPath = ""
+		}
+		if p.isDelete {
+			p.newPath = ""
+		}
+		if p.oldPath == "" && p.newPath == "" {
+			return nil, fmt.Errorf("git diff header lacks filename information")
+		}
+	}
+	return patches, nil
+}
+
+// parseHunk reads the hunk whose header is lines[i], up to the number of
+// lines the header gives, and returns it with the index of its last line.
+func parseHunk(lines []string, i int) (*patchHunk, int, error) {
+	oldStart, newStart, err := parseHunkStarts(lines[i])
+	if err != nil {
+		return nil, i, err
+	}
+	oldLeft, newLeft, err := hunkLengths(lines[i])
+	if err != nil {
+		return nil, i, err
+	}
+	h := &patchHunk{header: lines[i], oldStart: oldStart, newStart: newStart}
+	for oldLeft > 0 || newLeft > 0 {
+		i++
+		if i >= len(lines) {
+			return nil, i, fmt.Errorf("corrupt patch at line %d", i)
+		}
+		line := lines[i]
+		// Mailers may strip the space of empty context lines.
+		if line == "\n" {
+			line = " \n"
+		}
+		switch line[0] {
+		case ' ':
+			oldLeft--
+			newLeft--
+		case '-':
+			oldLeft--
+		case '+':
+			newLeft--
+		case '\\':
+			if len(h.lines) > 0 {
+				last := &h.lines[len(h.lines)-1]
+				*last = strings.TrimSuffix(*last, "\n")
+			}
+			continue
+		default:
+			return nil, i, fmt.Errorf("corrupt patch at line %d", i+1)
+		}
+		if oldLeft < 0 || newLeft < 0 {
+			return nil, i, fmt.Errorf("corrupt patch at line %d", i+1)
+		}
+		h.lines = append(h.lines, line)
+	}
+	if i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\\") && len(h.lines) > 0 {
+		i++
+		last := &h.lines[len(h.lines)-1]
+		*last = strings.TrimSuffix(*last, "\n")
+	}
+	return h, i, nil
+}
+
+// findHunk returns where the lines a hunk expects first match lines at or
+// after pos, searching outwards from want, or -1. A hunk starting at the
+// top must match there and one without trailing context at the end.
+func findHunk(lines, pre []string, want, pos int, atStart, atEnd bool) int {
+	matches := func(at int) bool {
+		if at < pos || at+len(pre) > len(lines) {
+			return false
+		}
+		if atStart && at != 0 || atEnd && at+len(pre) != len(lines) {
+			return false
+		}
+		for i, line := range pre {
+			if lines[at+i] != line {
+				return false
+			}
+		}
+		return true
+	}
+	for d := 0; want-d >= pos || want+d+len(pre) <= len(lines); d++ {
+		if matches(want - d) {
+			return want - d
+		}
+		if d > 0 && matches(want+d) {
+			return want + d
+		}
+	}
+	return -1
+}
+
+// applyOptions control how strictly patches must match what they apply
+// to.
+type applyOptions struct {
+	// minContext is how few lines of context around a hunk may still be
+	// matched when its full context does not; -1 requires all of it.
+	minContext int
+	// verbose reports where each hunk applied.
+	verbose bool
+}
+
+// hunkPath names the file a patch applies to in messages.
+func (p *filePatch) hunkPath() string {
+	if p.oldPath != "" {
+		return p.oldPath
+	}
+	return p.newPath
+}
+
+// displayName names the file a patch changes, or both of them for a
+// rename or a copy.
+func (p *filePatch) displayName() string {
+	if p.oldPath != "" && p.newPath != "" && p.oldPath != p.newPath {
+		return p.oldPath + " => " + p.newPath
+	}
+	return p.hunkPath()
+}
+
+// applyFileHunks applies the hunks of a file patch to the content of the
+// file. Hunks may have moved; unless opts asks for all of it, they may
+// also be applied with less of their context, dropped from the outside in
+// like git does.
+func applyFileHunks(data []byte, p *filePatch, opts *applyOptions) ([]byte, error) {
+	lines := splitLines(data)
+	var out strings.Builder
+	pos, offset := 0, 0
+	for n, h := range p.hunks {
+		var pre, post []string
+		leading, trailing := 0, 0
+		changed := false
+		for _, line := range h.lines {
+			switch line[0] {
+			case ' ':
+				pre = append(pre, line[1:])
+				post = append(post, line[1:])
+				if !changed {
+					leading++
+				}
+				trailing++
+			case '-':
+				pre = append(pre, line[1:])
+				changed, trailing = true, 0
+			case '+':
+				post = append(post, line[1:])
+				changed, trailing = true, 0
+			}
+		}
+
+		start := h.oldStart
+		atStart, atEnd := h.oldStart == 0, trailing == 0 && len(pre) > 0
+		at, reduced := -1, false
+		for {
+			if at = findHunk(lines, pre, start+offset, pos, atStart, atEnd); at >= 0 {
+				break
+			}
+			if opts.minContext < 0 || leading <= opts.minContext && trailing <= opts.minContext {
+				break
+			}
+			if atStart || atEnd {
+				atStart, atEnd = false, false
+				continue
+			}
+			reduced = true
+			if leading >= trailing {
+				pre, post = pre[1:], post[1:]
+				start++
+				leading--
+			}
+			if trailing > leading {
+				pre, post = pre[:len(pre)-1], post[:len(post)-1]
+				trailing--
+			}
+		}
+		if at < 0 {
+			if opts.verbose {
+				fmt.Fprintf(os.Stderr, "error: while searching for:\n%s", strings.Join(pre, ""))
+			}
+			return nil, fmt.Errorf("patch failed: %s:%d\n%s: patch does not apply", p.hunkPath(), h.oldStart+1, p.hunkPath())
+		}
+		if at != start && opts.verbose {
+			fmt.Fprintf(os.Stderr, "Hunk #%d succeeded at %d (offset %d lines).\n", n+1, at+1, at-start)
+		}
+		if reduced {
+			fmt.Fprintf(os.Stderr, "Context reduced to (%d/%d) to apply fragment at %d\n", leading, trailing, at+1)
+		}
+		for _, line := range lines[pos:at] {
+			out.WriteString(line)
+		}
+		for _, line := range post {
+			out.WriteString(line)
+		}
+		pos, offset = at+len(pre), at-start
+	}
+	for _, line := range lines[pos:] {
+		out.WriteString(line)
+	}
+	return []byte(out.String()), nil
+}
+
+// applyPatches works out what patches make of files, the state of the
+// tree they apply to by path, which where names in messages. It returns
+// the new state of every path they touch, a zero mode for removed files.
+func applyPatches(patches []*filePatch, files map[string]diffEntry, where string, opts *applyOptions) (map[string]diffEntry, error) {
+	results := make(map[string]diffEntry)
+	lookup := func(path string) (diffEntry, bool) {
+		if f, ok := results[path]; ok {
+			return f, f.mode != 0
+		}
+		f, ok := files[path]
+		return f, ok
+	}
+	for _, p := range patches {
+		path := p.newPath
+		if path == "" {
+			path = p.oldPath
+		}
+		if opts.verbose {
+			fmt.Fprintf(os.Stderr, "Checking patch %s...\n", p.displayName())
+		}
+		if p.binary {
+			return nil, fmt.Errorf("cannot apply binary patch to '%s' without full index line", path)
+		}
+		var old diffEntry
+		if p.isNew {
+			if _, ok := lookup(p.newPath); ok {
+				return nil, fmt.Errorf("%s: already exists in %s", p.newPath, where)
+			}
+		} else {
+			var ok bool
+			if old, ok = lookup(p.oldPath); !ok {
+				return nil, fmt.Errorf("%s: does not exist in %s", p.oldPath, where)
+			}
+		}
+		if !p.isNew && p.oldPath != p.newPath && !p.isCopy && p.newPath != "" {
+			if _, ok := lookup(p.newPath); ok {
+				return nil, fmt.Errorf("%s: already exists in %s", p.newPath, where)
+			}
+		}
+
+		data, err := old.content()
+		if err != nil {
+			return nil, err
+		}
+		if data, err = applyFileHunks(data, p, opts); err != nil {
+			return nil, err
+		}
+		if p.isDelete {
+			if len(data) > 0 {
+				return nil, fmt.Errorf("removal patch leaves file contents")
+			}
+			results[p.oldPath] = diffEntry{}
+			continue
+		}
+		mode := p.newMode
+		if mode == 0 {
+			mode = old.mode
+		}
+		if mode == 0 {
+			mode = modeRegular
+		}
+		if !p.isNew && !p.isCopy && p.oldPath != p.newPath {
+			results[p.oldPath] = diffEntry{}
+		}
+		results[p.newPath] = diffEntry{mode: mode, hash: hashObjectData(blobObject, data), data: data}
+	}
+	return results, nil
+}
+
+// reverse turns a file patch around, so that it undoes its change.
+func (p *filePatch) reverse() {
+	p.oldPath, p.newPath = p.newPath, p.oldPath
+	p.oldMode, p.newMode = p.newMode, p.oldMode
+	p.isNew, p.isDelete = p.isDelete, p.isNew
+	for _, h := range p.hunks {
+		h.oldStart, h.newStart = h.newStart, h.oldStart
+		for i, line := range h.lines {
+			switch line[0] {
+			case '-':
+				h.lines[i] = "+" + line[1:]
+			case '+':
+				h.lines[i] = "-" + line[1:]
+			}
+		}
+	}
+}
+
+// checkIndexMatches refuses to apply patches to index entries whose
+// working tree files have changes, which writing both would lose.
+func checkIndexMatches(cfg *config, entries []indexEntry, patches []*filePatch) error {
+	indexed, _ := indexFiles(entries)
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return err
+	}
+	for _, p := range patches {
+		for _, path := range []string{p.oldPath, p.newPath} {
+			if f, ok := indexed[path]; ok && !sameFile(f, work[path]) {
+				return fmt.Errorf("%s: does not match index", path)
+			}
+		}
+	}
+	return nil
+}
+
+// worktreePatchFiles reads the working tree files that patches touch, as
+// they would be added to the index.
+func worktreePatchFiles(patches []*filePatch) (map[string]diffEntry, error) {
+	files := make(map[string]diffEntry)
+	for _, p := range patches {
+		for _, path := range []string{p.oldPath, p.newPath} {
+			if _, ok := files[path]; ok || path == "" {
+				continue
+			}
+			fi, err := os.Lstat(path)
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+				continue
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+			}
+			mode := worktreeMode(fi)
+			var data []byte
+			switch mode {
+			case modeGitlink:
+				return nil, fmt.Errorf("%s: is a directory", path)
+			case modeSymlink:
+				target, err := os.Readlink(path)
+				if err != nil {
+					return nil, fmt.Errorf("failed to read %s: %w", path, err)
+				}
+				data = []byte(target)
+			default:
+				if data, err = os.ReadFile(path); err != nil {
+					return nil, fmt.Errorf("failed to read %s: %w", path, err)
+				}
+				if data, err = convertToGit(path, data); err != nil {
+					return nil, err
+				}
+			}
+			files[path] = diffEntry{mode: mode, hash: hashObjectData(blobObject, data), data: data}
+		}
+	}
+	return files, nil
+}
+
+func runApply(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	opts := applyOptions{minContext: -1}
+	check, cached, index, reverse := false, false, false, false
+	var inputs []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--check":
+			check = true
+		case arg == "--cached":
+			cached = true
+		case arg == "--index":
+			index = true
+		case arg == "-R" || arg == "--reverse":
+			reverse = true
+		case arg == "-v" || arg == "--verbose":
+			opts.verbose = true
+		case arg == "-C":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			if opts.minContext, err = strconv.Atoi(args[i]); err != nil || opts.minContext < 0 {
+				return fmt.Errorf("-C expects a non-negative number")
+			}
+		case strings.HasPrefix(arg, "-C"):
+			if opts.minContext, err = strconv.Atoi(arg[2:]); err != nil || opts.minContext < 0 {
+				return fmt.Errorf("-C expects a non-negative number")
+			}
+		case arg != "-" && strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			inputs = append(inputs, arg)
+		}
+	}
+	if cached && index {
+		return fmt.Errorf("options '--cached' and '--index' cannot be used together")
+	}
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
+	}
+
+	var patches []*filePatch
+	for _, name := range inputs {
+		var data []byte
+		if name == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(name)
+		}
+		if err != nil {
+			return fmt.Errorf("can't open patch '%s': %w", name, err)
+		}
+		parsed, err := parsePatch(data)
+		if err != nil {
+			return err
+		}
+		patches = append(patches, parsed...)
+	}
+	if len(patches) == 0 {
+		return fmt.Errorf("No valid patches in input")
+	}
+	if reverse {
+		for _, p := range patches {
+			p.reverse()
+		}
+	}
+
+	var entries []indexEntry
+	var files map[string]diffEntry
+	where := "working directory"
+	if cached || index {
+		if entries, err = readIndex(); err != nil {
+			return err
+		}
+		if index {
+			if err := checkIndexMatches(cfg, entries, patches); err != nil {
+				return err
+			}
+		}
+		files, _ = indexFiles(entries)
+		where = "index"
+	} else if files, err = worktreePatchFiles(patches); err != nil {
+		return err
+	}
+	results, err := applyPatches(patches, files, where, &opts)
+	if err != nil {
+		return err
+	}
+	if check {
+		return nil
+	}
+
+	switch {
+	case cached:
+		updates := make(map[string]diffEntry)
+		for path, file := range results {
+			if file.mode != 0 {
+				if _, err := storeObject(blobObject, file.data); err != nil {
+					return err
+				}
+			}
+			updates[path] = file
+		}
+		var result []indexEntry
+		for _, e := range entries {
+			if _, ok := updates[e.path]; !ok {
+				result = append(result, e)
+			}
+		}
+		// Without stat data the entries never match the working tree.
+		for path, file := range updates {
+			if file.mode != 0 {
+				result = append(result, indexEntry{path: path, mode: file.mode, hash: file.hash})
+			}
+		}
+		if err := writeIndex(result); err != nil {
+			return err
+		}
+	case index:
+		updates := make(map[string]pathUpdate)
+		for path, file := range results {
+			if file.mode != 0 {
+				if _, err := storeObject(blobObject, file.data); err != nil {
+					return err
+				}
+			}
+			updates[path] = pathUpdate{file: file}
+		}
+		if entries, err = applyUpdates(entries, updates); err != nil {
+			return err
+		}
+		if err := writeIndex(entries); err != nil {
+			return err
+		}
+	default:
+		paths := make([]string, 0, len(results))
+		for path := range results {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		// Removing first makes room for files replacing directories.
+		for _, path := range paths {
+			if results[path].mode == 0 {
+				if err := removeWorktreeFile(path); err != nil {
+					return err
+				}
+			}
+		}
+		for _, path := range paths {
+			if file := results[path]; file.mode != 0 {
+				if err := writeWorktreeFile(path, file); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if opts.verbose {
+		for _, p := range patches {
+			fmt.Fprintf(os.Stderr, "Applied patch %s cleanly.\n", p.displayName())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package mygit
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tarRecordSize is the size tar archives are padded to.
+const tarRecordSize = 10240
+
+// archiveFile is a file or directory to put in an archive, by its path in
+// the archive. Directory paths end with a slash.
+type archiveFile struct {
+	path string
+	mode uint32
+	data []byte
+}
+
+// archiver writes the files of an archive in order.
+type archiver interface {
+	writeFile(f archiveFile) error
+	close() error
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type tarArchiver struct {
+	out   *countingWriter
+	tw    *tar.Writer
+	mtime time.Time
+	umask uint32
+}
+
+// newTarArchiver starts a tar archive. Files get owner root and the given
+// mtime, and their permissions are masked with umask; a commit ID is
+// recorded in a pax global header.
+func newTarArchiver(w io.Writer, commitID objectID, mtime time.Time, umask uint32) (*tarArchiver, error) {
+	out := &countingWriter{w: w}
+	a := &tarArchiver{out: out, tw: tar.NewWriter(out), mtime: mtime, umask: umask}
+	if commitID != (objectID{}) {
+		hdr := &tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			Name:       "pax_global_header",
+			PAXRecords: map[string]string{"comment": commitID.String()},
+		}
+		if err := a.tw.WriteHeader(hdr); err != nil {
+			return nil, fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	return a, nil
+}
+
+func (a *tarArchiver) writeFile(f archiveFile) error {
+	hdr := &tar.Header{
+		Name:    f.path,
+		ModTime: a.mtime,
+		Uname:   "root",
+		Gname:   "root",
+		Format:  tar.FormatPAX,
+	}
+	switch {
+	case strings.HasSuffix(f.path, "/"):
+		hdr.Typeflag, hdr.Mode = tar.TypeDir, int64(0777&^a.umask)
+	case f.mode == modeSymlink:
+		hdr.Typeflag, hdr.Mode, hdr.Linkname = tar.TypeSymlink, 0777, string(f.data)
+	case f.mode == modeExecutable:
+		hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeReg, int64(0777&^a.umask), int64(len(f.data))
+	default:
+		hdr.Typeflag, hdr.Mode, hdr.Size = tar.TypeReg, int64(0666&^a.umask), int64(len(f.data))
+	}
+	if err := a.tw.WriteHeader(hdr); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		if _, err := a.tw.Write(f.data); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	return nil
+}
+
+// close ends the archive and pads it to a whole record, as tar does.
+func (a *tarArchiver) close() error {
+	if err := a.tw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if rest := a.out.n % tarRecordSize; rest != 0 {
+		if _, err := a.out.Write(make([]byte, tarRecordSize-rest)); err != nil {
+			return fmt.Errorf("failed to write archive: %w", err)
+		}
+	}
+	return nil
+}
+
+type zipArchiver struct {
+	zw    *zip.Writer
+	mtime time.Time
+	level int
+}
+
+// newZipArchiver starts a zip archive, its files compressed at the given
+// deflate level, 0 storing them. A commit ID becomes the archive comment.
+func newZipArchiver(w io.Writer, commitID objectID, mtime time.Time, level int) (*zipArchiver, error) {
+	a := &zipArchiver{zw: zip.NewWriter(w), mtime: mtime, level: level}
+	a.zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(w, level)
+	})
+	if commitID != (objectID{}) {
+		if err := a.zw.SetComment(commitID.String()); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func (a *zipArchiver) writeFile(f archiveFile) error {
+	hdr := &zip.FileHeader{Name: f.path, Modified: a.mtime, Method: zip.Store}
+	switch {
+	case strings.HasSuffix(f.path, "/"):
+		hdr.SetMode(os.ModeDir | 0755)
+	case f.mode == modeSymlink:
+		hdr.SetMode(os.ModeSymlink | 0777)
+	case f.mode == modeExecutable:
+		hdr.SetMode(0755)
+	default:
+		hdr.SetMode(0644)
+	}
+	if len(f.data) > 0 && a.level != 0 && f.mode != modeSymlink {
+		hdr.Method = zip.Deflate
+	}
+	w, err := a.zw.CreateHeader(hdr)
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if _, err := w.Write(f.data); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+func (a *zipArchiver) close() error {
+	if err := a.zw.Close(); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// archiveSource is what goes into an archive: the files below paths,
+// with prefix prepended, and the attributes saying how. A commit is given
+// for export-subst.
+type archiveSource struct {
+	prefix      string
+	paths       []string
+	attrs       *attrRules
+	commitID    objectID
+	commit      *commit
+	decorations map[objectID][]decoration
+}
+
+// substituteFormats expands the $Format:...$ placeholders of files with
+// the export-subst attribute.
+func (src *archiveSource) substituteFormats(data []byte) []byte {
+	var out []byte
+	rest := string(data)
+	for {
+		start := strings.Index(rest, "$Format:")
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start+len("$Format:"):], '$')
+		if end < 0 {
+			break
+		}
+		end += start + len("$Format:")
+		out = append(out, rest[:start]...)
+		out = append(out, formatCommit(rest[start+len("$Format:"):end], src.commitID, src.commit, src.decorations)...)
+		rest = rest[end+1:]
+	}
+	return append(out, rest...)
+}
+
+// archiveTree writes the files of a tree below the source's paths in tree
+// order, each directory before its content, leaving out those with the
+// export-ignore attribute. Submodules become empty directories.
+func archiveTree(a archiver, tree objectID, dir string, src *archiveSource) error {
+	_, content, err := readObject(tree)
+	if err != nil {
+		return err
+	}
+	entries, err := parseTree(content)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		mode, err := strconv.ParseUint(entry.mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q in tree %x", entry.mode, tree)
+		}
+		path := dir + entry.name
+		isDir := mode == modeDirectory || mode == modeGitlink
+		if isDir && !pathspecDir(path, src.paths) || !isDir && !matchPathspec(path, src.paths) {
+			continue
+		}
+		attrs, err := src.attrs.lookup(path, isDir)
+		if err != nil {
+			return err
+		}
+		if attrs["export-ignore"] == attrSet {
+			continue
+		}
+		switch mode {
+		case modeDirectory:
+			if err := a.writeFile(archiveFile{path: src.prefix + path + "/", mode: modeDirectory}); err != nil {
+				return err
+			}
+			if err := archiveTree(a, entry.hash, path+"/", src); err != nil {
+				return err
+			}
+		case modeGitlink:
+			if err := a.writeFile(archiveFile{path: src.prefix + path + "/", mode: modeDirectory}); err != nil {
+				return err
+			}
+		default:
+			_, data, err := readObject(entry.hash)
+			if err != nil {
+				return err
+			}
+			if attrs["export-subst"] == attrSet && src.commit != nil {
+				data = src.substituteFormats(data)
+			}
+			if err := a.writeFile(archiveFile{path: src.prefix + path, mode: uint32(mode), data: data}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func runArchive(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	umask := uint64(0002)
+	if value, ok := cfg.get("tar.umask"); ok {
+		if umask, err = strconv.ParseUint(value, 8, 32); err != nil {
+			return fmt.Errorf("bad tar.umask value '%s'", value)
+		}
+	}
+
+	var format, prefix, output, rev string
+	var paths []string
+	worktreeAttrs := false
+	level := flate.DefaultCompression
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case arg == "-l" || arg == "--list":
+			fmt.Println("tar")
+			fmt.Println("zip")
+			return nil
+		case strings.HasPrefix(arg, "--format="):
+			format = strings.TrimPrefix(arg, "--format=")
+		case strings.HasPrefix(arg, "--prefix="):
+			prefix = strings.TrimPrefix(arg, "--prefix=")
+		case arg == "-o" || arg == "--output":
+			if i+1 == len(args) {
+				return fmt.Errorf("option 'output' requires a value")
+			}
+			i++
+			output = args[i]
+		case strings.HasPrefix(arg, "--output="):
+			output = strings.TrimPrefix(arg, "--output=")
+		case arg == "--worktree-attributes":
+			worktreeAttrs = true
+		case len(arg) == 2 && arg[0] == '-' && '0' <= arg[1] && arg[1] <= '9':
+			level = int(arg[1] - '0')
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		case rev == "":
+			rev = arg
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if rev == "" {
+		return fmt.Errorf("usage: mygit archive [--format=<fmt>] [--prefix=<prefix>/] [-o <file>] [--worktree-attributes] <tree-ish> [<path>...]")
+	}
+	if format == "" {
+		format = "tar"
+		if strings.HasSuffix(output, ".zip") {
+			format = "zip"
+		}
+	}
+	if format != "tar" && format != "zip" {
+		return fmt.Errorf("Unknown archive format '%s'", format)
+	}
+
+	tree, err := revisionTree(rev)
+	if err != nil {
+		return fmt.Errorf("not a tree object: %s", rev)
+	}
+	// Commits give their ID and committer date to the archive; bare trees
+	// are dated now.
+	src := &archiveSource{prefix: prefix, paths: paths}
+	mtime := time.Now()
+	if hash, err := resolveRevision(rev); err != nil {
+		return err
+	} else if hash, ok, err := peelToCommit(hash); err != nil {
+		return err
+	} else if ok {
+		c, err := readCommit(hash)
+		if err != nil {
+			return err
+		}
+		src.commitID, src.commit = hash, c
+		_, _, mtime = parseIdent(c.committer)
+		if src.decorations, err = loadDecorations(); err != nil {
+			return err
+		}
+	}
+	// Attributes come from the archived tree unless asked otherwise.
+	if worktreeAttrs {
+		src.attrs, err = worktreeAttrRules(cfg)
+	} else {
+		src.attrs, err = treeAttrRules(cfg, tree)
+	}
+	if err != nil {
+		return err
+	}
+	if len(paths) > 0 {
+		files := make(map[string]diffEntry)
+		if err := treeFiles(tree, "", files); err != nil {
+			return err
+		}
+		for _, p := range paths {
+			found := false
+			for path := range files {
+				found = found || matchPathspec(path, []string{p})
+			}
+			if !found {
+				return fmt.Errorf("pathspec '%s' did not match any files", p)
+			}
+		}
+	}
+
+	var w io.Writer = os.Stdout
+	if output != "" {
+		f, err := os.Create(output)
+		if err != nil {
+			return fmt.Errorf("could not create archive file '%s': %w", output, err)
+		}
+		defer f.Close()
+		w = f
+	}
+	out := bufio.NewWriter(w)
+	var a archiver
+	if format == "zip" {
+		a, err = newZipArchiver(out, src.commitID, mtime, level)
+	} else {
+		a, err = newTarArchiver(out, src.commitID, mtime, uint32(umask))
+	}
+	if err != nil {
+		return err
+	}
+	// A prefix naming a directory gets an entry of its own.
+	if strings.HasSuffix(prefix, "/") {
+		if err := a.writeFile(archiveFile{path: prefix, mode: modeDirectory}); err != nil {
+			return err
+		}
+	}
+	if err := archiveTree(a, tree, "", src); err != nil {
+		return err
+	}
+	if err := a.close(); err != nil {
+		return err
+	}
+	return out.Flush()
+}
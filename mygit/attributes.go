@@ -0,0 +1,474 @@
+package mygit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const attributesFileName = ".gitattributes"
+
+var infoAttributesFile = ".git/info/attributes"
+
+// The states of an attribute besides a value, as check-attr prints them.
+const (
+	attrSet         = "set"
+	attrUnset       = "unset"
+	attrUnspecified = "unspecified"
+)
+
+// builtinMacros are the macro attributes git always knows about.
+var builtinMacros = map[string][]attrAssign{
+	"binary": {{"diff", attrUnset}, {"merge", attrUnset}, {"text", attrUnset}},
+}
+
+// attrAssign gives an attribute a state or a value.
+type attrAssign struct {
+	name  string
+	value string
+}
+
+// attrLine is one line of an attributes file: the paths it matches and
+// the attributes it assigns, in order.
+type attrLine struct {
+	pattern ignorePattern
+	assigns []attrAssign
+}
+
+// attrRules tell the attributes of paths, from the .gitattributes files
+// of a tree or of the working tree, the repository's info/attributes and
+// the user's global attributes file. The .gitattributes files are read
+// as directories are looked at, so mu guards dirs during lookups.
+type attrRules struct {
+	// read returns the .gitattributes file of a directory, "" for the top.
+	read   func(dir string) ([]byte, error)
+	global []attrLine
+	info   []attrLine
+	mu     sync.Mutex
+	dirs   map[string][]attrLine
+	macros map[string][]attrAssign
+	// names are the attributes in the order they were first read, which
+	// is how check-attr --all lists them.
+	names []string
+	known map[string]bool
+}
+
+// parseAttrAssign reads one attribute of a line: "name" sets it, "-name"
+// unsets it, "!name" leaves it unspecified and "name=value" gives it a
+// value.
+func parseAttrAssign(s string) attrAssign {
+	switch {
+	case strings.HasPrefix(s, "-"):
+		return attrAssign{s[1:], attrUnset}
+	case strings.HasPrefix(s, "!"):
+		return attrAssign{s[1:], attrUnspecified}
+	}
+	if name, value, ok := strings.Cut(s, "="); ok {
+		return attrAssign{name, value}
+	}
+	return attrAssign{s, attrSet}
+}
+
+// parseLines reads the lines of an attributes file found in base.
+// Macro definitions are only allowed at the top level.
+func (r *attrRules) parseLines(data []byte, base string, top bool) []attrLine {
+	var lines []attrLine
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(strings.TrimSuffix(line, "\r"))
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		name, isMacro := strings.CutPrefix(fields[0], "[attr]")
+		if isMacro && !top {
+			continue
+		}
+		if isMacro {
+			r.register(name)
+		}
+		var assigns []attrAssign
+		for _, f := range fields[1:] {
+			a := parseAttrAssign(f)
+			r.register(a.name)
+			assigns = append(assigns, a)
+		}
+		if isMacro {
+			r.macros[name] = assigns
+			continue
+		}
+		// Negative patterns mean nothing here.
+		if strings.HasPrefix(fields[0], "!") {
+			continue
+		}
+		patterns := parseIgnorePatterns([]byte(fields[0]), base)
+		if len(patterns) == 1 {
+			lines = append(lines, attrLine{pattern: patterns[0], assigns: assigns})
+		}
+	}
+	return lines
+}
+
+// register notes an attribute name the first time it is read.
+func (r *attrRules) register(name string) {
+	if !r.known[name] {
+		r.known[name] = true
+		r.names = append(r.names, name)
+	}
+}
+
+// globalAttributesFile returns the attributes file of core.attributesFile,
+// which defaults to git/attributes in the XDG config directory.
+func globalAttributesFile(cfg *config) (string, error) {
+	if value, ok := cfg.get("core.attributesFile"); ok {
+		return expandConfigPath(value)
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "git", "attributes"), nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config", "git", "attributes"), nil
+	}
+	return "", nil
+}
+
+// readOptionalFile reads a file that may be missing, which reads as
+// empty.
+func readOptionalFile(name string) ([]byte, error) {
+	data, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// newAttrRules sets up attribute lookups whose .gitattributes files come
+// from read.
+func newAttrRules(cfg *config, read func(dir string) ([]byte, error)) (*attrRules, error) {
+	r := &attrRules{
+		read:   read,
+		dirs:   make(map[string][]attrLine),
+		macros: make(map[string][]attrAssign),
+		known:  make(map[string]bool),
+	}
+	for name, assigns := range builtinMacros {
+		r.register(name)
+		for _, a := range assigns {
+			r.register(a.name)
+		}
+		r.macros[name] = assigns
+	}
+	global, err := globalAttributesFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if global != "" {
+		data, err := readOptionalFile(global)
+		if err != nil {
+			return nil, err
+		}
+		r.global = r.parseLines(data, "", true)
+	}
+	// Macros of the top-level file apply everywhere, so it is read first.
+	if _, err := r.dirLines(""); err != nil {
+		return nil, err
+	}
+	data, err := readOptionalFile(infoAttributesFile)
+	if err != nil {
+		return nil, err
+	}
+	r.info = r.parseLines(data, "", true)
+	return r, nil
+}
+
+// worktreeAttrRules looks up attributes in the working tree's
+// .gitattributes files.
+func worktreeAttrRules(cfg *config) (*attrRules, error) {
+	return newAttrRules(cfg, func(dir string) ([]byte, error) {
+		if dir == "" {
+			return readOptionalFile(attributesFileName)
+		}
+		return readOptionalFile(dir + "/" + attributesFileName)
+	})
+}
+
+// treeAttrRules looks up attributes in the .gitattributes files of a
+// tree.
+func treeAttrRules(cfg *config, tree objectID) (*attrRules, error) {
+	return newAttrRules(cfg, func(dir string) ([]byte, error) {
+		name := attributesFileName
+		if dir != "" {
+			name = dir + "/" + attributesFileName
+		}
+		entry, err := treeEntryAt(tree, name)
+		if err != nil || entry.mode&modeTypeMask != modeRegular&modeTypeMask {
+			return nil, err
+		}
+		_, data, err := readObject(entry.hash)
+		return data, err
+	})
+}
+
+// indexAttrRules looks up attributes in the .gitattributes files staged
+// in the index.
+func indexAttrRules(cfg *config, entries []indexEntry) (*attrRules, error) {
+	staged := make(map[string]objectID)
+	for _, e := range entries {
+		if e.stage() == 0 && e.mode&modeTypeMask == modeRegular&modeTypeMask {
+			staged[e.path] = e.hash
+		}
+	}
+	return newAttrRules(cfg, func(dir string) ([]byte, error) {
+		name := attributesFileName
+		if dir != "" {
+			name = dir + "/" + attributesFileName
+		}
+		hash, ok := staged[name]
+		if !ok {
+			return nil, nil
+		}
+		_, data, err := readObject(hash)
+		return data, err
+	})
+}
+
+// dirLines returns the lines of the .gitattributes file in dir.
+func (r *attrRules) dirLines(dir string) ([]attrLine, error) {
+	if lines, ok := r.dirs[dir]; ok {
+		return lines, nil
+	}
+	data, err := r.read(dir)
+	if err != nil {
+		return nil, err
+	}
+	base := ""
+	if dir != "" {
+		base = dir + "/"
+	}
+	lines := r.parseLines(data, base, dir == "")
+	r.dirs[dir] = lines
+	return lines, nil
+}
+
+// lookup returns the attributes of name that are not unspecified. For
+// each attribute, info/attributes wins over the .gitattributes files,
+// deeper ones first, which win over the global file; within a file the
+// last matching line wins.
+func (r *attrRules) lookup(name string, isDir bool) (map[string]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sources := [][]attrLine{r.info}
+	dirs := []string{""}
+	for i := range name {
+		if name[i] == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		lines, err := r.dirLines(dirs[i])
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, lines)
+	}
+	sources = append(sources, r.global)
+
+	attrs := make(map[string]string)
+	var assign func(a attrAssign, depth int)
+	assign = func(a attrAssign, depth int) {
+		if _, ok := attrs[a.name]; ok {
+			return
+		}
+		attrs[a.name] = a.value
+		// A set macro brings its attributes along.
+		if macro, ok := r.macros[a.name]; ok && a.value == attrSet && depth < 8 {
+			for i := len(macro) - 1; i >= 0; i-- {
+				assign(macro[i], depth+1)
+			}
+		}
+	}
+	for _, lines := range sources {
+		for i := len(lines) - 1; i >= 0; i-- {
+			if !lines[i].pattern.matches(name, isDir) {
+				continue
+			}
+			for j := len(lines[i].assigns) - 1; j >= 0; j-- {
+				assign(lines[i].assigns[j], 0)
+			}
+		}
+	}
+	for attr, value := range attrs {
+		if value == attrUnspecified {
+			delete(attrs, attr)
+		}
+	}
+	return attrs, nil
+}
+
+// diffAsBinary tells whether the changes to path are shown as binary: set
+// or unset, its diff attribute decides, and otherwise its contents do.
+func diffAsBinary(path string, contents ...[]byte) (bool, error) {
+	attrs, err := fileAttrs(path)
+	if err != nil {
+		return false, err
+	}
+	switch attrs["diff"] {
+	case attrSet:
+		return false, nil
+	case attrUnset:
+		return true, nil
+	}
+	return slices.ContainsFunc(contents, isBinary), nil
+}
+
+// mergeAsBinary tells whether path is merged as a binary file, which keeps
+// one side whole: its merge attribute decides when it is unset or names
+// the binary or text driver, and otherwise its contents do.
+func mergeAsBinary(path string, contents ...[]byte) (bool, error) {
+	attrs, err := fileAttrs(path)
+	if err != nil {
+		return false, err
+	}
+	switch attrs["merge"] {
+	case attrSet, "text":
+		return false, nil
+	case attrUnset, "binary":
+		return true, nil
+	}
+	return slices.ContainsFunc(contents, isBinary), nil
+}
+
+func runCheckAttr(args []string) error {
+	all, cached, stdin, nulTerminated := false, false, false, false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-a" || arg == "--all":
+			all = true
+		case arg == "--cached":
+			cached = true
+		case arg == "--stdin":
+			stdin = true
+		case arg == "-z":
+			nulTerminated = true
+		case arg == "--":
+			rest = append(rest, args[i:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			rest = append(rest, arg)
+		}
+	}
+
+	// Without --, a single attribute comes before the paths, and all of
+	// the arguments are attributes when the paths are read from stdin.
+	var names, paths []string
+	dashes := slices.Index(rest, "--")
+	switch {
+	case all && dashes > 0:
+		return fmt.Errorf("Attributes and --all both specified")
+	case all && dashes == 0:
+		paths = rest[1:]
+	case all:
+		paths = rest
+	case dashes == 0 || len(rest) == 0:
+		return fmt.Errorf("No attribute specified")
+	case dashes > 0:
+		names, paths = rest[:dashes], rest[dashes+1:]
+	case stdin:
+		names = rest
+	default:
+		names, paths = rest[:1], rest[1:]
+	}
+	if stdin && len(paths) > 0 {
+		return fmt.Errorf("Can't specify files with --stdin")
+	} else if !stdin && len(paths) == 0 {
+		return fmt.Errorf("No file specified")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	quoteHigh, err := cfg.getBool("core.quotePath", true)
+	if err != nil {
+		return err
+	}
+	var rules *attrRules
+	if cached {
+		entries, err := readIndex()
+		if err != nil {
+			return err
+		}
+		rules, err = indexAttrRules(cfg, entries)
+	} else {
+		rules, err = worktreeAttrRules(cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	check := func(path string) error {
+		attrs, err := rules.lookup(filepath.ToSlash(filepath.Clean(path)), false)
+		if err != nil {
+			return err
+		}
+		list := names
+		if all {
+			list = nil
+			for _, name := range rules.names {
+				if _, ok := attrs[name]; ok {
+					list = append(list, name)
+				}
+			}
+		}
+		for _, name := range list {
+			value, ok := attrs[name]
+			if !ok {
+				value = attrUnspecified
+			}
+			if nulTerminated {
+				fmt.Fprintf(out, "%s\x00%s\x00%s\x00", path, name, value)
+			} else {
+				fmt.Fprintf(out, "%s: %s: %s\n", quotePath(path, quoteHigh), name, value)
+			}
+		}
+		// Paths from stdin are answered as they come.
+		return out.Flush()
+	}
+	if !stdin {
+		for _, path := range paths {
+			if err := check(path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	in := bufio.NewReader(os.Stdin)
+	delim := byte('\n')
+	if nulTerminated {
+		delim = 0
+	}
+	for {
+		line, err := in.ReadString(delim)
+		if line = strings.TrimSuffix(line, string(delim)); line != "" {
+			if err := check(line); err != nil {
+				return err
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
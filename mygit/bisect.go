@@ -0,0 +1,713 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bisectCandidate is a commit that could be tested next, with its
+// distance: how many commits in the bisection it reaches or does not
+// reach, whichever is less.
+type bisectCandidate struct {
+	hash     objectID
+	distance int
+}
+
+// bisection is the outcome of findBisection. reaches is the number of
+// commits in the bisection, out of all, that best reaches, itself
+// included.
+type bisection struct {
+	candidates []bisectCandidate
+	reaches    int
+	all        int
+}
+
+// bisectRefs returns the commits marked bad, good and skipped in
+// refs/bisect.
+func bisectRefs() (bad objectID, good []objectID, skipped map[objectID]bool, err error) {
+	refs, err := listRefs()
+	if err != nil {
+		return objectID{}, nil, nil, err
+	}
+	skipped = make(map[objectID]bool)
+	for name, hash := range refs {
+		switch {
+		case name == "refs/bisect/bad":
+			bad = hash
+		case strings.HasPrefix(name, "refs/bisect/good-"):
+			good = append(good, hash)
+		case strings.HasPrefix(name, "refs/bisect/skip-"):
+			skipped[hash] = true
+		}
+	}
+	sort.Slice(good, func(i, j int) bool { return bytes.Compare(good[i][:], good[j][:]) < 0 })
+	return bad, good, skipped, nil
+}
+
+// bisectionCommits lists the commits reachable from bad but not from
+// good, newest first.
+func bisectionCommits(bad, good []objectID) ([]walkedCommit, error) {
+	excluded := make(map[objectID]bool)
+	err := walkCommits(good, func(hash objectID, c *commit) error {
+		excluded[hash] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var list []walkedCommit
+	err = walkCommits(bad, func(hash objectID, c *commit) error {
+		if !excluded[hash] {
+			list = append(list, walkedCommit{hash, c})
+		}
+		return nil
+	})
+	return list, err
+}
+
+// approxHalfway reports whether a commit reaching weight of nr commits
+// splits them well enough to stop looking: exactly for small sets, to
+// within about 0.1% for large ones.
+func approxHalfway(weight, nr int) bool {
+	diff := 2*weight - nr
+	if -1 <= diff && diff <= 1 {
+		return true
+	}
+	return max(diff, -diff) < nr/1024
+}
+
+// findBisection picks the commit of list, as returned by
+// bisectionCommits, that best halves it: whether it turns out good or
+// bad, as few commits as possible remain. Like git, it settles for the
+// first commit found at about halfway unless all candidates are wanted,
+// in which case they come best first.
+func findBisection(list []walkedCommit, findAll bool) bisection {
+	nr := len(list)
+	order := make([]walkedCommit, nr)
+	index := make(map[objectID]int, nr)
+	for i, w := range list {
+		order[nr-1-i] = w
+		index[w.hash] = nr - 1 - i
+	}
+	b := bisection{all: nr}
+	if nr == 0 {
+		return b
+	}
+
+	// Weights are the number of commits reached, or -1 and -2 while unknown
+	// for commits with one and several parents in the bisection.
+	weights := make([]int, nr)
+	parents := make([][]int, nr)
+	counted := 0
+	for i, w := range order {
+		for _, parent := range w.commit.parents {
+			if j, ok := index[parent]; ok {
+				parents[i] = append(parents[i], j)
+			}
+		}
+		switch len(parents[i]) {
+		case 0:
+			weights[i] = 1
+			counted++
+		case 1:
+			weights[i] = -1
+		default:
+			weights[i] = -2
+		}
+	}
+	found := func(i int) bisection {
+		b.candidates = []bisectCandidate{{order[i].hash, min(weights[i], nr-weights[i])}}
+		b.reaches = weights[i]
+		return b
+	}
+
+	// Merges reach their parents' commits, but those overlap: they are
+	// counted by walking them.
+	for i := range order {
+		if weights[i] != -2 {
+			continue
+		}
+		seen := make(map[int]bool)
+		pending := []int{i}
+		for len(pending) > 0 {
+			j := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			if !seen[j] {
+				seen[j] = true
+				pending = append(pending, parents[j]...)
+			}
+		}
+		weights[i] = len(seen)
+		if !findAll && approxHalfway(weights[i], nr) {
+			return found(i)
+		}
+		counted++
+	}
+
+	// A commit with a single parent reaches one more commit than it.
+	for counted < nr {
+		for i := range order {
+			if weights[i] >= 0 {
+				continue
+			}
+			known := -1
+			for _, j := range parents[i] {
+				if weights[j] >= 0 {
+					known = j
+					break
+				}
+			}
+			if known < 0 {
+				continue
+			}
+			weights[i] = weights[known] + 1
+			counted++
+			if !findAll && approxHalfway(weights[i], nr) {
+				return found(i)
+			}
+		}
+	}
+
+	if !findAll {
+		best, bestDistance := 0, -1
+		for i := range order {
+			if distance := min(weights[i], nr-weights[i]); distance > bestDistance {
+				best, bestDistance = i, distance
+			}
+		}
+		return found(best)
+	}
+
+	reaches := make(map[objectID]int, nr)
+	for i, w := range order {
+		reaches[w.hash] = weights[i]
+		b.candidates = append(b.candidates, bisectCandidate{w.hash, min(weights[i], nr-weights[i])})
+	}
+	sort.Slice(b.candidates, func(i, j int) bool {
+		x, y := b.candidates[i], b.candidates[j]
+		if x.distance != y.distance {
+			return x.distance > y.distance
+		}
+		return bytes.Compare(x.hash[:], y.hash[:]) < 0
+	})
+	b.reaches = reaches[b.candidates[0].hash]
+	return b
+}
+
+// withoutSkipped drops the skipped commits from candidates.
+func withoutSkipped(candidates []bisectCandidate, skipped map[objectID]bool) []bisectCandidate {
+	var kept []bisectCandidate
+	for _, c := range candidates {
+		if !skipped[c.hash] {
+			kept = append(kept, c)
+		}
+	}
+	return kept
+}
+
+// bisectPRN is git's pseudo random number generator for skipping: the
+// same candidates always lead to the same choice.
+func bisectPRN(count int) int {
+	const modulo = 32768
+	x := uint32(count)*1103515245 + 12345
+	return int(x/65536) % modulo
+}
+
+// sqrti is the integer square root as git computes it, with floats.
+func sqrti(val int) int {
+	if val == 0 {
+		return 0
+	}
+	x := float32(val)
+	for {
+		y := (x + float32(val)/x) / 2
+		d := y - x
+		if d < 0 {
+			d = -d
+		}
+		x = y
+		if d < 0.5 {
+			break
+		}
+	}
+	return int(x)
+}
+
+// skipBisection returns the candidates, best first, from the one to test
+// next when skipped commits are taken into account. If the best is
+// skipped, one is picked away from it, at a pseudo random position biased
+// towards the better candidates, so as not to end up testing commits
+// next to the skipped ones. bad is never picked.
+func skipBisection(candidates []bisectCandidate, skipped map[objectID]bool, bad objectID) []bisectCandidate {
+	if len(candidates) == 0 || !skipped[candidates[0].hash] {
+		return candidates
+	}
+	kept := withoutSkipped(candidates, skipped)
+	count := len(kept)
+	prn := bisectPRN(count)
+	index := (count * prn / 32768) * sqrti(prn) / sqrti(32768)
+	if index >= count {
+		return kept
+	}
+	if kept[index].hash == bad && index > 0 {
+		index--
+	}
+	return kept[index:]
+}
+
+// estimateBisectSteps is roughly how many more commits need testing to
+// find the first bad one among all.
+func estimateBisectSteps(all int) int {
+	if all < 3 {
+		return 0
+	}
+	n := 0
+	for 1<<(n+1) <= all {
+		n++
+	}
+	e := 1 << n
+	if x := all - e; e < 3*x {
+		return n
+	}
+	return n - 1
+}
+
+// writeBisectVars prints the outcome of a bisection as shell variables.
+func writeBisectVars(w io.Writer, b bisection, rev string) {
+	// The bad commit is already known, so one less is left to test.
+	left := max(b.all-b.reaches, b.reaches)
+	fmt.Fprintf(w, "bisect_rev='%s'\n", rev)
+	fmt.Fprintf(w, "bisect_nr=%d\n", left-1)
+	fmt.Fprintf(w, "bisect_good=%d\n", b.all-b.reaches-1)
+	fmt.Fprintf(w, "bisect_bad=%d\n", b.reaches-1)
+	fmt.Fprintf(w, "bisect_all=%d\n", b.all)
+	fmt.Fprintf(w, "bisect_steps=%d\n", estimateBisectSteps(b.all))
+}
+
+// Bisection state files, as git keeps them. BISECT_START names where HEAD
+// was when the bisection started; BISECT_LOG records the commands so far.
+var (
+	bisectStartFile       = ".git/BISECT_START"
+	bisectLogFile         = ".git/BISECT_LOG"
+	bisectTermsFile       = ".git/BISECT_TERMS"
+	bisectNamesFile       = ".git/BISECT_NAMES"
+	bisectAncestorsOKFile = ".git/BISECT_ANCESTORS_OK"
+)
+
+// errNotBisecting is returned by the commands that need a bisection in
+// progress.
+var errNotBisecting = errors.New(`You need to start by "git bisect start"`)
+
+func bisecting() bool {
+	_, err := os.Stat(bisectStartFile)
+	return err == nil
+}
+
+// appendBisectLog adds lines to BISECT_LOG.
+func appendBisectLog(lines ...string) error {
+	f, err := os.OpenFile(bisectLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", bisectLogFile, err)
+	}
+	for _, line := range lines {
+		fmt.Fprintln(f, line)
+	}
+	return f.Close()
+}
+
+// describeBisectCommit returns "[<hash>] <subject>".
+func describeBisectCommit(hash objectID) (string, error) {
+	c, err := readCommit(hash)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("[%s] %s", hash, commitSubject(c.message)), nil
+}
+
+// markBisect records a commit as bad, good or skipped.
+func markBisect(state string, hash objectID) error {
+	ref := "refs/bisect/bad"
+	if state != "bad" {
+		ref = fmt.Sprintf("refs/bisect/%s-%s", state, hash)
+	}
+	tx := newRefTransaction()
+	tx.update(ref, hash, "")
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	d, err := describeBisectCommit(hash)
+	if err != nil {
+		return err
+	}
+	return appendBisectLog(fmt.Sprintf("# %s: %s", state, d))
+}
+
+// checkoutBisect checks out the next commit to test.
+func checkoutBisect(cfg *config, hash objectID) error {
+	tx := newRefTransaction()
+	tx.update("BISECT_EXPECTED_REV", hash, "")
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if err := checkoutRevision(cfg, hash.String(), true); err != nil {
+		return err
+	}
+	d, err := describeBisectCommit(hash)
+	if err != nil {
+		return err
+	}
+	fmt.Println(d)
+	return nil
+}
+
+// checkMergeBases makes sure the good commits are ancestors of the bad
+// one. If not, the merge bases come first: a bad one means the bug was
+// fixed rather than introduced, and an untested one is checked out to be
+// tested. It reports whether it checked one out.
+func checkMergeBases(cfg *config, bad objectID, good []objectID, skipped map[objectID]bool) (bool, error) {
+	if _, err := os.Stat(bisectAncestorsOKFile); err == nil || len(good) == 0 {
+		return false, nil
+	}
+	allAncestors := true
+	for _, g := range good {
+		ok, err := isAncestor(g, bad)
+		if err != nil {
+			return false, err
+		}
+		allAncestors = allAncestors && ok
+	}
+	if !allAncestors {
+		bases, err := mergeBases([]objectID{bad}, good)
+		if err != nil {
+			return false, err
+		}
+		goodHex := make([]string, len(good))
+		for i, g := range good {
+			goodHex[i] = g.String()
+		}
+		for _, base := range bases {
+			switch {
+			case base == bad:
+				fmt.Fprintf(os.Stderr, "The merge base %s is bad.\nThis means the bug has been fixed between %s and [%s].\n",
+					bad, bad, strings.Join(goodHex, " "))
+				os.Exit(3)
+			case slices.Contains(good, base):
+			case skipped[base]:
+				fmt.Fprintf(os.Stderr, "Warning: the merge base between %s and [%s] must be skipped.\n"+
+					"So we cannot be sure the first bad commit is between %s and %s.\nWe continue anyway.\n",
+					bad, strings.Join(goodHex, " "), base, bad)
+			default:
+				fmt.Println("Bisecting: a merge base must be tested")
+				return true, checkoutBisect(cfg, base)
+			}
+		}
+	}
+	if err := os.WriteFile(bisectAncestorsOKFile, nil, 0644); err != nil {
+		return false, fmt.Errorf("failed to write %s: %w", bisectAncestorsOKFile, err)
+	}
+	return false, nil
+}
+
+// exitOnlySkipped reports that the first bad commit cannot be told apart
+// from the skipped ones that are left, and exits.
+func exitOnlySkipped(tried []objectID, bad objectID) {
+	fmt.Println("There are only 'skipped' commits left to test.\nThe first bad commit could be any of:")
+	for _, hash := range tried {
+		fmt.Println(hash)
+	}
+	if bad != (objectID{}) {
+		fmt.Println(bad)
+	}
+	fmt.Println("We cannot bisect more!")
+	os.Exit(2)
+}
+
+// bisectNext checks out the next commit to test once a bad and a good
+// commit are known, or shows the first bad commit if it was found.
+// Otherwise it says what is missing.
+func bisectNext(cfg *config) error {
+	bad, good, skipped, err := bisectRefs()
+	if err != nil {
+		return err
+	}
+	var status string
+	switch {
+	case bad == (objectID{}) && len(good) == 0:
+		status = "waiting for both good and bad commits"
+	case bad == (objectID{}) && len(good) == 1:
+		status = "waiting for bad commit, 1 good commit known"
+	case bad == (objectID{}):
+		status = fmt.Sprintf("waiting for bad commit, %d good commits known", len(good))
+	case len(good) == 0:
+		status = "waiting for good commit(s), bad commit known"
+	}
+	if status != "" {
+		fmt.Println("status: " + status)
+		return appendBisectLog("# status: " + status)
+	}
+
+	if checkedOut, err := checkMergeBases(cfg, bad, good, skipped); err != nil || checkedOut {
+		return err
+	}
+	list, err := bisectionCommits([]objectID{bad}, good)
+	if err != nil {
+		return err
+	}
+	var tried []objectID
+	for _, w := range list {
+		if skipped[w.hash] {
+			tried = append(tried, w.hash)
+		}
+	}
+	b := findBisection(list, len(skipped) > 0)
+	candidates := skipBisection(b.candidates, skipped, bad)
+	if len(skipped) > 0 {
+		candidates = skipBisection(withoutSkipped(b.candidates, nil), skipped, bad)
+	}
+	switch {
+	case len(candidates) == 0 && len(tried) > 0:
+		exitOnlySkipped(tried, objectID{})
+	case len(candidates) == 0:
+		fmt.Printf("%s was both good and bad\n", bad)
+		os.Exit(1)
+	}
+
+	next := candidates[0].hash
+	if next == bad {
+		if len(tried) > 0 {
+			exitOnlySkipped(tried, bad)
+		}
+		c, err := readCommit(bad)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s is the first bad commit\n", bad)
+		out := bufio.NewWriter(os.Stdout)
+		writeLogEntry(out, bad, c, &logOptions{now: time.Now()}, nil)
+		old := map[string]diffEntry{}
+		if len(c.parents) > 0 {
+			if old, err = commitFiles(c.parents[0]); err != nil {
+				return err
+			}
+		}
+		new, err := commitFiles(bad)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out)
+		if err := writeMergeStat(out, cfg, old, new); err != nil {
+			return err
+		}
+		if err := out.Flush(); err != nil {
+			return err
+		}
+		d, err := describeBisectCommit(bad)
+		if err != nil {
+			return err
+		}
+		return appendBisectLog("# first bad commit: " + d)
+	}
+
+	left := b.all - b.reaches - 1
+	steps := estimateBisectSteps(b.all)
+	revisions, stepWord := "revisions", "steps"
+	if left == 1 {
+		revisions = "revision"
+	}
+	if steps == 1 {
+		stepWord = "step"
+	}
+	fmt.Printf("Bisecting: %d %s left to test after this (roughly %d %s)\n", left, revisions, steps, stepWord)
+	return checkoutBisect(cfg, next)
+}
+
+// cleanBisectState removes the refs and files of a bisection.
+func cleanBisectState() error {
+	refs, err := listRefs()
+	if err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	for name := range refs {
+		if strings.HasPrefix(name, "refs/bisect/") {
+			tx.delete(name)
+		}
+	}
+	if _, err := resolveRef("BISECT_EXPECTED_REV"); err == nil {
+		tx.delete("BISECT_EXPECTED_REV")
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	for _, file := range []string{bisectAncestorsOKFile, bisectLogFile, bisectTermsFile, bisectNamesFile, bisectStartFile} {
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+// startBisect starts a bisection, given the bad commit and good ones if
+// they are known. A bisection in progress is reset first.
+func startBisect(cfg *config, args []string) error {
+	var revs []objectID
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			return fmt.Errorf("unknown option %s", arg)
+		}
+		hash, err := resolveCommit(arg)
+		if err != nil {
+			return fmt.Errorf("'%s' does not appear to be a valid revision", arg)
+		}
+		revs = append(revs, hash)
+	}
+
+	var start string
+	if bisecting() {
+		data, err := os.ReadFile(bisectStartFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", bisectStartFile, err)
+		}
+		start = strings.TrimSpace(string(data))
+		if err := checkoutRevision(cfg, start, false); err != nil {
+			return fmt.Errorf("checking out '%s' failed. Try 'git bisect start <valid-branch>'.", start)
+		}
+	} else {
+		head, err := symrefTarget("HEAD")
+		if err != nil {
+			return err
+		}
+		if start = strings.TrimPrefix(head, "refs/heads/"); head == "HEAD" {
+			hash, err := resolveRef("HEAD")
+			if err != nil {
+				return err
+			}
+			start = hash.String()
+		}
+	}
+	if err := cleanBisectState(); err != nil {
+		return err
+	}
+
+	for file, content := range map[string]string{
+		bisectStartFile: start + "\n",
+		bisectTermsFile: "bad\ngood\n",
+		bisectNamesFile: "\n",
+	} {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", file, err)
+		}
+	}
+	command := "git bisect start"
+	for i, hash := range revs {
+		state := "good"
+		if i == 0 {
+			state = "bad"
+		}
+		if err := markBisect(state, hash); err != nil {
+			return err
+		}
+		command += " " + sqQuote(args[i])
+	}
+	if err := appendBisectLog(command); err != nil {
+		return err
+	}
+	return bisectNext(cfg)
+}
+
+// markBisectRevs marks commits, HEAD by default, as bad, good or skipped
+// and moves on to the next commit to test.
+func markBisectRevs(cfg *config, state string, args []string) error {
+	if !bisecting() {
+		return errNotBisecting
+	}
+	if state == "bad" && len(args) > 1 {
+		return fmt.Errorf("'git bisect bad' can take only one argument.")
+	}
+	if len(args) == 0 {
+		args = []string{"HEAD"}
+	}
+	var revs []objectID
+	for _, arg := range args {
+		hash, err := resolveCommit(arg)
+		if err != nil {
+			return fmt.Errorf("Bad rev input: %s", arg)
+		}
+		revs = append(revs, hash)
+	}
+	for _, hash := range revs {
+		if err := markBisect(state, hash); err != nil {
+			return err
+		}
+		if err := appendBisectLog(fmt.Sprintf("git bisect %s %s", state, hash)); err != nil {
+			return err
+		}
+	}
+	return bisectNext(cfg)
+}
+
+// resetBisect ends a bisection, checking out where it started or the
+// given commit.
+func resetBisect(cfg *config, args []string) error {
+	if !bisecting() {
+		fmt.Println("We are not bisecting.")
+		return nil
+	}
+	if len(args) > 1 {
+		return fmt.Errorf("'git bisect reset' requires either no argument or a commit")
+	}
+	var target string
+	if len(args) == 1 {
+		if _, err := resolveCommit(args[0]); err != nil {
+			return fmt.Errorf("'%s' is not a valid commit", args[0])
+		}
+		target = args[0]
+	} else {
+		data, err := os.ReadFile(bisectStartFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", bisectStartFile, err)
+		}
+		target = strings.TrimSpace(string(data))
+	}
+	if err := checkoutRevision(cfg, target, false); err != nil {
+		return fmt.Errorf("could not check out original HEAD '%s'. Try 'git bisect reset <commit>'.", target)
+	}
+	return cleanBisectState()
+}
+
+func runBisect(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mygit bisect (start [<bad> [<good>...]] | (bad | good | skip) [<rev>...] | reset [<commit>] | log)")
+	}
+	switch args[0] {
+	case "start":
+		return startBisect(cfg, args[1:])
+	case "bad", "good", "skip":
+		return markBisectRevs(cfg, args[0], args[1:])
+	case "reset":
+		return resetBisect(cfg, args[1:])
+	case "log":
+		data, err := os.ReadFile(bisectLogFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("We are not bisecting.")
+		} else if err != nil {
+			return fmt.Errorf("failed to read %s: %w", bisectLogFile, err)
+		}
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return fmt.Errorf("unknown subcommand: %s", args[0])
+}
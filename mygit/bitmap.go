@@ -0,0 +1,639 @@
+package mygit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/bits"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	bitmapSignature = "BITM"
+	bitmapVersion   = 1
+
+	bitmapFullDAG   = 0x1
+	bitmapHashCache = 0x4
+
+	// bitmapCommitInterval is how many commits of the history go by
+	// between two commits that get a bitmap of their own, besides the
+	// ref tips.
+	bitmapCommitInterval = 100
+)
+
+var errBitmapIncomplete = errors.New("some objects are not being packed")
+
+// bitmap is a set of pack positions, one bit per object in pack order.
+type bitmap []uint64
+
+func (b *bitmap) set(i int) {
+	for len(*b) <= i/64 {
+		*b = append(*b, 0)
+	}
+	(*b)[i/64] |= 1 << (i % 64)
+}
+
+func (b bitmap) get(i int) bool {
+	return i/64 < len(b) && b[i/64]&(1<<(i%64)) != 0
+}
+
+func (b *bitmap) or(other bitmap) {
+	for len(*b) < len(other) {
+		*b = append(*b, 0)
+	}
+	for i, w := range other {
+		(*b)[i] |= w
+	}
+}
+
+func (b bitmap) andNot(other bitmap) {
+	for i := range b {
+		if i < len(other) {
+			b[i] &^= other[i]
+		}
+	}
+}
+
+// forEach calls fn with every position set, in ascending order.
+func (b bitmap) forEach(fn func(i int)) {
+	for i, w := range b {
+		for w != 0 {
+			fn(i*64 + bits.TrailingZeros64(w))
+			w &= w - 1
+		}
+	}
+}
+
+// encodeEWAH compresses b the way git stores bitmaps: the bit count, the
+// number of words, the words and the position of the last marker word. A
+// marker word holds the bit of a run of clean words in bit 0, the run
+// length in the next 32 bits and the number of literal words that follow
+// in the top 31.
+func encodeEWAH(b bitmap) []byte {
+	for len(b) > 0 && b[len(b)-1] == 0 {
+		b = b[:len(b)-1]
+	}
+	size := 0
+	if len(b) > 0 {
+		size = (len(b)-1)*64 + 64 - bits.LeadingZeros64(b[len(b)-1])
+	}
+
+	var words []uint64
+	last := 0
+	for i := 0; i < len(b) || len(words) == 0; {
+		var marker uint64
+		if i < len(b) && (b[i] == 0 || b[i] == ^uint64(0)) {
+			fill, run := b[i], uint64(0)
+			for i < len(b) && b[i] == fill && run < 1<<32-1 {
+				i, run = i+1, run+1
+			}
+			marker = run << 1
+			if fill != 0 {
+				marker |= 1
+			}
+		}
+		start := i
+		for i < len(b) && b[i] != 0 && b[i] != ^uint64(0) && uint64(i-start) < 1<<31-1 {
+			i++
+		}
+		last = len(words)
+		words = append(words, marker|uint64(i-start)<<33)
+		words = append(words, b[start:i]...)
+	}
+
+	buf := make([]byte, 8, 12+8*len(words))
+	binary.BigEndian.PutUint32(buf[0:], uint32(size))
+	binary.BigEndian.PutUint32(buf[4:], uint32(len(words)))
+	for _, w := range words {
+		buf = binary.BigEndian.AppendUint64(buf, w)
+	}
+	return binary.BigEndian.AppendUint32(buf, uint32(last))
+}
+
+// decodeEWAH reads a compressed bitmap from the start of data and returns
+// it with the number of bytes it took.
+func decodeEWAH(data []byte) (bitmap, int, error) {
+	if len(data) < 8 {
+		return nil, 0, fmt.Errorf("truncated bitmap")
+	}
+	// Runs and literals may not go past the words the bit count needs,
+	// so that a corrupt bitmap cannot make us allocate more.
+	words := (uint64(binary.BigEndian.Uint32(data[0:])) + 63) / 64
+	n := int(binary.BigEndian.Uint32(data[4:]))
+	end := 8 + 8*n + 4
+	if n < 0 || len(data) < end {
+		return nil, 0, fmt.Errorf("truncated bitmap")
+	}
+
+	var b bitmap
+	for i := 0; i < n; {
+		marker := binary.BigEndian.Uint64(data[8+8*i:])
+		var fill uint64
+		if marker&1 != 0 {
+			fill = ^uint64(0)
+		}
+		run := (marker >> 1) & (1<<32 - 1)
+		literals := int(marker >> 33)
+		if i+1+literals > n || uint64(len(b))+run+uint64(literals) > words {
+			return nil, 0, fmt.Errorf("corrupt bitmap")
+		}
+		for ; run > 0; run-- {
+			b = append(b, fill)
+		}
+		for j := 1; j <= literals; j++ {
+			b = append(b, binary.BigEndian.Uint64(data[8+8*(i+j):]))
+		}
+		i += 1 + literals
+	}
+	return b, end, nil
+}
+
+// packOrder returns the index positions of a pack's objects in the order
+// they are stored, which is the order of the bits in its bitmaps.
+func packOrder(idx *packIndex) []int {
+	order := make([]int, idx.count)
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return idx.offsetAt(order[i]) < idx.offsetAt(order[j]) })
+	return order
+}
+
+// packBitmap is the decoded .bitmap file of a pack: which objects are
+// of each type, and which objects each of a selection of commits can
+// reach.
+type packBitmap struct {
+	pack *pack
+	// order maps bits to index positions and bitAt index positions back
+	// to bits.
+	order []int
+	bitAt []int
+	// types holds the commits, trees, blobs and tags, in that order.
+	types   [4]bitmap
+	commits map[objectID]bitmap
+}
+
+var bitmapTypes = [4]string{commitObject, treeObject, blobObject, tagObject}
+
+func readPackBitmap(p *pack) (*packBitmap, error) {
+	path := strings.TrimSuffix(p.path, ".pack") + ".bitmap"
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bitmap: %w", err)
+	}
+	headerSize := 12 + hashAlgo.size
+	if len(data) < headerSize+hashAlgo.size || string(data[:4]) != bitmapSignature {
+		return nil, fmt.Errorf("corrupted bitmap index file (wrong header)")
+	}
+	if version := binary.BigEndian.Uint16(data[4:]); version != bitmapVersion {
+		return nil, fmt.Errorf("unsupported version '%d' for bitmap index file", version)
+	}
+	flags := binary.BigEndian.Uint16(data[6:])
+	if flags&bitmapFullDAG == 0 {
+		return nil, fmt.Errorf("unsupported options for bitmap index file (Git requires BITMAP_OPT_FULL_DAG)")
+	}
+	count := int(binary.BigEndian.Uint32(data[8:]))
+	packSum := p.idx.data[len(p.idx.data)-2*hashAlgo.size : len(p.idx.data)-hashAlgo.size]
+	if !bytes.Equal(data[12:headerSize], packSum) {
+		return nil, fmt.Errorf("checksum doesn't match in pack and bitmap")
+	}
+
+	bm := &packBitmap{pack: p, order: packOrder(p.idx), commits: make(map[objectID]bitmap, count)}
+	bm.bitAt = make([]int, len(bm.order))
+	for bit, i := range bm.order {
+		bm.bitAt[i] = bit
+	}
+
+	rest := data[headerSize : len(data)-hashAlgo.size]
+	for i := range bm.types {
+		b, n, err := decodeEWAH(rest)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load bitmap index (corrupted?)")
+		}
+		bm.types[i], rest = b, rest[n:]
+	}
+
+	// An entry may be stored xored with the one a few entries before it.
+	entries := make([]bitmap, 0, count)
+	for i := 0; i < count; i++ {
+		if len(rest) < 6 {
+			return nil, fmt.Errorf("corrupt ewah bitmap: truncated header for entry %d", i)
+		}
+		pos := int(binary.BigEndian.Uint32(rest))
+		xor := int(rest[4])
+		if pos >= p.idx.count || xor > i {
+			return nil, fmt.Errorf("corrupted bitmap pack index")
+		}
+		b, n, err := decodeEWAH(rest[6:])
+		if err != nil {
+			return nil, fmt.Errorf("corrupt ewah bitmap: commit index %d out of range", i)
+		}
+		rest = rest[6+n:]
+		if xor > 0 {
+			base := entries[i-xor]
+			for len(b) < len(base) {
+				b = append(b, 0)
+			}
+			for j, w := range base {
+				b[j] ^= w
+			}
+		}
+		entries = append(entries, b)
+		bm.commits[p.idx.hashAt(pos)] = b
+	}
+	return bm, nil
+}
+
+// loadPackBitmap returns the bitmap of the first pack that has one, or
+// nil when there is none, pack.useBitmaps is off or the repository is
+// shallow. A broken bitmap is reported and left unused.
+func loadPackBitmap(cfg *config) (*packBitmap, error) {
+	if use, err := cfg.getBool("pack.useBitmaps", true); err != nil || !use {
+		return nil, err
+	}
+	if shallow, err := readShallow(); err != nil || len(shallow) > 0 {
+		return nil, err
+	}
+	packs, err := openPacks()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packs {
+		if _, err := os.Stat(strings.TrimSuffix(p.path, ".pack") + ".bitmap"); errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		bm, err := readPackBitmap(p)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return nil, nil
+		}
+		return bm, nil
+	}
+	return nil, nil
+}
+
+// bitOf returns the bit of hash, and false when it is not in the pack.
+func (bm *packBitmap) bitOf(hash objectID) (int, bool) {
+	i, ok := bm.pack.idx.find(hash)
+	if !ok {
+		return 0, false
+	}
+	return bm.bitAt[i], true
+}
+
+// bitmapReach is what a set of tips can reach: the objects of the pack
+// as bits and the others, by type, in the order they were found.
+type bitmapReach struct {
+	bits       bitmap
+	extra      map[objectID]string
+	extraOrder []objectID
+}
+
+// reach collects everything reachable from tips. The bitmaps of commits
+// that have one stand in for their whole history; anything else is read.
+func (bm *packBitmap) reach(tips []objectID) (*bitmapReach, error) {
+	r := &bitmapReach{extra: make(map[objectID]string)}
+	type item struct {
+		hash    objectID
+		objType string
+	}
+	var pending []item
+	for _, tip := range tips {
+		pending = append(pending, item{hash: tip})
+	}
+
+	for len(pending) > 0 {
+		it := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		bit, inPack := bm.bitOf(it.hash)
+		if inPack && r.bits.get(bit) {
+			continue
+		}
+		if _, ok := r.extra[it.hash]; !inPack && ok {
+			continue
+		}
+		if b, ok := bm.commits[it.hash]; ok {
+			r.bits.or(b)
+			continue
+		}
+
+		objType, content := it.objType, []byte(nil)
+		if objType != blobObject {
+			var err error
+			if objType, content, err = readObject(it.hash); err != nil {
+				return nil, err
+			}
+		}
+		if inPack {
+			r.bits.set(bit)
+		} else {
+			r.extra[it.hash] = objType
+			r.extraOrder = append(r.extraOrder, it.hash)
+		}
+
+		switch objType {
+		case commitObject:
+			c, err := parseCommit(content)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, item{hash: c.tree, objType: treeObject})
+			for _, parent := range c.parents {
+				pending = append(pending, item{hash: parent, objType: commitObject})
+			}
+		case treeObject:
+			entries, err := parseTree(content)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				switch entry.mode {
+				case gitlinkMode:
+				case "40000":
+					pending = append(pending, item{hash: entry.hash, objType: treeObject})
+				default:
+					pending = append(pending, item{hash: entry.hash, objType: blobObject})
+				}
+			}
+		case tagObject:
+			t, err := parseTag(content)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, item{hash: t.object})
+		}
+	}
+	return r, nil
+}
+
+// bitmapObjects lists the objects reachable from include but not from
+// exclude: those of the pack by type, commits first, and in pack order,
+// then the others. Unlike
+// listObjects, it excludes everything exclude reaches and leaves the
+// names of trees and blobs empty. With commitsOnly only commits are
+// listed.
+func (bm *packBitmap) bitmapObjects(include, exclude []objectID, commitsOnly bool) ([]namedObject, error) {
+	want, err := bm.reach(include)
+	if err != nil {
+		return nil, err
+	}
+	var present []objectID
+	for _, hash := range exclude {
+		if hasObject(hash) {
+			present = append(present, hash)
+		}
+	}
+	have, err := bm.reach(present)
+	if err != nil {
+		return nil, err
+	}
+
+	want.bits.andNot(have.bits)
+	var list []namedObject
+	for t, b := range bm.types {
+		if commitsOnly && t > 0 {
+			break
+		}
+		of := append(bitmap(nil), want.bits...)
+		of.andNot(complementOf(b, len(of)))
+		of.forEach(func(bit int) {
+			list = append(list, namedObject{hash: bm.pack.idx.hashAt(bm.order[bit])})
+		})
+	}
+	for _, hash := range want.extraOrder {
+		if _, ok := have.extra[hash]; ok || commitsOnly && want.extra[hash] != commitObject {
+			continue
+		}
+		list = append(list, namedObject{hash: hash})
+	}
+	return list, nil
+}
+
+// complementOf returns the first n words of the positions b does not have.
+func complementOf(b bitmap, n int) bitmap {
+	c := make(bitmap, n)
+	for i := range c {
+		c[i] = ^uint64(0)
+		if i < len(b) {
+			c[i] = ^b[i]
+		}
+	}
+	return c
+}
+
+// buildPackBitmap computes the bitmap of the pack at path for the commits
+// reachable from tips. Every ref tip commit gets a bitmap, as does one
+// commit out of bitmapCommitInterval in the history. They are computed
+// oldest first so that later ones start from the bitmaps of their
+// ancestors. It fails with errBitmapIncomplete when tips reach objects
+// outside the pack.
+func buildPackBitmap(p *pack, tips []objectID) (*packBitmap, error) {
+	bm := &packBitmap{pack: p, order: packOrder(p.idx), commits: make(map[objectID]bitmap)}
+	bm.bitAt = make([]int, len(bm.order))
+	for bit, i := range bm.order {
+		bm.bitAt[i] = bit
+		info, err := p.entryInfo(p.idx.offsetAt(i))
+		if err != nil {
+			return nil, err
+		}
+		for t, name := range bitmapTypes {
+			if info.objType == name {
+				bm.types[t].set(bit)
+			}
+		}
+	}
+
+	tipCommits := make(map[objectID]bool)
+	var commitTips []objectID
+	for _, tip := range tips {
+		hash, ok, err := peelToCommit(tip)
+		if err != nil {
+			return nil, err
+		}
+		if ok && !tipCommits[hash] {
+			tipCommits[hash] = true
+			commitTips = append(commitTips, hash)
+		}
+	}
+	var selected []objectID
+	n := 0
+	err := walkCommitNodes(commitTips, func(hash objectID, node *commitNode) error {
+		if tipCommits[hash] || n%bitmapCommitInterval == 0 {
+			selected = append(selected, hash)
+		}
+		n++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(selected) - 1; i >= 0; i-- {
+		b, err := bm.closure(selected[i])
+		if err != nil {
+			return nil, err
+		}
+		bm.commits[selected[i]] = b
+	}
+	return bm, nil
+}
+
+// closure returns the bitmap of everything commit reaches, reusing the
+// bitmaps computed so far.
+func (bm *packBitmap) closure(commit objectID) (bitmap, error) {
+	var b bitmap
+	var markTree func(hash objectID) error
+	markTree = func(hash objectID) error {
+		bit, ok := bm.bitOf(hash)
+		if !ok {
+			return errBitmapIncomplete
+		}
+		if b.get(bit) {
+			return nil
+		}
+		b.set(bit)
+		_, content, err := readObject(hash)
+		if err != nil {
+			return err
+		}
+		entries, err := parseTree(content)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			switch entry.mode {
+			case gitlinkMode:
+			case "40000":
+				if err := markTree(entry.hash); err != nil {
+					return err
+				}
+			default:
+				bit, ok := bm.bitOf(entry.hash)
+				if !ok {
+					return errBitmapIncomplete
+				}
+				b.set(bit)
+			}
+		}
+		return nil
+	}
+
+	pending := []objectID{commit}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		bit, ok := bm.bitOf(hash)
+		if !ok {
+			return nil, errBitmapIncomplete
+		}
+		if b.get(bit) {
+			continue
+		}
+		if done, ok := bm.commits[hash]; ok {
+			b.or(done)
+			continue
+		}
+		b.set(bit)
+		c, err := readCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		if err := markTree(c.tree); err != nil {
+			return nil, err
+		}
+		pending = append(pending, c.parents...)
+	}
+	return b, nil
+}
+
+// encode serializes bm with the name hash of each object, written like
+// git: version 1 with the full history and a name-hash cache.
+func (bm *packBitmap) encode(names map[objectID]string) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(bitmapSignature)
+	binary.Write(&buf, binary.BigEndian, uint16(bitmapVersion))
+	binary.Write(&buf, binary.BigEndian, uint16(bitmapFullDAG|bitmapHashCache))
+	binary.Write(&buf, binary.BigEndian, uint32(len(bm.commits)))
+	idx := bm.pack.idx
+	buf.Write(idx.data[len(idx.data)-2*hashAlgo.size : len(idx.data)-hashAlgo.size])
+
+	for _, b := range bm.types {
+		buf.Write(encodeEWAH(b))
+	}
+	var positions []int
+	for hash := range bm.commits {
+		i, _ := idx.find(hash)
+		positions = append(positions, i)
+	}
+	sort.Ints(positions)
+	for _, i := range positions {
+		binary.Write(&buf, binary.BigEndian, uint32(i))
+		// Neither xor offset nor flags.
+		buf.Write([]byte{0, 0})
+		buf.Write(encodeEWAH(bm.commits[idx.hashAt(i)]))
+	}
+	for _, i := range bm.order {
+		binary.Write(&buf, binary.BigEndian, packNameHash(names[idx.hashAt(i)]))
+	}
+
+	sum := hashAlgo.new()
+	sum.Write(buf.Bytes())
+	buf.Write(sum.Sum(nil))
+	return buf.Bytes()
+}
+
+// writePackBitmap writes the bitmap of the pack at packPath next to it.
+func writePackBitmap(packPath string, tips []objectID, names map[objectID]string) error {
+	p, err := openPack(packPath)
+	if err != nil {
+		return err
+	}
+	defer p.retire()
+	bm, err := buildPackBitmap(p, tips)
+	if err != nil {
+		return err
+	}
+
+	path := strings.TrimSuffix(packPath, ".pack") + ".bitmap"
+	lock := path + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("failed to lock bitmap: %w", err)
+	}
+	if _, err := f.Write(bm.encode(names)); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return fmt.Errorf("failed to write bitmap: %w", err)
+	}
+	if err := fsyncFile(f, fsyncPackMetadata); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to write bitmap: %w", err)
+	}
+	if err := os.Rename(lock, path); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to install bitmap: %w", err)
+	}
+	return nil
+}
+
+// objectsToPack lists the objects a pack sent to another repository needs
+// to hold, with the help of the pack bitmap when there is one.
+func objectsToPack(cfg *config, include, exclude []objectID) ([]namedObject, error) {
+	bm, err := loadPackBitmap(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if bm == nil {
+		return listObjects(include, exclude)
+	}
+	return bm.bitmapObjects(include, exclude, false)
+}
@@ -0,0 +1,40 @@
+package mygit
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestEWAHRoundTrip(t *testing.T) {
+	var b bitmap
+	for _, i := range []int{0, 3, 64, 200, 64*40 + 1, 64 * 100} {
+		for len(b) <= i/64 {
+			b = append(b, 0)
+		}
+		b[i/64] |= 1 << (i % 64)
+	}
+	b[50] = ^uint64(0)
+	got, n, err := decodeEWAH(encodeEWAH(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(encodeEWAH(b)) || len(got) != len(b) {
+		t.Fatalf("decoded %d words from %d bytes, want %d words", len(got), n, len(b))
+	}
+	for i := range b {
+		if got[i] != b[i] {
+			t.Errorf("word %d: got %x, want %x", i, got[i], b[i])
+		}
+	}
+}
+
+func TestDecodeEWAHRunPastSize(t *testing.T) {
+	// 64 bits, but one marker word with a run of 2^32-1 set words.
+	data := make([]byte, 8+8+4)
+	binary.BigEndian.PutUint32(data[0:], 64)
+	binary.BigEndian.PutUint32(data[4:], 1)
+	binary.BigEndian.PutUint64(data[8:], (1<<32-1)<<1|1)
+	if _, _, err := decodeEWAH(data); err == nil {
+		t.Fatal("decoded a run past the bit count")
+	}
+}
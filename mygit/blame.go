@@ -0,0 +1,437 @@
+package mygit
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// blameEntry is a run of count lines of the final file, from line start,
+// that are blamed on suspect so far. They start at line sourceStart in
+// the suspect's version of the file.
+type blameEntry struct {
+	start, count int
+	sourceStart  int
+	suspect      objectID
+}
+
+// blameSuspect is a commit lines can be blamed on, with its version of
+// the file.
+type blameSuspect struct {
+	commit *commit
+	file   diffEntry
+	lines  []string
+	// boundary marks commits whose history is not looked into.
+	boundary bool
+}
+
+// blameRange is a run of lines that a commit and its parent share.
+type blameRange struct {
+	start, parentStart, count int
+}
+
+// blameScoreboard holds the state of a blame: the entries still being
+// passed down the history and those that reached the commit that
+// introduced them.
+type blameScoreboard struct {
+	path     string
+	suspects map[objectID]*blameSuspect
+	queue    commitQueue
+	pending  []*blameEntry
+	done     []*blameEntry
+	root     bool
+	shallow  map[objectID]bool
+	// flags are the whitespace options lines are compared under.
+	flags diffFlags
+}
+
+// suspect loads a commit's version of the file and queues it. The zero
+// ID stands for the working tree, which is loaded by the caller.
+func (sb *blameScoreboard) suspect(hash objectID) (*blameSuspect, error) {
+	if s, ok := sb.suspects[hash]; ok {
+		return s, nil
+	}
+	c, err := readCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	file, err := treeEntryAt(c.tree, sb.path)
+	if err != nil {
+		return nil, err
+	}
+	s := &blameSuspect{commit: c, file: file}
+	s.boundary = sb.shallow[hash] || len(c.parents) == 0 && !sb.root
+	sb.suspects[hash] = s
+	heap.Push(&sb.queue, queuedCommit{hash: hash, commit: c, time: identTimestamp(c.committer), seq: len(sb.suspects)})
+	return s, nil
+}
+
+func (s *blameSuspect) load() error {
+	if s.lines != nil {
+		return nil
+	}
+	data, err := s.file.content()
+	if err != nil {
+		return err
+	}
+	s.lines = splitLines(data)
+	return nil
+}
+
+// sharedRanges lists the runs of lines that are unchanged from parent to
+// child.
+func sharedRanges(parent, child []string, flags diffFlags) []blameRange {
+	var ranges []blameRange
+	p, c := 0, 0
+	for _, change := range diffLines(parent, child, flags) {
+		if n := change.i2 - c; n > 0 {
+			ranges = append(ranges, blameRange{start: c, parentStart: p, count: n})
+		}
+		p, c = change.i1+change.n1, change.i2+change.n2
+	}
+	if n := len(child) - c; n > 0 {
+		ranges = append(ranges, blameRange{start: c, parentStart: p, count: n})
+	}
+	return ranges
+}
+
+// passToParent hands the lines of e that parent shares, as listed by
+// ranges, over to parent. It returns the entries e splits into.
+func passToParent(e *blameEntry, ranges []blameRange, parent objectID) []*blameEntry {
+	var parts []*blameEntry
+	split := func(sourceStart, end int, suspect objectID, offset int) {
+		if end <= sourceStart {
+			return
+		}
+		parts = append(parts, &blameEntry{
+			start:       e.start + sourceStart - e.sourceStart,
+			count:       end - sourceStart,
+			sourceStart: sourceStart + offset,
+			suspect:     suspect,
+		})
+	}
+	pos, end := e.sourceStart, e.sourceStart+e.count
+	for _, r := range ranges {
+		from, to := max(pos, r.start), min(end, r.start+r.count)
+		if from >= to {
+			continue
+		}
+		split(pos, from, e.suspect, 0)
+		split(from, to, parent, r.parentStart-r.start)
+		pos = to
+	}
+	split(pos, end, e.suspect, 0)
+	return parts
+}
+
+// passBlame looks at the parents of a suspect for the lines blamed on it.
+// A parent with the same file takes them all; otherwise each parent in
+// turn takes the lines it shares, and the rest stay with the suspect.
+func (sb *blameScoreboard) passBlame(hash objectID, s *blameSuspect) error {
+	var mine, others []*blameEntry
+	for _, e := range sb.pending {
+		if e.suspect == hash {
+			mine = append(mine, e)
+		} else {
+			others = append(others, e)
+		}
+	}
+	sb.pending = others
+	if len(mine) == 0 {
+		return nil
+	}
+
+	var parents []*blameSuspect
+	if !s.boundary {
+		for _, parent := range s.commit.parents {
+			p, err := sb.suspect(parent)
+			if err != nil {
+				return err
+			}
+			if p.file.mode != 0 && p.file.hash == s.file.hash {
+				for _, e := range mine {
+					e.suspect = parent
+				}
+				sb.pending = append(sb.pending, mine...)
+				return nil
+			}
+			parents = append(parents, p)
+		}
+	}
+
+	for i, p := range parents {
+		if p.file.mode == 0 {
+			continue
+		}
+		if err := s.load(); err != nil {
+			return err
+		}
+		if err := p.load(); err != nil {
+			return err
+		}
+		ranges := sharedRanges(p.lines, s.lines, sb.flags)
+		var kept []*blameEntry
+		for _, e := range mine {
+			for _, part := range passToParent(e, ranges, s.commit.parents[i]) {
+				if part.suspect == hash {
+					kept = append(kept, part)
+				} else {
+					sb.pending = append(sb.pending, part)
+				}
+			}
+		}
+		mine = kept
+	}
+	sb.done = append(sb.done, mine...)
+	return nil
+}
+
+// run passes the blame down the history, newest commits first, until
+// every line has found the commit that introduced it.
+func (sb *blameScoreboard) run() error {
+	for sb.queue.Len() > 0 {
+		item := heap.Pop(&sb.queue).(queuedCommit)
+		if err := sb.passBlame(item.hash, sb.suspects[item.hash]); err != nil {
+			return err
+		}
+	}
+	sort.Slice(sb.done, func(i, j int) bool { return sb.done[i].start < sb.done[j].start })
+	return nil
+}
+
+// parseBlameRange parses a -L argument, "<start>,<end>" where either
+// can be left out and end can be "+<count>" or "-<count>", into the
+// zero-based lines it covers in a file of path with the given number of
+// lines.
+func parseBlameRange(arg, path string, lines int) (int, int, error) {
+	first, second, _ := strings.Cut(arg, ",")
+	start, end := 1, lines
+	invalid := fmt.Errorf("invalid -L argument '%s'", arg)
+	if first != "" {
+		n, err := strconv.Atoi(first)
+		if err != nil || n < 1 {
+			return 0, 0, invalid
+		}
+		start = n
+	}
+	if start > lines {
+		if lines == 1 {
+			return 0, 0, fmt.Errorf("file %s has only 1 line", path)
+		}
+		return 0, 0, fmt.Errorf("file %s has only %d lines", path, lines)
+	}
+	switch {
+	case second == "":
+	case strings.HasPrefix(second, "+"), strings.HasPrefix(second, "-"):
+		n, err := strconv.Atoi(second[1:])
+		if err != nil {
+			return 0, 0, invalid
+		}
+		if second[0] == '+' {
+			end = start + max(n, 1) - 1
+		} else {
+			end, start = start, max(start-max(n, 1)+1, 1)
+		}
+	default:
+		n, err := strconv.Atoi(second)
+		if err != nil || n < 1 {
+			return 0, 0, invalid
+		}
+		end = n
+	}
+	if end < start {
+		start, end = end, start
+	}
+	return start - 1, min(end, lines), nil
+}
+
+func runBlame(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	date := dateMode{style: dateISO}
+	if value, ok := cfg.get("blame.date"); ok {
+		if date, err = parseDateMode(value); err != nil {
+			return err
+		}
+	}
+	root, err := cfg.getBool("blame.showRoot", false)
+	if err != nil {
+		return err
+	}
+	var ranges, names []string
+	long, suppress, email := false, false, false
+	var flags diffFlags
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			names = append(names, args[i+1:]...)
+			i = len(args)
+		case arg == "-L":
+			if i+1 == len(args) {
+				return fmt.Errorf("switch 'L' requires a value")
+			}
+			i++
+			ranges = append(ranges, args[i])
+		case strings.HasPrefix(arg, "-L"):
+			ranges = append(ranges, strings.TrimPrefix(arg, "-L"))
+		case arg == "-l":
+			long = true
+		case arg == "-s":
+			suppress = true
+		case arg == "-e" || arg == "--show-email":
+			email = true
+		case arg == "--root":
+			root = true
+		case arg == "-w":
+			flags |= diffIgnoreAllSpace
+		case strings.HasPrefix(arg, "--date="):
+			if date, err = parseDateMode(strings.TrimPrefix(arg, "--date=")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+
+	var rev, path string
+	switch len(names) {
+	case 1:
+		path = names[0]
+	case 2:
+		rev, path = names[0], names[1]
+	default:
+		return fmt.Errorf("usage: mygit blame [-L <range>] [-l] [-s] [-e] [--root] [-w] [<rev>] [--] <file>")
+	}
+	path = filepath.ToSlash(filepath.Clean(path))
+
+	shallow, err := readShallow()
+	if err != nil {
+		return err
+	}
+	sb := &blameScoreboard{path: path, suspects: make(map[objectID]*blameSuspect), root: root, shallow: shallow, flags: flags}
+	var final *blameSuspect
+	var finalHash objectID
+	now := time.Now()
+	if rev != "" {
+		if finalHash, err = resolveCommit(rev); err != nil {
+			return fmt.Errorf("bad revision '%s'", rev)
+		}
+		if final, err = sb.suspect(finalHash); err != nil {
+			return err
+		}
+		if final.file.mode == 0 {
+			return fmt.Errorf("no such path %s in %s", path, rev)
+		}
+	} else {
+		// Changes in the working tree are blamed on a commit yet to be made
+		// on top of HEAD.
+		head, err := resolveRef("HEAD")
+		if err != nil {
+			return err
+		}
+		headSuspect, err := sb.suspect(head)
+		if err != nil {
+			return err
+		}
+		if headSuspect.file.mode == 0 {
+			return fmt.Errorf("no such path '%s' in HEAD", path)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("cannot stat path '%s': %w", path, err)
+		}
+		ident := "Not Committed Yet <not.committed.yet> " + formatIdentDate(now)
+		final = &blameSuspect{
+			commit: &commit{parents: []objectID{head}, author: ident, committer: ident},
+			file:   diffEntry{mode: headSuspect.file.mode, hash: hashObjectData(blobObject, data), data: data},
+		}
+		sb.suspects[finalHash] = final
+		heap.Push(&sb.queue, queuedCommit{commit: final.commit, time: now.Unix()})
+	}
+	if err := final.load(); err != nil {
+		return err
+	}
+
+	if len(ranges) == 0 {
+		ranges = append(ranges, "1,")
+	}
+	covered := make([]bool, len(final.lines))
+	for _, arg := range ranges {
+		start, end, err := parseBlameRange(arg, path, len(final.lines))
+		if err != nil {
+			return err
+		}
+		for i := start; i < end; i++ {
+			covered[i] = true
+		}
+	}
+	for i := 0; i < len(covered); {
+		if !covered[i] {
+			i++
+			continue
+		}
+		e := &blameEntry{start: i, sourceStart: i, suspect: finalHash}
+		for i < len(covered) && covered[i] {
+			e.count++
+			i++
+		}
+		sb.pending = append(sb.pending, e)
+	}
+	if err := sb.run(); err != nil {
+		return err
+	}
+
+	// Columns are as wide as the widest author and line number shown.
+	authorWidth, lineWidth := 0, 1
+	author := func(s *blameSuspect) string {
+		name, mail, _ := parseIdent(s.commit.author)
+		if email {
+			return "<" + mail + ">"
+		}
+		return name
+	}
+	for _, e := range sb.done {
+		authorWidth = max(authorWidth, utf8.RuneCountInString(author(sb.suspects[e.suspect])))
+		lineWidth = max(lineWidth, len(strconv.Itoa(e.start+e.count)))
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	for _, e := range sb.done {
+		s := sb.suspects[e.suspect]
+		hex := e.suspect.String()
+		if !long {
+			hex = hex[:8]
+		}
+		if s.boundary {
+			hex = "^" + hex[:len(hex)-1]
+		}
+		name := author(s)
+		name += strings.Repeat(" ", authorWidth-utf8.RuneCountInString(name))
+		_, _, when := parseIdent(s.commit.author)
+		for i := 0; i < e.count; i++ {
+			line := final.lines[e.start+i]
+			if !strings.HasSuffix(line, "\n") {
+				line += "\n"
+			}
+			if suppress {
+				fmt.Fprintf(out, "%s %*d) %s", hex, lineWidth, e.start+i+1, line)
+			} else {
+				fmt.Fprintf(out, "%s (%s %s %*d) %s", hex, name, formatDate(when, date, now), lineWidth, e.start+i+1, line)
+			}
+		}
+	}
+	return nil
+}
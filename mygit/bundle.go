@@ -0,0 +1,407 @@
+package mygit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+const (
+	bundleV2Signature = "# v2 git bundle\n"
+	bundleV3Signature = "# v3 git bundle\n"
+)
+
+// bundleHeader is what a bundle file says before its pack: the commits
+// the pack builds upon, which the receiving repository must have, and the
+// refs it carries.
+type bundleHeader struct {
+	version       int
+	format        *hashAlgorithm
+	prerequisites []objectID
+	refs          []advertisedRef
+}
+
+// readBundleHeader parses a bundle header up to the blank line before the
+// pack.
+func readBundleHeader(r *bufio.Reader) (*bundleHeader, error) {
+	sig, err := r.ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read bundle: %w", err)
+	}
+	h := &bundleHeader{}
+	switch sig {
+	case bundleV2Signature:
+		h.version = 2
+	case bundleV3Signature:
+		h.version = 3
+	default:
+		return nil, fmt.Errorf("not a bundle file")
+	}
+
+	format := sha1Algorithm
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("failed to read bundle header: %w", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			break
+		}
+		if capability, ok := strings.CutPrefix(line, "@"); ok {
+			if h.version < 3 {
+				return nil, fmt.Errorf("unexpected capability %q in v2 bundle", capability)
+			}
+			if name, ok := strings.CutPrefix(capability, "object-format="); ok {
+				if format, err = lookupHashAlgorithm(name); err != nil {
+					return nil, err
+				}
+			} else {
+				return nil, fmt.Errorf("unknown capability '%s'", capability)
+			}
+			continue
+		}
+		value, prerequisite := strings.CutPrefix(line, "-")
+		hexHash, name, _ := strings.Cut(value, " ")
+		hash, err := parseHash(hexHash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bundle header line %q: %w", line, err)
+		}
+		if prerequisite {
+			h.prerequisites = append(h.prerequisites, hash)
+		} else {
+			h.refs = append(h.refs, advertisedRef{name: name, hash: hash})
+		}
+	}
+	if format != hashAlgo {
+		return nil, fmt.Errorf("mismatched object format: bundle uses %s, repository uses %s", format.name, hashAlgo.name)
+	}
+	h.format = format
+	return h, nil
+}
+
+// missingPrerequisites returns the prerequisites of h that the repository
+// does not have as commits.
+func missingPrerequisites(h *bundleHeader) []objectID {
+	var missing []objectID
+	for _, hash := range h.prerequisites {
+		if objType, _, err := readObject(hash); err != nil || objType != commitObject {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
+}
+
+// isBundle reports whether path names a bundle file, which fetch and clone
+// read instead of talking to a remote.
+func isBundle(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	sig := make([]byte, len(bundleV2Signature))
+	if _, err := io.ReadFull(f, sig); err != nil {
+		return false
+	}
+	return string(sig) == bundleV2Signature || string(sig) == bundleV3Signature
+}
+
+// readBundleFile returns the header of the bundle at path.
+func readBundleFile(path string) (*bundleHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open '%s': %w", path, err)
+	}
+	defer f.Close()
+	return readBundleHeader(bufio.NewReader(f))
+}
+
+// unbundle stores the pack of the bundle at path, once the repository is
+// known to have its prerequisites.
+func unbundle(path string) (*bundleHeader, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open '%s': %w", path, err)
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	h, err := readBundleHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if missing := missingPrerequisites(h); len(missing) > 0 {
+		var lines []string
+		for _, hash := range missing {
+			lines = append(lines, hash.String())
+		}
+		return nil, fmt.Errorf("Repository lacks these prerequisite commits:\n%s", strings.Join(lines, "\n"))
+	}
+	if _, err := receivePack(r); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// bundleRefName returns the ref a revision argument names, if it is one.
+func bundleRefName(name string) (string, bool, error) {
+	if name == "HEAD" {
+		return name, true, nil
+	}
+	for _, pattern := range refSearchOrder {
+		ref := fmt.Sprintf(pattern, name)
+		if _, err := resolveRef(ref); err == nil {
+			return ref, strings.HasPrefix(ref, "refs/"), nil
+		} else if !errors.Is(err, errRefNotFound) {
+			return "", false, err
+		}
+	}
+	return "", false, nil
+}
+
+// createBundle writes the objects selected by the revision arguments to a
+// bundle at path, with the refs among the arguments. Commits left out
+// that the bundled ones build upon become prerequisites.
+func createBundle(cfg *config, path string, args []string) error {
+	var include, exclude []objectID
+	var refs []advertisedRef
+	seen := make(map[string]bool)
+	addRef := func(name string, hash objectID) {
+		if !seen[name] {
+			seen[name] = true
+			refs = append(refs, advertisedRef{name: name, hash: hash})
+		}
+	}
+	for _, arg := range args {
+		if arg == "--all" {
+			all, err := listRefs()
+			if err != nil {
+				return err
+			}
+			var names []string
+			for name := range all {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			if head, err := resolveRef("HEAD"); err == nil {
+				names = append(names, "HEAD")
+				all["HEAD"] = head
+			}
+			for _, name := range names {
+				include = append(include, all[name])
+				addRef(name, all[name])
+			}
+			continue
+		}
+		in, ex, err := parseRevisionArgs([]string{arg})
+		if err != nil {
+			return err
+		}
+		include, exclude = append(include, in...), append(exclude, ex...)
+		if len(in) == 0 {
+			continue
+		}
+		// The tip of a range is recorded if it is a ref.
+		name := arg
+		if _, to, ok := strings.Cut(arg, ".."); ok {
+			name = strings.TrimPrefix(to, ".")
+			if name == "" {
+				name = "HEAD"
+			}
+		}
+		if ref, ok, err := bundleRefName(name); err != nil {
+			return err
+		} else if ok {
+			addRef(ref, in[0])
+		}
+	}
+
+	objects, err := listObjects(include, exclude)
+	if err != nil {
+		return err
+	}
+	if len(refs) == 0 || len(objects) == 0 {
+		return fmt.Errorf("Refusing to create empty bundle.")
+	}
+	listed := make(map[objectID]bool)
+	for _, o := range objects {
+		listed[o.hash] = true
+	}
+	var prerequisites []string
+	required := make(map[objectID]bool)
+	for _, o := range objects {
+		objType, content, err := readObject(o.hash)
+		if err != nil {
+			return err
+		}
+		if objType != commitObject {
+			continue
+		}
+		c, err := parseCommit(content)
+		if err != nil {
+			return fmt.Errorf("corrupt commit %x: %w", o.hash, err)
+		}
+		for _, parent := range c.parents {
+			if listed[parent] || required[parent] {
+				continue
+			}
+			required[parent] = true
+			p, err := readCommit(parent)
+			if err != nil {
+				return err
+			}
+			prerequisites = append(prerequisites, fmt.Sprintf("-%x %s\n", parent, commitSubject(p.message)))
+		}
+	}
+
+	packed, err := loadPackObjects(objects, true)
+	if err != nil {
+		return err
+	}
+	opts := packOptions{reuseDeltas: true}
+	if opts.window, err = cfg.getInt("pack.window", defaultPackWindow); err != nil {
+		return err
+	}
+	if opts.depth, err = cfg.getInt("pack.depth", defaultPackDepth); err != nil {
+		return err
+	}
+	computeDeltas(packed, opts)
+
+	lock := path + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create '%s': %w", lock, err)
+	}
+	defer os.Remove(lock)
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	if hashAlgo == sha1Algorithm {
+		w.WriteString(bundleV2Signature)
+	} else {
+		fmt.Fprintf(w, "%s@object-format=%s\n", bundleV3Signature, hashAlgo.name)
+	}
+	for _, line := range prerequisites {
+		w.WriteString(line)
+	}
+	for _, ref := range refs {
+		fmt.Fprintf(w, "%x %s\n", ref.hash, ref.name)
+	}
+	w.WriteString("\n")
+	if _, err := writePack(w, packed); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	if err := os.Rename(lock, path); err != nil {
+		return fmt.Errorf("failed to write bundle: %w", err)
+	}
+	return nil
+}
+
+// printBundleRefs writes the refs of a bundle, one "<hash> <name>" line
+// each, only those named if names are given.
+func printBundleRefs(refs []advertisedRef, names []string) {
+	for _, ref := range refs {
+		if len(names) == 0 || slices.Contains(names, ref.name) {
+			fmt.Printf("%s %s\n", ref.hash, ref.name)
+		}
+	}
+}
+
+// verifyBundle checks that the repository has what the bundle at path
+// builds upon and, unless quiet, describes the bundle like git does.
+func verifyBundle(path string, quiet bool) error {
+	if _, err := os.Stat(gitDir); err != nil {
+		return fmt.Errorf("need a repository to verify a bundle")
+	}
+	h, err := readBundleFile(path)
+	if err != nil {
+		return err
+	}
+	if missing := missingPrerequisites(h); len(missing) > 0 {
+		fmt.Fprintln(os.Stderr, "error: Repository lacks these prerequisite commits:")
+		for _, hash := range missing {
+			fmt.Fprintf(os.Stderr, "error: %s \n", hash)
+		}
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%s is okay\n", path)
+	if quiet {
+		return nil
+	}
+
+	refCount := func(n int) string {
+		if n == 1 {
+			return "this ref"
+		}
+		return fmt.Sprintf("these %d refs", n)
+	}
+	fmt.Printf("The bundle contains %s:\n", refCount(len(h.refs)))
+	printBundleRefs(h.refs, nil)
+	if len(h.prerequisites) == 0 {
+		fmt.Println("The bundle records a complete history.")
+	} else {
+		fmt.Printf("The bundle requires %s:\n", refCount(len(h.prerequisites)))
+		// Like git, the subjects recorded with them are left out.
+		for _, hash := range h.prerequisites {
+			fmt.Printf("%s \n", hash)
+		}
+	}
+	fmt.Printf("The bundle uses this hash algorithm: %s\n", h.format.name)
+	return nil
+}
+
+func runBundle(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mygit bundle (create <file> <git-rev-list args> | verify [-q] <file> | list-heads <file> [<refname>...])")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	switch args[0] {
+	case "create":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: mygit bundle create <file> <git-rev-list args>")
+		}
+		return createBundle(cfg, args[1], args[2:])
+	case "verify":
+		quiet := false
+		var rest []string
+		for _, arg := range args[1:] {
+			switch {
+			case arg == "-q" || arg == "--quiet":
+				quiet = true
+			case strings.HasPrefix(arg, "-"):
+				return fmt.Errorf("unknown option %s", arg)
+			default:
+				rest = append(rest, arg)
+			}
+		}
+		if len(rest) != 1 {
+			return fmt.Errorf("usage: mygit bundle verify [-q] <file>")
+		}
+		return verifyBundle(rest[0], quiet)
+	case "list-heads":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: mygit bundle list-heads <file> [<refname>...]")
+		}
+		h, err := readBundleFile(args[1])
+		if err != nil {
+			return err
+		}
+		printBundleRefs(h.refs, args[2:])
+		return nil
+	default:
+		return fmt.Errorf("Unknown subcommand: %s", args[0])
+	}
+}
@@ -0,0 +1,196 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const defaultBatchFormat = "%(objectname) %(objecttype) %(objectsize)"
+
+func runCatFile(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mygit cat-file (-p|-t|-s|-e) <object> | (--batch[=<format>] | --batch-check[=<format>]) [--batch-all-objects [--unordered]]")
+	}
+
+	if mode, _, _ := strings.Cut(args[0], "="); mode == "--batch" || mode == "--batch-check" || mode == "--batch-all-objects" {
+		return runCatFileBatch(args)
+	}
+
+	if len(args) < 2 {
+		return fmt.Errorf("usage: mygit cat-file (-p|-t|-s|-e) <object>")
+	}
+	hash, err := resolveRevision(args[1])
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "-p":
+		_, content, err := readObject(hash)
+		if err != nil {
+			return err
+		}
+		fmt.Print(string(content))
+	case "-t", "-s":
+		info, err := statObject(hash)
+		if err != nil {
+			return err
+		}
+		if args[0] == "-t" {
+			fmt.Println(info.objType)
+		} else {
+			fmt.Println(info.size)
+		}
+	case "-e":
+		if !hasObject(hash) {
+			os.Exit(1)
+		}
+	default:
+		return fmt.Errorf("unknown option %s", args[0])
+	}
+	return nil
+}
+
+// runCatFileBatch handles the batch modes of cat-file, reading the names
+// of objects from stdin or, with --batch-all-objects, going over every
+// object in the repository.
+func runCatFileBatch(args []string) error {
+	var format string
+	batch, contents, all, unordered := false, false, false, false
+	for _, arg := range args {
+		switch mode, value, ok := strings.Cut(arg, "="); {
+		case mode == "--batch" || mode == "--batch-check":
+			if batch {
+				return fmt.Errorf("options '--batch' and '--batch-check' cannot be used together")
+			}
+			batch, contents, format = true, mode == "--batch", defaultBatchFormat
+			if ok {
+				format = value
+			}
+		case arg == "--batch-all-objects":
+			all = true
+		case arg == "--unordered":
+			unordered = true
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+	if !batch {
+		return fmt.Errorf("'--batch-all-objects' requires a batch mode")
+	}
+	if !all {
+		return catFileBatch(format, contents)
+	}
+	return catFileAllObjects(format, contents, unordered)
+}
+
+// catFileAllObjects prints every object in the repository the way
+// catFileBatch does, sorted by name unless unordered.
+func catFileAllObjects(format string, contents, unordered bool) error {
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if unordered {
+		return forEachObject("", func(hash objectID, info *objectInfo) error {
+			return writeBatchObject(out, hash, info, format, contents)
+		})
+	}
+
+	type object struct {
+		hash objectID
+		info *objectInfo
+	}
+	var objects []object
+	err := forEachObject("", func(hash objectID, info *objectInfo) error {
+		objects = append(objects, object{hash, info})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		return bytes.Compare(objects[i].hash[:], objects[j].hash[:]) < 0
+	})
+	for _, o := range objects {
+		if err := writeBatchObject(out, o.hash, o.info, format, contents); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBatchObject prints the info line of an object, followed by its
+// content when contents is set.
+func writeBatchObject(out *bufio.Writer, hash objectID, info *objectInfo, format string, contents bool) error {
+	line, err := formatObjectInfo(format, hash, info, "")
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, line)
+	if contents {
+		_, content, err := readObject(hash)
+		if err != nil {
+			return err
+		}
+		out.Write(content)
+		out.WriteString("\n")
+	}
+	return nil
+}
+
+// catFileBatch answers one object query per line of stdin. With contents
+// set, each object's content follows its info line.
+func catFileBatch(format string, contents bool) error {
+	scanner := bufio.NewScanner(os.Stdin)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	for scanner.Scan() {
+		name, rest := scanner.Text(), ""
+		if strings.Contains(format, "%(rest)") {
+			name, rest, _ = strings.Cut(name, " ")
+		}
+
+		hash, err := resolveRevision(name)
+		if err != nil {
+			fmt.Fprintf(out, "%s missing\n", name)
+			out.Flush()
+			continue
+		}
+		info, err := statObject(hash)
+		if errors.Is(err, errObjectNotFound) {
+			fmt.Fprintf(out, "%s missing\n", name)
+			out.Flush()
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		line, err := formatObjectInfo(format, hash, info, rest)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, line)
+
+		if contents {
+			_, content, err := readObject(hash)
+			if err != nil {
+				return err
+			}
+			out.Write(content)
+			out.WriteString("\n")
+		}
+		out.Flush()
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read input: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,662 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// defaultParallelCheckoutThreshold is the fewest files checked out on
+// several goroutines, as in git.
+const defaultParallelCheckoutThreshold = 100
+
+// pathUpdate is the new state of a path in the index and the working
+// tree. A zero file mode removes the path. A conflict records its stages
+// in the index, base, ours and theirs, and only writes file to the
+// working tree. Likewise, an unstaged change records staged in the index
+// and leaves file as a change in the working tree.
+type pathUpdate struct {
+	file     diffEntry
+	conflict bool
+	stages   [3]diffEntry
+	unstaged bool
+	staged   diffEntry
+}
+
+// writeWorktreeFile replaces whatever is at path with file, creating the
+// leading directories.
+func writeWorktreeFile(path string, file diffEntry) error {
+	// Submodules are not checked out, only their directory exists. Their
+	// commit is not in this repository, and one already checked out
+	// stays.
+	if file.mode == modeGitlink {
+		if fi, err := os.Lstat(path); err == nil && !fi.IsDir() {
+			if err := os.Remove(path); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", path, err)
+			}
+		}
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return fmt.Errorf("failed to write %s: %w", path, err)
+		}
+		return nil
+	}
+	data, err := file.content()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+
+	switch file.mode {
+	case modeSymlink:
+		err = os.Symlink(string(data), path)
+	case modeExecutable:
+		if data, err = convertToWorktree(path, data); err == nil {
+			err = os.WriteFile(path, data, 0755)
+		}
+	default:
+		if data, err = convertToWorktree(path, data); err == nil {
+			err = os.WriteFile(path, data, 0644)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// removeWorktreeFile deletes path and then the directories it leaves
+// empty.
+func removeWorktreeFile(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", path, err)
+	}
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+	return nil
+}
+
+// checkWorktree refuses updates that would lose work: paths whose index
+// entry differs from both the current and the new state, paths with
+// changes in the working tree and untracked files in the way. head lists
+// the current commit's files; op names the command in the messages.
+func checkWorktree(cfg *config, entries []indexEntry, head map[string]diffEntry, updates map[string]pathUpdate, op string) error {
+	action := op
+	if op == "checkout" {
+		action = "switch branches"
+	}
+	index := make(map[string]indexEntry)
+	for _, e := range entries {
+		index[e.path] = e
+	}
+
+	var changed, untracked []string
+	var tracked []indexEntry
+	for path, u := range updates {
+		e, ok := index[path]
+		if !ok {
+			if u.file.mode != 0 {
+				if _, err := os.Lstat(path); err == nil {
+					untracked = append(untracked, path)
+				}
+			}
+			continue
+		}
+		h := head[path]
+		if (e.mode != h.mode || e.hash != h.hash) && (e.mode != u.file.mode || e.hash != u.file.hash) {
+			changed = append(changed, path)
+			continue
+		}
+		tracked = append(tracked, e)
+	}
+
+	// Files missing from the working tree are fine to update.
+	files, err := worktreeFiles(cfg, tracked)
+	if err != nil {
+		return err
+	}
+	// Submodules are left alone, whatever commit they have checked out.
+	for _, e := range tracked {
+		if f, ok := files[e.path]; ok && e.mode != modeGitlink && (f.mode != e.mode || f.hash != e.hash) {
+			changed = append(changed, e.path)
+		}
+	}
+
+	switch {
+	case len(changed) > 0:
+		sort.Strings(changed)
+		return fmt.Errorf("Your local changes to the following files would be overwritten by %s:\n\t%s\n"+
+			"Please commit your changes or stash them before you %s.\nAborting",
+			op, strings.Join(changed, "\n\t"), action)
+	case len(untracked) > 0:
+		sort.Strings(untracked)
+		return fmt.Errorf("The following untracked working tree files would be overwritten by %s:\n\t%s\n"+
+			"Please move or remove them before you %s.\nAborting",
+			op, strings.Join(untracked, "\n\t"), action)
+	}
+	return nil
+}
+
+// checkoutWorkers returns how many files to write at once when checking
+// out n of them: checkout.workers, one per CPU if it is less than one,
+// once n reaches checkout.thresholdForParallelism.
+func checkoutWorkers(n int) (int, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return 0, err
+	}
+	workers, err := cfg.getInt("checkout.workers", 1)
+	if err != nil {
+		return 0, err
+	}
+	threshold, err := cfg.getInt("checkout.thresholdForParallelism", defaultParallelCheckoutThreshold)
+	if err != nil {
+		return 0, err
+	}
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	if n < threshold {
+		return 1, nil
+	}
+	return min(workers, n), nil
+}
+
+// writeWorktreeFiles writes the files of paths, sorted, to the working
+// tree, on several goroutines if checkout.workers asks for it. The leading
+// directories are then made up front, parents first, so that the workers
+// only ever create files.
+func writeWorktreeFiles(paths []string, updates map[string]pathUpdate) error {
+	// A partial clone fetches the blobs it lacks all at once first.
+	if repoFormat.partialClone != "" {
+		var missing []objectID
+		for _, path := range paths {
+			if f := updates[path].file; f.mode != modeGitlink && f.data == nil && !hasObject(f.hash) {
+				missing = append(missing, f.hash)
+			}
+		}
+		if err := fetchPromisedObjects(missing); err != nil {
+			return err
+		}
+	}
+	workers, err := checkoutWorkers(len(paths))
+	if err != nil {
+		return err
+	}
+	if workers <= 1 {
+		for _, path := range paths {
+			if err := writeWorktreeFile(path, updates[path].file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	made := make(map[string]bool)
+	for _, path := range paths {
+		if dir := filepath.Dir(path); dir != "." && !made[dir] {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				return fmt.Errorf("failed to create directory: %w", err)
+			}
+			made[dir] = true
+		}
+	}
+
+	errs := make([]error, len(paths))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = writeWorktreeFile(paths[i], updates[paths[i]].file)
+			}
+		}()
+	}
+	for i := range paths {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	// The first failure in path order is reported, as it would have
+	// been writing one file at a time.
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// applyUpdates writes updates to the working tree and returns the index
+// entries with the updated paths replaced.
+func applyUpdates(entries []indexEntry, updates map[string]pathUpdate) ([]indexEntry, error) {
+	paths := make([]string, 0, len(updates))
+	for path := range updates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	// Removing first makes room for files replacing directories.
+	for _, path := range paths {
+		if u := updates[path]; u.file.mode == 0 {
+			if err := removeWorktreeFile(path); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var writes []string
+	for _, path := range paths {
+		if updates[path].file.mode != 0 {
+			writes = append(writes, path)
+		}
+	}
+	if err := writeWorktreeFiles(writes, updates); err != nil {
+		return nil, err
+	}
+
+	var result []indexEntry
+	for _, e := range entries {
+		if _, ok := updates[e.path]; !ok {
+			result = append(result, e)
+		}
+	}
+	for _, path := range paths {
+		u := updates[path]
+		if u.conflict {
+			for i, stage := range u.stages {
+				if stage.mode != 0 {
+					e, _ := newIndexEntry(path, i+1, stage)
+					result = append(result, e)
+				}
+			}
+			continue
+		}
+		if u.unstaged {
+			// Without stat data the entry never matches the working tree.
+			if u.staged.mode != 0 {
+				result = append(result, indexEntry{path: path, mode: u.staged.mode, hash: u.staged.hash})
+			}
+			continue
+		}
+		if u.file.mode != 0 {
+			e, err := newIndexEntry(path, 0, u.file)
+			if err != nil {
+				return nil, err
+			}
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// checkoutRevision switches HEAD to a branch, given by its short name, or
+// to a commit, detached, like git checkout: the index and the working tree
+// follow, keeping local changes that do not get in the way. Unless quiet,
+// it says what it did the way git does.
+func checkoutRevision(cfg *config, name string, quiet bool) error {
+	ref := "refs/heads/" + name
+	target, err := resolveRef(ref)
+	branch := err == nil
+	if !branch {
+		if !errors.Is(err, errRefNotFound) {
+			return err
+		}
+		if target, err = resolveCommit(name); err != nil {
+			return fmt.Errorf("pathspec '%s' did not match any file(s) known to git", name)
+		}
+	}
+	head, err := resolveRef("HEAD")
+	if err != nil {
+		return err
+	}
+	from, err := symrefTarget("HEAD")
+	if err != nil {
+		return err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	if _, unmerged := indexFiles(entries); len(unmerged) > 0 {
+		return fmt.Errorf("you need to resolve your current index first")
+	}
+	old, err := commitFiles(head)
+	if err != nil {
+		return err
+	}
+	new, err := commitFiles(target)
+	if err != nil {
+		return err
+	}
+	updates := treeUpdates(old, new)
+	if err := checkWorktree(cfg, entries, old, updates, "checkout"); err != nil {
+		return err
+	}
+	if entries, err = applyUpdates(entries, updates); err != nil {
+		return err
+	}
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+
+	// The reflog names a detached HEAD by its commit.
+	fromName := strings.TrimPrefix(from, "refs/heads/")
+	if from == "HEAD" {
+		fromName = head.String()
+	}
+	message := fmt.Sprintf("checkout: moving from %s to %s", fromName, name)
+	tx := newRefTransaction()
+	if branch {
+		tx.symref("HEAD", ref, message)
+	} else {
+		tx.detach("HEAD", target, message)
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if !quiet {
+		if err := printCheckoutResult(head, target, from, name, branch); err != nil {
+			return err
+		}
+	}
+	if err := runHook(cfg, "post-checkout", "", head.String(), target.String(), "1"); err != nil {
+		return fmt.Errorf("post-checkout hook failed")
+	}
+	return nil
+}
+
+// printCheckoutResult says what checking out name did: moving HEAD from
+// head, with from the ref HEAD was on, to target, on the branch name if
+// branch is set.
+func printCheckoutResult(head, target objectID, from, name string, branch bool) error {
+	describe := func(hash objectID) (string, error) {
+		c, err := readCommit(hash)
+		if err != nil {
+			return "", err
+		}
+		return shortHash(hash) + " " + commitSubject(c.message), nil
+	}
+	if from == "HEAD" && target != head {
+		d, err := describe(head)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Previous HEAD position was %s\n", d)
+	}
+	switch {
+	case branch && from == "refs/heads/"+name:
+		fmt.Fprintf(os.Stderr, "Already on '%s'\n", name)
+	case branch:
+		fmt.Fprintf(os.Stderr, "Switched to branch '%s'\n", name)
+	default:
+		d, err := describe(target)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "HEAD is now at %s\n", d)
+	}
+	return nil
+}
+
+// checkoutStage picks the side of a conflict that checking out paths
+// from the index writes: 2 for --ours, 3 for --theirs, 0 for neither.
+type checkoutStage int
+
+// checkoutPaths updates the paths matching pathspecs, from the index or,
+// when source is given, from that tree-ish, which also updates the index.
+// In no-overlay mode, paths the source lacks are removed as well. Unless
+// quiet, it counts the files it wrote.
+func checkoutPaths(cfg *config, source string, pathspecs []string, stage checkoutStage, overlay, quiet bool) error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	var files map[string]diffEntry
+	var tree objectID
+	if source != "" {
+		if tree, err = revisionTree(source); err != nil {
+			return err
+		}
+		files = make(map[string]diffEntry)
+		if err := treeFiles(tree, "", files); err != nil {
+			return err
+		}
+	}
+
+	// Every pathspec must match something before anything changes.
+	failed := false
+	for _, p := range pathspecs {
+		found := slices.ContainsFunc(entries, func(e indexEntry) bool {
+			return e.extFlags&indexSkipWorktree == 0 && matchPathspec(e.path, []string{p})
+		})
+		for path := range files {
+			found = found || matchPathspec(path, []string{p})
+		}
+		if !found {
+			fmt.Fprintf(os.Stderr, "error: pathspec '%s' did not match any file(s) known to git\n", p)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return err
+	}
+	written := 0
+	write := func(path string, file diffEntry) error {
+		if w, ok := work[path]; ok && sameFile(w, file) {
+			return nil
+		}
+		written++
+		return writeWorktreeFile(path, file)
+	}
+
+	if source != "" {
+		updates := make(map[string]pathUpdate)
+		for path, file := range files {
+			if matchPathspec(path, pathspecs) {
+				updates[path] = pathUpdate{file: file}
+			}
+		}
+		if !overlay {
+			for _, e := range entries {
+				if _, ok := files[e.path]; !ok && e.extFlags&indexSkipWorktree == 0 && matchPathspec(e.path, pathspecs) {
+					updates[e.path] = pathUpdate{}
+				}
+			}
+		}
+		for path, u := range updates {
+			if w, ok := work[path]; u.file.mode != 0 && (!ok || !sameFile(w, u.file)) {
+				written++
+			}
+		}
+		if entries, err = applyUpdates(entries, updates); err != nil {
+			return err
+		}
+	} else {
+		// A conflict is resolved in the working tree only, to the side
+		// asked for; the index keeps its stages.
+		conflicts := make(map[string][4]*indexEntry)
+		for i := range entries {
+			if e := &entries[i]; e.stage() != 0 && matchPathspec(e.path, pathspecs) {
+				stages := conflicts[e.path]
+				stages[e.stage()] = e
+				conflicts[e.path] = stages
+			}
+		}
+		var paths []string
+		for path := range conflicts {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			e := conflicts[path][stage]
+			switch {
+			case stage == 0:
+				fmt.Fprintf(os.Stderr, "error: path '%s' is unmerged\n", path)
+				failed = true
+			case e == nil && stage == 2:
+				fmt.Fprintf(os.Stderr, "error: path '%s' does not have our version\n", path)
+				failed = true
+			case e == nil:
+				fmt.Fprintf(os.Stderr, "error: path '%s' does not have their version\n", path)
+				failed = true
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+		for _, path := range paths {
+			e := conflicts[path][stage]
+			if w, err := readWorktreeFile(path); err == nil {
+				work[path] = w
+			}
+			if err := write(path, diffEntry{mode: e.mode, hash: e.hash}); err != nil {
+				return err
+			}
+		}
+
+		for i := range entries {
+			e := &entries[i]
+			if e.stage() != 0 || e.extFlags&indexSkipWorktree != 0 || !matchPathspec(e.path, pathspecs) {
+				continue
+			}
+			file := diffEntry{mode: e.mode, hash: e.hash}
+			if w, ok := work[e.path]; ok && sameFile(w, file) {
+				continue
+			}
+			if err := write(e.path, file); err != nil {
+				return err
+			}
+			// The stat data of the new file tells it is clean.
+			updated, err := newIndexEntry(e.path, 0, file)
+			if err != nil {
+				return err
+			}
+			updated.extFlags = e.extFlags
+			*e = updated
+		}
+	}
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+
+	if quiet {
+		return nil
+	}
+	noun := "paths"
+	if written == 1 {
+		noun = "path"
+	}
+	if source != "" {
+		fmt.Fprintf(os.Stderr, "Updated %d %s from %s\n", written, noun, shortHash(tree))
+	} else {
+		fmt.Fprintf(os.Stderr, "Updated %d %s from the index\n", written, noun)
+	}
+	return nil
+}
+
+func runCheckout(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	recurse, err := recurseSubmodules(cfg)
+	if err != nil {
+		return err
+	}
+	var names, pathspecs []string
+	var stage checkoutStage
+	quiet, dashDash, overlay, overlaySet := false, false, true, false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case arg == "--recurse-submodules":
+			recurse = true
+		case arg == "--no-recurse-submodules":
+			recurse = false
+		case arg == "--ours" || arg == "-2":
+			stage = 2
+		case arg == "--theirs" || arg == "-3":
+			stage = 3
+		case arg == "--overlay":
+			overlay, overlaySet = true, true
+		case arg == "--no-overlay":
+			overlay, overlaySet = false, true
+		case arg == "--":
+			pathspecs = append(pathspecs, args[i+1:]...)
+			dashDash = true
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+
+	// Without "--", a first argument naming a revision is the source
+	// of the paths that follow, or what to switch to if none do; any
+	// other arguments are paths.
+	var source string
+	switch {
+	case dashDash && len(names) > 1:
+		return fmt.Errorf("only one reference expected, %d given.", len(names))
+	case dashDash && len(names) == 1:
+		source = names[0]
+	case !dashDash && len(names) > 0:
+		if _, err := resolveRevision(names[0]); err == nil {
+			source, pathspecs = names[0], names[1:]
+		} else {
+			pathspecs = names
+		}
+	}
+	if dashDash && len(pathspecs) == 0 {
+		return fmt.Errorf("you must specify path(s) to restore")
+	}
+
+	if len(pathspecs) > 0 {
+		return checkoutPaths(cfg, source, pathspecs, stage, overlay, quiet || dashDash)
+	}
+	switch {
+	case source == "":
+		return fmt.Errorf("usage: mygit checkout [-q] [--[no-]recurse-submodules] <branch>|<commit>\n" +
+			"   or: mygit checkout [-q] [--ours|--theirs] [--[no-]overlay] [<tree-ish>] [--] <pathspec>...")
+	case stage != 0:
+		return fmt.Errorf("'--ours/--theirs' cannot be used with switching branches")
+	case overlaySet:
+		return fmt.Errorf("'--[no]-overlay' cannot be used with switching branches")
+	}
+	if err := checkoutRevision(cfg, source, quiet); err != nil {
+		return err
+	}
+	if !recurse {
+		return nil
+	}
+	files, err := headFiles()
+	if err != nil {
+		return err
+	}
+	return updateSubmodules(files)
+}
@@ -0,0 +1,384 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// cloneDirName returns the directory a clone of url goes to by default:
+// the last component of its path, without a .git or .bundle suffix.
+func cloneDirName(url string) string {
+	name := strings.TrimRight(url, "/")
+	name = strings.TrimSuffix(name, "/.git")
+	name = name[strings.LastIndexAny(name, "/:")+1:]
+	name = strings.TrimSuffix(name, ".git")
+	return strings.TrimSuffix(name, ".bundle")
+}
+
+// remoteHead returns the branch the remote's HEAD points to. Remotes that
+// do not say, bundles among them, have it guessed from the branches at the
+// same commit, the default branch first.
+func remoteHead(adv *refAdvertisement) (string, objectID, bool) {
+	var head *advertisedRef
+	for i := range adv.refs {
+		if adv.refs[i].name == "HEAD" {
+			head = &adv.refs[i]
+		}
+	}
+	if head == nil {
+		return "", objectID{}, false
+	}
+	if strings.HasPrefix(head.symref, "refs/heads/") {
+		return head.symref, head.hash, true
+	}
+	guess := ""
+	for _, ref := range adv.refs {
+		if !strings.HasPrefix(ref.name, "refs/heads/") || ref.hash != head.hash {
+			continue
+		}
+		if ref.name == "refs/heads/main" || ref.name == "refs/heads/master" {
+			return ref.name, ref.hash, true
+		}
+		if guess == "" {
+			guess = ref.name
+		}
+	}
+	return guess, head.hash, guess != ""
+}
+
+// repositoryObjectDir returns the absolute object directory of the local
+// repository at path, bare or not.
+func repositoryObjectDir(path string) (string, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return "", false
+	}
+	for _, dir := range []string{filepath.Join(abs, ".git", "objects"), filepath.Join(abs, "objects")} {
+		if fi, err := os.Stat(dir); err == nil && fi.IsDir() {
+			return dir, true
+		}
+	}
+	return "", false
+}
+
+// cloneTarget returns the ref a clone checks out: the branch, or else the
+// tag, named by --branch, or the branch the remote's HEAD points at. It is
+// empty when the remote has no HEAD.
+func cloneTarget(adv *refAdvertisement, branch, origin string) (string, objectID, error) {
+	if branch == "" {
+		target, hash, _ := remoteHead(adv)
+		return target, hash, nil
+	}
+	target, hash := "", objectID{}
+	for _, ref := range adv.refs {
+		if ref.name == "refs/heads/"+branch || target == "" && ref.name == "refs/tags/"+branch {
+			target, hash = ref.name, ref.hash
+		}
+	}
+	if target == "" {
+		return "", objectID{}, fmt.Errorf("Remote branch %s not found in upstream %s", branch, origin)
+	}
+	return target, hash, nil
+}
+
+func runClone(args []string) (err error) {
+	var url, dir, branch, filter string
+	origin := "origin"
+	depth := 0
+	noCheckout, quiet, recurse, shared := false, false, false, false
+	singleBranch, noSingleBranch := false, false
+	var subOpts submoduleCloneOptions
+	var references []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" || arg == "--origin" || arg == "-b" || arg == "--branch":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			if arg == "-o" || arg == "--origin" {
+				origin = args[i]
+			} else {
+				branch = args[i]
+			}
+		case strings.HasPrefix(arg, "--origin="):
+			origin = strings.TrimPrefix(arg, "--origin=")
+		case strings.HasPrefix(arg, "--branch="):
+			branch = strings.TrimPrefix(arg, "--branch=")
+		case arg == "--depth":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--depth requires a value")
+			}
+			i++
+			arg = "--depth=" + args[i]
+			fallthrough
+		case strings.HasPrefix(arg, "--depth="):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--depth="))
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid depth %q", arg)
+			}
+			depth = n
+		case arg == "-n" || arg == "--no-checkout":
+			noCheckout = true
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case arg == "--recurse-submodules" || arg == "--recursive":
+			recurse = true
+		case arg == "--no-recurse-submodules":
+			recurse = false
+		case arg == "-j" || arg == "--jobs":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			arg = "--jobs=" + args[i]
+			fallthrough
+		case strings.HasPrefix(arg, "--jobs="):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--jobs="))
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid number of jobs %q", arg)
+			}
+			subOpts.jobs = n
+		case arg == "--shallow-submodules":
+			subOpts.shallow, subOpts.noShallow = true, false
+		case arg == "--no-shallow-submodules":
+			subOpts.shallow, subOpts.noShallow = false, true
+		case arg == "--single-branch":
+			singleBranch, noSingleBranch = true, false
+		case arg == "--no-single-branch":
+			singleBranch, noSingleBranch = false, true
+		case arg == "-s" || arg == "--shared":
+			shared = true
+		case arg == "--reference":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--reference requires a value")
+			}
+			i++
+			references = append(references, args[i])
+		case strings.HasPrefix(arg, "--reference="):
+			references = append(references, strings.TrimPrefix(arg, "--reference="))
+		case strings.HasPrefix(arg, "--filter="):
+			spec, err := parseObjectFilter(strings.TrimPrefix(arg, "--filter="))
+			if err != nil {
+				return err
+			}
+			filter = spec
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		case url == "":
+			url = arg
+		case dir == "":
+			dir = arg
+		default:
+			return fmt.Errorf("usage: mygit clone [<options>] <repo> [<dir>]")
+		}
+	}
+	if url == "" {
+		return fmt.Errorf("usage: mygit clone [<options>] <repo> [<dir>]")
+	}
+	// Shallow clones only fetch one branch unless told otherwise.
+	if depth > 0 && !noSingleBranch {
+		singleBranch = true
+	}
+	if dir == "" {
+		dir = cloneDirName(url)
+	}
+	existing, err := os.ReadDir(dir)
+	if err == nil && len(existing) > 0 || err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("destination path '%s' already exists and is not an empty directory.", dir)
+	}
+	existed := err == nil
+	// The clone runs from within its directory, so local paths are made
+	// absolute first.
+	u, err := parseRemoteURL(url)
+	if err != nil {
+		return err
+	} else if u.scheme == "file" && !strings.Contains(url, "://") {
+		if url, err = filepath.Abs(url); err != nil {
+			return err
+		}
+	}
+	// Objects are borrowed from the reference repositories and, with
+	// --shared, from a local source instead of being copied.
+	var alternates []string
+	for _, ref := range references {
+		dir, ok := repositoryObjectDir(ref)
+		if !ok {
+			return fmt.Errorf("reference repository '%s' is not a local repository.", ref)
+		}
+		alternates = append(alternates, dir)
+	}
+	if shared && u.scheme == "file" {
+		if dir, ok := repositoryObjectDir(u.path); ok {
+			alternates = append(alternates, dir)
+		}
+	}
+
+	if !quiet {
+		fmt.Fprintf(os.Stderr, "Cloning into '%s'...\n", dir)
+	}
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("could not create work tree dir '%s': %w", dir, err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	// A failed clone leaves nothing behind but the directory it was
+	// given.
+	defer func() {
+		if err == nil {
+			return
+		}
+		if existed {
+			os.RemoveAll(filepath.Join(abs, ".git"))
+		} else {
+			os.RemoveAll(abs)
+		}
+	}()
+	if err := createRepository(hashAlgo, "files"); err != nil {
+		return err
+	}
+	if err := loadRepositoryFormat(); err != nil {
+		return err
+	}
+	for _, dir := range alternates {
+		if err := addAlternate(dir); err != nil {
+			return err
+		}
+	}
+	settings := [][2]string{
+		{"core.logallrefupdates", "true"},
+		{"remote." + origin + ".url", url},
+		{"remote." + origin + ".fetch", "+refs/heads/*:refs/remotes/" + origin + "/*"},
+	}
+	for _, kv := range settings {
+		if err := setConfigValue(configFile, kv[0], kv[1]); err != nil {
+			return fmt.Errorf("error writing config: %w", err)
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	remote, err := lookupRemote(cfg, origin)
+	if err != nil {
+		return err
+	}
+	// A partial clone's checkout fetches the blobs it needs from the
+	// remote, once the repository format says where they are promised.
+	if filter != "" {
+		if err := registerPromisorRemote(cfg, origin, filter); err != nil {
+			return err
+		}
+		if err := loadRepositoryFormat(); err != nil {
+			return err
+		}
+	}
+	action := "clone: from " + url
+	opts := fetchOptions{depth: depth, filter: filter, action: action, clone: true}
+	// A single-branch clone only fetches what it checks out, and keeps
+	// fetching only that.
+	singleSpec := ""
+	if singleBranch {
+		opts.pickSpecs = func(adv *refAdvertisement) ([]refspec, error) {
+			target, _, err := cloneTarget(adv, branch, origin)
+			if err != nil || target == "" {
+				return remote.refspecs, err
+			}
+			if name, ok := strings.CutPrefix(target, "refs/heads/"); ok {
+				singleSpec = "+" + target + ":refs/remotes/" + origin + "/" + name
+			} else {
+				singleSpec = "+" + target + ":" + target
+			}
+			spec, err := parseRefspec(singleSpec)
+			return []refspec{spec}, err
+		}
+	}
+	adv, err := fetch(remote, remote.refspecs, opts)
+	if err != nil {
+		return err
+	}
+	if singleSpec != "" {
+		if err := setConfigValue(configFile, "remote."+origin+".fetch", singleSpec); err != nil {
+			return fmt.Errorf("error writing config: %w", err)
+		}
+	}
+
+	headRef, _, hasHead := remoteHead(adv)
+	target, hash, err := cloneTarget(adv, branch, origin)
+	if err != nil {
+		return err
+	}
+	if target == "" {
+		if len(adv.refs) == 0 {
+			fmt.Fprintln(os.Stderr, "warning: You appear to have cloned an empty repository.")
+			return nil
+		}
+		fmt.Fprintln(os.Stderr, "warning: remote HEAD refers to nonexistent ref, unable to checkout")
+		return nil
+	}
+
+	tx := newRefTransaction()
+	if hasHead && (!singleBranch || headRef == target) {
+		name := strings.TrimPrefix(headRef, "refs/heads/")
+		tx.symref("refs/remotes/"+origin+"/HEAD", "refs/remotes/"+origin+"/"+name, action)
+	}
+	commit, ok, err := peelToCommit(hash)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%s does not point to a commit", target)
+	}
+	if name, ok := strings.CutPrefix(target, "refs/heads/"); ok {
+		tx.update(target, commit, action)
+		tx.symref("HEAD", target, "")
+		if err := tx.commit(); err != nil {
+			return err
+		}
+		if err := setConfigValue(configFile, "branch."+name+".remote", origin); err != nil {
+			return fmt.Errorf("error writing config: %w", err)
+		}
+		if err := setConfigValue(configFile, "branch."+name+".merge", target); err != nil {
+			return fmt.Errorf("error writing config: %w", err)
+		}
+	} else {
+		tx.detach("HEAD", commit, action)
+		if err := tx.commit(); err != nil {
+			return err
+		}
+	}
+	if noCheckout {
+		return nil
+	}
+
+	files, err := commitFiles(commit)
+	if err != nil {
+		return err
+	}
+	entries, err := applyUpdates(nil, treeUpdates(nil, files))
+	if err != nil {
+		return err
+	}
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+	if err := runHook(cfg, "post-checkout", "", objectID{}.String(), commit.String(), "1"); err != nil {
+		return fmt.Errorf("post-checkout hook failed")
+	}
+	if recurse {
+		subOpts.quiet = quiet
+		return cloneSubmodules(cfg, files, subOpts)
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package mygit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var colorNames = []string{"black", "red", "green", "yellow", "blue", "magenta", "cyan", "white"}
+
+// colorAttributes map the attribute words of color specs to their SGR
+// codes; the "no" forms turn an attribute off.
+var colorAttributes = map[string]int{
+	"bold": 1, "dim": 2, "italic": 3, "ul": 4, "blink": 5, "reverse": 7, "strike": 9,
+	"nobold": 22, "nodim": 22, "noitalic": 23, "noul": 24, "noblink": 25, "noreverse": 27, "nostrike": 29,
+}
+
+// parseColorWord returns the SGR parameters of a color word for the
+// foreground, or for the background with bg, and "" for "normal".
+func parseColorWord(word string, bg bool) (string, bool) {
+	base := 30
+	if bg {
+		base = 40
+	}
+	switch {
+	case word == "normal":
+		return "", true
+	case word == "default":
+		return strconv.Itoa(base + 9), true
+	case strings.HasPrefix(word, "#") && len(word) == 7:
+		var rgb [3]int64
+		for i := range rgb {
+			n, err := strconv.ParseUint(word[1+2*i:3+2*i], 16, 8)
+			if err != nil {
+				return "", false
+			}
+			rgb[i] = int64(n)
+		}
+		return fmt.Sprintf("%d;2;%d;%d;%d", base+8, rgb[0], rgb[1], rgb[2]), true
+	}
+	if n, err := strconv.Atoi(word); err == nil {
+		switch {
+		case n == -1:
+			return "", true
+		case n >= 0 && n < 8:
+			return strconv.Itoa(base + n), true
+		case n >= 8 && n < 16:
+			return strconv.Itoa(base + 60 + n - 8), true
+		case n >= 16 && n < 256:
+			return fmt.Sprintf("%d;5;%d", base+8, n), true
+		}
+		return "", false
+	}
+	name, bright := strings.CutPrefix(word, "bright")
+	for i, c := range colorNames {
+		if c == name {
+			if bright {
+				return strconv.Itoa(base + 60 + i), true
+			}
+			return strconv.Itoa(base + i), true
+		}
+	}
+	return "", false
+}
+
+// parseColor turns a color spec such as "bold red ul" or "reset #ff0000"
+// into its ANSI escape sequence: attributes in ascending order, then the
+// foreground and the background, the first and second colors named.
+func parseColor(spec string) (string, error) {
+	var attrs [30]bool
+	var fg, bg string
+	colors, reset, nonEmpty := 0, false, false
+	for _, word := range strings.Fields(strings.ToLower(spec)) {
+		word = strings.Replace(word, "no-", "no", 1)
+		if word == "reset" {
+			reset, nonEmpty = true, true
+			continue
+		}
+		if code, ok := colorAttributes[word]; ok {
+			attrs[code], nonEmpty = true, true
+			continue
+		}
+		if colors == 2 {
+			return "", fmt.Errorf("invalid color value: %s", spec)
+		}
+		params, ok := parseColorWord(word, colors == 1)
+		if !ok {
+			return "", fmt.Errorf("invalid color value: %s", spec)
+		}
+		if colors == 0 {
+			fg = params
+		} else {
+			bg = params
+		}
+		colors++
+		nonEmpty = nonEmpty || params != ""
+	}
+	if !nonEmpty {
+		return "", nil
+	}
+
+	var params []string
+	// A reset is an empty parameter.
+	if reset {
+		params = append(params, "")
+	}
+	for code, set := range attrs {
+		if set {
+			params = append(params, strconv.Itoa(code))
+		}
+	}
+	for _, p := range []string{fg, bg} {
+		if p != "" {
+			params = append(params, p)
+		}
+	}
+	return "\033[" + strings.Join(params, ";") + "m", nil
+}
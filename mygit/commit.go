@@ -0,0 +1,740 @@
+package mygit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var identDateLayouts = []string{
+	time.RFC1123Z,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	time.RFC3339,
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+}
+
+// identity returns the "Name <email> <timestamp> <tz>" line for the author
+// or committer role, honoring GIT_<ROLE>_{NAME,EMAIL,DATE} before falling
+// back to user.name and user.email from config.
+func identity(cfg *config, role string) (string, error) {
+	prefix := "GIT_" + strings.ToUpper(role) + "_"
+
+	name := os.Getenv(prefix + "NAME")
+	if name == "" {
+		name, _ = cfg.get("user.name")
+	}
+	email := os.Getenv(prefix + "EMAIL")
+	if email == "" {
+		email, _ = cfg.get("user.email")
+	}
+	if name == "" || email == "" {
+		return "", fmt.Errorf("%s identity unknown: set user.name and user.email", role)
+	}
+
+	date, err := identityDate(role)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s <%s> %s", name, email, date), nil
+}
+
+// identityDate returns GIT_<ROLE>_DATE, or the current time.
+func identityDate(role string) (string, error) {
+	if env := os.Getenv("GIT_" + strings.ToUpper(role) + "_DATE"); env != "" {
+		return parseIdentDate(env)
+	}
+	return formatIdentDate(time.Now()), nil
+}
+
+func formatIdentDate(t time.Time) string {
+	return fmt.Sprintf("%d %s", t.Unix(), t.Format("-0700"))
+}
+
+// parseIdent splits an author, committer or tagger line into the name, the
+// email and the recorded time in its original timezone.
+func parseIdent(ident string) (name, email string, when time.Time) {
+	open, end := strings.IndexByte(ident, '<'), strings.LastIndexByte(ident, '>')
+	if open == -1 || end < open {
+		return strings.TrimSpace(ident), "", time.Unix(0, 0).UTC()
+	}
+	name, email = strings.TrimSpace(ident[:open]), ident[open+1:end]
+
+	fields := strings.Fields(ident[end+1:])
+	when = time.Unix(0, 0).UTC()
+	if len(fields) > 0 {
+		unix, _ := strconv.ParseInt(fields[0], 10, 64)
+		when = time.Unix(unix, 0).UTC()
+	}
+	if len(fields) > 1 {
+		if tz, err := strconv.Atoi(fields[1]); err == nil {
+			offset := (tz/100*60 + tz%100) * 60
+			when = when.In(time.FixedZone(fields[1], offset))
+		}
+	}
+	return name, email, when
+}
+
+// parseIdentDate accepts git's internal "<unix> <tz>" format (optionally
+// prefixed with @) as well as RFC 2822 and ISO 8601 dates.
+func parseIdentDate(s string) (string, error) {
+	s = strings.TrimSpace(s)
+
+	raw := strings.TrimPrefix(s, "@")
+	seconds, tz, hasTZ := strings.Cut(raw, " ")
+	if unix, err := strconv.ParseInt(seconds, 10, 64); err == nil {
+		if !hasTZ {
+			tz = "+0000"
+		}
+		if _, err := time.Parse("-0700", tz); err != nil {
+			return "", fmt.Errorf("invalid date %q", s)
+		}
+		return fmt.Sprintf("%d %s", unix, tz), nil
+	}
+
+	for _, layout := range identDateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return formatIdentDate(t), nil
+		}
+	}
+	return "", fmt.Errorf("invalid date %q", s)
+}
+
+// commitTree writes a commit object for tree with the given parents and
+// message, taking author and committer identities from config.
+func commitTree(tree objectID, parents []objectID, message string) (objectID, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return objectID{}, err
+	}
+
+	author, err := identity(cfg, "author")
+	if err != nil {
+		return objectID{}, err
+	}
+	committer, err := identity(cfg, "committer")
+	if err != nil {
+		return objectID{}, err
+	}
+
+	return storeObject(commitObject, serializeCommit(&commit{
+		tree:      tree,
+		parents:   parents,
+		author:    author,
+		committer: committer,
+		message:   message,
+	}))
+}
+
+// cleanupMessage tidies a commit message the way git does before
+// committing: trailing whitespace goes, runs of blank lines collapse into
+// one and the message ends with a single newline. With stripComments,
+// comment lines go too, as in messages from the editor.
+func cleanupMessage(message string, stripComments bool) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(message, "\n") {
+		if stripComments && strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimRight(line, " \t\r")
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return ""
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// printCommitSummary prints what git shows after a commit is made on
+// HEAD: the branch, the abbreviated hash and the subject, then how the
+// files changed from old. The author is shown when it is not the
+// committer, and so is the author date with showDate.
+func printCommitSummary(cfg *config, hash objectID, old map[string]diffEntry, showDate bool) error {
+	c, err := readCommit(hash)
+	if err != nil {
+		return err
+	}
+	head, err := symrefTarget("HEAD")
+	if err != nil {
+		return err
+	}
+	branch := "detached HEAD"
+	if head != "HEAD" {
+		branch = describeRef(head)
+	}
+	if len(c.parents) == 0 {
+		branch += " (root-commit)"
+	}
+	new := make(map[string]diffEntry)
+	if err := treeFiles(c.tree, "", new); err != nil {
+		return err
+	}
+	opts, err := configDiffOptions(cfg)
+	if err != nil {
+		return err
+	}
+	pairs := diffFiles(old, new, nil, nil)
+	stats, err := diffStats(pairs, opts)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	fmt.Fprintf(out, "[%s %s] %s\n", branch, shortHash(hash), commitSubject(c.message))
+	authorName, authorEmail, when := parseIdent(c.author)
+	if name, email, _ := parseIdent(c.committer); name != authorName || email != authorEmail {
+		fmt.Fprintf(out, " Author: %s <%s>\n", authorName, authorEmail)
+	}
+	if showDate {
+		fmt.Fprintf(out, " Date: %s\n", formatDate(when, dateMode{style: dateDefault}, time.Now()))
+	}
+	// Like git, merges get no stat.
+	if len(pairs) > 0 && len(c.parents) < 2 {
+		writeShortstat(out, stats)
+		writeSummary(out, pairs, opts)
+	}
+	return out.Flush()
+}
+
+// isAncestor reports whether ancestor is reachable from descendant by
+// following parent links. The walk stops at shallow commits, and at
+// commits whose generation in the commit-graph is too low to reach
+// ancestor.
+func isAncestor(ancestor, descendant objectID) (bool, error) {
+	shallow, err := readShallow()
+	if err != nil {
+		return false, err
+	}
+	minGeneration := uint32(0)
+	if node, err := readCommitNode(ancestor); err == nil {
+		minGeneration = node.generation
+	}
+
+	seen := make(map[objectID]bool)
+	pending := []objectID{descendant}
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if hash == ancestor {
+			return true, nil
+		}
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		if shallow[hash] {
+			continue
+		}
+
+		node, err := readCommitNode(hash)
+		if err != nil {
+			return false, err
+		}
+		if node.generation < minGeneration {
+			continue
+		}
+		pending = append(pending, node.parents...)
+	}
+	return false, nil
+}
+
+func readCommit(hash objectID) (*commit, error) {
+	objType, content, err := readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+	if objType != commitObject {
+		return nil, fmt.Errorf("object %x is a %s, not a commit", hash, objType)
+	}
+	return parseCommit(content)
+}
+
+func serializeCommit(c *commit) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "tree %x\n", c.tree)
+	for _, parent := range c.parents {
+		fmt.Fprintf(&b, "parent %x\n", parent)
+	}
+	fmt.Fprintf(&b, "author %s\n", c.author)
+	fmt.Fprintf(&b, "committer %s\n", c.committer)
+	if c.gpgsig != "" {
+		// Continuation lines of a header start with a space.
+		fmt.Fprintf(&b, "gpgsig %s\n", strings.ReplaceAll(strings.TrimSuffix(c.gpgsig, "\n"), "\n", "\n "))
+	}
+	b.WriteString("\n")
+	b.WriteString(c.message)
+	return []byte(b.String())
+}
+
+var commitEditMsgFile = ".git/COMMIT_EDITMSG"
+
+// commitAuthor returns the author line of a new commit, with the name and
+// email of author and the date date when given.
+func commitAuthor(cfg *config, author, date string) (string, error) {
+	var name, email string
+	if author != "" {
+		open, end := strings.IndexByte(author, '<'), strings.LastIndexByte(author, '>')
+		if open == -1 || end < open || strings.TrimSpace(author[end+1:]) != "" {
+			return "", fmt.Errorf("--author '%s' is not 'Name <email>' and matches no existing author", author)
+		}
+		name, email = strings.TrimSpace(author[:open]), strings.TrimSpace(author[open+1:end])
+	} else {
+		ident, err := identity(cfg, "author")
+		if err != nil {
+			return "", err
+		}
+		name, email, _ = parseIdent(ident)
+	}
+
+	when, err := identityDate("author")
+	if err != nil {
+		return "", err
+	}
+	if date != "" {
+		if when, err = parseIdentDate(date); err != nil {
+			return "", fmt.Errorf("invalid date format: %s", date)
+		}
+	}
+	return fmt.Sprintf("%s <%s> %s", name, email, when), nil
+}
+
+// stageTracked updates the index with the changes to tracked files in the
+// working tree, removing the files that were deleted.
+func stageTracked(cfg *config, entries []indexEntry) ([]indexEntry, error) {
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return nil, err
+	}
+	var staged []indexEntry
+	for _, e := range entries {
+		file, ok := work[e.path]
+		switch {
+		case !ok:
+			continue
+		case file.data != nil:
+			if _, err := storeObject(blobObject, file.data); err != nil {
+				return nil, err
+			}
+			if e, err = newIndexEntry(e.path, 0, file); err != nil {
+				return nil, err
+			}
+		}
+		staged = append(staged, e)
+	}
+	return staged, nil
+}
+
+// pathUpdates returns the working tree state of the files in the index or
+// in HEAD that paths match, a zero entry standing for a deleted file. Each
+// path must match one.
+func pathUpdates(cfg *config, entries []indexEntry, head map[string]diffEntry, paths []string) (map[string]diffEntry, error) {
+	var candidates []indexEntry
+	known := make(map[string]bool)
+	for _, e := range entries {
+		if !known[e.path] && matchPathspec(e.path, paths) {
+			// Unmerged paths are resolved with whatever is in the working
+			// tree.
+			candidates = append(candidates, indexEntry{path: e.path, mode: e.mode, hash: e.hash, mtime: e.mtime, size: e.size})
+		}
+		known[e.path] = true
+	}
+	for path, file := range head {
+		if !known[path] && matchPathspec(path, paths) {
+			candidates = append(candidates, indexEntry{path: path, mode: file.mode, hash: file.hash})
+		}
+		known[path] = true
+	}
+	for _, p := range paths {
+		if !slices.ContainsFunc(candidates, func(e indexEntry) bool { return matchPathspec(e.path, []string{p}) }) {
+			return nil, fmt.Errorf("pathspec '%s' did not match any file(s) known to git", p)
+		}
+	}
+
+	work, err := worktreeFiles(cfg, candidates)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[string]diffEntry)
+	for _, e := range candidates {
+		file := work[e.path]
+		if file.data != nil {
+			if _, err := storeObject(blobObject, file.data); err != nil {
+				return nil, err
+			}
+		}
+		updates[e.path] = diffEntry{mode: file.mode, hash: file.hash}
+	}
+	return updates, nil
+}
+
+// updateIndexPaths replaces the index entries of the updated paths, any
+// conflict stages included, with their new state.
+func updateIndexPaths(entries []indexEntry, updates map[string]diffEntry) ([]indexEntry, error) {
+	var result []indexEntry
+	for _, e := range entries {
+		if _, ok := updates[e.path]; !ok {
+			result = append(result, e)
+		}
+	}
+	for path, file := range updates {
+		if file.mode == 0 {
+			continue
+		}
+		e, err := newIndexEntry(path, 0, file)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, e)
+	}
+	return result, nil
+}
+
+// printNothingToCommit explains why there is no commit to make.
+func printNothingToCommit(cfg *config, head objectID, indexed map[string]diffEntry, entries []indexEntry) error {
+	branch, err := symrefTarget("HEAD")
+	if err != nil {
+		return err
+	}
+	if branch == "HEAD" {
+		fmt.Printf("HEAD detached at %s\n", shortHash(head))
+	} else {
+		fmt.Printf("On branch %s\n", strings.TrimPrefix(branch, "refs/heads/"))
+	}
+	if head == (objectID{}) {
+		fmt.Print("\nInitial commit\n\n")
+		if len(indexed) == 0 {
+			fmt.Println(`nothing to commit (create/copy files and use "git add" to track)`)
+			return nil
+		}
+	}
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return err
+	}
+	if len(diffFiles(indexed, work, nil, nil)) > 0 {
+		fmt.Println(`no changes added to commit (use "git add" and/or "git commit -a")`)
+	} else {
+		fmt.Println("nothing to commit, working tree clean")
+	}
+	return nil
+}
+
+func runCommit(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var messages []string
+	var messageFile, author, date string
+	var paths []string
+	all, quiet, allowEmpty, allowEmptyMessage := false, false, false, false
+	only, include, noVerify := false, false, false
+	sign, err := cfg.getBool("commit.gpgSign", false)
+	if err != nil {
+		return err
+	}
+	var signKey string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		value := func(name string) (string, error) {
+			if i+1 == len(args) {
+				return "", fmt.Errorf("option '%s' requires a value", name)
+			}
+			i++
+			return args[i], nil
+		}
+		switch {
+		case arg == "-m" || arg == "--message":
+			m, err := value("message")
+			if err != nil {
+				return err
+			}
+			messages = append(messages, m)
+		case strings.HasPrefix(arg, "--message="):
+			messages = append(messages, strings.TrimPrefix(arg, "--message="))
+		case strings.HasPrefix(arg, "-m"):
+			messages = append(messages, strings.TrimPrefix(arg, "-m"))
+		case arg == "-F" || arg == "--file":
+			if messageFile, err = value("file"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "--file="):
+			messageFile = strings.TrimPrefix(arg, "--file=")
+		case arg == "--author":
+			if author, err = value("author"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "--author="):
+			author = strings.TrimPrefix(arg, "--author=")
+		case arg == "--date":
+			if date, err = value("date"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "--date="):
+			date = strings.TrimPrefix(arg, "--date=")
+		case arg == "-a" || arg == "--all":
+			all = true
+			safeCRLFCheck = safeCRLFDie
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case arg == "--allow-empty":
+			allowEmpty = true
+		case arg == "--allow-empty-message":
+			allowEmptyMessage = true
+		case arg == "-o" || arg == "--only":
+			only = true
+		case arg == "-i" || arg == "--include":
+			include = true
+		case arg == "-n" || arg == "--no-verify":
+			noVerify = true
+		case arg == "-S" || arg == "--gpg-sign":
+			sign, signKey = true, ""
+		case strings.HasPrefix(arg, "--gpg-sign="):
+			sign, signKey = true, strings.TrimPrefix(arg, "--gpg-sign=")
+		case strings.HasPrefix(arg, "-S"):
+			sign, signKey = true, strings.TrimPrefix(arg, "-S")
+		case arg == "--no-gpg-sign":
+			sign = false
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	switch {
+	case len(messages) > 0 && messageFile != "":
+		return fmt.Errorf("Option -m cannot be combined with -F.")
+	case len(paths) > 0 && all:
+		return fmt.Errorf("paths '%s ...' with -a does not make sense", paths[0])
+	case only && include, (only || include) && all:
+		return fmt.Errorf("Only one of --include/--only/--all can be used.")
+	case (only || include) && len(paths) == 0:
+		return fmt.Errorf("No paths with --include/--only does not make sense.")
+	}
+
+	head, err := resolveRef("HEAD")
+	if err != nil && !errors.Is(err, errRefNotFound) {
+		return err
+	}
+	var parents []objectID
+	headFiles := map[string]diffEntry{}
+	if head != (objectID{}) {
+		parents = append(parents, head)
+		if headFiles, err = commitFiles(head); err != nil {
+			return err
+		}
+	}
+	merging := false
+	if theirs, err := resolveRef("MERGE_HEAD"); err == nil {
+		parents = append(parents, theirs)
+		merging = true
+	} else if !errors.Is(err, errRefNotFound) {
+		return err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	// Paths given on the command line are committed as they are in the
+	// working tree: on their own by default, or along with the rest of
+	// the index with --include. Either way the index gets them too.
+	var updates map[string]diffEntry
+	if len(paths) > 0 {
+		if merging && !include {
+			return fmt.Errorf("cannot do a partial commit during a merge.")
+		}
+		if updates, err = pathUpdates(cfg, entries, headFiles, paths); err != nil {
+			return err
+		}
+	}
+	indexed, unmerged := indexFiles(entries)
+	for path := range unmerged {
+		if _, ok := updates[path]; !ok {
+			return fmt.Errorf("Committing is not possible because you have unmerged files.")
+		}
+	}
+	switch {
+	case all:
+		if entries, err = stageTracked(cfg, entries); err != nil {
+			return err
+		}
+		if err := writeIndex(entries); err != nil {
+			return err
+		}
+		indexed, _ = indexFiles(entries)
+	case include:
+		if entries, err = updateIndexPaths(entries, updates); err != nil {
+			return err
+		}
+		indexed, _ = indexFiles(entries)
+	case len(paths) > 0:
+		indexed = maps.Clone(headFiles)
+		for path, file := range updates {
+			if file.mode == 0 {
+				delete(indexed, path)
+			} else {
+				indexed[path] = file
+			}
+		}
+	}
+	// The pre-commit hook may stage more changes, which then get
+	// committed along.
+	if !noVerify && hookPath(cfg, "pre-commit") != "" {
+		if err := runHook(cfg, "pre-commit", ""); err != nil {
+			return fmt.Errorf("pre-commit hook declined the commit")
+		}
+		if len(paths) == 0 {
+			if entries, err = readIndex(); err != nil {
+				return err
+			}
+			indexed, _ = indexFiles(entries)
+		}
+	}
+	if !merging && !allowEmpty && len(diffFiles(headFiles, indexed, nil, nil)) == 0 {
+		if err := printNothingToCommit(cfg, head, indexed, entries); err != nil {
+			return err
+		}
+		os.Exit(1)
+	}
+
+	authorIdent, err := commitAuthor(cfg, author, date)
+	if err != nil {
+		return err
+	}
+
+	// Messages given on the command line are only tidied up; those
+	// from the editor lose their comments too.
+	var message string
+	switch {
+	case len(messages) > 0:
+		message = cleanupMessage(strings.Join(messages, "\n\n"), false)
+	case messageFile == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("could not read log from standard input: %w", err)
+		}
+		message = cleanupMessage(string(data), false)
+	case messageFile != "":
+		data, err := os.ReadFile(messageFile)
+		if err != nil {
+			return fmt.Errorf("could not read log file '%s': %w", messageFile, err)
+		}
+		message = cleanupMessage(string(data), false)
+	default:
+		initial, err := os.ReadFile(mergeMsgFile)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to read %s: %w", mergeMsgFile, err)
+		}
+		edited, err := editMessage(cfg, commitEditMsgFile, string(initial)+"\n"+
+			"# Please enter the commit message for your changes. Lines starting\n"+
+			"# with '#' will be ignored, and an empty message aborts the commit.\n#\n")
+		if err != nil {
+			return err
+		}
+		message = cleanupMessage(edited, true)
+	}
+	if len(messages) > 0 || messageFile != "" {
+		if err := os.WriteFile(commitEditMsgFile, []byte(message), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", commitEditMsgFile, err)
+		}
+	}
+	// The commit-msg hook may rewrite the message in place.
+	if !noVerify && hookPath(cfg, "commit-msg") != "" {
+		if err := runHook(cfg, "commit-msg", "", commitEditMsgFile); err != nil {
+			return fmt.Errorf("commit-msg hook declined the commit")
+		}
+		data, err := os.ReadFile(commitEditMsgFile)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", commitEditMsgFile, err)
+		}
+		message = cleanupMessage(string(data), len(messages) == 0 && messageFile == "")
+	}
+	if message == "" && !allowEmptyMessage {
+		fmt.Fprintln(os.Stderr, "Aborting commit due to empty commit message.")
+		os.Exit(1)
+	}
+
+	committer, err := identity(cfg, "committer")
+	if err != nil {
+		return err
+	}
+	tree, err := writeFilesTree(indexed)
+	if err != nil {
+		return err
+	}
+	c := &commit{
+		tree:      tree,
+		parents:   parents,
+		author:    authorIdent,
+		committer: committer,
+		message:   message,
+	}
+	// The signature covers the commit as it would be without it.
+	if sign {
+		key, err := signingKey(cfg, signKey, committer)
+		if err != nil {
+			return err
+		}
+		if c.gpgsig, err = signPayload(cfg, serializeCommit(c), key); err != nil {
+			return fmt.Errorf("failed to write commit object: %w", err)
+		}
+	}
+	hash, err := storeObject(commitObject, serializeCommit(c))
+	if err != nil {
+		return err
+	}
+
+	action := "commit"
+	switch {
+	case head == (objectID{}):
+		action = "commit (initial)"
+	case merging:
+		action = "commit (merge)"
+	}
+	tx := newRefTransaction()
+	tx.updateFrom("HEAD", head, hash, action+": "+commitSubject(message))
+	if err := clearRevert(tx); err != nil {
+		return err
+	}
+	if updates != nil {
+		if !include {
+			if entries, err = updateIndexPaths(entries, updates); err != nil {
+				return err
+			}
+		}
+		if err := writeIndex(entries); err != nil {
+			return err
+		}
+	}
+	for _, file := range []string{mergeHeadFile, mergeModeFile} {
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", file, err)
+		}
+	}
+	if quiet {
+		return nil
+	}
+	return printCommitSummary(cfg, hash, headFiles, date != "")
+}
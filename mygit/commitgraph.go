@@ -0,0 +1,651 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+var commitGraphFile = ".git/objects/info/commit-graph"
+
+const (
+	commitGraphSignature  = "CGPH"
+	commitGraphVersion    = 1
+	commitGraphHeaderSize = 8
+	commitGraphChunkSize  = 12
+
+	commitGraphChunkOIDFanout  = 0x4f494446 // OIDF
+	commitGraphChunkOIDLookup  = 0x4f49444c // OIDL
+	commitGraphChunkData       = 0x43444154 // CDAT
+	commitGraphChunkExtraEdges = 0x45444745 // EDGE
+
+	// A CDAT parent slot holds the position of the parent, this value for
+	// no parent or, for the second slot of an octopus merge, the position
+	// of the remaining parents in EDGE with the top bit set. The top bit
+	// also marks the last parent of a list in EDGE.
+	commitGraphNoParent  = 0x70000000
+	commitGraphEdgeIndex = 0x80000000
+
+	// generationMax is the largest topological level CDAT can hold.
+	generationMax = 0x3fffffff
+	// generationInfinity is the generation of commits missing from the
+	// commit-graph, which may be descendants of any commit in it.
+	generationInfinity = 0xffffffff
+)
+
+// commitNode is what revision walks need of a commit. Commits in the
+// commit-graph are described without reading their objects; commit is
+// only set for those that had to be read.
+type commitNode struct {
+	tree    objectID
+	parents []objectID
+	time    int64
+	// generation is one more than the largest generation of the parents,
+	// so no commit reaches one with a higher generation.
+	generation uint32
+	commit     *commit
+}
+
+// commitGraph is a commit-graph file; entries are decoded on lookup.
+type commitGraph struct {
+	data   []byte
+	count  int
+	fanout []byte
+	oids   []byte
+	cdat   []byte
+	edges  []byte
+}
+
+func readCommitGraph(path string) (*commitGraph, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read commit-graph: %w", err)
+	}
+	if len(data) < commitGraphHeaderSize+hashAlgo.size || string(data[:4]) != commitGraphSignature {
+		return nil, fmt.Errorf("commit-graph signature %x does not match signature %x", data[:min(4, len(data))], commitGraphSignature)
+	}
+	if data[4] != commitGraphVersion {
+		return nil, fmt.Errorf("commit-graph version %d does not match version %d", data[4], commitGraphVersion)
+	}
+	if data[5] != hashAlgo.formatID {
+		return nil, fmt.Errorf("commit-graph hash version %d does not match version %d", data[5], hashAlgo.formatID)
+	}
+	if data[7] != 0 {
+		return nil, fmt.Errorf("commit-graph chains are not supported")
+	}
+	numChunks := int(data[6])
+
+	chunks := make(map[uint32][]byte)
+	table := data[commitGraphHeaderSize:]
+	if len(table) < (numChunks+1)*commitGraphChunkSize {
+		return nil, fmt.Errorf("commit-graph chunk lookup table entry missing; file may be incomplete")
+	}
+	for i := 0; i < numChunks; i++ {
+		id := binary.BigEndian.Uint32(table[i*commitGraphChunkSize:])
+		start := binary.BigEndian.Uint64(table[i*commitGraphChunkSize+4:])
+		end := binary.BigEndian.Uint64(table[(i+1)*commitGraphChunkSize+4:])
+		if start > end || end > uint64(len(data)-hashAlgo.size) {
+			return nil, fmt.Errorf("improper chunk offset(s) %x and %x", start, end)
+		}
+		chunks[id] = data[start:end]
+	}
+
+	for _, id := range []uint32{commitGraphChunkOIDFanout, commitGraphChunkOIDLookup, commitGraphChunkData} {
+		if _, ok := chunks[id]; !ok {
+			return nil, fmt.Errorf("commit-graph is missing chunk %08x", id)
+		}
+	}
+	g := &commitGraph{
+		data:   data,
+		fanout: chunks[commitGraphChunkOIDFanout],
+		oids:   chunks[commitGraphChunkOIDLookup],
+		cdat:   chunks[commitGraphChunkData],
+		edges:  chunks[commitGraphChunkExtraEdges],
+	}
+	if len(g.fanout) != 256*4 {
+		return nil, fmt.Errorf("commit-graph fanout chunk is wrong size")
+	}
+	g.count = int(binary.BigEndian.Uint32(g.fanout[255*4:]))
+	if len(g.oids) != g.count*hashAlgo.size || len(g.cdat) != g.count*(hashAlgo.size+16) {
+		return nil, fmt.Errorf("commit-graph is missing the expected number of commits")
+	}
+	return g, nil
+}
+
+// hashAt returns the ID of the commit at pos in the lookup order.
+func (g *commitGraph) hashAt(pos int) objectID {
+	return objectIDFromBytes(g.oids[pos*hashAlgo.size:])
+}
+
+// find returns the position of hash in the graph.
+func (g *commitGraph) find(hash objectID) (int, bool) {
+	lo := 0
+	if hash[0] > 0 {
+		lo = int(binary.BigEndian.Uint32(g.fanout[(int(hash[0])-1)*4:]))
+	}
+	hi := int(binary.BigEndian.Uint32(g.fanout[int(hash[0])*4:]))
+	key := hash.bytes()
+	pos := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(g.oids[(lo+i)*hashAlgo.size:(lo+i+1)*hashAlgo.size], key) >= 0
+	})
+	return pos, pos < hi && bytes.Equal(g.oids[pos*hashAlgo.size:(pos+1)*hashAlgo.size], key)
+}
+
+// nodeAt decodes the CDAT entry at pos.
+func (g *commitGraph) nodeAt(pos int) (*commitNode, error) {
+	entry := g.cdat[pos*(hashAlgo.size+16):]
+	node := &commitNode{tree: objectIDFromBytes(entry)}
+	entry = entry[hashAlgo.size:]
+	parent := func(p uint32) error {
+		if int(p) >= g.count {
+			return fmt.Errorf("invalid parent position %d in commit-graph", p)
+		}
+		node.parents = append(node.parents, g.hashAt(int(p)))
+		return nil
+	}
+
+	if p := binary.BigEndian.Uint32(entry); p != commitGraphNoParent {
+		if err := parent(p); err != nil {
+			return nil, err
+		}
+	}
+	switch p := binary.BigEndian.Uint32(entry[4:]); {
+	case p == commitGraphNoParent:
+	case p&commitGraphEdgeIndex == 0:
+		if err := parent(p); err != nil {
+			return nil, err
+		}
+	default:
+		for i := int(p &^ commitGraphEdgeIndex); ; i++ {
+			if (i+1)*4 > len(g.edges) {
+				return nil, fmt.Errorf("commit-graph parent list terminates early")
+			}
+			edge := binary.BigEndian.Uint32(g.edges[i*4:])
+			if err := parent(edge &^ commitGraphEdgeIndex); err != nil {
+				return nil, err
+			}
+			if edge&commitGraphEdgeIndex != 0 {
+				break
+			}
+		}
+	}
+
+	high := binary.BigEndian.Uint32(entry[8:])
+	node.generation = high >> 2
+	node.time = int64(high&3)<<32 | int64(binary.BigEndian.Uint32(entry[12:]))
+	return node, nil
+}
+
+// lookup returns the node of hash if the graph has it.
+func (g *commitGraph) lookup(hash objectID) (*commitNode, bool) {
+	pos, ok := g.find(hash)
+	if !ok {
+		return nil, false
+	}
+	node, err := g.nodeAt(pos)
+	if err != nil {
+		return nil, false
+	}
+	return node, true
+}
+
+// commitGraphMu guards loadedCommitGraph and commitGraphLoaded.
+var commitGraphMu sync.Mutex
+var loadedCommitGraph *commitGraph
+var commitGraphLoaded bool
+
+// loadCommitGraph returns the commit-graph of the repository, or nil if
+// there is none or it must not be used: with core.commitGraph off or in a
+// shallow repository, whose parents differ from the recorded ones. A
+// broken file is reported and then ignored.
+func loadCommitGraph() *commitGraph {
+	commitGraphMu.Lock()
+	defer commitGraphMu.Unlock()
+	if commitGraphLoaded {
+		return loadedCommitGraph
+	}
+	commitGraphLoaded = true
+
+	if cfg, err := loadConfig(); err != nil {
+		return nil
+	} else if use, err := cfg.getBool("core.commitGraph", true); err != nil || !use {
+		return nil
+	}
+	if shallow, err := readShallow(); err != nil || len(shallow) > 0 {
+		return nil
+	}
+	g, err := readCommitGraph(commitGraphFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		return nil
+	}
+	loadedCommitGraph = g
+	return g
+}
+
+// reloadCommitGraph forgets the loaded commit-graph after it was rewritten.
+func reloadCommitGraph() {
+	commitGraphMu.Lock()
+	defer commitGraphMu.Unlock()
+	loadedCommitGraph, commitGraphLoaded = nil, false
+}
+
+// readCommitNode returns the node of a commit, from the commit-graph when
+// it has the commit and from the commit object otherwise.
+func readCommitNode(hash objectID) (*commitNode, error) {
+	if g := loadCommitGraph(); g != nil {
+		if node, ok := g.lookup(hash); ok {
+			return node, nil
+		}
+	}
+	c, err := readCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	return &commitNode{
+		tree:       c.tree,
+		parents:    c.parents,
+		time:       identTimestamp(c.committer),
+		generation: generationInfinity,
+		commit:     c,
+	}, nil
+}
+
+// graphCommit is a commit to be written to a commit-graph.
+type graphCommit struct {
+	hash       objectID
+	tree       objectID
+	parents    []objectID
+	time       int64
+	generation uint32
+}
+
+// buildCommitGraph collects the commits reachable from starts, which must
+// all be commits, and computes their generations.
+func buildCommitGraph(starts []objectID) ([]*graphCommit, error) {
+	byHash := make(map[objectID]*graphCommit)
+	pending := append([]objectID(nil), starts...)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if byHash[hash] != nil {
+			continue
+		}
+		c, err := readCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		byHash[hash] = &graphCommit{hash: hash, tree: c.tree, parents: c.parents, time: identTimestamp(c.committer)}
+		pending = append(pending, c.parents...)
+	}
+
+	// Generations are computed parents first, without recursing through
+	// long histories.
+	for _, gc := range byHash {
+		stack := []*graphCommit{gc}
+		for len(stack) > 0 {
+			top := stack[len(stack)-1]
+			if top.generation != 0 {
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			generation, ready := uint32(1), true
+			for _, parent := range top.parents {
+				p := byHash[parent]
+				if p.generation == 0 {
+					stack = append(stack, p)
+					ready = false
+				} else if p.generation >= generation {
+					generation = min(p.generation+1, generationMax)
+				}
+			}
+			if ready {
+				top.generation = generation
+				stack = stack[:len(stack)-1]
+			}
+		}
+	}
+
+	commits := make([]*graphCommit, 0, len(byHash))
+	for _, gc := range byHash {
+		commits = append(commits, gc)
+	}
+	sort.Slice(commits, func(i, j int) bool {
+		return bytes.Compare(commits[i].hash[:], commits[j].hash[:]) < 0
+	})
+	return commits, nil
+}
+
+// encodeCommitGraph serializes commits, sorted by hash and closed under
+// parents, in the version 1 format: a header, the chunk table, the OIDF,
+// OIDL, CDAT and (for octopus merges) EDGE chunks and a trailing checksum.
+func encodeCommitGraph(commits []*graphCommit) []byte {
+	position := make(map[objectID]uint32, len(commits))
+	for i, gc := range commits {
+		position[gc.hash] = uint32(i)
+	}
+
+	fanout := make([]byte, 256*4)
+	var counts [256]uint32
+	for _, gc := range commits {
+		counts[gc.hash[0]]++
+	}
+	var total uint32
+	for i, c := range counts {
+		total += c
+		binary.BigEndian.PutUint32(fanout[i*4:], total)
+	}
+
+	oids := make([]byte, 0, len(commits)*hashAlgo.size)
+	cdat := make([]byte, 0, len(commits)*(hashAlgo.size+16))
+	var edges []byte
+	for _, gc := range commits {
+		oids = append(oids, gc.hash.bytes()...)
+		cdat = append(cdat, gc.tree.bytes()...)
+		parents := [2]uint32{commitGraphNoParent, commitGraphNoParent}
+		for i, parent := range gc.parents[:min(len(gc.parents), 2)] {
+			parents[i] = position[parent]
+		}
+		if len(gc.parents) > 2 {
+			parents[1] = commitGraphEdgeIndex | uint32(len(edges)/4)
+			for i, parent := range gc.parents[1:] {
+				edge := position[parent]
+				if i == len(gc.parents)-2 {
+					edge |= commitGraphEdgeIndex
+				}
+				edges = binary.BigEndian.AppendUint32(edges, edge)
+			}
+		}
+		cdat = binary.BigEndian.AppendUint32(cdat, parents[0])
+		cdat = binary.BigEndian.AppendUint32(cdat, parents[1])
+		t := uint64(gc.time) & (1<<34 - 1)
+		cdat = binary.BigEndian.AppendUint32(cdat, gc.generation<<2|uint32(t>>32))
+		cdat = binary.BigEndian.AppendUint32(cdat, uint32(t))
+	}
+
+	type chunk struct {
+		id   uint32
+		data []byte
+	}
+	chunks := []chunk{
+		{commitGraphChunkOIDFanout, fanout},
+		{commitGraphChunkOIDLookup, oids},
+		{commitGraphChunkData, cdat},
+	}
+	if len(edges) > 0 {
+		chunks = append(chunks, chunk{commitGraphChunkExtraEdges, edges})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(commitGraphSignature)
+	buf.Write([]byte{commitGraphVersion, hashAlgo.formatID, byte(len(chunks)), 0})
+
+	offset := uint64(commitGraphHeaderSize + (len(chunks)+1)*commitGraphChunkSize)
+	for _, c := range chunks {
+		buf.Write(binary.BigEndian.AppendUint32(nil, c.id))
+		buf.Write(binary.BigEndian.AppendUint64(nil, offset))
+		offset += uint64(len(c.data))
+	}
+	buf.Write(make([]byte, 4))
+	buf.Write(binary.BigEndian.AppendUint64(nil, offset))
+	for _, c := range chunks {
+		buf.Write(c.data)
+	}
+
+	sum := hashAlgo.new()
+	sum.Write(buf.Bytes())
+	buf.Write(sum.Sum(nil))
+	return buf.Bytes()
+}
+
+// writeCommitGraph writes the commit-graph of everything reachable from
+// starts through a lock file. Like git, it writes nothing without commits.
+func writeCommitGraph(starts []objectID) error {
+	commits, err := buildCommitGraph(starts)
+	if err != nil || len(commits) == 0 {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(commitGraphFile), 0755); err != nil {
+		return fmt.Errorf("failed to create info directory: %w", err)
+	}
+	lock := commitGraphFile + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("failed to lock commit-graph: %w", err)
+	}
+	if _, err := f.Write(encodeCommitGraph(commits)); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return fmt.Errorf("failed to write commit-graph: %w", err)
+	}
+	if err := fsyncFile(f, fsyncCommitGraph); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to write commit-graph: %w", err)
+	}
+	if err := os.Rename(lock, commitGraphFile); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to install commit-graph: %w", err)
+	}
+	reloadCommitGraph()
+	return nil
+}
+
+// reachableCommitTips returns the commits HEAD and the refs point at,
+// peeling tags.
+func reachableCommitTips() ([]objectID, error) {
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+	var tips []objectID
+	if head, err := resolveRef("HEAD"); err == nil {
+		tips = append(tips, head)
+	}
+	for _, hash := range refs {
+		tips = append(tips, hash)
+	}
+	var commits []objectID
+	for _, tip := range tips {
+		if !hasObject(tip) {
+			continue
+		}
+		hash, ok, err := peelToCommit(tip)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			commits = append(commits, hash)
+		}
+	}
+	return commits, nil
+}
+
+// packedCommits returns the commits stored in packs, which is what git
+// writes a commit-graph for by default.
+func packedCommits() ([]objectID, error) {
+	packs, err := openPacks()
+	if err != nil {
+		return nil, err
+	}
+	var commits []objectID
+	for _, p := range packs {
+		for i := 0; i < p.idx.count; i++ {
+			info, err := p.entryInfo(p.idx.offsetAt(i))
+			if err != nil {
+				return nil, err
+			}
+			if info.objType == commitObject {
+				commits = append(commits, p.idx.hashAt(i))
+			}
+		}
+	}
+	return commits, nil
+}
+
+// verifyCommitGraph checks the commit-graph against its checksum and the
+// commit objects, reporting each problem. It returns false if any was
+// found.
+func verifyCommitGraph(g *commitGraph) bool {
+	ok := true
+	report := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+		ok = false
+	}
+
+	sum := hashAlgo.new()
+	sum.Write(g.data[:len(g.data)-hashAlgo.size])
+	if !bytes.Equal(sum.Sum(nil), g.data[len(g.data)-hashAlgo.size:]) {
+		report("commit-graph has incorrect checksum and is likely corrupt")
+	}
+
+	var counts [256]uint32
+	for i := 0; i < g.count; i++ {
+		hash := g.hashAt(i)
+		counts[hash[0]]++
+		if i > 0 {
+			if prev := g.hashAt(i - 1); bytes.Compare(prev[:], hash[:]) >= 0 {
+				report("commit-graph has incorrect OID order: %s then %s", prev, hash)
+			}
+		}
+	}
+	var total uint32
+	for i, c := range counts {
+		total += c
+		if fanout := binary.BigEndian.Uint32(g.fanout[i*4:]); fanout != total {
+			report("commit-graph has incorrect fanout value: fanout[%d] = %d != %d", i, fanout, total)
+		}
+	}
+	if !ok {
+		return false
+	}
+
+	for i := 0; i < g.count; i++ {
+		hash := g.hashAt(i)
+		c, err := readCommit(hash)
+		if err != nil {
+			report("failed to parse commit %s from object database for commit-graph", hash)
+			continue
+		}
+		node, err := g.nodeAt(i)
+		if err != nil {
+			report("failed to parse commit %s from commit-graph", hash)
+			continue
+		}
+		if node.tree != c.tree {
+			report("root tree OID for commit %s in commit-graph is %s != %s", hash, node.tree, c.tree)
+		}
+
+		var maxGeneration uint32
+		for j, parent := range c.parents {
+			if j == len(node.parents) {
+				report("commit-graph parent list for commit %s terminates early", hash)
+				break
+			}
+			if node.parents[j] != parent {
+				report("commit-graph parent for %s is %s != %s", hash, node.parents[j], parent)
+			}
+			if p, found := g.lookup(parent); found && p.generation > maxGeneration {
+				maxGeneration = p.generation
+			}
+		}
+		if len(node.parents) > len(c.parents) {
+			report("commit-graph parent list for commit %s is too long", hash)
+		}
+		if maxGeneration == generationMax {
+			maxGeneration--
+		}
+		if node.generation < maxGeneration+1 {
+			report("commit-graph generation for commit %s is %d < %d", hash, node.generation, maxGeneration+1)
+		}
+		if t := identTimestamp(c.committer) & (1<<34 - 1); node.time != t {
+			report("commit date for commit %s in commit-graph is %d != %d", hash, node.time, t)
+		}
+	}
+	return ok
+}
+
+func runCommitGraph(args []string) error {
+	if len(args) == 0 || args[0] != "write" && args[0] != "verify" {
+		return fmt.Errorf("usage: mygit commit-graph write [--reachable | --stdin-commits] | verify")
+	}
+	subcommand := args[0]
+	reachable, stdinCommits := false, false
+	for _, arg := range args[1:] {
+		switch {
+		case arg == "--reachable" && subcommand == "write":
+			reachable = true
+		case arg == "--stdin-commits" && subcommand == "write":
+			stdinCommits = true
+		case arg == "--progress" || arg == "--no-progress":
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+	if reachable && stdinCommits {
+		return fmt.Errorf("options '--reachable' and '--stdin-commits' cannot be used together")
+	}
+
+	if subcommand == "verify" {
+		g, err := readCommitGraph(commitGraphFile)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !verifyCommitGraph(g) {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	// The parents of shallow commits are unknown, so git writes no graph
+	// for them.
+	if shallow, err := readShallow(); err != nil {
+		return err
+	} else if len(shallow) > 0 {
+		return nil
+	}
+	var starts []objectID
+	var err error
+	switch {
+	case reachable:
+		starts, err = reachableCommitTips()
+	case stdinCommits:
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			hash, err := parseHash(scanner.Text())
+			if err != nil {
+				return fmt.Errorf("invalid commit object id: %s", scanner.Text())
+			}
+			commit, ok, err := peelToCommit(hash)
+			if err != nil {
+				return err
+			}
+			if ok {
+				starts = append(starts, commit)
+			}
+		}
+		err = scanner.Err()
+	default:
+		starts, err = packedCommits()
+	}
+	if err != nil {
+		return err
+	}
+	return writeCommitGraph(starts)
+}
@@ -0,0 +1,993 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// configFile is the repository's config, shared by its worktrees.
+var configFile = ".git/config"
+
+// configMu keeps config reads from interleaving with the edits of this
+// process, and edits from losing each other's changes.
+var configMu sync.RWMutex
+
+type configEntry struct {
+	section    string
+	subsection string
+	key        string
+	value      string
+	noValue    bool
+	origin     string
+
+	// Byte offsets of the entry's line(s) within its file, used when
+	// rewriting the file in place.
+	start, end int
+}
+
+func (e configEntry) name() string {
+	if e.subsection != "" {
+		return e.section + "." + e.subsection + "." + e.key
+	}
+	return e.section + "." + e.key
+}
+
+type configSection struct {
+	section    string
+	subsection string
+	// end is the offset just past the header or the section's last entry,
+	// i.e. where a new key should be inserted.
+	end int
+}
+
+type config struct {
+	entries []configEntry
+}
+
+// configFiles returns the files read by loadConfig in increasing order of
+// precedence.
+func configFiles() []string {
+	var files []string
+
+	if os.Getenv("GIT_CONFIG_NOSYSTEM") == "" {
+		files = append(files, systemConfigFile())
+	}
+	if global := os.Getenv("GIT_CONFIG_GLOBAL"); global != "" {
+		files = append(files, global)
+	} else {
+		if xdg := xdgConfigFile(); xdg != "" {
+			files = append(files, xdg)
+		}
+		if home, err := os.UserHomeDir(); err == nil {
+			files = append(files, filepath.Join(home, ".gitconfig"))
+		}
+	}
+	files = append(files, configFile)
+	if worktreeConfigEnabled() {
+		files = append(files, worktreeConfigFile())
+	}
+
+	return files
+}
+
+// worktreeConfigFile returns the config file of the current worktree,
+// which is only read with extensions.worktreeConfig enabled.
+func worktreeConfigFile() string {
+	return filepath.Join(gitDir, "config.worktree")
+}
+
+func worktreeConfigEnabled() bool {
+	return repoFormat.worktreeConfig
+}
+
+// hasLinkedWorktrees reports whether the repository has worktrees besides
+// the main one.
+func hasLinkedWorktrees() bool {
+	entries, err := os.ReadDir(filepath.Join(commonDir, "worktrees"))
+	return err == nil && len(entries) > 0
+}
+
+func systemConfigFile() string {
+	if system := os.Getenv("GIT_CONFIG_SYSTEM"); system != "" {
+		return system
+	}
+	return "/etc/gitconfig"
+}
+
+func globalConfigFile() (string, error) {
+	if global := os.Getenv("GIT_CONFIG_GLOBAL"); global != "" {
+		return global, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	return filepath.Join(home, ".gitconfig"), nil
+}
+
+func xdgConfigFile() string {
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "git", "config")
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config", "git", "config")
+	}
+	return ""
+}
+
+// expandConfigPath expands a leading ~ or ~user in a path given in the
+// config to the home directory of the current or the named user.
+func expandConfigPath(value string) (string, error) {
+	rest, ok := strings.CutPrefix(value, "~")
+	if !ok {
+		return value, nil
+	}
+	name, rest, _ := strings.Cut(rest, "/")
+	var home string
+	if name == "" {
+		dir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("failed to expand user dir in: '%s'", value)
+		}
+		home = dir
+	} else {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", fmt.Errorf("failed to expand user dir in: '%s'", value)
+		}
+		home = u.HomeDir
+	}
+	return filepath.Join(home, rest), nil
+}
+
+// loadConfig reads the system, global and repository config files. Later
+// files override earlier ones, and the environment overrides them all.
+func loadConfig() (*config, error) {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	cfg := &config{}
+	for _, path := range configFiles() {
+		entries, _, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		cfg.entries = append(cfg.entries, entries...)
+	}
+	entries, err := envConfigEntries()
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse command-line config: %w", err)
+	}
+	cfg.entries = append(cfg.entries, entries...)
+	return cfg, nil
+}
+
+// envConfigEntries returns the entries given in the environment as
+// GIT_CONFIG_KEY_<n> and GIT_CONFIG_VALUE_<n>, for each n below
+// GIT_CONFIG_COUNT.
+func envConfigEntries() ([]configEntry, error) {
+	count := os.Getenv("GIT_CONFIG_COUNT")
+	if count == "" {
+		return nil, nil
+	}
+	n, err := strconv.ParseUint(count, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("bogus count in GIT_CONFIG_COUNT")
+	}
+	if n > math.MaxInt32 {
+		return nil, fmt.Errorf("too many entries in GIT_CONFIG_COUNT")
+	}
+
+	var entries []configEntry
+	for i := 0; i < int(n); i++ {
+		key, ok := os.LookupEnv(fmt.Sprintf("GIT_CONFIG_KEY_%d", i))
+		if !ok || key == "" {
+			return nil, fmt.Errorf("missing config key GIT_CONFIG_KEY_%d", i)
+		}
+		value, ok := os.LookupEnv(fmt.Sprintf("GIT_CONFIG_VALUE_%d", i))
+		if !ok {
+			return nil, fmt.Errorf("missing config value GIT_CONFIG_VALUE_%d", i)
+		}
+		section, subsection, name, err := splitConfigName(key)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, configEntry{
+			section:    section,
+			subsection: subsection,
+			key:        name,
+			value:      value,
+			origin:     "command line",
+		})
+	}
+	return entries, nil
+}
+
+func readConfigFile(path string) ([]configEntry, []configSection, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	return parseConfig(data, path)
+}
+
+// splitConfigName splits section[.subsection].key, lowercasing the section
+// and key which are case-insensitive.
+func splitConfigName(name string) (string, string, string, error) {
+	first := strings.IndexByte(name, '.')
+	last := strings.LastIndexByte(name, '.')
+	if first <= 0 || last == len(name)-1 {
+		return "", "", "", fmt.Errorf("key does not contain a section: %s", name)
+	}
+
+	section := strings.ToLower(name[:first])
+	key := strings.ToLower(name[last+1:])
+	var subsection string
+	if first != last {
+		subsection = name[first+1 : last]
+	}
+	return section, subsection, key, nil
+}
+
+func (e configEntry) matches(section, subsection, key string) bool {
+	return e.section == section && e.subsection == subsection && e.key == key
+}
+
+// get returns the last value set for name.
+func (c *config) get(name string) (string, bool) {
+	values := c.getAll(name)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[len(values)-1], true
+}
+
+// getAll returns every value set for name, in order of precedence.
+func (c *config) getAll(name string) []string {
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return nil
+	}
+
+	var values []string
+	for _, e := range c.entries {
+		if e.matches(section, subsection, key) {
+			if e.noValue {
+				values = append(values, "true")
+			} else {
+				values = append(values, e.value)
+			}
+		}
+	}
+	return values
+}
+
+func (c *config) getBool(name string, def bool) (bool, error) {
+	value, ok := c.get(name)
+	if !ok {
+		return def, nil
+	}
+	b, err := parseConfigBool(value)
+	if err != nil {
+		return false, fmt.Errorf("bad boolean config value '%s' for '%s'", value, name)
+	}
+	return b, nil
+}
+
+func (c *config) getInt(name string, def int) (int, error) {
+	value, ok := c.get(name)
+	if !ok {
+		return def, nil
+	}
+	n, err := parseConfigInt(value)
+	if err == nil && int64(int(n)) != n {
+		err = errConfigIntRange
+	}
+	if err != nil {
+		return 0, fmt.Errorf("bad numeric config value '%s' for '%s': %w", value, name, err)
+	}
+	return int(n), nil
+}
+
+// parseConfigBool accepts git's spellings of booleans, any integer
+// standing for whether it is non-zero.
+func parseConfigBool(value string) (bool, error) {
+	if b, ok := parseConfigBoolText(value); ok {
+		return b, nil
+	}
+	if n, err := parseConfigInt(value); err == nil {
+		return n != 0, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", value)
+}
+
+// parseConfigBoolText recognizes the boolean words, and the empty value
+// of "key =" as false.
+func parseConfigBoolText(value string) (bool, bool) {
+	switch strings.ToLower(value) {
+	case "true", "yes", "on":
+		return true, true
+	case "false", "no", "off", "":
+		return false, true
+	}
+	return false, false
+}
+
+var (
+	errConfigIntUnit  = errors.New("invalid unit")
+	errConfigIntRange = errors.New("out of range")
+)
+
+// parseConfigInt parses an integer in decimal, octal or hex with an
+// optional k, m or g suffix that scales it by 1024, 1024² or 1024³.
+func parseConfigInt(value string) (int64, error) {
+	digits, scale := value, int64(1)
+	if value != "" {
+		switch value[len(value)-1] {
+		case 'k', 'K':
+			scale = 1 << 10
+		case 'm', 'M':
+			scale = 1 << 20
+		case 'g', 'G':
+			scale = 1 << 30
+		}
+	}
+	if scale > 1 {
+		digits = value[:len(value)-1]
+	}
+	n, err := strconv.ParseInt(digits, 0, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return 0, errConfigIntRange
+	}
+	if err != nil || strings.Contains(digits, "_") {
+		return 0, errConfigIntUnit
+	}
+	if n > math.MaxInt64/scale || n < math.MinInt64/scale {
+		return 0, errConfigIntRange
+	}
+	return n * scale, nil
+}
+
+type configParser struct {
+	data     []byte
+	pos      int
+	line     int
+	origin   string
+	entries  []configEntry
+	sections []configSection
+}
+
+func parseConfig(data []byte, origin string) ([]configEntry, []configSection, error) {
+	p := &configParser{data: data, line: 1, origin: origin}
+	if err := p.parse(); err != nil {
+		return nil, nil, fmt.Errorf("bad config line %d in file %s: %w", p.line, origin, err)
+	}
+	return p.entries, p.sections, nil
+}
+
+func (p *configParser) peek() int {
+	if p.pos >= len(p.data) {
+		return -1
+	}
+	return int(p.data[p.pos])
+}
+
+func (p *configParser) next() int {
+	c := p.peek()
+	if c != -1 {
+		p.pos++
+		if c == '\n' {
+			p.line++
+		}
+	}
+	return c
+}
+
+func (p *configParser) skipLine() {
+	for c := p.peek(); c != -1 && c != '\n'; c = p.peek() {
+		p.next()
+	}
+	p.next()
+}
+
+func (p *configParser) parse() error {
+	for {
+		c := p.peek()
+		switch {
+		case c == -1:
+			return nil
+		case c == '\n' || c == ' ' || c == '\t' || c == '\r':
+			p.next()
+		case c == '#' || c == ';':
+			p.skipLine()
+		case c == '[':
+			if err := p.parseSectionHeader(); err != nil {
+				return err
+			}
+		case isConfigKeyChar(byte(c)):
+			if len(p.sections) == 0 {
+				return fmt.Errorf("key outside of a section")
+			}
+			if err := p.parseEntry(); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unexpected character %q", rune(c))
+		}
+	}
+}
+
+func (p *configParser) parseSectionHeader() error {
+	p.next() // [
+
+	start := p.pos
+	for c := p.peek(); c != -1 && (isConfigKeyChar(byte(c)) || c == '.'); c = p.peek() {
+		p.next()
+	}
+	name := string(p.data[start:p.pos])
+	if name == "" {
+		return fmt.Errorf("empty section name")
+	}
+
+	var section, subsection string
+	switch p.peek() {
+	case ']':
+		p.next()
+		// Legacy [section.subsection] syntax, where the subsection is
+		// case-insensitive.
+		var ok bool
+		section, subsection, ok = strings.Cut(name, ".")
+		if ok {
+			subsection = strings.ToLower(subsection)
+		}
+	case ' ', '\t':
+		for c := p.peek(); c == ' ' || c == '\t'; c = p.peek() {
+			p.next()
+		}
+		sub, err := p.parseSubsection()
+		if err != nil {
+			return err
+		}
+		section, subsection = name, sub
+	default:
+		return fmt.Errorf("invalid section header")
+	}
+
+	p.sections = append(p.sections, configSection{
+		section:    strings.ToLower(section),
+		subsection: subsection,
+		end:        p.lineEnd(),
+	})
+	return nil
+}
+
+func (p *configParser) parseSubsection() (string, error) {
+	if p.next() != '"' {
+		return "", fmt.Errorf("expected quoted subsection")
+	}
+
+	var b strings.Builder
+	for {
+		c := p.next()
+		switch c {
+		case -1, '\n':
+			return "", fmt.Errorf("unterminated subsection")
+		case '\\':
+			c = p.next()
+			if c == -1 || c == '\n' {
+				return "", fmt.Errorf("unterminated subsection")
+			}
+		case '"':
+			if p.next() != ']' {
+				return "", fmt.Errorf("expected ']' after subsection")
+			}
+			return b.String(), nil
+		}
+		b.WriteByte(byte(c))
+	}
+}
+
+// lineEnd returns the offset just past the rest of the current line if it
+// holds nothing but whitespace or a comment, or the current offset otherwise.
+func (p *configParser) lineEnd() int {
+	for i := p.pos; i < len(p.data); i++ {
+		switch p.data[i] {
+		case ' ', '\t', '\r':
+			continue
+		case '\n':
+			return i + 1
+		case '#', ';':
+			if nl := strings.IndexByte(string(p.data[i:]), '\n'); nl != -1 {
+				return i + nl + 1
+			}
+			return len(p.data)
+		}
+		return p.pos
+	}
+	return len(p.data)
+}
+
+func (p *configParser) parseEntry() error {
+	start := p.pos
+	for start > 0 && (p.data[start-1] == ' ' || p.data[start-1] == '\t') {
+		start--
+	}
+	if start > 0 && p.data[start-1] != '\n' {
+		start = p.pos
+	}
+
+	keyStart := p.pos
+	for c := p.peek(); c != -1 && isConfigKeyChar(byte(c)); c = p.peek() {
+		p.next()
+	}
+	key := strings.ToLower(string(p.data[keyStart:p.pos]))
+
+	for c := p.peek(); c == ' ' || c == '\t' || c == '\r'; c = p.peek() {
+		p.next()
+	}
+
+	entry := configEntry{
+		section:    p.sections[len(p.sections)-1].section,
+		subsection: p.sections[len(p.sections)-1].subsection,
+		key:        key,
+		origin:     p.origin,
+		start:      start,
+	}
+
+	switch p.peek() {
+	case '=':
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return err
+		}
+		entry.value = value
+	case -1, '\n', '#', ';':
+		entry.noValue = true
+		if p.peek() != -1 {
+			p.skipLine()
+		}
+	default:
+		return fmt.Errorf("invalid key %q", key)
+	}
+
+	entry.end = p.pos
+	p.sections[len(p.sections)-1].end = p.pos
+	p.entries = append(p.entries, entry)
+	return nil
+}
+
+// parseValue follows git's rules: whitespace outside quotes is trimmed at
+// the ends and preserved inside, comments end the value and a backslash
+// escapes \n, \t, \b, \\, \" or a line break.
+func (p *configParser) parseValue() (string, error) {
+	var b strings.Builder
+	quote, comment := false, false
+	space := 0
+
+	for {
+		c := p.next()
+		if c == -1 || c == '\n' {
+			if quote {
+				return "", fmt.Errorf("unterminated quoted value")
+			}
+			return b.String(), nil
+		}
+		if comment {
+			continue
+		}
+		if !quote && (c == ' ' || c == '\t' || c == '\r') {
+			if b.Len() > 0 {
+				space++
+			}
+			continue
+		}
+		if !quote && (c == '#' || c == ';') {
+			comment = true
+			continue
+		}
+		for ; space > 0; space-- {
+			b.WriteByte(' ')
+		}
+		switch c {
+		case '\\':
+			switch esc := p.next(); esc {
+			case '\n':
+			case 't':
+				b.WriteByte('\t')
+			case 'b':
+				b.WriteByte('\b')
+			case 'n':
+				b.WriteByte('\n')
+			case '\\', '"':
+				b.WriteByte(byte(esc))
+			default:
+				return "", fmt.Errorf("invalid escape sequence")
+			}
+		case '"':
+			quote = !quote
+		default:
+			b.WriteByte(byte(c))
+		}
+	}
+}
+
+func isConfigKeyChar(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-'
+}
+
+func quoteConfigValue(value string) string {
+	needsQuotes := value != strings.TrimSpace(value) || strings.ContainsAny(value, "#;")
+
+	var b strings.Builder
+	for _, c := range value {
+		switch c {
+		case '\\':
+			b.WriteString(`\\`)
+		case '"':
+			b.WriteString(`\"`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		default:
+			b.WriteRune(c)
+		}
+	}
+
+	if needsQuotes {
+		return `"` + b.String() + `"`
+	}
+	return b.String()
+}
+
+func formatSectionHeader(section, subsection string) string {
+	if subsection == "" {
+		return "[" + section + "]\n"
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(subsection)
+	return fmt.Sprintf("[%s \"%s\"]\n", section, escaped)
+}
+
+// setConfigValue sets name to value in the config file at path, replacing
+// the last existing assignment or adding one to the matching section.
+func setConfigValue(path, name, value string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return err
+	}
+	rawKey := name[strings.LastIndexByte(name, '.')+1:]
+	line := fmt.Sprintf("\t%s = %s\n", rawKey, quoteConfigValue(value))
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	entries, sections, err := parseConfig(data, path)
+	if err != nil {
+		return err
+	}
+
+	var updated []byte
+	if i := lastMatchingEntry(entries, section, subsection, key); i != -1 {
+		updated = spliceBytes(data, entries[i].start, entries[i].end, line)
+	} else if j := lastMatchingSection(sections, section, subsection); j != -1 {
+		end := sections[j].end
+		if end > 0 && data[end-1] != '\n' {
+			line = "\n" + line
+		}
+		updated = spliceBytes(data, end, end, line)
+	} else {
+		updated = data
+		if len(updated) > 0 && updated[len(updated)-1] != '\n' {
+			updated = append(updated, '\n')
+		}
+		updated = append(updated, formatSectionHeader(section, subsection)...)
+		updated = append(updated, line...)
+	}
+
+	return writeConfigFile(path, updated)
+}
+
+// unsetConfigValue removes the assignment of name from the config file at
+// path. It refuses to guess when the key has several values unless all is
+// set.
+func unsetConfigValue(path, name string, all bool) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+	section, subsection, key, err := splitConfigName(name)
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read config file: %w", err)
+	}
+	entries, _, err := parseConfig(data, path)
+	if err != nil {
+		return err
+	}
+
+	var matches []configEntry
+	for _, e := range entries {
+		if e.matches(section, subsection, key) {
+			matches = append(matches, e)
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no such key: %s", name)
+	}
+	if len(matches) > 1 && !all {
+		return fmt.Errorf("%s has multiple values", name)
+	}
+
+	for i := len(matches) - 1; i >= 0; i-- {
+		data = spliceBytes(data, matches[i].start, matches[i].end, "")
+	}
+	return writeConfigFile(path, data)
+}
+
+func lastMatchingEntry(entries []configEntry, section, subsection, key string) int {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].matches(section, subsection, key) {
+			return i
+		}
+	}
+	return -1
+}
+
+func lastMatchingSection(sections []configSection, section, subsection string) int {
+	for i := len(sections) - 1; i >= 0; i-- {
+		if sections[i].section == section && sections[i].subsection == subsection {
+			return i
+		}
+	}
+	return -1
+}
+
+func spliceBytes(data []byte, start, end int, insert string) []byte {
+	result := make([]byte, 0, len(data)-(end-start)+len(insert))
+	result = append(result, data[:start]...)
+	result = append(result, insert...)
+	return append(result, data[end:]...)
+}
+
+func writeConfigFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create config directory: %w", err)
+	}
+
+	tmp := path + ".lock"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write config file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to update config file: %w", err)
+	}
+	return nil
+}
+
+func runConfig(args []string) error {
+	var file, action, name, value, valueType string
+	var positional []string
+
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; arg {
+		case "--type":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a type", arg)
+			}
+			i++
+			valueType = args[i]
+		case "--bool", "--int", "--bool-or-int", "--path", "--expiry-date":
+			valueType = strings.TrimPrefix(arg, "--")
+		case "--no-type":
+			valueType = ""
+		case "--global":
+			path, err := globalConfigFile()
+			if err != nil {
+				return err
+			}
+			file = path
+		case "--system":
+			file = systemConfigFile()
+		case "--local":
+			file = configFile
+		case "--worktree":
+			switch {
+			case worktreeConfigEnabled():
+				file = worktreeConfigFile()
+			case hasLinkedWorktrees():
+				return fmt.Errorf("--worktree cannot be used with multiple working trees unless the config extension worktreeConfig is enabled")
+			default:
+				file = configFile
+			}
+		case "-f", "--file":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a file", arg)
+			}
+			i++
+			file = args[i]
+		case "--get", "--get-all", "--set", "--unset", "--unset-all", "-l", "--list":
+			action = arg
+		default:
+			if t, ok := strings.CutPrefix(arg, "--type="); ok {
+				valueType = t
+				continue
+			}
+			if strings.HasPrefix(arg, "-") {
+				return fmt.Errorf("unknown option %s", arg)
+			}
+			positional = append(positional, arg)
+		}
+	}
+	switch valueType {
+	case "", "bool", "int", "bool-or-int", "path", "expiry-date", "color":
+	default:
+		return fmt.Errorf("unrecognized --type argument, %s", valueType)
+	}
+
+	if action == "" {
+		switch len(positional) {
+		case 1:
+			action = "--get"
+		case 2:
+			action = "--set"
+		default:
+			return fmt.Errorf("usage: mygit config [--global|--system|--local|--worktree|-f <file>] [--type=<type>] [--get|--get-all|--set|--unset|--unset-all|--list] [<name> [<value>]]")
+		}
+	}
+
+	if len(positional) > 0 {
+		name = positional[0]
+	}
+	if len(positional) > 1 {
+		value = positional[1]
+	}
+
+	switch action {
+	case "-l", "--list":
+		entries, err := scopedConfigEntries(file)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.noValue {
+				fmt.Println(e.name())
+			} else {
+				fmt.Printf("%s=%s\n", e.name(), e.value)
+			}
+		}
+	case "--get", "--get-all":
+		if name == "" {
+			return fmt.Errorf("%s requires a name", action)
+		}
+		entries, err := scopedConfigEntries(file)
+		if err != nil {
+			return err
+		}
+		values := (&config{entries: entries}).getAll(name)
+		if len(values) == 0 {
+			os.Exit(1)
+		}
+		if action == "--get" {
+			values = values[len(values)-1:]
+		}
+		for _, v := range values {
+			formatted, err := formatConfigValue(valueType, name, v)
+			if err != nil {
+				return err
+			}
+			fmt.Println(formatted)
+		}
+	case "--set":
+		if len(positional) != 2 {
+			return fmt.Errorf("--set requires a name and a value")
+		}
+		if file == "" {
+			file = configFile
+		}
+		value, err := normalizeConfigValue(valueType, name, value)
+		if err != nil {
+			return err
+		}
+		return setConfigValue(file, name, value)
+	case "--unset", "--unset-all":
+		if name == "" {
+			return fmt.Errorf("%s requires a name", action)
+		}
+		if file == "" {
+			file = configFile
+		}
+		return unsetConfigValue(file, name, action == "--unset-all")
+	}
+
+	return nil
+}
+
+// formatConfigValue shows a value the way --type asks for: in canonical
+// form, with a path expanded, a date as a timestamp or a color as its
+// escape sequence.
+func formatConfigValue(valueType, name, value string) (string, error) {
+	switch valueType {
+	case "bool":
+		b, err := parseConfigBool(value)
+		if err != nil {
+			return "", fmt.Errorf("bad boolean config value '%s' for '%s'", value, name)
+		}
+		return strconv.FormatBool(b), nil
+	case "int":
+		n, err := parseConfigInt(value)
+		if err != nil {
+			return "", fmt.Errorf("bad numeric config value '%s' for '%s': %w", value, name, err)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case "bool-or-int":
+		if b, ok := parseConfigBoolText(value); ok {
+			return strconv.FormatBool(b), nil
+		}
+		n, err := parseConfigInt(value)
+		if err != nil {
+			return "", fmt.Errorf("bad numeric config value '%s' for '%s': %w", value, name, err)
+		}
+		return strconv.FormatInt(n, 10), nil
+	case "path":
+		return expandConfigPath(value)
+	case "expiry-date":
+		t, err := parseExpiry(value, time.Now())
+		if err != nil {
+			return "", fmt.Errorf("'%s' for '%s' is not a valid timestamp", value, name)
+		}
+		if t.IsZero() {
+			return "0", nil
+		}
+		return strconv.FormatInt(t.Unix(), 10), nil
+	case "color":
+		color, err := parseColor(value)
+		if err != nil {
+			return "", fmt.Errorf("cannot parse color '%s': %w", value, err)
+		}
+		return color, nil
+	}
+	return value, nil
+}
+
+// normalizeConfigValue checks a value being set against --type. Booleans
+// and numbers are stored in canonical form, other types as given.
+func normalizeConfigValue(valueType, name, value string) (string, error) {
+	formatted, err := formatConfigValue(valueType, name, value)
+	if err != nil {
+		return "", err
+	}
+	switch valueType {
+	case "bool", "int", "bool-or-int":
+		return formatted, nil
+	}
+	return value, nil
+}
+
+func scopedConfigEntries(file string) ([]configEntry, error) {
+	if file != "" {
+		entries, _, err := readConfigFile(file)
+		return entries, err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return cfg.entries, nil
+}
@@ -0,0 +1,125 @@
+package mygit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const gitlinkMode = "160000"
+
+// readShallow returns the commits listed in .git/shallow. Their parents are
+// intentionally absent from the repository.
+func readShallow() (map[objectID]bool, error) {
+	shallow := make(map[objectID]bool)
+
+	f, err := os.Open(filepath.Join(commonDir, "shallow"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return shallow, nil
+		}
+		return nil, fmt.Errorf("failed to open shallow file: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hash, err := parseHash(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("invalid shallow file: %w", err)
+		}
+		shallow[hash] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read shallow file: %w", err)
+	}
+
+	return shallow, nil
+}
+
+// checkConnectivity walks every object reachable from tips and fails if any
+// of them is missing or unparsable. Commits already pointed to by existing
+// refs are assumed complete and end the walk, as do shallow commits, whose
+// parents are not expected to be present. Objects referenced from promisor
+// packs may be missing.
+func checkConnectivity(tips []objectID, shallow map[objectID]bool) error {
+	existing, err := listRefs()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[objectID]bool)
+	for _, hash := range existing {
+		seen[hash] = true
+	}
+
+	type item struct {
+		hash objectID
+		// promised is set when a promisor object references hash.
+		promised bool
+	}
+	var pending []item
+	for _, tip := range tips {
+		if !seen[tip] {
+			pending = append(pending, item{hash: tip})
+		}
+	}
+
+	for len(pending) > 0 {
+		it := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		hash := it.hash
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		if it.promised && !hasObject(hash) {
+			continue
+		}
+
+		objType, content, err := readObject(hash)
+		if err != nil {
+			return fmt.Errorf("missing object %x: %w", hash, err)
+		}
+		promised := isPromisorObject(hash)
+
+		switch objType {
+		case commitObject:
+			c, err := parseCommit(content)
+			if err != nil {
+				return fmt.Errorf("corrupt commit %x: %w", hash, err)
+			}
+			pending = append(pending, item{hash: c.tree, promised: promised})
+			if !shallow[hash] {
+				for _, parent := range c.parents {
+					pending = append(pending, item{hash: parent, promised: promised})
+				}
+			}
+		case treeObject:
+			entries, err := parseTree(content)
+			if err != nil {
+				return fmt.Errorf("corrupt tree %x: %w", hash, err)
+			}
+			for _, entry := range entries {
+				if entry.mode == gitlinkMode {
+					continue
+				}
+				pending = append(pending, item{hash: entry.hash, promised: promised})
+			}
+		case tagObject:
+			t, err := parseTag(content)
+			if err != nil {
+				return fmt.Errorf("corrupt tag %x: %w", hash, err)
+			}
+			pending = append(pending, item{hash: t.object, promised: promised})
+		case blobObject:
+		default:
+			return fmt.Errorf("object %x has unknown type %q", hash, objType)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,125 @@
+package mygit
+
+import (
+	"bytes"
+	"sync"
+)
+
+// worktreeAttrs holds the attributes of the working tree once read by
+// loadWorktreeAttrs, which worktreeAttrsMu guards.
+var (
+	worktreeAttrsMu sync.Mutex
+	worktreeAttrs   *attrRules
+)
+
+func loadWorktreeAttrs() (*attrRules, error) {
+	worktreeAttrsMu.Lock()
+	defer worktreeAttrsMu.Unlock()
+	if worktreeAttrs != nil {
+		return worktreeAttrs, nil
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	if worktreeAttrs, err = worktreeAttrRules(cfg); err != nil {
+		return nil, err
+	}
+	return worktreeAttrs, nil
+}
+
+// convertToGit turns the content of a working tree file into what is
+// stored for it, according to its attributes: the clean filter of its
+// filter driver runs first, then line endings are normalized.
+func convertToGit(path string, data []byte) ([]byte, error) {
+	attrs, err := fileAttrs(path)
+	if err != nil {
+		return nil, err
+	}
+	if data, err = applyFilter(path, data, attrs["filter"], "clean"); err != nil {
+		return nil, err
+	}
+	if data, err = crlfToGit(path, data, attrs); err != nil {
+		return nil, err
+	}
+	if attrs["ident"] == attrSet {
+		data = collapseIdent(data)
+	}
+	return lfsClean(data)
+}
+
+// convertToWorktree turns the stored content of a file into what is
+// written to the working tree, undoing convertToGit.
+func convertToWorktree(path string, data []byte) ([]byte, error) {
+	attrs, err := fileAttrs(path)
+	if err != nil {
+		return nil, err
+	}
+	if attrs["ident"] == attrSet {
+		data = expandIdent(data, hashObjectData(blobObject, data))
+	}
+	if data, err = crlfToWorktree(data, attrs); err != nil {
+		return nil, err
+	}
+	if data, err = applyFilter(path, data, attrs["filter"], "smudge"); err != nil {
+		return nil, err
+	}
+	return lfsSmudge(data)
+}
+
+// fileAttrs returns the attributes of a working tree file.
+func fileAttrs(path string) (map[string]string, error) {
+	rules, err := loadWorktreeAttrs()
+	if err != nil {
+		return nil, err
+	}
+	return rules.lookup(path, false)
+}
+
+// identKeyword starts the keyword the ident attribute expands.
+var identKeyword = []byte("$Id")
+
+// replaceIdents rewrites every $Id$ and $Id: ... $ keyword of data, those
+// whose end is not on the same line left alone.
+func replaceIdents(data []byte, keyword []byte) []byte {
+	var out []byte
+	rest := data
+	for {
+		i := bytes.Index(rest, identKeyword)
+		if i < 0 {
+			break
+		}
+		after := rest[i+len(identKeyword):]
+		end := -1
+		switch {
+		case len(after) > 0 && after[0] == '$':
+			end = 0
+		case len(after) > 0 && after[0] == ':':
+			line, _, _ := bytes.Cut(after, []byte("\n"))
+			end = bytes.IndexByte(line, '$')
+		}
+		if end < 0 {
+			out = append(out, rest[:i+len(identKeyword)]...)
+			rest = after
+			continue
+		}
+		out = append(out, rest[:i]...)
+		out = append(out, keyword...)
+		rest = after[end+1:]
+	}
+	if out == nil {
+		return data
+	}
+	return append(out, rest...)
+}
+
+// collapseIdent turns expanded $Id: <hash> $ keywords back into $Id$.
+func collapseIdent(data []byte) []byte {
+	return replaceIdents(data, []byte("$Id$"))
+}
+
+// expandIdent writes the hash of the blob into the $Id$ keywords of its
+// content.
+func expandIdent(data []byte, blob objectID) []byte {
+	return replaceIdents(data, []byte("$Id: "+blob.String()+" $"))
+}
@@ -0,0 +1,200 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// objectCounts are the statistics reported by count-objects.
+type objectCounts struct {
+	loose         int
+	looseSize     int64
+	inPack        int
+	packs         int
+	packSize      int64
+	prunePackable int
+	garbage       int
+	garbageSize   int64
+}
+
+// reportGarbage counts a stray file in the object directory and warns
+// about it when verbose.
+func (c *objectCounts) reportGarbage(msg, path string, verbose bool) {
+	if fi, err := os.Stat(path); err == nil {
+		c.garbageSize += fi.Size()
+	}
+	c.garbage++
+	if verbose {
+		fmt.Fprintf(os.Stderr, "warning: %s: %s\n", msg, path)
+	}
+}
+
+// countPackDir checks the pack directory. Files belonging to a pack are
+// grouped by name, and a group that lacks its .pack or .idx is garbage,
+// as is anything that is not a pack file at all.
+func countPackDir(c *objectCounts, verbose bool) error {
+	entries, err := os.ReadDir(packDir)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read pack directory: %w", err)
+	}
+
+	groups := make(map[string][]string)
+	var bases []string
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		path := filepath.Join(packDir, e.Name())
+		ext := filepath.Ext(e.Name())
+		switch ext {
+		case ".pack", ".idx", ".bitmap", ".keep", ".promisor", ".rev", ".mtimes":
+			base := strings.TrimSuffix(path, ext)
+			if groups[base] == nil {
+				bases = append(bases, base)
+			}
+			groups[base] = append(groups[base], ext)
+		default:
+			if e.Name() != "multi-pack-index" {
+				c.reportGarbage("garbage found", path, verbose)
+			}
+		}
+	}
+
+	sort.Strings(bases)
+	for _, base := range bases {
+		exts := groups[base]
+		sort.Strings(exts)
+		hasPack, hasIdx := false, false
+		for _, ext := range exts {
+			hasPack = hasPack || ext == ".pack"
+			hasIdx = hasIdx || ext == ".idx"
+		}
+		if hasPack && hasIdx {
+			c.packs++
+			for _, ext := range []string{".pack", ".idx"} {
+				if fi, err := os.Stat(base + ext); err == nil {
+					c.packSize += fi.Size()
+				}
+			}
+			continue
+		}
+		msg := "garbage found"
+		if hasPack {
+			msg = "no corresponding .idx"
+		} else if hasIdx {
+			msg = "no corresponding .pack"
+		}
+		for _, ext := range exts {
+			c.reportGarbage(msg, base+ext, verbose)
+		}
+	}
+
+	packed, err := listPackedObjects()
+	if err != nil {
+		return err
+	}
+	c.inPack = len(packed)
+	return nil
+}
+
+// countLoose counts the loose objects and the stray files next to them.
+func countLoose(c *objectCounts, verbose bool) error {
+	dirs, err := os.ReadDir(objDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read object directory: %w", err)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || !isHexFanout(dir.Name()) {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(objDir, dir.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read object directory: %w", err)
+		}
+		for _, file := range files {
+			path := filepath.Join(objDir, dir.Name(), file.Name())
+			hash, err := parseHash(dir.Name() + file.Name())
+			if err != nil {
+				c.reportGarbage("garbage found", path, verbose)
+				continue
+			}
+			fi, err := file.Info()
+			if err != nil {
+				return fmt.Errorf("failed to stat loose object: %w", err)
+			}
+			c.loose++
+			c.looseSize += diskUsage(fi)
+			if _, _, ok := findPacked(hash); ok {
+				c.prunePackable++
+			}
+		}
+	}
+	return nil
+}
+
+func isHexFanout(name string) bool {
+	return len(name) == 2 && strings.Trim(name, "0123456789abcdef") == ""
+}
+
+func runCountObjects(args []string) error {
+	verbose, human := false, false
+	for _, arg := range args {
+		switch arg {
+		case "-v", "--verbose":
+			verbose = true
+		case "-H", "--human-readable":
+			human = true
+		case "-vH", "-Hv":
+			verbose, human = true, true
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	size := func(n int64) string {
+		if human {
+			return humanizeBytes(n)
+		}
+		return fmt.Sprint(n / 1024)
+	}
+
+	var c objectCounts
+	if verbose {
+		if err := countPackDir(&c, verbose); err != nil {
+			return err
+		}
+	}
+	if err := countLoose(&c, verbose); err != nil {
+		return err
+	}
+
+	if !verbose {
+		if human {
+			fmt.Printf("%d objects, %s\n", c.loose, humanizeBytes(c.looseSize))
+		} else {
+			fmt.Printf("%d objects, %d kilobytes\n", c.loose, c.looseSize/1024)
+		}
+		return nil
+	}
+	fmt.Printf("count: %d\n", c.loose)
+	fmt.Printf("size: %s\n", size(c.looseSize))
+	fmt.Printf("in-pack: %d\n", c.inPack)
+	fmt.Printf("packs: %d\n", c.packs)
+	fmt.Printf("size-pack: %s\n", size(c.packSize))
+	fmt.Printf("prune-packable: %d\n", c.prunePackable)
+	fmt.Printf("garbage: %d\n", c.garbage)
+	fmt.Printf("size-garbage: %s\n", size(c.garbageSize))
+	for _, dir := range alternateObjectDirs() {
+		fmt.Printf("alternate: %s\n", quotePath(dir, true))
+	}
+	return nil
+}
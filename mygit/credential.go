@@ -0,0 +1,350 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// credential is the set of attributes exchanged with credential helpers
+// in git's "key=value" format.
+type credential struct {
+	protocol string
+	host     string
+	path     string
+	username string
+	password string
+}
+
+// credentialFromURL fills a credential from a remote URL, including any
+// user name and password embedded in it. Like git it splits the URL by
+// hand and percent-decodes each part, since credential files escape
+// characters that net/url does not accept in a host.
+func credentialFromURL(rawURL string) (*credential, error) {
+	protocol, rest, ok := strings.Cut(rawURL, "://")
+	if !ok || protocol == "" {
+		return nil, fmt.Errorf("invalid credential url %q", rawURL)
+	}
+	authority, path, _ := strings.Cut(rest, "/")
+	c := &credential{protocol: protocol}
+	if at := strings.LastIndexByte(authority, '@'); at >= 0 {
+		user, password, hasPassword := strings.Cut(authority[:at], ":")
+		c.username = urlDecode(user)
+		if hasPassword {
+			c.password = urlDecode(password)
+		}
+		authority = authority[at+1:]
+	}
+	c.host = urlDecode(authority)
+	c.path = strings.TrimRight(urlDecode(path), "/")
+	return c, nil
+}
+
+// urlDecode undoes percent-encoding, leaving malformed escapes as they are.
+func urlDecode(s string) string {
+	if decoded, err := url.PathUnescape(s); err == nil {
+		return decoded
+	}
+	return s
+}
+
+// readCredential parses "key=value" lines up to a blank line or EOF.
+// Unknown keys are ignored; "url" sets the fields it contains.
+func readCredential(r *bufio.Reader) (*credential, error) {
+	c := &credential{}
+	for {
+		line, err := r.ReadString('\n')
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			if err != nil && err != io.EOF {
+				return nil, fmt.Errorf("failed to read credential: %w", err)
+			}
+			return c, nil
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid credential line: %s", line)
+		}
+		switch key {
+		case "protocol":
+			c.protocol = value
+		case "host":
+			c.host = value
+		case "path":
+			c.path = value
+		case "username":
+			c.username = value
+		case "password":
+			c.password = value
+		case "url":
+			u, err := credentialFromURL(value)
+			if err != nil {
+				return nil, err
+			}
+			*c = *u
+		}
+		if err == io.EOF {
+			return c, nil
+		}
+	}
+}
+
+// write emits the credential's non-empty fields in helper format.
+func (c *credential) write(w io.Writer) {
+	for _, kv := range [][2]string{
+		{"protocol", c.protocol},
+		{"host", c.host},
+		{"path", c.path},
+		{"username", c.username},
+		{"password", c.password},
+	} {
+		if kv[1] != "" {
+			fmt.Fprintf(w, "%s=%s\n", kv[0], kv[1])
+		}
+	}
+}
+
+// matches reports whether have satisfies the fields set in c, which is
+// how helpers look up stored credentials. The password is not compared.
+func (c *credential) matches(have *credential) bool {
+	return (c.protocol == "" || c.protocol == have.protocol) &&
+		(c.host == "" || c.host == have.host) &&
+		(c.path == "" || c.path == have.path) &&
+		(c.username == "" || c.username == have.username)
+}
+
+// url describes the credential in prompts, e.g. "https://user@host".
+func (c *credential) url() string {
+	s := c.protocol + "://"
+	if c.username != "" {
+		s += c.username + "@"
+	}
+	s += c.host
+	if c.path != "" {
+		s += "/" + c.path
+	}
+	return s
+}
+
+// credentialHelpers returns the credential.helper values that apply to c.
+// URL-scoped entries are matched like http.<url>.*, and an empty value
+// clears the helpers configured before it.
+func credentialHelpers(cfg *config, c *credential) []string {
+	u := &url.URL{Scheme: c.protocol, Host: c.host, Path: "/" + c.path}
+	var helpers []string
+	for _, e := range cfg.entries {
+		if e.section != "credential" || e.key != "helper" {
+			continue
+		}
+		if e.subsection != "" {
+			if _, ok := matchURLPattern(e.subsection, u); !ok {
+				continue
+			}
+		}
+		if e.value == "" {
+			helpers = nil
+		} else {
+			helpers = append(helpers, e.value)
+		}
+	}
+	return helpers
+}
+
+// builtinCredentialHelpers are the helpers this binary implements itself.
+var builtinCredentialHelpers = map[string]bool{"cache": true, "store": true}
+
+// credentialHelperCommand turns a credential.helper value into a command
+// line: "!cmd" is run as is, absolute paths are executed directly and
+// other names run credential-<name> of this binary or of git.
+func credentialHelperCommand(helper string) string {
+	if command, ok := strings.CutPrefix(helper, "!"); ok {
+		return command
+	}
+	if filepath.IsAbs(helper) {
+		return helper
+	}
+	name, _, _ := strings.Cut(helper, " ")
+	if builtinCredentialHelpers[name] {
+		if self, err := os.Executable(); err == nil {
+			return "'" + strings.ReplaceAll(self, "'", `'\''`) + "' credential-" + helper
+		}
+	}
+	return "git credential-" + helper
+}
+
+// runCredentialHelper sends c to helper with the given action and returns
+// what the helper printed back. Only "get" produces output.
+func runCredentialHelper(helper, action string, c *credential) (*credential, error) {
+	var in bytes.Buffer
+	c.write(&in)
+
+	cmd := shellCommand(credentialHelperCommand(helper) + " " + action)
+	cmd.Stdin = &in
+	cmd.Stderr = os.Stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("credential helper %q failed: %w", helper, err)
+	}
+	return readCredential(bufio.NewReader(bytes.NewReader(out)))
+}
+
+// prompt asks the user for a value, through GIT_ASKPASS, core.askPass or
+// SSH_ASKPASS when set and otherwise on the terminal. Secret values are
+// read without echo.
+func prompt(cfg *config, text string, secret bool) (string, error) {
+	askpass := os.Getenv("GIT_ASKPASS")
+	if askpass == "" {
+		askpass, _ = cfg.get("core.askPass")
+	}
+	if askpass == "" {
+		askpass = os.Getenv("SSH_ASKPASS")
+	}
+	if askpass != "" {
+		out, err := shellCommand(askpass, text).Output()
+		if err != nil {
+			return "", fmt.Errorf("unable to read askpass response from '%s'", askpass)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	}
+
+	what := strings.TrimSuffix(text, ": ")
+	if os.Getenv("GIT_TERMINAL_PROMPT") == "0" {
+		return "", fmt.Errorf("could not read %s: terminal prompts disabled", what)
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s: No such device or address", what)
+	}
+	defer tty.Close()
+
+	fmt.Fprint(tty, text)
+	if secret {
+		stty := exec.Command("stty", "-echo")
+		stty.Stdin = tty
+		if err := stty.Run(); err == nil {
+			defer func() {
+				stty := exec.Command("stty", "echo")
+				stty.Stdin = tty
+				stty.Run()
+				fmt.Fprintln(tty)
+			}()
+		}
+	}
+	line, err := bufio.NewReader(tty).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("could not read %s: %w", what, err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// prepareCredential applies credential.username and drops the path of
+// HTTP credentials unless credential.useHttpPath is set, as git does
+// before asking helpers.
+func prepareCredential(cfg *config, c *credential) error {
+	if c.username == "" {
+		c.username, _ = cfg.get("credential.username")
+	}
+	if c.protocol == "http" || c.protocol == "https" {
+		useHTTPPath, err := cfg.getBool("credential.useHttpPath", false)
+		if err != nil {
+			return err
+		}
+		if !useHTTPPath {
+			c.path = ""
+		}
+	}
+	return nil
+}
+
+// fillCredential completes c's user name and password by asking each
+// helper in turn and finally prompting for whatever is still missing.
+func fillCredential(cfg *config, c *credential) error {
+	for _, helper := range credentialHelpers(cfg, c) {
+		if c.username != "" && c.password != "" {
+			return nil
+		}
+		got, err := runCredentialHelper(helper, "get", c)
+		if err != nil {
+			return err
+		}
+		if c.username == "" {
+			c.username = got.username
+		}
+		if c.password == "" && (got.username == "" || got.username == c.username) {
+			c.password = got.password
+		}
+	}
+
+	var err error
+	if c.username == "" {
+		if c.username, err = prompt(cfg, fmt.Sprintf("Username for '%s': ", c.url()), false); err != nil {
+			return err
+		}
+	}
+	if c.password == "" {
+		if c.password, err = prompt(cfg, fmt.Sprintf("Password for '%s': ", c.url()), true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// approveCredential tells every helper to store a credential that worked.
+func approveCredential(cfg *config, c *credential) error {
+	if c.username == "" || c.password == "" {
+		return nil
+	}
+	for _, helper := range credentialHelpers(cfg, c) {
+		if _, err := runCredentialHelper(helper, "store", c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rejectCredential tells every helper to forget a credential that failed.
+func rejectCredential(cfg *config, c *credential) error {
+	for _, helper := range credentialHelpers(cfg, c) {
+		if _, err := runCredentialHelper(helper, "erase", c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runCredential(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: mygit credential (fill|approve|reject)")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	c, err := readCredential(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return err
+	}
+	if err := prepareCredential(cfg, c); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "fill":
+		if err := fillCredential(cfg, c); err != nil {
+			return err
+		}
+		c.write(os.Stdout)
+		return nil
+	case "approve":
+		return approveCredential(cfg, c)
+	case "reject":
+		return rejectCredential(cfg, c)
+	}
+	return fmt.Errorf("unknown credential action %s", args[0])
+}
@@ -0,0 +1,297 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultCacheTimeout = 900
+	// cacheIdleTimeout is how long a daemon with nothing cached waits for
+	// a connection before exiting.
+	cacheIdleTimeout = 30 * time.Second
+	// cacheRequestTimeout bounds how long a client may take to send its
+	// request, so that none can hold up the daemon.
+	cacheRequestTimeout = 5 * time.Second
+)
+
+// defaultCacheSocket returns ~/.git-credential-cache/socket if that
+// directory exists, and the socket under $XDG_CACHE_HOME/git/credential
+// otherwise, like git.
+func defaultCacheSocket() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to find home directory: %w", err)
+	}
+	legacy := filepath.Join(home, ".git-credential-cache")
+	if fi, err := os.Stat(legacy); err == nil && fi.IsDir() {
+		return filepath.Join(legacy, "socket"), nil
+	}
+	cache := os.Getenv("XDG_CACHE_HOME")
+	if cache == "" {
+		cache = filepath.Join(home, ".cache")
+	}
+	return filepath.Join(cache, "git", "credential", "socket"), nil
+}
+
+type cacheEntry struct {
+	cred       *credential
+	expiration time.Time
+}
+
+// credentialCache holds credentials in memory until they expire.
+type credentialCache struct {
+	entries []cacheEntry
+}
+
+// expire drops expired entries and returns the next expiration, or the
+// zero time if nothing is cached.
+func (c *credentialCache) expire(now time.Time) time.Time {
+	var next time.Time
+	kept := c.entries[:0]
+	for _, e := range c.entries {
+		if !e.expiration.After(now) {
+			continue
+		}
+		kept = append(kept, e)
+		if next.IsZero() || e.expiration.Before(next) {
+			next = e.expiration
+		}
+	}
+	c.entries = kept
+	return next
+}
+
+func (c *credentialCache) remove(want *credential) {
+	kept := c.entries[:0]
+	for _, e := range c.entries {
+		if !want.matches(e.cred) {
+			kept = append(kept, e)
+		}
+	}
+	c.entries = kept
+}
+
+// serve handles a single request. It returns false for "exit".
+func (c *credentialCache) serve(conn net.Conn) (bool, error) {
+	r := bufio.NewReader(conn)
+	action, timeout := "", 0
+	for _, key := range []string{"action", "timeout"} {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return true, fmt.Errorf("failed to read cache request: %w", err)
+		}
+		value, ok := strings.CutPrefix(strings.TrimSuffix(line, "\n"), key+"=")
+		if !ok {
+			return true, fmt.Errorf("cache request has no %s", key)
+		}
+		if key == "action" {
+			action = value
+		} else if timeout, err = strconv.Atoi(value); err != nil {
+			return true, fmt.Errorf("invalid cache timeout %q", value)
+		}
+	}
+	cred, err := readCredential(r)
+	if err != nil {
+		return true, err
+	}
+
+	switch action {
+	case "get":
+		for i := len(c.entries) - 1; i >= 0; i-- {
+			if e := c.entries[i]; cred.matches(e.cred) {
+				fmt.Fprintf(conn, "username=%s\npassword=%s\n", e.cred.username, e.cred.password)
+				break
+			}
+		}
+	case "store":
+		c.remove(&credential{protocol: cred.protocol, host: cred.host, path: cred.path, username: cred.username})
+		c.entries = append(c.entries, cacheEntry{cred: cred, expiration: time.Now().Add(time.Duration(timeout) * time.Second)})
+	case "erase":
+		c.remove(cred)
+	case "exit":
+		return false, nil
+	default:
+		return true, fmt.Errorf("unknown cache action %s", action)
+	}
+	return true, nil
+}
+
+// runCredentialCacheDaemon serves the cache on a unix socket until every
+// entry has expired or it is told to exit.
+func runCredentialCacheDaemon(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: mygit credential-cache--daemon <socket>")
+	}
+	socket := args[0]
+
+	// Like git, a missing socket directory is created private, and an
+	// existing one that others can get into is refused rather than changed.
+	dir := filepath.Dir(socket)
+	fi, err := os.Stat(dir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("failed to create socket directory: %w", err)
+		}
+	case err != nil:
+		return fmt.Errorf("failed to stat socket directory: %w", err)
+	case fi.Mode().Perm()&0077 != 0:
+		return fmt.Errorf("The permissions on your socket directory are too loose; other users may be able to read your cached credentials. Consider running:\n\n\tchmod 0700 %s", dir)
+	}
+	os.Remove(socket)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: socket, Net: "unix"})
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", socket, err)
+	}
+	defer l.Close()
+
+	// The spawning client waits for this line, and sees startup errors;
+	// afterwards the daemon keeps running on its own, silently.
+	signal.Ignore(syscall.SIGHUP)
+	fmt.Println("ok")
+	os.Stdout.Close()
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		os.Stderr = devNull
+	}
+
+	cache := &credentialCache{}
+	for {
+		deadline := cache.expire(time.Now())
+		if deadline.IsZero() {
+			deadline = time.Now().Add(cacheIdleTimeout)
+		}
+		l.SetDeadline(deadline)
+
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				if cache.expire(time.Now()).IsZero() {
+					return nil
+				}
+				continue
+			}
+			return fmt.Errorf("failed to accept connection: %w", err)
+		}
+		conn.SetDeadline(time.Now().Add(cacheRequestTimeout))
+		more, err := cache.serve(conn)
+		conn.Close()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		}
+		if !more {
+			return nil
+		}
+	}
+}
+
+// spawnCacheDaemon starts a daemon on socket and waits until it listens.
+func spawnCacheDaemon(socket string) error {
+	self, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+	cmd := exec.Command(self, "credential-cache--daemon", socket)
+	cmd.Stderr = os.Stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to start cache daemon: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start cache daemon: %w", err)
+	}
+	line, _ := bufio.NewReader(out).ReadString('\n')
+	if line != "ok\n" {
+		cmd.Wait()
+		return fmt.Errorf("cache daemon did not start")
+	}
+	return cmd.Process.Release()
+}
+
+func runCredentialCache(args []string) error {
+	timeout, socket, action := defaultCacheTimeout, "", ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--timeout" || arg == "--socket":
+			if i+1 >= len(args) {
+				return fmt.Errorf("option '%s' requires a value", arg[2:])
+			}
+			i++
+			arg += "=" + args[i]
+			fallthrough
+		case strings.HasPrefix(arg, "--timeout="), strings.HasPrefix(arg, "--socket="):
+			name, value, _ := strings.Cut(arg, "=")
+			if name == "--socket" {
+				socket = value
+				continue
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid timeout %q", value)
+			}
+			timeout = n
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		case action == "":
+			action = arg
+		default:
+			return fmt.Errorf("usage: mygit credential-cache [<options>] <action>")
+		}
+	}
+	if action == "" {
+		return fmt.Errorf("usage: mygit credential-cache [<options>] <action>")
+	}
+	if socket == "" {
+		var err error
+		if socket, err = defaultCacheSocket(); err != nil {
+			return err
+		}
+	}
+
+	var req bytes.Buffer
+	fmt.Fprintf(&req, "action=%s\ntimeout=%d\n", action, timeout)
+	if action != "exit" {
+		cred, err := readCredential(bufio.NewReader(os.Stdin))
+		if err != nil {
+			return err
+		}
+		cred.write(&req)
+	}
+	req.WriteString("\n")
+
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		// Nothing is cached without a daemon, so only storing starts one.
+		if action != "store" {
+			return nil
+		}
+		if err := spawnCacheDaemon(socket); err != nil {
+			return err
+		}
+		if conn, err = net.Dial("unix", socket); err != nil {
+			return fmt.Errorf("failed to connect to cache daemon: %w", err)
+		}
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return fmt.Errorf("failed to send cache request: %w", err)
+	}
+	if _, err := io.Copy(os.Stdout, conn); err != nil {
+		return fmt.Errorf("failed to read cache response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package mygit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// credentialStoreFiles returns ~/.git-credentials followed by
+// $XDG_CONFIG_HOME/git/credentials, the files the store helper reads.
+func credentialStoreFiles() ([]string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find home directory: %w", err)
+	}
+	xdg := os.Getenv("XDG_CONFIG_HOME")
+	if xdg == "" {
+		xdg = filepath.Join(home, ".config")
+	}
+	return []string{filepath.Join(home, ".git-credentials"), filepath.Join(xdg, "git", "credentials")}, nil
+}
+
+// urlEncode percent-encodes s the way git writes credential URLs: only
+// RFC 3986 unreserved characters are kept, plus the reserved ones if
+// keepReserved is set.
+func urlEncode(s string, keepReserved bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', strings.IndexByte("-._~", c) >= 0:
+			b.WriteByte(c)
+		case keepReserved && strings.IndexByte("!*'();:@&=+$,/?#[]", c) >= 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02x", c)
+		}
+	}
+	return b.String()
+}
+
+// storeLine formats c as a line of a credentials file.
+func (c *credential) storeLine() string {
+	line := c.protocol + "://" + urlEncode(c.username, false) + ":" + urlEncode(c.password, false) + "@" + urlEncode(c.host, false)
+	if c.path != "" {
+		line += "/" + urlEncode(c.path, true)
+	}
+	return line
+}
+
+// readCredentialStore returns the lines of a credentials file, or nothing
+// if it does not exist.
+func readCredentialStore(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return strings.Split(strings.TrimRight(string(data), "\n"), "\n"), nil
+}
+
+// rewriteCredentialStore writes first, if not empty, and then every line
+// of path that does not match c. Matching the password as well is used
+// when erasing, so that a stale entry is only removed if it is the one
+// that failed.
+func rewriteCredentialStore(path, first string, c *credential, matchPassword bool) error {
+	lines, err := readCredentialStore(path)
+	if err != nil {
+		return err
+	}
+
+	var b strings.Builder
+	if first != "" {
+		b.WriteString(first + "\n")
+	}
+	changed := first != ""
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if have, err := credentialFromURL(line); err == nil && have.username != "" && have.password != "" &&
+			c.matches(have) && (!matchPassword || c.password == "" || c.password == have.password) {
+			changed = true
+			continue
+		}
+		b.WriteString(line + "\n")
+	}
+	if !changed {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	lock := path + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to lock %s: %w", path, err)
+	}
+	if _, err := f.WriteString(b.String()); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(lock, path); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to update %s: %w", path, err)
+	}
+	return nil
+}
+
+// runCredentialStore implements the store helper, which keeps credentials
+// in plain text files, one URL per line.
+func runCredentialStore(args []string) error {
+	var files []string
+	action := ""
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--file="):
+			files = []string{strings.TrimPrefix(arg, "--file=")}
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		case action == "":
+			action = arg
+		default:
+			return fmt.Errorf("usage: mygit credential-store [<options>] <action>")
+		}
+	}
+	if action == "" {
+		return fmt.Errorf("usage: mygit credential-store [<options>] <action>")
+	}
+	if files == nil {
+		var err error
+		if files, err = credentialStoreFiles(); err != nil {
+			return err
+		}
+	}
+
+	c, err := readCredential(bufio.NewReader(os.Stdin))
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "get":
+		for _, path := range files {
+			lines, err := readCredentialStore(path)
+			if err != nil {
+				return err
+			}
+			for _, line := range lines {
+				have, err := credentialFromURL(line)
+				if err != nil || have.username == "" || have.password == "" || !c.matches(have) {
+					continue
+				}
+				fmt.Printf("username=%s\npassword=%s\n", have.username, have.password)
+				return nil
+			}
+		}
+	case "store":
+		if c.protocol == "" || c.host == "" || c.username == "" || c.password == "" {
+			return nil
+		}
+		// Store into the first file that exists, or create the first one.
+		target := files[0]
+		for _, path := range files {
+			if _, err := os.Stat(path); err == nil {
+				target = path
+				break
+			}
+		}
+		match := &credential{protocol: c.protocol, host: c.host, path: c.path, username: c.username}
+		return rewriteCredentialStore(target, c.storeLine(), match, false)
+	case "erase":
+		if c.protocol == "" && c.host == "" {
+			return nil
+		}
+		for _, path := range files {
+			if err := rewriteCredentialStore(path, "", c, true); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package mygit
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type dateStyle int
+
+const (
+	dateDefault dateStyle = iota
+	dateRelative
+	dateISO
+	dateISOStrict
+	dateRFC
+	dateShort
+	dateRaw
+	dateUnix
+	dateFormat
+)
+
+// dateMode is a parsed --date=<format>. local shows times in the local
+// timezone instead of the one they were recorded in.
+type dateMode struct {
+	style  dateStyle
+	local  bool
+	format string
+}
+
+var dateStyleNames = map[string]dateStyle{
+	"default":        dateDefault,
+	"relative":       dateRelative,
+	"iso":            dateISO,
+	"iso8601":        dateISO,
+	"iso-strict":     dateISOStrict,
+	"iso8601-strict": dateISOStrict,
+	"rfc":            dateRFC,
+	"rfc2822":        dateRFC,
+	"short":          dateShort,
+	"raw":            dateRaw,
+	"unix":           dateUnix,
+}
+
+// parseDateMode understands the formats accepted by git's --date option,
+// including "format:<strftime>" and the "-local" variants.
+func parseDateMode(s string) (dateMode, error) {
+	if format, ok := strings.CutPrefix(s, "format-local:"); ok {
+		return dateMode{style: dateFormat, local: true, format: format}, nil
+	}
+	if format, ok := strings.CutPrefix(s, "format:"); ok {
+		return dateMode{style: dateFormat, format: format}, nil
+	}
+	if s == "local" {
+		return dateMode{style: dateDefault, local: true}, nil
+	}
+
+	name, local := strings.CutSuffix(s, "-local")
+	style, ok := dateStyleNames[name]
+	if !ok {
+		return dateMode{}, fmt.Errorf("unknown date format %s", s)
+	}
+	return dateMode{style: style, local: local}, nil
+}
+
+// formatDate renders t, which carries the timezone it was recorded in,
+// according to mode. now is only used for relative dates.
+func formatDate(t time.Time, mode dateMode, now time.Time) string {
+	if mode.local {
+		t = t.Local()
+	}
+
+	switch mode.style {
+	case dateRelative:
+		return relativeDate(t, now)
+	case dateISO:
+		return t.Format("2006-01-02 15:04:05 -0700")
+	case dateISOStrict:
+		return t.Format("2006-01-02T15:04:05-07:00")
+	case dateRFC:
+		return t.Format("Mon, 2 Jan 2006 15:04:05 -0700")
+	case dateShort:
+		return t.Format("2006-01-02")
+	case dateRaw:
+		return fmt.Sprintf("%d %s", t.Unix(), t.Format("-0700"))
+	case dateUnix:
+		return strconv.FormatInt(t.Unix(), 10)
+	case dateFormat:
+		return strftime(mode.format, t, mode.local)
+	}
+
+	layout := "Mon Jan 2 15:04:05 2006 -0700"
+	if mode.local {
+		layout = "Mon Jan 2 15:04:05 2006"
+	}
+	return t.Format(layout)
+}
+
+func plural(n int64, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
+
+// relativeDate mirrors git's show_date_relative, including its rounding.
+func relativeDate(t, now time.Time) string {
+	diff := now.Unix() - t.Unix()
+	if diff < 0 {
+		return "in the future"
+	}
+	if diff < 90 {
+		return plural(diff, "second") + " ago"
+	}
+	diff = (diff + 30) / 60
+	if diff < 90 {
+		return plural(diff, "minute") + " ago"
+	}
+	diff = (diff + 30) / 60
+	if diff < 36 {
+		return plural(diff, "hour") + " ago"
+	}
+	diff = (diff + 12) / 24
+	if diff < 14 {
+		return plural(diff, "day") + " ago"
+	}
+	if diff < 70 {
+		return plural((diff+3)/7, "week") + " ago"
+	}
+	if diff < 365 {
+		return plural((diff+15)/30, "month") + " ago"
+	}
+	if diff < 1825 {
+		totalMonths := (diff*12*2 + 365) / (365 * 2)
+		years, months := totalMonths/12, totalMonths%12
+		if months > 0 {
+			return plural(years, "year") + ", " + plural(months, "month") + " ago"
+		}
+		return plural(years, "year") + " ago"
+	}
+	return plural((diff+183)/365, "year") + " ago"
+}
+
+// parseExpiry parses an expiry date such as gc.pruneExpire: "now", "never",
+// "<n>.<unit>.ago" or an absolute date. Anything not newer than the result
+// has expired; "never" returns the zero time, which nothing is older than.
+func parseExpiry(s string, now time.Time) (time.Time, error) {
+	switch s {
+	case "now", "all":
+		return now, nil
+	case "never", "false":
+		return time.Time{}, nil
+	}
+
+	fields := strings.FieldsFunc(s, func(r rune) bool { return r == '.' || r == ' ' })
+	if len(fields) == 3 && fields[2] == "ago" {
+		if n, err := strconv.Atoi(fields[0]); err == nil && n >= 0 {
+			switch strings.TrimSuffix(fields[1], "s") {
+			case "second":
+				return now.Add(-time.Duration(n) * time.Second), nil
+			case "minute":
+				return now.Add(-time.Duration(n) * time.Minute), nil
+			case "hour":
+				return now.Add(-time.Duration(n) * time.Hour), nil
+			case "day":
+				return now.AddDate(0, 0, -n), nil
+			case "week":
+				return now.AddDate(0, 0, -7*n), nil
+			case "month":
+				return now.AddDate(0, -n, 0), nil
+			case "year":
+				return now.AddDate(-n, 0, 0), nil
+			}
+		}
+	}
+
+	for _, layout := range []string{time.DateTime, time.DateOnly, time.RFC3339} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid expiry date %q", s)
+}
+
+// strftime implements the conversions of C's strftime that are useful in
+// dates. %Z is only known for local times, matching git.
+func strftime(format string, t time.Time, local bool) string {
+	var b strings.Builder
+	for i := 0; i < len(format); i++ {
+		c := format[i]
+		if c != '%' || i+1 == len(format) {
+			b.WriteByte(c)
+			continue
+		}
+		i++
+		switch format[i] {
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'b', 'h':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'c':
+			b.WriteString(t.Format("Mon Jan _2 15:04:05 2006"))
+		case 'd':
+			b.WriteString(t.Format("02"))
+		case 'D':
+			b.WriteString(t.Format("01/02/06"))
+		case 'e':
+			b.WriteString(t.Format("_2"))
+		case 'F':
+			b.WriteString(t.Format("2006-01-02"))
+		case 'H':
+			b.WriteString(t.Format("15"))
+		case 'I':
+			b.WriteString(t.Format("03"))
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'k':
+			fmt.Fprintf(&b, "%2d", t.Hour())
+		case 'l':
+			fmt.Fprintf(&b, "%2d", (t.Hour()+11)%12+1)
+		case 'm':
+			b.WriteString(t.Format("01"))
+		case 'M':
+			b.WriteString(t.Format("04"))
+		case 'n':
+			b.WriteByte('\n')
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'P':
+			b.WriteString(strings.ToLower(t.Format("PM")))
+		case 'R':
+			b.WriteString(t.Format("15:04"))
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case 'S':
+			b.WriteString(t.Format("05"))
+		case 't':
+			b.WriteByte('\t')
+		case 'T':
+			b.WriteString(t.Format("15:04:05"))
+		case 'u':
+			fmt.Fprintf(&b, "%d", (int(t.Weekday())+6)%7+1)
+		case 'w':
+			fmt.Fprintf(&b, "%d", int(t.Weekday()))
+		case 'y':
+			b.WriteString(t.Format("06"))
+		case 'Y':
+			b.WriteString(t.Format("2006"))
+		case 'z':
+			b.WriteString(t.Format("-0700"))
+		case 'Z':
+			if local {
+				b.WriteString(t.Format("MST"))
+			}
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,168 @@
+package mygit
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+type decorationKind int
+
+const (
+	decorationOther decorationKind = iota
+	decorationBranch
+	decorationRemote
+	decorationTag
+	decorationStash
+	decorationHead
+)
+
+// decorationColors are git's default color.decorate.* slots, indexed by
+// decorationKind.
+var decorationColors = [...]string{
+	decorationOther:  "\033[m",
+	decorationBranch: "\033[1;32m",
+	decorationRemote: "\033[1;31m",
+	decorationTag:    "\033[1;33m",
+	decorationStash:  "\033[1;35m",
+	decorationHead:   "\033[1;36m",
+}
+
+// decorationPrefixes lists the refs that decorate commits by default.
+var decorationPrefixes = []string{"refs/heads/", "refs/remotes/", "refs/tags/", "refs/stash", "refs/notes/"}
+
+type decoration struct {
+	ref  string
+	kind decorationKind
+}
+
+func decorationKindOf(ref string) decorationKind {
+	switch {
+	case ref == "HEAD":
+		return decorationHead
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return decorationBranch
+	case strings.HasPrefix(ref, "refs/remotes/"):
+		return decorationRemote
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return decorationTag
+	case strings.HasPrefix(ref, "refs/stash"):
+		return decorationStash
+	default:
+		return decorationOther
+	}
+}
+
+// loadDecorations maps objects to the refs pointing at them. Annotated tags
+// also decorate the objects they peel to. Each list is in git's display
+// order: HEAD first, then the other refs in reverse name order.
+func loadDecorations() (map[objectID][]decoration, error) {
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for name := range refs {
+		for _, prefix := range decorationPrefixes {
+			if strings.HasPrefix(name, prefix) {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+
+	decorations := make(map[objectID][]decoration)
+	add := func(hash objectID, d decoration) {
+		decorations[hash] = append(decorations[hash], d)
+	}
+
+	if head, err := resolveRef("HEAD"); err == nil {
+		add(head, decoration{ref: "HEAD", kind: decorationHead})
+	} else if !errors.Is(err, errRefNotFound) {
+		return nil, err
+	}
+
+	for _, name := range names {
+		d := decoration{ref: name, kind: decorationKindOf(name)}
+		hash := refs[name]
+		add(hash, d)
+		for {
+			objType, content, err := readObject(hash)
+			if err != nil || objType != tagObject {
+				break
+			}
+			t, err := parseTag(content)
+			if err != nil {
+				break
+			}
+			hash = t.object
+			add(hash, decoration{ref: name, kind: decorationTag})
+		}
+	}
+	return decorations, nil
+}
+
+// formatDecorations renders a commit's decorations as " (HEAD -> main,
+// tag: v1.0, origin/main)". With full set refs keep their refs/ prefix; an
+// empty colorCommit disables color.
+func formatDecorations(decorations []decoration, full bool, colorCommit string) string {
+	if len(decorations) == 0 {
+		return ""
+	}
+
+	color := func(kind decorationKind) string {
+		if colorCommit == "" {
+			return ""
+		}
+		return decorationColors[kind]
+	}
+	reset := color(decorationOther)
+	name := func(d decoration) string {
+		if full || d.kind == decorationHead {
+			return d.ref
+		}
+		return describeRef(d.ref)
+	}
+
+	// When HEAD points at a branch that is also listed, show "HEAD -> branch"
+	// where HEAD appears and drop the separate branch entry.
+	var current *decoration
+	if target, err := symrefTarget("HEAD"); err == nil && target != "HEAD" {
+		for i := range decorations {
+			if decorations[i].ref == target {
+				current = &decorations[i]
+				break
+			}
+		}
+	}
+	hasHead := false
+	for _, d := range decorations {
+		hasHead = hasHead || d.kind == decorationHead
+	}
+	if !hasHead {
+		current = nil
+	}
+
+	var b strings.Builder
+	sep := " ("
+	for i := range decorations {
+		d := &decorations[i]
+		if d == current {
+			continue
+		}
+		b.WriteString(colorCommit + sep + reset + color(d.kind))
+		if d.kind == decorationTag {
+			b.WriteString("tag: ")
+		}
+		b.WriteString(name(*d))
+		if current != nil && d.kind == decorationHead {
+			b.WriteString(" -> " + reset + color(current.kind) + name(*current))
+		}
+		b.WriteString(reset)
+		sep = ", "
+	}
+	b.WriteString(colorCommit + ")" + reset)
+	return b.String()
+}
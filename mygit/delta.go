@@ -0,0 +1,246 @@
+package mygit
+
+import (
+	"fmt"
+)
+
+const (
+	deltaBlockSize   = 16
+	deltaMaxCopy     = 0x10000
+	deltaMaxInsert   = 0x7f
+	deltaMaxBucket   = 64
+	deltaHashPrime   = 16777619
+	deltaMinSize     = 50
+	deltaSizeRatio   = 32
+	deltaHeaderSlack = 20
+)
+
+// deltaIndex indexes a delta source by the hash of each aligned block so
+// that matching regions of a target can be found while rolling over it.
+type deltaIndex struct {
+	src   []byte
+	table map[uint32][]int32
+	pow   uint32
+}
+
+func newDeltaIndex(src []byte) *deltaIndex {
+	idx := &deltaIndex{src: src, table: make(map[uint32][]int32)}
+
+	idx.pow = 1
+	for i := 0; i < deltaBlockSize-1; i++ {
+		idx.pow *= deltaHashPrime
+	}
+
+	for off := 0; off+deltaBlockSize <= len(src); off += deltaBlockSize {
+		h := blockHash(src[off : off+deltaBlockSize])
+		if bucket := idx.table[h]; len(bucket) < deltaMaxBucket {
+			idx.table[h] = append(bucket, int32(off))
+		}
+	}
+	return idx
+}
+
+func blockHash(block []byte) uint32 {
+	var h uint32
+	for _, b := range block {
+		h = h*deltaHashPrime + uint32(b)
+	}
+	return h
+}
+
+// createDelta encodes trg as a delta against the indexed source. It gives
+// up and returns nil as soon as the delta would exceed maxSize bytes.
+func (idx *deltaIndex) createDelta(trg []byte, maxSize int) []byte {
+	src := idx.src
+	out := appendDeltaSize(nil, len(src))
+	out = appendDeltaSize(out, len(trg))
+
+	literal := 0
+	i := 0
+	var h uint32
+	if len(trg) >= deltaBlockSize {
+		h = blockHash(trg[:deltaBlockSize])
+	}
+
+	for i+deltaBlockSize <= len(trg) {
+		bestOff, bestLen := 0, 0
+		for _, off := range idx.table[h] {
+			o := int(off)
+			n := 0
+			for o+n < len(src) && i+n < len(trg) && src[o+n] == trg[i+n] {
+				n++
+			}
+			if n > bestLen {
+				bestOff, bestLen = o, n
+			}
+		}
+
+		if bestLen < deltaBlockSize {
+			if i+deltaBlockSize < len(trg) {
+				h = (h-uint32(trg[i])*idx.pow)*deltaHashPrime + uint32(trg[i+deltaBlockSize])
+			}
+			i++
+			continue
+		}
+
+		for bestOff > 0 && i > literal && src[bestOff-1] == trg[i-1] {
+			bestOff--
+			i--
+			bestLen++
+		}
+
+		out = appendDeltaInsert(out, trg[literal:i])
+		out = appendDeltaCopy(out, bestOff, bestLen)
+		if maxSize > 0 && len(out) > maxSize {
+			return nil
+		}
+
+		i += bestLen
+		literal = i
+		if i+deltaBlockSize <= len(trg) {
+			h = blockHash(trg[i : i+deltaBlockSize])
+		}
+	}
+
+	out = appendDeltaInsert(out, trg[literal:])
+	if maxSize > 0 && len(out) > maxSize {
+		return nil
+	}
+	return out
+}
+
+func appendDeltaSize(out []byte, size int) []byte {
+	for size >= 0x80 {
+		out = append(out, byte(size)|0x80)
+		size >>= 7
+	}
+	return append(out, byte(size))
+}
+
+func appendDeltaInsert(out []byte, data []byte) []byte {
+	for len(data) > 0 {
+		n := min(len(data), deltaMaxInsert)
+		out = append(out, byte(n))
+		out = append(out, data[:n]...)
+		data = data[n:]
+	}
+	return out
+}
+
+func appendDeltaCopy(out []byte, offset, size int) []byte {
+	for size > 0 {
+		n := min(size, deltaMaxCopy)
+
+		op := byte(0x80)
+		opIndex := len(out)
+		out = append(out, 0)
+		for i := 0; i < 4; i++ {
+			if b := byte(offset >> (8 * i)); b != 0 {
+				op |= 1 << i
+				out = append(out, b)
+			}
+		}
+		// A size of 0x10000 is encoded by leaving every size byte out.
+		if n != deltaMaxCopy {
+			for i := 0; i < 3; i++ {
+				if b := byte(n >> (8 * i)); b != 0 {
+					op |= 0x10 << i
+					out = append(out, b)
+				}
+			}
+		}
+		out[opIndex] = op
+
+		offset += n
+		size -= n
+	}
+	return out
+}
+
+func readDeltaSize(delta []byte) (int, int, error) {
+	size, shift := 0, 0
+	for i, b := range delta {
+		if shift > 56 {
+			break
+		}
+		size |= int(b&0x7f) << shift
+		shift += 7
+		if b&0x80 == 0 {
+			return size, i + 1, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("invalid delta size")
+}
+
+// applyDelta reconstructs an object from its delta base.
+func applyDelta(base, delta []byte) ([]byte, error) {
+	srcSize, n, err := readDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	delta = delta[n:]
+	if srcSize != len(base) {
+		return nil, fmt.Errorf("delta base size mismatch: expected %d, got %d", srcSize, len(base))
+	}
+
+	trgSize, n, err := readDeltaSize(delta)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDeltaSize(int64(trgSize)); err != nil {
+		return nil, err
+	}
+	delta = delta[n:]
+
+	// The target size is not trusted to allocate up front beyond what the
+	// base and delta could plausibly make; out grows if the copies need it.
+	out := make([]byte, 0, min(trgSize, 2*(len(base)+len(delta))))
+	for len(delta) > 0 {
+		op := delta[0]
+		delta = delta[1:]
+
+		switch {
+		case op&0x80 != 0:
+			var offset, size int
+			for i := 0; i < 4; i++ {
+				if op&(1<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, fmt.Errorf("truncated delta copy")
+					}
+					offset |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			for i := 0; i < 3; i++ {
+				if op&(0x10<<i) != 0 {
+					if len(delta) == 0 {
+						return nil, fmt.Errorf("truncated delta copy")
+					}
+					size |= int(delta[0]) << (8 * i)
+					delta = delta[1:]
+				}
+			}
+			if size == 0 {
+				size = deltaMaxCopy
+			}
+			if offset+size > len(base) || len(out)+size > trgSize {
+				return nil, fmt.Errorf("delta copy out of bounds")
+			}
+			out = append(out, base[offset:offset+size]...)
+		case op != 0:
+			n := int(op)
+			if n > len(delta) || len(out)+n > trgSize {
+				return nil, fmt.Errorf("delta insert out of bounds")
+			}
+			out = append(out, delta[:n]...)
+			delta = delta[n:]
+		default:
+			return nil, fmt.Errorf("invalid delta opcode 0")
+		}
+	}
+
+	if len(out) != trgSize {
+		return nil, fmt.Errorf("delta result size mismatch: expected %d, got %d", trgSize, len(out))
+	}
+	return out, nil
+}
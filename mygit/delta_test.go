@@ -0,0 +1,28 @@
+package mygit
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestApplyDeltaHugeTargetSize(t *testing.T) {
+	// A base of 1 byte, a target claimed to be 2^56 bytes, and one insert.
+	delta := []byte{0x01, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x80, 0x01, 0x01, 'x'}
+	if _, err := applyDelta([]byte("a"), delta); err == nil {
+		t.Fatal("delta with a wrong target size applied")
+	}
+}
+
+func TestApplyDeltaCopies(t *testing.T) {
+	base := bytes.Repeat([]byte("0123456789"), 100)
+	// Target of 2005 bytes: the base twice, then five inserted bytes.
+	delta := []byte{0xe8, 0x07, 0xd5, 0x0f, 0xb0, 0xe8, 0x03, 0xb0, 0xe8, 0x03, 0x05, 'h', 'e', 'l', 'l', 'o'}
+	out, err := applyDelta(base, delta)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append(append(append([]byte{}, base...), base...), "hello"...)
+	if !bytes.Equal(out, want) {
+		t.Errorf("got %d bytes, want %d", len(out), len(want))
+	}
+}
@@ -0,0 +1,224 @@
+package mygit
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxDescribeCandidates bounds the tags describe weighs against each other.
+const maxDescribeCandidates = 10
+
+// describeName is a tag that can name a commit. Annotated tags win over
+// lightweight ones, and newer annotated tags over older ones.
+type describeName struct {
+	name      string
+	annotated bool
+	date      int64
+}
+
+func (n *describeName) betterThan(o *describeName) bool {
+	if n.annotated != o.annotated {
+		return n.annotated
+	}
+	return n.date > o.date
+}
+
+// loadDescribeNames maps commits to the tag naming them, lightweight tags
+// included only when asked for. It also reports whether there were tags
+// left out.
+func loadDescribeNames(lightweight bool) (map[objectID]*describeName, bool, error) {
+	refs, err := listRefs()
+	if err != nil {
+		return nil, false, err
+	}
+	names := make(map[objectID]*describeName)
+	skipped := false
+	for ref, hash := range refs {
+		short, ok := strings.CutPrefix(ref, "refs/tags/")
+		if !ok {
+			continue
+		}
+		n := &describeName{name: short}
+		objType, content, err := readObject(hash)
+		if err != nil {
+			return nil, false, err
+		}
+		if objType == tagObject {
+			t, err := parseTag(content)
+			if err != nil {
+				return nil, false, fmt.Errorf("corrupt tag %s: %w", short, err)
+			}
+			n.annotated, n.date = true, identTimestamp(t.tagger)
+		} else if !lightweight {
+			skipped = true
+			continue
+		}
+		commit, ok, err := peelToCommit(hash)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		if old := names[commit]; old == nil || n.betterThan(old) || !old.betterThan(n) && n.name < old.name {
+			names[commit] = n
+		}
+	}
+	return names, skipped, nil
+}
+
+// describeCommit names hash after the nearest tag it descends from, as
+// <tag>-<n>-g<abbreviated hash>, n counting the commits since the tag.
+// Without a tag to use, always falls back on the abbreviated hash.
+func describeCommit(hash objectID, names map[objectID]*describeName, skipped, long, always bool, abbrev int) (string, error) {
+	short := hash.String()
+	if abbrev > 0 {
+		short = short[:abbrev]
+	}
+	if n := names[hash]; n != nil && !long {
+		return n.name, nil
+	}
+
+	// Tags are tried in the order a walk from the commit comes across
+	// them, the first ones with the fewest commits since winning.
+	type candidate struct {
+		name   *describeName
+		commit objectID
+		depth  int
+	}
+	var candidates []candidate
+	err := walkCommits([]objectID{hash}, func(c objectID, _ *commit) error {
+		if n := names[c]; n != nil {
+			candidates = append(candidates, candidate{name: n, commit: c})
+			if len(candidates) == maxDescribeCandidates {
+				return errStopWalk
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		switch {
+		case always:
+			return short, nil
+		case skipped:
+			return "", fmt.Errorf("No annotated tags can describe '%s'.\nHowever, there were unannotated tags: try --tags.", hash)
+		default:
+			return "", fmt.Errorf("No tags can describe '%s'.\nTry --always, or create some tags.", hash)
+		}
+	}
+	for i := range candidates {
+		ahead, _, err := aheadBehind(hash, candidates[i].commit)
+		if err != nil {
+			return "", err
+		}
+		candidates[i].depth = ahead
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].depth < candidates[j].depth })
+	best := candidates[0]
+	if abbrev == 0 {
+		return best.name.name, nil
+	}
+	return fmt.Sprintf("%s-%d-g%s", best.name.name, best.depth, short), nil
+}
+
+// worktreeDirty reports whether the index or the working tree differ from
+// HEAD.
+func worktreeDirty(cfg *config, head objectID) (bool, error) {
+	entries, err := readIndex()
+	if err != nil {
+		return false, err
+	}
+	indexed, unmerged := indexFiles(entries)
+	if len(unmerged) > 0 {
+		return true, nil
+	}
+	files, err := commitFiles(head)
+	if err != nil {
+		return false, err
+	}
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return false, err
+	}
+	return len(diffFiles(files, indexed, nil, nil)) > 0 || len(diffFiles(indexed, work, nil, nil)) > 0, nil
+}
+
+func runDescribe(args []string) error {
+	var revs []string
+	var dirtyMark string
+	lightweight, long, always, dirty := false, false, false, false
+	abbrev := 7
+	for _, arg := range args {
+		switch {
+		case arg == "--tags":
+			lightweight = true
+		case arg == "--long":
+			long = true
+		case arg == "--always":
+			always = true
+		case arg == "--dirty":
+			dirty, dirtyMark = true, "-dirty"
+		case strings.HasPrefix(arg, "--dirty="):
+			dirty, dirtyMark = true, strings.TrimPrefix(arg, "--dirty=")
+		case strings.HasPrefix(arg, "--abbrev="):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--abbrev="))
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid abbrev %q", arg)
+			}
+			// Like git, abbreviations are at least four digits long.
+			abbrev = min(max(n, minAbbrev), hashAlgo.size*2)
+			if n == 0 {
+				abbrev = 0
+			}
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			revs = append(revs, arg)
+		}
+	}
+	if long && abbrev == 0 {
+		return fmt.Errorf("options '--long' and '--abbrev=0' cannot be used together")
+	}
+	if dirty && len(revs) > 0 {
+		return fmt.Errorf("option '--dirty' and commit-ishes cannot be used together")
+	}
+	if len(revs) == 0 {
+		revs = []string{"HEAD"}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	names, skipped, err := loadDescribeNames(lightweight)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 && !skipped && !always {
+		return fmt.Errorf("No names found, cannot describe anything.")
+	}
+	for _, rev := range revs {
+		hash, err := resolveCommit(rev)
+		if err != nil {
+			return fmt.Errorf("Not a valid object name %s", rev)
+		}
+		desc, err := describeCommit(hash, names, skipped, long, always, abbrev)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			if isDirty, err := worktreeDirty(cfg, hash); err != nil {
+				return err
+			} else if isDirty {
+				desc += dirtyMark
+			}
+		}
+		fmt.Println(desc)
+	}
+	return nil
+}
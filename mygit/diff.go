@@ -0,0 +1,936 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+const (
+	defaultDiffContext = 3
+	// binaryCheckSize is how much of a file git looks at for a NUL byte
+	// to decide that it is binary.
+	binaryCheckSize = 8000
+	// maxFuncNameLength caps the function name shown in hunk headers.
+	maxFuncNameLength = 80
+)
+
+const (
+	modeTypeMask   = 0170000
+	modeDirectory  = 0040000
+	modeRegular    = 0100644
+	modeExecutable = 0100755
+	modeSymlink    = 0120000
+	modeGitlink    = 0160000
+)
+
+// diffEntry is one side of a file pair. A zero mode means the file does
+// not exist on that side. data holds working tree content; otherwise the
+// blob is read when needed.
+type diffEntry struct {
+	mode uint32
+	hash objectID
+	data []byte
+}
+
+func (e diffEntry) content() ([]byte, error) {
+	if e.data != nil || e.mode == 0 {
+		return e.data, nil
+	}
+	_, content, err := readObject(e.hash)
+	if err != nil {
+		return nil, err
+	}
+	return content, nil
+}
+
+// diffContent is the content of a file as diffs show it: submodules show
+// as the commit they are at.
+func (e diffEntry) diffContent() ([]byte, error) {
+	if e.mode == modeGitlink {
+		return []byte(fmt.Sprintf("Subproject commit %s\n", e.hash)), nil
+	}
+	return e.content()
+}
+
+// diffPair is a changed path with its old and new states.
+type diffPair struct {
+	path     string
+	old, new diffEntry
+	// unmerged marks a path with conflict stages in the index.
+	unmerged bool
+}
+
+type diffOptions struct {
+	context   int
+	quotePath bool
+
+	// Output formats; the patch is the default if none is chosen.
+	patch      bool
+	stat       bool
+	numstat    bool
+	shortstat  bool
+	nameOnly   bool
+	nameStatus bool
+	// statWidth, statNameWidth and statGraphWidth limit the --stat
+	// columns, 0 meaning no limit beyond the terminal width; statCount
+	// limits the number of files listed.
+	statWidth      int
+	statNameWidth  int
+	statGraphWidth int
+	statCount      int
+	// submodule is how changes to submodules are shown in patches.
+	submodule submoduleFormat
+	// flags are the whitespace options lines are compared under.
+	flags diffFlags
+	// filter holds the status letters of --diff-filter: upper case ones
+	// select the only pairs shown, lower case ones leave pairs out.
+	filter string
+}
+
+// hasFormat tells whether an output format was chosen.
+func (o *diffOptions) hasFormat() bool {
+	return o.patch || o.stat || o.numstat || o.shortstat || o.nameOnly || o.nameStatus
+}
+
+// diffStatus returns the letter git uses for the kind of change a pair
+// is. Renames and copies are not detected, so 'R' and 'C' are not seen.
+func diffStatus(p diffPair) byte {
+	switch {
+	case p.unmerged:
+		return 'U'
+	case p.old.mode == 0:
+		return 'A'
+	case p.new.mode == 0:
+		return 'D'
+	case p.old.mode&modeTypeMask != p.new.mode&modeTypeMask:
+		return 'T'
+	}
+	return 'M'
+}
+
+// filterPairs keeps the pairs whose status --diff-filter lets through.
+func filterPairs(pairs []diffPair, filter string) []diffPair {
+	if filter == "" {
+		return pairs
+	}
+	include := strings.ToLower(filter) != filter
+	var kept []diffPair
+	for _, p := range pairs {
+		status := diffStatus(p)
+		if strings.IndexByte(filter, status+'a'-'A') >= 0 {
+			continue
+		}
+		if include && strings.IndexByte(filter, status) < 0 {
+			continue
+		}
+		kept = append(kept, p)
+	}
+	return kept
+}
+
+// splitLines cuts data into lines that keep their newline; only the last
+// line can lack one.
+func splitLines(data []byte) []string {
+	var lines []string
+	for len(data) > 0 {
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			end = len(data)
+		}
+		lines = append(lines, string(data[:end]))
+		data = data[end:]
+	}
+	return lines
+}
+
+func isBinary(data []byte) bool {
+	return bytes.IndexByte(data[:min(len(data), binaryCheckSize)], 0) >= 0
+}
+
+// quotePath quotes a path the way git's headers do when it contains
+// control characters, quotes or backslashes, or bytes above ASCII if
+// core.quotePath is on.
+func quotePath(path string, quoteHigh bool) string {
+	var b strings.Builder
+	needed := false
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\a', c == '\b', c == '\t', c == '\n', c == '\v', c == '\f', c == '\r':
+			b.WriteByte('\\')
+			b.WriteByte("abtnvfr"[strings.IndexByte("\a\b\t\n\v\f\r", c)])
+		case c < 0x20 || c == 0x7f || c >= 0x80 && quoteHigh:
+			fmt.Fprintf(&b, "\\%03o", c)
+		default:
+			b.WriteByte(c)
+			continue
+		}
+		needed = true
+	}
+	if !needed {
+		return path
+	}
+	return `"` + b.String() + `"`
+}
+
+// funcName returns the hunk header context for a line using git's default
+// rule: lines starting with a letter, '_' or '$'.
+func funcName(line string) (string, bool) {
+	if line == "" {
+		return "", false
+	}
+	c := line[0]
+	if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == '$') {
+		return "", false
+	}
+	if len(line) > maxFuncNameLength {
+		line = line[:maxFuncNameLength]
+	}
+	return strings.TrimRight(line, " \t\n\v\f\r"), true
+}
+
+// hunkRange formats one side of a hunk header; single lines omit the
+// count, and empty ranges name the line before them.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+func nameTerminator(name string) string {
+	if strings.Contains(name, " ") {
+		return "\t"
+	}
+	return ""
+}
+
+// diffHunks groups changes into hunks as xdiff does: changes closer than
+// twice the context share a hunk, and ignorable changes only join one when
+// within the context of a change that is not.
+func diffHunks(changes []lineChange, context int) [][]lineChange {
+	maxCommon, maxIgnorable := 2*context, context
+	var hunks [][]lineChange
+	for len(changes) > 0 {
+		// Ignorable changes too far from the next change are dropped.
+		start := 0
+		for i := 0; i < len(changes) && changes[i].ignore; i++ {
+			if i+1 == len(changes) || changes[i+1].i1-(changes[i].i1+changes[i].n1) >= maxIgnorable {
+				start = i + 1
+			}
+		}
+		changes = changes[start:]
+		if len(changes) == 0 {
+			break
+		}
+
+		// last is the final change of the hunk; ignored counts the lines
+		// of the ignorable changes after it.
+		last, ignored := 0, 0
+	grow:
+		for i := 1; i < len(changes); i++ {
+			prev, c := changes[i-1], changes[i]
+			distance := c.i1 - (prev.i1 + prev.n1)
+			switch {
+			case distance > maxCommon:
+				break grow
+			case distance < maxIgnorable && (!c.ignore || last == i-1):
+				last, ignored = i, 0
+			case distance < maxIgnorable:
+				ignored += c.n2
+			case last != i-1 && c.i1+ignored-(changes[last].i1+changes[last].n1) > maxCommon:
+				break grow
+			case !c.ignore:
+				last, ignored = i, 0
+			default:
+				ignored += c.n2
+			}
+		}
+		hunks = append(hunks, changes[:last+1])
+		changes = changes[last+1:]
+	}
+	return hunks
+}
+
+// writeHunks prints hunks of changes between a and b in unified diff
+// form, with context lines around each change. Context lines are taken
+// from b, which matters when whitespace is ignored.
+func writeHunks(w io.Writer, a, b []string, hunks [][]lineChange, context int) {
+	writeLine := func(prefix byte, line string) {
+		fmt.Fprintf(w, "%c%s", prefix, line)
+		if !strings.HasSuffix(line, "\n") {
+			io.WriteString(w, "\n\\ No newline at end of file\n")
+		}
+	}
+
+	funcLine, funcSearched := "", 0
+	for _, hunk := range hunks {
+		first, last := hunk[0], hunk[len(hunk)-1]
+
+		s1 := max(first.i1-context, 0)
+		s2 := max(first.i2-context, 0)
+		trailing := min(context, len(a)-(last.i1+last.n1), len(b)-(last.i2+last.n2))
+		e1 := last.i1 + last.n1 + trailing
+		e2 := last.i2 + last.n2 + trailing
+
+		// The function line is the closest match above the hunk; lines
+		// already searched for an earlier hunk need no second look.
+		for i := s1 - 1; i >= funcSearched; i-- {
+			if name, ok := funcName(a[i]); ok {
+				funcLine = name
+				break
+			}
+		}
+		funcSearched = max(funcSearched, s1)
+
+		header := fmt.Sprintf("@@ -%s +%s @@", hunkRange(s1, e1-s1), hunkRange(s2, e2-s2))
+		if funcLine != "" {
+			header += " " + funcLine
+		}
+		fmt.Fprintln(w, header)
+
+		pos := s2
+		for _, c := range hunk {
+			for ; pos < c.i2; pos++ {
+				writeLine(' ', b[pos])
+			}
+			for _, line := range a[c.i1 : c.i1+c.n1] {
+				writeLine('-', line)
+			}
+			for _, line := range b[c.i2 : c.i2+c.n2] {
+				writeLine('+', line)
+			}
+			pos = c.i2 + c.n2
+		}
+		for ; pos < e2; pos++ {
+			writeLine(' ', b[pos])
+		}
+	}
+}
+
+// writePatch prints the git-style patch for one file pair.
+func writePatch(w io.Writer, p diffPair, opts *diffOptions) error {
+	if opts.submodule != submoduleShort && isSubmodulePair(p) {
+		return writeSubmoduleDiff(w, p, opts)
+	}
+	// A change of file type is shown as a deletion and a creation.
+	if p.old.mode != 0 && p.new.mode != 0 && p.old.mode&modeTypeMask != p.new.mode&modeTypeMask {
+		if err := writePatch(w, diffPair{path: p.path, old: p.old}, opts); err != nil {
+			return err
+		}
+		return writePatch(w, diffPair{path: p.path, new: p.new}, opts)
+	}
+
+	// The content is compared before any header is written, as a file
+	// whose changes are all ignored is left out entirely.
+	var a, b []string
+	var hunks [][]lineChange
+	binary := false
+	if p.old.hash != p.new.hash {
+		oldData, err := p.old.diffContent()
+		if err != nil {
+			return err
+		}
+		newData, err := p.new.diffContent()
+		if err != nil {
+			return err
+		}
+		if binary, err = diffAsBinary(p.path, oldData, newData); err != nil {
+			return err
+		}
+		if !binary {
+			a, b = splitLines(oldData), splitLines(newData)
+			hunks = diffHunks(diffLines(a, b, opts.flags), opts.context)
+			if opts.flags != 0 && len(hunks) == 0 && p.old.mode == p.new.mode {
+				return nil
+			}
+		}
+	}
+
+	oldName := quotePath("a/"+p.path, opts.quotePath)
+	newName := quotePath("b/"+p.path, opts.quotePath)
+	fmt.Fprintf(w, "diff --git %s %s\n", oldName, newName)
+	switch {
+	case p.old.mode == 0:
+		fmt.Fprintf(w, "new file mode %06o\n", p.new.mode)
+		oldName = "/dev/null"
+	case p.new.mode == 0:
+		fmt.Fprintf(w, "deleted file mode %06o\n", p.old.mode)
+		newName = "/dev/null"
+	case p.old.mode != p.new.mode:
+		fmt.Fprintf(w, "old mode %06o\nnew mode %06o\n", p.old.mode, p.new.mode)
+	}
+	if p.old.hash == p.new.hash {
+		return nil
+	}
+	index := fmt.Sprintf("index %s..%s", shortHash(p.old.hash), shortHash(p.new.hash))
+	if p.old.mode == p.new.mode {
+		index += fmt.Sprintf(" %06o", p.old.mode)
+	}
+	fmt.Fprintln(w, index)
+
+	if binary {
+		fmt.Fprintf(w, "Binary files %s and %s differ\n", oldName, newName)
+		return nil
+	}
+	if len(hunks) == 0 {
+		return nil
+	}
+	// Names with spaces are terminated by a tab so that patch tools can
+	// tell where they end.
+	fmt.Fprintf(w, "--- %s%s\n+++ %s%s\n", oldName, nameTerminator(oldName), newName, nameTerminator(newName))
+	writeHunks(w, a, b, hunks, opts.context)
+	return nil
+}
+
+// treeFiles lists the files below a tree by their full path.
+func treeFiles(hash objectID, prefix string, files map[string]diffEntry) error {
+	_, content, err := readObject(hash)
+	if err != nil {
+		return err
+	}
+	entries, err := parseTree(content)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		mode, err := strconv.ParseUint(entry.mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid mode %q in tree %x", entry.mode, hash)
+		}
+		path := prefix + entry.name
+		if mode == modeDirectory {
+			if err := treeFiles(entry.hash, path+"/", files); err != nil {
+				return err
+			}
+			continue
+		}
+		files[path] = diffEntry{mode: uint32(mode), hash: entry.hash}
+	}
+	return nil
+}
+
+// treeEntryAt looks up the file at path below a tree. The zero entry
+// means there is none.
+func treeEntryAt(tree objectID, path string) (diffEntry, error) {
+	hash := tree
+	for {
+		name, rest, more := strings.Cut(path, "/")
+		_, content, err := readObject(hash)
+		if err != nil {
+			return diffEntry{}, err
+		}
+		entries, err := parseTree(content)
+		if err != nil {
+			return diffEntry{}, err
+		}
+		i := slices.IndexFunc(entries, func(e treeEntry) bool { return e.name == name })
+		if i < 0 {
+			return diffEntry{}, nil
+		}
+		mode, err := strconv.ParseUint(entries[i].mode, 8, 32)
+		if err != nil {
+			return diffEntry{}, fmt.Errorf("invalid mode %q in tree %x", entries[i].mode, hash)
+		}
+		if more != (mode == modeDirectory) {
+			return diffEntry{}, nil
+		}
+		if !more {
+			return diffEntry{mode: uint32(mode), hash: entries[i].hash}, nil
+		}
+		hash, path = entries[i].hash, rest
+	}
+}
+
+// revisionTree resolves a revision to the tree it names, peeling tags and
+// commits.
+func revisionTree(name string) (objectID, error) {
+	hash, err := resolveRevision(name)
+	if err != nil {
+		return objectID{}, err
+	}
+	for {
+		objType, content, err := readObject(hash)
+		if err != nil {
+			return objectID{}, err
+		}
+		switch objType {
+		case treeObject:
+			return hash, nil
+		case commitObject:
+			c, err := parseCommit(content)
+			if err != nil {
+				return objectID{}, fmt.Errorf("corrupt commit %x: %w", hash, err)
+			}
+			return c.tree, nil
+		case tagObject:
+			t, err := parseTag(content)
+			if err != nil {
+				return objectID{}, fmt.Errorf("corrupt tag %x: %w", hash, err)
+			}
+			hash = t.object
+		default:
+			return objectID{}, fmt.Errorf("%s is a %s, not a tree", name, objType)
+		}
+	}
+}
+
+// revisionFiles lists the files of a revision's tree.
+func revisionFiles(name string) (map[string]diffEntry, error) {
+	tree, err := revisionTree(name)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]diffEntry)
+	return files, treeFiles(tree, "", files)
+}
+
+// headFiles lists the files of HEAD, or nothing on an unborn branch.
+func headFiles() (map[string]diffEntry, error) {
+	if _, err := resolveRef("HEAD"); errors.Is(err, errRefNotFound) {
+		return map[string]diffEntry{}, nil
+	}
+	return revisionFiles("HEAD")
+}
+
+// indexFiles lists the merged entries of the index and the paths that
+// have conflicts.
+func indexFiles(entries []indexEntry) (map[string]diffEntry, map[string]bool) {
+	files := make(map[string]diffEntry)
+	unmerged := make(map[string]bool)
+	for _, e := range entries {
+		if e.stage() != 0 {
+			unmerged[e.path] = true
+			continue
+		}
+		files[e.path] = diffEntry{mode: e.mode, hash: e.hash}
+	}
+	return files, unmerged
+}
+
+// worktreeMode maps a file's type and permissions to a git mode.
+func worktreeMode(fi fs.FileInfo) uint32 {
+	switch {
+	case fi.Mode()&fs.ModeSymlink != 0:
+		return modeSymlink
+	case fi.IsDir():
+		return modeGitlink
+	case fi.Mode()&0100 != 0:
+		return modeExecutable
+	}
+	return modeRegular
+}
+
+// worktreeFiles returns the working tree state of every merged index
+// entry; deleted files are left out. Files whose size and modification
+// time still match the index, and were not modified in the same instant
+// the index was written, are taken to be unchanged without reading them,
+// as are those outside a sparse checkout and those assumed unchanged.
+func worktreeFiles(cfg *config, entries []indexEntry) (map[string]diffEntry, error) {
+	fileMode, err := cfg.getBool("core.fileMode", true)
+	if err != nil {
+		return nil, err
+	}
+	var indexTime int64
+	if fi, err := os.Stat(indexFile); err == nil {
+		indexTime = fi.ModTime().UnixNano()
+	}
+
+	files := make(map[string]diffEntry)
+	for _, e := range entries {
+		if e.stage() != 0 {
+			continue
+		}
+		if e.extFlags&indexSkipWorktree != 0 || e.flags&indexFlagValid != 0 {
+			files[e.path] = diffEntry{mode: e.mode, hash: e.hash}
+			continue
+		}
+		fi, err := os.Lstat(e.path)
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) || errors.Is(err, syscall.ENOTDIR) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to stat %s: %w", e.path, err)
+		}
+
+		mode := worktreeMode(fi)
+		if !fileMode && mode&modeTypeMask == modeRegular&modeTypeMask && e.mode&modeTypeMask == mode&modeTypeMask {
+			mode = e.mode
+		}
+		// A submodule stands for the commit checked out in it, like in
+		// status; one that is not checked out is taken to be unchanged.
+		if mode == modeGitlink || e.mode == modeGitlink {
+			if mode != e.mode {
+				continue
+			}
+			head, ok, err := submoduleHead(e.path)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				head = e.hash
+			}
+			files[e.path] = diffEntry{mode: e.mode, hash: head}
+			continue
+		}
+
+		mtime := fi.ModTime().UnixNano()
+		if mode == e.mode && uint32(fi.Size()) == e.size && mtime == e.mtime.UnixNano() && mtime < indexTime {
+			files[e.path] = diffEntry{mode: mode, hash: e.hash}
+			continue
+		}
+
+		var data []byte
+		if mode == modeSymlink {
+			target, err := os.Readlink(e.path)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read link %s: %w", e.path, err)
+			}
+			data = []byte(target)
+		} else if data, err = os.ReadFile(e.path); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", e.path, err)
+		} else if data, err = convertToGit(e.path, data); err != nil {
+			return nil, err
+		}
+		files[e.path] = diffEntry{mode: mode, hash: hashObjectData(blobObject, data), data: data}
+	}
+	return files, nil
+}
+
+// matchPathspec reports whether path is one of the given paths or below
+// one of them. No paths match everything.
+func matchPathspec(path string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = strings.TrimSuffix(filepath.ToSlash(filepath.Clean(p)), "/")
+		if p == "." || path == p || strings.HasPrefix(path, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// diffFiles pairs up two listings and returns the paths that differ,
+// sorted by path.
+func diffFiles(old, new map[string]diffEntry, unmerged map[string]bool, paths []string) []diffPair {
+	var pairs []diffPair
+	seen := make(map[string]bool)
+	add := func(path string) {
+		if seen[path] || !matchPathspec(path, paths) {
+			return
+		}
+		seen[path] = true
+		if unmerged[path] {
+			pairs = append(pairs, diffPair{path: path, unmerged: true})
+			return
+		}
+		o, n := old[path], new[path]
+		if o.mode != n.mode || o.hash != n.hash {
+			pairs = append(pairs, diffPair{path: path, old: o, new: n})
+		}
+	}
+	for path := range old {
+		add(path)
+	}
+	for path := range new {
+		add(path)
+	}
+	for path := range unmerged {
+		add(path)
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].path < pairs[j].path })
+	return pairs
+}
+
+// writeDiff prints a patch for every pair, a diffstat, or both. Like git,
+// listing the names of the files overrides either.
+func writeDiff(w io.Writer, pairs []diffPair, opts *diffOptions) error {
+	pairs = filterPairs(pairs, opts.filter)
+	if opts.nameOnly || opts.nameStatus {
+		for _, p := range pairs {
+			if opts.nameStatus {
+				fmt.Fprintf(w, "%c\t", diffStatus(p))
+			}
+			fmt.Fprintln(w, quotePath(p.path, opts.quotePath))
+		}
+		return nil
+	}
+	if opts.stat || opts.numstat || opts.shortstat {
+		stats, err := diffStats(pairs, opts)
+		if err != nil {
+			return err
+		}
+		if opts.numstat {
+			writeNumstat(w, stats)
+		}
+		if opts.stat {
+			writeStat(w, stats, opts)
+		}
+		if opts.shortstat && len(stats) > 0 {
+			writeShortstat(w, stats)
+		}
+		// A blank line separates the summaries from the patch.
+		if opts.patch && len(stats) > 0 {
+			fmt.Fprintln(w)
+		}
+	}
+	if !opts.patch {
+		return nil
+	}
+
+	for _, p := range pairs {
+		if p.unmerged {
+			fmt.Fprintf(w, "* Unmerged path %s\n", p.path)
+			continue
+		}
+		if err := writePatch(w, p, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseStatLimits parses the value of --stat=<width>[,<name-width>[,<count>]].
+func parseStatLimits(value string, opts *diffOptions) error {
+	limits := []*int{&opts.statWidth, &opts.statNameWidth, &opts.statCount}
+	parts := strings.Split(value, ",")
+	if len(parts) > len(limits) {
+		return fmt.Errorf("invalid --stat value: %s", value)
+	}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return fmt.Errorf("invalid --stat value: %s", value)
+		}
+		*limits[i] = n
+	}
+	return nil
+}
+
+// parseDiffFormatOption handles an option choosing the output format of
+// a diff, as taken by every command that shows one. It reports whether
+// arg was one.
+func parseDiffFormatOption(arg string, opts *diffOptions) (bool, error) {
+	switch {
+	case strings.HasPrefix(arg, "-U") || strings.HasPrefix(arg, "--unified="):
+		value := strings.TrimPrefix(strings.TrimPrefix(arg, "--unified="), "-U")
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return true, fmt.Errorf("invalid context length %q", value)
+		}
+		// Asking for context asks for a patch.
+		opts.context = n
+		opts.patch = true
+	case arg == "-p" || arg == "--patch":
+		opts.patch = true
+	case arg == "--patch-with-stat":
+		opts.patch, opts.stat = true, true
+	case arg == "--name-only":
+		opts.nameOnly = true
+	case arg == "--name-status":
+		opts.nameStatus = true
+	case strings.HasPrefix(arg, "--diff-filter="):
+		value := strings.TrimPrefix(arg, "--diff-filter=")
+		for _, c := range value {
+			if !strings.ContainsRune("ACDMRTUXBacdmrtuxb", c) {
+				return true, fmt.Errorf("unknown change class '%c' in --diff-filter=%s", c, value)
+			}
+		}
+		opts.filter = value
+	case arg == "-w" || arg == "--ignore-all-space":
+		opts.flags |= diffIgnoreAllSpace
+	case arg == "-b" || arg == "--ignore-space-change":
+		opts.flags |= diffIgnoreSpaceChange
+	case arg == "--ignore-space-at-eol":
+		opts.flags |= diffIgnoreSpaceAtEOL
+	case arg == "--ignore-blank-lines":
+		opts.flags |= diffIgnoreBlankLines
+	case arg == "--numstat":
+		opts.numstat = true
+	case arg == "--shortstat":
+		opts.shortstat = true
+	case arg == "--stat" || strings.HasPrefix(arg, "--stat="):
+		opts.stat = true
+		if value, ok := strings.CutPrefix(arg, "--stat="); ok {
+			if err := parseStatLimits(value, opts); err != nil {
+				return true, err
+			}
+		}
+	case arg == "--submodule" || strings.HasPrefix(arg, "--submodule="):
+		value := "log"
+		if v, ok := strings.CutPrefix(arg, "--submodule="); ok {
+			value = v
+		}
+		format, ok := submoduleFormats[value]
+		if !ok {
+			return true, fmt.Errorf("failed to parse --submodule option parameter: '%s'", value)
+		}
+		opts.submodule = format
+	case strings.HasPrefix(arg, "--stat-"):
+		name, value, _ := strings.Cut(strings.TrimPrefix(arg, "--stat-"), "=")
+		limits := map[string]*int{
+			"width":       &opts.statWidth,
+			"name-width":  &opts.statNameWidth,
+			"graph-width": &opts.statGraphWidth,
+			"count":       &opts.statCount,
+		}
+		limit, ok := limits[name]
+		if !ok {
+			return false, nil
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return true, fmt.Errorf("%s expects a numerical value", strings.TrimSuffix(arg, "="+value))
+		}
+		*limit = n
+		opts.stat = true
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// configDiffOptions returns the diff options set in config.
+func configDiffOptions(cfg *config) (*diffOptions, error) {
+	opts := &diffOptions{}
+	var err error
+	if opts.quotePath, err = cfg.getBool("core.quotePath", true); err != nil {
+		return nil, err
+	}
+	if opts.context, err = cfg.getInt("diff.context", defaultDiffContext); err != nil {
+		return nil, err
+	}
+	if opts.statNameWidth, err = cfg.getInt("diff.statNameWidth", 0); err != nil {
+		return nil, err
+	}
+	if opts.statGraphWidth, err = cfg.getInt("diff.statGraphWidth", 0); err != nil {
+		return nil, err
+	}
+	if value, ok := cfg.get("diff.submodule"); ok {
+		if opts.submodule, ok = submoduleFormats[value]; !ok {
+			return nil, fmt.Errorf("bad diff.submodule value '%s'", value)
+		}
+	}
+	return opts, nil
+}
+
+func runDiff(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	safeCRLFCheck = safeCRLFWarn
+	opts, err := configDiffOptions(cfg)
+	if err != nil {
+		return err
+	}
+
+	cached := false
+	var revs, paths []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case arg == "--cached" || arg == "--staged":
+			cached = true
+		case arg == "-U" || arg == "--unified":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			if _, err := parseDiffFormatOption("-U"+args[i], opts); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "-"):
+			if ok, err := parseDiffFormatOption(arg, opts); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("unknown option %s", arg)
+			}
+		case len(paths) > 0:
+			paths = append(paths, arg)
+		default:
+			if from, to, ok := strings.Cut(arg, ".."); ok && !strings.HasPrefix(to, ".") {
+				if from == "" {
+					from = "HEAD"
+				}
+				if to == "" {
+					to = "HEAD"
+				}
+				revs = append(revs, from, to)
+				continue
+			}
+			if _, err := resolveRevision(arg); err == nil {
+				revs = append(revs, arg)
+				continue
+			}
+			if _, err := os.Lstat(arg); err != nil {
+				return fmt.Errorf("ambiguous argument '%s': unknown revision or path not in the working tree", arg)
+			}
+			paths = append(paths, arg)
+		}
+	}
+	if !opts.hasFormat() {
+		opts.patch = true
+	}
+	if len(revs) > 2 || len(revs) == 2 && cached {
+		return fmt.Errorf("usage: mygit diff [--cached] [<commit> [<commit>]] [-- <path>...]")
+	}
+
+	var old, new map[string]diffEntry
+	var unmerged map[string]bool
+	if len(revs) == 2 {
+		if old, err = revisionFiles(revs[0]); err != nil {
+			return err
+		}
+		if new, err = revisionFiles(revs[1]); err != nil {
+			return err
+		}
+	} else {
+		entries, err := readIndex()
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(revs) == 1:
+			old, err = revisionFiles(revs[0])
+		case cached:
+			old, err = headFiles()
+		default:
+			old, unmerged = indexFiles(entries)
+		}
+		if err != nil {
+			return err
+		}
+		if cached {
+			new, unmerged = indexFiles(entries)
+		} else if new, err = worktreeFiles(cfg, entries); err != nil {
+			return err
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return writeDiff(out, diffFiles(old, new, unmerged, paths), opts)
+}
@@ -0,0 +1,274 @@
+package mygit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultTerminalColumns is the width assumed for --stat when COLUMNS is
+// not set.
+const defaultTerminalColumns = 80
+
+// fileStat is what --stat and --numstat report for a file pair: the lines
+// added and deleted or, for binary files, the new and old size in bytes.
+type fileStat struct {
+	name     string
+	added    int
+	deleted  int
+	binary   bool
+	unmerged bool
+}
+
+func pairStat(p diffPair, opts *diffOptions) (fileStat, error) {
+	s := fileStat{name: quotePath(p.path, opts.quotePath), unmerged: p.unmerged}
+	if p.unmerged {
+		return s, nil
+	}
+	oldData, err := p.old.diffContent()
+	if err != nil {
+		return fileStat{}, err
+	}
+	newData, err := p.new.diffContent()
+	if err != nil {
+		return fileStat{}, err
+	}
+
+	same := p.old.hash == p.new.hash
+	if binary, err := diffAsBinary(p.path, oldData, newData); err != nil {
+		return fileStat{}, err
+	} else if binary {
+		s.binary = true
+		if !same {
+			s.added, s.deleted = len(newData), len(oldData)
+		}
+		return s, nil
+	}
+	if !same {
+		// Like git, count the lines of the hunks a patch would show, which
+		// leaves out ignorable changes far from others.
+		changes := diffLines(splitLines(oldData), splitLines(newData), opts.flags)
+		for _, hunk := range diffHunks(changes, opts.context) {
+			for _, c := range hunk {
+				s.added += c.n2
+				s.deleted += c.n1
+			}
+		}
+	}
+	return s, nil
+}
+
+func diffStats(pairs []diffPair, opts *diffOptions) ([]fileStat, error) {
+	stats := make([]fileStat, 0, len(pairs))
+	for _, p := range pairs {
+		s, err := pairStat(p, opts)
+		if err != nil {
+			return nil, err
+		}
+		// Files whose changes are all ignored are left out, as in patches.
+		if opts.flags != 0 && !s.binary && !s.unmerged && s.added == 0 && s.deleted == 0 && p.old.mode == p.new.mode {
+			continue
+		}
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
+
+// writeNumstat prints tab-separated added and deleted line counts, with
+// dashes for binary files.
+func writeNumstat(w io.Writer, stats []fileStat) {
+	for _, s := range stats {
+		if s.binary {
+			fmt.Fprintf(w, "-\t-\t%s\n", s.name)
+		} else {
+			fmt.Fprintf(w, "%d\t%d\t%s\n", s.added, s.deleted, s.name)
+		}
+	}
+}
+
+// terminalColumns is the width --stat output fits into by default.
+func terminalColumns() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultTerminalColumns
+}
+
+func decimalWidth(n int) int {
+	return len(strconv.Itoa(n))
+}
+
+// scaleLinear scales a change count to the graph width, keeping at least
+// one column for any change.
+func scaleLinear(n, width, maxChange int) int {
+	if n == 0 {
+		return 0
+	}
+	return 1 + n*(width-1)/maxChange
+}
+
+// writeStat prints git's diffstat: a line per file with the number of
+// changed lines and a +/- histogram scaled to fit the width, followed by
+// the summary. The name gets at most 5/8 of the width when space runs
+// out, and is then shortened from the left.
+func writeStat(w io.Writer, stats []fileStat, opts *diffOptions) {
+	if len(stats) == 0 {
+		return
+	}
+	shown := stats
+	if opts.statCount > 0 && opts.statCount < len(stats) {
+		shown = stats[:opts.statCount]
+	}
+
+	maxLen, maxChange, binWidth, numberWidth := 0, 0, 0, 0
+	for _, s := range shown {
+		maxLen = max(maxLen, len([]rune(s.name)))
+		switch {
+		case s.unmerged:
+			// "Unmerged" is 8 characters.
+			binWidth = max(binWidth, 8)
+		case s.binary:
+			// "Bin XXX -> YYY bytes", with the counts aligned to "Bin".
+			binWidth = max(binWidth, 14+decimalWidth(s.added)+decimalWidth(s.deleted))
+			numberWidth = 3
+		default:
+			maxChange = max(maxChange, s.added+s.deleted)
+		}
+	}
+
+	width := opts.statWidth
+	if width == 0 {
+		width = terminalColumns()
+	}
+	numberWidth = max(numberWidth, decimalWidth(maxChange))
+	width = max(width, 16+6+numberWidth)
+
+	graphWidth := maxChange
+	if maxChange+4 <= binWidth {
+		graphWidth = binWidth - 4
+	}
+	if opts.statGraphWidth > 0 && opts.statGraphWidth < graphWidth {
+		graphWidth = opts.statGraphWidth
+	}
+	nameWidth := maxLen
+	if opts.statNameWidth > 0 && opts.statNameWidth < maxLen {
+		nameWidth = opts.statNameWidth
+	}
+	if nameWidth+numberWidth+6+graphWidth > width {
+		if graphWidth > width*3/8-numberWidth-6 {
+			graphWidth = max(width*3/8-numberWidth-6, 6)
+		}
+		if opts.statGraphWidth > 0 && graphWidth > opts.statGraphWidth {
+			graphWidth = opts.statGraphWidth
+		}
+		if nameWidth > width-numberWidth-6-graphWidth {
+			nameWidth = width - numberWidth - 6 - graphWidth
+		} else {
+			graphWidth = width - numberWidth - 6 - nameWidth
+		}
+	}
+
+	for _, s := range shown {
+		prefix, name := "", []rune(s.name)
+		room := nameWidth
+		if len(name) > nameWidth {
+			prefix = "..."
+			room = max(room-3, 0)
+			name = name[len(name)-room:]
+			if slash := strings.IndexRune(string(name), '/'); slash >= 0 {
+				name = []rune(string(name)[slash:])
+			}
+		}
+		padding := strings.Repeat(" ", max(room-len(name), 0))
+		label := " " + prefix + string(name) + padding + " | "
+
+		switch {
+		case s.binary && s.added == 0 && s.deleted == 0:
+			fmt.Fprintf(w, "%s%*s\n", label, numberWidth, "Bin")
+		case s.binary:
+			fmt.Fprintf(w, "%s%*s %d -> %d bytes\n", label, numberWidth, "Bin", s.deleted, s.added)
+		case s.unmerged:
+			fmt.Fprintf(w, "%s%*s\n", label, numberWidth, "Unmerged")
+		default:
+			add, del := s.added, s.deleted
+			if graphWidth <= maxChange {
+				total := scaleLinear(add+del, graphWidth, maxChange)
+				if total < 2 && add > 0 && del > 0 {
+					total = 2
+				}
+				if add < del {
+					add = scaleLinear(add, graphWidth, maxChange)
+					del = total - add
+				} else {
+					del = scaleLinear(del, graphWidth, maxChange)
+					add = total - del
+				}
+			}
+			sep := ""
+			if s.added+s.deleted > 0 {
+				sep = " "
+			}
+			fmt.Fprintf(w, "%s%*d%s%s%s\n", label, numberWidth, s.added+s.deleted, sep,
+				strings.Repeat("+", add), strings.Repeat("-", del))
+		}
+	}
+	if len(shown) < len(stats) {
+		fmt.Fprintln(w, " ...")
+	}
+	writeShortstat(w, stats)
+}
+
+// writeShortstat prints the "N files changed" summary. Unmerged paths are
+// not counted, and binary files only count as changed files.
+func writeShortstat(w io.Writer, stats []fileStat) {
+	files, insertions, deletions := 0, 0, 0
+	for _, s := range stats {
+		if s.unmerged {
+			continue
+		}
+		files++
+		if !s.binary {
+			insertions += s.added
+			deletions += s.deleted
+		}
+	}
+	if files == 0 {
+		fmt.Fprintln(w, " 0 files changed")
+		return
+	}
+
+	plural := func(n int, one, many string) string {
+		if n == 1 {
+			return fmt.Sprintf(one, n)
+		}
+		return fmt.Sprintf(many, n)
+	}
+	summary := plural(files, " %d file changed", " %d files changed")
+	// Zero counts are only left out when the other one is not zero.
+	if insertions > 0 || deletions == 0 {
+		summary += plural(insertions, ", %d insertion(+)", ", %d insertions(+)")
+	}
+	if deletions > 0 || insertions == 0 {
+		summary += plural(deletions, ", %d deletion(-)", ", %d deletions(-)")
+	}
+	fmt.Fprintln(w, summary)
+}
+
+// writeSummary lists the files that were created or deleted or that
+// changed mode, as git does after a diffstat.
+func writeSummary(w io.Writer, pairs []diffPair, opts *diffOptions) {
+	for _, p := range pairs {
+		name := quotePath(p.path, opts.quotePath)
+		switch {
+		case p.unmerged:
+		case p.old.mode == 0:
+			fmt.Fprintf(w, " create mode %06o %s\n", p.new.mode, name)
+		case p.new.mode == 0:
+			fmt.Fprintf(w, " delete mode %06o %s\n", p.old.mode, name)
+		case p.old.mode != p.new.mode:
+			fmt.Fprintf(w, " mode change %06o => %06o %s\n", p.old.mode, p.new.mode, name)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package mygit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// topLevelFiles lists the entries of a revision's tree itself, without
+// descending into subtrees, which are listed with their directory mode.
+func topLevelFiles(name string) (map[string]diffEntry, error) {
+	tree, err := revisionTree(name)
+	if err != nil {
+		return nil, err
+	}
+	_, content, err := readObject(tree)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := parseTree(content)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]diffEntry)
+	for _, entry := range entries {
+		mode, err := strconv.ParseUint(entry.mode, 8, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mode %q in tree %x", entry.mode, tree)
+		}
+		files[entry.name] = diffEntry{mode: uint32(mode), hash: entry.hash}
+	}
+	return files, nil
+}
+
+// writeRawDiff prints the pairs in git's raw format,
+// ":<old mode> <new mode> <old hash> <new hash> <status>\t<path>".
+func writeRawDiff(w io.Writer, pairs []diffPair, opts *diffOptions) {
+	for _, p := range filterPairs(pairs, opts.filter) {
+		fmt.Fprintf(w, ":%06o %06o %s %s %c\t%s\n",
+			p.old.mode, p.new.mode, p.old.hash, p.new.hash, diffStatus(p), quotePath(p.path, opts.quotePath))
+	}
+}
+
+// runDiffTree compares the trees of two revisions. Without -r only the
+// entries of the top-level trees are compared; patches and stats always
+// look at files, so they imply -r.
+func runDiffTree(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	opts, err := configDiffOptions(cfg)
+	if err != nil {
+		return err
+	}
+
+	recursive := false
+	var revs, paths []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case arg == "-r":
+			recursive = true
+		case strings.HasPrefix(arg, "-"):
+			if ok, err := parseDiffFormatOption(arg, opts); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("unknown option %s", arg)
+			}
+		case len(revs) < 2:
+			revs = append(revs, arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(revs) != 2 {
+		return fmt.Errorf("usage: mygit diff-tree [-r] [<options>] <tree-ish> <tree-ish> [<path>...]")
+	}
+	if opts.patch || opts.stat || opts.numstat || opts.shortstat {
+		recursive = true
+	}
+
+	list := topLevelFiles
+	if recursive {
+		list = revisionFiles
+	}
+	old, err := list(revs[0])
+	if err != nil {
+		return err
+	}
+	new, err := list(revs[1])
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	pairs := diffFiles(old, new, nil, paths)
+	if !opts.hasFormat() {
+		writeRawDiff(out, pairs, opts)
+		return nil
+	}
+	return writeDiff(out, pairs, opts)
+}
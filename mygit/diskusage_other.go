@@ -0,0 +1,10 @@
+//go:build !unix
+
+package mygit
+
+import "io/fs"
+
+// diskUsage returns the file size where block counts are not available.
+func diskUsage(fi fs.FileInfo) int64 {
+	return fi.Size()
+}
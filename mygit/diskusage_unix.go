@@ -0,0 +1,17 @@
+//go:build unix
+
+package mygit
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// diskUsage returns the space a file takes up on disk, which is what git
+// reports for loose objects.
+func diskUsage(fi fs.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
@@ -0,0 +1,123 @@
+package mygit
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+const defaultEditor = "vi"
+
+// shellMetachars are the characters that make git hand a command to the
+// shell instead of executing it directly.
+const shellMetachars = "|&;<>()$`\\\"' \t\n*?[#~=%"
+
+// shellCommand builds a command for a user-supplied command line such as
+// core.editor. Lines with shell syntax run through "sh -c" with args
+// appended as positional parameters, so quoting and arguments in the
+// configured value work the way they do in git.
+func shellCommand(command string, args ...string) *exec.Cmd {
+	if !strings.ContainsAny(command, shellMetachars) {
+		return exec.Command(command, args...)
+	}
+	shellArgs := []string{"-c", command + ` "$@"`, command}
+	return exec.Command("sh", append(shellArgs, args...)...)
+}
+
+// gitEditor resolves the editor for commit and tag messages: GIT_EDITOR,
+// core.editor, VISUAL, EDITOR and finally vi. VISUAL is ignored on dumb
+// terminals, and vi is refused there.
+func gitEditor(cfg *config) (string, error) {
+	if editor := os.Getenv("GIT_EDITOR"); editor != "" {
+		return editor, nil
+	}
+	if editor, ok := cfg.get("core.editor"); ok && editor != "" {
+		return editor, nil
+	}
+
+	dumb := os.Getenv("TERM") == "" || os.Getenv("TERM") == "dumb"
+	if editor := os.Getenv("VISUAL"); editor != "" && !dumb {
+		return editor, nil
+	}
+	if editor := os.Getenv("EDITOR"); editor != "" {
+		return editor, nil
+	}
+	if dumb {
+		return "", fmt.Errorf("terminal is dumb, but EDITOR unset")
+	}
+	return defaultEditor, nil
+}
+
+// sequenceEditor resolves the editor for rebase todo lists, falling back
+// to gitEditor when neither GIT_SEQUENCE_EDITOR nor sequence.editor is set.
+func sequenceEditor(cfg *config) (string, error) {
+	if editor := os.Getenv("GIT_SEQUENCE_EDITOR"); editor != "" {
+		return editor, nil
+	}
+	if editor, ok := cfg.get("sequence.editor"); ok && editor != "" {
+		return editor, nil
+	}
+	return gitEditor(cfg)
+}
+
+// launchEditor lets the user edit path with editor on the terminal. The
+// editor ":" leaves the file untouched.
+func launchEditor(editor, path string) error {
+	if editor == ":" {
+		return nil
+	}
+	cmd := shellCommand(editor, path)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("there was a problem with the editor '%s': %w", editor, err)
+	}
+	return nil
+}
+
+// editMessage writes initial to path, opens it in the user's editor and
+// returns the edited contents.
+func editMessage(cfg *config, path, initial string) (string, error) {
+	editor, err := gitEditor(cfg)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(initial), 0644); err != nil {
+		return "", fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := launchEditor(editor, path); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	return string(data), nil
+}
+
+// runVar prints the value of a git logical variable. Only the editor
+// variables are supported.
+func runVar(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: mygit var (GIT_EDITOR | GIT_SEQUENCE_EDITOR)")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	var value string
+	switch args[0] {
+	case "GIT_EDITOR":
+		value, err = gitEditor(cfg)
+	case "GIT_SEQUENCE_EDITOR":
+		value, err = sequenceEditor(cfg)
+	default:
+		return fmt.Errorf("%s: no such variable", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
@@ -0,0 +1,323 @@
+package mygit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// crlfAction is what happens to the line endings of a file, worked out
+// from its text, crlf and eol attributes, core.autocrlf and core.eol.
+type crlfAction int
+
+const (
+	// crlfBinary leaves the file alone.
+	crlfBinary crlfAction = iota
+	// The text actions store LF line endings and check out LF or CRLF.
+	crlfTextInput
+	crlfTextCRLF
+	// The auto actions do the same, but only to files that look like
+	// text and have no CRLF line endings stored yet.
+	crlfAutoInput
+	crlfAutoCRLF
+)
+
+// safeCRLFMode tells what becomes of a conversion that would not give
+// back the same file once checked out again.
+type safeCRLFMode int
+
+const (
+	safeCRLFOff safeCRLFMode = iota
+	safeCRLFWarn
+	safeCRLFDie
+)
+
+// safeCRLFCheck is set by the commands that look out for line endings
+// that would not survive being stored and checked out again, as far as
+// core.safecrlf allows: add fails, diff only ever warns. Other commands
+// convert silently.
+var safeCRLFCheck = safeCRLFOff
+
+// eolSettings holds core.autocrlf, core.eol and core.safecrlf once read
+// by loadEOLSettings.
+var eolSettings struct {
+	sync.Mutex
+	loaded bool
+	// autocrlf is "true", "false" or "input".
+	autocrlf string
+	// crlf is whether text files are checked out with CRLF when
+	// core.autocrlf does not decide.
+	crlf     bool
+	safeCRLF safeCRLFMode
+}
+
+// loadEOLSettings reads the line ending settings unless already done.
+func loadEOLSettings() (autocrlf string, crlf bool, safeCRLF safeCRLFMode, err error) {
+	eolSettings.Lock()
+	defer eolSettings.Unlock()
+	if !eolSettings.loaded {
+		if err := readEOLSettings(); err != nil {
+			return "", false, safeCRLFOff, err
+		}
+		eolSettings.loaded = true
+	}
+	return eolSettings.autocrlf, eolSettings.crlf, eolSettings.safeCRLF, nil
+}
+
+func readEOLSettings() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	eolSettings.autocrlf = "false"
+	if value, ok := cfg.get("core.autocrlf"); ok && value == "input" {
+		eolSettings.autocrlf = "input"
+	} else if autocrlf, err := cfg.getBool("core.autocrlf", false); err != nil {
+		return err
+	} else if autocrlf {
+		eolSettings.autocrlf = "true"
+	}
+	switch value, _ := cfg.get("core.eol"); value {
+	case "", "native", "lf":
+	case "crlf":
+		eolSettings.crlf = true
+	default:
+		return fmt.Errorf("bad core.eol value '%s'", value)
+	}
+	eolSettings.safeCRLF = safeCRLFWarn
+	if value, ok := cfg.get("core.safecrlf"); ok && value != "warn" {
+		if safe, err := cfg.getBool("core.safecrlf", true); err != nil {
+			return err
+		} else if safe {
+			eolSettings.safeCRLF = safeCRLFDie
+		} else {
+			eolSettings.safeCRLF = safeCRLFOff
+		}
+	}
+	return nil
+}
+
+// fileCRLFAction works out what happens to the line endings of a file
+// with attrs.
+func fileCRLFAction(attrs map[string]string) (crlfAction, error) {
+	autocrlf, crlf, _, err := loadEOLSettings()
+	if err != nil {
+		return crlfBinary, err
+	}
+	// core.autocrlf wins over core.eol.
+	switch autocrlf {
+	case "true":
+		crlf = true
+	case "input":
+		crlf = false
+	}
+
+	// text, or the older crlf, says whether the file is text; eol which
+	// line endings it gets checked out with, making it text.
+	text, ok := attrs["text"]
+	if !ok {
+		text = attrs["crlf"]
+	}
+	switch {
+	case text == attrUnset:
+		return crlfBinary, nil
+	case attrs["eol"] == "lf" && text == "auto":
+		return crlfAutoInput, nil
+	case attrs["eol"] == "crlf" && text == "auto":
+		return crlfAutoCRLF, nil
+	case attrs["eol"] == "lf" || text == "input":
+		return crlfTextInput, nil
+	case attrs["eol"] == "crlf":
+		return crlfTextCRLF, nil
+	case text == attrSet && crlf:
+		return crlfTextCRLF, nil
+	case text == attrSet:
+		return crlfTextInput, nil
+	case text == "auto" && crlf:
+		return crlfAutoCRLF, nil
+	case text == "auto":
+		return crlfAutoInput, nil
+	}
+	switch autocrlf {
+	case "true":
+		return crlfAutoCRLF, nil
+	case "input":
+		return crlfAutoInput, nil
+	}
+	return crlfBinary, nil
+}
+
+func (a crlfAction) auto() bool {
+	return a == crlfAutoInput || a == crlfAutoCRLF
+}
+
+// textStats counts the line endings and kinds of characters of a file.
+type textStats struct {
+	nul, loneCR, loneLF, crlf int
+	printable, nonPrintable   int
+}
+
+func gatherTextStats(data []byte) textStats {
+	var s textStats
+	for i := 0; i < len(data); i++ {
+		switch c := data[i]; {
+		case c == '\r' && i+1 < len(data) && data[i+1] == '\n':
+			s.crlf++
+			i++
+		case c == '\r':
+			s.loneCR++
+		case c == '\n':
+			s.loneLF++
+		case c == 127:
+			s.nonPrintable++
+		case c == '\b' || c == '\t' || c == '\033' || c == '\f':
+			s.printable++
+		case c == 0:
+			s.nul++
+			s.nonPrintable++
+		case c < 32:
+			s.nonPrintable++
+		default:
+			s.printable++
+		}
+	}
+	// A DOS end-of-file marker at the very end is not held against it.
+	if len(data) > 0 && data[len(data)-1] == '\032' {
+		s.nonPrintable--
+	}
+	return s
+}
+
+// binary tells whether the counts look like those of a binary file, which
+// conversions leave alone.
+func (s textStats) binary() bool {
+	return s.loneCR > 0 || s.nul > 0 || s.printable>>7 < s.nonPrintable
+}
+
+// willAddCR tells whether checking out a file with these counts turns its
+// LF line endings into CRLF.
+func (s textStats) willAddCR(action crlfAction) bool {
+	if action != crlfTextCRLF && action != crlfAutoCRLF || s.loneLF == 0 {
+		return false
+	}
+	// Files that already have CRs are not touched by the auto actions.
+	return !action.auto() || s.loneCR == 0 && s.crlf == 0 && !s.binary()
+}
+
+// indexBlobs holds the blobs of the index by path once read by
+// hasCRLFInIndex, which indexBlobsMu guards.
+var (
+	indexBlobsMu sync.Mutex
+	indexBlobs   map[string]objectID
+)
+
+// hasCRLFInIndex tells whether the text stored in the index for path has
+// CRLF line endings, which the auto actions then leave alone.
+func hasCRLFInIndex(path string) (bool, error) {
+	indexBlobsMu.Lock()
+	if indexBlobs == nil {
+		entries, err := readIndex()
+		if err != nil {
+			indexBlobsMu.Unlock()
+			return false, err
+		}
+		indexBlobs = make(map[string]objectID)
+		for _, e := range entries {
+			if e.stage() == 0 && e.mode != modeGitlink && e.mode != modeSymlink {
+				indexBlobs[e.path] = e.hash
+			}
+		}
+	}
+	hash, ok := indexBlobs[path]
+	indexBlobsMu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	_, data, err := readObject(hash)
+	if err != nil || bytes.IndexByte(data, '\r') < 0 {
+		return false, err
+	}
+	s := gatherTextStats(data)
+	return s.crlf > 0 && !s.binary(), nil
+}
+
+// crlfToGit turns the CRLF line endings of a working tree file into LF as
+// its attributes ask, checking the conversion round-trips if the command
+// cares.
+func crlfToGit(path string, data []byte, attrs map[string]string) ([]byte, error) {
+	action, err := fileCRLFAction(attrs)
+	if err != nil || action == crlfBinary || len(data) == 0 {
+		return data, err
+	}
+	s := gatherTextStats(data)
+	convert := s.crlf > 0
+	if action.auto() {
+		if s.binary() {
+			return data, nil
+		}
+		if inIndex, err := hasCRLFInIndex(path); err != nil {
+			return nil, err
+		} else if inIndex {
+			convert = false
+		}
+	}
+
+	_, _, safeCRLF, err := loadEOLSettings()
+	if err != nil {
+		return nil, err
+	}
+	if mode := min(safeCRLFCheck, safeCRLF); mode != safeCRLFOff {
+		// What the file would look like stored and checked out again.
+		after := s
+		if convert {
+			after.loneLF += after.crlf
+			after.crlf = 0
+		}
+		if after.willAddCR(action) {
+			after.crlf += after.loneLF
+			after.loneLF = 0
+		}
+		from, to := "", ""
+		switch {
+		case s.crlf > 0 && after.crlf == 0:
+			from, to = "CRLF", "LF"
+		case s.loneLF > 0 && after.loneLF == 0:
+			from, to = "LF", "CRLF"
+		}
+		switch {
+		case from != "" && mode == safeCRLFDie:
+			return nil, fmt.Errorf("%s would be replaced by %s in %s", from, to, path)
+		case from != "":
+			fmt.Fprintf(os.Stderr, "warning: in the working copy of '%s', %s will be replaced by %s the next time Git touches it\n", path, from, to)
+		}
+	}
+
+	if !convert {
+		return data, nil
+	}
+	out := make([]byte, 0, len(data))
+	for i, c := range data {
+		if c != '\r' || i+1 == len(data) || data[i+1] != '\n' {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// crlfToWorktree turns the LF line endings of a stored file into CRLF as
+// its attributes ask.
+func crlfToWorktree(data []byte, attrs map[string]string) ([]byte, error) {
+	action, err := fileCRLFAction(attrs)
+	if err != nil || !gatherTextStats(data).willAddCR(action) {
+		return data, err
+	}
+	out := make([]byte, 0, len(data)+bytes.Count(data, []byte("\n")))
+	for i, c := range data {
+		if c == '\n' && (i == 0 || data[i-1] != '\r') {
+			out = append(out, '\r')
+		}
+		out = append(out, c)
+	}
+	return out, nil
+}
@@ -0,0 +1,932 @@
+package mygit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/git-starter-go/internal/pktline"
+)
+
+const maxHaves = 256
+
+type advertisedRef struct {
+	name string
+	hash objectID
+	// peeled is the object an annotated tag points at, if advertised.
+	peeled objectID
+	// symref is the ref a symbolic ref such as HEAD points to, if known.
+	symref string
+}
+
+type refAdvertisement struct {
+	// version is the protocol version the server answered with. For
+	// version 2 refs are not advertised and must be listed with ls-refs.
+	version int
+	refs    []advertisedRef
+	caps    []string
+}
+
+func (a *refAdvertisement) capability(name string) (string, bool) {
+	for _, c := range a.caps {
+		if k, v, _ := strings.Cut(c, "="); k == name {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// checkObjectFormat fails unless the server uses the repository's hash
+// algorithm. Servers that do not advertise one use SHA-1.
+func (a *refAdvertisement) checkObjectFormat() error {
+	format, ok := a.capability("object-format")
+	if !ok {
+		format = sha1Algorithm.name
+	}
+	if format != hashAlgo.name {
+		return fmt.Errorf("mismatched object format: server uses %s, repository uses %s", format, hashAlgo.name)
+	}
+	return nil
+}
+
+// readAdvertisement parses a protocol v0/v1 ref advertisement: the first
+// ref line carries the capability list after a NUL byte and annotated tags
+// are followed by their peeled "<name>^{}" value.
+func readAdvertisement(r io.Reader) (*refAdvertisement, error) {
+	pr := wireReader(r)
+	adv := &refAdvertisement{}
+
+	first := true
+	for size := 0; ; {
+		t, line, err := pr.ReadLine()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ref advertisement: %w", err)
+		}
+		if size += len(line); pr.MaxListSize > 0 && size > pr.MaxListSize {
+			return nil, fmt.Errorf("ref advertisement exceeds transfer.maxListSize of %d bytes", pr.MaxListSize)
+		}
+		if t == pktline.Flush {
+			for _, c := range adv.caps {
+				value, ok := strings.CutPrefix(c, "symref=")
+				if !ok {
+					continue
+				}
+				name, target, _ := strings.Cut(value, ":")
+				for i := range adv.refs {
+					if adv.refs[i].name == name {
+						adv.refs[i].symref = target
+					}
+				}
+			}
+			return adv, nil
+		}
+		if t != pktline.Data {
+			return nil, fmt.Errorf("unexpected %s packet in ref advertisement", t)
+		}
+		if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+			return nil, fmt.Errorf("remote error: %s", msg)
+		}
+		if first && line == "version 1" {
+			continue
+		}
+		if first && line == "version 2" {
+			adv.version = 2
+			if adv.caps, err = pr.ReadUntilFlush(); err != nil {
+				return nil, fmt.Errorf("failed to read capability advertisement: %w", err)
+			}
+			return adv, adv.checkObjectFormat()
+		}
+		if first {
+			var caps string
+			line, caps, _ = strings.Cut(line, "\x00")
+			adv.caps = strings.Fields(caps)
+			if err := adv.checkObjectFormat(); err != nil {
+				return nil, err
+			}
+			first = false
+		}
+		if strings.HasPrefix(line, "shallow ") {
+			continue
+		}
+
+		hexHash, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid ref advertisement line %q", line)
+		}
+		hash, err := parseHash(hexHash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ref advertisement line %q: %w", line, err)
+		}
+
+		if name == "capabilities^{}" {
+			continue
+		}
+		if base, ok := strings.CutSuffix(name, "^{}"); ok {
+			if n := len(adv.refs); n > 0 && adv.refs[n-1].name == base {
+				adv.refs[n-1].peeled = hash
+			}
+			continue
+		}
+		adv.refs = append(adv.refs, advertisedRef{name: name, hash: hash})
+	}
+}
+
+// sidebandReader demultiplexes a side-band stream: channel 1 carries data,
+// channel 2 progress messages and channel 3 a fatal error.
+type sidebandReader struct {
+	pr       *pktline.Reader
+	buf      []byte
+	progress io.Writer
+	// partial holds a progress message not yet terminated by \r or \n.
+	partial []byte
+}
+
+func newSidebandReader(pr *pktline.Reader) *sidebandReader {
+	return &sidebandReader{pr: pr, progress: os.Stderr}
+}
+
+// writeProgress prefixes every progress line with "remote: ", keeping the
+// carriage returns servers use to redraw counters in place.
+func (s *sidebandReader) writeProgress(data []byte) {
+	s.partial = append(s.partial, data...)
+	for {
+		i := bytes.IndexAny(s.partial, "\r\n")
+		if i == -1 {
+			return
+		}
+		fmt.Fprintf(s.progress, "remote: %s%c", s.partial[:i], s.partial[i])
+		s.partial = s.partial[i+1:]
+	}
+}
+
+func (s *sidebandReader) Read(p []byte) (int, error) {
+	for len(s.buf) == 0 {
+		t, data, err := s.pr.ReadPacket()
+		if err != nil {
+			return 0, err
+		}
+		if t == pktline.Flush {
+			return 0, io.EOF
+		}
+		if t != pktline.Data || len(data) == 0 {
+			continue
+		}
+		switch data[0] {
+		case 1:
+			s.buf = data[1:]
+		case 2:
+			s.writeProgress(data[1:])
+		case 3:
+			return 0, fmt.Errorf("remote error: %s", strings.TrimSpace(string(data[1:])))
+		default:
+			return 0, fmt.Errorf("invalid side-band channel %d", data[0])
+		}
+	}
+
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+type fetchRequest struct {
+	wants []objectID
+	haves []objectID
+	// depth limits the history fetched; zero means complete history.
+	depth   int
+	shallow map[objectID]bool
+	// filter omits matching objects from the pack, which then comes from
+	// a promisor remote.
+	filter string
+}
+
+type shallowUpdate struct {
+	shallow   []objectID
+	unshallow []objectID
+}
+
+// parseShallowUpdate reads the "shallow <hash>" and "unshallow <hash>" lines
+// a server sends in response to a depth request.
+func parseShallowUpdate(lines []string) (*shallowUpdate, error) {
+	update := &shallowUpdate{}
+	for _, line := range lines {
+		kind, hexHash, _ := strings.Cut(line, " ")
+		hash, err := parseHash(hexHash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid shallow update %q", line)
+		}
+		switch kind {
+		case "shallow":
+			update.shallow = append(update.shallow, hash)
+		case "unshallow":
+			update.unshallow = append(update.unshallow, hash)
+		default:
+			return nil, fmt.Errorf("invalid shallow update %q", line)
+		}
+	}
+	return update, nil
+}
+
+// requestCapabilities returns the subset of wanted capabilities that the
+// server advertised, followed by our object format and agent string.
+func requestCapabilities(adv *refAdvertisement, wanted ...string) []string {
+	var caps []string
+	for _, c := range wanted {
+		if _, ok := adv.capability(c); ok {
+			caps = append(caps, c)
+		}
+	}
+	if _, ok := adv.capability("object-format"); ok {
+		caps = append(caps, "object-format="+hashAlgo.name)
+	}
+	if _, ok := adv.capability("agent"); ok {
+		caps = append(caps, "agent="+userAgent)
+	}
+	return caps
+}
+
+// fetchPack runs the upload-pack negotiation for req and stores the pack
+// the server sends. All haves are sent in a single round, which works the
+// same for stateful and stateless transports.
+func fetchPack(t transport, adv *refAdvertisement, req fetchRequest) (*shallowUpdate, error) {
+	wanted := []string{"ofs-delta", "include-tag"}
+	if _, ok := adv.capability("side-band-64k"); ok {
+		wanted = append(wanted, "side-band-64k")
+	} else {
+		wanted = append(wanted, "side-band")
+	}
+	if req.depth > 0 || len(req.shallow) > 0 {
+		if _, ok := adv.capability("shallow"); !ok {
+			return nil, fmt.Errorf("server does not support shallow clients")
+		}
+		wanted = append(wanted, "shallow")
+	}
+	if req.filter != "" {
+		if _, ok := adv.capability("filter"); !ok {
+			return nil, fmt.Errorf("server does not support filters")
+		}
+		wanted = append(wanted, "filter")
+	}
+	caps := requestCapabilities(adv, wanted...)
+	if !slices.ContainsFunc(caps, func(c string) bool { return strings.HasPrefix(c, "side-band") }) {
+		return nil, fmt.Errorf("server does not support side-band")
+	}
+
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	for i, want := range req.wants {
+		if i == 0 {
+			pw.Writef("want %x %s\n", want, strings.Join(caps, " "))
+		} else {
+			pw.Writef("want %x\n", want)
+		}
+	}
+	for hash := range req.shallow {
+		pw.Writef("shallow %x\n", hash)
+	}
+	if req.depth > 0 {
+		pw.Writef("deepen %d\n", req.depth)
+	}
+	if req.filter != "" {
+		pw.Writef("filter %s\n", req.filter)
+	}
+	pw.Flush()
+	for _, have := range req.haves {
+		pw.Writef("have %x\n", have)
+	}
+	pw.WriteString("done\n")
+
+	resp, err := t.request(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	pr := wireReader(resp)
+
+	update := &shallowUpdate{}
+	if req.depth > 0 {
+		lines, err := pr.ReadUntilFlush()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read shallow update: %w", err)
+		}
+		if update, err = parseShallowUpdate(lines); err != nil {
+			return nil, err
+		}
+	}
+
+	// The server may ACK several haves before the side-band stream starts.
+	for acks := 0; ; acks++ {
+		_, data, err := pr.Peek()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read negotiation response: %w", err)
+		}
+		line := strings.TrimSuffix(string(data), "\n")
+		if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+			return nil, fmt.Errorf("remote error: %s", msg)
+		}
+		if line != "NAK" && !strings.HasPrefix(line, "ACK ") {
+			if acks == 0 {
+				return nil, fmt.Errorf("unexpected negotiation response %q", line)
+			}
+			break
+		}
+		pr.ReadPacket()
+	}
+
+	if err := receiveFetchedPack(newSidebandReader(pr), req); err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// receiveFetchedPack stores the pack sent in response to req. Filtered
+// packs are marked as promisor packs.
+func receiveFetchedPack(r io.Reader, req fetchRequest) error {
+	checksum, err := receivePack(r)
+	if err != nil {
+		return err
+	}
+	if req.filter != "" {
+		return markPromisorPack(checksum)
+	}
+	return nil
+}
+
+// collectHaves lists recent commits reachable from local refs to tell the
+// server what it does not need to send.
+func collectHaves() ([]objectID, error) {
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var tips []objectID
+	for _, hash := range refs {
+		tips = append(tips, hash)
+	}
+
+	var haves []objectID
+	err = walkCommits(tips, func(hash objectID, c *commit) error {
+		haves = append(haves, hash)
+		if len(haves) >= maxHaves {
+			return errStopWalk
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return haves, nil
+}
+
+// writeShallow applies a shallow update to .git/shallow, removing the file
+// once the history is complete.
+func writeShallow(current map[objectID]bool, update *shallowUpdate) error {
+	for _, hash := range update.shallow {
+		current[hash] = true
+	}
+	for _, hash := range update.unshallow {
+		delete(current, hash)
+	}
+
+	path := filepath.Join(commonDir, "shallow")
+	if len(current) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove shallow file: %w", err)
+		}
+		return nil
+	}
+
+	var lines []string
+	for hash := range current {
+		lines = append(lines, fmt.Sprintf("%x\n", hash))
+	}
+	sort.Strings(lines)
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "")), 0644); err != nil {
+		return fmt.Errorf("failed to write shallow file: %w", err)
+	}
+	return nil
+}
+
+type remoteConfig struct {
+	name string
+	url  string
+	// pushURL is where pushes go, from remote.<name>.pushurl or url.
+	pushURL  string
+	refspecs []refspec
+	noTags   bool
+}
+
+// rewriteURL applies the url.<base>.<key> setting with the longest value
+// that prefixes rawURL, replacing that prefix with base.
+func rewriteURL(cfg *config, rawURL, key string) (string, bool) {
+	base, prefix := "", ""
+	for _, e := range cfg.entries {
+		if e.section != "url" || e.key != key {
+			continue
+		}
+		if strings.HasPrefix(rawURL, e.value) && len(e.value) > len(prefix) {
+			base, prefix = e.subsection, e.value
+		}
+	}
+	if prefix == "" {
+		return rawURL, false
+	}
+	return base + strings.TrimPrefix(rawURL, prefix), true
+}
+
+// remoteURLs returns the fetch and push URLs for rawURL after insteadOf
+// rewriting. pushInsteadOf takes precedence for pushes but is not applied
+// to an explicit pushurl.
+func remoteURLs(cfg *config, rawURL, pushURL string) (string, string) {
+	fetchURL, _ := rewriteURL(cfg, rawURL, "insteadof")
+	if pushURL != "" {
+		pushURL, _ = rewriteURL(cfg, pushURL, "insteadof")
+		return fetchURL, pushURL
+	}
+	if rewritten, ok := rewriteURL(cfg, rawURL, "pushinsteadof"); ok {
+		return fetchURL, rewritten
+	}
+	return fetchURL, fetchURL
+}
+
+// lookupRemote resolves a configured remote by name. Anything else is
+// treated as a URL fetched without tracking refs.
+func lookupRemote(cfg *config, name string) (*remoteConfig, error) {
+	url, ok := cfg.get("remote." + name + ".url")
+	if !ok {
+		remote := &remoteConfig{refspecs: []refspec{{src: "HEAD"}}, noTags: true}
+		remote.url, remote.pushURL = remoteURLs(cfg, name, "")
+		return remote, nil
+	}
+
+	remote := &remoteConfig{name: name}
+	pushURL, _ := cfg.get("remote." + name + ".pushurl")
+	remote.url, remote.pushURL = remoteURLs(cfg, url, pushURL)
+	specs := cfg.getAll("remote." + name + ".fetch")
+	if len(specs) == 0 {
+		specs = []string{"+refs/heads/*:refs/remotes/" + name + "/*"}
+	}
+	for _, s := range specs {
+		r, err := parseRefspec(s)
+		if err != nil {
+			return nil, err
+		}
+		remote.refspecs = append(remote.refspecs, r)
+	}
+	if tagOpt, _ := cfg.get("remote." + name + ".tagOpt"); tagOpt == "--no-tags" {
+		remote.noTags = true
+	}
+	return remote, nil
+}
+
+type refUpdate struct {
+	remoteName string
+	localName  string
+	old        objectID
+	new        objectID
+	force      bool
+}
+
+// mapRefspecs pairs every advertised ref with the local ref the refspecs
+// say it should update. Refs without a destination are still returned so
+// they end up in FETCH_HEAD.
+func mapRefspecs(adv *refAdvertisement, specs []refspec) []refUpdate {
+	var updates []refUpdate
+	seen := make(map[string]bool)
+	for _, spec := range specs {
+		for _, ref := range adv.refs {
+			dst, ok := spec.match(ref.name)
+			if !ok || seen[ref.name] {
+				continue
+			}
+			seen[ref.name] = true
+			updates = append(updates, refUpdate{remoteName: ref.name, localName: dst, new: ref.hash, force: spec.force})
+		}
+	}
+	return updates
+}
+
+func describeRef(name string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/", "refs/remotes/"} {
+		if short, ok := strings.CutPrefix(name, prefix); ok {
+			return short
+		}
+	}
+	return name
+}
+
+// applyFetchedRef queues the update of a local ref after a fetch in tx and
+// returns the summary line git prints for it, or an empty string if
+// nothing changed. action prefixes the reflog message, e.g. "fetch origin".
+func applyFetchedRef(tx *refTransaction, u *refUpdate, action string) (string, error) {
+	old, err := resolveRef(u.localName)
+	if err != nil && !errors.Is(err, errRefNotFound) {
+		return "", err
+	}
+	u.old = old
+	from, to := describeRef(u.remoteName), describeRef(u.localName)
+
+	switch {
+	case err != nil:
+		kind, stored := "new ref", "ref"
+		if strings.HasPrefix(u.remoteName, "refs/heads/") {
+			kind, stored = "new branch", "head"
+		} else if strings.HasPrefix(u.remoteName, "refs/tags/") {
+			kind, stored = "new tag", "tag"
+		}
+		tx.updateFrom(u.localName, objectID{}, u.new, action+": storing "+stored)
+		return fmt.Sprintf(" * %-17s %-10s -> %s", "["+kind+"]", from, to), nil
+	case old == u.new:
+		return "", nil
+	}
+
+	if strings.HasPrefix(u.localName, "refs/tags/") && !u.force {
+		return fmt.Sprintf(" ! %-17s %-10s -> %s  (would clobber existing tag)", "[rejected]", from, to), nil
+	}
+
+	fastForward, err := isAncestor(old, u.new)
+	if err != nil {
+		return "", err
+	}
+	if !fastForward && !u.force {
+		return fmt.Sprintf(" ! %-17s %-10s -> %s  (non-fast-forward)", "[rejected]", from, to), nil
+	}
+	message := action + ": forced-update"
+	if fastForward {
+		message = action + ": fast-forward"
+	}
+	tx.updateFrom(u.localName, old, u.new, message)
+	if fastForward {
+		return fmt.Sprintf("   %-17s %-10s -> %s", shortHash(old)+".."+shortHash(u.new), from, to), nil
+	}
+	return fmt.Sprintf(" + %-17s %-10s -> %s  (forced update)", shortHash(old)+"..."+shortHash(u.new), from, to), nil
+}
+
+// writeFetchHead records the fetched refs in FETCH_HEAD. Refs matching the
+// current branch's upstream are marked for merge.
+func writeFetchHead(cfg *config, remote *remoteConfig, updates []refUpdate) error {
+	var mergeRef string
+	if branch, err := symrefTarget("HEAD"); err == nil {
+		name := strings.TrimPrefix(branch, "refs/heads/")
+		if r, _ := cfg.get("branch." + name + ".remote"); r == remote.name {
+			mergeRef, _ = cfg.get("branch." + name + ".merge")
+		}
+	}
+
+	var b strings.Builder
+	for i, u := range updates {
+		forMerge := u.remoteName == mergeRef || (remote.name == "" && i == 0)
+		marker := "not-for-merge"
+		if forMerge {
+			marker = ""
+		}
+
+		var desc string
+		switch {
+		case u.remoteName == "HEAD":
+			desc = remote.url
+		case strings.HasPrefix(u.remoteName, "refs/heads/"):
+			desc = fmt.Sprintf("branch '%s' of %s", describeRef(u.remoteName), remote.url)
+		case strings.HasPrefix(u.remoteName, "refs/tags/"):
+			desc = fmt.Sprintf("tag '%s' of %s", describeRef(u.remoteName), remote.url)
+		default:
+			desc = fmt.Sprintf("'%s' of %s", u.remoteName, remote.url)
+		}
+		fmt.Fprintf(&b, "%x\t%s\t%s\n", u.new, marker, desc)
+	}
+
+	if err := os.WriteFile(filepath.Join(gitDir, "FETCH_HEAD"), []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write FETCH_HEAD: %w", err)
+	}
+	return nil
+}
+
+func runFetch(args []string) error {
+	var positional []string
+	depth := 0
+	filter, recurse := "", ""
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--recurse-submodules":
+			recurse = "yes"
+		case strings.HasPrefix(arg, "--recurse-submodules="):
+			mode, err := parseFetchRecurse(strings.TrimPrefix(arg, "--recurse-submodules="))
+			if err != nil {
+				return err
+			}
+			recurse = mode
+		case arg == "--no-recurse-submodules":
+			recurse = "no"
+		case arg == "--depth":
+			if i+1 >= len(args) {
+				return fmt.Errorf("--depth requires a value")
+			}
+			i++
+			arg = "--depth=" + args[i]
+			fallthrough
+		case strings.HasPrefix(arg, "--depth="):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--depth="))
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid depth %q", arg)
+			}
+			depth = n
+		case strings.HasPrefix(arg, "--filter="):
+			spec, err := parseObjectFilter(strings.TrimPrefix(arg, "--filter="))
+			if err != nil {
+				return err
+			}
+			filter = spec
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	name := "origin"
+	if len(positional) > 0 {
+		name = positional[0]
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	remote, err := lookupRemote(cfg, name)
+	if err != nil {
+		return err
+	}
+	specs := remote.refspecs
+	if len(positional) > 1 {
+		specs = nil
+		for _, s := range positional[1:] {
+			r, err := parseRefspec(s)
+			if err != nil {
+				return err
+			}
+			if r.dst != "" {
+				r.dst = expandRefName(r.dst)
+			}
+			specs = append(specs, r)
+		}
+	}
+
+	if filter != "" {
+		if remote.name == "" {
+			return fmt.Errorf("--filter can only be used with a configured remote")
+		}
+		if err := registerPromisorRemote(cfg, remote.name, filter); err != nil {
+			return err
+		}
+	}
+	if recurse == "" {
+		if recurse, err = configFetchRecurse(cfg); err != nil {
+			return err
+		}
+	}
+	action := os.Getenv("GIT_REFLOG_ACTION")
+	if action == "" {
+		action = strings.Join(append([]string{"fetch"}, args...), " ")
+	}
+	before, err := listRefs()
+	if err != nil {
+		return err
+	}
+	if _, err = fetch(remote, specs, fetchOptions{depth: depth, filter: filter, action: action}); err != nil {
+		return err
+	}
+	if recurse == "no" {
+		return nil
+	}
+	after, err := listRefs()
+	if err != nil {
+		return err
+	}
+	return fetchSubmodules(before, after, recurse == "on-demand")
+}
+
+// parseFetchRecurse reads a --recurse-submodules value: "yes", "no",
+// "on-demand" or a boolean.
+func parseFetchRecurse(value string) (string, error) {
+	if value == "on-demand" {
+		return value, nil
+	}
+	b, err := parseConfigBool(value)
+	if err != nil {
+		return "", fmt.Errorf("bad recurse-submodules argument: %s", value)
+	}
+	if b {
+		return "yes", nil
+	}
+	return "no", nil
+}
+
+// configFetchRecurse returns how fetch recurses into submodules by
+// default: fetch.recurseSubmodules, else submodule.recurse, else on
+// demand.
+func configFetchRecurse(cfg *config) (string, error) {
+	if value, ok := cfg.get("fetch.recurseSubmodules"); ok {
+		return parseFetchRecurse(value)
+	}
+	if value, ok := cfg.get("submodule.recurse"); ok {
+		return parseFetchRecurse(value)
+	}
+	return "on-demand", nil
+}
+
+// fetchOptions tune a fetch. A non-empty filter requests a partial pack;
+// fetches from a promisor remote default to its filter. action begins the
+// reflog messages of the updated refs.
+type fetchOptions struct {
+	depth  int
+	filter string
+	action string
+	// clone marks the first fetch of a clone, which also asks for the
+	// remote's HEAD and neither reports the updated refs nor writes
+	// FETCH_HEAD.
+	clone bool
+	// pickSpecs, if set, replaces the refspecs once the remote's refs are
+	// known, as a single-branch clone does.
+	pickSpecs func(adv *refAdvertisement) ([]refspec, error)
+}
+
+// openUploadPack connects to the remote's upload-pack service and returns
+// its refs, listing those below prefixes for protocol v2. Bundle files
+// stand in for remotes, with no transport.
+func openUploadPack(cfg *config, url string, prefixes []string) (transport, *refAdvertisement, error) {
+	if isBundle(url) {
+		h, err := readBundleFile(url)
+		if err != nil {
+			return nil, nil, err
+		}
+		return nil, &refAdvertisement{refs: h.refs}, nil
+	}
+	version, err := cfg.getInt("protocol.version", defaultProtocolVersion)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := openTransport(url, uploadPackService, version)
+	if err != nil {
+		return nil, nil, err
+	}
+	advStream, err := t.advertisement()
+	if err != nil {
+		t.close()
+		return nil, nil, err
+	}
+	adv, err := readAdvertisement(advStream)
+	if err != nil {
+		t.close()
+		return nil, nil, err
+	}
+	if adv.version == 2 {
+		if err := lsRefs(t, adv, prefixes); err != nil {
+			t.close()
+			return nil, nil, err
+		}
+	}
+	return t, adv, nil
+}
+
+// fetch downloads the objects needed for the refs matched by specs and
+// updates the corresponding local refs. It returns the remote's refs.
+func fetch(remote *remoteConfig, specs []refspec, opts fetchOptions) (*refAdvertisement, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	prefixes := refPrefixes(specs, !remote.noTags)
+	if opts.clone {
+		prefixes = append(prefixes, "HEAD")
+	}
+	t, adv, err := openUploadPack(cfg, remote.url, prefixes)
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		defer t.close()
+	} else if opts.depth > 0 || opts.filter != "" {
+		return nil, fmt.Errorf("shallow and partial fetches are not supported from bundles")
+	}
+	if opts.pickSpecs != nil {
+		if specs, err = opts.pickSpecs(adv); err != nil {
+			return nil, err
+		}
+	}
+
+	updates := mapRefspecs(adv, specs)
+	if len(updates) == 0 && len(specs) > 0 && !strings.Contains(specs[0].src, "*") {
+		return nil, fmt.Errorf("couldn't find remote ref %s", specs[0].src)
+	}
+
+	var wants []objectID
+	wanted := make(map[objectID]bool)
+	for _, u := range updates {
+		if !wanted[u.new] && (opts.depth > 0 || !hasObject(u.new)) {
+			wanted[u.new] = true
+			wants = append(wants, u.new)
+		}
+	}
+
+	shallow, err := readShallow()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wants) > 0 && t == nil {
+		if _, err := unbundle(remote.url); err != nil {
+			return nil, err
+		}
+	} else if len(wants) > 0 {
+		haves, err := collectHaves()
+		if err != nil {
+			return nil, err
+		}
+		req := fetchRequest{
+			wants:   wants,
+			haves:   haves,
+			depth:   opts.depth,
+			shallow: shallow,
+			filter:  promisorFilter(cfg, remote, opts.filter),
+		}
+		var update *shallowUpdate
+		if adv.version == 2 {
+			update, err = fetchPackV2(t, adv, req)
+		} else {
+			update, err = fetchPack(t, adv, req)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if err := writeShallow(shallow, update); err != nil {
+			return nil, err
+		}
+		if err := fetchLFSObjects(remote.url, wants, haves); err != nil {
+			return nil, err
+		}
+	}
+
+	if !remote.noTags {
+		updated := make(map[string]bool)
+		for _, u := range updates {
+			updated[u.localName] = true
+		}
+		for _, ref := range adv.refs {
+			if !strings.HasPrefix(ref.name, "refs/tags/") || updated[ref.name] || !hasObject(ref.hash) {
+				continue
+			}
+			if _, err := resolveRef(ref.name); err == nil {
+				continue
+			}
+			updates = append(updates, refUpdate{remoteName: ref.name, localName: ref.name, new: ref.hash})
+		}
+	}
+
+	var tips []objectID
+	for _, u := range updates {
+		tips = append(tips, u.new)
+	}
+	if err := checkConnectivity(tips, shallow); err != nil {
+		return nil, fmt.Errorf("fetch is incomplete: %w", err)
+	}
+
+	// All refs are updated in one transaction, and reported once it
+	// went through.
+	tx := newRefTransaction()
+	var summary []string
+	for i := range updates {
+		if updates[i].localName == "" {
+			continue
+		}
+		if opts.clone {
+			// Refs of a new clone are all logged as the clone itself.
+			tx.update(updates[i].localName, updates[i].new, opts.action)
+			continue
+		}
+		line, err := applyFetchedRef(tx, &updates[i], opts.action)
+		if err != nil {
+			return nil, err
+		}
+		if line != "" {
+			summary = append(summary, line)
+		}
+	}
+	if err := tx.commit(); err != nil {
+		return nil, err
+	}
+	if opts.clone {
+		return adv, nil
+	}
+	fmt.Fprintf(os.Stderr, "From %s\n", remote.url)
+	for _, line := range summary {
+		fmt.Fprintln(os.Stderr, line)
+	}
+	return adv, writeFetchHead(cfg, remote, updates)
+}
@@ -0,0 +1,269 @@
+package mygit
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/git-starter-go/internal/pktline"
+)
+
+// filterDriver is what filter.<driver>.* configures for the files whose
+// filter attribute names it: commands run once per file, or a process
+// started once and asked for every file.
+type filterDriver struct {
+	name     string
+	clean    string
+	smudge   string
+	process  string
+	required bool
+}
+
+// loadFilterDriver reads the configuration of the filter driver name,
+// returning nil for one that is not configured at all.
+func loadFilterDriver(name string) (*filterDriver, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	d := &filterDriver{name: name}
+	d.clean, _ = cfg.get("filter." + name + ".clean")
+	d.smudge, _ = cfg.get("filter." + name + ".smudge")
+	d.process, _ = cfg.get("filter." + name + ".process")
+	if d.required, err = cfg.getBool("filter."+name+".required", false); err != nil {
+		return nil, err
+	}
+	if d.clean == "" && d.smudge == "" && d.process == "" && !d.required {
+		return nil, nil
+	}
+	return d, nil
+}
+
+// applyFilter runs the filter attribute's driver over data, as command
+// "clean" when storing a file and "smudge" when checking it out. A driver
+// that fails passes data through, unless it is required.
+func applyFilter(path string, data []byte, attr, command string) ([]byte, error) {
+	if attr == attrSet || attr == attrUnset || attr == attrUnspecified || attr == "" {
+		return data, nil
+	}
+	d, err := loadFilterDriver(attr)
+	if err != nil || d == nil {
+		return data, err
+	}
+
+	var out []byte
+	switch {
+	case d.process != "":
+		out, err = runFilterProcess(d, path, data, command)
+	case command == "smudge" && d.smudge != "":
+		out, err = runFilterCommand(d.smudge, path, data)
+	case command == "clean" && d.clean != "":
+		out, err = runFilterCommand(d.clean, path, data)
+	default:
+		err = fmt.Errorf("no %s command", command)
+	}
+	if err == nil {
+		return out, nil
+	}
+	if d.required {
+		return nil, fmt.Errorf("%s: %s filter '%s' failed", path, command, d.name)
+	}
+	if d.clean != "" || d.smudge != "" || d.process != "" {
+		fmt.Fprintf(os.Stderr, "error: external filter '%s' failed\n", d.name)
+	}
+	return data, nil
+}
+
+// runFilterCommand pipes data through a clean or smudge command, in which
+// %f stands for the quoted path of the file.
+func runFilterCommand(command, path string, data []byte) ([]byte, error) {
+	var b strings.Builder
+	for i := 0; i < len(command); i++ {
+		switch {
+		case command[i] == '%' && i+1 < len(command) && command[i+1] == 'f':
+			b.WriteString(sqQuote(path))
+			i++
+		case command[i] == '%' && i+1 < len(command) && command[i+1] == '%':
+			b.WriteByte('%')
+			i++
+		default:
+			b.WriteByte(command[i])
+		}
+	}
+	cmd := exec.Command("sh", "-c", b.String())
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
+
+// filterProcess is a long-running filter driver speaking the filter
+// protocol on its standard input and output. Files are filtered one at a
+// time.
+type filterProcess struct {
+	mu           sync.Mutex
+	w            *pktline.Writer
+	r            *pktline.Reader
+	capabilities map[string]bool
+	// err is set once the process failed or asked to be left alone, and
+	// reported for every file after.
+	err error
+}
+
+// filterProcesses holds the processes started so far, by command line.
+var (
+	filterProcessesMu sync.Mutex
+	filterProcesses   = make(map[string]*filterProcess)
+)
+
+// startFilterProcess starts command and goes through the handshake,
+// offering the clean and smudge capabilities.
+func startFilterProcess(command string) (*filterProcess, error) {
+	cmd := shellCommand(command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot fork to run subprocess '%s'", command)
+	}
+	p := &filterProcess{w: pktline.NewWriter(stdin), r: pktline.NewReader(stdout)}
+
+	for _, line := range []string{"git-filter-client\n", "version=2\n"} {
+		if err := p.w.WriteString(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.w.Flush(); err != nil {
+		return nil, err
+	}
+	lines, err := p.r.ReadUntilFlush()
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) < 2 || lines[0] != "git-filter-server" || lines[1] != "version=2" {
+		return nil, fmt.Errorf("unexpected line '%s', expected git-filter-server", strings.Join(lines, " "))
+	}
+
+	for _, line := range []string{"capability=clean\n", "capability=smudge\n"} {
+		if err := p.w.WriteString(line); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.w.Flush(); err != nil {
+		return nil, err
+	}
+	if lines, err = p.r.ReadUntilFlush(); err != nil {
+		return nil, err
+	}
+	p.capabilities = make(map[string]bool)
+	for _, line := range lines {
+		if name, ok := strings.CutPrefix(line, "capability="); ok {
+			p.capabilities[name] = true
+		}
+	}
+	return p, nil
+}
+
+// runFilterProcess filters data through the driver's process, starting it
+// on first use.
+func runFilterProcess(d *filterDriver, path string, data []byte, command string) ([]byte, error) {
+	filterProcessesMu.Lock()
+	p, ok := filterProcesses[d.process]
+	if !ok {
+		var err error
+		if p, err = startFilterProcess(d.process); err != nil {
+			p = &filterProcess{err: err}
+			fmt.Fprintf(os.Stderr, "error: initialization for subprocess '%s' failed\n", d.process)
+		}
+		filterProcesses[d.process] = p
+	}
+	filterProcessesMu.Unlock()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return nil, p.err
+	}
+	if !p.capabilities[command] {
+		return data, nil
+	}
+	out, status, err := p.filter(path, data, command)
+	if err != nil {
+		p.err = err
+		return nil, err
+	}
+	switch status {
+	case "success":
+		return out, nil
+	case "abort":
+		// Files after this one are passed through as they are.
+		delete(p.capabilities, command)
+	}
+	return nil, fmt.Errorf("filter process failed on %s", path)
+}
+
+// filter sends one file to the process and reads back its content and
+// the final status, which a status after the content overrides.
+func (p *filterProcess) filter(path string, data []byte, command string) ([]byte, string, error) {
+	for _, line := range []string{"command=" + command + "\n", "pathname=" + path + "\n"} {
+		if err := p.w.WriteString(line); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := p.w.Flush(); err != nil {
+		return nil, "", err
+	}
+	for len(data) > 0 {
+		n := min(len(data), pktline.MaxDataSize)
+		if _, err := p.w.Write(data[:n]); err != nil {
+			return nil, "", err
+		}
+		data = data[n:]
+	}
+	if err := p.w.Flush(); err != nil {
+		return nil, "", err
+	}
+
+	status, err := p.readStatus("")
+	if err != nil || status != "success" {
+		return nil, status, err
+	}
+	var out bytes.Buffer
+	for {
+		t, packet, err := p.r.ReadPacket()
+		if err != nil {
+			return nil, "", err
+		}
+		if t == pktline.Flush {
+			break
+		}
+		out.Write(packet)
+	}
+	if status, err = p.readStatus(status); err != nil {
+		return nil, "", err
+	}
+	return out.Bytes(), status, nil
+}
+
+// readStatus reads a list of "key=value" lines up to a flush and returns
+// the status they give, or status if they give none.
+func (p *filterProcess) readStatus(status string) (string, error) {
+	lines, err := p.r.ReadUntilFlush()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range lines {
+		if value, ok := strings.CutPrefix(line, "status="); ok {
+			status = value
+		}
+	}
+	return status, nil
+}
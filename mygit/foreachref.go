@@ -0,0 +1,543 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultRefFormat is what for-each-ref prints without --format.
+const defaultRefFormat = "%(objectname) %(objecttype)\t%(refname)"
+
+// refItem is a ref listed by for-each-ref. The object it points at is only
+// read once an atom needs it.
+type refItem struct {
+	name string
+	// symref is the ref a symbolic ref points to.
+	symref  string
+	hash    objectID
+	objType string
+	content []byte
+}
+
+func (r *refItem) object() (string, []byte, error) {
+	if r.objType == "" {
+		objType, content, err := readObject(r.hash)
+		if err != nil {
+			return "", nil, err
+		}
+		r.objType, r.content = objType, content
+	}
+	return r.objType, r.content, nil
+}
+
+// refAtomValue is an atom expanded for one ref. Dates, sizes and counts
+// also have a number, by which they sort.
+type refAtomValue struct {
+	s       string
+	num     int64
+	numeric bool
+}
+
+// refFormatPart is a piece of a parsed format: literal text, or the atom
+// to expand in its place.
+type refFormatPart struct {
+	literal string
+	atom    string
+}
+
+// identAtom splits an atom like "authoremail" into the ident it reads and
+// the part of it wanted: "", "name", "email" or "date".
+func identAtom(name string) (ident, field string, ok bool) {
+	for _, ident := range []string{"author", "committer", "tagger", "creator"} {
+		if field, ok := strings.CutPrefix(name, ident); ok {
+			switch field {
+			case "", "name", "email", "date":
+				return ident, field, true
+			}
+		}
+	}
+	return "", "", false
+}
+
+func knownRefAtom(atom string) bool {
+	name, _, _ := strings.Cut(strings.TrimPrefix(atom, "*"), ":")
+	switch name {
+	case "refname", "symref", "HEAD", "upstream", "objectname", "objecttype", "objectsize",
+		"tree", "parent", "numparent", "object", "type", "tag", "subject", "body", "contents":
+		return true
+	}
+	_, _, ok := identAtom(name)
+	return ok
+}
+
+// parseRefFormat splits a for-each-ref format into literal text and
+// %(atom) placeholders. %% stands for a percent sign and %xx for the byte
+// with that hex value.
+func parseRefFormat(format string) ([]refFormatPart, error) {
+	var parts []refFormatPart
+	var literal strings.Builder
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			literal.WriteByte(format[i])
+			continue
+		}
+		switch rest := format[i+1:]; {
+		case rest[0] == '%':
+			literal.WriteByte('%')
+			i++
+		case rest[0] == '(':
+			end := strings.IndexByte(rest, ')')
+			if end == -1 {
+				return nil, fmt.Errorf("malformed format string %s", format[i:])
+			}
+			atom := rest[1:end]
+			if !knownRefAtom(atom) {
+				name, _, _ := strings.Cut(atom, ":")
+				return nil, fmt.Errorf("unknown field name: %s", name)
+			}
+			parts = append(parts, refFormatPart{literal: literal.String()}, refFormatPart{atom: atom})
+			literal.Reset()
+			i += end + 1
+		default:
+			if len(rest) >= 2 {
+				if b, err := strconv.ParseUint(rest[:2], 16, 8); err == nil {
+					literal.WriteByte(byte(b))
+					i += 2
+					continue
+				}
+			}
+			literal.WriteByte('%')
+		}
+	}
+	return append(parts, refFormatPart{literal: literal.String()}), nil
+}
+
+// stripRefName applies the refname modifiers: short, lstrip=N and
+// rstrip=N, where a negative N keeps that many components instead of
+// removing them.
+func stripRefName(name, modifier string) (string, error) {
+	switch {
+	case modifier == "":
+		return name, nil
+	case modifier == "short":
+		return shortRefName(name), nil
+	}
+	how, value, _ := strings.Cut(modifier, "=")
+	n, err := strconv.Atoi(value)
+	if err != nil || how != "lstrip" && how != "strip" && how != "rstrip" {
+		return "", fmt.Errorf("unrecognized %%(refname) argument: %s", modifier)
+	}
+	components := strings.Split(name, "/")
+	if n < 0 {
+		n = max(len(components)+n, 0)
+	}
+	n = min(n, len(components))
+	if how == "rstrip" {
+		return strings.Join(components[:len(components)-n], "/"), nil
+	}
+	return strings.Join(components[n:], "/"), nil
+}
+
+// shortRefName shortens a ref name as far as it stays unambiguous in the
+// usual places names are looked up.
+func shortRefName(name string) string {
+	if remote, ok := strings.CutPrefix(name, "refs/remotes/"); ok {
+		if remote, ok := strings.CutSuffix(remote, "/HEAD"); ok {
+			return remote
+		}
+	}
+	if short := describeRef(name); short != name {
+		return short
+	}
+	return strings.TrimPrefix(name, "refs/")
+}
+
+// messageBody returns what follows the subject paragraph of a message.
+func messageBody(message string) string {
+	message = strings.TrimLeft(message, "\n")
+	_, body, _ := strings.Cut(message, "\n\n")
+	return strings.TrimLeft(body, "\n")
+}
+
+// refFormatter expands atoms for the refs for-each-ref lists.
+type refFormatter struct {
+	cfg *config
+	// head is the branch HEAD points to.
+	head string
+	now  time.Time
+}
+
+func (f *refFormatter) atom(r *refItem, atom string) (refAtomValue, error) {
+	// A leading * reads the object an annotated tag points to instead.
+	if atom, ok := strings.CutPrefix(atom, "*"); ok {
+		objType, content, err := r.object()
+		if err != nil || objType != tagObject {
+			return refAtomValue{}, err
+		}
+		t, err := parseTag(content)
+		if err != nil {
+			return refAtomValue{}, fmt.Errorf("corrupt tag %x: %w", r.hash, err)
+		}
+		return f.atom(&refItem{name: r.name, hash: t.object}, atom)
+	}
+	text := func(s string) (refAtomValue, error) {
+		return refAtomValue{s: s}, nil
+	}
+	number := func(n int64) (refAtomValue, error) {
+		return refAtomValue{s: strconv.FormatInt(n, 10), num: n, numeric: true}, nil
+	}
+
+	name, modifier, _ := strings.Cut(atom, ":")
+	switch name {
+	case "refname":
+		s, err := stripRefName(r.name, modifier)
+		return refAtomValue{s: s}, err
+	case "symref":
+		if r.symref == "" {
+			return text("")
+		}
+		s, err := stripRefName(r.symref, modifier)
+		return refAtomValue{s: s}, err
+	case "HEAD":
+		if r.name == f.head {
+			return text("*")
+		}
+		return text(" ")
+	case "upstream":
+		return f.upstream(r, modifier)
+	case "objectname":
+		switch {
+		case modifier == "":
+			return text(r.hash.String())
+		case modifier == "short":
+			return text(shortHash(r.hash))
+		case strings.HasPrefix(modifier, "short="):
+			n, err := strconv.Atoi(strings.TrimPrefix(modifier, "short="))
+			if err != nil || n < 0 {
+				return refAtomValue{}, fmt.Errorf("positive value expected '%s' in %%(objectname)", modifier)
+			}
+			return text(r.hash.String()[:min(max(n, minAbbrev), hashAlgo.size*2)])
+		}
+		return refAtomValue{}, fmt.Errorf("unrecognized %%(objectname) argument: %s", modifier)
+	}
+
+	objType, content, err := r.object()
+	if err != nil {
+		return refAtomValue{}, err
+	}
+	var c *commit
+	var t *tag
+	switch objType {
+	case commitObject:
+		if c, err = parseCommit(content); err != nil {
+			return refAtomValue{}, fmt.Errorf("corrupt commit %x: %w", r.hash, err)
+		}
+	case tagObject:
+		if t, err = parseTag(content); err != nil {
+			return refAtomValue{}, fmt.Errorf("corrupt tag %x: %w", r.hash, err)
+		}
+	}
+	message := ""
+	if c != nil {
+		message = c.message
+	} else if t != nil {
+		message = t.message
+	}
+
+	switch name {
+	case "objecttype":
+		return text(objType)
+	case "objectsize":
+		return number(int64(len(content)))
+	case "tree":
+		if c == nil {
+			return text("")
+		}
+		return text(c.tree.String())
+	case "parent":
+		if c == nil {
+			return text("")
+		}
+		parents := make([]string, len(c.parents))
+		for i, p := range c.parents {
+			parents[i] = p.String()
+		}
+		return text(strings.Join(parents, " "))
+	case "numparent":
+		if c == nil {
+			return text("")
+		}
+		return number(int64(len(c.parents)))
+	case "object":
+		if t == nil {
+			return text("")
+		}
+		return text(t.object.String())
+	case "type":
+		if t == nil {
+			return text("")
+		}
+		return text(t.objType)
+	case "tag":
+		if t == nil {
+			return text("")
+		}
+		return text(t.name)
+	case "subject":
+		return text(commitSubject(message))
+	case "body":
+		return text(messageBody(message))
+	case "contents":
+		switch modifier {
+		case "":
+			return text(message)
+		case "subject":
+			return text(commitSubject(message))
+		case "body":
+			return text(messageBody(message))
+		}
+		return refAtomValue{}, fmt.Errorf("unrecognized %%(contents) argument: %s", modifier)
+	}
+
+	ident, field, _ := identAtom(name)
+	line := ""
+	switch {
+	case c != nil && ident == "author":
+		line = c.author
+	case c != nil && (ident == "committer" || ident == "creator"):
+		line = c.committer
+	case t != nil && (ident == "tagger" || ident == "creator"):
+		line = t.tagger
+	}
+	if line == "" {
+		return text("")
+	}
+	identName, email, when := parseIdent(line)
+	switch field {
+	case "name":
+		return text(identName)
+	case "email":
+		return text("<" + email + ">")
+	case "date":
+		mode, err := parseDateMode(modifier)
+		if modifier == "" {
+			mode, err = dateMode{}, nil
+		}
+		if err != nil {
+			return refAtomValue{}, err
+		}
+		return refAtomValue{s: formatDate(when, mode, f.now), num: when.Unix(), numeric: true}, nil
+	}
+	return text(line)
+}
+
+// upstream expands %(upstream), the ref a branch tracks, or with the track
+// modifiers how the branch compares to it.
+func (f *refFormatter) upstream(r *refItem, modifier string) (refAtomValue, error) {
+	track := strings.HasPrefix(modifier, "track")
+	info, err := branchTracking(f.cfg, r.name, r.hash, track)
+	if err != nil || info.upstream == "" {
+		return refAtomValue{}, err
+	}
+	switch modifier {
+	case "track", "track,nobracket":
+		var s string
+		switch {
+		case info.gone:
+			s = "gone"
+		case info.ahead > 0 && info.behind > 0:
+			s = fmt.Sprintf("ahead %d, behind %d", info.ahead, info.behind)
+		case info.ahead > 0:
+			s = fmt.Sprintf("ahead %d", info.ahead)
+		case info.behind > 0:
+			s = fmt.Sprintf("behind %d", info.behind)
+		}
+		if s != "" && modifier == "track" {
+			s = "[" + s + "]"
+		}
+		return refAtomValue{s: s}, nil
+	case "trackshort":
+		var s string
+		switch {
+		case info.gone:
+		case info.ahead > 0 && info.behind > 0:
+			s = "<>"
+		case info.ahead > 0:
+			s = ">"
+		case info.behind > 0:
+			s = "<"
+		default:
+			s = "="
+		}
+		return refAtomValue{s: s}, nil
+	}
+	s, err := stripRefName(info.upstream, modifier)
+	return refAtomValue{s: s}, err
+}
+
+// refPatternMatches tells whether a for-each-ref pattern selects ref:
+// literally, matching it whole or up to a slash, or as a wildcard.
+func refPatternMatches(ref string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if rest, ok := strings.CutPrefix(ref, p); ok && (rest == "" || strings.HasSuffix(p, "/") || rest[0] == '/') {
+			return true
+		}
+		if wildmatch(p, ref, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// refSortKey is a --sort key: an atom, compared in reverse when the key
+// starts with "-".
+type refSortKey struct {
+	atom    string
+	reverse bool
+}
+
+func runForEachRef(args []string) error {
+	format := defaultRefFormat
+	var sortKeys []refSortKey
+	var patterns []string
+	count := 0
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		// Options taking a value are handled in their --opt=value form.
+		if (arg == "--format" || arg == "--sort" || arg == "--count") && i+1 < len(args) {
+			i++
+			arg += "=" + args[i]
+		}
+		switch {
+		case strings.HasPrefix(arg, "--format="):
+			format = strings.TrimPrefix(arg, "--format=")
+		case strings.HasPrefix(arg, "--sort="):
+			atom, reverse := strings.CutPrefix(strings.TrimPrefix(arg, "--sort="), "-")
+			if !knownRefAtom(atom) {
+				name, _, _ := strings.Cut(atom, ":")
+				return fmt.Errorf("unknown field name: %s", name)
+			}
+			sortKeys = append(sortKeys, refSortKey{atom: atom, reverse: reverse})
+		case strings.HasPrefix(arg, "--count="):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--count="))
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid --count argument: `%s'", strings.TrimPrefix(arg, "--count="))
+			}
+			count = n
+		case arg == "--format" || arg == "--sort" || arg == "--count":
+			return fmt.Errorf("%s requires a value", arg)
+		case arg == "--":
+			patterns = append(patterns, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			patterns = append(patterns, arg)
+		}
+	}
+	parts, err := parseRefFormat(format)
+	if err != nil {
+		return err
+	}
+	if len(sortKeys) == 0 {
+		sortKeys = []refSortKey{{atom: "refname"}}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	f := &refFormatter{cfg: cfg, now: time.Now()}
+	if f.head, err = symrefTarget("HEAD"); err != nil {
+		return err
+	}
+	values, err := refStore().refs()
+	if err != nil {
+		return err
+	}
+	var items []*refItem
+	for name, value := range values {
+		if !refPatternMatches(name, patterns) {
+			continue
+		}
+		item := &refItem{name: name, symref: value.symref, hash: value.hash}
+		if value.symref != "" {
+			// Dangling symbolic refs are left out.
+			hash, err := resolveRef(name)
+			if errors.Is(err, errRefNotFound) {
+				continue
+			} else if err != nil {
+				return err
+			}
+			item.hash = hash
+		}
+		items = append(items, item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+
+	// The last key given sorts first; refs that tie on every key stay in
+	// name order.
+	keys := make([][]refAtomValue, len(items))
+	for i, item := range items {
+		keys[i] = make([]refAtomValue, len(sortKeys))
+		for k, key := range sortKeys {
+			if keys[i][k], err = f.atom(item, key.atom); err != nil {
+				return err
+			}
+		}
+	}
+	order := make([]int, len(items))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		for k := len(sortKeys) - 1; k >= 0; k-- {
+			x, y := keys[order[a]][k], keys[order[b]][k]
+			cmp := 0
+			switch {
+			case x.numeric && y.numeric && x.num != y.num:
+				cmp = 1
+				if x.num < y.num {
+					cmp = -1
+				}
+			case !(x.numeric && y.numeric):
+				cmp = strings.Compare(x.s, y.s)
+			}
+			if sortKeys[k].reverse {
+				cmp = -cmp
+			}
+			if cmp != 0 {
+				return cmp < 0
+			}
+		}
+		return false
+	})
+	if count > 0 && count < len(order) {
+		order = order[:count]
+	}
+
+	var b strings.Builder
+	for _, i := range order {
+		b.Reset()
+		for _, part := range parts {
+			if part.atom == "" {
+				b.WriteString(part.literal)
+				continue
+			}
+			value, err := f.atom(items[i], part.atom)
+			if err != nil {
+				return err
+			}
+			b.WriteString(value.s)
+		}
+		fmt.Println(b.String())
+	}
+	return nil
+}
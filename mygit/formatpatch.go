@@ -0,0 +1,371 @@
+package mygit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// mailWrap is the width email headers are folded at.
+	mailWrap = 78
+	// mailStatWidth is the width of the diffstat of a patch.
+	mailStatWidth = 72
+	// maxPatchNameLen bounds the names of patch files, suffix included.
+	maxPatchNameLen = 64
+	// mboxFromLine starts every message; the date is the fixed one git
+	// uses so that mail tools can tell patches from other mail.
+	mboxFromLine = "From %s Mon Sep 17 00:00:00 2001\n"
+)
+
+// emailSubject splits a commit message into the subject of its email, the
+// first paragraph joined into one line, and the rest as its body.
+func emailSubject(message string) (string, string) {
+	message = strings.TrimLeft(message, "\n")
+	var lines []string
+	rest := message
+	for rest != "" {
+		line, after, _ := strings.Cut(rest, "\n")
+		if strings.TrimSpace(line) == "" {
+			break
+		}
+		lines = append(lines, strings.TrimRight(line, " \t"))
+		rest = after
+	}
+	body := strings.TrimRight(strings.TrimLeft(rest, "\n"), "\n")
+	return strings.Join(lines, " "), body
+}
+
+// isASCII reports whether s is plain ASCII.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+// needsRFC2047 reports whether a header value must be encoded.
+func needsRFC2047(s string) bool {
+	return !isASCII(s) || strings.Contains(s, "=?")
+}
+
+// rfc2047Encode writes s as RFC 2047 quoted-printable encoded words,
+// folding lines that would grow past 76 characters. col is where on its
+// line s starts; addresses encode more characters than subjects.
+func rfc2047Encode(s string, col int, address bool) string {
+	const maxEncodedLen = 76
+	var b strings.Builder
+	b.WriteString("=?UTF-8?q?")
+	col += len("UTF-8") + 5
+	for _, r := range s {
+		char := string(r)
+		special := len(char) > 1 || r <= ' ' || r == 0x7f || strings.ContainsRune("=?_", r) ||
+			address && !(isAlnum(byte(r)) || strings.ContainsRune("!*+-/", r))
+		encoded := char
+		if special {
+			encoded = ""
+			for i := 0; i < len(char); i++ {
+				encoded += fmt.Sprintf("=%02X", char[i])
+			}
+		}
+		if col+len(encoded)+2 > maxEncodedLen {
+			// Encoded characters are never split across lines.
+			b.WriteString("?=\n =?UTF-8?q?")
+			col = len("UTF-8") + 5 + 1
+		}
+		b.WriteString(encoded)
+		col += len(encoded)
+	}
+	b.WriteString("?=")
+	return b.String()
+}
+
+func isAlnum(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// foldHeader wraps a header value at spaces so that its lines stay within
+// mailWrap columns, col being where on its line the value starts.
+// Continuation lines are indented by one space.
+func foldHeader(s string, col int) string {
+	var b strings.Builder
+	for i, word := range strings.Split(s, " ") {
+		if i > 0 {
+			if col+1+len(word) > mailWrap {
+				b.WriteString("\n")
+				col = 0
+			}
+			b.WriteByte(' ')
+			col++
+		}
+		b.WriteString(word)
+		col += len(word)
+	}
+	return b.String()
+}
+
+// emailAddress formats the From header value of an identity, encoding or
+// quoting the name as mail needs it.
+func emailAddress(name, email string) string {
+	switch {
+	case needsRFC2047(name):
+		name = rfc2047Encode(name, len("From: "), true)
+	case strings.ContainsAny(name, "()<>@,;:\\\".[]"):
+		name = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(name) + `"`
+	}
+	return fmt.Sprintf("%s <%s>", name, email)
+}
+
+// patchFileName names the file of the nth patch after its subject, with
+// runs of characters other than letters, digits, dots and underscores
+// turned into dashes.
+func patchFileName(n int, subject string) string {
+	name := fmt.Sprintf("%04d-", n)
+	start := len(name)
+	dash := false
+	for i := 0; i < len(subject); i++ {
+		c := subject[i]
+		if !isAlnum(c) && c != '.' && c != '_' {
+			dash = len(name) > start
+			continue
+		}
+		if dash {
+			name += "-"
+			dash = false
+		}
+		name += string(c)
+		// Runs of dots are kept to one.
+		for c == '.' && i+1 < len(subject) && subject[i+1] == '.' {
+			i++
+		}
+	}
+	name = name[:start] + strings.TrimRight(name[start:], ".-")
+	suffix := ".patch"
+	if maxLen := maxPatchNameLen - len(suffix) - 1; len(name) > maxLen {
+		name = name[:maxLen]
+	}
+	return name + suffix
+}
+
+// patchOptions control how format-patch writes each patch.
+type patchOptions struct {
+	prefix    string
+	numbered  bool
+	signature string
+	diff      *diffOptions
+	now       time.Time
+}
+
+// writeEmailPatch prints a commit as the mail of patch n out of total:
+// the headers, the message, a diffstat and the patch.
+func writeEmailPatch(w io.Writer, hash objectID, c *commit, pairs []diffPair, n, total int, opts *patchOptions) error {
+	fmt.Fprintf(w, mboxFromLine, hash)
+	name, email, when := parseIdent(c.author)
+	fmt.Fprintf(w, "From: %s\n", emailAddress(name, email))
+	fmt.Fprintf(w, "Date: %s\n", formatDate(when, dateMode{style: dateRFC}, opts.now))
+
+	prefix := "[" + opts.prefix + "] "
+	if opts.numbered {
+		prefix = fmt.Sprintf("[%s %d/%d] ", opts.prefix, n, total)
+	}
+	header := "Subject: " + prefix
+	subject, body := emailSubject(c.message)
+	if needsRFC2047(subject) {
+		fmt.Fprintf(w, "%s%s\n", header, rfc2047Encode(subject, len(header), false))
+	} else {
+		fmt.Fprintf(w, "%s%s\n", header, foldHeader(subject, len(header)))
+	}
+	if !isASCII(subject) || !isASCII(body) {
+		fmt.Fprint(w, "MIME-Version: 1.0\nContent-Type: text/plain; charset=UTF-8\nContent-Transfer-Encoding: 8bit\n")
+	}
+	fmt.Fprintln(w)
+	if body != "" {
+		fmt.Fprintln(w, body)
+	}
+	fmt.Fprintln(w, "---")
+
+	stats, err := diffStats(pairs, opts.diff)
+	if err != nil {
+		return err
+	}
+	writeStat(w, stats, opts.diff)
+	writeSummary(w, pairs, opts.diff)
+	fmt.Fprintln(w)
+	for _, p := range pairs {
+		if err := writePatch(w, p, opts.diff); err != nil {
+			return err
+		}
+	}
+	if opts.signature != "" {
+		fmt.Fprintf(w, "-- \n%s\n\n", opts.signature)
+	}
+	return nil
+}
+
+func runFormatPatch(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	diff, err := configDiffOptions(cfg)
+	if err != nil {
+		return err
+	}
+	diff.statWidth = mailStatWidth
+	opts := patchOptions{prefix: "PATCH", signature: userAgent, diff: diff, now: time.Now()}
+
+	var revs []string
+	var outDir string
+	stdout, root := false, false
+	numbered, noNumbered := false, false
+	maxCount := -1
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-o" || arg == "--output-directory":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			outDir = args[i]
+		case strings.HasPrefix(arg, "--output-directory="):
+			outDir = strings.TrimPrefix(arg, "--output-directory=")
+		case arg == "--stdout":
+			stdout = true
+		case arg == "--root":
+			root = true
+		case arg == "-n" || arg == "--numbered":
+			numbered, noNumbered = true, false
+		case arg == "-N" || arg == "--no-numbered":
+			numbered, noNumbered = false, true
+		case strings.HasPrefix(arg, "--subject-prefix="):
+			opts.prefix = strings.TrimPrefix(arg, "--subject-prefix=")
+		case arg == "--no-signature":
+			opts.signature = ""
+		case strings.HasPrefix(arg, "--signature="):
+			opts.signature = strings.TrimPrefix(arg, "--signature=")
+		case len(arg) > 1 && arg[0] == '-' && isDigits(arg[1:]):
+			maxCount, _ = strconv.Atoi(arg[1:])
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			revs = append(revs, arg)
+		}
+	}
+	if stdout && outDir != "" {
+		return fmt.Errorf("options '--stdout' and '--output-directory' cannot be used together")
+	}
+	switch {
+	case len(revs) == 0:
+		if maxCount < 0 && !root {
+			return fmt.Errorf("usage: mygit format-patch [<options>] [<since> | <revision-range>]")
+		}
+		revs = []string{"HEAD"}
+	case len(revs) == 1 && maxCount < 0 && !root && !strings.Contains(revs[0], ".."):
+		// A single revision stands for what HEAD has on top of it.
+		revs[0] += "..HEAD"
+	}
+
+	include, exclude, err := parseRevisionArgs(revs)
+	if err != nil {
+		return err
+	}
+	excluded := make(map[objectID]bool)
+	err = walkCommits(exclude, func(hash objectID, c *commit) error {
+		excluded[hash] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Merges make no patch. Commits that change nothing make none either,
+	// but like in git they still count.
+	type patch struct {
+		hash  objectID
+		c     *commit
+		pairs []diffPair
+	}
+	var patches []patch
+	err = walkCommits(include, func(hash objectID, c *commit) error {
+		if excluded[hash] || len(c.parents) > 1 {
+			return nil
+		}
+		if maxCount >= 0 && len(patches) >= maxCount {
+			return errStopWalk
+		}
+		old := map[string]diffEntry{}
+		if len(c.parents) == 1 {
+			var err error
+			if old, err = commitFiles(c.parents[0]); err != nil {
+				return err
+			}
+		}
+		files := make(map[string]diffEntry)
+		if err := treeFiles(c.tree, "", files); err != nil {
+			return err
+		}
+		patches = append(patches, patch{hash, c, diffFiles(old, files, nil, nil)})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	opts.numbered = numbered || len(patches) > 1 && !noNumbered
+
+	if outDir != "" {
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			return fmt.Errorf("failed to create output directory: %w", err)
+		}
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	// Patches go out oldest first.
+	wrote := false
+	for i := range patches {
+		p := patches[len(patches)-1-i]
+		n := i + 1
+		if len(p.pairs) == 0 {
+			continue
+		}
+		if stdout {
+			if wrote {
+				fmt.Fprintln(out)
+			}
+			if err := writeEmailPatch(out, p.hash, p.c, p.pairs, n, len(patches), &opts); err != nil {
+				return err
+			}
+			wrote = true
+			continue
+		}
+
+		subject, _ := emailSubject(p.c.message)
+		name := patchFileName(n, subject)
+		if outDir != "" {
+			name = filepath.Join(outDir, name)
+		}
+		f, err := os.Create(name)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", name, err)
+		}
+		w := bufio.NewWriter(f)
+		err = writeEmailPatch(w, p.hash, p.c, p.pairs, n, len(patches), &opts)
+		if err == nil {
+			err = w.Flush()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		fmt.Fprintln(out, name)
+	}
+	return nil
+}
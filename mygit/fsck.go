@@ -0,0 +1,559 @@
+package mygit
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// fsckLink is a reference from one object to another together with the
+// type the referring object expects it to have.
+type fsckLink struct {
+	hash    objectID
+	objType string
+}
+
+type fsckObject struct {
+	objType string
+	links   []fsckLink
+	// promisor is set for objects from promisor packs, whose links may
+	// point at objects that were never downloaded.
+	promisor bool
+}
+
+type fsckChecker struct {
+	objects map[objectID]*fsckObject
+	// used marks objects that another object refers to.
+	used   map[objectID]bool
+	errors int
+}
+
+func (f *fsckChecker) errorf(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+	f.errors++
+}
+
+// report prints a problem found in an object's content, using git's
+// camelCase message IDs. Warnings do not make fsck fail.
+func (f *fsckChecker) report(warning bool, objType string, hash objectID, id, msg string) {
+	if warning {
+		fmt.Fprintf(os.Stderr, "warning in %s %x: %s: %s\n", objType, hash, id, msg)
+		return
+	}
+	fmt.Fprintf(os.Stderr, "error in %s %x: %s: %s\n", objType, hash, id, msg)
+	f.errors++
+}
+
+// checkLoose re-reads a loose object from disk and verifies that its
+// header is well-formed and that its content hashes to its name.
+func (f *fsckChecker) checkLoose(hash objectID) {
+	path := objectPath(hash)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		f.errorf("%x: object corrupt or missing: %s", hash, path)
+		return
+	}
+	br := bytes.NewReader(data)
+	r, err := zlib.NewReader(br)
+	if err != nil {
+		f.errorf("%x: object corrupt or missing: %s", hash, path)
+		return
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		f.errorf("inflate: %v", err)
+		f.errorf("%x: object corrupt or missing: %s", hash, path)
+		return
+	}
+	if br.Len() > 0 {
+		f.errorf("garbage at end of loose object '%x'", hash)
+		f.errorf("%x: object corrupt or missing: %s", hash, path)
+		return
+	}
+	objType, content, err := parseObjectHeader(raw)
+	if err != nil {
+		f.errorf("unable to unpack header of %s", path)
+		f.errorf("%x: object corrupt or missing: %s", hash, path)
+		return
+	}
+	f.checkObject(hash, objType, content, false)
+}
+
+// checkPack verifies the pack and index checksums and re-hashes every
+// object in the pack.
+func (f *fsckChecker) checkPack(p *pack) {
+	size := hashAlgo.size
+	file, done, err := p.use()
+	if err != nil {
+		f.errorf("%s: unable to read pack", p.path)
+		return
+	}
+	defer done()
+	fi, err := file.Stat()
+	if err != nil || fi.Size() < int64(12+size) {
+		f.errorf("%s: unable to read pack", p.path)
+		return
+	}
+	sum := hashAlgo.new()
+	if _, err := io.Copy(sum, io.NewSectionReader(file, 0, fi.Size()-int64(size))); err != nil {
+		f.errorf("%s: unable to read pack: %v", p.path, err)
+		return
+	}
+	trailer := make([]byte, size)
+	if _, err := file.ReadAt(trailer, fi.Size()-int64(size)); err != nil {
+		f.errorf("%s: unable to read pack: %v", p.path, err)
+		return
+	}
+	if !bytes.Equal(sum.Sum(nil), trailer) {
+		f.errorf("%s: pack checksum mismatch", p.path)
+		return
+	}
+
+	idx := p.idx.data
+	sum = hashAlgo.new()
+	sum.Write(idx[:len(idx)-size])
+	if !bytes.Equal(sum.Sum(nil), idx[len(idx)-size:]) {
+		f.errorf("%s: index checksum mismatch", p.path)
+		return
+	}
+	if !bytes.Equal(idx[len(idx)-2*size:len(idx)-size], trailer) {
+		f.errorf("%s: packfile does not match index", p.path)
+		return
+	}
+
+	for i := 0; i < p.idx.count; i++ {
+		hash := p.idx.hashAt(i)
+		obj, err := p.readAt(p.idx.offsetAt(i))
+		if err != nil {
+			f.errorf("%x: object corrupt or missing: %v", hash, err)
+			continue
+		}
+		f.checkObject(hash, obj.objType, obj.data, p.promisor)
+	}
+}
+
+// checkObject verifies an object's hash and the syntax of its content and
+// records the objects it links to.
+func (f *fsckChecker) checkObject(hash objectID, objType string, content []byte, promisor bool) {
+	if got := hashObjectData(objType, content); got != hash {
+		f.errorf("hash mismatch for %x (got %x)", hash, got)
+		return
+	}
+	if _, ok := f.objects[hash]; ok {
+		return
+	}
+
+	obj := &fsckObject{objType: objType, promisor: promisor}
+	switch objType {
+	case blobObject:
+	case treeObject:
+		obj.links = f.checkTree(hash, content)
+	case commitObject:
+		obj.links = f.checkCommit(hash, content)
+	case tagObject:
+		obj.links = f.checkTag(hash, content)
+	default:
+		f.errorf("%x: object is of unknown type '%s'", hash, objType)
+		return
+	}
+	f.objects[hash] = obj
+	for _, l := range obj.links {
+		f.used[l.hash] = true
+	}
+}
+
+// treeSortKey orders tree entries the way git does, as if directory names
+// ended in a slash.
+func treeSortKey(name, mode string) string {
+	if mode == "40000" {
+		return name + "/"
+	}
+	return name
+}
+
+func (f *fsckChecker) checkTree(hash objectID, content []byte) []fsckLink {
+	var links []fsckLink
+	var fullPathname, emptyName, hasDot, hasDotdot, hasDotgit, zeroPadded, nullHash, duplicates, unsorted bool
+	var prevName, prevKey string
+	for first := true; len(content) > 0; first = false {
+		nullIndex := bytes.IndexByte(content, 0)
+		if nullIndex == -1 || len(content) < nullIndex+1+hashAlgo.size {
+			f.report(false, treeObject, hash, "badTree", "cannot be parsed as a tree")
+			return nil
+		}
+		mode, name, ok := strings.Cut(string(content[:nullIndex]), " ")
+		if !ok || mode == "" {
+			f.report(false, treeObject, hash, "badTree", "cannot be parsed as a tree")
+			return nil
+		}
+		entryHash := objectIDFromBytes(content[nullIndex+1:])
+		content = content[nullIndex+1+hashAlgo.size:]
+
+		zeroPadded = zeroPadded || mode[0] == '0'
+		mode = strings.TrimLeft(mode, "0")
+		fullPathname = fullPathname || strings.Contains(name, "/")
+		emptyName = emptyName || name == ""
+		hasDot = hasDot || name == "."
+		hasDotdot = hasDotdot || name == ".."
+		hasDotgit = hasDotgit || strings.EqualFold(name, ".git")
+		nullHash = nullHash || entryHash == objectID{}
+
+		key := treeSortKey(name, mode)
+		if !first {
+			if name == prevName {
+				duplicates = true
+			} else if prevKey > key {
+				unsorted = true
+			}
+		}
+		prevName, prevKey = name, key
+
+		switch mode {
+		case gitlinkMode:
+		case "40000":
+			links = append(links, fsckLink{hash: entryHash, objType: treeObject})
+		default:
+			links = append(links, fsckLink{hash: entryHash, objType: blobObject})
+		}
+	}
+
+	for _, c := range []struct {
+		set     bool
+		warning bool
+		id, msg string
+	}{
+		{nullHash, true, "nullSha1", "contains entries pointing to null sha1"},
+		{fullPathname, true, "fullPathname", "contains full pathnames"},
+		{emptyName, true, "emptyName", "contains empty pathname"},
+		{hasDot, true, "hasDot", "contains '.'"},
+		{hasDotdot, true, "hasDotdot", "contains '..'"},
+		{hasDotgit, true, "hasDotgit", "contains '.git'"},
+		{zeroPadded, true, "zeroPaddedFilemode", "contains zero-padded file modes"},
+		{duplicates, false, "duplicateEntries", "contains duplicate file entries"},
+		{unsorted, false, "treeNotSorted", "not properly sorted"},
+	} {
+		if c.set {
+			f.report(c.warning, treeObject, hash, c.id, c.msg)
+		}
+	}
+	return links
+}
+
+// headerLines splits an object's header from its message, reporting a NUL
+// inside the header.
+func (f *fsckChecker) headerLines(objType string, hash objectID, content []byte) ([]string, bool) {
+	headers, _, _ := bytes.Cut(content, []byte("\n\n"))
+	if i := bytes.IndexByte(headers, 0); i >= 0 {
+		f.report(false, objType, hash, "nulInHeader", fmt.Sprintf("unterminated header: NUL at offset %d", i))
+		return nil, false
+	}
+	return strings.Split(string(headers), "\n"), true
+}
+
+func (f *fsckChecker) checkCommit(hash objectID, content []byte) []fsckLink {
+	lines, ok := f.headerLines(commitObject, hash, content)
+	if !ok {
+		return nil
+	}
+	fail := func(id, msg string) []fsckLink {
+		f.report(false, commitObject, hash, id, msg)
+		return nil
+	}
+
+	value, ok := strings.CutPrefix(lines[0], "tree ")
+	if !ok {
+		return fail("missingTree", "invalid format - expected 'tree' line")
+	}
+	tree, err := parseHash(value)
+	if err != nil {
+		return fail("badTreeSha1", "invalid 'tree' line format - bad sha1")
+	}
+	links := []fsckLink{{hash: tree, objType: treeObject}}
+	lines = lines[1:]
+
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "parent ") {
+		parent, err := parseHash(strings.TrimPrefix(lines[0], "parent "))
+		if err != nil {
+			return fail("badParentSha1", "invalid 'parent' line format - bad sha1")
+		}
+		links = append(links, fsckLink{hash: parent, objType: commitObject})
+		lines = lines[1:]
+	}
+
+	authors := 0
+	for len(lines) > 0 && strings.HasPrefix(lines[0], "author ") {
+		if id, msg := checkIdent(strings.TrimPrefix(lines[0], "author ")); id != "" {
+			return fail(id, msg)
+		}
+		authors++
+		lines = lines[1:]
+	}
+	switch {
+	case authors == 0:
+		return fail("missingAuthor", "invalid format - expected 'author' line")
+	case authors > 1:
+		return fail("multipleAuthors", "invalid format - multiple 'author' lines")
+	}
+
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "committer ") {
+		return fail("missingCommitter", "invalid format - expected 'committer' line")
+	}
+	if id, msg := checkIdent(strings.TrimPrefix(lines[0], "committer ")); id != "" {
+		return fail(id, msg)
+	}
+	return links
+}
+
+func (f *fsckChecker) checkTag(hash objectID, content []byte) []fsckLink {
+	lines, ok := f.headerLines(tagObject, hash, content)
+	if !ok {
+		return nil
+	}
+	fail := func(id, msg string) []fsckLink {
+		f.report(false, tagObject, hash, id, msg)
+		return nil
+	}
+
+	value, ok := strings.CutPrefix(lines[0], "object ")
+	if !ok {
+		return fail("missingObject", "invalid format - expected 'object' line")
+	}
+	target, err := parseHash(value)
+	if err != nil {
+		return fail("badObjectSha1", "invalid 'object' line format - bad sha1")
+	}
+
+	if len(lines) < 2 || !strings.HasPrefix(lines[1], "type ") {
+		return fail("missingTypeEntry", "invalid format - expected 'type' line")
+	}
+	targetType := strings.TrimPrefix(lines[1], "type ")
+	switch targetType {
+	case blobObject, treeObject, commitObject, tagObject:
+	default:
+		return fail("badType", "invalid 'type' value")
+	}
+
+	if len(lines) < 3 || !strings.HasPrefix(lines[2], "tag ") {
+		return fail("missingTagEntry", "invalid format - expected 'tag' line")
+	}
+	if len(lines) > 3 {
+		if value, ok := strings.CutPrefix(lines[3], "tagger "); ok {
+			if id, msg := checkIdent(value); id != "" {
+				return fail(id, msg)
+			}
+		}
+	}
+	return []fsckLink{{hash: target, objType: targetType}}
+}
+
+// checkIdent validates "Name <email> timestamp tz", returning git's message
+// ID and text for the first problem found.
+func checkIdent(ident string) (string, string) {
+	const prefix = "invalid author/committer line - "
+	if strings.HasPrefix(ident, "<") {
+		return "missingNameBeforeEmail", prefix + "missing space before email"
+	}
+	i := strings.IndexAny(ident, "<>")
+	switch {
+	case i >= 0 && ident[i] == '>':
+		return "badName", prefix + "bad name"
+	case i < 0:
+		return "missingEmail", prefix + "missing email"
+	case ident[i-1] != ' ':
+		return "missingSpaceBeforeEmail", prefix + "missing space before email"
+	}
+	rest := ident[i+1:]
+	j := strings.IndexAny(rest, "<>")
+	if j < 0 || rest[j] != '>' {
+		return "badEmail", prefix + "bad email"
+	}
+	rest, ok := strings.CutPrefix(rest[j+1:], " ")
+	if !ok {
+		return "missingSpaceBeforeDate", prefix + "missing space before date"
+	}
+
+	date, tz, ok := strings.Cut(rest, " ")
+	if len(date) > 1 && date[0] == '0' {
+		return "zeroPaddedDate", prefix + "zero-padded date"
+	}
+	if !ok || !isDigits(date) {
+		return "badDate", prefix + "bad date"
+	}
+	if _, err := strconv.ParseUint(date, 10, 64); err != nil {
+		return "badDateOverflow", prefix + "date causes integer overflow"
+	}
+	if len(tz) != 5 || (tz[0] != '+' && tz[0] != '-') || !isDigits(tz[1:]) {
+		return "badTimezone", prefix + "bad time zone"
+	}
+	return "", ""
+}
+
+// checkLinkTypes reports links to existing objects of the wrong type.
+func (f *fsckChecker) checkLinkTypes() {
+	for hash, obj := range f.objects {
+		broken := false
+		for _, l := range obj.links {
+			if target, ok := f.objects[l.hash]; ok && target.objType != l.objType {
+				f.errorf("object %x is a %s, not a %s", l.hash, target.objType, l.objType)
+				broken = true
+			}
+		}
+		if broken {
+			fmt.Fprintf(os.Stderr, "error in %s %x: broken links\n", obj.objType, hash)
+			f.errors++
+		}
+	}
+}
+
+// checkReachable marks everything reachable from roots and reports
+// links to objects that do not exist.
+func (f *fsckChecker) checkReachable(roots []objectID, shallow map[objectID]bool) map[objectID]bool {
+	reachable := make(map[objectID]bool)
+	pending := append([]objectID(nil), roots...)
+	for len(pending) > 0 {
+		hash := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if reachable[hash] {
+			continue
+		}
+		reachable[hash] = true
+
+		obj := f.objects[hash]
+		if obj == nil {
+			continue
+		}
+		for i, l := range obj.links {
+			if obj.objType == commitObject && i > 0 && shallow[hash] {
+				break
+			}
+			if _, ok := f.objects[l.hash]; !ok {
+				if obj.promisor && !hasObject(l.hash) {
+					continue
+				}
+				fmt.Printf("broken link from %7s %x\n", obj.objType, hash)
+				fmt.Printf("              to %7s %x\n", l.objType, l.hash)
+				fmt.Printf("missing %s %x\n", l.objType, l.hash)
+				f.errors++
+				reachable[l.hash] = true
+				continue
+			}
+			pending = append(pending, l.hash)
+		}
+	}
+	return reachable
+}
+
+// fsckRoots returns the objects that refs and HEAD point at, reporting
+// refs to missing objects.
+func (f *fsckChecker) fsckRoots() ([]objectID, error) {
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var roots []objectID
+	for _, name := range names {
+		if _, ok := f.objects[refs[name]]; !ok {
+			f.errorf("%s: invalid sha1 pointer %x", name, refs[name])
+			continue
+		}
+		roots = append(roots, refs[name])
+	}
+
+	head, err := resolveRef("HEAD")
+	switch {
+	case err == nil:
+		if _, ok := f.objects[head]; !ok {
+			f.errorf("HEAD: invalid sha1 pointer %x", head)
+		} else {
+			roots = append(roots, head)
+		}
+	case errors.Is(err, errRefNotFound):
+		if target, err := symrefTarget("HEAD"); err == nil && target != "HEAD" {
+			fmt.Fprintf(os.Stderr, "notice: HEAD points to an unborn branch (%s)\n", strings.TrimPrefix(target, "refs/heads/"))
+		}
+		if len(refs) == 0 {
+			fmt.Fprintln(os.Stderr, "notice: No default references")
+		}
+	default:
+		return nil, err
+	}
+	return roots, nil
+}
+
+func runFsck(args []string) error {
+	dangling, unreachable := true, false
+	for _, arg := range args {
+		switch arg {
+		case "--dangling":
+			dangling = true
+		case "--no-dangling":
+			dangling = false
+		case "--unreachable":
+			unreachable = true
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	f := &fsckChecker{objects: make(map[objectID]*fsckObject), used: make(map[objectID]bool)}
+
+	loose, err := listLooseObjects()
+	if err != nil {
+		return err
+	}
+	for _, hash := range loose {
+		f.checkLoose(hash)
+	}
+	packs, err := openPacks()
+	if err != nil {
+		return err
+	}
+	for _, p := range packs {
+		f.checkPack(p)
+	}
+
+	f.checkLinkTypes()
+
+	roots, err := f.fsckRoots()
+	if err != nil {
+		return err
+	}
+	shallow, err := readShallow()
+	if err != nil {
+		return err
+	}
+	reachable := f.checkReachable(roots, shallow)
+
+	hashes := make([]objectID, 0, len(f.objects))
+	for hash := range f.objects {
+		if !reachable[hash] {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+	for _, hash := range hashes {
+		switch {
+		case unreachable:
+			fmt.Printf("unreachable %s %x\n", f.objects[hash].objType, hash)
+		case dangling && !f.used[hash]:
+			fmt.Printf("dangling %s %x\n", f.objects[hash].objType, hash)
+		}
+	}
+
+	if f.errors > 0 {
+		return fmt.Errorf("fsck found %d errors", f.errors)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package mygit
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The kinds of files core.fsync can flush to disk.
+const (
+	fsyncLooseObject = 1 << iota
+	fsyncPack
+	fsyncPackMetadata
+	fsyncCommitGraph
+	fsyncIndex
+	fsyncReference
+)
+
+var fsyncComponents = map[string]int{
+	"none":             0,
+	"loose-object":     fsyncLooseObject,
+	"pack":             fsyncPack,
+	"pack-metadata":    fsyncPackMetadata,
+	"commit-graph":     fsyncCommitGraph,
+	"index":            fsyncIndex,
+	"reference":        fsyncReference,
+	"objects":          fsyncLooseObject | fsyncPack,
+	"derived-metadata": fsyncPackMetadata | fsyncCommitGraph,
+	"committed":        fsyncLooseObject | fsyncPack | fsyncReference,
+	"added":            fsyncLooseObject | fsyncPack | fsyncReference | fsyncIndex,
+	"all": fsyncLooseObject | fsyncPack | fsyncPackMetadata | fsyncCommitGraph |
+		fsyncIndex | fsyncReference,
+}
+
+// defaultFsyncComponents is git's default: packs and the files derived
+// from them, but not the many small loose objects.
+const defaultFsyncComponents = fsyncPack | fsyncPackMetadata | fsyncCommitGraph
+
+// fsyncSettings are core.fsync and core.fsyncMethod, read on first use.
+var fsyncSettings struct {
+	sync.Mutex
+	loaded     bool
+	components int
+	// method is "fsync", "writeout-only", which leaves flushing to the
+	// system, or "batch", which flushes the loose objects of a batch all
+	// at once.
+	method string
+}
+
+// parseFsyncComponents reads a core.fsync value: components to add to the
+// default, "-" before those to remove, and "none" to start from nothing.
+func parseFsyncComponents(value string) int {
+	current, positive, negative := defaultFsyncComponents, 0, 0
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if name == "none" {
+			current = 0
+			continue
+		}
+		name, remove := strings.CutPrefix(name, "-")
+		bits, ok := fsyncComponents[name]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "warning: ignoring unknown core.fsync component '%s'\n", name)
+			continue
+		}
+		if remove {
+			negative |= bits
+		} else {
+			positive |= bits
+		}
+	}
+	return current&^negative | positive
+}
+
+// loadFsyncSettings reads the fsync settings unless already done. A
+// config that cannot be read leaves the defaults.
+func loadFsyncSettings() (components int, method string) {
+	fsyncSettings.Lock()
+	defer fsyncSettings.Unlock()
+	if fsyncSettings.loaded {
+		return fsyncSettings.components, fsyncSettings.method
+	}
+	fsyncSettings.loaded = true
+	fsyncSettings.components, fsyncSettings.method = defaultFsyncComponents, "fsync"
+	cfg, err := loadConfig()
+	if err != nil {
+		return fsyncSettings.components, fsyncSettings.method
+	}
+	if value, ok := cfg.get("core.fsync"); ok {
+		fsyncSettings.components = parseFsyncComponents(value)
+	}
+	if legacy, err := cfg.getBool("core.fsyncObjectFiles", false); err == nil && legacy {
+		fsyncSettings.components |= fsyncLooseObject
+	}
+	if value, ok := cfg.get("core.fsyncMethod"); ok {
+		switch value {
+		case "fsync", "writeout-only", "batch":
+			fsyncSettings.method = value
+		default:
+			fmt.Fprintf(os.Stderr, "warning: ignoring unknown core.fsyncMethod value '%s'\n", value)
+		}
+	}
+	return fsyncSettings.components, fsyncSettings.method
+}
+
+// fsyncFile flushes f to disk if core.fsync covers component. Loose
+// objects written in a batch are flushed when it ends instead.
+func fsyncFile(f *os.File, component int) error {
+	components, method := loadFsyncSettings()
+	if components&component == 0 || method == "writeout-only" {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to fsync %s: %w", f.Name(), err)
+	}
+	return nil
+}
+
+// objectBatch holds the loose objects written since beginObjectBatch with
+// core.fsyncMethod=batch, by their final path. They stay in temporary
+// files until the batch ends, so that none is visible before it is on
+// disk.
+var objectBatch struct {
+	sync.Mutex
+	active  bool
+	pending map[string]string
+}
+
+// beginObjectBatch starts collecting loose objects to flush together,
+// if core.fsyncMethod asks for it and core.fsync covers loose objects.
+func beginObjectBatch() {
+	components, method := loadFsyncSettings()
+	if method != "batch" || components&fsyncLooseObject == 0 {
+		return
+	}
+	objectBatch.Lock()
+	defer objectBatch.Unlock()
+	objectBatch.active = true
+	objectBatch.pending = make(map[string]string)
+}
+
+// batchObject adds the loose object written to tmp to the current batch,
+// and reports false if there is none.
+func batchObject(tmp, path string) bool {
+	objectBatch.Lock()
+	defer objectBatch.Unlock()
+	if !objectBatch.active {
+		return false
+	}
+	if _, ok := objectBatch.pending[path]; ok {
+		os.Remove(tmp)
+		return true
+	}
+	objectBatch.pending[path] = tmp
+	return true
+}
+
+// endObjectBatch flushes the objects of the batch to disk with a single
+// sync and moves them into place.
+func endObjectBatch() error {
+	objectBatch.Lock()
+	pending := objectBatch.pending
+	objectBatch.active, objectBatch.pending = false, nil
+	objectBatch.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	paths := make([]string, 0, len(pending))
+	tmps := make([]string, 0, len(pending))
+	for path, tmp := range pending {
+		paths = append(paths, path)
+		tmps = append(tmps, tmp)
+	}
+	if err := syncFiles(objDir, tmps); err != nil {
+		for _, tmp := range tmps {
+			os.Remove(tmp)
+		}
+		return fmt.Errorf("failed to flush objects: %w", err)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := os.Rename(pending[path], path); err != nil {
+			return fmt.Errorf("failed to write object: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,22 @@
+//go:build !unix
+
+package mygit
+
+import "os"
+
+// syncFiles flushes files one at a time where there is no sync of the
+// whole file system.
+func syncFiles(dir string, files []string) error {
+	for _, path := range files {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
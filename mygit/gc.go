@@ -0,0 +1,496 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPackWindow       = 10
+	defaultPackDepth        = 50
+	defaultAggressiveWindow = 250
+	defaultAggressiveDepth  = 50
+	defaultPruneExpire      = "2.weeks.ago"
+)
+
+// listLooseObjects returns the hashes of every loose object.
+func listLooseObjects() ([]objectID, error) {
+	var hashes []objectID
+
+	dirs, err := os.ReadDir(objDir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read object directory: %w", err)
+	}
+
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(objDir, dir.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read object directory: %w", err)
+		}
+		for _, file := range files {
+			hash, err := parseHash(dir.Name() + file.Name())
+			if err != nil {
+				continue
+			}
+			hashes = append(hashes, hash)
+		}
+	}
+
+	return hashes, nil
+}
+
+// refTips returns the objects the HEADs of all worktrees, the refs and
+// their reflogs point at.
+func refTips() ([]objectID, error) {
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+
+	var tips []objectID
+	if head, err := resolveRef("HEAD"); err == nil {
+		tips = append(tips, head)
+	}
+	if trees, err := listWorktrees(); err == nil {
+		for _, wt := range trees {
+			if wt.head.hash != (objectID{}) {
+				tips = append(tips, wt.head.hash)
+			}
+		}
+	}
+	for _, hash := range refs {
+		tips = append(tips, hash)
+	}
+	logged, err := reflogTips()
+	if err != nil {
+		return nil, err
+	}
+	return append(tips, logged...), nil
+}
+
+// reachableNames walks everything reachable from tips and records the path
+// each tree and blob was first seen at. Pack writing uses these names to
+// find good delta candidates. Objects a promisor object references are
+// skipped when missing, as are all missing objects with ignoreMissing set.
+func reachableNames(tips []objectID, ignoreMissing bool) (map[objectID]string, error) {
+	names := make(map[objectID]string)
+	type item struct {
+		hash     objectID
+		name     string
+		promised bool
+	}
+	var pending []item
+	for _, tip := range tips {
+		pending = append(pending, item{hash: tip})
+	}
+
+	for len(pending) > 0 {
+		it := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if _, ok := names[it.hash]; ok {
+			continue
+		}
+		if (it.promised || ignoreMissing) && !hasObject(it.hash) {
+			continue
+		}
+		names[it.hash] = it.name
+
+		objType, content, err := readObject(it.hash)
+		if err != nil {
+			return nil, err
+		}
+		promised := isPromisorObject(it.hash)
+		switch objType {
+		case commitObject:
+			c, err := parseCommit(content)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, item{hash: c.tree, promised: promised})
+			for _, parent := range c.parents {
+				pending = append(pending, item{hash: parent, promised: promised})
+			}
+		case treeObject:
+			entries, err := parseTree(content)
+			if err != nil {
+				return nil, err
+			}
+			for _, entry := range entries {
+				if entry.mode == gitlinkMode {
+					continue
+				}
+				pending = append(pending, item{hash: entry.hash, name: entry.name, promised: promised})
+			}
+		case tagObject:
+			t, err := parseTag(content)
+			if err != nil {
+				return nil, err
+			}
+			pending = append(pending, item{hash: t.object, promised: promised})
+		}
+	}
+
+	return names, nil
+}
+
+// repackAll writes every loose and packed object into a single new pack.
+// With remove set it then deletes the old packs and the now redundant loose
+// objects.
+func repackAll(opts packOptions, remove, bitmaps bool) (packStats, error) {
+	tips, err := refTips()
+	if err != nil {
+		return packStats{}, err
+	}
+	names, err := reachableNames(tips, false)
+	if err != nil {
+		return packStats{}, err
+	}
+
+	loose, err := listLooseObjects()
+	if err != nil {
+		return packStats{}, err
+	}
+	packed, err := listPackedObjects()
+	if err != nil {
+		return packStats{}, err
+	}
+
+	oldPacks, err := filepath.Glob(filepath.Join(packDir, "pack-*.pack"))
+	if err != nil {
+		return packStats{}, fmt.Errorf("failed to list packs: %w", err)
+	}
+	stats, newPacks, err := packObjects(append(loose, packed...), names, opts)
+	if err != nil {
+		return packStats{}, err
+	}
+	if stats.total == 0 {
+		return stats, nil
+	}
+	if remove {
+		if err := replacePacks(oldPacks, newPacks, loose); err != nil {
+			return packStats{}, err
+		}
+	}
+	if bitmaps {
+		if err := writeRepackBitmap(newPacks, tips, names); err != nil {
+			return packStats{}, err
+		}
+	}
+	return stats, nil
+}
+
+// writeRepackBitmap writes the bitmap of the single pack a full repack
+// produced. Objects left to a promisor pack keep it from covering
+// everything the refs reach, in which case no bitmap is written.
+func writeRepackBitmap(newPacks map[string]bool, tips []objectID, names map[objectID]string) error {
+	err := errBitmapIncomplete
+	if len(newPacks) == 1 {
+		for path := range newPacks {
+			err = writePackBitmap(path, tips, names)
+		}
+	}
+	if errors.Is(err, errBitmapIncomplete) {
+		fmt.Fprintf(os.Stderr, "warning: disabling bitmap writing, as %v\n", err)
+		return nil
+	}
+	return err
+}
+
+// packObjects writes hashes, skipping duplicates, into a new pack and
+// returns the paths of the packs written. Objects from promisor packs go
+// into a separate promisor pack so that the objects they reference may stay
+// missing.
+func packObjects(hashes []objectID, names map[objectID]string, opts packOptions) (packStats, map[string]bool, error) {
+	seen := make(map[objectID]bool)
+	var regular, promised []namedObject
+	for _, hash := range hashes {
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+		o := namedObject{hash: hash, name: names[hash]}
+		if isPromisorObject(hash) {
+			promised = append(promised, o)
+		} else {
+			regular = append(regular, o)
+		}
+	}
+
+	stats, checksum, err := packNamedObjects(regular, opts)
+	if err != nil {
+		return packStats{}, nil, err
+	}
+	newPacks := map[string]bool{filepath.Join(packDir, fmt.Sprintf("pack-%x.pack", checksum)): true}
+	if len(promised) > 0 {
+		promisorStats, checksum, err := packNamedObjects(promised, opts)
+		if err != nil {
+			return packStats{}, nil, err
+		}
+		if err := markPromisorPack(checksum); err != nil {
+			return packStats{}, nil, err
+		}
+		newPacks[filepath.Join(packDir, fmt.Sprintf("pack-%x.pack", checksum))] = true
+		stats.total += promisorStats.total
+		stats.deltas += promisorStats.deltas
+		stats.reused += promisorStats.reused
+		stats.reusedDelta += promisorStats.reusedDelta
+	}
+	return stats, newPacks, nil
+}
+
+// replacePacks deletes the old packs that were not rewritten as one of
+// newPacks, then the loose objects the new packs now hold.
+func replacePacks(oldPacks []string, newPacks map[string]bool, loose []objectID) error {
+	for _, old := range oldPacks {
+		if newPacks[old] {
+			continue
+		}
+		if err := removePack(old); err != nil {
+			return err
+		}
+	}
+	reloadPacks()
+	if err := removeMultiPackIndex(); err != nil {
+		return err
+	}
+	return prunePacked(loose)
+}
+
+// objectAges returns the modification time of every loose object and
+// packed object, taking the pack's time for the latter. An object stored
+// more than once gets its newest time.
+func objectAges(loose []objectID) (map[objectID]time.Time, error) {
+	ages := make(map[objectID]time.Time)
+	for _, hash := range loose {
+		fi, err := os.Stat(objectPath(hash))
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat loose object: %w", err)
+		}
+		ages[hash] = fi.ModTime()
+	}
+
+	packs, err := openPacks()
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range packs {
+		fi, err := os.Stat(p.path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat pack: %w", err)
+		}
+		for i := 0; i < p.idx.count; i++ {
+			hash := p.idx.hashAt(i)
+			if age, ok := ages[hash]; !ok || fi.ModTime().After(age) {
+				ages[hash] = fi.ModTime()
+			}
+		}
+	}
+	return ages, nil
+}
+
+// gcRepack packs the objects reachable from the refs into a new pack and
+// removes the old packs. Unreachable objects newer than expire are kept
+// loose, along with anything they reference, so that a later gc can expire
+// them; older ones are deleted.
+func gcRepack(opts packOptions, expire time.Time) (packStats, error) {
+	tips, err := refTips()
+	if err != nil {
+		return packStats{}, err
+	}
+	names, err := reachableNames(tips, false)
+	if err != nil {
+		return packStats{}, err
+	}
+
+	loose, err := listLooseObjects()
+	if err != nil {
+		return packStats{}, err
+	}
+	packed, err := listPackedObjects()
+	if err != nil {
+		return packStats{}, err
+	}
+	ages, err := objectAges(loose)
+	if err != nil {
+		return packStats{}, err
+	}
+
+	kept, err := recentUnreachable(names, ages, expire)
+	if err != nil {
+		return packStats{}, err
+	}
+
+	var reachable []objectID
+	for _, hash := range append(loose, packed...) {
+		if _, ok := names[hash]; ok {
+			reachable = append(reachable, hash)
+		}
+	}
+
+	oldPacks, err := filepath.Glob(filepath.Join(packDir, "pack-*.pack"))
+	if err != nil {
+		return packStats{}, fmt.Errorf("failed to list packs: %w", err)
+	}
+	stats, newPacks, err := packObjects(reachable, names, opts)
+	if err != nil {
+		return packStats{}, err
+	}
+
+	// Kept objects leave the old packs as loose objects that keep the
+	// pack's age, so they still expire on time.
+	for hash := range kept {
+		if _, ok := names[hash]; ok {
+			continue
+		}
+		if _, err := os.Stat(objectPath(hash)); err == nil {
+			continue
+		}
+		objType, content, err := readObject(hash)
+		if err != nil {
+			return packStats{}, err
+		}
+		if err := writeObject(fmt.Sprintf("%s %d\x00%s", objType, len(content), content), hash); err != nil {
+			return packStats{}, err
+		}
+		if err := os.Chtimes(objectPath(hash), ages[hash], ages[hash]); err != nil {
+			return packStats{}, fmt.Errorf("failed to set object time: %w", err)
+		}
+	}
+
+	if err := replacePacks(oldPacks, newPacks, loose); err != nil {
+		return packStats{}, err
+	}
+	if err := pruneLoose(loose, names, kept, false, false); err != nil {
+		return packStats{}, err
+	}
+	return stats, nil
+}
+
+// packNamedObjects deltifies objects and writes them to a new pack. Nothing
+// is written for an empty list.
+func packNamedObjects(named []namedObject, opts packOptions) (packStats, objectID, error) {
+	objects, err := loadPackObjects(named, opts.reuseDeltas)
+	if err != nil {
+		return packStats{}, objectID{}, err
+	}
+	if len(objects) == 0 {
+		return packStats{}, objectID{}, nil
+	}
+
+	stats := computeDeltas(objects, opts)
+	checksum, err := writePackFile(objects)
+	if err != nil {
+		return packStats{}, objectID{}, err
+	}
+	return stats, checksum, nil
+}
+
+// removePack deletes a pack along with its index and any auxiliary files.
+func removePack(packPath string) error {
+	base := strings.TrimSuffix(packPath, ".pack")
+	for _, ext := range []string{".idx", ".pack", ".rev", ".bitmap", ".keep", ".promisor"} {
+		if err := os.Remove(base + ext); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", base+ext, err)
+		}
+	}
+	return nil
+}
+
+// prunePacked deletes loose objects that are also present in a pack.
+func prunePacked(loose []objectID) error {
+	for _, hash := range loose {
+		if _, _, ok := findPacked(hash); !ok {
+			continue
+		}
+		path := objectPath(hash)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove loose object: %w", err)
+		}
+		// Only succeeds once the fan-out directory is empty.
+		os.Remove(filepath.Dir(path))
+	}
+	return nil
+}
+
+func runGC(args []string) error {
+	aggressive, prune := false, ""
+	for _, arg := range args {
+		switch {
+		case arg == "--aggressive":
+			aggressive = true
+		case arg == "--no-prune":
+			prune = "never"
+		case strings.HasPrefix(arg, "--prune="):
+			prune = strings.TrimPrefix(arg, "--prune=")
+		case arg == "--prune":
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if prune == "" {
+		prune = defaultPruneExpire
+		if v, ok := cfg.get("gc.pruneExpire"); ok {
+			prune = v
+		}
+	}
+	expire, err := parseExpiry(prune, time.Now())
+	if err != nil {
+		return err
+	}
+
+	opts := packOptions{reuseDeltas: !aggressive}
+	if aggressive {
+		if opts.window, err = cfg.getInt("gc.aggressiveWindow", defaultAggressiveWindow); err != nil {
+			return err
+		}
+		if opts.depth, err = cfg.getInt("gc.aggressiveDepth", defaultAggressiveDepth); err != nil {
+			return err
+		}
+	} else {
+		if opts.window, err = cfg.getInt("pack.window", defaultPackWindow); err != nil {
+			return err
+		}
+		if opts.depth, err = cfg.getInt("pack.depth", defaultPackDepth); err != nil {
+			return err
+		}
+	}
+
+	if err := packRefs(); err != nil {
+		return err
+	}
+	// Objects of a precious-objects repository must never be deleted, and
+	// repacking would do just that.
+	if repoFormat.preciousObjects {
+		return nil
+	}
+	stats, err := gcRepack(opts, expire)
+	if err != nil {
+		return err
+	}
+	if write, err := cfg.getBool("gc.writeCommitGraph", true); err != nil {
+		return err
+	} else if write {
+		if err := runCommitGraph([]string{"write", "--reachable"}); err != nil {
+			return err
+		}
+	}
+
+	writePackSummary(os.Stderr, stats)
+	return nil
+}
@@ -0,0 +1,291 @@
+package mygit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// signatureFormat is a kind of signature, told apart by the armor it
+// starts with, and made by a program set in gpg.<name>.program.
+type signatureFormat struct {
+	name    string
+	program string
+	begin   []string
+}
+
+var signatureFormats = []signatureFormat{
+	{"openpgp", "gpg", []string{"-----BEGIN PGP SIGNATURE-----", "-----BEGIN PGP MESSAGE-----"}},
+	{"x509", "gpgsm", []string{"-----BEGIN SIGNED MESSAGE-----"}},
+	{"ssh", "ssh-keygen", []string{"-----BEGIN SSH SIGNATURE-----"}},
+}
+
+var errBadSignature = errors.New("bad signature")
+
+// signingFormat returns the format new signatures are made in, from
+// gpg.format.
+func signingFormat(cfg *config) (signatureFormat, error) {
+	name := "openpgp"
+	if value, ok := cfg.get("gpg.format"); ok {
+		name = value
+	}
+	for _, f := range signatureFormats {
+		if f.name == name {
+			return f, nil
+		}
+	}
+	return signatureFormat{}, fmt.Errorf("invalid value for 'gpg.format': '%s'", name)
+}
+
+// signatureProgram returns the program for signatures of format f. The
+// OpenPGP one can also be set as gpg.program.
+func signatureProgram(cfg *config, f signatureFormat) string {
+	if p, ok := cfg.get("gpg." + f.name + ".program"); ok && p != "" {
+		return p
+	}
+	if p, ok := cfg.get("gpg.program"); ok && p != "" && f.name == "openpgp" {
+		return p
+	}
+	return f.program
+}
+
+// signatureStart returns where the signature appended to a tag message
+// begins, at the last line starting with an armor, and false if the
+// message is not signed.
+func signatureStart(message []byte) (int, bool) {
+	start, found := 0, false
+	for pos := 0; pos < len(message); {
+		for _, f := range signatureFormats {
+			for _, begin := range f.begin {
+				if bytes.HasPrefix(message[pos:], []byte(begin)) {
+					start, found = pos, true
+				}
+			}
+		}
+		end := bytes.IndexByte(message[pos:], '\n')
+		if end == -1 {
+			break
+		}
+		pos += end + 1
+	}
+	return start, found
+}
+
+// signingKey returns the key to sign with: key when given, then
+// user.signingkey. Without either, gpg looks up the "Name <email>" of
+// ident as a user ID, and ssh takes the key gpg.ssh.defaultKeyCommand
+// prints.
+func signingKey(cfg *config, key, ident string) (string, error) {
+	if key != "" {
+		return key, nil
+	}
+	if key, ok := cfg.get("user.signingkey"); ok && key != "" {
+		return key, nil
+	}
+	f, err := signingFormat(cfg)
+	if err != nil {
+		return "", err
+	}
+	if f.name != "ssh" {
+		name, email, _ := parseIdent(ident)
+		return fmt.Sprintf("%s <%s>", name, email), nil
+	}
+	command, ok := cfg.get("gpg.ssh.defaultKeyCommand")
+	if !ok || command == "" {
+		return "", fmt.Errorf("either user.signingkey or gpg.ssh.defaultKeyCommand needs to be configured")
+	}
+	out, err := shellCommand(command).Output()
+	if err != nil {
+		return "", fmt.Errorf("gpg.ssh.defaultKeyCommand failed: %w", err)
+	}
+	line, _, _ := strings.Cut(string(out), "\n")
+	if !strings.HasPrefix(line, "ssh-") && !strings.HasPrefix(line, "key::") {
+		return "", fmt.Errorf("gpg.ssh.defaultKeyCommand succeeded but returned no keys: %s", out)
+	}
+	return line, nil
+}
+
+// signPayload makes a detached, armored signature of payload with key, in
+// the format gpg.format selects.
+func signPayload(cfg *config, payload []byte, key string) (string, error) {
+	f, err := signingFormat(cfg)
+	if err != nil {
+		return "", err
+	}
+	program := signatureProgram(cfg, f)
+	if f.name == "ssh" {
+		return signSSH(program, payload, key)
+	}
+	return signGPG(program, payload, key)
+}
+
+// signGPG signs with gpg or gpgsm the way git runs them. They report a
+// signature they made on the status fd, which is how success is told
+// apart from a failure that still exits zero. Their other messages are
+// passed on to stderr.
+func signGPG(program string, payload []byte, key string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(program, "--status-fd=2", "-bsau", key)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	created := false
+	for _, line := range splitLines(stderr.Bytes()) {
+		if status, ok := strings.CutPrefix(line, "[GNUPG:] "); ok {
+			created = created || strings.HasPrefix(status, "SIG_CREATED ")
+		} else {
+			fmt.Fprint(os.Stderr, line)
+		}
+	}
+	if err != nil || !created || stdout.Len() == 0 {
+		return "", fmt.Errorf("gpg failed to sign the data")
+	}
+	return strings.ReplaceAll(stdout.String(), "\r\n", "\n"), nil
+}
+
+// signSSH signs with ssh-keygen, which only signs files. key is the path
+// of a key file, or a public key given literally, optionally prefixed
+// with "key::", whose private half is in ssh-agent.
+func signSSH(program string, payload []byte, key string) (string, error) {
+	args := []string{"-Y", "sign", "-n", "git"}
+	literal, isLiteral := strings.CutPrefix(key, "key::")
+	if isLiteral || strings.HasPrefix(key, "ssh-") {
+		if !isLiteral {
+			literal = key
+		}
+		keyFile, err := writeTempFile(".git_signing_key_tmp", []byte(literal))
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(keyFile)
+		args = append(args, "-f", keyFile, "-U")
+	} else {
+		path, err := expandConfigPath(key)
+		if err != nil {
+			return "", err
+		}
+		args = append(args, "-f", path)
+	}
+	buffer, err := writeTempFile(".git_signing_buffer_tmp", payload)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(buffer)
+	defer os.Remove(buffer + ".sig")
+
+	var stderr bytes.Buffer
+	cmd := exec.Command(program, append(args, buffer)...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stderr.String(), "usage:") {
+			return "", fmt.Errorf("ssh-keygen -Y sign is needed for ssh signing (available in openssh version 8.2p1+)")
+		}
+		os.Stderr.Write(stderr.Bytes())
+		return "", fmt.Errorf("failed to sign the data")
+	}
+	signature, err := os.ReadFile(buffer + ".sig")
+	if err != nil {
+		return "", fmt.Errorf("failed reading ssh signing data buffer from '%s': %w", buffer+".sig", err)
+	}
+	return strings.ReplaceAll(string(signature), "\r\n", "\n"), nil
+}
+
+// writeTempFile stores data in a new temporary file named after pattern
+// and returns its path.
+func writeTempFile(pattern string, data []byte) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write temporary file: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// verifySignature checks that signature signs payload, passing on what
+// the program checking it says to stderr. The armor of the signature
+// tells which program that is.
+func verifySignature(cfg *config, payload []byte, signature string) error {
+	format, ok := signatureFormat{}, false
+	for _, f := range signatureFormats {
+		for _, begin := range f.begin {
+			if strings.HasPrefix(signature, begin) {
+				format, ok = f, true
+			}
+		}
+	}
+	if !ok {
+		return errBadSignature
+	}
+	sigFile, err := writeTempFile(".git_vtag_tmp", []byte(signature))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sigFile)
+	program := signatureProgram(cfg, format)
+	if format.name == "ssh" {
+		return verifySSH(cfg, program, payload, sigFile)
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(program, "--status-fd=1", "--verify", sigFile, "-")
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout, cmd.Stderr = &stdout, os.Stderr
+	err = cmd.Run()
+	if err != nil || !strings.Contains("\n"+stdout.String(), "\n[GNUPG:] GOODSIG ") {
+		return errBadSignature
+	}
+	return nil
+}
+
+// verifySSH checks an ssh signature for each principal of
+// gpg.ssh.allowedSignersFile whose key could have made it. A good
+// signature by a key no principal is allowed to sign with still fails.
+func verifySSH(cfg *config, program string, payload []byte, sigFile string) error {
+	allowed, ok := cfg.get("gpg.ssh.allowedSignersFile")
+	if ok {
+		var err error
+		if allowed, err = expandConfigPath(allowed); err != nil {
+			return err
+		}
+	}
+	if _, err := os.Stat(allowed); !ok || err != nil {
+		return fmt.Errorf("gpg.ssh.allowedSignersFile needs to be configured and exist for ssh signature verification")
+	}
+
+	out, _ := exec.Command(program, "-Y", "find-principals", "-f", allowed, "-s", sigFile).Output()
+	for _, principal := range strings.Fields(string(out)) {
+		var stdout bytes.Buffer
+		cmd := exec.Command(program, "-Y", "verify", "-n", "git", "-f", allowed, "-I", principal, "-s", sigFile)
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Stdout = &stdout
+		if cmd.Run() == nil && strings.HasPrefix(stdout.String(), "Good") {
+			os.Stderr.Write(stdout.Bytes())
+			return nil
+		}
+	}
+
+	// Without an allowed principal the signature is still checked on its
+	// own, to tell a bad signature from an unknown signer.
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(program, "-Y", "check-novalidate", "-n", "git", "-s", sigFile)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if cmd.Run() == nil {
+		os.Stderr.Write(stdout.Bytes())
+		fmt.Fprintln(os.Stderr, "No principal matched.")
+	} else {
+		os.Stderr.Write(stderr.Bytes())
+	}
+	return errBadSignature
+}
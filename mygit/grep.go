@@ -0,0 +1,349 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// grepOptions select what grep prints for each searched file.
+type grepOptions struct {
+	re         *regexp.Regexp
+	invert     bool
+	lineNumber bool
+	filesOnly  bool
+	count      bool
+}
+
+// grepTarget is a blob to search and the name it is shown under: its
+// path, prefixed with the revision it was found in if any.
+type grepTarget struct {
+	name string
+	hash objectID
+}
+
+// grepResult is what searching a blob printed.
+type grepResult struct {
+	out []byte
+	err error
+}
+
+// basicRegexp translates a POSIX basic regular expression, git grep's
+// default, into the extended syntax: the operators +, ?, |, (), {} need a
+// backslash in the basic syntax and are plain characters without one.
+func basicRegexp(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			if strings.IndexByte("+?|(){}", pattern[i]) >= 0 {
+				b.WriteByte(pattern[i])
+			} else {
+				b.WriteByte('\\')
+				b.WriteByte(pattern[i])
+			}
+		case strings.IndexByte("+?|(){}", c) >= 0:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '*' && (i == 0 || i == 1 && pattern[0] == '^'):
+			// A leading star has nothing to repeat and matches itself.
+			b.WriteString(`\*`)
+		case c == '[':
+			// Bracket expressions are the same in both syntaxes; a
+			// leading ] is part of the set.
+			end := i + 1
+			if end < len(pattern) && pattern[end] == '^' {
+				end++
+			}
+			if end < len(pattern) && pattern[end] == ']' {
+				end++
+			}
+			for end < len(pattern) && pattern[end] != ']' {
+				if strings.HasPrefix(pattern[end:], "[:") {
+					if close := strings.Index(pattern[end+2:], ":]"); close >= 0 {
+						end += close + 4
+						continue
+					}
+				}
+				end++
+			}
+			if end >= len(pattern) {
+				b.WriteString(pattern[i:])
+				i = len(pattern)
+				continue
+			}
+			b.WriteString(pattern[i : end+1])
+			i = end
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// wordBoundaries replaces GNU's \< and \> with \b, which Go's regular
+// expressions know.
+func wordBoundaries(pattern string) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+			if pattern[i] == '<' || pattern[i] == '>' {
+				b.WriteString(`\b`)
+			} else {
+				b.WriteByte('\\')
+				b.WriteByte(pattern[i])
+			}
+			continue
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
+
+// compileGrepPatterns builds the regular expression matching any of
+// patterns, given in the syntax named by mode: "basic", "extended",
+// "fixed" or "perl".
+func compileGrepPatterns(patterns []string, mode string, ignoreCase bool) (*regexp.Regexp, error) {
+	var alternatives []string
+	for _, p := range patterns {
+		switch mode {
+		case "fixed":
+			p = regexp.QuoteMeta(p)
+		case "basic":
+			p = wordBoundaries(basicRegexp(p))
+		case "extended":
+			p = wordBoundaries(p)
+		}
+		if _, err := regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("command line, '%s': %w", p, err)
+		}
+		alternatives = append(alternatives, "(?:"+p+")")
+	}
+	expr := strings.Join(alternatives, "|")
+	if ignoreCase {
+		expr = "(?i)" + expr
+	}
+	return regexp.Compile(expr)
+}
+
+// grepBlob searches a blob line by line and returns what to print for it.
+func grepBlob(t grepTarget, opts *grepOptions) ([]byte, error) {
+	_, content, err := readObject(t.hash)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	binary := isBinary(content)
+	matches := 0
+	for n, line := range splitLines(content) {
+		line = strings.TrimSuffix(line, "\n")
+		if opts.re.MatchString(line) == opts.invert {
+			continue
+		}
+		matches++
+		switch {
+		case opts.filesOnly:
+			fmt.Fprintln(&out, t.name)
+			return out.Bytes(), nil
+		case opts.count:
+		case binary:
+			fmt.Fprintf(&out, "Binary file %s matches\n", t.name)
+			return out.Bytes(), nil
+		case opts.lineNumber:
+			fmt.Fprintf(&out, "%s:%d:%s\n", t.name, n+1, line)
+		default:
+			fmt.Fprintf(&out, "%s:%s\n", t.name, line)
+		}
+	}
+	if opts.count && matches > 0 {
+		fmt.Fprintf(&out, "%s:%d\n", t.name, matches)
+	}
+	return out.Bytes(), nil
+}
+
+// grepBlobs searches targets on up to threads goroutines and prints the
+// results in order as soon as they are known. It reports whether any
+// blob matched.
+func grepBlobs(w io.Writer, targets []grepTarget, opts *grepOptions, threads int) (bool, error) {
+	results := make([]chan grepResult, len(targets))
+	for i := range results {
+		results[i] = make(chan grepResult, 1)
+	}
+	// A slot is taken for each blob being searched or waiting to be
+	// printed, so that fast searches don't pile up behind a slow one.
+	slots := make(chan struct{}, threads)
+	go func() {
+		for i, t := range targets {
+			slots <- struct{}{}
+			go func(i int, t grepTarget) {
+				out, err := grepBlob(t, opts)
+				results[i] <- grepResult{out, err}
+			}(i, t)
+		}
+	}()
+
+	matched := false
+	for i := range targets {
+		r := <-results[i]
+		<-slots
+		if r.err != nil {
+			return matched, r.err
+		}
+		if len(r.out) > 0 {
+			matched = true
+			if _, err := w.Write(r.out); err != nil {
+				return matched, err
+			}
+		}
+	}
+	return matched, nil
+}
+
+func runGrep(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	opts := &grepOptions{}
+	mode := "basic"
+	if extended, err := cfg.getBool("grep.extendedRegexp", false); err != nil {
+		return err
+	} else if extended {
+		mode = "extended"
+	}
+	if value, ok := cfg.get("grep.patternType"); ok && value != "default" {
+		mode = value
+	}
+	if opts.lineNumber, err = cfg.getBool("grep.lineNumber", false); err != nil {
+		return err
+	}
+	threads, err := cfg.getInt("grep.threads", 0)
+	if err != nil {
+		return err
+	}
+
+	var patterns, revs, paths []string
+	ignoreCase := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case arg == "-e":
+			if i+1 == len(args) {
+				return fmt.Errorf("switch 'e' requires a value")
+			}
+			i++
+			patterns = append(patterns, args[i])
+		case arg == "-n" || arg == "--line-number":
+			opts.lineNumber = true
+		case arg == "--no-line-number":
+			opts.lineNumber = false
+		case arg == "-l" || arg == "--files-with-matches" || arg == "--name-only":
+			opts.filesOnly = true
+		case arg == "-c" || arg == "--count":
+			opts.count = true
+		case arg == "-v" || arg == "--invert-match":
+			opts.invert = true
+		case arg == "-i" || arg == "--ignore-case":
+			ignoreCase = true
+		case arg == "-G" || arg == "--basic-regexp":
+			mode = "basic"
+		case arg == "-E" || arg == "--extended-regexp":
+			mode = "extended"
+		case arg == "-F" || arg == "--fixed-strings":
+			mode = "fixed"
+		case arg == "-P" || arg == "--perl-regexp":
+			mode = "perl"
+		case arg == "--cached":
+		case strings.HasPrefix(arg, "--threads="):
+			if threads, err = strconv.Atoi(strings.TrimPrefix(arg, "--threads=")); err != nil {
+				return fmt.Errorf("invalid number of threads specified (%s)", strings.TrimPrefix(arg, "--threads="))
+			}
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return fmt.Errorf("unknown option %s", arg)
+		case len(patterns) == 0:
+			patterns = append(patterns, arg)
+		case len(paths) == 0:
+			// Revisions come before paths.
+			if _, err := revisionTree(arg); err == nil {
+				revs = append(revs, arg)
+			} else {
+				paths = append(paths, arg)
+			}
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(patterns) == 0 {
+		return fmt.Errorf("no pattern given")
+	}
+	switch mode {
+	case "basic", "extended", "fixed", "perl":
+	default:
+		return fmt.Errorf("invalid grep.patternType: %s", mode)
+	}
+	if opts.re, err = compileGrepPatterns(patterns, mode, ignoreCase); err != nil {
+		return err
+	}
+	if threads <= 0 {
+		threads = runtime.NumCPU()
+	}
+
+	var targets []grepTarget
+	if len(revs) == 0 {
+		entries, err := readIndex()
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if e.stage() == 0 && e.mode != modeGitlink && matchPathspec(e.path, paths) {
+				targets = append(targets, grepTarget{name: e.path, hash: e.hash})
+			}
+		}
+	}
+	for _, rev := range revs {
+		tree, err := revisionTree(rev)
+		if err != nil {
+			return err
+		}
+		files := make(map[string]diffEntry)
+		if err := treeFiles(tree, "", files); err != nil {
+			return err
+		}
+		var names []string
+		for path, file := range files {
+			if file.mode != modeGitlink && matchPathspec(path, paths) {
+				names = append(names, path)
+			}
+		}
+		sort.Strings(names)
+		for _, path := range names {
+			targets = append(targets, grepTarget{name: rev + ":" + path, hash: files[path].hash})
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	matched, err := grepBlobs(out, targets, opts, threads)
+	if err != nil {
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		return err
+	}
+	if !matched {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package mygit
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// hookPath returns the path of an installed hook, looked up in
+// core.hooksPath or .git/hooks, or "" if there is none. Like git, hooks
+// that are not executable are ignored.
+func hookPath(cfg *config, name string) string {
+	dir := filepath.Join(commonDir, "hooks")
+	if path, ok := cfg.get("core.hooksPath"); ok && path != "" {
+		expanded, err := expandConfigPath(path)
+		if err != nil {
+			return ""
+		}
+		dir = expanded
+	}
+	path := filepath.Join(dir, name)
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() || fi.Mode()&0111 == 0 {
+		return ""
+	}
+	return path
+}
+
+// runHook runs a hook, if installed, with args and stdin. Its output goes
+// to stderr as in git. A hook that exits non-zero returns an error.
+func runHook(cfg *config, name, stdin string, args ...string) error {
+	path := hookPath(cfg, name)
+	if path == "" {
+		return nil
+	}
+	cmd := exec.Command(path, args...)
+	cmd.Stdin = strings.NewReader(stdin)
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	return cmd.Run()
+}
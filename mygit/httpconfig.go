@@ -0,0 +1,306 @@
+package mygit
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// httpOptions are the http.* settings that apply to one remote URL.
+type httpOptions struct {
+	extraHeaders []string
+	sslVerify    bool
+	// version is "HTTP/1.1" or "HTTP/2"; empty leaves the choice to the
+	// TLS negotiation.
+	version string
+	// Transfers slower than lowSpeedLimit bytes per second for
+	// lowSpeedTime seconds are aborted. Both must be set.
+	lowSpeedLimit int
+	lowSpeedTime  int
+}
+
+// urlMatch is how specifically an http.<url>.* subsection matches a URL.
+// As in git, a longer host match wins, then a longer path, then a user name.
+type urlMatch struct {
+	host int
+	path int
+	user bool
+}
+
+func (m urlMatch) less(o urlMatch) bool {
+	if m.host != o.host {
+		return m.host < o.host
+	}
+	if m.path != o.path {
+		return m.path < o.path
+	}
+	return !m.user && o.user
+}
+
+func defaultPort(scheme string) string {
+	if scheme == "https" {
+		return "443"
+	}
+	return "80"
+}
+
+// matchURLPattern reports whether the URL pattern of an http.<url>.* entry
+// applies to u. Host labels may be "*", and the pattern's path must match
+// whole path components.
+func matchURLPattern(pattern string, u *url.URL) (urlMatch, bool) {
+	p, err := url.Parse(pattern)
+	if err != nil || p.Host == "" || !strings.EqualFold(p.Scheme, u.Scheme) {
+		return urlMatch{}, false
+	}
+
+	patternLabels := strings.Split(strings.ToLower(p.Hostname()), ".")
+	labels := strings.Split(strings.ToLower(u.Hostname()), ".")
+	if len(patternLabels) != len(labels) {
+		return urlMatch{}, false
+	}
+	for i, label := range patternLabels {
+		if label != "*" && label != labels[i] {
+			return urlMatch{}, false
+		}
+	}
+	patternPort, port := p.Port(), u.Port()
+	if patternPort == "" {
+		patternPort = defaultPort(strings.ToLower(p.Scheme))
+	}
+	if port == "" {
+		port = defaultPort(strings.ToLower(u.Scheme))
+	}
+	if patternPort != port {
+		return urlMatch{}, false
+	}
+
+	path := strings.TrimSuffix(p.Path, "/")
+	if path != "" && u.Path != path && !strings.HasPrefix(u.Path, path+"/") {
+		return urlMatch{}, false
+	}
+	m := urlMatch{host: len(p.Host), path: len(path)}
+	if p.User != nil {
+		if u.User == nil || u.User.Username() != p.User.Username() {
+			return urlMatch{}, false
+		}
+		m.user = true
+	}
+	return m, true
+}
+
+// loadHTTPOptions collects the http.* settings for rawURL. For every key
+// only entries at least as specific as the best match seen so far are
+// applied, so plain http.<key> entries act as defaults for the URL-scoped
+// ones. The GIT_SSL_NO_VERIFY and GIT_HTTP_LOW_SPEED_* variables override
+// the configuration.
+func loadHTTPOptions(cfg *config, rawURL string) (*httpOptions, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote url %q: %w", rawURL, err)
+	}
+
+	opts := &httpOptions{sslVerify: true}
+	best := make(map[string]urlMatch)
+	for _, e := range cfg.entries {
+		if e.section != "http" {
+			continue
+		}
+		var m urlMatch
+		if e.subsection != "" {
+			var ok bool
+			if m, ok = matchURLPattern(e.subsection, u); !ok {
+				continue
+			}
+		}
+		if prev, ok := best[e.key]; ok && m.less(prev) {
+			continue
+		}
+		best[e.key] = m
+		if err := opts.set(e); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, ok := os.LookupEnv("GIT_SSL_NO_VERIFY"); ok {
+		opts.sslVerify = false
+	}
+	for name, field := range map[string]*int{
+		"GIT_HTTP_LOW_SPEED_LIMIT": &opts.lowSpeedLimit,
+		"GIT_HTTP_LOW_SPEED_TIME":  &opts.lowSpeedTime,
+	} {
+		if value := os.Getenv(name); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s '%s'", name, value)
+			}
+			*field = n
+		}
+	}
+	return opts, nil
+}
+
+func (o *httpOptions) set(e configEntry) error {
+	value := e.value
+	if e.noValue {
+		value = "true"
+	}
+	switch e.key {
+	case "extraheader":
+		// An empty value clears the headers collected so far.
+		if value == "" {
+			o.extraHeaders = nil
+		} else {
+			o.extraHeaders = append(o.extraHeaders, value)
+		}
+	case "sslverify":
+		b, err := parseConfigBool(value)
+		if err != nil {
+			return fmt.Errorf("bad boolean config value '%s' for '%s'", value, e.name())
+		}
+		o.sslVerify = b
+	case "version":
+		if value != "HTTP/1.1" && value != "HTTP/2" {
+			return fmt.Errorf("unsupported value '%s' for '%s'", value, e.name())
+		}
+		o.version = value
+	case "lowspeedlimit", "lowspeedtime":
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("bad numeric config value '%s' for '%s'", value, e.name())
+		}
+		if e.key == "lowspeedlimit" {
+			o.lowSpeedLimit = n
+		} else {
+			o.lowSpeedTime = n
+		}
+	}
+	return nil
+}
+
+// httpTransportKey is what tells the shared transports apart.
+type httpTransportKey struct {
+	sslVerify bool
+	version   string
+}
+
+// httpTransports are shared by every client of the process, so that the
+// requests of a fetch, and those to other remotes on the same host, reuse
+// connections rather than each opening their own.
+var (
+	httpTransportsMu sync.Mutex
+	httpTransports   = make(map[httpTransportKey]*http.Transport)
+)
+
+// client returns an HTTP client honouring sslVerify and version. HTTP/2
+// is tried unless version says otherwise, and idle connections are kept
+// for the next request.
+func (o *httpOptions) client() *http.Client {
+	key := httpTransportKey{sslVerify: o.sslVerify, version: o.version}
+	httpTransportsMu.Lock()
+	defer httpTransportsMu.Unlock()
+	if tr, ok := httpTransports[key]; ok {
+		return &http.Client{Transport: tr}
+	}
+
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: !o.sslVerify}
+	tr.ForceAttemptHTTP2 = true
+	tr.MaxIdleConnsPerHost = 8
+	// Packs come in large reads.
+	tr.ReadBufferSize = 64 << 10
+	tr.WriteBufferSize = 64 << 10
+	if o.version == "HTTP/1.1" {
+		// A non-nil empty map turns off HTTP/2 negotiation.
+		tr.ForceAttemptHTTP2 = false
+		tr.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	httpTransports[key] = tr
+	return &http.Client{Transport: tr}
+}
+
+// setHeaders adds the configured extra headers to req.
+func (o *httpOptions) setHeaders(req *http.Request) {
+	for _, header := range o.extraHeaders {
+		name, value, ok := strings.Cut(header, ":")
+		if !ok {
+			continue
+		}
+		req.Header.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+}
+
+// speedWatch cancels a request once fewer than limit bytes per second
+// arrived during a whole window, like curl's CURLOPT_LOW_SPEED_LIMIT.
+type speedWatch struct {
+	limit  int
+	window time.Duration
+	cancel context.CancelFunc
+	bytes  atomic.Int64
+	slow   atomic.Bool
+	done   chan struct{}
+	once   sync.Once
+}
+
+func newSpeedWatch(limit, seconds int, cancel context.CancelFunc) *speedWatch {
+	w := &speedWatch{limit: limit, window: time.Duration(seconds) * time.Second, cancel: cancel, done: make(chan struct{})}
+	go w.run()
+	return w
+}
+
+func (w *speedWatch) run() {
+	ticker := time.NewTicker(w.window)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			if w.bytes.Swap(0) < int64(w.limit)*int64(w.window/time.Second) {
+				w.slow.Store(true)
+				w.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (w *speedWatch) stop() {
+	w.once.Do(func() {
+		close(w.done)
+		w.cancel()
+	})
+}
+
+func (w *speedWatch) err() error {
+	return fmt.Errorf("operation too slow. Less than %d bytes/sec transferred the last %d seconds",
+		w.limit, int(w.window/time.Second))
+}
+
+// watchedBody counts the bytes read from a response for its speedWatch.
+type watchedBody struct {
+	io.ReadCloser
+	watch *speedWatch
+}
+
+func (b *watchedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.watch.bytes.Add(int64(n))
+	if err != nil && err != io.EOF && b.watch.slow.Load() {
+		return n, b.watch.err()
+	}
+	return n, err
+}
+
+func (b *watchedBody) Close() error {
+	b.watch.stop()
+	return b.ReadCloser.Close()
+}
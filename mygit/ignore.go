@@ -0,0 +1,180 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+const ignoreFileName = ".gitignore"
+
+var infoExcludeFile = ".git/info/exclude"
+
+// ignorePattern is one line of an ignore file. Patterns without a slash
+// match file names at any depth; the others match paths relative to the
+// directory of the file they come from, base.
+type ignorePattern struct {
+	pattern string
+	base    string
+	negated bool
+	dirOnly bool
+	nodir   bool
+}
+
+// ignoreRules tell which untracked files are ignored, from the
+// .gitignore files of the working tree and the repository's exclude
+// file. The .gitignore files are read as directories are looked at.
+type ignoreRules struct {
+	// global holds the patterns that apply everywhere, by increasing
+	// precedence.
+	global []ignorePattern
+	dirs   map[string][]ignorePattern
+}
+
+// parseIgnorePatterns reads the patterns of an ignore file found in base.
+func parseIgnorePatterns(data []byte, base string) []ignorePattern {
+	var patterns []ignorePattern
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSuffix(line, "\r")
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		// Trailing spaces are dropped unless quoted with a backslash.
+		for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+			line = line[:len(line)-1]
+		}
+		if line == "" {
+			continue
+		}
+		p := ignorePattern{base: base}
+		if line[0] == '!' {
+			p.negated = true
+			line = line[1:]
+		}
+		if strings.HasSuffix(line, "/") {
+			p.dirOnly = true
+			line = strings.TrimSuffix(line, "/")
+		}
+		if line == "" {
+			continue
+		}
+		p.nodir = !strings.Contains(line, "/")
+		p.pattern = strings.TrimPrefix(line, "/")
+		patterns = append(patterns, p)
+	}
+	return patterns
+}
+
+// globalExcludesFile returns the ignore file of core.excludesFile, which
+// defaults to git/ignore in the XDG config directory.
+func globalExcludesFile(cfg *config) (string, error) {
+	if value, ok := cfg.get("core.excludesFile"); ok {
+		return expandConfigPath(value)
+	}
+	if xdg := os.Getenv("XDG_CONFIG_HOME"); xdg != "" {
+		return filepath.Join(xdg, "git", "ignore"), nil
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		return filepath.Join(home, ".config", "git", "ignore"), nil
+	}
+	return "", nil
+}
+
+// loadIgnoreRules reads the user's global excludes file and the
+// repository's exclude file, which takes precedence.
+func loadIgnoreRules(cfg *config) (*ignoreRules, error) {
+	r := &ignoreRules{dirs: make(map[string][]ignorePattern)}
+	global, err := globalExcludesFile(cfg)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range []string{global, infoExcludeFile} {
+		if name == "" {
+			continue
+		}
+		data, err := os.ReadFile(name)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		r.global = append(r.global, parseIgnorePatterns(data, "")...)
+	}
+	return r, nil
+}
+
+// dirPatterns returns the patterns of the .gitignore file in dir, "" for
+// the top of the working tree.
+func (r *ignoreRules) dirPatterns(dir string) ([]ignorePattern, error) {
+	if patterns, ok := r.dirs[dir]; ok {
+		return patterns, nil
+	}
+	name, base := ignoreFileName, ""
+	if dir != "" {
+		name, base = dir+"/"+ignoreFileName, dir+"/"
+	}
+	data, err := os.ReadFile(name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	patterns := parseIgnorePatterns(data, base)
+	r.dirs[dir] = patterns
+	return patterns, nil
+}
+
+func (p *ignorePattern) matches(name string, isDir bool) bool {
+	if p.dirOnly && !isDir {
+		return false
+	}
+	if p.nodir {
+		return wildmatch(p.pattern, path.Base(name), false)
+	}
+	rest, ok := strings.CutPrefix(name, p.base)
+	return ok && wildmatch(p.pattern, rest, true)
+}
+
+// match returns the verdict of the last pattern matching name, the
+// .gitignore files of deeper directories coming last.
+func (r *ignoreRules) match(name string, isDir bool) (bool, error) {
+	dirs := []string{""}
+	for i := range name {
+		if name[i] == '/' {
+			dirs = append(dirs, name[:i])
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		patterns, err := r.dirPatterns(dirs[i])
+		if err != nil {
+			return false, err
+		}
+		for j := len(patterns) - 1; j >= 0; j-- {
+			if patterns[j].matches(name, isDir) {
+				return !patterns[j].negated, nil
+			}
+		}
+	}
+	for j := len(r.global) - 1; j >= 0; j-- {
+		if r.global[j].matches(name, isDir) {
+			return !r.global[j].negated, nil
+		}
+	}
+	return false, nil
+}
+
+// ignored reports whether a path is ignored, either itself or because a
+// directory above it is: files in ignored directories cannot be
+// brought back.
+func (r *ignoreRules) ignored(name string, isDir bool) (bool, error) {
+	for i := range name {
+		if name[i] != '/' {
+			continue
+		}
+		if ignored, err := r.match(name[:i], true); err != nil || ignored {
+			return ignored, err
+		}
+	}
+	return r.match(name, isDir)
+}
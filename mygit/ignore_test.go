@@ -0,0 +1,21 @@
+package mygit
+
+import "testing"
+
+func TestParseIgnorePatternsBlankLines(t *testing.T) {
+	patterns := parseIgnorePatterns([]byte("*.o\n   \n\t\n\\ \nbuild/ \n"), "")
+	var got []string
+	for _, p := range patterns {
+		got = append(got, p.pattern)
+	}
+	// A line of spaces is blank, but a tab or a quoted space is a pattern.
+	want := []string{"*.o", "\t", "\\ ", "build"}
+	if len(got) != len(want) {
+		t.Fatalf("got patterns %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("pattern %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
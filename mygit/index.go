@@ -0,0 +1,316 @@
+package mygit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var indexFile = ".git/index"
+
+// indexEntry is one file recorded in the index, with the stat data git
+// uses to tell whether the working tree copy may have changed.
+type indexEntry struct {
+	ctime time.Time
+	mtime time.Time
+	dev   uint32
+	ino   uint32
+	mode  uint32
+	uid   uint32
+	gid   uint32
+	size  uint32
+	hash  objectID
+	flags uint16
+	// extFlags holds the version 3 extended flags (skip-worktree and
+	// intent-to-add).
+	extFlags uint16
+	path     string
+}
+
+const (
+	// indexFlagValid marks an entry assumed unchanged, whose working tree
+	// file is not looked at until the flag is cleared.
+	indexFlagValid     = 0x8000
+	indexFlagExtended  = 0x4000
+	indexFlagStageMask = 0x3000
+	indexNameMask      = 0x0fff
+
+	// indexSkipWorktree is the extended flag of entries left out of a
+	// sparse checkout, whose working tree file is not looked at.
+	indexSkipWorktree = 0x4000
+)
+
+// stage is 0 for a merged entry and 1-3 for the sides of a conflict.
+func (e *indexEntry) stage() int {
+	return int(e.flags&indexFlagStageMask) >> 12
+}
+
+// readIndex parses .git/index, in any of the versions 2 to 4. A missing
+// index is empty. Extensions are skipped.
+func readIndex() ([]indexEntry, error) {
+	data, err := os.ReadFile(indexFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+
+	if len(data) < 12+hashAlgo.size || string(data[:4]) != "DIRC" {
+		return nil, fmt.Errorf("index file corrupt: bad signature")
+	}
+	body := data[:len(data)-hashAlgo.size]
+	h := hashAlgo.new()
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), data[len(body):]) {
+		return nil, fmt.Errorf("index file corrupt: bad checksum")
+	}
+	version := binary.BigEndian.Uint32(data[4:8])
+	if version < 2 || version > 4 {
+		return nil, fmt.Errorf("index file corrupt: bad version %d", version)
+	}
+	count := binary.BigEndian.Uint32(data[8:12])
+
+	entries := make([]indexEntry, 0, count)
+	pos := 12
+	prevPath := ""
+	// Fixed fields: ten 32-bit stat words, the hash and the flags.
+	fixed := 40 + hashAlgo.size + 2
+	for i := uint32(0); i < count; i++ {
+		if pos+fixed > len(body) {
+			return nil, fmt.Errorf("index file corrupt: truncated entry")
+		}
+		b := body[pos:]
+		word := func(n int) uint32 { return binary.BigEndian.Uint32(b[n*4:]) }
+		e := indexEntry{
+			ctime: time.Unix(int64(word(0)), int64(word(1))),
+			mtime: time.Unix(int64(word(2)), int64(word(3))),
+			dev:   word(4),
+			ino:   word(5),
+			mode:  word(6),
+			uid:   word(7),
+			gid:   word(8),
+			size:  word(9),
+			hash:  objectIDFromBytes(b[40:]),
+			flags: binary.BigEndian.Uint16(b[40+hashAlgo.size:]),
+		}
+		n := fixed
+		if e.flags&indexFlagExtended != 0 {
+			if version < 3 || pos+n+2 > len(body) {
+				return nil, fmt.Errorf("index file corrupt: bad extended flags")
+			}
+			e.extFlags = binary.BigEndian.Uint16(b[n:])
+			n += 2
+		}
+
+		if version == 4 {
+			// The path drops a number of bytes from the end of the
+			// previous one and appends a NUL-terminated suffix.
+			strip, used := readIndexVarint(b[n:])
+			if used == 0 || strip > len(prevPath) {
+				return nil, fmt.Errorf("index file corrupt: bad path prefix")
+			}
+			n += used
+			end := bytes.IndexByte(b[n:], 0)
+			if end < 0 {
+				return nil, fmt.Errorf("index file corrupt: unterminated path")
+			}
+			e.path = prevPath[:len(prevPath)-strip] + string(b[n:n+end])
+			n += end + 1
+		} else {
+			end := bytes.IndexByte(b[n:], 0)
+			if end < 0 {
+				return nil, fmt.Errorf("index file corrupt: unterminated path")
+			}
+			e.path = string(b[n : n+end])
+			// Entries are padded with NULs to a multiple of eight bytes.
+			n = (n + end + 8) &^ 7
+		}
+		prevPath = e.path
+		entries = append(entries, e)
+		pos += n
+	}
+	return entries, nil
+}
+
+// readIndexVarint decodes the offset encoding used by index version 4,
+// returning the value and the number of bytes read, or 0 if truncated.
+func readIndexVarint(b []byte) (int, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	val := int(b[0] & 0x7f)
+	i := 1
+	for b[i-1]&0x80 != 0 {
+		if i >= len(b) {
+			return 0, 0
+		}
+		val = (val+1)<<7 | int(b[i]&0x7f)
+		i++
+	}
+	return val, i
+}
+
+// writeIndex replaces .git/index with entries, which are sorted by path
+// and stage first. Version 3 is only used if an entry needs extended
+// flags.
+func writeIndex(entries []indexEntry) error {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].path != entries[j].path {
+			return entries[i].path < entries[j].path
+		}
+		return entries[i].stage() < entries[j].stage()
+	})
+	version := uint32(2)
+	for _, e := range entries {
+		if e.extFlags != 0 {
+			version = 3
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("DIRC")
+	binary.Write(&buf, binary.BigEndian, version)
+	binary.Write(&buf, binary.BigEndian, uint32(len(entries)))
+	for _, e := range entries {
+		start := buf.Len()
+		for _, word := range []uint32{
+			uint32(e.ctime.Unix()), uint32(e.ctime.Nanosecond()),
+			uint32(e.mtime.Unix()), uint32(e.mtime.Nanosecond()),
+			e.dev, e.ino, e.mode, e.uid, e.gid, e.size,
+		} {
+			binary.Write(&buf, binary.BigEndian, word)
+		}
+		buf.Write(e.hash.bytes())
+		flags := e.flags&^(indexFlagExtended|indexNameMask) | uint16(min(len(e.path), indexNameMask))
+		if e.extFlags != 0 {
+			flags |= indexFlagExtended
+		}
+		binary.Write(&buf, binary.BigEndian, flags)
+		if e.extFlags != 0 {
+			binary.Write(&buf, binary.BigEndian, e.extFlags)
+		}
+		buf.WriteString(e.path)
+		// Pad with at least one NUL to a multiple of eight bytes.
+		buf.Write(make([]byte, 8-(buf.Len()-start)%8))
+	}
+	h := hashAlgo.new()
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+
+	lock := indexFile + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("unable to create '%s': %w", lock, err)
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := fsyncFile(f, fsyncIndex); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	if err := os.Rename(lock, indexFile); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// newIndexEntry records path at the given stage. Merged entries get the
+// stat data of the working tree file so that it is known to be clean.
+func newIndexEntry(path string, stage int, file diffEntry) (indexEntry, error) {
+	e := indexEntry{path: path, mode: file.mode, hash: file.hash, flags: uint16(stage) << 12}
+	if stage != 0 {
+		return e, nil
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return indexEntry{}, fmt.Errorf("failed to stat %s: %w", path, err)
+	}
+	e.mtime = fi.ModTime()
+	e.size = uint32(fi.Size())
+	fillStatData(&e, fi)
+	return e, nil
+}
+
+// writeFilesTree writes the tree objects for a listing of files by their
+// full path and returns the root tree.
+func writeFilesTree(files map[string]diffEntry) (objectID, error) {
+	type dirEntry struct {
+		name string
+		mode uint32
+		hash objectID
+	}
+	dirs := map[string][]dirEntry{"": nil}
+	for path, file := range files {
+		dir, name := "", path
+		if i := strings.LastIndexByte(path, '/'); i >= 0 {
+			dir, name = path[:i], path[i+1:]
+		}
+		dirs[dir] = append(dirs[dir], dirEntry{name: name, mode: file.mode, hash: file.hash})
+		// Make sure every parent directory gets listed in its own parent.
+		// The file's own directory was just added above, so start with its
+		// parent; once one is known, so are all of its parents.
+		for dir != "" {
+			if i := strings.LastIndexByte(dir, '/'); i >= 0 {
+				dir = dir[:i]
+			} else {
+				dir = ""
+			}
+			if _, ok := dirs[dir]; ok {
+				break
+			}
+			dirs[dir] = nil
+		}
+	}
+
+	var write func(dir string) (objectID, error)
+	write = func(dir string) (objectID, error) {
+		entries := dirs[dir]
+		prefix := dir + "/"
+		if dir == "" {
+			prefix = ""
+		}
+		for sub := range dirs {
+			rest, ok := strings.CutPrefix(sub, prefix)
+			if !ok || sub == dir || strings.Contains(rest, "/") {
+				continue
+			}
+			hash, err := write(sub)
+			if err != nil {
+				return objectID{}, err
+			}
+			entries = append(entries, dirEntry{name: rest, mode: modeDirectory, hash: hash})
+		}
+		// Git sorts directories as if their name ended in a slash.
+		sortName := func(e dirEntry) string {
+			if e.mode == modeDirectory {
+				return e.name + "/"
+			}
+			return e.name
+		}
+		sort.Slice(entries, func(i, j int) bool { return sortName(entries[i]) < sortName(entries[j]) })
+
+		var content []byte
+		for _, e := range entries {
+			content = fmt.Appendf(content, "%o %s\x00", e.mode, e.name)
+			content = append(content, e.hash.bytes()...)
+		}
+		return storeObject(treeObject, content)
+	}
+	return write("")
+}
@@ -0,0 +1,62 @@
+package mygit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// chdirRepo makes a new empty repository the working directory for the
+// rest of the test.
+func chdirRepo(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	for _, sub := range []string{"objects", "refs/heads", "refs/tags"} {
+		if err := os.MkdirAll(filepath.Join(dir, ".git", sub), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(filepath.Join(dir, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+}
+
+func TestWriteFilesTreeNestedDirectories(t *testing.T) {
+	chdirRepo(t)
+	blob, err := storeObject(blobObject, []byte("content\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// d holds nothing but a subdirectory, and d/e/f nothing but files.
+	files := map[string]diffEntry{
+		"a.txt":       {mode: 0100644, hash: blob},
+		"d/e/g.txt":   {mode: 0100644, hash: blob},
+		"d/e/f/h.txt": {mode: 0100644, hash: blob},
+		"x/y.txt":     {mode: 0100644, hash: blob},
+	}
+	tree, err := writeFilesTree(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]diffEntry)
+	if err := treeFiles(tree, "", got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(files) {
+		t.Errorf("tree has %d files, want %d: %v", len(got), len(files), got)
+	}
+	for path, want := range files {
+		if e, ok := got[path]; !ok || e.mode != want.mode || e.hash != want.hash {
+			t.Errorf("%s: got %v, want %v", path, e, want)
+		}
+	}
+}
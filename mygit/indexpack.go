@@ -0,0 +1,261 @@
+package mygit
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+)
+
+// countingReader tracks how many bytes have been consumed and feeds them to
+// the pack checksum and the current entry's CRC. It implements
+// io.ByteReader so the zlib decompressor never reads past the end of an
+// entry.
+type countingReader struct {
+	r   *bufio.Reader
+	n   int64
+	sum hash.Hash
+	crc hash.Hash32
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	c.sum.Write(p[:n])
+	c.crc.Write(p[:n])
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+		c.sum.Write([]byte{b})
+		c.crc.Write([]byte{b})
+	}
+	return b, err
+}
+
+// receivePack stores a pack streamed from r in the pack directory, builds
+// its index and returns the pack checksum.
+func receivePack(r io.Reader) (objectID, error) {
+	if err := os.MkdirAll(packDir, 0755); err != nil {
+		return objectID{}, fmt.Errorf("failed to create pack directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(packDir, "tmp_pack_")
+	if err != nil {
+		return objectID{}, fmt.Errorf("failed to create pack file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return objectID{}, fmt.Errorf("failed to receive pack: %w", err)
+	}
+	if err := fsyncFile(tmp, fsyncPack); err != nil {
+		return objectID{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return objectID{}, fmt.Errorf("failed to write pack file: %w", err)
+	}
+
+	checksum, entries, err := indexPackFile(tmp.Name())
+	if err != nil {
+		return objectID{}, err
+	}
+	if err := installPack(tmp.Name(), entries, checksum); err != nil {
+		return objectID{}, err
+	}
+	return checksum, nil
+}
+
+type indexedEntry struct {
+	idxEntry
+	typeCode int
+	baseHash objectID
+	resolved bool
+}
+
+// indexPackFile parses every entry of the pack at path, verifies its
+// checksum and resolves deltas to compute each object's hash.
+func indexPackFile(path string) (objectID, []idxEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return objectID{}, nil, fmt.Errorf("failed to open pack: %w", err)
+	}
+	defer f.Close()
+
+	cr := &countingReader{r: bufio.NewReader(f), sum: hashAlgo.new(), crc: crc32.NewIEEE()}
+
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(cr, header); err != nil {
+		return objectID{}, nil, fmt.Errorf("failed to read pack header: %w", err)
+	}
+	if string(header[:4]) != "PACK" {
+		return objectID{}, nil, fmt.Errorf("not a pack file")
+	}
+	if version := binary.BigEndian.Uint32(header[4:8]); version != 2 && version != 3 {
+		return objectID{}, nil, fmt.Errorf("unsupported pack version %d", version)
+	}
+	count := int(binary.BigEndian.Uint32(header[8:12]))
+
+	// The count is not trusted to allocate up front.
+	entries := make([]indexedEntry, 0, min(count, 1<<16))
+	for i := 0; i < count; i++ {
+		cr.crc.Reset()
+		entry, err := readPackEntry(cr)
+		if err != nil {
+			return objectID{}, nil, fmt.Errorf("failed to read pack entry %d: %w", i, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	var trailer objectID
+	checksum := sumObjectID(cr.sum)
+	if _, err := io.ReadFull(cr.r, trailer[:hashAlgo.size]); err != nil {
+		return objectID{}, nil, fmt.Errorf("failed to read pack checksum: %w", err)
+	}
+	if checksum != trailer {
+		return objectID{}, nil, fmt.Errorf("pack checksum mismatch")
+	}
+
+	if err := resolvePackDeltas(f, entries); err != nil {
+		return objectID{}, nil, err
+	}
+
+	result := make([]idxEntry, len(entries))
+	for i, e := range entries {
+		result[i] = e.idxEntry
+	}
+	return checksum, result, nil
+}
+
+// readPackEntry consumes one entry. Whole objects are hashed immediately;
+// deltas are left unresolved.
+func readPackEntry(cr *countingReader) (indexedEntry, error) {
+	entry := indexedEntry{idxEntry: idxEntry{offset: cr.n}}
+
+	var hdr []byte
+	for {
+		b, err := cr.ReadByte()
+		if err != nil {
+			return entry, err
+		}
+		hdr = append(hdr, b)
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if int(hdr[0]>>4)&7 == packOfsDelta {
+		for {
+			b, err := cr.ReadByte()
+			if err != nil {
+				return entry, err
+			}
+			hdr = append(hdr, b)
+			if b&0x80 == 0 {
+				break
+			}
+		}
+	}
+
+	h, err := parseEntryHeader(hdr, entry.offset)
+	if err != nil {
+		return entry, err
+	}
+	if h.typeCode == packOfsDelta || h.typeCode == packRefDelta {
+		if err := checkDeltaSize(h.size); err != nil {
+			return entry, err
+		}
+	}
+	entry.typeCode = h.typeCode
+	if h.typeCode == packRefDelta {
+		if _, err := io.ReadFull(cr, entry.baseHash[:hashAlgo.size]); err != nil {
+			return entry, err
+		}
+	}
+
+	z, err := zlib.NewReader(cr)
+	if err != nil {
+		return entry, fmt.Errorf("failed to create zlib reader: %w", err)
+	}
+	// Inflating stops one byte past the size the header gives, enough to
+	// tell that it lied.
+	data, err := io.ReadAll(io.LimitReader(z, h.size+1))
+	if err != nil {
+		return entry, fmt.Errorf("failed to decompress entry: %w", err)
+	}
+	z.Close()
+	if int64(len(data)) != h.size {
+		return entry, fmt.Errorf("entry size mismatch")
+	}
+
+	if objType, ok := packTypeNames[h.typeCode]; ok {
+		entry.hash = hashObjectData(objType, data)
+		entry.resolved = true
+	} else if h.typeCode != packOfsDelta && h.typeCode != packRefDelta {
+		return entry, fmt.Errorf("invalid entry type %d", h.typeCode)
+	}
+
+	entry.crc = cr.crc.Sum32()
+	return entry, nil
+}
+
+// resolvePackDeltas hashes every delta entry. Ref deltas may depend on
+// objects later in the pack, so passes repeat until nothing changes.
+func resolvePackDeltas(f *os.File, entries []indexedEntry) error {
+	p := &pack{path: f.Name(), file: f, cache: make(map[int64]packedObject), refBases: make(map[objectID]int64)}
+	for _, e := range entries {
+		if e.resolved {
+			p.refBases[e.hash] = e.offset
+		}
+	}
+
+	for {
+		progress, unresolved := false, 0
+		// The last failure to rebuild an offset delta, which may be why
+		// it stays unresolved.
+		var lastErr error
+		for i := range entries {
+			e := &entries[i]
+			if e.resolved {
+				continue
+			}
+			if e.typeCode == packRefDelta {
+				if _, ok := p.refBases[e.baseHash]; !ok && !hasObject(e.baseHash) {
+					unresolved++
+					continue
+				}
+			}
+
+			obj, err := p.readAt(e.offset)
+			if err != nil {
+				if e.typeCode == packOfsDelta {
+					unresolved++
+					lastErr = err
+					continue
+				}
+				return fmt.Errorf("failed to resolve delta at offset %d: %w", e.offset, err)
+			}
+			e.hash = hashObjectData(obj.objType, obj.data)
+			e.resolved = true
+			p.refBases[e.hash] = e.offset
+			progress = true
+		}
+
+		if unresolved == 0 {
+			return nil
+		}
+		if !progress && lastErr != nil {
+			return fmt.Errorf("pack has %d unresolved deltas: %w", unresolved, lastErr)
+		}
+		if !progress {
+			return fmt.Errorf("pack has %d unresolved deltas", unresolved)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux
+
+package mygit
+
+import (
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+// fillStatData copies the inode change time and the identity of a file
+// into its index entry.
+func fillStatData(e *indexEntry, fi fs.FileInfo) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		e.ctime = e.mtime
+		return
+	}
+	e.ctime = time.Unix(int64(st.Ctim.Sec), int64(st.Ctim.Nsec))
+	e.dev = uint32(st.Dev)
+	e.ino = uint32(st.Ino)
+	e.uid = st.Uid
+	e.gid = st.Gid
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package mygit
+
+import "io/fs"
+
+// fillStatData uses the modification time as change time where the stat
+// layout is not known.
+func fillStatData(e *indexEntry, fi fs.FileInfo) {
+	e.ctime = e.mtime
+}
@@ -0,0 +1,314 @@
+package mygit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	lfsSpecVersion = "https://git-lfs.github.com/spec/v1"
+	// maxLFSPointerSize bounds the blobs worth reading as pointers.
+	maxLFSPointerSize = 1024
+)
+
+var lfsObjectsDir = ".git/lfs/objects"
+
+// lfsThreshold is the size above which files are stored as large objects,
+// once read by loadLFSThreshold, which lfsThresholdMu guards. Zero turns
+// large objects off.
+var (
+	lfsThresholdMu sync.Mutex
+	lfsThreshold   int64 = -1
+)
+
+// loadLFSThreshold reads lfs.threshold, a byte count with an optional k, m
+// or g suffix.
+func loadLFSThreshold() (int64, error) {
+	lfsThresholdMu.Lock()
+	defer lfsThresholdMu.Unlock()
+	if lfsThreshold >= 0 {
+		return lfsThreshold, nil
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	if value, ok := cfg.get("lfs.threshold"); ok {
+		if n, err = parseConfigInt(value); err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid lfs.threshold %q", value)
+		}
+	}
+	lfsThreshold = n
+	return lfsThreshold, nil
+}
+
+// lfsPointer stands for a large object in trees, in the format of Git
+// LFS pointer files.
+type lfsPointer struct {
+	oid  string
+	size int64
+}
+
+func (p lfsPointer) String() string {
+	return fmt.Sprintf("version %s\noid sha256:%s\nsize %d\n", lfsSpecVersion, p.oid, p.size)
+}
+
+// parseLFSPointer reads the content of a pointer file.
+func parseLFSPointer(data []byte) (lfsPointer, bool) {
+	if len(data) > maxLFSPointerSize {
+		return lfsPointer{}, false
+	}
+	var p lfsPointer
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) < 3 || lines[0] != "version "+lfsSpecVersion {
+		return lfsPointer{}, false
+	}
+	for _, line := range lines[1:] {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "oid":
+			oid, ok := strings.CutPrefix(value, "sha256:")
+			if _, err := hex.DecodeString(oid); !ok || err != nil || len(oid) != sha256.Size*2 {
+				return lfsPointer{}, false
+			}
+			p.oid = oid
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || size < 0 {
+				return lfsPointer{}, false
+			}
+			p.size = size
+		}
+	}
+	return p, p.oid != ""
+}
+
+// lfsObjectPath returns where a large object is kept below dir, the
+// large-object area of a repository.
+func lfsObjectPath(dir, oid string) string {
+	return filepath.Join(dir, oid[:2], oid[2:4], oid)
+}
+
+// storeLFSObject keeps data in the large-object area and returns the
+// pointer standing for it.
+func storeLFSObject(data []byte) (lfsPointer, error) {
+	sum := sha256.Sum256(data)
+	p := lfsPointer{oid: hex.EncodeToString(sum[:]), size: int64(len(data))}
+	return p, writeLFSObject(lfsObjectsDir, p.oid, data)
+}
+
+// writeLFSObject adds a large object to the large-object area dir, unless
+// it is already there.
+func writeLFSObject(dir, oid string, data []byte) error {
+	path := lfsObjectPath(dir, oid)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create large object directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp_lfs_")
+	if err != nil {
+		return fmt.Errorf("failed to create large object: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write large object: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write large object: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to store large object: %w", err)
+	}
+	return nil
+}
+
+// readLFSObject returns the content a pointer stands for, and false when
+// the large object is not here.
+func readLFSObject(p lfsPointer) ([]byte, bool, error) {
+	data, err := os.ReadFile(lfsObjectPath(lfsObjectsDir, p.oid))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read large object: %w", err)
+	}
+	if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != p.oid {
+		return nil, false, fmt.Errorf("large object %s is corrupt", p.oid)
+	}
+	return data, true, nil
+}
+
+// lfsClean stores files above the threshold as large objects, leaving a
+// pointer in their place.
+func lfsClean(data []byte) ([]byte, error) {
+	threshold, err := loadLFSThreshold()
+	if err != nil || threshold == 0 || int64(len(data)) <= threshold {
+		return data, err
+	}
+	if _, ok := parseLFSPointer(data); ok {
+		return data, nil
+	}
+	p, err := storeLFSObject(data)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(p.String()), nil
+}
+
+// lfsSmudge replaces a pointer by the large object it stands for. Pointers
+// to large objects that were not transferred are left as they are.
+func lfsSmudge(data []byte) ([]byte, error) {
+	p, ok := parseLFSPointer(data)
+	if !ok {
+		return data, nil
+	}
+	content, ok, err := readLFSObject(p)
+	if err != nil || !ok {
+		return data, err
+	}
+	return content, nil
+}
+
+// remoteLFSDir returns the large-object area of the repository at a
+// local url, and false for remotes reached any other way.
+func remoteLFSDir(rawURL string) (string, bool) {
+	u, err := parseRemoteURL(rawURL)
+	if err != nil || u.scheme != "file" {
+		return "", false
+	}
+	if fi, err := os.Stat(filepath.Join(u.path, ".git")); err == nil && fi.IsDir() {
+		return filepath.Join(u.path, ".git", "lfs", "objects"), true
+	}
+	return filepath.Join(u.path, "lfs", "objects"), true
+}
+
+// reachableLFSPointers lists the pointers among the blobs reachable from
+// include but not from exclude.
+func reachableLFSPointers(include, exclude []objectID) ([]lfsPointer, error) {
+	list, err := listObjects(include, exclude)
+	if err != nil {
+		return nil, err
+	}
+	var pointers []lfsPointer
+	seen := make(map[string]bool)
+	for _, o := range list {
+		if !hasObject(o.hash) {
+			continue
+		}
+		info, err := statObject(o.hash)
+		if err != nil {
+			return nil, err
+		}
+		if info.objType != blobObject || info.size > maxLFSPointerSize {
+			continue
+		}
+		_, data, err := readObject(o.hash)
+		if err != nil {
+			return nil, err
+		}
+		if p, ok := parseLFSPointer(data); ok && !seen[p.oid] {
+			seen[p.oid] = true
+			pointers = append(pointers, p)
+		}
+	}
+	return pointers, nil
+}
+
+// transferLFSObjects copies the large objects that the pointers reachable
+// from include but not from exclude stand for, from one large-object area
+// to another. Objects the source lacks are skipped.
+func transferLFSObjects(from, to string, include, exclude []objectID) error {
+	if _, err := os.Stat(from); err != nil {
+		return nil
+	}
+	pointers, err := reachableLFSPointers(include, exclude)
+	if err != nil {
+		return err
+	}
+	for _, p := range pointers {
+		if _, err := os.Stat(lfsObjectPath(to, p.oid)); err == nil {
+			continue
+		}
+		data, err := os.ReadFile(lfsObjectPath(from, p.oid))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read large object: %w", err)
+		}
+		if err := writeLFSObject(to, p.oid, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchLFSObjects brings the large objects of newly fetched commits over,
+// copying them from a local remote and downloading them through the LFS
+// API of others. Only the ones not already here are asked for.
+func fetchLFSObjects(rawURL string, include, exclude []objectID) error {
+	if dir, ok := remoteLFSDir(rawURL); ok {
+		return transferLFSObjects(dir, lfsObjectsDir, include, exclude)
+	}
+	pointers, err := reachableLFSPointers(include, exclude)
+	if err != nil {
+		return err
+	}
+	var missing []lfsPointer
+	for _, p := range pointers {
+		if _, err := os.Stat(lfsObjectPath(lfsObjectsDir, p.oid)); err != nil {
+			missing = append(missing, p)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	c, err := newLFSClient(rawURL, "download")
+	if err != nil {
+		// The commits are fetched all the same; their pointers stay
+		// checked out as they are.
+		fmt.Fprintf(os.Stderr, "warning: %d large objects not fetched: %v\n", len(missing), err)
+		return nil
+	}
+	return c.download(lfsObjectsDir, missing)
+}
+
+// pushLFSObjects sends the large objects of pushed commits to the remote,
+// copying them to a local one and uploading them through the LFS API of
+// others. Pushing pointers to a remote that cannot take their objects
+// fails.
+func pushLFSObjects(rawURL string, include, exclude []objectID) error {
+	if dir, ok := remoteLFSDir(rawURL); ok {
+		return transferLFSObjects(lfsObjectsDir, dir, include, exclude)
+	}
+	pointers, err := reachableLFSPointers(include, exclude)
+	if err != nil {
+		return err
+	}
+	var present []lfsPointer
+	for _, p := range pointers {
+		if _, err := os.Stat(lfsObjectPath(lfsObjectsDir, p.oid)); err == nil {
+			present = append(present, p)
+		}
+	}
+	if len(present) == 0 {
+		return nil
+	}
+	c, err := newLFSClient(rawURL, "upload")
+	if err != nil {
+		return err
+	}
+	return c.upload(lfsObjectsDir, present)
+}
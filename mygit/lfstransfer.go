@@ -0,0 +1,227 @@
+package mygit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const lfsMediaType = "application/vnd.git-lfs+json"
+
+// lfsAction is a request the batch API asks the client to make for one
+// object.
+type lfsAction struct {
+	Href   string            `json:"href"`
+	Header map[string]string `json:"header,omitempty"`
+}
+
+type lfsBatchObject struct {
+	Oid     string               `json:"oid"`
+	Size    int64                `json:"size"`
+	Actions map[string]lfsAction `json:"actions,omitempty"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+	} `json:"error,omitempty"`
+}
+
+type lfsBatchRequest struct {
+	Operation string           `json:"operation"`
+	Transfers []string         `json:"transfers"`
+	Objects   []lfsBatchObject `json:"objects"`
+}
+
+type lfsBatchResponse struct {
+	Transfer string           `json:"transfer"`
+	Objects  []lfsBatchObject `json:"objects"`
+}
+
+// lfsClient speaks the Git LFS batch API of a remote, moving objects with
+// the basic transfer adapter.
+type lfsClient struct {
+	t *httpTransport
+	// header is added to batch requests, such as the authorization that
+	// git-lfs-authenticate hands out over ssh.
+	header map[string]string
+}
+
+// newLFSClient finds the LFS endpoint of an http or ssh remote. Over ssh
+// the server is asked for it with git-lfs-authenticate, and derived from
+// the host and path if it has no such command.
+func newLFSClient(rawURL, operation string) (*lfsClient, error) {
+	u, err := parseRemoteURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var endpoint string
+	var header map[string]string
+	switch u.scheme {
+	case "http", "https":
+		endpoint = lfsEndpoint(rawURL)
+	case "ssh":
+		cmd, err := sshCommand(u, "git-lfs-authenticate", false, operation)
+		if err != nil {
+			return nil, err
+		}
+		var auth lfsAction
+		if out, err := cmd.Output(); err == nil && json.Unmarshal(out, &auth) == nil && auth.Href != "" {
+			endpoint, header = strings.TrimSuffix(auth.Href, "/"), auth.Header
+		} else {
+			endpoint = lfsEndpoint("https://" + u.host + "/" + strings.TrimPrefix(u.path, "/"))
+		}
+	default:
+		return nil, fmt.Errorf("large objects cannot be transferred over %s", u.scheme)
+	}
+
+	t, err := newHTTPTransport(&remoteURL{scheme: "https", raw: endpoint}, "", "")
+	if err != nil {
+		return nil, err
+	}
+	return &lfsClient{t: t.(*httpTransport), header: header}, nil
+}
+
+// lfsEndpoint returns the LFS endpoint git-lfs uses for a remote url:
+// <url>.git/info/lfs, the .git suffix added if missing.
+func lfsEndpoint(rawURL string) string {
+	rawURL = strings.TrimSuffix(rawURL, "/")
+	if !strings.HasSuffix(rawURL, ".git") {
+		rawURL += ".git"
+	}
+	return rawURL + "/info/lfs"
+}
+
+// batch asks the server what to do to move the objects of pointers.
+func (c *lfsClient) batch(operation string, pointers []lfsPointer) ([]lfsBatchObject, error) {
+	req := lfsBatchRequest{Operation: operation, Transfers: []string{"basic"}}
+	for _, p := range pointers {
+		req.Objects = append(req.Objects, lfsBatchObject{Oid: p.oid, Size: p.size})
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	httpReq, err := http.NewRequest("POST", c.t.base+"/objects/batch", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	c.t.setHeaders(httpReq)
+	for k, v := range c.header {
+		httpReq.Header.Set(k, v)
+	}
+	httpReq.Header.Set("Accept", lfsMediaType)
+	httpReq.Header.Set("Content-Type", lfsMediaType)
+
+	resp, err := c.t.do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("LFS batch request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	var res lfsBatchResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("invalid LFS batch response: %w", err)
+	}
+	if res.Transfer != "" && res.Transfer != "basic" {
+		return nil, fmt.Errorf("unsupported LFS transfer adapter %s", res.Transfer)
+	}
+	for _, o := range res.Objects {
+		if o.Error != nil {
+			return nil, fmt.Errorf("LFS object %s: %s", o.Oid, o.Error.Message)
+		}
+	}
+	return res.Objects, nil
+}
+
+// act makes the request of an action, failing unless it succeeds.
+func (c *lfsClient) act(method string, a lfsAction, body []byte, contentType string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(method, a.Href, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	for k, v := range a.Header {
+		req.Header.Set(k, v)
+	}
+	resp, err := c.t.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected http status %s from %s", resp.Status, req.URL.Redacted())
+	}
+	return resp.Body, nil
+}
+
+// upload sends the large objects of pointers the server does not have.
+func (c *lfsClient) upload(dir string, pointers []lfsPointer) error {
+	objects, err := c.batch("upload", pointers)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		action, ok := o.Actions["upload"]
+		if !ok {
+			continue
+		}
+		data, err := os.ReadFile(lfsObjectPath(dir, o.Oid))
+		if err != nil {
+			return fmt.Errorf("failed to read large object: %w", err)
+		}
+		body, err := c.act("PUT", action, data, "application/octet-stream")
+		if err != nil {
+			return fmt.Errorf("failed to upload large object %s: %w", o.Oid, err)
+		}
+		body.Close()
+		if verify, ok := o.Actions["verify"]; ok {
+			req, err := json.Marshal(lfsBatchObject{Oid: o.Oid, Size: o.Size})
+			if err != nil {
+				return err
+			}
+			body, err := c.act("POST", verify, req, lfsMediaType)
+			if err != nil {
+				return fmt.Errorf("failed to verify large object %s: %w", o.Oid, err)
+			}
+			body.Close()
+		}
+	}
+	return nil
+}
+
+// download fetches the large objects of pointers into dir.
+func (c *lfsClient) download(dir string, pointers []lfsPointer) error {
+	objects, err := c.batch("download", pointers)
+	if err != nil {
+		return err
+	}
+	for _, o := range objects {
+		action, ok := o.Actions["download"]
+		if !ok {
+			return fmt.Errorf("LFS server offers no download of %s", o.Oid)
+		}
+		body, err := c.act("GET", action, nil, "")
+		if err != nil {
+			return fmt.Errorf("failed to download large object %s: %w", o.Oid, err)
+		}
+		data, err := io.ReadAll(body)
+		body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to download large object %s: %w", o.Oid, err)
+		}
+		if sum := sha256.Sum256(data); hex.EncodeToString(sum[:]) != o.Oid {
+			return fmt.Errorf("downloaded large object %s is corrupt", o.Oid)
+		}
+		if err := writeLFSObject(dir, o.Oid, data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,369 @@
+package mygit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	colorCommit = "\033[33m"
+	colorReset  = "\033[m"
+)
+
+type decorateMode int
+
+const (
+	decorateNo decorateMode = iota
+	decorateShort
+	decorateFull
+)
+
+type logOptions struct {
+	maxCount int
+	oneline  bool
+	decorate decorateMode
+	color    bool
+	date     dateMode
+	now      time.Time
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// parseDecorateMode interprets --decorate=<mode> and log.decorate values.
+// "auto" decorates only when writing to a terminal.
+func parseDecorateMode(value string) (decorateMode, error) {
+	switch strings.ToLower(value) {
+	case "short", "true", "yes", "on", "1":
+		return decorateShort, nil
+	case "full":
+		return decorateFull, nil
+	case "no", "false", "off", "0":
+		return decorateNo, nil
+	case "auto":
+		if isTerminal(os.Stdout) {
+			return decorateShort, nil
+		}
+		return decorateNo, nil
+	}
+	return decorateNo, fmt.Errorf("invalid decorate mode %q", value)
+}
+
+// parseColorMode interprets --color=<when> and color.ui values.
+func parseColorMode(value string) (bool, error) {
+	switch strings.ToLower(value) {
+	case "always", "true", "yes", "on", "1":
+		return true, nil
+	case "never", "false", "no", "off", "0":
+		return false, nil
+	case "auto":
+		return isTerminal(os.Stdout) && os.Getenv("TERM") != "dumb", nil
+	}
+	return false, fmt.Errorf("invalid color mode %q", value)
+}
+
+// commitSubject returns the first paragraph of a commit message joined
+// into a single line, as shown by --oneline.
+func commitSubject(message string) string {
+	message = strings.TrimLeft(message, "\n")
+	paragraph, _, _ := strings.Cut(message, "\n\n")
+	return strings.Join(strings.Fields(strings.ReplaceAll(paragraph, "\n", " ")), " ")
+}
+
+// writeLogEntry prints one commit in the oneline or medium format.
+func writeLogEntry(w io.Writer, hash objectID, c *commit, opts *logOptions, decorations map[objectID][]decoration) {
+	commitColor, reset := "", ""
+	if opts.color {
+		commitColor, reset = colorCommit, colorReset
+	}
+	decor := ""
+	if opts.decorate != decorateNo {
+		decor = formatDecorations(decorations[hash], opts.decorate == decorateFull, commitColor)
+	}
+
+	if opts.oneline {
+		fmt.Fprintf(w, "%s%s%s%s %s\n", commitColor, shortHash(hash), reset, decor, commitSubject(c.message))
+		return
+	}
+
+	fmt.Fprintf(w, "%scommit %x%s%s\n", commitColor, hash, reset, decor)
+	if len(c.parents) > 1 {
+		short := make([]string, len(c.parents))
+		for i, p := range c.parents {
+			short[i] = shortHash(p)
+		}
+		fmt.Fprintf(w, "Merge: %s\n", strings.Join(short, " "))
+	}
+	name, email, when := parseIdent(c.author)
+	fmt.Fprintf(w, "Author: %s <%s>\n", name, email)
+	fmt.Fprintf(w, "Date:   %s\n\n", formatDate(when, opts.date, opts.now))
+
+	message := strings.TrimRight(strings.TrimLeft(c.message, "\n"), "\n")
+	for _, line := range strings.Split(message, "\n") {
+		fmt.Fprintf(w, "    %s\n", line)
+	}
+}
+
+// configLogOptions returns the options for showing commits set in config.
+func configLogOptions(cfg *config) (logOptions, error) {
+	opts := logOptions{maxCount: -1, now: time.Now()}
+	var err error
+	if value, ok := cfg.get("log.date"); ok {
+		if opts.date, err = parseDateMode(value); err != nil {
+			return opts, err
+		}
+	}
+	decorate, _ := cfg.get("log.decorate")
+	if decorate == "" {
+		decorate = "auto"
+	}
+	if opts.decorate, err = parseDecorateMode(decorate); err != nil {
+		return opts, err
+	}
+	colorUI, _ := cfg.get("color.ui")
+	if colorUI == "" {
+		colorUI = "auto"
+	}
+	if opts.color, err = parseColorMode(colorUI); err != nil {
+		return opts, err
+	}
+	return opts, nil
+}
+
+func runLog(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	opts, err := configLogOptions(cfg)
+	if err != nil {
+		return err
+	}
+	// Commits are shown with their changes only if a diff format is asked
+	// for.
+	diffOpts, err := configDiffOptions(cfg)
+	if err != nil {
+		return err
+	}
+	noPatch := false
+
+	var revs, ancestryNames []string
+	all, ancestryPath, simplifyByDecor := false, false, false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--all":
+			all = true
+		case arg == "--oneline":
+			opts.oneline = true
+		case arg == "-s" || arg == "--no-patch":
+			noPatch = true
+		case arg == "--simplify-by-decoration":
+			simplifyByDecor = true
+		case arg == "--ancestry-path":
+			ancestryPath = true
+		case strings.HasPrefix(arg, "--ancestry-path="):
+			ancestryNames = append(ancestryNames, strings.TrimPrefix(arg, "--ancestry-path="))
+		case arg == "--decorate":
+			opts.decorate = decorateShort
+		case arg == "--no-decorate":
+			opts.decorate = decorateNo
+		case strings.HasPrefix(arg, "--decorate="):
+			if opts.decorate, err = parseDecorateMode(strings.TrimPrefix(arg, "--decorate=")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "--date="):
+			if opts.date, err = parseDateMode(strings.TrimPrefix(arg, "--date=")); err != nil {
+				return err
+			}
+		case arg == "--relative-date":
+			opts.date = dateMode{style: dateRelative}
+		case arg == "--color":
+			opts.color = true
+		case arg == "--no-color":
+			opts.color = false
+		case strings.HasPrefix(arg, "--color="):
+			if opts.color, err = parseColorMode(strings.TrimPrefix(arg, "--color=")); err != nil {
+				return err
+			}
+		case arg == "-n" || strings.HasPrefix(arg, "--max-count=") ||
+			len(arg) > 1 && arg[0] == '-' && isDigits(arg[1:]):
+			value := strings.TrimPrefix(strings.TrimPrefix(arg, "--max-count="), "-")
+			if arg == "-n" {
+				if i+1 >= len(args) {
+					return fmt.Errorf("-n requires a value")
+				}
+				i++
+				value = args[i]
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid count %q", value)
+			}
+			opts.maxCount = n
+		case strings.HasPrefix(arg, "-"):
+			if ok, err := parseDiffFormatOption(arg, diffOpts); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("unknown option %s", arg)
+			}
+		default:
+			revs = append(revs, arg)
+		}
+	}
+	if len(revs) == 0 && !all {
+		revs = []string{"HEAD"}
+	}
+	showDiff := !noPatch && diffOpts.hasFormat()
+
+	include, exclude, err := parseRevisionArgs(revs)
+	if err != nil {
+		return err
+	}
+	if all {
+		refs, err := listRefs()
+		if err != nil {
+			return err
+		}
+		for _, hash := range refs {
+			include = append(include, hash)
+		}
+		if head, err := resolveRef("HEAD"); err == nil {
+			include = append(include, head)
+		}
+	}
+
+	// --ancestry-path relates the tips to the excluded commits, or to the
+	// commits given with it.
+	var anchors []objectID
+	for _, name := range ancestryNames {
+		hash, err := resolveCommit(name)
+		if err != nil {
+			return err
+		}
+		anchors = append(anchors, hash)
+	}
+	if ancestryPath {
+		for _, hash := range exclude {
+			if hash, ok, err := peelToCommit(hash); err == nil && ok {
+				anchors = append(anchors, hash)
+			}
+		}
+		if len(anchors) == 0 {
+			return fmt.Errorf("--ancestry-path given but there are no bottom commits")
+		}
+	}
+
+	var decorations map[objectID][]decoration
+	if opts.decorate != decorateNo || simplifyByDecor {
+		if decorations, err = loadDecorations(); err != nil {
+			return err
+		}
+	}
+
+	excluded := make(map[objectID]bool)
+	err = walkCommitNodes(exclude, func(hash objectID, node *commitNode) error {
+		excluded[hash] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	shown := 0
+	show := func(hash objectID, c *commit) error {
+		if opts.maxCount >= 0 && shown >= opts.maxCount {
+			return errStopWalk
+		}
+		// With --diff-filter, only commits with changes it lets through
+		// are shown, which leaves out merges.
+		if diffOpts.filter != "" {
+			if len(c.parents) > 1 {
+				return nil
+			}
+			pairs, err := commitPairs(c)
+			if err != nil {
+				return err
+			}
+			if len(filterPairs(pairs, diffOpts.filter)) == 0 {
+				return nil
+			}
+		}
+		if shown > 0 && !opts.oneline {
+			out.WriteString("\n")
+		}
+		writeLogEntry(out, hash, c, &opts, decorations)
+		shown++
+		// Like git without -m or --cc, merges are shown without a diff.
+		if !showDiff || len(c.parents) > 1 {
+			return nil
+		}
+		return writeCommitDiff(out, c, diffOpts, opts.oneline)
+	}
+	if len(anchors) == 0 && !simplifyByDecor {
+		return walkCommits(include, func(hash objectID, c *commit) error {
+			if excluded[hash] {
+				return nil
+			}
+			return show(hash, c)
+		})
+	}
+
+	// Both refinements need to see the whole walk first.
+	var list []walkedCommit
+	err = walkCommits(include, func(hash objectID, c *commit) error {
+		if !excluded[hash] {
+			list = append(list, walkedCommit{hash: hash, commit: c})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(anchors) > 0 {
+		list = limitToAncestry(list, anchors)
+	}
+	if simplifyByDecor {
+		// Like git, simplifying by decoration implies --topo-order.
+		list = sortTopologically(list)
+		decorated := make(map[objectID]bool, len(decorations))
+		for hash := range decorations {
+			decorated[hash] = true
+		}
+		if list, err = simplifyByDecoration(list, decorated); err != nil {
+			return err
+		}
+	}
+	for _, w := range list {
+		if err := show(w.hash, w.commit); err != nil {
+			if errors.Is(err, errStopWalk) {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func isDigits(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, c := range s {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,127 @@
+package mygit
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// lsRemoteMatches tells whether an ls-remote pattern names ref: like git,
+// each pattern is matched as a glob against the trailing components.
+func lsRemoteMatches(ref string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if wildmatch("*/"+p, "/"+ref, false) {
+			return true
+		}
+	}
+	return false
+}
+
+func runLsRemote(args []string) error {
+	var positional []string
+	heads, tags, refsOnly, quiet, symrefs, exitCode, getURL := false, false, false, false, false, false, false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			positional = append(positional, args[i+1:]...)
+			i = len(args)
+		case arg == "--heads":
+			heads = true
+		case arg == "-t" || arg == "--tags":
+			tags = true
+		case arg == "--refs":
+			refsOnly = true
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case arg == "--symref":
+			symrefs = true
+		case arg == "--exit-code":
+			exitCode = true
+		case arg == "--get-url":
+			getURL = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	name := ""
+	if len(positional) > 0 {
+		name = positional[0]
+	} else {
+		if branch, err := symrefTarget("HEAD"); err == nil {
+			name, _ = cfg.get("branch." + strings.TrimPrefix(branch, "refs/heads/") + ".remote")
+		}
+		if name == "" {
+			name = "origin"
+		}
+		if _, ok := cfg.get("remote." + name + ".url"); !ok {
+			return fmt.Errorf("No remote configured to list refs from.")
+		}
+	}
+	remote, err := lookupRemote(cfg, name)
+	if err != nil {
+		return err
+	}
+	if getURL {
+		fmt.Println(remote.url)
+		return nil
+	}
+	var patterns []string
+	if len(positional) > 1 {
+		patterns = positional[1:]
+	}
+
+	// Protocol v2 servers are asked for just the refs wanted; older ones
+	// advertise them all and are left before any negotiation starts.
+	var prefixes []string
+	if heads {
+		prefixes = append(prefixes, "refs/heads/")
+	}
+	if tags {
+		prefixes = append(prefixes, "refs/tags/")
+	}
+	t, adv, err := openUploadPack(cfg, remote.url, prefixes)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		t.close()
+	}
+
+	if len(positional) == 0 && !quiet {
+		fmt.Fprintf(os.Stderr, "From %s\n", remote.url)
+	}
+
+	// Peeled tags are listed as refs of their own, which patterns must
+	// match separately.
+	found := false
+	for _, ref := range adv.refs {
+		if (heads || tags) && !(heads && strings.HasPrefix(ref.name, "refs/heads/") || tags && strings.HasPrefix(ref.name, "refs/tags/")) {
+			continue
+		}
+		if (!refsOnly || strings.HasPrefix(ref.name, "refs/")) && lsRemoteMatches(ref.name, patterns) {
+			found = true
+			if symrefs && ref.symref != "" {
+				fmt.Printf("ref: %s\t%s\n", ref.symref, ref.name)
+			}
+			fmt.Printf("%s\t%s\n", ref.hash, ref.name)
+		}
+		if !refsOnly && ref.peeled != (objectID{}) && lsRemoteMatches(ref.name+"^{}", patterns) {
+			found = true
+			fmt.Printf("%s\t%s^{}\n", ref.peeled, ref.name)
+		}
+	}
+	if exitCode && !found {
+		os.Exit(2)
+	}
+	return nil
+}
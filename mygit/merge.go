@@ -0,0 +1,728 @@
+package mygit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+var (
+	mergeHeadFile = ".git/MERGE_HEAD"
+	mergeMsgFile  = ".git/MERGE_MSG"
+	mergeModeFile = ".git/MERGE_MODE"
+)
+
+// When a merge may fast-forward, as set by --ff, --no-ff, --ff-only and
+// merge.ff.
+const (
+	fastForwardAllow = iota
+	fastForwardNever
+	fastForwardOnly
+)
+
+// treeMerge merges the files of two commits against their common
+// ancestor, like git's ort strategy without rename detection.
+type treeMerge struct {
+	opts mergeFileOptions
+	// depth is above zero while merging several merge bases into a
+	// virtual ancestor. Conflicts are then left in the content and not
+	// reported.
+	depth int
+	out   io.Writer
+}
+
+func (m *treeMerge) say(format string, args ...any) {
+	if m.depth == 0 {
+		fmt.Fprintf(m.out, format+"\n", args...)
+	}
+}
+
+// commitFiles lists the files of a commit's tree.
+func commitFiles(hash objectID) (map[string]diffEntry, error) {
+	c, err := readCommit(hash)
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string]diffEntry)
+	return files, treeFiles(c.tree, "", files)
+}
+
+// baseLabel names the merge base in diff3 conflict markers.
+func baseLabel(bases []objectID) string {
+	switch len(bases) {
+	case 0:
+		return "empty tree"
+	case 1:
+		return shortHash(bases[0])
+	}
+	return "merged common ancestors"
+}
+
+// baseFiles returns the files to merge against. Several merge bases are
+// merged into a virtual ancestor first, oldest first, the result of each
+// step standing for a commit with the merged bases as parents.
+func (m *treeMerge) baseFiles(bases []objectID) (map[string]diffEntry, error) {
+	if len(bases) == 0 {
+		return map[string]diffEntry{}, nil
+	}
+	bases = slices.Clone(bases)
+	slices.Reverse(bases)
+
+	files, err := commitFiles(bases[0])
+	if err != nil {
+		return nil, err
+	}
+	tips := bases[:1]
+	for _, next := range bases[1:] {
+		ancestors, err := mergeBases(tips, []objectID{next})
+		if err != nil {
+			return nil, err
+		}
+		inner := &treeMerge{
+			opts: mergeFileOptions{
+				base:       baseLabel(ancestors),
+				ours:       "Temporary merge branch 1",
+				theirs:     "Temporary merge branch 2",
+				style:      m.opts.style,
+				markerSize: m.opts.markerSize + 2,
+				flags:      m.opts.flags,
+			},
+			depth: m.depth + 1,
+			out:   m.out,
+		}
+		ancestorFiles, err := inner.baseFiles(ancestors)
+		if err != nil {
+			return nil, err
+		}
+		nextFiles, err := commitFiles(next)
+		if err != nil {
+			return nil, err
+		}
+		merged, _, err := inner.mergeFiles(ancestorFiles, files, nextFiles)
+		if err != nil {
+			return nil, err
+		}
+		files = make(map[string]diffEntry)
+		for path, u := range merged {
+			files[path] = u.file
+		}
+		tips = append(tips, next)
+	}
+	return files, nil
+}
+
+// mergeFiles merges the changes from base to ours and from base to theirs
+// and returns the state of every path in the result along with the
+// number of conflicting paths.
+func (m *treeMerge) mergeFiles(base, ours, theirs map[string]diffEntry) (map[string]pathUpdate, int, error) {
+	seen := make(map[string]bool)
+	var paths []string
+	for _, files := range []map[string]diffEntry{base, ours, theirs} {
+		for path := range files {
+			if !seen[path] {
+				seen[path] = true
+				paths = append(paths, path)
+			}
+		}
+	}
+	sort.Strings(paths)
+
+	result := make(map[string]pathUpdate)
+	conflicts := 0
+	for _, path := range paths {
+		u, err := m.mergePath(path, base[path], ours[path], theirs[path])
+		if err != nil {
+			return nil, 0, err
+		}
+		if u.conflict {
+			conflicts++
+		}
+		if u.conflict || u.file.mode != 0 {
+			result[path] = u
+		}
+	}
+	return result, conflicts, nil
+}
+
+func sameFile(a, b diffEntry) bool {
+	return a.mode == b.mode && a.hash == b.hash
+}
+
+// mergePath merges one path. A side that left it alone takes the other
+// side's version; otherwise deletions conflict with modifications and
+// regular files are merged line by line.
+func (m *treeMerge) mergePath(path string, b, o, t diffEntry) (pathUpdate, error) {
+	switch {
+	case sameFile(o, t):
+		return pathUpdate{file: o}, nil
+	case sameFile(b, o):
+		return pathUpdate{file: t}, nil
+	case sameFile(b, t):
+		return pathUpdate{file: o}, nil
+	case o.mode == 0 || t.mode == 0:
+		if m.depth > 0 {
+			return pathUpdate{file: b}, nil
+		}
+		deletedIn, modifiedIn, kept := m.opts.ours, m.opts.theirs, t
+		if t.mode == 0 {
+			deletedIn, modifiedIn, kept = m.opts.theirs, m.opts.ours, o
+		}
+		m.say("CONFLICT (modify/delete): %s deleted in %s and modified in %s.  Version %s of %s left in tree.",
+			path, deletedIn, modifiedIn, modifiedIn, path)
+		return pathUpdate{file: kept, conflict: true, stages: [3]diffEntry{b, o, t}}, nil
+	}
+
+	m.say("Auto-merging %s", path)
+	merged := o
+	clean := true
+	switch {
+	case o.mode == t.mode:
+	case b.mode == o.mode:
+		merged.mode = t.mode
+	case b.mode != t.mode:
+		clean = false
+	}
+
+	regular := uint32(modeRegular & modeTypeMask)
+	if o.mode&modeTypeMask != regular || t.mode&modeTypeMask != regular {
+		// Symbolic links and submodules cannot be merged: ours is kept.
+		if o.hash != t.hash {
+			clean = false
+		}
+	} else {
+		data, ok, err := m.mergeBlobs(path, b, o, t)
+		if err != nil {
+			return pathUpdate{}, err
+		}
+		if merged.hash, err = storeObject(blobObject, data); err != nil {
+			return pathUpdate{}, err
+		}
+		merged.data = data
+		clean = clean && ok
+	}
+
+	if clean || m.depth > 0 {
+		return pathUpdate{file: merged}, nil
+	}
+	if b.mode == 0 {
+		m.say("CONFLICT (add/add): Merge conflict in %s", path)
+	} else {
+		m.say("CONFLICT (content): Merge conflict in %s", path)
+	}
+	return pathUpdate{file: merged, conflict: true, stages: [3]diffEntry{b, o, t}}, nil
+}
+
+// mergeBlobs merges the content of a file and reports whether it merged
+// cleanly. Binary files are not merged: ours is kept, or the base in a
+// virtual ancestor.
+func (m *treeMerge) mergeBlobs(path string, b, o, t diffEntry) ([]byte, bool, error) {
+	var contents [3][]byte
+	for i, e := range []diffEntry{b, o, t} {
+		data, err := e.content()
+		if err != nil {
+			return nil, false, err
+		}
+		contents[i] = data
+	}
+	if binary, err := mergeAsBinary(path, contents[:]...); err != nil {
+		return nil, false, err
+	} else if binary {
+		if m.depth > 0 {
+			return contents[0], false, nil
+		}
+		fmt.Fprintf(os.Stderr, "warning: Cannot merge binary files: %s (%s vs. %s)\n", path, m.opts.ours, m.opts.theirs)
+		return contents[1], false, nil
+	}
+	data, conflicts := mergeContent(contents[0], contents[1], contents[2], &m.opts)
+	return data, conflicts == 0, nil
+}
+
+// mergeMessage is the default message of a merge commit, which tells
+// what kind of ref was merged and, unless it is a main branch, into
+// which branch.
+func mergeMessage(cfg *config, name string) (string, error) {
+	kind := "commit"
+	for _, pattern := range refSearchOrder {
+		ref := fmt.Sprintf(pattern, name)
+		if _, err := resolveRef(ref); err != nil {
+			if errors.Is(err, errRefNotFound) {
+				continue
+			}
+			return "", err
+		}
+		switch {
+		case strings.HasPrefix(ref, "refs/heads/"):
+			kind = "branch"
+		case strings.HasPrefix(ref, "refs/remotes/"):
+			kind = "remote-tracking branch"
+		case strings.HasPrefix(ref, "refs/tags/"):
+			kind = "tag"
+		}
+		break
+	}
+	message := fmt.Sprintf("Merge %s '%s'", kind, name)
+
+	head, err := symrefTarget("HEAD")
+	if err != nil {
+		return "", err
+	}
+	branch, ok := strings.CutPrefix(head, "refs/heads/")
+	if !ok {
+		return message, nil
+	}
+	suppress := cfg.getAll("merge.suppressDest")
+	if len(suppress) == 0 {
+		suppress = []string{"main", "master"}
+	}
+	for _, pattern := range suppress {
+		if ok, _ := filepath.Match(pattern, branch); ok {
+			return message, nil
+		}
+	}
+	return message + " into " + branch, nil
+}
+
+// writeMergeStat prints the diffstat and summary of what a merge changed.
+func writeMergeStat(w io.Writer, cfg *config, old, new map[string]diffEntry) error {
+	opts, err := configDiffOptions(cfg)
+	if err != nil {
+		return err
+	}
+	opts.stat = true
+	pairs := diffFiles(old, new, nil, nil)
+	stats, err := diffStats(pairs, opts)
+	if err != nil {
+		return err
+	}
+	writeStat(w, stats, opts)
+	writeSummary(w, pairs, opts)
+	return nil
+}
+
+// treeUpdates lists the changes turning the files old into new.
+func treeUpdates(old, new map[string]diffEntry) map[string]pathUpdate {
+	updates := make(map[string]pathUpdate)
+	for _, p := range diffFiles(old, new, nil, nil) {
+		updates[p.path] = pathUpdate{file: p.new}
+	}
+	return updates
+}
+
+// mergeUpdates lists the changes turning the files head into the result
+// of a merge, conflicts included.
+func mergeUpdates(head map[string]diffEntry, result map[string]pathUpdate) map[string]pathUpdate {
+	updates := make(map[string]pathUpdate)
+	for path, u := range result {
+		if u.conflict || !sameFile(u.file, head[path]) {
+			updates[path] = u
+		}
+	}
+	for path := range head {
+		if _, ok := result[path]; !ok {
+			updates[path] = pathUpdate{}
+		}
+	}
+	return updates
+}
+
+// checkoutUpdates checks and applies updates to the working tree and the
+// index.
+func checkoutUpdates(cfg *config, entries []indexEntry, head map[string]diffEntry, updates map[string]pathUpdate) error {
+	if err := checkWorktree(cfg, entries, head, updates, "merge"); err != nil {
+		return err
+	}
+	entries, err := applyUpdates(entries, updates)
+	if err != nil {
+		return err
+	}
+	return writeIndex(entries)
+}
+
+// mergeConflictStyle returns the style of conflict markers set by
+// merge.conflictStyle.
+func mergeConflictStyle(cfg *config) (string, error) {
+	style, _ := cfg.get("merge.conflictStyle")
+	switch style {
+	case "":
+		style = conflictStyleMerge
+	case conflictStyleMerge, conflictStyleDiff3:
+	default:
+		return "", fmt.Errorf("unknown style '%s' given for 'merge.conflictstyle'", style)
+	}
+	return style, nil
+}
+
+// postMergeHook runs the post-merge hook after a successful merge. Like
+// in git, it cannot change the outcome, so how it exits is ignored.
+func postMergeHook(cfg *config) {
+	runHook(cfg, "post-merge", "", "0")
+}
+
+// writeOrigHead records where HEAD was before a merge.
+func writeOrigHead(head objectID) error {
+	tx := newRefTransaction()
+	tx.update("ORIG_HEAD", head, "")
+	return tx.commit()
+}
+
+// parseMergeStrategyOption handles a -X option of the merge strategy; the
+// whitespace options make changes that only touch whitespace on one side
+// give way to the other side.
+func parseMergeStrategyOption(value string, flags *diffFlags) error {
+	switch value {
+	case "ignore-space-change":
+		*flags |= diffIgnoreSpaceChange
+	case "ignore-all-space":
+		*flags |= diffIgnoreAllSpace
+	case "ignore-space-at-eol":
+		*flags |= diffIgnoreSpaceAtEOL
+	default:
+		return fmt.Errorf("unknown option for merge-recursive: -X%s", value)
+	}
+	return nil
+}
+
+func runMerge(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	ff := fastForwardAllow
+	if value, ok := cfg.get("merge.ff"); ok {
+		if value == "only" {
+			ff = fastForwardOnly
+		} else if b, err := parseConfigBool(value); err != nil {
+			return fmt.Errorf("bad config value '%s' for 'merge.ff'", value)
+		} else if !b {
+			ff = fastForwardNever
+		}
+	}
+	showStat, err := cfg.getBool("merge.stat", true)
+	if err != nil {
+		return err
+	}
+	style, err := mergeConflictStyle(cfg)
+	if err != nil {
+		return err
+	}
+
+	var message string
+	var names []string
+	var flags diffFlags
+	abort, allowUnrelated := false, false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--ff":
+			ff = fastForwardAllow
+		case arg == "--no-ff":
+			ff = fastForwardNever
+		case arg == "--ff-only":
+			ff = fastForwardOnly
+		case arg == "--stat":
+			showStat = true
+		case arg == "-n" || arg == "--no-stat":
+			showStat = false
+		case arg == "--abort":
+			abort = true
+		case arg == "--allow-unrelated-histories":
+			allowUnrelated = true
+		case arg == "-m" || arg == "--message":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			message = args[i]
+		case strings.HasPrefix(arg, "--message="):
+			message = strings.TrimPrefix(arg, "--message=")
+		case strings.HasPrefix(arg, "-m"):
+			message = strings.TrimPrefix(arg, "-m")
+		case arg == "-X" || arg == "--strategy-option":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			if err := parseMergeStrategyOption(args[i], &flags); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "-X") || strings.HasPrefix(arg, "--strategy-option="):
+			value := strings.TrimPrefix(strings.TrimPrefix(arg, "--strategy-option="), "-X")
+			if err := parseMergeStrategyOption(value, &flags); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+
+	if abort {
+		if len(names) > 0 {
+			return fmt.Errorf("--abort expects no arguments")
+		}
+		return abortMerge()
+	}
+	if _, err := os.Stat(mergeHeadFile); err == nil {
+		return fmt.Errorf("You have not concluded your merge (MERGE_HEAD exists).\nPlease, commit your changes before you merge.")
+	}
+	switch {
+	case len(names) == 0:
+		return fmt.Errorf("usage: mygit merge [--no-ff | --ff-only] [-m <message>] <commit>")
+	case len(names) > 1:
+		return fmt.Errorf("merging more than one commit is not supported")
+	}
+	name := names[0]
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if e.stage() != 0 {
+			return fmt.Errorf("Merging is not possible because you have unmerged files.")
+		}
+	}
+
+	theirs, err := resolveRevision(name)
+	if err == nil {
+		var ok bool
+		if theirs, ok, err = peelToCommit(theirs); err == nil && !ok {
+			err = errors.New("not a commit")
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("merge: %s - not something we can merge", name)
+	}
+	theirFiles, err := commitFiles(theirs)
+	if err != nil {
+		return err
+	}
+
+	head, err := resolveRef("HEAD")
+	if errors.Is(err, errRefNotFound) {
+		// Merging into an unborn branch just checks out the commit.
+		if ff == fastForwardNever {
+			return fmt.Errorf("Non-fast-forward commit does not make sense into an empty head")
+		}
+		empty := map[string]diffEntry{}
+		if err := checkoutUpdates(cfg, entries, empty, treeUpdates(empty, theirFiles)); err != nil {
+			return err
+		}
+		tx := newRefTransaction()
+		tx.update("HEAD", theirs, "initial pull")
+		return tx.commit()
+	}
+	if err != nil {
+		return err
+	}
+	headFiles, err := commitFiles(head)
+	if err != nil {
+		return err
+	}
+
+	if err := writeOrigHead(head); err != nil {
+		return err
+	}
+	bases, err := mergeBases([]objectID{head}, []objectID{theirs})
+	if err != nil {
+		return err
+	}
+	if slices.Contains(bases, theirs) {
+		fmt.Println("Already up to date.")
+		return nil
+	}
+
+	if len(bases) == 1 && bases[0] == head && ff != fastForwardNever {
+		fmt.Printf("Updating %s..%s\n", shortHash(head), shortHash(theirs))
+		if err := checkoutUpdates(cfg, entries, headFiles, treeUpdates(headFiles, theirFiles)); err != nil {
+			return err
+		}
+		tx := newRefTransaction()
+		tx.updateFrom("HEAD", head, theirs, fmt.Sprintf("merge %s: Fast-forward", name))
+		if err := tx.commit(); err != nil {
+			return err
+		}
+		fmt.Println("Fast-forward")
+		if showStat {
+			if err := writeMergeStat(os.Stdout, cfg, headFiles, theirFiles); err != nil {
+				return err
+			}
+		}
+		postMergeHook(cfg)
+		return nil
+	}
+	if ff == fastForwardOnly {
+		return fmt.Errorf("Not possible to fast-forward, aborting.")
+	}
+	if len(bases) == 0 && !allowUnrelated {
+		return fmt.Errorf("refusing to merge unrelated histories")
+	}
+
+	// The merge starts from HEAD, so staged changes would be lost.
+	indexed, _ := indexFiles(entries)
+	if staged := diffFiles(headFiles, indexed, nil, nil); len(staged) > 0 {
+		var paths []string
+		for _, p := range staged {
+			paths = append(paths, p.path)
+		}
+		return fmt.Errorf("Your local changes to the following files would be overwritten by merge:\n  %s", strings.Join(paths, " "))
+	}
+
+	if message == "" {
+		if message, err = mergeMessage(cfg, name); err != nil {
+			return err
+		}
+	}
+
+	// Messages are only shown once the working tree was updated.
+	var out bytes.Buffer
+	m := &treeMerge{
+		opts: mergeFileOptions{
+			base:       baseLabel(bases),
+			ours:       "HEAD",
+			theirs:     name,
+			style:      style,
+			markerSize: defaultConflictMarkerSize,
+			flags:      flags,
+		},
+		out: &out,
+	}
+	baseFiles, err := m.baseFiles(bases)
+	if err != nil {
+		return err
+	}
+	result, conflicts, err := m.mergeFiles(baseFiles, headFiles, theirFiles)
+	if err != nil {
+		return err
+	}
+
+	if err := checkoutUpdates(cfg, entries, headFiles, mergeUpdates(headFiles, result)); err != nil {
+		return err
+	}
+	os.Stdout.Write(out.Bytes())
+
+	if conflicts > 0 {
+		if err := stopMerge(theirs, message, ff, result); err != nil {
+			return err
+		}
+		fmt.Println("Automatic merge failed; fix conflicts and then commit the result.")
+		os.Exit(1)
+	}
+
+	files := make(map[string]diffEntry)
+	for path, u := range result {
+		files[path] = u.file
+	}
+	tree, err := writeFilesTree(files)
+	if err != nil {
+		return err
+	}
+	hash, err := commitTree(tree, []objectID{head, theirs}, message+"\n")
+	if err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	tx.updateFrom("HEAD", head, hash, fmt.Sprintf("merge %s: Merge made by the 'ort' strategy.", name))
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	fmt.Println("Merge made by the 'ort' strategy.")
+	if showStat {
+		if err := writeMergeStat(os.Stdout, cfg, headFiles, files); err != nil {
+			return err
+		}
+	}
+	postMergeHook(cfg)
+	return nil
+}
+
+// conflictsMessage appends the list of conflicting paths to message, as
+// comments that committing removes.
+func conflictsMessage(message string, result map[string]pathUpdate) string {
+	var conflicted []string
+	for path, u := range result {
+		if u.conflict {
+			conflicted = append(conflicted, path)
+		}
+	}
+	sort.Strings(conflicted)
+
+	var msg strings.Builder
+	msg.WriteString(strings.TrimRight(message, "\n") + "\n\n# Conflicts:\n")
+	for _, path := range conflicted {
+		msg.WriteString("#\t" + path + "\n")
+	}
+	return msg.String()
+}
+
+// stopMerge records a conflicted merge for the commit that concludes it:
+// MERGE_HEAD names the merged commit and MERGE_MSG holds the message,
+// listing the conflicts.
+func stopMerge(theirs objectID, message string, ff int, result map[string]pathUpdate) error {
+	mode := ""
+	if ff == fastForwardNever {
+		mode = "no-ff"
+	}
+	for file, content := range map[string]string{
+		mergeHeadFile: theirs.String() + "\n",
+		mergeMsgFile:  conflictsMessage(message, result),
+		mergeModeFile: mode,
+	} {
+		if err := os.WriteFile(file, []byte(content), 0644); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+	}
+	return nil
+}
+
+// abortMerge gives up on a conflicted merge, resetting the index and the
+// files it records to HEAD. Changes to files the merge did not touch are
+// kept.
+func abortMerge() error {
+	if _, err := os.Stat(mergeHeadFile); errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("There is no merge to abort (MERGE_HEAD missing).")
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	head, err := headFiles()
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string]pathUpdate)
+	indexed := make(map[string]bool)
+	for _, e := range entries {
+		indexed[e.path] = true
+		if e.stage() != 0 || !sameFile(diffEntry{mode: e.mode, hash: e.hash}, head[e.path]) {
+			updates[e.path] = pathUpdate{file: head[e.path]}
+		}
+	}
+	for path, file := range head {
+		if !indexed[path] {
+			updates[path] = pathUpdate{file: file}
+		}
+	}
+	if entries, err = applyUpdates(entries, updates); err != nil {
+		return err
+	}
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+	for _, file := range []string{mergeHeadFile, mergeMsgFile, mergeModeFile} {
+		if err := os.Remove(file); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", file, err)
+		}
+	}
+	return nil
+}
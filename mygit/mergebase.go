@@ -0,0 +1,236 @@
+package mygit
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"slices"
+)
+
+// Flags painted on commits while looking for merge bases.
+const (
+	paintParent1 = 1 << iota
+	paintParent2
+	paintStale
+	paintResult
+)
+
+// paintDownToCommon walks back from ones and twos, newest first, marking
+// which side reaches each commit. A commit reached from both sides is a
+// common ancestor and everything behind it is stale. It returns the
+// common ancestors in the order they were found, some of which may be
+// ancestors of others, along with the flags of every commit visited.
+func paintDownToCommon(ones, twos []objectID) ([]objectID, map[objectID]int, error) {
+	shallow, err := readShallow()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	flags := make(map[objectID]int)
+	q := &commitQueue{}
+	seq := 0
+	push := func(hash objectID) error {
+		node, err := readCommitNode(hash)
+		if err != nil {
+			return err
+		}
+		heap.Push(q, queuedCommit{hash: hash, node: node, time: node.time, seq: seq})
+		seq++
+		return nil
+	}
+	// The walk ends once only stale commits are left to look at.
+	nonStale := func() bool {
+		for _, item := range *q {
+			if flags[item.hash]&paintStale == 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, one := range ones {
+		flags[one] |= paintParent1
+		if err := push(one); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, two := range twos {
+		flags[two] |= paintParent2
+		if err := push(two); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var result []objectID
+	for nonStale() {
+		item := heap.Pop(q).(queuedCommit)
+		f := flags[item.hash] & (paintParent1 | paintParent2 | paintStale)
+		if f == paintParent1|paintParent2 {
+			if flags[item.hash]&paintResult == 0 {
+				flags[item.hash] |= paintResult
+				result = append(result, item.hash)
+			}
+			f |= paintStale
+		}
+		if shallow[item.hash] {
+			continue
+		}
+		for _, parent := range item.node.parents {
+			if flags[parent]&f == f {
+				continue
+			}
+			flags[parent] |= f
+			if err := push(parent); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return result, flags, nil
+}
+
+// mergeBases returns the best common ancestors of ones and twos: those
+// that are not ancestors of another common ancestor, newest first. Several
+// ones stand for a commit with those parents.
+func mergeBases(ones, twos []objectID) ([]objectID, error) {
+	for _, one := range ones {
+		if slices.Contains(twos, one) {
+			return []objectID{one}, nil
+		}
+	}
+	found, flags, err := paintDownToCommon(ones, twos)
+	if err != nil {
+		return nil, err
+	}
+	var bases []objectID
+	for _, hash := range found {
+		if flags[hash]&paintStale == 0 {
+			bases = append(bases, hash)
+		}
+	}
+	if len(bases) > 1 {
+		if bases, err = removeRedundant(bases); err != nil {
+			return nil, err
+		}
+	}
+	return sortByCommitDate(bases)
+}
+
+// removeRedundant drops the commits that are ancestors of another one in
+// the list.
+func removeRedundant(commits []objectID) ([]objectID, error) {
+	redundant := make([]bool, len(commits))
+	for i := range commits {
+		if redundant[i] {
+			continue
+		}
+		var others []objectID
+		var index []int
+		for j := range commits {
+			if i != j && !redundant[j] {
+				others = append(others, commits[j])
+				index = append(index, j)
+			}
+		}
+		_, flags, err := paintDownToCommon(commits[i:i+1], others)
+		if err != nil {
+			return nil, err
+		}
+		if flags[commits[i]]&paintParent2 != 0 {
+			redundant[i] = true
+		}
+		for k, other := range others {
+			if flags[other]&paintParent1 != 0 {
+				redundant[index[k]] = true
+			}
+		}
+	}
+
+	var kept []objectID
+	for i, hash := range commits {
+		if !redundant[i] {
+			kept = append(kept, hash)
+		}
+	}
+	return kept, nil
+}
+
+// sortByCommitDate orders commits newest first, keeping the order of
+// commits with the same date.
+func sortByCommitDate(commits []objectID) ([]objectID, error) {
+	times := make(map[objectID]int64, len(commits))
+	for _, hash := range commits {
+		node, err := readCommitNode(hash)
+		if err != nil {
+			return nil, err
+		}
+		times[hash] = node.time
+	}
+	slices.SortStableFunc(commits, func(a, b objectID) int {
+		switch {
+		case times[a] > times[b]:
+			return -1
+		case times[a] < times[b]:
+			return 1
+		}
+		return 0
+	})
+	return commits, nil
+}
+
+func runMergeBase(args []string) error {
+	all, ancestor := false, false
+	var names []string
+	for _, arg := range args {
+		switch arg {
+		case "-a", "--all":
+			all = true
+		case "--is-ancestor":
+			ancestor = true
+		default:
+			if len(arg) > 1 && arg[0] == '-' {
+				return fmt.Errorf("unknown option %s", arg)
+			}
+			names = append(names, arg)
+		}
+	}
+	if ancestor && (all || len(names) != 2) || len(names) < 2 {
+		return fmt.Errorf("usage: mygit merge-base [-a | --all] <commit> <commit>...\n   or: mygit merge-base --is-ancestor <commit> <commit>")
+	}
+
+	commits := make([]objectID, len(names))
+	for i, name := range names {
+		hash, err := resolveCommit(name)
+		if err != nil {
+			return err
+		}
+		commits[i] = hash
+	}
+
+	// Answers are given by the exit status alone.
+	if ancestor {
+		ok, err := isAncestor(commits[0], commits[1])
+		if err != nil {
+			return err
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return nil
+	}
+
+	// Further commits stand for a merge of all of them.
+	bases, err := mergeBases(commits[:1], commits[1:])
+	if err != nil {
+		return err
+	}
+	if len(bases) == 0 {
+		os.Exit(1)
+	}
+	if !all {
+		bases = bases[:1]
+	}
+	for _, hash := range bases {
+		fmt.Println(hash)
+	}
+	return nil
+}
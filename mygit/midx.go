@@ -0,0 +1,539 @@
+package mygit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var midxFile = ".git/objects/pack/multi-pack-index"
+
+const (
+	midxSignature  = "MIDX"
+	midxVersion    = 1
+	midxHeaderSize = 12
+	midxChunkSize  = 12
+
+	midxChunkPackNames    = 0x504e414d // PNAM
+	midxChunkOIDFanout    = 0x4f494446 // OIDF
+	midxChunkOIDLookup    = 0x4f49444c // OIDL
+	midxChunkOffsets      = 0x4f4f4646 // OOFF
+	midxChunkLargeOffsets = 0x4c4f4646 // LOFF
+
+	midxLargeOffset = 0x80000000
+)
+
+// midxEntry records which pack, by position in packNames, an object is
+// taken from and where it starts in that pack.
+type midxEntry struct {
+	hash   objectID
+	pack   int
+	offset int64
+}
+
+// multiPackIndex is the decoded content of a multi-pack-index: the packs it
+// covers, sorted by index name, and one entry per object sorted by hash.
+type multiPackIndex struct {
+	packNames []string
+	entries   []midxEntry
+}
+
+func readMultiPackIndex(path string) (*multiPackIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read multi-pack-index: %w", err)
+	}
+	if len(data) < midxHeaderSize+hashAlgo.size || string(data[:4]) != midxSignature {
+		return nil, fmt.Errorf("invalid multi-pack-index signature")
+	}
+	if data[4] != midxVersion {
+		return nil, fmt.Errorf("unsupported multi-pack-index version %d", data[4])
+	}
+	if data[5] != hashAlgo.formatID {
+		return nil, fmt.Errorf("unsupported multi-pack-index hash version %d", data[5])
+	}
+	numChunks := int(data[6])
+	numPacks := int(binary.BigEndian.Uint32(data[8:12]))
+
+	chunks := make(map[uint32][]byte)
+	table := data[midxHeaderSize:]
+	if len(table) < (numChunks+1)*midxChunkSize {
+		return nil, fmt.Errorf("truncated multi-pack-index chunk table")
+	}
+	for i := 0; i < numChunks; i++ {
+		id := binary.BigEndian.Uint32(table[i*midxChunkSize:])
+		start := binary.BigEndian.Uint64(table[i*midxChunkSize+4:])
+		end := binary.BigEndian.Uint64(table[(i+1)*midxChunkSize+4:])
+		if start > end || end > uint64(len(data)-hashAlgo.size) {
+			return nil, fmt.Errorf("invalid multi-pack-index chunk offsets")
+		}
+		chunks[id] = data[start:end]
+	}
+
+	for _, id := range []uint32{midxChunkPackNames, midxChunkOIDFanout, midxChunkOIDLookup, midxChunkOffsets} {
+		if _, ok := chunks[id]; !ok {
+			return nil, fmt.Errorf("multi-pack-index is missing chunk %08x", id)
+		}
+	}
+
+	m := &multiPackIndex{}
+	for _, name := range bytes.Split(chunks[midxChunkPackNames], []byte{0}) {
+		if len(name) > 0 {
+			m.packNames = append(m.packNames, string(name))
+		}
+	}
+	if len(m.packNames) != numPacks {
+		return nil, fmt.Errorf("multi-pack-index lists %d packs, expected %d", len(m.packNames), numPacks)
+	}
+
+	fanout := chunks[midxChunkOIDFanout]
+	if len(fanout) != 256*4 {
+		return nil, fmt.Errorf("invalid multi-pack-index fanout")
+	}
+	count := int(binary.BigEndian.Uint32(fanout[255*4:]))
+	oids, offsets, large := chunks[midxChunkOIDLookup], chunks[midxChunkOffsets], chunks[midxChunkLargeOffsets]
+	if len(oids) != count*hashAlgo.size || len(offsets) != count*8 {
+		return nil, fmt.Errorf("truncated multi-pack-index")
+	}
+
+	m.entries = make([]midxEntry, count)
+	for i := range m.entries {
+		e := &m.entries[i]
+		e.hash = objectIDFromBytes(oids[i*hashAlgo.size:])
+		e.pack = int(binary.BigEndian.Uint32(offsets[i*8:]))
+		offset := binary.BigEndian.Uint32(offsets[i*8+4:])
+		if offset&midxLargeOffset == 0 {
+			e.offset = int64(offset)
+		} else {
+			pos := int(offset&^midxLargeOffset) * 8
+			if pos+8 > len(large) {
+				return nil, fmt.Errorf("invalid multi-pack-index large offset")
+			}
+			e.offset = int64(binary.BigEndian.Uint64(large[pos:]))
+		}
+		if e.pack >= numPacks {
+			return nil, fmt.Errorf("multi-pack-index entry refers to pack %d of %d", e.pack, numPacks)
+		}
+	}
+	return m, nil
+}
+
+// find returns the entry of hash if the index has it.
+func (m *multiPackIndex) find(hash objectID) (midxEntry, bool) {
+	key := hash.bytes()
+	i := sort.Search(len(m.entries), func(i int) bool {
+		return bytes.Compare(m.entries[i].hash.bytes(), key) >= 0
+	})
+	if i < len(m.entries) && m.entries[i].hash == hash {
+		return m.entries[i], true
+	}
+	return midxEntry{}, false
+}
+
+// openMultiPackIndex reads the multi-pack-index for lookups among packs
+// and returns it with the packs it covers, by position. It is not used
+// with core.multiPackIndex off, nor when a pack it covers is gone.
+func openMultiPackIndex(packs []*pack) (*multiPackIndex, []*pack) {
+	if cfg, err := loadConfig(); err != nil {
+		return nil, nil
+	} else if use, err := cfg.getBool("core.multiPackIndex", true); err != nil || !use {
+		return nil, nil
+	}
+	m, err := readMultiPackIndex(midxFile)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		return nil, nil
+	}
+
+	byName := make(map[string]*pack, len(packs))
+	for _, p := range packs {
+		byName[strings.TrimSuffix(filepath.Base(p.path), ".pack")+".idx"] = p
+	}
+	covered := make([]*pack, len(m.packNames))
+	for i, name := range m.packNames {
+		if covered[i] = byName[name]; covered[i] == nil {
+			return nil, nil
+		}
+	}
+	for _, p := range covered {
+		p.inMidx = true
+	}
+	return m, covered
+}
+
+// encode serializes the index in the version 1 format: a header, the chunk
+// table, the PNAM, OIDF, OIDL, OOFF and (if needed) LOFF chunks and a
+// trailing checksum.
+func (m *multiPackIndex) encode() []byte {
+	var names bytes.Buffer
+	for _, name := range m.packNames {
+		names.WriteString(name)
+		names.WriteByte(0)
+	}
+	for names.Len()%4 != 0 {
+		names.WriteByte(0)
+	}
+
+	fanout := make([]byte, 256*4)
+	var counts [256]uint32
+	for _, e := range m.entries {
+		counts[e.hash[0]]++
+	}
+	var total uint32
+	for i, c := range counts {
+		total += c
+		binary.BigEndian.PutUint32(fanout[i*4:], total)
+	}
+
+	oids := make([]byte, 0, len(m.entries)*hashAlgo.size)
+	offsets := make([]byte, len(m.entries)*8)
+	var large []byte
+	for i, e := range m.entries {
+		oids = append(oids, e.hash.bytes()...)
+		binary.BigEndian.PutUint32(offsets[i*8:], uint32(e.pack))
+		if e.offset < midxLargeOffset {
+			binary.BigEndian.PutUint32(offsets[i*8+4:], uint32(e.offset))
+			continue
+		}
+		binary.BigEndian.PutUint32(offsets[i*8+4:], midxLargeOffset|uint32(len(large)/8))
+		large = binary.BigEndian.AppendUint64(large, uint64(e.offset))
+	}
+
+	type chunk struct {
+		id   uint32
+		data []byte
+	}
+	chunks := []chunk{
+		{midxChunkPackNames, names.Bytes()},
+		{midxChunkOIDFanout, fanout},
+		{midxChunkOIDLookup, oids},
+		{midxChunkOffsets, offsets},
+	}
+	if len(large) > 0 {
+		chunks = append(chunks, chunk{midxChunkLargeOffsets, large})
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(midxSignature)
+	buf.Write([]byte{midxVersion, hashAlgo.formatID, byte(len(chunks)), 0})
+	buf.Write(binary.BigEndian.AppendUint32(nil, uint32(len(m.packNames))))
+
+	offset := uint64(midxHeaderSize + (len(chunks)+1)*midxChunkSize)
+	for _, c := range chunks {
+		buf.Write(binary.BigEndian.AppendUint32(nil, c.id))
+		buf.Write(binary.BigEndian.AppendUint64(nil, offset))
+		offset += uint64(len(c.data))
+	}
+	buf.Write(make([]byte, 4))
+	buf.Write(binary.BigEndian.AppendUint64(nil, offset))
+	for _, c := range chunks {
+		buf.Write(c.data)
+	}
+
+	sum := hashAlgo.new()
+	sum.Write(buf.Bytes())
+	buf.Write(sum.Sum(nil))
+	return buf.Bytes()
+}
+
+// writeMultiPackIndex writes m to path through a lock file.
+func writeMultiPackIndex(path string, m *multiPackIndex) error {
+	lock := path + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0444)
+	if err != nil {
+		return fmt.Errorf("failed to lock multi-pack-index: %w", err)
+	}
+	if _, err := f.Write(m.encode()); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return fmt.Errorf("failed to write multi-pack-index: %w", err)
+	}
+	if err := fsyncFile(f, fsyncPackMetadata); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to write multi-pack-index: %w", err)
+	}
+	if err := os.Rename(lock, path); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to install multi-pack-index: %w", err)
+	}
+	return nil
+}
+
+// buildMultiPackIndex indexes every pack in the pack directory. When all
+// packs covered by previous still exist, its entries are carried over and
+// only the indexes of new packs are read. An object found in several packs
+// is taken from the most recently modified one.
+func buildMultiPackIndex(previous *multiPackIndex) (*multiPackIndex, error) {
+	idxFiles, err := filepath.Glob(filepath.Join(packDir, "pack-*.idx"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+
+	type packFile struct {
+		name  string
+		mtime int64
+	}
+	var packs []packFile
+	present := make(map[string]bool)
+	for _, idxFile := range idxFiles {
+		fi, err := os.Stat(strings.TrimSuffix(idxFile, ".idx") + ".pack")
+		if err != nil {
+			continue
+		}
+		name := filepath.Base(idxFile)
+		packs = append(packs, packFile{name: name, mtime: fi.ModTime().UnixNano()})
+		present[name] = true
+	}
+	sort.Slice(packs, func(i, j int) bool { return packs[i].name < packs[j].name })
+
+	m := &multiPackIndex{}
+	packID := make(map[string]int)
+	for i, p := range packs {
+		m.packNames = append(m.packNames, p.name)
+		packID[p.name] = i
+	}
+
+	chosen := make(map[objectID]midxEntry)
+	reused := make(map[string]bool)
+	if previous != nil && previous.coveredBy(present) {
+		for _, e := range previous.entries {
+			name := previous.packNames[e.pack]
+			chosen[e.hash] = midxEntry{hash: e.hash, pack: packID[name], offset: e.offset}
+		}
+		for _, name := range previous.packNames {
+			reused[name] = true
+		}
+	}
+
+	var added []packFile
+	for _, p := range packs {
+		if !reused[p.name] {
+			added = append(added, p)
+		}
+	}
+	sort.SliceStable(added, func(i, j int) bool { return added[i].mtime > added[j].mtime })
+
+	for _, p := range added {
+		idx, err := readPackIndex(filepath.Join(packDir, p.name))
+		if err != nil {
+			return nil, err
+		}
+		for i := 0; i < idx.count; i++ {
+			hash := idx.hashAt(i)
+			if e, ok := chosen[hash]; ok && (!reused[packs[e.pack].name] || packs[e.pack].mtime >= p.mtime) {
+				continue
+			}
+			chosen[hash] = midxEntry{hash: hash, pack: packID[p.name], offset: idx.offsetAt(i)}
+		}
+	}
+
+	m.entries = make([]midxEntry, 0, len(chosen))
+	for _, e := range chosen {
+		m.entries = append(m.entries, e)
+	}
+	sort.Slice(m.entries, func(i, j int) bool {
+		return bytes.Compare(m.entries[i].hash[:], m.entries[j].hash[:]) < 0
+	})
+	return m, nil
+}
+
+// coveredBy reports whether every pack the index refers to is in present.
+func (m *multiPackIndex) coveredBy(present map[string]bool) bool {
+	for _, name := range m.packNames {
+		if !present[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// unreferencedPacks returns the packs none of whose objects are selected by
+// the index, because every object is also found in another pack.
+func (m *multiPackIndex) unreferencedPacks() []string {
+	used := make([]bool, len(m.packNames))
+	for _, e := range m.entries {
+		used[e.pack] = true
+	}
+	var unused []string
+	for i, name := range m.packNames {
+		if !used[i] {
+			unused = append(unused, name)
+		}
+	}
+	return unused
+}
+
+// dropPacks removes packs from the index, renumbering the remaining ones.
+// Only packs without selected objects may be dropped.
+func (m *multiPackIndex) dropPacks(names []string) {
+	drop := make(map[string]bool)
+	for _, name := range names {
+		drop[name] = true
+	}
+	remap := make([]int, len(m.packNames))
+	var kept []string
+	for i, name := range m.packNames {
+		remap[i] = len(kept)
+		if !drop[name] {
+			kept = append(kept, name)
+		}
+	}
+	for i := range m.entries {
+		m.entries[i].pack = remap[m.entries[i].pack]
+	}
+	m.packNames = kept
+}
+
+// updateMultiPackIndex refreshes the multi-pack-index after packs were
+// added. With expire set, packs whose objects are all available from other
+// packs are deleted, unless they carry a .keep file.
+func updateMultiPackIndex(expire bool) error {
+	// A missing or unreadable index is simply rebuilt from scratch.
+	previous, err := readMultiPackIndex(midxFile)
+	if err != nil {
+		previous = nil
+	}
+
+	m, err := buildMultiPackIndex(previous)
+	if err != nil {
+		return err
+	}
+
+	if expire {
+		var expired []string
+		for _, name := range m.unreferencedPacks() {
+			base := filepath.Join(packDir, strings.TrimSuffix(name, ".idx"))
+			if _, err := os.Stat(base + ".keep"); err == nil {
+				continue
+			}
+			if err := removePack(base + ".pack"); err != nil {
+				return err
+			}
+			expired = append(expired, name)
+		}
+		m.dropPacks(expired)
+		if len(expired) > 0 {
+			reloadPacks()
+		}
+	}
+
+	if len(m.packNames) == 0 {
+		return removeMultiPackIndex()
+	}
+	return writeMultiPackIndex(midxFile, m)
+}
+
+// removeMultiPackIndex deletes the multi-pack-index, which must happen
+// whenever a pack it covers is removed by other means.
+func removeMultiPackIndex() error {
+	if err := os.Remove(midxFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove multi-pack-index: %w", err)
+	}
+	return nil
+}
+
+// verifyMultiPackIndex checks the multi-pack-index against its checksum
+// and the indexes of the packs it covers, reporting each problem. It
+// returns false if any was found.
+func verifyMultiPackIndex() (bool, error) {
+	data, err := os.ReadFile(midxFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to read multi-pack-index: %w", err)
+	}
+	m, err := readMultiPackIndex(midxFile)
+	if err != nil {
+		return false, err
+	}
+
+	ok := true
+	report := func(format string, args ...any) {
+		fmt.Fprintf(os.Stderr, "error: "+format+"\n", args...)
+		ok = false
+	}
+	sum := hashAlgo.new()
+	sum.Write(data[:len(data)-hashAlgo.size])
+	if !bytes.Equal(sum.Sum(nil), data[len(data)-hashAlgo.size:]) {
+		report("incorrect checksum")
+	}
+
+	indexes := make([]*packIndex, len(m.packNames))
+	for i, name := range m.packNames {
+		if indexes[i], err = readPackIndex(filepath.Join(packDir, name)); err != nil {
+			report("failed to load pack-index for packfile %s", name)
+		}
+	}
+	for i, e := range m.entries {
+		if i > 0 && bytes.Compare(m.entries[i-1].hash[:], e.hash[:]) >= 0 {
+			report("oid lookup out of order: oid[%d] = %s >= %s = oid[%d]", i-1, m.entries[i-1].hash, e.hash, i)
+		}
+		idx := indexes[e.pack]
+		if idx == nil {
+			continue
+		}
+		pos, found := idx.find(e.hash)
+		if !found {
+			report("failed to load pack entry for oid[%d] = %s", i, e.hash)
+			continue
+		}
+		if offset := idx.offsetAt(pos); offset != e.offset {
+			report("incorrect object offset for oid[%d] = %s: %x != %x", i, e.hash, e.offset, offset)
+		}
+	}
+	return ok, nil
+}
+
+func runMultiPackIndex(args []string) error {
+	var subcommand string
+	for _, arg := range args {
+		switch {
+		case arg == "--progress" || arg == "--no-progress":
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		case subcommand != "":
+			return fmt.Errorf("too many arguments")
+		default:
+			subcommand = arg
+		}
+	}
+
+	switch subcommand {
+	case "write", "expire":
+		idxFiles, err := filepath.Glob(filepath.Join(packDir, "pack-*.idx"))
+		if err != nil {
+			return fmt.Errorf("failed to list packs: %w", err)
+		}
+		if len(idxFiles) == 0 && subcommand == "write" {
+			fmt.Fprintln(os.Stderr, "error: no pack files to index.")
+			os.Exit(1)
+		}
+		return updateMultiPackIndex(subcommand == "expire")
+	case "verify":
+		ok, err := verifyMultiPackIndex()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return nil
+	case "":
+		return fmt.Errorf("usage: mygit multi-pack-index [--[no-]progress] (write | verify | expire)")
+	}
+	return fmt.Errorf("unknown subcommand: `%s'", subcommand)
+}
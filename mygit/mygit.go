@@ -0,0 +1,732 @@
+// Package mygit implements the mygit commands, and gives other programs
+// read access to a repository through Repository.
+package mygit
+
+import (
+	"compress/zlib"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// objDir is where objects are read from and written to. Like packDir,
+// midxFile and commitGraphFile, it moves to the common directory of a
+// linked worktree and while looking into a submodule.
+var objDir = ".git/objects"
+
+var ignoredDirs = []string{".", "..", ".git"}
+
+// Main runs the mygit command named by os.Args in the repository of the
+// working directory, exiting the process when it fails.
+func Main() {
+	if len(os.Args) < 2 {
+		fmt.Println("usage: mygit <command> [<args>...]")
+		os.Exit(1)
+	}
+
+	// init and clone make a repository of their own.
+	if command := os.Args[1]; command != "init" && command != "clone" {
+		if err := setupGitDir(); err != nil {
+			slog.Error("Failed to set up git directory", "err", err)
+			os.Exit(1)
+		}
+	}
+	if err := loadRepositoryFormat(); err != nil {
+		slog.Error("Failed to read repository format", "err", err)
+		os.Exit(1)
+	}
+
+	switch command := os.Args[1]; command {
+	case "init":
+		if err := initRepo(os.Args[2:]); err != nil {
+			slog.Error("Failed to initialize repo", "err", err)
+			os.Exit(1)
+		}
+	case "bundle":
+		if err := runBundle(os.Args[2:]); err != nil {
+			slog.Error("Error bundling", "err", err)
+			os.Exit(1)
+		}
+	case "cat-file":
+		if err := runCatFile(os.Args[2:]); err != nil {
+			slog.Error("Error reading object", "err", err)
+			os.Exit(1)
+		}
+	case "hash-object":
+		if err := runHashObject(os.Args[2:]); err != nil {
+			slog.Error("Error hashing object", "err", err)
+			os.Exit(1)
+		}
+	case "ls-tree":
+		if len(os.Args) < 3 {
+			fmt.Println("usage: mygit ls-tree [--name-only] <hash>")
+			os.Exit(1)
+		}
+		var hexHash string
+		nameOnly := false
+		if os.Args[2] == "--name-only" {
+			nameOnly = true
+			hexHash = os.Args[3]
+		} else {
+			hexHash = os.Args[2]
+		}
+		treeEntries, err := lsTree(hexHash, nameOnly)
+		if err != nil {
+			slog.Error("Error listing tree", "err", err)
+			os.Exit(1)
+		}
+		for _, entry := range treeEntries {
+			fmt.Println(entry)
+		}
+	case "write-tree":
+		if len(os.Args) < 2 {
+			fmt.Println("usage: mygit write-tree")
+			os.Exit(1)
+		}
+		hash, err := writeTree(".")
+		if err != nil {
+			slog.Error("Error writing tree", "err", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%x\n", hash)
+	case "commit-tree":
+		if len(os.Args) < 3 {
+			fmt.Println("usage: mygit commit-tree <tree> [-p <parent>]... -m <message>")
+			os.Exit(1)
+		}
+		tree, err := parseHash(os.Args[2])
+		if err != nil {
+			slog.Error("Invalid tree", "err", err)
+			os.Exit(1)
+		}
+		var parents []objectID
+		var message string
+		for i := 3; i+1 < len(os.Args); i += 2 {
+			switch os.Args[i] {
+			case "-p":
+				parent, err := parseHash(os.Args[i+1])
+				if err != nil {
+					slog.Error("Invalid parent", "err", err)
+					os.Exit(1)
+				}
+				parents = append(parents, parent)
+			case "-m":
+				message = os.Args[i+1] + "\n"
+			}
+		}
+		hash, err := commitTree(tree, parents, message)
+		if err != nil {
+			slog.Error("Error creating commit", "err", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%x\n", hash)
+	case "add":
+		if err := runAdd(os.Args[2:]); err != nil {
+			slog.Error("Error adding files", "err", err)
+			os.Exit(1)
+		}
+	case "am":
+		if err := runAm(os.Args[2:]); err != nil {
+			slog.Error("Error applying mailbox", "err", err)
+			os.Exit(1)
+		}
+	case "apply":
+		if err := runApply(os.Args[2:]); err != nil {
+			slog.Error("Error applying patch", "err", err)
+			os.Exit(1)
+		}
+	case "archive":
+		if err := runArchive(os.Args[2:]); err != nil {
+			slog.Error("Error creating archive", "err", err)
+			os.Exit(1)
+		}
+	case "bisect":
+		if err := runBisect(os.Args[2:]); err != nil {
+			slog.Error("Error bisecting", "err", err)
+			os.Exit(1)
+		}
+	case "blame":
+		if err := runBlame(os.Args[2:]); err != nil {
+			slog.Error("Error blaming", "err", err)
+			os.Exit(1)
+		}
+	case "check-attr":
+		if err := runCheckAttr(os.Args[2:]); err != nil {
+			slog.Error("Error checking attributes", "err", err)
+			os.Exit(1)
+		}
+	case "checkout":
+		if err := runCheckout(os.Args[2:]); err != nil {
+			slog.Error("Error checking out", "err", err)
+			os.Exit(1)
+		}
+	case "commit-graph":
+		if err := runCommitGraph(os.Args[2:]); err != nil {
+			slog.Error("Error running commit-graph", "err", err)
+			os.Exit(1)
+		}
+	case "commit":
+		if err := runCommit(os.Args[2:]); err != nil {
+			slog.Error("Error committing", "err", err)
+			os.Exit(1)
+		}
+	case "config":
+		if err := runConfig(os.Args[2:]); err != nil {
+			slog.Error("Error running config", "err", err)
+			os.Exit(1)
+		}
+	case "clone":
+		if err := runClone(os.Args[2:]); err != nil {
+			slog.Error("Error cloning", "err", err)
+			os.Exit(1)
+		}
+	case "describe":
+		if err := runDescribe(os.Args[2:]); err != nil {
+			slog.Error("Error describing", "err", err)
+			os.Exit(1)
+		}
+	case "shortlog":
+		if err := runShortlog(os.Args[2:]); err != nil {
+			slog.Error("Error summarizing log", "err", err)
+			os.Exit(1)
+		}
+	case "for-each-ref":
+		if err := runForEachRef(os.Args[2:]); err != nil {
+			slog.Error("Error listing refs", "err", err)
+			os.Exit(1)
+		}
+	case "format-patch":
+		if err := runFormatPatch(os.Args[2:]); err != nil {
+			slog.Error("Error formatting patches", "err", err)
+			os.Exit(1)
+		}
+	case "show":
+		if err := runShow(os.Args[2:]); err != nil {
+			slog.Error("Error showing", "err", err)
+			os.Exit(1)
+		}
+	case "fetch":
+		if err := runFetch(os.Args[2:]); err != nil {
+			slog.Error("Error fetching", "err", err)
+			os.Exit(1)
+		}
+	case "ls-remote":
+		if err := runLsRemote(os.Args[2:]); err != nil {
+			slog.Error("Error listing remote refs", "err", err)
+			os.Exit(1)
+		}
+	case "grep":
+		if err := runGrep(os.Args[2:]); err != nil {
+			slog.Error("Error searching", "err", err)
+			os.Exit(1)
+		}
+	case "log":
+		if err := runLog(os.Args[2:]); err != nil {
+			slog.Error("Error showing log", "err", err)
+			os.Exit(1)
+		}
+	case "push":
+		if err := runPush(os.Args[2:]); err != nil {
+			slog.Error("Error pushing", "err", err)
+			os.Exit(1)
+		}
+	case "multi-pack-index":
+		if err := runMultiPackIndex(os.Args[2:]); err != nil {
+			slog.Error("Error running multi-pack-index", "err", err)
+			os.Exit(1)
+		}
+	case "repack":
+		if err := runRepack(os.Args[2:]); err != nil {
+			slog.Error("Error repacking", "err", err)
+			os.Exit(1)
+		}
+	case "rev-list":
+		if err := runRevList(os.Args[2:]); err != nil {
+			slog.Error("Error listing revisions", "err", err)
+			os.Exit(1)
+		}
+	case "fsck":
+		if err := runFsck(os.Args[2:]); err != nil {
+			slog.Error("Error checking repository", "err", err)
+			os.Exit(1)
+		}
+	case "gc":
+		if err := runGC(os.Args[2:]); err != nil {
+			slog.Error("Error running gc", "err", err)
+			os.Exit(1)
+		}
+	case "count-objects":
+		if err := runCountObjects(os.Args[2:]); err != nil {
+			slog.Error("Error counting objects", "err", err)
+			os.Exit(1)
+		}
+	case "credential":
+		if err := runCredential(os.Args[2:]); err != nil {
+			slog.Error("Error running credential", "err", err)
+			os.Exit(1)
+		}
+	case "credential-cache":
+		if err := runCredentialCache(os.Args[2:]); err != nil {
+			slog.Error("Error running credential cache", "err", err)
+			os.Exit(1)
+		}
+	case "credential-store":
+		if err := runCredentialStore(os.Args[2:]); err != nil {
+			slog.Error("Error running credential store", "err", err)
+			os.Exit(1)
+		}
+	case "credential-cache--daemon":
+		if err := runCredentialCacheDaemon(os.Args[2:]); err != nil {
+			slog.Error("Error running credential cache daemon", "err", err)
+			os.Exit(1)
+		}
+	case "prune":
+		if err := runPrune(os.Args[2:]); err != nil {
+			slog.Error("Error pruning", "err", err)
+			os.Exit(1)
+		}
+	case "diff":
+		if err := runDiff(os.Args[2:]); err != nil {
+			slog.Error("Error showing diff", "err", err)
+			os.Exit(1)
+		}
+	case "diff-tree":
+		if err := runDiffTree(os.Args[2:]); err != nil {
+			slog.Error("Error comparing trees", "err", err)
+			os.Exit(1)
+		}
+	case "merge":
+		if err := runMerge(os.Args[2:]); err != nil {
+			slog.Error("Error merging", "err", err)
+			os.Exit(1)
+		}
+	case "merge-base":
+		if err := runMergeBase(os.Args[2:]); err != nil {
+			slog.Error("Error finding merge base", "err", err)
+			os.Exit(1)
+		}
+	case "read-tree":
+		if err := runReadTree(os.Args[2:]); err != nil {
+			slog.Error("Error reading tree", "err", err)
+			os.Exit(1)
+		}
+	case "rebase":
+		if err := runRebase(os.Args[2:]); err != nil {
+			slog.Error("Error rebasing", "err", err)
+			os.Exit(1)
+		}
+	case "restore":
+		if err := runRestore(os.Args[2:]); err != nil {
+			slog.Error("Error restoring files", "err", err)
+			os.Exit(1)
+		}
+	case "revert":
+		if err := runRevert(os.Args[2:]); err != nil {
+			slog.Error("Error reverting", "err", err)
+			os.Exit(1)
+		}
+	case "patch-id":
+		if err := runPatchID(os.Args[2:]); err != nil {
+			slog.Error("Error computing patch ids", "err", err)
+			os.Exit(1)
+		}
+	case "notes":
+		if err := runNotes(os.Args[2:]); err != nil {
+			slog.Error("Error handling notes", "err", err)
+			os.Exit(1)
+		}
+	case "sparse-checkout":
+		if err := runSparseCheckout(os.Args[2:]); err != nil {
+			slog.Error("Error running sparse-checkout", "err", err)
+			os.Exit(1)
+		}
+	case "show-ref":
+		if err := runShowRef(os.Args[2:]); err != nil {
+			slog.Error("Error showing refs", "err", err)
+			os.Exit(1)
+		}
+	case "stats":
+		if err := runStats(os.Args[2:]); err != nil {
+			slog.Error("Error collecting stats", "err", err)
+			os.Exit(1)
+		}
+	case "status":
+		if err := runStatus(os.Args[2:]); err != nil {
+			slog.Error("Error reading status", "err", err)
+			os.Exit(1)
+		}
+	case "stash":
+		if err := runStash(os.Args[2:]); err != nil {
+			slog.Error("Error stashing", "err", err)
+			os.Exit(1)
+		}
+	case "tag":
+		if err := runTag(os.Args[2:]); err != nil {
+			slog.Error("Error tagging", "err", err)
+			os.Exit(1)
+		}
+	case "update-index":
+		if err := runUpdateIndex(os.Args[2:]); err != nil {
+			slog.Error("Error updating index", "err", err)
+			os.Exit(1)
+		}
+	case "verify-commit":
+		if err := runVerifyCommit(os.Args[2:]); err != nil {
+			slog.Error("Error verifying commit", "err", err)
+			os.Exit(1)
+		}
+	case "verify-tag":
+		if err := runVerifyTag(os.Args[2:]); err != nil {
+			slog.Error("Error verifying tag", "err", err)
+			os.Exit(1)
+		}
+	case "reflog":
+		if err := runReflog(os.Args[2:]); err != nil {
+			slog.Error("Error showing reflog", "err", err)
+			os.Exit(1)
+		}
+	case "remote":
+		if err := runRemote(os.Args[2:]); err != nil {
+			slog.Error("Error managing remotes", "err", err)
+			os.Exit(1)
+		}
+	case "var":
+		if err := runVar(os.Args[2:]); err != nil {
+			slog.Error("Error reading variable", "err", err)
+			os.Exit(1)
+		}
+	case "worktree":
+		if err := runWorktree(os.Args[2:]); err != nil {
+			slog.Error("Error managing worktrees", "err", err)
+			os.Exit(1)
+		}
+
+	default:
+		slog.Error("Unknown command", slog.String("command", command))
+		os.Exit(1)
+	}
+}
+
+func initRepo(args []string) error {
+	format := hashAlgo
+	refFormat := "files"
+	if env := os.Getenv("GIT_DEFAULT_REF_FORMAT"); env != "" {
+		refFormat = env
+	}
+	for _, arg := range args {
+		if name, ok := strings.CutPrefix(arg, "--object-format="); ok {
+			var err error
+			if format, err = lookupHashAlgorithm(name); err != nil {
+				return err
+			}
+		} else if name, ok := strings.CutPrefix(arg, "--ref-format="); ok {
+			refFormat = name
+		} else {
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+	if err := createRepository(format, refFormat); err != nil {
+		return err
+	}
+	fmt.Println("Initialized git directory")
+	return nil
+}
+
+// createRepository creates an empty repository in .git using the given
+// object and ref formats.
+func createRepository(format *hashAlgorithm, refFormat string) error {
+	if refFormat != "files" && refFormat != "reftable" {
+		return fmt.Errorf("unknown ref storage format '%s'", refFormat)
+	}
+
+	for _, dir := range []string{".git", ".git/objects", ".git/refs"} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("error creating directory: %w", err)
+		}
+	}
+
+	headFileContents := []byte("ref: refs/heads/main\n")
+	if refFormat == "reftable" {
+		// HEAD and refs/heads must exist for other git versions to
+		// recognize the repository, but are made invalid so that they
+		// don't mistake it for one using loose refs.
+		headFileContents = []byte("ref: refs/heads/.invalid\n")
+		if err := os.WriteFile(".git/refs/heads", []byte("this repository uses the reftable format\n"), 0644); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+		if err := os.MkdirAll(reftableDir, 0755); err != nil {
+			return fmt.Errorf("error creating directory: %w", err)
+		}
+		if err := os.WriteFile(reftableListFile, nil, 0644); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+	}
+	if err := os.WriteFile(".git/HEAD", headFileContents, 0644); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+
+	settings := [][2]string{
+		{"core.repositoryformatversion", "0"},
+		{"core.filemode", "true"},
+		{"core.bare", "false"},
+	}
+	// Repositories using anything but SHA-1 or loose refs need format
+	// version 1 so that older clients refuse to touch them.
+	if format != sha1Algorithm {
+		settings[0][1] = "1"
+		settings = append(settings, [2]string{"extensions.objectformat", format.name})
+	}
+	if refFormat != "files" {
+		settings[0][1] = "1"
+		settings = append(settings, [2]string{"extensions.refstorage", refFormat})
+	}
+	for _, kv := range settings {
+		if err := setConfigValue(configFile, kv[0], kv[1]); err != nil {
+			return fmt.Errorf("error writing config: %w", err)
+		}
+	}
+
+	if refFormat == "reftable" {
+		hashAlgo = format
+		repoFormat.refStorage = refFormat
+		if err := writeSymref("HEAD", "refs/heads/main"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runHashObject prints the IDs of files as blobs, writing them with -w.
+// Like add, it runs the conversions their attributes ask for, looked up by
+// the --path given or else by their own path, unless --no-filters is set.
+func runHashObject(args []string) error {
+	write, filters, path := false, true, ""
+	var files []string
+	for _, arg := range args {
+		switch {
+		case arg == "-w":
+			write = true
+		case arg == "--no-filters":
+			filters = false
+		case strings.HasPrefix(arg, "--path="):
+			path = strings.TrimPrefix(arg, "--path=")
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			files = append(files, arg)
+		}
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("usage: mygit hash-object [-w] [--path=<file> | --no-filters] <file>...")
+	}
+	if path != "" && !filters {
+		return fmt.Errorf("options '--path' and '--no-filters' cannot be used together")
+	}
+
+	for _, file := range files {
+		attrPath := ""
+		if filters {
+			attrPath = file
+			if path != "" {
+				attrPath = path
+			}
+		}
+		objectContent, hash, err := hashObject(file, attrPath)
+		if err != nil {
+			return err
+		}
+		if write {
+			if err := writeObject(objectContent, hash); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("%x\n", hash)
+	}
+	return nil
+}
+
+// hashObject reads a file as a blob. With attrPath set, its content is
+// converted for storage according to the attributes of that path.
+func hashObject(filePath, attrPath string) (string, objectID, error) {
+	fileContent, err := os.ReadFile(filePath)
+	if err != nil {
+		return "", objectID{}, fmt.Errorf("failed to read file: %v", err)
+	}
+	if attrPath != "" {
+		attrPath = filepath.ToSlash(filepath.Clean(attrPath))
+		if fileContent, err = convertToGit(attrPath, fileContent); err != nil {
+			return "", objectID{}, err
+		}
+	}
+
+	objectContent := fmt.Sprintf("blob %d\x00%s", len(fileContent), fileContent)
+
+	hash := hashObjectData(blobObject, fileContent)
+	return objectContent, hash, nil
+}
+
+func writeObject(objectContent string, hash objectID) error {
+	hexHash := fmt.Sprintf("%x", hash)
+	path := filepath.Join(objDir, hexHash[:2], hexHash[2:])
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create object directory: %w", err)
+	}
+
+	// The object is written to a temporary file first, so that it is
+	// never seen half written.
+	f, err := os.CreateTemp(filepath.Dir(path), "tmp_obj_")
+	if err != nil {
+		return fmt.Errorf("failed to create object file: %w", err)
+	}
+	w := zlib.NewWriter(f)
+	_, err = w.Write([]byte(objectContent))
+	if err == nil {
+		err = w.Close()
+	}
+	if err == nil {
+		err = f.Chmod(0444)
+	}
+	batched := err == nil && batchObject(f.Name(), path)
+	if err == nil && !batched {
+		err = fsyncFile(f, fsyncLooseObject)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to compress object content: %w", err)
+	}
+	if batched {
+		return nil
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("failed to write object file: %w", err)
+	}
+	return nil
+}
+
+func lsTree(hexHash string, nameOnly bool) ([]string, error) {
+	// tree <size>\0
+	// <mode> <name>\0<20_byte_sha>
+	// <mode> <name>\0<20_byte_sha>
+	hash, err := parseHash(hexHash)
+	if err != nil {
+		return nil, err
+	}
+
+	objType, content, err := readObject(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	if objType != treeObject {
+		return nil, fmt.Errorf("object is not a tree")
+	}
+
+	entries, err := parseTree(content)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, e := range entries {
+		if nameOnly {
+			result = append(result, e.name)
+		} else {
+			result = append(result, fmt.Sprintf("%s %s %x", e.mode, e.name, e.hash))
+		}
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// isNestedRepository reports whether the directory at path is the working
+// tree of a repository of its own, with a .git directory or file.
+func isNestedRepository(path string) bool {
+	_, err := os.Lstat(filepath.Join(path, ".git"))
+	return err == nil
+}
+
+func writeTree(path string) (objectID, error) {
+	// tree <size>\0
+	// <mode> <name>\0<20_byte_sha>
+	// <mode> <name>\0<20_byte_sha>
+	type sortedEntry struct {
+		sortName string
+		data     []byte
+	}
+	var treeEntries []sortedEntry
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return objectID{}, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(path, entry.Name())
+		if slices.Contains(ignoredDirs, entry.Name()) {
+			continue
+		}
+
+		var mode string
+		var hash objectID
+		sortName := entry.Name()
+
+		if entry.IsDir() && isNestedRepository(entryPath) {
+			// A nested repository is recorded as a gitlink to the
+			// commit it has checked out, not as a tree of its files.
+			head, ok, err := submoduleHead(entryPath)
+			if err != nil {
+				return objectID{}, err
+			}
+			if !ok {
+				return objectID{}, fmt.Errorf("'%s' does not have a commit checked out", entryPath)
+			}
+			mode, hash = gitlinkMode, head
+		} else if entry.IsDir() {
+			// Git sorts trees as if their name ended in a slash.
+			sortName += "/"
+			mode = "40000"
+			hash, err = writeTree(entryPath)
+			if err != nil {
+				return objectID{}, fmt.Errorf("failed to write tree object: %w", err)
+			}
+		} else {
+			_, hash, err = hashObject(entryPath, entryPath)
+			if err != nil {
+				return objectID{}, fmt.Errorf("failed to hash object: %w", err)
+			}
+
+			mode = "100644"
+		}
+
+		entryData := []byte(fmt.Sprintf("%s %s\x00", mode, filepath.Base(entryPath)))
+		entryData = append(entryData, hash.bytes()...)
+		treeEntries = append(treeEntries, sortedEntry{sortName, entryData})
+	}
+
+	sort.Slice(treeEntries, func(i, j int) bool {
+		return treeEntries[i].sortName < treeEntries[j].sortName
+	})
+
+	var flattenedTreeEntries []byte
+	for _, entry := range treeEntries {
+		flattenedTreeEntries = append(flattenedTreeEntries, entry.data...)
+	}
+
+	treeObject := fmt.Sprintf("tree %d\x00%s", len(flattenedTreeEntries), flattenedTreeEntries)
+	hash := hashObjectData("tree", flattenedTreeEntries)
+
+	if err := writeObject(treeObject, hash); err != nil {
+		return objectID{}, fmt.Errorf("failed to write tree object: %w", err)
+	}
+
+	return hash, nil
+}
@@ -0,0 +1,604 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	defaultNotesRef   = "refs/notes/commits"
+	notesMergePartial = "NOTES_MERGE_PARTIAL"
+	notesMergeRef     = "NOTES_MERGE_REF"
+)
+
+var notesMergeWorktree = ".git/NOTES_MERGE_WORKTREE"
+
+// Ways of resolving notes that were changed on both sides of a merge, as
+// set by -s and notes.mergeStrategy. A manual merge leaves the conflicts
+// in NOTES_MERGE_WORKTREE to be resolved and committed.
+const (
+	notesStrategyManual      = "manual"
+	notesStrategyOurs        = "ours"
+	notesStrategyTheirs      = "theirs"
+	notesStrategyUnion       = "union"
+	notesStrategyCatSortUniq = "cat_sort_uniq"
+)
+
+func validNotesStrategy(s string) bool {
+	switch s {
+	case notesStrategyManual, notesStrategyOurs, notesStrategyTheirs, notesStrategyUnion, notesStrategyCatSortUniq:
+		return true
+	}
+	return false
+}
+
+// notesRef is the notes ref commands work on: GIT_NOTES_REF, then
+// core.notesRef, then refs/notes/commits.
+func notesRef(cfg *config) string {
+	if ref := os.Getenv("GIT_NOTES_REF"); ref != "" {
+		return ref
+	}
+	if ref, ok := cfg.get("core.notesRef"); ok {
+		return ref
+	}
+	return defaultNotesRef
+}
+
+// expandNotesRef turns a short notes ref name like "commits" or
+// "notes/commits" into a full one.
+func expandNotesRef(name string) string {
+	switch {
+	case strings.HasPrefix(name, "refs/notes/"):
+		return name
+	case strings.HasPrefix(name, "notes/"):
+		return "refs/" + name
+	}
+	return "refs/notes/" + name
+}
+
+// readNotes maps each annotated object to its note in a notes commit, or
+// returns no notes for a zero commit. Notes trees spread the notes over
+// directories named after leading bytes of the object ID, so the path
+// without slashes is the object ID.
+func readNotes(commit objectID) (map[objectID]objectID, error) {
+	notes := make(map[objectID]objectID)
+	if commit == (objectID{}) {
+		return notes, nil
+	}
+	files, err := commitFiles(commit)
+	if err != nil {
+		return nil, err
+	}
+	for path, file := range files {
+		if obj, err := parseHash(strings.ReplaceAll(path, "/", "")); err == nil {
+			notes[obj] = file.hash
+		}
+	}
+	return notes, nil
+}
+
+// notesFanout spreads notes, all sharing the first prefixLen hex digits
+// of their object IDs, over directories like git does: a level splits
+// into directories named by the next two digits once every possible next
+// digit starts at least two notes.
+func notesFanout(objs []string, prefixLen int, dir string, files map[string]diffEntry, notes map[string]objectID) {
+	counts := make(map[byte]int)
+	for _, obj := range objs {
+		counts[obj[prefixLen]]++
+	}
+	full := len(counts) == 16
+	for _, n := range counts {
+		full = full && n >= 2
+	}
+	if !full || prefixLen+2 >= len(objs[0]) {
+		for _, obj := range objs {
+			files[dir+obj[prefixLen:]] = diffEntry{mode: modeRegular, hash: notes[obj]}
+		}
+		return
+	}
+
+	groups := make(map[string][]string)
+	for _, obj := range objs {
+		groups[obj[prefixLen:prefixLen+2]] = append(groups[obj[prefixLen:prefixLen+2]], obj)
+	}
+	for name, group := range groups {
+		notesFanout(group, prefixLen+2, dir+name+"/", files, notes)
+	}
+}
+
+// writeNotesTree writes a notes tree holding notes and returns its hash.
+func writeNotesTree(notes map[objectID]objectID) (objectID, error) {
+	files := make(map[string]diffEntry)
+	if len(notes) > 0 {
+		byName := make(map[string]objectID, len(notes))
+		objs := make([]string, 0, len(notes))
+		for obj, note := range notes {
+			byName[obj.String()] = note
+			objs = append(objs, obj.String())
+		}
+		notesFanout(objs, 0, "", files, byName)
+	}
+	return writeFilesTree(files)
+}
+
+// concatenateNotes joins two notes with a blank line in between. A
+// missing or empty note leaves the other one.
+func concatenateNotes(local, remote objectID) (objectID, error) {
+	l, err := readNote(local)
+	if err != nil {
+		return objectID{}, err
+	}
+	r, err := readNote(remote)
+	if err != nil {
+		return objectID{}, err
+	}
+	switch {
+	case len(r) == 0:
+		return local, nil
+	case len(l) == 0:
+		return remote, nil
+	}
+	data := append(append(append([]byte(nil), strings.TrimSuffix(string(l), "\n")...), "\n\n"...), r...)
+	return storeObject(blobObject, data)
+}
+
+// catSortUniqNotes joins the lines of two notes, sorted and without empty
+// or repeated lines.
+func catSortUniqNotes(local, remote objectID) (objectID, error) {
+	var lines []string
+	for _, note := range []objectID{local, remote} {
+		data, err := readNote(note)
+		if err != nil {
+			return objectID{}, err
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+	}
+	sort.Strings(lines)
+	var b strings.Builder
+	for i, line := range lines {
+		if i == 0 || lines[i-1] != line {
+			b.WriteString(line + "\n")
+		}
+	}
+	return storeObject(blobObject, []byte(b.String()))
+}
+
+// readNote returns the content of a note, or nothing for a zero ID.
+func readNote(note objectID) ([]byte, error) {
+	if note == (objectID{}) {
+		return nil, nil
+	}
+	return diffEntry{mode: modeRegular, hash: note}.content()
+}
+
+// notesMerge merges the notes of two notes commits, resolving notes
+// changed on both sides by strategy.
+type notesMerge struct {
+	strategy  string
+	localRef  string
+	remoteRef string
+	verbosity int
+	// hasWorktree is set once NOTES_MERGE_WORKTREE was created.
+	hasWorktree bool
+}
+
+func (m *notesMerge) say(level int, format string, args ...any) {
+	if m.verbosity >= level {
+		fmt.Printf(format+"\n", args...)
+	}
+}
+
+// merge applies the changes from base to remote on top of local. A manual
+// merge writes conflicting notes to NOTES_MERGE_WORKTREE and leaves them
+// out of the result; they are returned as the objects left to resolve.
+func (m *notesMerge) merge(base, local, remote map[objectID]objectID) (map[objectID]objectID, []objectID, error) {
+	seen := make(map[objectID]bool)
+	var objs []objectID
+	for _, notes := range []map[objectID]objectID{base, local, remote} {
+		for obj := range notes {
+			if !seen[obj] {
+				seen[obj] = true
+				objs = append(objs, obj)
+			}
+		}
+	}
+	sort.Slice(objs, func(i, j int) bool { return objs[i].String() < objs[j].String() })
+
+	result := make(map[objectID]objectID, len(local))
+	for obj, note := range local {
+		result[obj] = note
+	}
+	var conflicts []objectID
+	for _, obj := range objs {
+		b, l, r := base[obj], local[obj], remote[obj]
+		if l == r || r == b {
+			continue
+		}
+		note := r
+		if l != b {
+			var err error
+			if note, err = m.resolve(obj, b, l, r); err != nil {
+				return nil, nil, err
+			}
+			if m.strategy == notesStrategyManual {
+				conflicts = append(conflicts, obj)
+			}
+		}
+		if note == (objectID{}) {
+			delete(result, obj)
+		} else {
+			result[obj] = note
+		}
+	}
+	return result, conflicts, nil
+}
+
+// resolve picks the note for an object whose note changed on both sides.
+func (m *notesMerge) resolve(obj, base, local, remote objectID) (objectID, error) {
+	switch m.strategy {
+	case notesStrategyOurs:
+		m.say(2, "Using local notes for %s", obj)
+		return local, nil
+	case notesStrategyTheirs:
+		m.say(2, "Using remote notes for %s", obj)
+		return remote, nil
+	case notesStrategyUnion:
+		m.say(2, "Concatenating local and remote notes for %s", obj)
+		return concatenateNotes(local, remote)
+	case notesStrategyCatSortUniq:
+		m.say(2, "Concatenating unique lines in local and remote notes for %s", obj)
+		return catSortUniqNotes(local, remote)
+	}
+
+	m.say(2, "Auto-merging notes for %s", obj)
+	if !m.hasWorktree {
+		if err := createNotesWorktree(); err != nil {
+			return objectID{}, err
+		}
+		m.hasWorktree = true
+	}
+	var data []byte
+	var err error
+	switch {
+	case local == (objectID{}):
+		m.say(1, "CONFLICT (delete/modify): Notes for object %s deleted in %s and modified in %s. Version from %s left in tree.",
+			obj, m.localRef, m.remoteRef, m.remoteRef)
+		data, err = readNote(remote)
+	case remote == (objectID{}):
+		m.say(1, "CONFLICT (delete/modify): Notes for object %s deleted in %s and modified in %s. Version from %s left in tree.",
+			obj, m.remoteRef, m.localRef, m.localRef)
+		data, err = readNote(local)
+	default:
+		reason := "content"
+		if base == (objectID{}) {
+			reason = "add/add"
+		}
+		m.say(1, "CONFLICT (%s): Merge conflict in notes for object %s", reason, obj)
+		var b, l, r []byte
+		if b, err = readNote(base); err != nil {
+			return objectID{}, err
+		}
+		if l, err = readNote(local); err != nil {
+			return objectID{}, err
+		}
+		if r, err = readNote(remote); err != nil {
+			return objectID{}, err
+		}
+		data, _ = mergeContent(b, l, r, &mergeFileOptions{
+			ours:       m.localRef,
+			theirs:     m.remoteRef,
+			style:      conflictStyleMerge,
+			markerSize: defaultConflictMarkerSize,
+		})
+	}
+	if err != nil {
+		return objectID{}, err
+	}
+	if err := os.WriteFile(filepath.Join(notesMergeWorktree, obj.String()), data, 0644); err != nil {
+		return objectID{}, fmt.Errorf("failed to write note: %w", err)
+	}
+	// The note stays out of the result until it is resolved.
+	return objectID{}, nil
+}
+
+// createNotesWorktree makes NOTES_MERGE_WORKTREE for the notes of a manual
+// merge, unless it still holds those of an unfinished one.
+func createNotesWorktree() error {
+	if entries, err := os.ReadDir(notesMergeWorktree); err == nil && len(entries) > 0 {
+		return fmt.Errorf("You have not concluded your previous notes merge (.git/NOTES_MERGE_* exists).\n" +
+			"Please, use 'mygit notes merge --commit' or 'mygit notes merge --abort' to commit/abort the previous merge before you start a new notes merge.")
+	}
+	if err := os.MkdirAll(notesMergeWorktree, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", notesMergeWorktree, err)
+	}
+	return nil
+}
+
+func runNotesMerge(cfg *config, localRef string, args []string) error {
+	verbosity := 2
+	var strategy string
+	doCommit, doAbort := false, false
+	var names []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-v" || arg == "--verbose":
+			verbosity++
+		case arg == "-q" || arg == "--quiet":
+			verbosity--
+		case arg == "--commit":
+			doCommit = true
+		case arg == "--abort":
+			doAbort = true
+		case arg == "-s" || arg == "--strategy":
+			if i+1 >= len(args) {
+				return fmt.Errorf("%s requires a value", arg)
+			}
+			i++
+			strategy = args[i]
+		case strings.HasPrefix(arg, "--strategy="):
+			strategy = strings.TrimPrefix(arg, "--strategy=")
+		case strings.HasPrefix(arg, "-s"):
+			strategy = strings.TrimPrefix(arg, "-s")
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+	if strategy != "" && !validNotesStrategy(strategy) {
+		return fmt.Errorf("unknown -s/--strategy: %s", strategy)
+	}
+
+	switch {
+	case doCommit && doAbort:
+		return fmt.Errorf("cannot mix --commit, --abort or -s/--strategy")
+	case doCommit || doAbort:
+		if strategy != "" {
+			return fmt.Errorf("cannot mix --commit, --abort or -s/--strategy")
+		}
+		if len(names) > 0 {
+			return fmt.Errorf("too many arguments")
+		}
+		if doCommit {
+			return commitNotesMerge()
+		}
+		return abortNotesMerge()
+	case len(names) == 0:
+		return fmt.Errorf("must specify a notes ref to merge")
+	case len(names) > 1:
+		return fmt.Errorf("too many arguments")
+	}
+
+	if !strings.HasPrefix(localRef, "refs/notes/") {
+		return fmt.Errorf("refusing to merge into %s outside of refs/notes/", localRef)
+	}
+	if strategy == "" {
+		strategy = notesStrategyManual
+		for _, key := range []string{"notes." + strings.TrimPrefix(localRef, "refs/notes/") + ".mergeStrategy", "notes.mergeStrategy"} {
+			if value, ok := cfg.get(key); ok {
+				if !validNotesStrategy(value) {
+					return fmt.Errorf("unknown notes merge strategy %s", value)
+				}
+				strategy = value
+				break
+			}
+		}
+	}
+
+	// A name that is not a revision is taken for a notes ref, which may
+	// not exist yet.
+	remoteRef := names[0]
+	remote, err := resolveRevision(remoteRef)
+	if err != nil {
+		remoteRef = expandNotesRef(remoteRef)
+		remote, err = resolveRef(remoteRef)
+		if err != nil && !errors.Is(err, errRefNotFound) {
+			return err
+		}
+	}
+	local, err := resolveRef(localRef)
+	if err != nil && !errors.Is(err, errRefNotFound) {
+		return err
+	}
+	message := fmt.Sprintf("notes: Merged notes from %s into %s", remoteRef, localRef)
+
+	result := local
+	switch {
+	case local == (objectID{}) && remote == (objectID{}):
+		return fmt.Errorf("Cannot merge empty notes ref (%s) into empty notes ref (%s)", remoteRef, localRef)
+	case local == (objectID{}):
+		result = remote
+	case remote == (objectID{}):
+	default:
+		bases, err := mergeBases([]objectID{local}, []objectID{remote})
+		if err != nil {
+			return err
+		}
+		// Notes histories are merged against their newest common
+		// ancestor only.
+		var base objectID
+		if len(bases) > 0 {
+			base = bases[0]
+		}
+		switch {
+		case remote == base:
+			if verbosity >= 2 {
+				fmt.Println("Already up to date.")
+			}
+		case local == base:
+			if verbosity >= 2 {
+				fmt.Println("Fast-forward")
+			}
+			result = remote
+		default:
+			m := &notesMerge{strategy: strategy, localRef: localRef, remoteRef: remoteRef, verbosity: verbosity}
+			if result, err = m.commit(base, local, remote, strings.TrimPrefix(message, "notes: ")); err != nil {
+				return err
+			}
+		}
+	}
+
+	if result == (objectID{}) {
+		// The manual merge stopped with conflicts.
+		fmt.Fprintf(os.Stderr, "Automatic notes merge failed. Fix conflicts in %s and commit the result with "+
+			"'mygit notes merge --commit', or abort the merge with 'mygit notes merge --abort'.\n", notesMergeWorktree)
+		os.Exit(1)
+	}
+	if result == local {
+		return nil
+	}
+	tx := newRefTransaction()
+	tx.updateFrom(localRef, local, result, message)
+	return tx.commit()
+}
+
+// commit merges the notes of local and remote against base and commits
+// the result. If conflicts are left to resolve, the partial result is
+// kept in NOTES_MERGE_PARTIAL and NOTES_MERGE_REF points at the notes ref
+// to update, and a zero ID is returned.
+func (m *notesMerge) commit(base, local, remote objectID, message string) (objectID, error) {
+	baseNotes, err := readNotes(base)
+	if err != nil {
+		return objectID{}, err
+	}
+	localNotes, err := readNotes(local)
+	if err != nil {
+		return objectID{}, err
+	}
+	remoteNotes, err := readNotes(remote)
+	if err != nil {
+		return objectID{}, err
+	}
+	notes, conflicts, err := m.merge(baseNotes, localNotes, remoteNotes)
+	if err != nil {
+		return objectID{}, err
+	}
+
+	if len(conflicts) > 0 {
+		message += "\n\nConflicts:\n"
+		for _, obj := range conflicts {
+			message += "\t" + obj.String() + "\n"
+		}
+	}
+	tree, err := writeNotesTree(notes)
+	if err != nil {
+		return objectID{}, err
+	}
+	hash, err := commitTree(tree, []objectID{local, remote}, message)
+	if err != nil || len(conflicts) == 0 {
+		return hash, err
+	}
+
+	tx := newRefTransaction()
+	tx.update(notesMergePartial, hash, "")
+	tx.symref(notesMergeRef, m.localRef, "")
+	return objectID{}, tx.commit()
+}
+
+// commitNotesMerge concludes a manual notes merge with the notes resolved
+// in NOTES_MERGE_WORKTREE.
+func commitNotesMerge() error {
+	localRef, err := symrefTarget(notesMergeRef)
+	if err != nil || localRef == notesMergeRef {
+		return fmt.Errorf("failed to resolve %s", notesMergeRef)
+	}
+	hash, err := resolveRef(notesMergePartial)
+	if err != nil {
+		return fmt.Errorf("failed to read ref %s", notesMergePartial)
+	}
+	partial, err := readCommit(hash)
+	if err != nil {
+		return err
+	}
+	if len(partial.parents) == 0 {
+		return fmt.Errorf("could not find commit from %s", notesMergePartial)
+	}
+	notes, err := readNotes(hash)
+	if err != nil {
+		return err
+	}
+
+	entries, err := os.ReadDir(notesMergeWorktree)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", notesMergeWorktree, err)
+	}
+	for _, e := range entries {
+		obj, err := parseHash(e.Name())
+		if err != nil {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(notesMergeWorktree, e.Name()))
+		if err != nil {
+			return fmt.Errorf("failed to read note: %w", err)
+		}
+		if notes[obj], err = storeObject(blobObject, data); err != nil {
+			return err
+		}
+	}
+
+	tree, err := writeNotesTree(notes)
+	if err != nil {
+		return err
+	}
+	result, err := commitTree(tree, partial.parents, partial.message)
+	if err != nil {
+		return err
+	}
+	subject, _, _ := strings.Cut(strings.TrimSpace(partial.message), "\n")
+	tx := newRefTransaction()
+	tx.updateFrom(localRef, partial.parents[0], result, "notes: "+subject)
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	return abortNotesMerge()
+}
+
+// abortNotesMerge drops the state of a manual notes merge.
+func abortNotesMerge() error {
+	if err := os.RemoveAll(notesMergeWorktree); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", notesMergeWorktree, err)
+	}
+	tx := newRefTransaction()
+	for _, name := range []string{notesMergePartial, notesMergeRef} {
+		if _, err := refStore().readRef(name); err == nil {
+			tx.delete(name)
+		}
+	}
+	return tx.commit()
+}
+
+func runNotes(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	ref := notesRef(cfg)
+	for len(args) > 0 && strings.HasPrefix(args[0], "--ref") {
+		if value, ok := strings.CutPrefix(args[0], "--ref="); ok {
+			ref, args = expandNotesRef(value), args[1:]
+			continue
+		}
+		if args[0] != "--ref" || len(args) < 2 {
+			return fmt.Errorf("--ref requires a value")
+		}
+		ref, args = expandNotesRef(args[1]), args[2:]
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mygit notes [--ref <notes-ref>] merge [-s <strategy>] <notes-ref>")
+	}
+	switch args[0] {
+	case "merge":
+		return runNotesMerge(cfg, ref, args[1:])
+	}
+	return fmt.Errorf("unknown subcommand: %s", args[0])
+}
@@ -0,0 +1,229 @@
+package mygit
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	blobObject   = "blob"
+	treeObject   = "tree"
+	commitObject = "commit"
+	tagObject    = "tag"
+)
+
+var errObjectNotFound = errors.New("object not found")
+
+type treeEntry struct {
+	mode string
+	name string
+	hash objectID
+}
+
+type commit struct {
+	tree      objectID
+	parents   []objectID
+	author    string
+	committer string
+	// gpgsig is the signature of a signed commit, written out as a
+	// header but not read back.
+	gpgsig  string
+	message string
+}
+
+type tag struct {
+	object  objectID
+	objType string
+	name    string
+	tagger  string
+	message string
+}
+
+// The headers commits and tags start with, in order, which strict mode
+// insists on.
+var (
+	commitHeaders         = []string{"tree", "parent", "author", "committer"}
+	repeatedCommitHeaders = map[string]bool{"parent": true}
+	tagHeaders            = []string{"object", "type", "tag"}
+)
+
+func parseHash(s string) (objectID, error) {
+	var hash objectID
+	if len(s) != hashAlgo.size*2 {
+		return hash, fmt.Errorf("invalid object name %q", s)
+	}
+	if _, err := hex.Decode(hash[:hashAlgo.size], []byte(s)); err != nil {
+		return hash, fmt.Errorf("invalid object name %q", s)
+	}
+	return hash, nil
+}
+
+func shortHash(hash objectID) string {
+	return hash.String()[:7]
+}
+
+func objectPath(hash objectID) string {
+	hexHash := hash.String()
+	return filepath.Join(objDir, hexHash[:2], hexHash[2:])
+}
+
+func hasObject(hash objectID) bool {
+	if _, err := os.Stat(looseObjectPath(hash)); err == nil {
+		return true
+	}
+	_, _, ok := findPacked(hash)
+	return ok
+}
+
+// readObject returns the type and content of the object with the given
+// hash, looking at loose objects first and then at packs.
+func readObject(hash objectID) (string, []byte, error) {
+	data, err := os.ReadFile(looseObjectPath(hash))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			objType, content, err := readPackedObject(hash)
+			if errors.Is(err, errObjectNotFound) && fetchMissingObject(hash) {
+				return readObject(hash)
+			}
+			return objType, content, err
+		}
+		return "", nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	r, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create zlib reader: %w", err)
+	}
+	defer r.Close()
+
+	decompressed, err := io.ReadAll(r)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+
+	return parseObjectHeader(decompressed)
+}
+
+// storeObject writes content as a loose object of the given type unless it
+// already exists, and returns its hash.
+func storeObject(objType string, content []byte) (objectID, error) {
+	objectContent := fmt.Sprintf("%s %d\x00%s", objType, len(content), content)
+	hash := hashObjectData(objType, content)
+	if hasObject(hash) {
+		return hash, nil
+	}
+	return hash, writeObject(objectContent, hash)
+}
+
+func parseObjectHeader(raw []byte) (string, []byte, error) {
+	nullIndex := bytes.IndexByte(raw, 0)
+	if nullIndex == -1 {
+		return "", nil, fmt.Errorf("invalid object header")
+	}
+
+	objType, sizeStr, ok := strings.Cut(string(raw[:nullIndex]), " ")
+	if !ok {
+		return "", nil, fmt.Errorf("invalid object header %q", raw[:nullIndex])
+	}
+	size, err := strconv.Atoi(sizeStr)
+	if err != nil || size != len(raw)-nullIndex-1 {
+		return "", nil, fmt.Errorf("invalid object size %q", sizeStr)
+	}
+
+	return objType, raw[nullIndex+1:], nil
+}
+
+func parseTree(content []byte) ([]treeEntry, error) {
+	var entries []treeEntry
+	for len(content) > 0 {
+		nullIndex := bytes.IndexByte(content, 0)
+		if nullIndex == -1 || len(content) < nullIndex+1+hashAlgo.size {
+			return nil, fmt.Errorf("invalid tree object format")
+		}
+
+		mode, name, ok := strings.Cut(string(content[:nullIndex]), " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid tree entry %q", content[:nullIndex])
+		}
+		if err := checkTreeEntry(mode, name); err != nil {
+			return nil, err
+		}
+
+		hash := objectIDFromBytes(content[nullIndex+1:])
+		entries = append(entries, treeEntry{mode: mode, name: name, hash: hash})
+
+		content = content[nullIndex+1+hashAlgo.size:]
+	}
+	return entries, nil
+}
+
+func parseCommit(content []byte) (*commit, error) {
+	c := &commit{}
+	headers, message, _ := bytes.Cut(content, []byte("\n\n"))
+	c.message = string(message)
+	if err := checkObjectHeaders(commitObject, headers, commitHeaders, repeatedCommitHeaders); err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(headers), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "tree":
+			hash, err := parseHash(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid commit tree: %w", err)
+			}
+			c.tree = hash
+		case "parent":
+			hash, err := parseHash(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid commit parent: %w", err)
+			}
+			c.parents = append(c.parents, hash)
+		case "author":
+			c.author = value
+		case "committer":
+			c.committer = value
+		}
+	}
+
+	return c, nil
+}
+
+func parseTag(content []byte) (*tag, error) {
+	t := &tag{}
+	headers, message, _ := bytes.Cut(content, []byte("\n\n"))
+	t.message = string(message)
+	if err := checkObjectHeaders(tagObject, headers, tagHeaders, nil); err != nil {
+		return nil, err
+	}
+
+	for _, line := range strings.Split(string(headers), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		switch key {
+		case "object":
+			hash, err := parseHash(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid tag object: %w", err)
+			}
+			t.object = hash
+		case "type":
+			t.objType = value
+		case "tag":
+			t.name = value
+		case "tagger":
+			t.tagger = value
+		}
+	}
+
+	return t, nil
+}
@@ -0,0 +1,303 @@
+package mygit
+
+import (
+	"bufio"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// objectInfo describes an object without its content. size is the
+// inflated size; diskSize is what the object occupies in storage, which for
+// a packed delta is the size of the delta entry alone.
+type objectInfo struct {
+	objType    string
+	size       int64
+	diskSize   int64
+	deltaBase  objectID
+	deltaDepth int
+}
+
+// statObject returns an object's type and sizes while inflating as little
+// of it as possible.
+func statObject(hash objectID) (*objectInfo, error) {
+	fi, err := os.Stat(looseObjectPath(hash))
+	if err == nil {
+		objType, size, err := readLooseHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+		return &objectInfo{objType: objType, size: size, diskSize: fi.Size()}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to stat object: %w", err)
+	}
+
+	p, offset, ok := findPacked(hash)
+	if !ok {
+		if fetchMissingObject(hash) {
+			return statObject(hash)
+		}
+		return nil, fmt.Errorf("%x: %w", hash, errObjectNotFound)
+	}
+	return p.entryInfo(offset)
+}
+
+// forEachObject calls fn with every object in the repository of type
+// objType, or of any type when it is empty: loose objects first, then the
+// objects of each pack in the order they are stored. Objects stored more
+// than once are only visited once. An error from fn stops the iteration
+// and is returned.
+func forEachObject(objType string, fn func(hash objectID, info *objectInfo) error) error {
+	seen := make(map[objectID]bool)
+	visit := func(hash objectID, info *objectInfo) error {
+		if seen[hash] || objType != "" && info.objType != objType {
+			return nil
+		}
+		seen[hash] = true
+		return fn(hash, info)
+	}
+
+	loose, err := listLooseObjects()
+	if err != nil {
+		return err
+	}
+	for _, hash := range loose {
+		info, err := statObject(hash)
+		if err != nil {
+			return err
+		}
+		if err := visit(hash, info); err != nil {
+			return err
+		}
+	}
+
+	packs, err := openPacks()
+	if err != nil {
+		return err
+	}
+	for _, p := range packs {
+		positions := make([]int, p.idx.count)
+		for i := range positions {
+			positions[i] = i
+		}
+		sort.Slice(positions, func(a, b int) bool {
+			return p.idx.offsetAt(positions[a]) < p.idx.offsetAt(positions[b])
+		})
+		for _, i := range positions {
+			hash := p.idx.hashAt(i)
+			if seen[hash] {
+				continue
+			}
+			info, err := p.entryInfo(p.idx.offsetAt(i))
+			if err != nil {
+				return err
+			}
+			if err := visit(hash, info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readLooseHeader(hash objectID) (string, int64, error) {
+	f, err := os.Open(looseObjectPath(hash))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	r, err := zlib.NewReader(f)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create zlib reader: %w", err)
+	}
+	defer r.Close()
+
+	header, err := bufio.NewReader(io.LimitReader(r, 64)).ReadBytes(0)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid object header")
+	}
+
+	objType, sizeStr, ok := strings.Cut(string(header[:len(header)-1]), " ")
+	if !ok {
+		return "", 0, fmt.Errorf("invalid object header %q", header)
+	}
+	size, err := strconv.ParseInt(sizeStr, 10, 64)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid object size %q", sizeStr)
+	}
+	return objType, size, nil
+}
+
+// entryInfo describes the pack entry at offset, following the delta chain
+// only through entry headers.
+func (p *pack) entryInfo(offset int64) (*objectInfo, error) {
+	h, err := p.readEntryHeader(offset)
+	if err != nil {
+		return nil, err
+	}
+	diskSize, err := p.entrySize(offset)
+	if err != nil {
+		return nil, err
+	}
+	info := &objectInfo{diskSize: diskSize}
+
+	if objType, ok := packTypeNames[h.typeCode]; ok {
+		info.objType, info.size = objType, h.size
+		return info, nil
+	}
+
+	prefix, err := p.inflatePrefix(h.dataOffset, 20)
+	if err != nil {
+		return nil, err
+	}
+	_, n, err := readDeltaSize(prefix)
+	if err != nil {
+		return nil, err
+	}
+	size, _, err := readDeltaSize(prefix[n:])
+	if err != nil {
+		return nil, err
+	}
+	info.size = int64(size)
+
+	var base *objectInfo
+	switch h.typeCode {
+	case packOfsDelta:
+		hash, ok := p.hashAtOffset(h.baseOffset)
+		if !ok {
+			return nil, fmt.Errorf("delta base at offset %d not in index", h.baseOffset)
+		}
+		info.deltaBase = hash
+		base, err = p.entryInfo(h.baseOffset)
+	case packRefDelta:
+		info.deltaBase = h.baseHash
+		if p.idx != nil {
+			if i, ok := p.idx.find(h.baseHash); ok {
+				base, err = p.entryInfo(p.idx.offsetAt(i))
+				break
+			}
+		}
+		base, err = statObject(h.baseHash)
+	default:
+		return nil, fmt.Errorf("invalid entry type %d", h.typeCode)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	info.objType = base.objType
+	info.deltaDepth = base.deltaDepth + 1
+	return info, nil
+}
+
+// inflatePrefix inflates at most n bytes of the entry data at offset.
+func (p *pack) inflatePrefix(offset int64, n int) ([]byte, error) {
+	f, done, err := p.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	r, err := zlib.NewReader(bufio.NewReader(io.NewSectionReader(f, offset, 1<<62)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zlib reader: %w", err)
+	}
+	defer r.Close()
+
+	buf := make([]byte, n)
+	read, err := io.ReadFull(r, buf)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decompress entry: %w", err)
+	}
+	return buf[:read], nil
+}
+
+// entrySize returns the number of bytes the entry at offset occupies,
+// measured up to the next entry or the trailing checksum.
+func (p *pack) entrySize(offset int64) (int64, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.sortedOffsets == nil {
+		f, done, err := p.use()
+		if err != nil {
+			return 0, err
+		}
+		fi, err := f.Stat()
+		done()
+		if err != nil {
+			return 0, fmt.Errorf("failed to stat pack: %w", err)
+		}
+		offsets := make([]int64, 0, p.idx.count+1)
+		for i := 0; i < p.idx.count; i++ {
+			offsets = append(offsets, p.idx.offsetAt(i))
+		}
+		sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+		p.sortedOffsets = append(offsets, fi.Size()-int64(hashAlgo.size))
+	}
+
+	i := sort.Search(len(p.sortedOffsets), func(i int) bool { return p.sortedOffsets[i] >= offset })
+	if i >= len(p.sortedOffsets)-1 || p.sortedOffsets[i] != offset {
+		return 0, fmt.Errorf("no pack entry at offset %d", offset)
+	}
+	return p.sortedOffsets[i+1] - offset, nil
+}
+
+// hashAtOffset maps a pack entry offset back to the object's hash.
+func (p *pack) hashAtOffset(offset int64) (objectID, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.byOffset == nil {
+		p.byOffset = make(map[int64]int, p.idx.count)
+		for i := 0; i < p.idx.count; i++ {
+			p.byOffset[p.idx.offsetAt(i)] = i
+		}
+	}
+	i, ok := p.byOffset[offset]
+	if !ok {
+		return objectID{}, false
+	}
+	return p.idx.hashAt(i), true
+}
+
+// formatObjectInfo expands cat-file style %(atom) placeholders.
+func formatObjectInfo(format string, hash objectID, info *objectInfo, rest string) (string, error) {
+	var b strings.Builder
+	for {
+		start := strings.Index(format, "%(")
+		if start == -1 {
+			b.WriteString(format)
+			return b.String(), nil
+		}
+		end := strings.IndexByte(format[start:], ')')
+		if end == -1 {
+			return "", fmt.Errorf("unterminated format atom in %q", format)
+		}
+		b.WriteString(format[:start])
+		atom := format[start+2 : start+end]
+		format = format[start+end+1:]
+
+		switch atom {
+		case "objectname":
+			fmt.Fprintf(&b, "%x", hash)
+		case "objecttype":
+			b.WriteString(info.objType)
+		case "objectsize":
+			b.WriteString(strconv.FormatInt(info.size, 10))
+		case "objectsize:disk":
+			b.WriteString(strconv.FormatInt(info.diskSize, 10))
+		case "deltabase":
+			fmt.Fprintf(&b, "%x", info.deltaBase)
+		case "rest":
+			b.WriteString(rest)
+		default:
+			return "", fmt.Errorf("unknown format element: %%(%s)", atom)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package mygit
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// objectID names an object by its hash. It is sized for the largest
+// supported hash; SHA-1 repositories only use the first 20 bytes and leave
+// the rest zero, so IDs can be compared and used as map keys either way.
+type objectID [sha256.Size]byte
+
+// hashAlgorithm describes an object format.
+type hashAlgorithm struct {
+	name string
+	size int
+	new  func() hash.Hash
+	// formatID identifies the algorithm in binary file headers such as
+	// the multi-pack-index.
+	formatID byte
+}
+
+var (
+	sha1Algorithm   = &hashAlgorithm{name: "sha1", size: sha1.Size, new: sha1.New, formatID: 1}
+	sha256Algorithm = &hashAlgorithm{name: "sha256", size: sha256.Size, new: sha256.New, formatID: 2}
+)
+
+// hashAlgo is the object format of the current repository, set from
+// extensions.objectFormat by loadRepositoryFormat.
+var hashAlgo = sha1Algorithm
+
+func lookupHashAlgorithm(name string) (*hashAlgorithm, error) {
+	switch name {
+	case "sha1":
+		return sha1Algorithm, nil
+	case "sha256":
+		return sha256Algorithm, nil
+	}
+	return nil, fmt.Errorf("unknown object format %q", name)
+}
+
+// bytes returns the part of the ID used by the repository's hash.
+func (id objectID) bytes() []byte {
+	return id[:hashAlgo.size]
+}
+
+func (id objectID) String() string {
+	return hex.EncodeToString(id.bytes())
+}
+
+// Format prints the ID in hex for %x, %s and %v, so IDs can be formatted
+// without slicing them to the hash size first.
+func (id objectID) Format(f fmt.State, verb rune) {
+	io.WriteString(f, id.String())
+}
+
+// objectIDFromBytes copies a raw hash of the repository's size.
+func objectIDFromBytes(b []byte) objectID {
+	var id objectID
+	copy(id[:], b[:hashAlgo.size])
+	return id
+}
+
+// sumObjectID finishes h, which must be an instance of hashAlgo.
+func sumObjectID(h hash.Hash) objectID {
+	return objectIDFromBytes(h.Sum(nil))
+}
+
+// hashObjectData computes the ID of an object from its type and content.
+func hashObjectData(objType string, content []byte) objectID {
+	h := hashAlgo.new()
+	fmt.Fprintf(h, "%s %d\x00", objType, len(content))
+	h.Write(content)
+	return sumObjectID(h)
+}
@@ -0,0 +1,560 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var packDir = ".git/objects/pack"
+
+// Object type codes used in pack entry headers.
+const (
+	packCommit   = 1
+	packTree     = 2
+	packBlob     = 3
+	packTag      = 4
+	packOfsDelta = 6
+	packRefDelta = 7
+)
+
+const (
+	idxMagic       = "\377tOc"
+	idxHeaderSize  = 8 + 256*4
+	deltaCacheSize = 256
+)
+
+var packTypeNames = map[int]string{
+	packCommit: commitObject,
+	packTree:   treeObject,
+	packBlob:   blobObject,
+	packTag:    tagObject,
+}
+
+func packTypeCode(objType string) int {
+	for code, name := range packTypeNames {
+		if name == objType {
+			return code
+		}
+	}
+	return 0
+}
+
+// packIndex is a parsed version 2 .idx file. The raw bytes are kept and
+// entries are decoded on demand.
+type packIndex struct {
+	data    []byte
+	count   int
+	fanout  [256]uint32
+	hashes  int
+	crcs    int
+	offsets int
+	large   int
+}
+
+func readPackIndex(path string) (*packIndex, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read pack index: %w", err)
+	}
+	return parsePackIndex(data)
+}
+
+func parsePackIndex(data []byte) (*packIndex, error) {
+	if len(data) < idxHeaderSize+2*hashAlgo.size || string(data[:4]) != idxMagic {
+		return nil, fmt.Errorf("unsupported pack index format")
+	}
+	if version := binary.BigEndian.Uint32(data[4:8]); version != 2 {
+		return nil, fmt.Errorf("unsupported pack index version %d", version)
+	}
+
+	idx := &packIndex{data: data}
+	for i := range idx.fanout {
+		idx.fanout[i] = binary.BigEndian.Uint32(data[8+i*4:])
+	}
+	idx.count = int(idx.fanout[255])
+	idx.hashes = idxHeaderSize
+	idx.crcs = idx.hashes + idx.count*hashAlgo.size
+	idx.offsets = idx.crcs + idx.count*4
+	idx.large = idx.offsets + idx.count*4
+
+	if len(data) < idx.large+2*hashAlgo.size {
+		return nil, fmt.Errorf("truncated pack index")
+	}
+	return idx, nil
+}
+
+func (idx *packIndex) hashAt(i int) objectID {
+	return objectIDFromBytes(idx.data[idx.hashes+i*hashAlgo.size:])
+}
+
+func (idx *packIndex) crcAt(i int) uint32 {
+	return binary.BigEndian.Uint32(idx.data[idx.crcs+i*4:])
+}
+
+func (idx *packIndex) offsetAt(i int) int64 {
+	offset := binary.BigEndian.Uint32(idx.data[idx.offsets+i*4:])
+	if offset&0x80000000 == 0 {
+		return int64(offset)
+	}
+	pos := idx.large + int(offset&0x7fffffff)*8
+	return int64(binary.BigEndian.Uint64(idx.data[pos:]))
+}
+
+// find returns the position of hash in the index.
+func (idx *packIndex) find(hash objectID) (int, bool) {
+	lo := 0
+	if hash[0] > 0 {
+		lo = int(idx.fanout[hash[0]-1])
+	}
+	hi := int(idx.fanout[hash[0]])
+
+	size := hashAlgo.size
+	at := func(i int) []byte {
+		return idx.data[idx.hashes+i*size : idx.hashes+(i+1)*size]
+	}
+	i := lo + sort.Search(hi-lo, func(i int) bool {
+		return bytes.Compare(at(lo+i), hash.bytes()) >= 0
+	})
+	if i < hi && bytes.Equal(at(i), hash.bytes()) {
+		return i, true
+	}
+	return 0, false
+}
+
+type packedObject struct {
+	objType string
+	data    []byte
+}
+
+// pack is an open pack file. Its objects can be read from several
+// goroutines at once: the file is only read with ReadAt, between use and
+// the function it returns, and mu guards the caches filled in along the
+// way.
+type pack struct {
+	path string
+	idx  *packIndex
+	// fileMu guards file, which is nil once a retired pack was closed,
+	// and the count of reads using it.
+	fileMu  sync.Mutex
+	file    *os.File
+	users   int
+	retired bool
+	mu      sync.Mutex
+	cache   map[int64]packedObject
+	// byOffset maps entry offsets back to index positions and
+	// sortedOffsets lists every entry offset followed by the end of the
+	// last entry. Both are built lazily.
+	byOffset      map[int64]int
+	sortedOffsets []int64
+	// refBases locates ref-delta bases inside a pack that has no index
+	// yet, while it is being indexed.
+	refBases map[objectID]int64
+	// promisor is set for packs fetched from a promisor remote.
+	promisor bool
+	// inMidx is set for packs whose objects are looked up through the
+	// multi-pack-index.
+	inMidx bool
+}
+
+// packsMu guards loadedPacks, packsLoaded, the packs of alternates and
+// the multi-pack-index with the packs it covers, by position.
+var packsMu sync.Mutex
+var loadedPacks []*pack
+var packsLoaded bool
+var alternatePacks []*pack
+var loadedMidx *multiPackIndex
+var midxPacks []*pack
+
+// openPacks returns every pack in the object directory, loading their
+// indexes on first use. The packs of alternates are loaded along with
+// them but only searched by findPacked.
+func openPacks() ([]*pack, error) {
+	packsMu.Lock()
+	defer packsMu.Unlock()
+	if packsLoaded {
+		return loadedPacks, nil
+	}
+
+	packs, err := openPackDir(packDir)
+	if err != nil {
+		return nil, err
+	}
+	var borrowed []*pack
+	for _, dir := range alternateObjectDirs() {
+		more, err := openPackDir(filepath.Join(dir, "pack"))
+		if err != nil {
+			return nil, err
+		}
+		borrowed = append(borrowed, more...)
+	}
+
+	loadedPacks, alternatePacks, packsLoaded = packs, borrowed, true
+	loadedMidx, midxPacks = openMultiPackIndex(packs)
+	return packs, nil
+}
+
+// openPackDir opens the packs in dir.
+func openPackDir(dir string) ([]*pack, error) {
+	idxFiles, err := filepath.Glob(filepath.Join(dir, "pack-*.idx"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list packs: %w", err)
+	}
+
+	var packs []*pack
+	for _, idxFile := range idxFiles {
+		packFile := strings.TrimSuffix(idxFile, ".idx") + ".pack"
+		// An index without its pack, e.g. left over from an interrupted
+		// write, is ignored like git does.
+		if _, err := os.Stat(packFile); err != nil {
+			continue
+		}
+		p, err := openPack(packFile)
+		if err != nil {
+			return nil, err
+		}
+		packs = append(packs, p)
+	}
+	return packs, nil
+}
+
+// reloadPacks retires the open packs so the next lookup rescans the pack
+// directory, e.g. after a pack was written or deleted. Reads still going
+// on in other goroutines finish with the packs they started with.
+func reloadPacks() {
+	packsMu.Lock()
+	defer packsMu.Unlock()
+	for _, p := range loadedPacks {
+		p.retire()
+	}
+	for _, p := range alternatePacks {
+		p.retire()
+	}
+	loadedPacks, alternatePacks, packsLoaded = nil, nil, false
+	loadedMidx, midxPacks = nil, nil
+}
+
+// use returns the file of the pack for a read and the function to call
+// once the read is done. A retired pack read again is reopened for it.
+func (p *pack) use() (*os.File, func(), error) {
+	p.fileMu.Lock()
+	defer p.fileMu.Unlock()
+	if p.file == nil {
+		f, err := os.Open(p.path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open pack: %w", err)
+		}
+		p.file = f
+	}
+	p.users++
+	return p.file, p.done, nil
+}
+
+func (p *pack) done() {
+	p.fileMu.Lock()
+	defer p.fileMu.Unlock()
+	p.users--
+	if p.users == 0 && p.retired {
+		p.file.Close()
+		p.file = nil
+	}
+}
+
+// retire closes the file of the pack as soon as no read is using it.
+func (p *pack) retire() {
+	p.fileMu.Lock()
+	defer p.fileMu.Unlock()
+	p.retired = true
+	if p.users == 0 && p.file != nil {
+		p.file.Close()
+		p.file = nil
+	}
+}
+
+func openPack(path string) (*pack, error) {
+	idx, err := readPackIndex(strings.TrimSuffix(path, ".pack") + ".idx")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open pack: %w", err)
+	}
+
+	p := &pack{path: path, idx: idx, file: f, cache: make(map[int64]packedObject)}
+	if _, err := os.Stat(strings.TrimSuffix(path, ".pack") + ".promisor"); err == nil {
+		p.promisor = true
+	}
+	return p, nil
+}
+
+// findPacked returns the pack containing hash and the entry's offset. The
+// packs the multi-pack-index covers are searched at once through it; only
+// packs added since are searched one by one, then those of alternates.
+func findPacked(hash objectID) (*pack, int64, bool) {
+	packs, err := openPacks()
+	if err != nil {
+		return nil, 0, false
+	}
+	packsMu.Lock()
+	m, covered, borrowed := loadedMidx, midxPacks, alternatePacks
+	packsMu.Unlock()
+	if m != nil {
+		if e, ok := m.find(hash); ok {
+			return covered[e.pack], e.offset, true
+		}
+	}
+	for _, p := range packs {
+		if p.inMidx {
+			continue
+		}
+		if i, ok := p.idx.find(hash); ok {
+			return p, p.idx.offsetAt(i), true
+		}
+	}
+	for _, p := range borrowed {
+		if i, ok := p.idx.find(hash); ok {
+			return p, p.idx.offsetAt(i), true
+		}
+	}
+	return nil, 0, false
+}
+
+func readPackedObject(hash objectID) (string, []byte, error) {
+	p, offset, ok := findPacked(hash)
+	if !ok {
+		return "", nil, fmt.Errorf("%x: %w", hash, errObjectNotFound)
+	}
+	obj, err := p.readAt(offset)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to read %x from %s: %w", hash, filepath.Base(p.path), err)
+	}
+	return obj.objType, obj.data, nil
+}
+
+type packEntryHeader struct {
+	typeCode   int
+	size       int64
+	dataOffset int64
+	baseOffset int64
+	baseHash   objectID
+}
+
+func (p *pack) readEntryHeader(offset int64) (packEntryHeader, error) {
+	f, done, err := p.use()
+	if err != nil {
+		return packEntryHeader{}, err
+	}
+	defer done()
+	var buf [32]byte
+	n, err := f.ReadAt(buf[:], offset)
+	if err != nil && !(errors.Is(err, io.EOF) && n > 0) {
+		return packEntryHeader{}, fmt.Errorf("failed to read entry header: %w", err)
+	}
+	h, err := parseEntryHeader(buf[:n], offset)
+	if err != nil {
+		return packEntryHeader{}, err
+	}
+	if h.typeCode == packRefDelta {
+		if _, err := f.ReadAt(h.baseHash[:hashAlgo.size], h.dataOffset); err != nil {
+			return packEntryHeader{}, fmt.Errorf("failed to read delta base: %w", err)
+		}
+		h.dataOffset += int64(hashAlgo.size)
+	}
+	return h, nil
+}
+
+// parseEntryHeader decodes the type/size varint and, for offset deltas, the
+// base offset that follows it. Ref-delta base hashes are left to the caller.
+func parseEntryHeader(buf []byte, offset int64) (packEntryHeader, error) {
+	if len(buf) == 0 {
+		return packEntryHeader{}, fmt.Errorf("truncated entry header")
+	}
+
+	h := packEntryHeader{typeCode: int(buf[0]>>4) & 7, size: int64(buf[0] & 0x0f)}
+	i, shift := 1, 4
+	for buf[i-1]&0x80 != 0 {
+		if i >= len(buf) || shift > 56 {
+			return packEntryHeader{}, fmt.Errorf("invalid entry header")
+		}
+		h.size |= int64(buf[i]&0x7f) << shift
+		shift += 7
+		i++
+	}
+
+	if h.typeCode == packOfsDelta {
+		if i >= len(buf) {
+			return packEntryHeader{}, fmt.Errorf("truncated delta offset")
+		}
+		rel := int64(buf[i] & 0x7f)
+		for buf[i]&0x80 != 0 {
+			i++
+			if i >= len(buf) || rel >= math.MaxInt64>>7 {
+				return packEntryHeader{}, fmt.Errorf("invalid delta offset")
+			}
+			rel = ((rel + 1) << 7) | int64(buf[i]&0x7f)
+		}
+		i++
+		h.baseOffset = offset - rel
+		if h.baseOffset < 0 || rel == 0 {
+			return packEntryHeader{}, fmt.Errorf("invalid delta offset")
+		}
+	}
+
+	h.dataOffset = offset + int64(i)
+	return h, nil
+}
+
+func (p *pack) inflate(offset, size int64) ([]byte, error) {
+	f, done, err := p.use()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	r, err := zlib.NewReader(bufio.NewReader(io.NewSectionReader(f, offset, math.MaxInt64-offset)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zlib reader: %w", err)
+	}
+	defer r.Close()
+
+	limits, err := loadParseLimits()
+	if err != nil {
+		return nil, err
+	}
+	if !limits.strict {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("failed to decompress entry: %w", err)
+		}
+		return data, nil
+	}
+	// The size in the entry header is not trusted to allocate up front.
+	data, err := io.ReadAll(io.LimitReader(r, size))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress entry: %w", err)
+	}
+	if int64(len(data)) != size {
+		return nil, fmt.Errorf("failed to decompress entry: %w", io.ErrUnexpectedEOF)
+	}
+	return data, nil
+}
+
+// readAt reads and fully resolves the entry at offset.
+func (p *pack) readAt(offset int64) (packedObject, error) {
+	p.mu.Lock()
+	obj, ok := p.cache[offset]
+	p.mu.Unlock()
+	if ok {
+		return obj, nil
+	}
+
+	h, err := p.readEntryHeader(offset)
+	if err != nil {
+		return packedObject{}, err
+	}
+	if h.typeCode == packOfsDelta || h.typeCode == packRefDelta {
+		if err := checkDeltaSize(h.size); err != nil {
+			return packedObject{}, err
+		}
+	}
+	data, err := p.inflate(h.dataOffset, h.size)
+	if err != nil {
+		return packedObject{}, err
+	}
+
+	switch h.typeCode {
+	case packCommit, packTree, packBlob, packTag:
+		obj = packedObject{objType: packTypeNames[h.typeCode], data: data}
+	case packOfsDelta:
+		base, err := p.readAt(h.baseOffset)
+		if err != nil {
+			return packedObject{}, err
+		}
+		resolved, err := applyDelta(base.data, data)
+		if err != nil {
+			return packedObject{}, err
+		}
+		obj = packedObject{objType: base.objType, data: resolved}
+	case packRefDelta:
+		var baseType string
+		var baseData []byte
+		if baseOffset, ok := p.refBases[h.baseHash]; ok {
+			base, err := p.readAt(baseOffset)
+			if err != nil {
+				return packedObject{}, err
+			}
+			baseType, baseData = base.objType, base.data
+		} else if baseType, baseData, err = readObject(h.baseHash); err != nil {
+			return packedObject{}, fmt.Errorf("missing delta base: %w", err)
+		}
+		resolved, err := applyDelta(baseData, data)
+		if err != nil {
+			return packedObject{}, err
+		}
+		obj = packedObject{objType: baseType, data: resolved}
+	default:
+		return packedObject{}, fmt.Errorf("invalid entry type %d", h.typeCode)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.cache) >= deltaCacheSize {
+		clear(p.cache)
+	}
+	p.cache[offset] = obj
+	return obj, nil
+}
+
+// rawDelta returns the delta stored at offset and the hash of its base, or
+// ok=false if the object is stored whole.
+func (p *pack) rawDelta(offset int64) (base objectID, delta []byte, ok bool, err error) {
+	h, err := p.readEntryHeader(offset)
+	if err != nil {
+		return base, nil, false, err
+	}
+
+	switch h.typeCode {
+	case packOfsDelta:
+		var found bool
+		if base, found = p.hashAtOffset(h.baseOffset); !found {
+			return base, nil, false, fmt.Errorf("delta base at offset %d not in index", h.baseOffset)
+		}
+	case packRefDelta:
+		base = h.baseHash
+	default:
+		return base, nil, false, nil
+	}
+
+	delta, err = p.inflate(h.dataOffset, h.size)
+	if err != nil {
+		return base, nil, false, err
+	}
+	return base, delta, true, nil
+}
+
+// listPackedObjects returns the hashes of every object in every pack.
+func listPackedObjects() ([]objectID, error) {
+	packs, err := openPacks()
+	if err != nil {
+		return nil, err
+	}
+
+	var hashes []objectID
+	for _, p := range packs {
+		for i := 0; i < p.idx.count; i++ {
+			hashes = append(hashes, p.idx.hashAt(i))
+		}
+	}
+	return hashes, nil
+}
@@ -0,0 +1,447 @@
+package mygit
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"unicode"
+)
+
+// packObject is an object queued for writing into a pack.
+type packObject struct {
+	hash    objectID
+	objType string
+	data    []byte
+	// name is the path the object was reached through, used to group
+	// similar objects together when searching for deltas.
+	name string
+
+	base  *packObject
+	delta []byte
+	depth int
+
+	// reuseBase and reuseDelta describe a delta found in an existing pack
+	// that may be copied instead of recomputed.
+	reuseBase  objectID
+	reuseDelta []byte
+	// packed is set for objects loaded from an existing pack, which count
+	// as reused if they are written the way they were stored.
+	packed bool
+
+	written bool
+	offset  int64
+	crc     uint32
+}
+
+type packOptions struct {
+	window int
+	depth  int
+	// reuseDeltas allows deltas from existing packs to be kept as-is.
+	reuseDeltas bool
+}
+
+type packStats struct {
+	total       int
+	deltas      int
+	reused      int
+	reusedDelta int
+}
+
+// writePackSummary prints the object counts of a written pack the way git
+// ends pack-objects.
+func writePackSummary(w io.Writer, stats packStats) {
+	fmt.Fprintf(w, "Total %d (delta %d), reused %d (delta %d)\n",
+		stats.total, stats.deltas, stats.reused, stats.reusedDelta)
+}
+
+// loadPackObjects reads objects to be packed. With reuse set, any delta an
+// object is already stored as is recorded so computeDeltas can keep it.
+func loadPackObjects(objects []namedObject, reuse bool) ([]*packObject, error) {
+	var result []*packObject
+	for _, o := range objects {
+		objType, data, err := readObject(o.hash)
+		if err != nil {
+			return nil, err
+		}
+		obj := &packObject{hash: o.hash, objType: objType, data: data, name: o.name}
+
+		if reuse {
+			if p, offset, ok := findPacked(o.hash); ok {
+				obj.packed = true
+				base, delta, ok, err := p.rawDelta(offset)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					obj.reuseBase, obj.reuseDelta = base, delta
+				}
+			}
+		}
+		result = append(result, obj)
+	}
+	return result, nil
+}
+
+// packNameHash mirrors git's pack_name_hash: the last characters of a path
+// weigh the most so files with the same name or extension sort together.
+func packNameHash(name string) uint32 {
+	var h uint32
+	for _, c := range []byte(name) {
+		if unicode.IsSpace(rune(c)) {
+			continue
+		}
+		h = (h >> 2) + (uint32(c) << 24)
+	}
+	return h
+}
+
+// computeDeltas chooses a delta base for each object by trying the previous
+// window objects of the same type, sorted by name hash and size, and keeping
+// the smallest delta whose chain stays within opts.depth.
+func computeDeltas(objects []*packObject, opts packOptions) packStats {
+	var stats packStats
+	byHash := make(map[objectID]*packObject, len(objects))
+	for _, obj := range objects {
+		byHash[obj.hash] = obj
+	}
+
+	reusedBases := make(map[*packObject]bool)
+	reusedDeltas := make(map[*packObject]bool)
+	if opts.reuseDeltas {
+		for _, obj := range objects {
+			if base, ok := byHash[obj.reuseBase]; ok && obj.reuseDelta != nil && base != obj {
+				obj.base, obj.delta = base, obj.reuseDelta
+			}
+		}
+
+		visiting := make(map[*packObject]bool)
+		var resolveDepth func(obj *packObject) int
+		resolveDepth = func(obj *packObject) int {
+			if obj.base == nil || obj.depth > 0 {
+				return obj.depth
+			}
+			if visiting[obj] {
+				obj.base, obj.delta = nil, nil
+				return 0
+			}
+			visiting[obj] = true
+			depth := resolveDepth(obj.base) + 1
+			delete(visiting, obj)
+			if obj.base == nil || depth > opts.depth {
+				obj.base, obj.delta = nil, nil
+				return 0
+			}
+			obj.depth = depth
+			return depth
+		}
+		for _, obj := range objects {
+			resolveDepth(obj)
+		}
+		for _, obj := range objects {
+			if obj.base != nil {
+				reusedBases[obj.base] = true
+				reusedDeltas[obj] = true
+				stats.reusedDelta++
+			}
+		}
+	}
+
+	sorted := make([]*packObject, len(objects))
+	copy(sorted, objects)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		a, b := sorted[i], sorted[j]
+		if a.objType != b.objType {
+			return a.objType < b.objType
+		}
+		if ha, hb := packNameHash(a.name), packNameHash(b.name); ha != hb {
+			return ha < hb
+		}
+		return len(a.data) > len(b.data)
+	})
+
+	type candidate struct {
+		obj   *packObject
+		index *deltaIndex
+	}
+	var window []candidate
+
+	for _, trg := range sorted {
+		if trg.base == nil && !reusedBases[trg] && len(trg.data) >= deltaMinSize && opts.window > 0 {
+			maxSize := len(trg.data)/2 - deltaHeaderSlack
+			for i := len(window) - 1; i >= 0; i-- {
+				cand := &window[i]
+				src := cand.obj
+				if src.objType != trg.objType || src.depth >= opts.depth {
+					continue
+				}
+				if len(trg.data) < len(src.data)/deltaSizeRatio || len(src.data) < deltaMinSize {
+					continue
+				}
+				if cand.index == nil {
+					cand.index = newDeltaIndex(src.data)
+				}
+				if delta := cand.index.createDelta(trg.data, maxSize); delta != nil && len(delta) < maxSize {
+					trg.base, trg.delta, trg.depth = src, delta, src.depth+1
+					maxSize = len(delta)
+				}
+			}
+		}
+
+		window = append(window, candidate{obj: trg})
+		if len(window) > opts.window {
+			window = window[1:]
+		}
+	}
+
+	for _, obj := range objects {
+		if obj.base != nil {
+			stats.deltas++
+		}
+		if reusedDeltas[obj] || obj.packed && obj.base == nil && obj.reuseDelta == nil {
+			stats.reused++
+		}
+	}
+	stats.total = len(objects)
+	return stats
+}
+
+type packWriter struct {
+	w      io.Writer
+	sum    hash.Hash
+	offset int64
+}
+
+func (pw *packWriter) Write(p []byte) (int, error) {
+	n, err := pw.w.Write(p)
+	pw.sum.Write(p[:n])
+	pw.offset += int64(n)
+	return n, err
+}
+
+// writePack streams objects in pack format to w, writing every delta base
+// before the objects that depend on it. It returns the pack checksum.
+func writePack(w io.Writer, objects []*packObject) (objectID, error) {
+	pw := &packWriter{w: w, sum: hashAlgo.new()}
+
+	header := make([]byte, 12)
+	copy(header, "PACK")
+	binary.BigEndian.PutUint32(header[4:], 2)
+	binary.BigEndian.PutUint32(header[8:], uint32(len(objects)))
+	if _, err := pw.Write(header); err != nil {
+		return objectID{}, fmt.Errorf("failed to write pack header: %w", err)
+	}
+
+	for _, obj := range objects {
+		if err := pw.writeObject(obj); err != nil {
+			return objectID{}, err
+		}
+	}
+
+	checksum := sumObjectID(pw.sum)
+	if _, err := w.Write(checksum.bytes()); err != nil {
+		return objectID{}, fmt.Errorf("failed to write pack checksum: %w", err)
+	}
+	return checksum, nil
+}
+
+func (pw *packWriter) writeObject(obj *packObject) error {
+	if obj.written {
+		return nil
+	}
+	if obj.base != nil {
+		if err := pw.writeObject(obj.base); err != nil {
+			return err
+		}
+	}
+
+	obj.offset = pw.offset
+	obj.written = true
+
+	typeCode := packTypeCode(obj.objType)
+	data := obj.data
+	if obj.base != nil {
+		typeCode = packOfsDelta
+		data = obj.delta
+	}
+
+	var entry bytes.Buffer
+	entry.Write(encodeEntryHeader(typeCode, len(data)))
+	if obj.base != nil {
+		entry.Write(encodeOfsDelta(obj.offset - obj.base.offset))
+	}
+
+	zw := zlib.NewWriter(&entry)
+	if _, err := zw.Write(data); err != nil {
+		return fmt.Errorf("failed to compress object: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("failed to compress object: %w", err)
+	}
+
+	obj.crc = crc32.ChecksumIEEE(entry.Bytes())
+	if _, err := pw.Write(entry.Bytes()); err != nil {
+		return fmt.Errorf("failed to write pack entry: %w", err)
+	}
+	return nil
+}
+
+func encodeEntryHeader(typeCode, size int) []byte {
+	b := []byte{byte(typeCode<<4) | byte(size&0x0f)}
+	size >>= 4
+	for size > 0 {
+		b[len(b)-1] |= 0x80
+		b = append(b, byte(size&0x7f))
+		size >>= 7
+	}
+	return b
+}
+
+// encodeOfsDelta writes the distance back to the delta base using git's
+// offset encoding, in which each continuation byte adds one before shifting.
+func encodeOfsDelta(rel int64) []byte {
+	b := []byte{byte(rel & 0x7f)}
+	for rel >>= 7; rel > 0; rel >>= 7 {
+		rel--
+		b = append([]byte{byte(rel&0x7f) | 0x80}, b...)
+	}
+	return b
+}
+
+type idxEntry struct {
+	hash   objectID
+	crc    uint32
+	offset int64
+}
+
+// writePackIndex writes a version 2 pack index for the given entries.
+func writePackIndex(w io.Writer, entries []idxEntry, packChecksum objectID) error {
+	sort.Slice(entries, func(i, j int) bool {
+		return bytes.Compare(entries[i].hash[:], entries[j].hash[:]) < 0
+	})
+
+	sum := hashAlgo.new()
+	mw := io.MultiWriter(w, sum)
+
+	var buf bytes.Buffer
+	buf.WriteString(idxMagic)
+	binary.Write(&buf, binary.BigEndian, uint32(2))
+
+	var fanout [256]uint32
+	for _, e := range entries {
+		fanout[e.hash[0]]++
+	}
+	for i := 1; i < 256; i++ {
+		fanout[i] += fanout[i-1]
+	}
+	binary.Write(&buf, binary.BigEndian, fanout)
+
+	for _, e := range entries {
+		buf.Write(e.hash.bytes())
+	}
+	for _, e := range entries {
+		binary.Write(&buf, binary.BigEndian, e.crc)
+	}
+
+	var large []uint64
+	for _, e := range entries {
+		if e.offset < 0x80000000 {
+			binary.Write(&buf, binary.BigEndian, uint32(e.offset))
+		} else {
+			binary.Write(&buf, binary.BigEndian, uint32(len(large))|0x80000000)
+			large = append(large, uint64(e.offset))
+		}
+	}
+	for _, offset := range large {
+		binary.Write(&buf, binary.BigEndian, offset)
+	}
+	buf.Write(packChecksum.bytes())
+
+	if _, err := mw.Write(buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write pack index: %w", err)
+	}
+	if _, err := w.Write(sum.Sum(nil)); err != nil {
+		return fmt.Errorf("failed to write pack index checksum: %w", err)
+	}
+	return nil
+}
+
+// writePackFile writes objects as a new pack and index in the pack
+// directory and returns the pack checksum, which also names the files.
+func writePackFile(objects []*packObject) (objectID, error) {
+	if err := os.MkdirAll(packDir, 0755); err != nil {
+		return objectID{}, fmt.Errorf("failed to create pack directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(packDir, "tmp_pack_")
+	if err != nil {
+		return objectID{}, fmt.Errorf("failed to create pack file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	checksum, err := writePack(tmp, objects)
+	if err != nil {
+		return objectID{}, err
+	}
+	if err := fsyncFile(tmp, fsyncPack); err != nil {
+		return objectID{}, err
+	}
+	if err := tmp.Close(); err != nil {
+		return objectID{}, fmt.Errorf("failed to write pack file: %w", err)
+	}
+
+	entries := make([]idxEntry, len(objects))
+	for i, obj := range objects {
+		entries[i] = idxEntry{hash: obj.hash, crc: obj.crc, offset: obj.offset}
+	}
+	if err := installPack(tmp.Name(), entries, checksum); err != nil {
+		return objectID{}, err
+	}
+	return checksum, nil
+}
+
+// installPack moves a finished pack file into place and writes its index.
+// The index is renamed last so readers never see an index without a pack.
+func installPack(tmpPack string, entries []idxEntry, checksum objectID) error {
+	base := filepath.Join(packDir, fmt.Sprintf("pack-%x", checksum))
+
+	tmpIdx, err := os.CreateTemp(packDir, "tmp_idx_")
+	if err != nil {
+		return fmt.Errorf("failed to create pack index: %w", err)
+	}
+	defer os.Remove(tmpIdx.Name())
+	defer tmpIdx.Close()
+
+	if err := writePackIndex(tmpIdx, entries, checksum); err != nil {
+		return err
+	}
+	if err := fsyncFile(tmpIdx, fsyncPackMetadata); err != nil {
+		return err
+	}
+	if err := tmpIdx.Close(); err != nil {
+		return fmt.Errorf("failed to write pack index: %w", err)
+	}
+
+	if err := os.Chmod(tmpPack, 0444); err != nil {
+		return fmt.Errorf("failed to set pack permissions: %w", err)
+	}
+	if err := os.Chmod(tmpIdx.Name(), 0444); err != nil {
+		return fmt.Errorf("failed to set pack index permissions: %w", err)
+	}
+	if err := os.Rename(tmpPack, base+".pack"); err != nil {
+		return fmt.Errorf("failed to install pack: %w", err)
+	}
+	if err := os.Rename(tmpIdx.Name(), base+".idx"); err != nil {
+		return fmt.Errorf("failed to install pack index: %w", err)
+	}
+
+	reloadPacks()
+	return nil
+}
@@ -0,0 +1,173 @@
+package mygit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/codecrafters-io/git-starter-go/internal/pktline"
+)
+
+// parseLimits bound what the object, pack and wire decoders accept in
+// strict mode, which transfer.strictParsing turns on. A hostile remote can
+// then neither make them allocate without end nor slip in malformed
+// objects that are only caught once something trips over them.
+type parseLimits struct {
+	strict bool
+	// maxHeaderSize bounds the headers of a commit or tag, up to the
+	// blank line before the message (transfer.maxHeaderSize).
+	maxHeaderSize int
+	// maxNameLength bounds the names of tree entries
+	// (transfer.maxNameLength).
+	maxNameLength int
+	// maxDeltaSize bounds a delta, as stored and once applied
+	// (transfer.maxDeltaSize).
+	maxDeltaSize int64
+	// maxListSize bounds the pkt-line lists a server answers with, such as
+	// its refs (transfer.maxListSize).
+	maxListSize int
+}
+
+// parseLimitSettings holds the limits once read by loadParseLimits.
+var parseLimitSettings struct {
+	sync.Mutex
+	loaded bool
+	parseLimits
+}
+
+// loadParseLimits reads the strict parsing settings unless already done.
+func loadParseLimits() (parseLimits, error) {
+	parseLimitSettings.Lock()
+	defer parseLimitSettings.Unlock()
+	if !parseLimitSettings.loaded {
+		limits, err := readParseLimits()
+		if err != nil {
+			return parseLimits{}, err
+		}
+		parseLimitSettings.parseLimits, parseLimitSettings.loaded = limits, true
+	}
+	return parseLimitSettings.parseLimits, nil
+}
+
+func readParseLimits() (parseLimits, error) {
+	var l parseLimits
+	cfg, err := loadConfig()
+	if err != nil {
+		return l, err
+	}
+	if l.strict, err = cfg.getBool("transfer.strictParsing", false); err != nil || !l.strict {
+		return l, err
+	}
+	if l.maxHeaderSize, err = cfg.getInt("transfer.maxHeaderSize", 1<<20); err != nil {
+		return l, err
+	}
+	if l.maxNameLength, err = cfg.getInt("transfer.maxNameLength", 4096); err != nil {
+		return l, err
+	}
+	maxDeltaSize, err := cfg.getInt("transfer.maxDeltaSize", 512<<20)
+	if err != nil {
+		return l, err
+	}
+	l.maxDeltaSize = int64(maxDeltaSize)
+	if l.maxListSize, err = cfg.getInt("transfer.maxListSize", 256<<20); err != nil {
+		return l, err
+	}
+	return l, nil
+}
+
+// wireReader reads the pkt-lines of a server's answer, bounding the lists
+// it collects in strict mode. A bad setting is left for the object
+// decoders to report.
+func wireReader(r io.Reader) *pktline.Reader {
+	pr := pktline.NewReader(r)
+	if limits, err := loadParseLimits(); err == nil && limits.strict {
+		pr.MaxListSize = limits.maxListSize
+	}
+	return pr
+}
+
+// readWireBody reads a whole response body, which strict mode bounds like
+// the lists within it.
+func readWireBody(r io.Reader) ([]byte, error) {
+	limits, err := loadParseLimits()
+	if err != nil {
+		return nil, err
+	}
+	if !limits.strict {
+		return io.ReadAll(r)
+	}
+	body, err := io.ReadAll(io.LimitReader(r, int64(limits.maxListSize)+1))
+	if err == nil && len(body) > limits.maxListSize {
+		err = fmt.Errorf("response exceeds transfer.maxListSize of %d bytes", limits.maxListSize)
+	}
+	return body, err
+}
+
+// checkDeltaSize fails for a delta, or the object it builds, larger than
+// strict mode allows.
+func checkDeltaSize(size int64) error {
+	limits, err := loadParseLimits()
+	if err != nil || !limits.strict || size <= limits.maxDeltaSize {
+		return err
+	}
+	return fmt.Errorf("delta of %d bytes exceeds transfer.maxDeltaSize", size)
+}
+
+// strictTreeModes are the modes tree entries may have in strict mode,
+// including the group-writable files of old repositories.
+var strictTreeModes = map[string]bool{
+	"100644": true, "100755": true, "100664": true,
+	"120000": true, "40000": true, gitlinkMode: true,
+}
+
+// checkTreeEntry rejects, in strict mode, tree entries that could not have
+// been written by git or that would escape their directory when checked
+// out.
+func checkTreeEntry(mode, name string) error {
+	limits, err := loadParseLimits()
+	if err != nil || !limits.strict {
+		return err
+	}
+	switch {
+	case !strictTreeModes[mode]:
+		return fmt.Errorf("invalid tree entry mode %q", mode)
+	case len(name) > limits.maxNameLength:
+		return fmt.Errorf("tree entry name exceeds transfer.maxNameLength of %d bytes", limits.maxNameLength)
+	case name == "" || name == "." || name == ".." || strings.EqualFold(name, ".git") || strings.Contains(name, "/"):
+		return fmt.Errorf("invalid tree entry name %q", name)
+	}
+	return nil
+}
+
+// checkObjectHeaders checks, in strict mode, that the headers of a commit
+// or tag fit transfer.maxHeaderSize and start with the required ones in
+// order: each of required must be given once, except that those named in
+// repeated may be given any number of times.
+func checkObjectHeaders(objType string, headers []byte, required []string, repeated map[string]bool) error {
+	limits, err := loadParseLimits()
+	if err != nil || !limits.strict {
+		return err
+	}
+	if len(headers) > limits.maxHeaderSize {
+		return fmt.Errorf("%s headers exceed transfer.maxHeaderSize of %d bytes", objType, limits.maxHeaderSize)
+	}
+	if i := bytes.IndexByte(headers, 0); i >= 0 {
+		return fmt.Errorf("%s header has a NUL at offset %d", objType, i)
+	}
+	lines := strings.Split(string(headers), "\n")
+	for _, key := range required {
+		if repeated[key] {
+			for len(lines) > 0 && strings.HasPrefix(lines[0], key+" ") {
+				lines = lines[1:]
+			}
+			continue
+		}
+		if len(lines) == 0 || !strings.HasPrefix(lines[0], key+" ") {
+			return fmt.Errorf("%s is missing its %s header", objType, key)
+		}
+		lines = lines[1:]
+	}
+	return nil
+}
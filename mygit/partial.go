@@ -0,0 +1,172 @@
+package mygit
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// parseObjectFilter validates a --filter spec and returns it in the form
+// sent to the server, with size suffixes expanded to bytes.
+func parseObjectFilter(spec string) (string, error) {
+	switch {
+	case spec == "blob:none":
+		return spec, nil
+	case strings.HasPrefix(spec, "blob:limit="):
+		size, err := parseSize(strings.TrimPrefix(spec, "blob:limit="))
+		if err != nil {
+			return "", fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		return fmt.Sprintf("blob:limit=%d", size), nil
+	case strings.HasPrefix(spec, "tree:"):
+		if _, err := strconv.ParseUint(strings.TrimPrefix(spec, "tree:"), 10, 64); err != nil {
+			return "", fmt.Errorf("invalid filter-spec '%s'", spec)
+		}
+		return spec, nil
+	case strings.HasPrefix(spec, "object:type="):
+		switch strings.TrimPrefix(spec, "object:type=") {
+		case blobObject, treeObject, commitObject, tagObject:
+			return spec, nil
+		}
+	}
+	return "", fmt.Errorf("invalid filter-spec '%s'", spec)
+}
+
+// parseSize parses a byte count the way config integers are parsed,
+// with an optional k, m or g suffix, refusing negative counts.
+func parseSize(s string) (int64, error) {
+	n, err := parseConfigInt(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, errConfigIntRange
+	}
+	return n, nil
+}
+
+// promisorFilter returns the filter to use when fetching from remote: the
+// one given on the command line, else the default recorded for a promisor
+// remote by an earlier partial fetch.
+func promisorFilter(cfg *config, remote *remoteConfig, filter string) string {
+	if filter != "" || remote.name == "" {
+		return filter
+	}
+	if promisor, _ := cfg.getBool("remote."+remote.name+".promisor", false); !promisor {
+		return ""
+	}
+	filter, _ = cfg.get("remote." + remote.name + ".partialclonefilter")
+	return filter
+}
+
+// registerPromisorRemote marks remote as a promisor, whose objects may
+// legitimately reference objects that were never downloaded. The first
+// filter used becomes the remote's default.
+func registerPromisorRemote(cfg *config, remote, filter string) error {
+	settings := [][2]string{{"remote." + remote + ".promisor", "true"}}
+	if _, ok := cfg.get("remote." + remote + ".partialclonefilter"); !ok {
+		settings = append(settings, [2]string{"remote." + remote + ".partialclonefilter", filter})
+	}
+	// Older git versions must not touch a repository with missing objects,
+	// so the extension also requires format version 1.
+	if _, ok := cfg.get("extensions.partialclone"); !ok {
+		settings = append(settings,
+			[2]string{"core.repositoryformatversion", "1"},
+			[2]string{"extensions.partialclone", remote})
+	}
+	for _, kv := range settings {
+		if err := setConfigValue(configFile, kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markPromisorPack records that the pack with the given checksum came from
+// a promisor remote.
+func markPromisorPack(checksum objectID) error {
+	path := filepath.Join(packDir, fmt.Sprintf("pack-%x.promisor", checksum))
+	if err := os.WriteFile(path, nil, 0444); err != nil {
+		return fmt.Errorf("failed to write promisor file: %w", err)
+	}
+	reloadPacks()
+	return nil
+}
+
+var (
+	// lazyFetchMu lets one fetch of missing objects run at a time, and
+	// lazyFetching is set meanwhile so that reads made by the fetch itself,
+	// or by other goroutines, fail rather than start another.
+	lazyFetchMu  sync.Mutex
+	lazyFetching atomic.Bool
+)
+
+// fetchPromisedObjects downloads objects a partial clone lacks from its
+// promisor remote, in a single request as git does for the blobs a
+// checkout needs.
+func fetchPromisedObjects(hashes []objectID) error {
+	if len(hashes) == 0 || repoFormat.partialClone == "" {
+		return nil
+	}
+	lazyFetchMu.Lock()
+	defer lazyFetchMu.Unlock()
+	lazyFetching.Store(true)
+	defer lazyFetching.Store(false)
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	remote, err := lookupRemote(cfg, repoFormat.partialClone)
+	if err != nil {
+		return err
+	}
+	t, adv, err := openUploadPack(cfg, remote.url, []string{"HEAD"})
+	if err != nil {
+		return err
+	}
+	if t == nil {
+		return fmt.Errorf("cannot fetch missing objects from bundle %s", remote.url)
+	}
+	defer t.close()
+	// Objects asked for by name are sent whatever the filter, which keeps
+	// what they reference out.
+	req := fetchRequest{wants: hashes, filter: "blob:none"}
+	if adv.version == 2 {
+		_, err = fetchPackV2(t, adv, req)
+	} else {
+		_, err = fetchPack(t, adv, req)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to fetch missing objects from %s: %w", remote.name, err)
+	}
+	return nil
+}
+
+// fetchMissingObject fetches an object a partial clone lacks from its
+// promisor remote, as git does when an object it reads is missing, and
+// reports whether the object is now there. GIT_NO_LAZY_FETCH turns this
+// off.
+func fetchMissingObject(hash objectID) bool {
+	if repoFormat.partialClone == "" || lazyFetching.Load() {
+		return false
+	}
+	if off, err := parseConfigBool(os.Getenv("GIT_NO_LAZY_FETCH")); err == nil && off {
+		return false
+	}
+	if err := fetchPromisedObjects([]objectID{hash}); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+		return false
+	}
+	return hasObject(hash)
+}
+
+// isPromisorObject reports whether hash is stored in a promisor pack. The
+// objects such an object references may be missing.
+func isPromisorObject(hash objectID) bool {
+	p, _, ok := findPacked(hash)
+	return ok && p.promisor
+}
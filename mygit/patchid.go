@@ -0,0 +1,303 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// patchIDOptions select how patch ids are computed. Stable ids hash each
+// file separately and add up the hashes, so that they do not depend on
+// the order of the files in the patch. Verbatim ids keep whitespace,
+// which is otherwise ignored, and imply stable ones.
+type patchIDOptions struct {
+	stable   bool
+	verbatim bool
+}
+
+// patchIDReader reads patch ids from patches such as the output of
+// "log -p" or "format-patch", each introduced by its commit id.
+type patchIDReader struct {
+	r    *bufio.Reader
+	opts patchIDOptions
+	eof  bool
+}
+
+// addPatchID adds a file's hash to the sum of a stable patch id, as
+// git's 20-byte sum with carry.
+func addPatchID(sum *objectID, h hash.Hash) {
+	digest := h.Sum(nil)
+	h.Reset()
+	carry := 0
+	for i := range digest {
+		carry += int(sum[i]) + int(digest[i])
+		sum[i] = byte(carry)
+		carry >>= 8
+	}
+}
+
+// scanHunkHeader reads the line counts of a "@@ -a,b +c,d @@" line.
+func scanHunkHeader(line string) (before, after int) {
+	counts := func(s string) (int, string, bool) {
+		n := len(s) - len(strings.TrimLeft(s, "0123456789"))
+		if n == 0 {
+			return 0, s, false
+		}
+		rest := s[n:]
+		if !strings.HasPrefix(rest, ",") {
+			return 1, rest, true
+		}
+		rest = rest[1:]
+		n = len(rest) - len(strings.TrimLeft(rest, "0123456789"))
+		count, _ := strconv.Atoi(rest[:n])
+		return count, rest[n:], n > 0
+	}
+	before, rest, ok := counts(strings.TrimPrefix(line, "@@ -"))
+	if !ok || !strings.HasPrefix(rest, " +") {
+		return 0, 0
+	}
+	after, _, ok = counts(rest[2:])
+	if !ok {
+		return 0, 0
+	}
+	return before, after
+}
+
+// removeSpace drops the whitespace of a line, which patch ids ignore.
+func removeSpace(line string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" \t\n\r", r) {
+			return -1
+		}
+		return r
+	}, line)
+}
+
+func isASCIILetter(c byte) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
+
+// next reads the patch up to the next commit id and returns its id, or
+// a zero id if it is empty, along with that next commit id.
+func (p *patchIDReader) next() (id, nextCommit objectID, err error) {
+	h := hashAlgo.new()
+	patchLen := 0
+	before, after := -1, -1
+	binary := false
+	var preImage, postImage string
+
+	for {
+		line, err := p.r.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return objectID{}, objectID{}, err
+		}
+		if line == "" {
+			p.eof = true
+			break
+		}
+
+		rest := line
+		for _, prefix := range []string{"diff-tree ", "commit ", "From "} {
+			if after, ok := strings.CutPrefix(line, prefix); ok {
+				rest = after
+				break
+			}
+		}
+		if rest == line && strings.HasPrefix(line, "\\ ") && len(line) > 12 {
+			if p.opts.verbatim {
+				h.Write([]byte(line))
+			}
+			continue
+		}
+		if hex := hashAlgo.size * 2; len(rest) >= hex {
+			if commitID, err := parseHash(rest[:hex]); err == nil {
+				nextCommit = commitID
+				break
+			}
+		}
+
+		// Commit messages come before the diff.
+		if patchLen == 0 && !strings.HasPrefix(line, "diff ") {
+			continue
+		}
+
+		if before == -1 {
+			switch {
+			case strings.HasPrefix(line, "GIT binary patch") || strings.HasPrefix(line, "Binary files"):
+				binary = true
+				before = 0
+				h.Write([]byte(preImage))
+				h.Write([]byte(postImage))
+				if p.opts.stable {
+					addPatchID(&id, h)
+				}
+				continue
+			case strings.HasPrefix(line, "index "):
+				if pre, post, ok := strings.Cut(strings.TrimPrefix(line, "index "), ".."); ok {
+					post, _, _ = strings.Cut(strings.TrimRight(post, "\n"), " ")
+					preImage, postImage = pre, post
+				}
+				continue
+			case strings.HasPrefix(line, "--- "):
+				before, after = 1, 1
+			case !isASCIILetter(line[0]):
+				return p.finish(id, h, patchLen, nextCommit)
+			}
+		}
+
+		if binary {
+			if strings.HasPrefix(line, "diff ") {
+				binary = false
+				before = -1
+			}
+			continue
+		}
+
+		if before == 0 && after == 0 {
+			if strings.HasPrefix(line, "@@ -") {
+				before, after = scanHunkHeader(line)
+				continue
+			}
+			// Anything but the next file ends the patch.
+			if !strings.HasPrefix(line, "diff ") {
+				return p.finish(id, h, patchLen, nextCommit)
+			}
+			if p.opts.stable {
+				addPatchID(&id, h)
+			}
+			before, after = -1, -1
+		}
+
+		if line[0] == '-' || line[0] == ' ' {
+			before--
+		}
+		if line[0] == '+' || line[0] == ' ' {
+			after--
+		}
+		if !p.opts.verbatim {
+			line = removeSpace(line)
+		}
+		patchLen += len(line)
+		h.Write([]byte(line))
+	}
+	return p.finish(id, h, patchLen, nextCommit)
+}
+
+func (p *patchIDReader) finish(id objectID, h hash.Hash, patchLen int, nextCommit objectID) (objectID, objectID, error) {
+	if patchLen == 0 {
+		return objectID{}, nextCommit, nil
+	}
+	addPatchID(&id, h)
+	return id, nextCommit, nil
+}
+
+// commitPatchID computes the stable patch id of the changes a commit
+// makes to its first parent, which is the same for commits that make the
+// same change on different bases. Merges and commits that change nothing
+// have none.
+func commitPatchID(hash objectID) (objectID, bool, error) {
+	c, err := readCommit(hash)
+	if err != nil {
+		return objectID{}, false, err
+	}
+	if len(c.parents) > 1 {
+		return objectID{}, false, nil
+	}
+	old := map[string]diffEntry{}
+	if len(c.parents) == 1 {
+		if old, err = commitFiles(c.parents[0]); err != nil {
+			return objectID{}, false, err
+		}
+	}
+	new, err := commitFiles(hash)
+	if err != nil {
+		return objectID{}, false, err
+	}
+
+	var patch bytes.Buffer
+	opts := &diffOptions{context: defaultDiffContext, quotePath: true, patch: true}
+	if err := writeDiff(&patch, diffFiles(old, new, nil, nil), opts); err != nil {
+		return objectID{}, false, err
+	}
+	r := &patchIDReader{r: bufio.NewReader(&patch), opts: patchIDOptions{stable: true}}
+	id, _, err := r.next()
+	return id, id != (objectID{}), err
+}
+
+// appliedCommits returns the commits of list whose changes one of the
+// upstream commits already makes, matching them by patch id.
+func appliedCommits(list []walkedCommit, upstream []objectID) (map[objectID]bool, error) {
+	applied := make(map[objectID]bool)
+	if len(list) == 0 || len(upstream) == 0 {
+		return applied, nil
+	}
+	ids := make(map[objectID]bool)
+	for _, hash := range upstream {
+		id, ok, err := commitPatchID(hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			ids[id] = true
+		}
+	}
+	for _, w := range list {
+		id, ok, err := commitPatchID(w.hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok && ids[id] {
+			applied[w.hash] = true
+		}
+	}
+	return applied, nil
+}
+
+func runPatchID(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var opts patchIDOptions
+	if opts.stable, err = cfg.getBool("patchid.stable", false); err != nil {
+		return err
+	}
+	if opts.verbatim, err = cfg.getBool("patchid.verbatim", false); err != nil {
+		return err
+	}
+	for _, arg := range args {
+		switch arg {
+		case "--stable":
+			opts.stable = true
+		case "--unstable":
+			opts.stable, opts.verbatim = false, false
+		case "--verbatim":
+			opts.verbatim = true
+		default:
+			return fmt.Errorf("usage: mygit patch-id [--stable | --unstable | --verbatim] < patch")
+		}
+	}
+	opts.stable = opts.stable || opts.verbatim
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	r := &patchIDReader{r: bufio.NewReader(os.Stdin), opts: opts}
+	var commitID objectID
+	for !r.eof {
+		id, next, err := r.next()
+		if err != nil {
+			return err
+		}
+		if id != (objectID{}) {
+			fmt.Fprintf(out, "%s %s\n", id, commitID)
+		}
+		commitID = next
+	}
+	return nil
+}
@@ -0,0 +1,104 @@
+package mygit
+
+import (
+	"strings"
+	"time"
+)
+
+// formatCommit expands the placeholders of a --format string for a commit,
+// such as %H for its hash or %an for its author's name. Decorations are
+// only needed for %d and %D. Unknown placeholders are kept as they are.
+func formatCommit(format string, hash objectID, c *commit, decorations map[objectID][]decoration) string {
+	var b strings.Builder
+	ident := func(ident string, spec byte) (string, bool) {
+		name, email, when := parseIdent(ident)
+		switch spec {
+		case 'n':
+			return name, true
+		case 'e':
+			return email, true
+		case 'd':
+			return formatDate(when, dateMode{}, time.Now()), true
+		case 'D':
+			return formatDate(when, dateMode{style: dateRFC}, time.Now()), true
+		case 'r':
+			return formatDate(when, dateMode{style: dateRelative}, time.Now()), true
+		case 't':
+			return formatDate(when, dateMode{style: dateUnix}, time.Now()), true
+		case 'i':
+			return formatDate(when, dateMode{style: dateISO}, time.Now()), true
+		case 'I':
+			return formatDate(when, dateMode{style: dateISOStrict}, time.Now()), true
+		case 's':
+			return formatDate(when, dateMode{style: dateShort}, time.Now()), true
+		}
+		return "", false
+	}
+	parents := func(short bool) string {
+		var names []string
+		for _, p := range c.parents {
+			if short {
+				names = append(names, shortHash(p))
+			} else {
+				names = append(names, p.String())
+			}
+		}
+		return strings.Join(names, " ")
+	}
+
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			b.WriteByte(format[i])
+			continue
+		}
+		i++
+		switch format[i] {
+		case '%':
+			b.WriteByte('%')
+		case 'n':
+			b.WriteByte('\n')
+		case 'H':
+			b.WriteString(hash.String())
+		case 'h':
+			b.WriteString(shortHash(hash))
+		case 'T':
+			b.WriteString(c.tree.String())
+		case 't':
+			b.WriteString(shortHash(c.tree))
+		case 'P':
+			b.WriteString(parents(false))
+		case 'p':
+			b.WriteString(parents(true))
+		case 's':
+			b.WriteString(commitSubject(c.message))
+		case 'b':
+			message := strings.TrimLeft(c.message, "\n")
+			if _, body, ok := strings.Cut(message, "\n\n"); ok {
+				b.WriteString(strings.TrimLeft(body, "\n"))
+			}
+		case 'B':
+			b.WriteString(c.message)
+		case 'd':
+			b.WriteString(formatDecorations(decorations[hash], false, ""))
+		case 'D':
+			d := formatDecorations(decorations[hash], false, "")
+			b.WriteString(strings.TrimSuffix(strings.TrimPrefix(d, " ("), ")"))
+		case 'a', 'c':
+			who := c.author
+			if format[i] == 'c' {
+				who = c.committer
+			}
+			if i+1 < len(format) {
+				if s, ok := ident(who, format[i+1]); ok {
+					b.WriteString(s)
+					i++
+					continue
+				}
+			}
+			b.WriteString(format[i-1 : i+1])
+		default:
+			b.WriteString(format[i-1 : i+1])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,187 @@
+package mygit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	"github.com/codecrafters-io/git-starter-go/internal/pktline"
+)
+
+const defaultProtocolVersion = 2
+
+// supportsFeature reports whether a protocol v2 command lists feature among
+// the arguments it accepts, e.g. "shallow" for "fetch=shallow filter".
+func (a *refAdvertisement) supportsFeature(command, feature string) bool {
+	value, ok := a.capability(command)
+	return ok && slices.Contains(strings.Fields(value), feature)
+}
+
+// v2Request encodes a protocol v2 command: the command and capability
+// lines, a delimiter, the command arguments and a flush.
+func v2Request(adv *refAdvertisement, command string, args []string) []byte {
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	pw.Writef("command=%s\n", command)
+	if _, ok := adv.capability("agent"); ok {
+		pw.Writef("agent=%s\n", userAgent)
+	}
+	if _, ok := adv.capability("object-format"); ok {
+		pw.Writef("object-format=%s\n", hashAlgo.name)
+	}
+	pw.Delim()
+	for _, arg := range args {
+		pw.Writef("%s\n", arg)
+	}
+	pw.Flush()
+	return buf.Bytes()
+}
+
+// refPrefixes returns the ls-refs prefixes that cover every ref the
+// refspecs could match, so the server can leave the rest out.
+func refPrefixes(specs []refspec, tags bool) []string {
+	var prefixes []string
+	add := func(p string) {
+		if !slices.Contains(prefixes, p) {
+			prefixes = append(prefixes, p)
+		}
+	}
+	for _, spec := range specs {
+		if prefix, _, wildcard := strings.Cut(spec.src, "*"); wildcard {
+			add(prefix)
+			continue
+		}
+		add(spec.src)
+		add(expandRefName(spec.src))
+	}
+	if tags {
+		add("refs/tags/")
+	}
+	return prefixes
+}
+
+// lsRefs runs the protocol v2 ls-refs command, asking only for refs that
+// start with one of prefixes.
+func lsRefs(t transport, adv *refAdvertisement, prefixes []string) error {
+	if _, ok := adv.capability("ls-refs"); !ok {
+		return fmt.Errorf("server does not support ls-refs")
+	}
+
+	args := []string{"peel", "symrefs"}
+	for _, prefix := range prefixes {
+		args = append(args, "ref-prefix "+prefix)
+	}
+	resp, err := t.request(v2Request(adv, "ls-refs", args))
+	if err != nil {
+		return err
+	}
+
+	lines, err := wireReader(resp).ReadUntilFlush()
+	if err != nil {
+		return fmt.Errorf("failed to read ref list: %w", err)
+	}
+	for _, line := range lines {
+		if msg, ok := strings.CutPrefix(line, "ERR "); ok {
+			return fmt.Errorf("remote error: %s", msg)
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			return fmt.Errorf("invalid ls-refs line %q", line)
+		}
+		hash, err := parseHash(fields[0])
+		if err != nil {
+			return fmt.Errorf("invalid ls-refs line %q: %w", line, err)
+		}
+		ref := advertisedRef{name: fields[1], hash: hash}
+		for _, attr := range fields[2:] {
+			if target, ok := strings.CutPrefix(attr, "symref-target:"); ok {
+				ref.symref = target
+			} else if peeled, ok := strings.CutPrefix(attr, "peeled:"); ok {
+				if ref.peeled, err = parseHash(peeled); err != nil {
+					return fmt.Errorf("invalid ls-refs line %q: %w", line, err)
+				}
+			}
+		}
+		adv.refs = append(adv.refs, ref)
+	}
+	return nil
+}
+
+// fetchPackV2 runs the protocol v2 fetch command. As with fetchPack, all
+// haves are sent at once together with "done", so the server skips the
+// acknowledgments section and answers with the pack straight away.
+func fetchPackV2(t transport, adv *refAdvertisement, req fetchRequest) (*shallowUpdate, error) {
+	if _, ok := adv.capability("fetch"); !ok {
+		return nil, fmt.Errorf("server does not support fetch")
+	}
+	if (req.depth > 0 || len(req.shallow) > 0) && !adv.supportsFeature("fetch", "shallow") {
+		return nil, fmt.Errorf("server does not support shallow clients")
+	}
+	if req.filter != "" && !adv.supportsFeature("fetch", "filter") {
+		return nil, fmt.Errorf("server does not support filters")
+	}
+
+	args := []string{"ofs-delta", "include-tag"}
+	for _, want := range req.wants {
+		args = append(args, fmt.Sprintf("want %x", want))
+	}
+	for hash := range req.shallow {
+		args = append(args, fmt.Sprintf("shallow %x", hash))
+	}
+	if req.depth > 0 {
+		args = append(args, fmt.Sprintf("deepen %d", req.depth))
+	}
+	if req.filter != "" {
+		args = append(args, "filter "+req.filter)
+	}
+	for _, have := range req.haves {
+		args = append(args, fmt.Sprintf("have %x", have))
+	}
+	args = append(args, "done")
+
+	resp, err := t.request(v2Request(adv, "fetch", args))
+	if err != nil {
+		return nil, err
+	}
+	pr := wireReader(resp)
+
+	update := &shallowUpdate{}
+	for {
+		pt, header, err := pr.ReadLine()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read fetch response: %w", err)
+		}
+		if pt != pktline.Data {
+			return nil, fmt.Errorf("unexpected %s packet in fetch response", pt)
+		}
+		if msg, ok := strings.CutPrefix(header, "ERR "); ok {
+			return nil, fmt.Errorf("remote error: %s", msg)
+		}
+
+		if header == "packfile" {
+			if err := receiveFetchedPack(newSidebandReader(pr), req); err != nil {
+				return nil, err
+			}
+			return update, nil
+		}
+
+		lines, end, err := pr.ReadSection()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s section: %w", header, err)
+		}
+		switch header {
+		case "shallow-info":
+			if update, err = parseShallowUpdate(lines); err != nil {
+				return nil, err
+			}
+		case "acknowledgments", "wanted-refs", "packfile-uris":
+		default:
+			return nil, fmt.Errorf("unknown fetch response section %q", header)
+		}
+		if end == pktline.Flush {
+			return nil, fmt.Errorf("fetch response ended without a pack: %w", io.ErrUnexpectedEOF)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package mygit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// recentUnreachable returns the unreachable objects newer than expire and
+// everything they reference. Pruning keeps these so that objects which are
+// still being written, or were only just orphaned, survive.
+func recentUnreachable(reachable map[objectID]string, ages map[objectID]time.Time, expire time.Time) (map[objectID]string, error) {
+	var recent []objectID
+	for hash, age := range ages {
+		if _, ok := reachable[hash]; !ok && age.After(expire) {
+			recent = append(recent, hash)
+		}
+	}
+	return reachableNames(recent, true)
+}
+
+// pruneLoose deletes the loose objects that are neither reachable nor
+// kept. With show set each one is printed as "<hash> <type>", and with
+// dryRun nothing is deleted.
+func pruneLoose(loose []objectID, reachable, kept map[objectID]string, show, dryRun bool) error {
+	for _, hash := range loose {
+		if _, ok := reachable[hash]; ok {
+			continue
+		}
+		if _, ok := kept[hash]; ok {
+			continue
+		}
+		if show {
+			objType, _, err := readObject(hash)
+			if err != nil {
+				objType = "unknown"
+			}
+			fmt.Printf("%s %s\n", hash, objType)
+		}
+		if dryRun {
+			continue
+		}
+		path := objectPath(hash)
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove loose object: %w", err)
+		}
+		// Only succeeds once the fan-out directory is empty.
+		os.Remove(filepath.Dir(path))
+	}
+	return nil
+}
+
+func runPrune(args []string) error {
+	dryRun, verbose, expiry := false, false, "now"
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-n" || arg == "--dry-run":
+			dryRun = true
+		case arg == "-v" || arg == "--verbose":
+			verbose = true
+		case arg == "--expire":
+			if i+1 >= len(args) {
+				return fmt.Errorf("option 'expire' requires a value")
+			}
+			i++
+			expiry = args[i]
+		case strings.HasPrefix(arg, "--expire="):
+			expiry = strings.TrimPrefix(arg, "--expire=")
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	if repoFormat.preciousObjects {
+		return fmt.Errorf("cannot prune in a precious-objects repo")
+	}
+	expire, err := parseExpiry(expiry, time.Now())
+	if err != nil {
+		return err
+	}
+
+	tips, err := refTips()
+	if err != nil {
+		return err
+	}
+	reachable, err := reachableNames(tips, false)
+	if err != nil {
+		return err
+	}
+	loose, err := listLooseObjects()
+	if err != nil {
+		return err
+	}
+	sort.Slice(loose, func(i, j int) bool { return bytes.Compare(loose[i][:], loose[j][:]) < 0 })
+
+	ages, err := objectAges(loose)
+	if err != nil {
+		return err
+	}
+	kept, err := recentUnreachable(reachable, ages, expire)
+	if err != nil {
+		return err
+	}
+
+	if err := pruneLoose(loose, reachable, kept, dryRun || verbose, dryRun); err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	return prunePacked(loose)
+}
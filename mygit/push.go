@@ -0,0 +1,457 @@
+package mygit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/codecrafters-io/git-starter-go/internal/pktline"
+)
+
+// pushCommand is a single ref update requested from receive-pack.
+type pushCommand struct {
+	src   string
+	dst   string
+	old   objectID
+	new   objectID
+	force bool
+
+	// rejected holds the reason the update was refused, either locally
+	// before sending or by the remote.
+	rejected       string
+	remoteRejected bool
+	upToDate       bool
+}
+
+func (c *pushCommand) isDelete() bool {
+	return c.src == ""
+}
+
+// localPushRef resolves the source side of a push refspec to a full ref
+// name and the object it points at.
+func localPushRef(name string) (string, objectID, error) {
+	candidates := []string{name}
+	if name == "HEAD" {
+		target, err := symrefTarget("HEAD")
+		if err != nil {
+			return "", objectID{}, err
+		}
+		candidates = []string{target}
+	} else if !strings.HasPrefix(name, "refs/") {
+		candidates = []string{"refs/heads/" + name, "refs/tags/" + name}
+	}
+
+	for _, ref := range candidates {
+		hash, err := resolveRef(ref)
+		if err == nil {
+			return ref, hash, nil
+		}
+		if !errors.Is(err, errRefNotFound) {
+			return "", objectID{}, err
+		}
+	}
+	return "", objectID{}, fmt.Errorf("src refspec %s does not match any", name)
+}
+
+// parsePushRefspec turns "[+]<src>[:<dst>]" into a push command. An empty
+// src deletes dst on the remote.
+func parsePushRefspec(s string, force bool) (*pushCommand, error) {
+	spec, err := parseRefspec(s)
+	if err != nil {
+		return nil, err
+	}
+	cmd := &pushCommand{force: force || spec.force}
+
+	if spec.src == "" {
+		if spec.dst == "" {
+			return nil, fmt.Errorf("invalid refspec %q", s)
+		}
+		cmd.dst = expandRefName(spec.dst)
+		return cmd, nil
+	}
+
+	cmd.src, cmd.new, err = localPushRef(spec.src)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case spec.dst == "":
+		cmd.dst = cmd.src
+	case strings.HasPrefix(spec.dst, "refs/"):
+		cmd.dst = spec.dst
+	case strings.HasPrefix(cmd.src, "refs/tags/"):
+		cmd.dst = "refs/tags/" + spec.dst
+	default:
+		cmd.dst = "refs/heads/" + spec.dst
+	}
+	return cmd, nil
+}
+
+// checkPushCommand rejects updates that would lose history on the remote
+// unless they are forced, mirroring git's client-side checks.
+func checkPushCommand(cmd *pushCommand, adv *refAdvertisement) error {
+	var exists bool
+	for _, ref := range adv.refs {
+		if ref.name == cmd.dst {
+			cmd.old, exists = ref.hash, true
+			break
+		}
+	}
+
+	switch {
+	case cmd.isDelete():
+		if !exists {
+			cmd.rejected = "remote ref does not exist"
+		} else if _, ok := adv.capability("delete-refs"); !ok {
+			cmd.rejected = "remote does not support deleting refs"
+		}
+		return nil
+	case cmd.old == cmd.new:
+		cmd.upToDate = true
+		return nil
+	case !exists || cmd.force:
+		return nil
+	case strings.HasPrefix(cmd.dst, "refs/tags/"):
+		cmd.rejected = "already exists"
+		return nil
+	case !hasObject(cmd.old):
+		cmd.rejected = "fetch first"
+		return nil
+	}
+
+	fastForward, err := isAncestor(cmd.old, cmd.new)
+	if err != nil {
+		return err
+	}
+	if !fastForward {
+		cmd.rejected = "non-fast-forward"
+	}
+	return nil
+}
+
+// buildPushPack packs every object reachable from the pushed tips that the
+// remote's advertised refs do not already cover.
+func buildPushPack(cfg *config, adv *refAdvertisement, cmds []*pushCommand) ([]byte, error) {
+	var include, exclude []objectID
+	for _, cmd := range cmds {
+		if !cmd.isDelete() {
+			include = append(include, cmd.new)
+		}
+	}
+	for _, ref := range adv.refs {
+		exclude = append(exclude, ref.hash)
+	}
+
+	list, err := objectsToPack(cfg, include, exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	// Without ofs-delta the remote cannot read the deltas writePack emits.
+	_, ofsDelta := adv.capability("ofs-delta")
+	objects, err := loadPackObjects(list, ofsDelta)
+	if err != nil {
+		return nil, err
+	}
+	if ofsDelta {
+		opts := packOptions{reuseDeltas: true}
+		if opts.window, err = cfg.getInt("pack.window", defaultPackWindow); err != nil {
+			return nil, err
+		}
+		if opts.depth, err = cfg.getInt("pack.depth", defaultPackDepth); err != nil {
+			return nil, err
+		}
+		computeDeltas(objects, opts)
+	}
+
+	var buf bytes.Buffer
+	if _, err := writePack(&buf, objects); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readPushReport parses receive-pack's report-status response and records
+// any refs the remote refused.
+func readPushReport(pr *pktline.Reader, cmds []*pushCommand) error {
+	t, line, err := pr.ReadLine()
+	if err != nil {
+		return fmt.Errorf("failed to read push status: %w", err)
+	}
+	if t != pktline.Data || !strings.HasPrefix(line, "unpack ") {
+		return fmt.Errorf("unexpected push status %q", line)
+	}
+	unpack := strings.TrimPrefix(line, "unpack ")
+
+	lines, err := pr.ReadUntilFlush()
+	if err != nil {
+		return fmt.Errorf("failed to read push status: %w", err)
+	}
+	for _, line := range lines {
+		status, rest, _ := strings.Cut(line, " ")
+		ref, reason, _ := strings.Cut(rest, " ")
+		for _, cmd := range cmds {
+			if cmd.dst != ref {
+				continue
+			}
+			switch status {
+			case "ok":
+			case "ng":
+				cmd.rejected, cmd.remoteRejected = reason, true
+			default:
+				return fmt.Errorf("unexpected push status %q", line)
+			}
+		}
+	}
+
+	if unpack != "ok" {
+		return fmt.Errorf("remote unpack failed: %s", unpack)
+	}
+	return nil
+}
+
+// sendPack sends the ref update commands, followed by a pack when anything
+// other than deletions is being pushed, and reads back the result.
+func sendPack(t transport, cfg *config, adv *refAdvertisement, cmds []*pushCommand) error {
+	caps := requestCapabilities(adv, "report-status", "side-band-64k")
+
+	var buf bytes.Buffer
+	pw := pktline.NewWriter(&buf)
+	for i, cmd := range cmds {
+		if i == 0 {
+			pw.Writef("%x %x %s\x00%s", cmd.old, cmd.new, cmd.dst, strings.Join(caps, " "))
+		} else {
+			pw.Writef("%x %x %s", cmd.old, cmd.new, cmd.dst)
+		}
+	}
+	pw.Flush()
+
+	needsPack := false
+	for _, cmd := range cmds {
+		needsPack = needsPack || !cmd.isDelete()
+	}
+	if needsPack {
+		data, err := buildPushPack(cfg, adv, cmds)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+
+	resp, err := t.request(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if _, ok := adv.capability("report-status"); !ok {
+		return nil
+	}
+
+	pr := wireReader(resp)
+	if _, ok := adv.capability("side-band-64k"); ok {
+		pr = wireReader(newSidebandReader(pr))
+	}
+	return readPushReport(pr, cmds)
+}
+
+// pushStatusLine formats the per-ref summary git prints after a push.
+func pushStatusLine(cmd *pushCommand) string {
+	from, to := describeRef(cmd.src), describeRef(cmd.dst)
+	switch {
+	case cmd.remoteRejected:
+		return fmt.Sprintf(" ! %-17s %s -> %s (%s)", "[remote rejected]", from, to, cmd.rejected)
+	case cmd.rejected != "" && cmd.isDelete():
+		return fmt.Sprintf(" ! %-17s %s (%s)", "[rejected]", to, cmd.rejected)
+	case cmd.rejected != "":
+		return fmt.Sprintf(" ! %-17s %s -> %s (%s)", "[rejected]", from, to, cmd.rejected)
+	case cmd.isDelete():
+		return fmt.Sprintf(" - %-17s %s", "[deleted]", to)
+	case cmd.old == objectID{}:
+		kind := "new reference"
+		if strings.HasPrefix(cmd.dst, "refs/heads/") {
+			kind = "new branch"
+		} else if strings.HasPrefix(cmd.dst, "refs/tags/") {
+			kind = "new tag"
+		}
+		return fmt.Sprintf(" * %-17s %s -> %s", "["+kind+"]", from, to)
+	}
+
+	if ok, _ := isAncestor(cmd.old, cmd.new); ok {
+		return fmt.Sprintf("   %-17s %s -> %s", shortHash(cmd.old)+".."+shortHash(cmd.new), from, to)
+	}
+	return fmt.Sprintf(" + %-17s %s -> %s (forced update)", shortHash(cmd.old)+"..."+shortHash(cmd.new), from, to)
+}
+
+// updateTrackingRefs moves the remote-tracking refs that mirror the pushed
+// refs, so they reflect the remote without another fetch.
+func updateTrackingRefs(remote *remoteConfig, cmds []*pushCommand) error {
+	tx := newRefTransaction()
+	for _, cmd := range cmds {
+		if cmd.rejected != "" || cmd.upToDate {
+			continue
+		}
+		for _, spec := range remote.refspecs {
+			tracking, ok := spec.match(cmd.dst)
+			if !ok || tracking == "" {
+				continue
+			}
+			if cmd.isDelete() {
+				tx.delete(tracking)
+			} else {
+				tx.update(tracking, cmd.new, "update by push")
+			}
+			break
+		}
+	}
+	return tx.commit()
+}
+
+func runPush(args []string) error {
+	var positional []string
+	force, noVerify := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "-f" || arg == "--force":
+			force = true
+		case arg == "--no-verify":
+			noVerify = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			positional = append(positional, arg)
+		}
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+
+	name := ""
+	if len(positional) > 0 {
+		name = positional[0]
+	} else if branch, err := symrefTarget("HEAD"); err == nil {
+		name, _ = cfg.get("branch." + strings.TrimPrefix(branch, "refs/heads/") + ".remote")
+	}
+	if name == "" {
+		name = "origin"
+	}
+	remote, err := lookupRemote(cfg, name)
+	if err != nil {
+		return err
+	}
+	specs := []string{"HEAD"}
+	if len(positional) > 1 {
+		specs = positional[1:]
+	}
+	var cmds []*pushCommand
+	for _, s := range specs {
+		cmd, err := parsePushRefspec(s, force)
+		if err != nil {
+			return err
+		}
+		cmds = append(cmds, cmd)
+	}
+
+	return push(cfg, remote, cmds, noVerify)
+}
+
+// prePushHook runs the pre-push hook on the updates about to be sent, one
+// "<local ref> <local hash> <remote ref> <remote hash>" line each. The
+// hook exiting non-zero fails the whole push.
+func prePushHook(cfg *config, remote *remoteConfig, send []*pushCommand) error {
+	var b strings.Builder
+	for _, cmd := range send {
+		src := cmd.src
+		if cmd.isDelete() {
+			src = "(delete)"
+		}
+		fmt.Fprintf(&b, "%s %s %s %s\n", src, cmd.new, cmd.dst, cmd.old)
+	}
+	if err := runHook(cfg, "pre-push", b.String(), remote.name, remote.pushURL); err != nil {
+		return fmt.Errorf("failed to push some refs to '%s'", remote.pushURL)
+	}
+	return nil
+}
+
+// push updates refs on the remote through receive-pack. Updates that fail
+// the local fast-forward check are reported without being sent. Unless
+// noVerify is set, the pre-push hook gets to refuse them first.
+func push(cfg *config, remote *remoteConfig, cmds []*pushCommand, noVerify bool) error {
+	t, err := openTransport(remote.pushURL, receivePackService, 0)
+	if err != nil {
+		return err
+	}
+	defer t.close()
+
+	advStream, err := t.advertisement()
+	if err != nil {
+		return err
+	}
+	adv, err := readAdvertisement(advStream)
+	if err != nil {
+		return err
+	}
+
+	var send []*pushCommand
+	for _, cmd := range cmds {
+		if err := checkPushCommand(cmd, adv); err != nil {
+			return err
+		}
+		if cmd.rejected == "" && !cmd.upToDate {
+			send = append(send, cmd)
+		}
+	}
+
+	if len(send) > 0 && !noVerify {
+		if err := prePushHook(cfg, remote, send); err != nil {
+			return err
+		}
+	}
+	if len(send) > 0 {
+		// Large objects go first, so that no ref points to a pointer
+		// whose object the remote lacks.
+		var include, exclude []objectID
+		for _, cmd := range send {
+			if !cmd.isDelete() {
+				include = append(include, cmd.new)
+			}
+		}
+		for _, ref := range adv.refs {
+			exclude = append(exclude, ref.hash)
+		}
+		if err := pushLFSObjects(remote.pushURL, include, exclude); err != nil {
+			return err
+		}
+		if err := sendPack(t, cfg, adv, send); err != nil {
+			return err
+		}
+	}
+
+	var lines []string
+	failed := false
+	for _, cmd := range cmds {
+		if cmd.upToDate {
+			continue
+		}
+		failed = failed || cmd.rejected != ""
+		lines = append(lines, pushStatusLine(cmd))
+	}
+	if len(lines) == 0 {
+		fmt.Fprintln(os.Stderr, "Everything up-to-date")
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "To %s\n", remote.pushURL)
+	for _, line := range lines {
+		fmt.Fprintln(os.Stderr, line)
+	}
+
+	if err := updateTrackingRefs(remote, cmds); err != nil {
+		return err
+	}
+	if failed {
+		return fmt.Errorf("failed to push some refs to '%s'", remote.pushURL)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package mygit
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// errWouldOverwrite is how read-tree refuses a merge that would lose what
+// the index holds for a path.
+func errWouldOverwrite(path string) error {
+	return fmt.Errorf("Entry '%s' would be overwritten by merge. Cannot merge.", path)
+}
+
+// readTreeMerge holds the index a tree merge starts from, by entry and
+// as files, and the entries it results in.
+type readTreeMerge struct {
+	index  map[string]indexEntry
+	files  map[string]diffEntry
+	result []indexEntry
+}
+
+// keep carries the index entry of a path over, stat data included.
+func (m *readTreeMerge) keep(path string) {
+	if e, ok := m.index[path]; ok {
+		m.result = append(m.result, e)
+	}
+}
+
+// take puts a file in the index at a stage. Merged files the index
+// already holds keep their stat data; other entries get none, so that
+// they never match the working tree until refreshed.
+func (m *readTreeMerge) take(path string, stage int, file diffEntry) {
+	if file.mode == 0 {
+		return
+	}
+	if e, ok := m.index[path]; ok && stage == 0 && sameFile(file, diffEntry{mode: e.mode, hash: e.hash}) {
+		m.result = append(m.result, e)
+		return
+	}
+	m.result = append(m.result, indexEntry{path: path, mode: file.mode, hash: file.hash, flags: uint16(stage) << 12})
+}
+
+// twoWay moves the index from tree h to tree n, keeping the changes
+// staged on top of h, as git read-tree -m <h> <n> does.
+func (m *readTreeMerge) twoWay(h, n map[string]diffEntry) error {
+	initial := len(m.index) == 0
+	for _, path := range unionPaths(h, n, m.files) {
+		hf, nf := h[path], n[path]
+		i, inIndex := m.files[path]
+		switch {
+		case sameFile(hf, nf):
+			if !inIndex && initial {
+				m.take(path, 0, nf)
+			} else {
+				m.keep(path)
+			}
+		case !inIndex && hf.mode != 0 && nf.mode != 0:
+			return errWouldOverwrite(path)
+		case !inIndex:
+			m.take(path, 0, nf)
+		case sameFile(i, nf):
+			m.keep(path)
+		case sameFile(i, hf):
+			m.take(path, 0, nf)
+		default:
+			return errWouldOverwrite(path)
+		}
+	}
+	return nil
+}
+
+// threeWay merges trees a and b with the base o into the index, which
+// must match a. Paths changed or added on one side only, or the same way
+// on both, are merged; the others, removals included, are left as
+// conflicting stages.
+func (m *readTreeMerge) threeWay(o, a, b map[string]diffEntry) error {
+	for _, path := range unionPaths(o, a, b, m.files) {
+		of, af, bf := o[path], a[path], b[path]
+		i, inIndex := m.files[path]
+		// Only the side taken from b may already be staged.
+		theirs := bf.mode != 0 && sameFile(of, af) && !sameFile(of, bf)
+		if inIndex && !sameFile(i, af) && !(theirs && sameFile(i, bf)) {
+			return errWouldOverwrite(path)
+		}
+		switch {
+		case theirs:
+			m.take(path, 0, bf)
+		case af.mode != 0 && sameFile(af, bf):
+			m.take(path, 0, af)
+		case af.mode != 0 && sameFile(of, bf):
+			m.take(path, 0, af)
+		case af.mode == 0 && bf.mode == 0 && of.mode == 0:
+		default:
+			m.take(path, 1, of)
+			m.take(path, 2, af)
+			m.take(path, 3, bf)
+		}
+	}
+	return nil
+}
+
+// unionPaths returns the sorted paths of several listings.
+func unionPaths(listings ...map[string]diffEntry) []string {
+	seen := make(map[string]bool)
+	for _, files := range listings {
+		for path := range files {
+			seen[path] = true
+		}
+	}
+	paths := make([]string, 0, len(seen))
+	for path := range seen {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func runReadTree(args []string) error {
+	var names []string
+	merge, update, empty := false, false, false
+	prefix, hasPrefix := "", false
+	for _, arg := range args {
+		switch {
+		case arg == "-m":
+			merge = true
+		case arg == "-u":
+			update = true
+		case arg == "--empty":
+			empty = true
+		case strings.HasPrefix(arg, "--prefix="):
+			prefix, hasPrefix = strings.TrimPrefix(arg, "--prefix="), true
+			if strings.HasPrefix(prefix, "/") {
+				return fmt.Errorf("Invalid prefix, prefix cannot start with '/'")
+			}
+			if prefix != "" && !strings.HasSuffix(prefix, "/") {
+				prefix += "/"
+			}
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+	switch {
+	case update && !merge && !hasPrefix:
+		return fmt.Errorf("-u is meaningless without -m or --prefix")
+	case merge && hasPrefix:
+		return fmt.Errorf("--prefix and -m cannot be used together")
+	case empty && len(names) > 0:
+		return fmt.Errorf("passing trees as arguments contradicts --empty")
+	case !empty && (len(names) == 0 || merge && len(names) > 3):
+		return fmt.Errorf("usage: mygit read-tree [(-m [-u] | --prefix=<prefix>) <tree-ish>...] | --empty")
+	}
+
+	trees := make([]map[string]diffEntry, len(names))
+	for i, name := range names {
+		var err error
+		if trees[i], err = revisionFiles(name); err != nil {
+			return fmt.Errorf("failed to unpack tree object %s: %w", name, err)
+		}
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	m := &readTreeMerge{index: make(map[string]indexEntry), files: make(map[string]diffEntry)}
+	for _, e := range entries {
+		if merge && e.stage() != 0 {
+			return fmt.Errorf("You need to resolve your current index first")
+		}
+		m.index[e.path] = e
+		m.files[e.path] = diffEntry{mode: e.mode, hash: e.hash}
+	}
+	switch {
+	case empty:
+	case hasPrefix:
+		// The tree is read next to what the index holds, which must not
+		// have any of its paths already.
+		m.result = entries
+		for path, file := range trees[0] {
+			path = prefix + path
+			if _, ok := m.index[path]; ok {
+				return fmt.Errorf("Entry '%s' overlaps with '%s'.  Cannot bind.", path, path)
+			}
+			m.result = append(m.result, indexEntry{path: path, mode: file.mode, hash: file.hash})
+		}
+	case !merge:
+		// Later trees win over earlier ones for the paths they share.
+		files := make(map[string]diffEntry)
+		for _, tree := range trees {
+			for path, file := range tree {
+				files[path] = file
+			}
+		}
+		for path, file := range files {
+			m.result = append(m.result, indexEntry{path: path, mode: file.mode, hash: file.hash})
+		}
+	case len(trees) == 1:
+		for _, path := range unionPaths(trees[0]) {
+			m.take(path, 0, trees[0][path])
+		}
+	case len(trees) == 2:
+		err = m.twoWay(trees[0], trees[1])
+	default:
+		err = m.threeWay(trees[0], trees[1], trees[2])
+	}
+	if err != nil {
+		return err
+	}
+
+	if update {
+		// The working tree follows the merged entries that changed;
+		// conflicts leave it alone.
+		old, _ := indexFiles(entries)
+		merged, unmerged := indexFiles(m.result)
+		updates := make(map[string]pathUpdate)
+		for _, p := range diffFiles(old, merged, nil, nil) {
+			if !unmerged[p.path] {
+				updates[p.path] = pathUpdate{file: p.new}
+			}
+		}
+		if err := checkWorktree(cfg, entries, old, updates, "merge"); err != nil {
+			return err
+		}
+		if m.result, err = applyUpdates(m.result, updates); err != nil {
+			return err
+		}
+	}
+	return writeIndex(m.result)
+}
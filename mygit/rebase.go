@@ -0,0 +1,786 @@
+package mygit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var rebaseDir = ".git/rebase-merge"
+
+// Files in rebaseDir that only exist while the rebase is stopped at a
+// commit that did not apply cleanly.
+var rebaseStopFiles = []string{"author-script", "message", "stopped-sha"}
+
+// rebaseState is a rebase in progress as recorded in rebaseDir: the
+// branch being rebased, or "detached HEAD", the commit it is rebased
+// onto, where it was before and the todo list of commits to pick, which
+// moves line by line to the done list.
+type rebaseState struct {
+	headName string
+	onto     objectID
+	origHead objectID
+	todo     []string
+	done     []string
+	end      int
+}
+
+func rebaseFile(name string) string {
+	return filepath.Join(rebaseDir, name)
+}
+
+// readTodoList reads the commands of a todo list, skipping blank lines
+// and comments.
+func readTodoList(name string) ([]string, error) {
+	data, err := os.ReadFile(rebaseFile(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read rebase state: %w", err)
+	}
+	var lines []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	return lines, nil
+}
+
+func readRebaseState() (*rebaseState, error) {
+	if _, err := os.Stat(rebaseDir); errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("No rebase in progress?")
+	}
+	values := make(map[string]string)
+	for _, name := range []string{"head-name", "onto", "orig-head", "end"} {
+		data, err := os.ReadFile(rebaseFile(name))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rebase state: %w", err)
+		}
+		values[name] = strings.TrimSpace(string(data))
+	}
+
+	s := &rebaseState{headName: values["head-name"]}
+	var err error
+	if s.onto, err = parseHash(values["onto"]); err != nil {
+		return nil, fmt.Errorf("invalid onto: '%s'", values["onto"])
+	}
+	if s.origHead, err = parseHash(values["orig-head"]); err != nil {
+		return nil, fmt.Errorf("invalid orig-head: '%s'", values["orig-head"])
+	}
+	if s.end, err = strconv.Atoi(values["end"]); err != nil {
+		return nil, fmt.Errorf("invalid end: '%s'", values["end"])
+	}
+	if s.todo, err = readTodoList("git-rebase-todo"); err != nil {
+		return nil, err
+	}
+	if s.done, err = readTodoList("done"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// write saves the state, creating rebaseDir when the rebase starts.
+func (s *rebaseState) write() error {
+	if err := os.MkdirAll(rebaseDir, 0755); err != nil {
+		return fmt.Errorf("failed to create rebase state: %w", err)
+	}
+	list := func(lines []string) string {
+		var b strings.Builder
+		for _, line := range lines {
+			b.WriteString(line + "\n")
+		}
+		return b.String()
+	}
+	for name, content := range map[string]string{
+		"head-name":       s.headName + "\n",
+		"onto":            s.onto.String() + "\n",
+		"orig-head":       s.origHead.String() + "\n",
+		"git-rebase-todo": list(s.todo),
+		"done":            list(s.done),
+		"msgnum":          strconv.Itoa(len(s.done)) + "\n",
+		"end":             strconv.Itoa(s.end) + "\n",
+		"interactive":     "",
+	} {
+		if err := os.WriteFile(rebaseFile(name), []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write rebase state: %w", err)
+		}
+	}
+	return nil
+}
+
+// sqQuote quotes s for the shell, the way author-script is written.
+func sqQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// sqDequote undoes sqQuote, also accepting backslash escapes between
+// quoted parts.
+func sqDequote(s string) string {
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\'':
+			quoted = !quoted
+		case s[i] == '\\' && !quoted && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+// writeAuthorScript records the author of the commit being picked in
+// path, so that continuing keeps it.
+func writeAuthorScript(path, author string) error {
+	name, email, _ := parseIdent(author)
+	date := strings.TrimSpace(author[strings.LastIndexByte(author, '>')+1:])
+	script := fmt.Sprintf("GIT_AUTHOR_NAME=%s\nGIT_AUTHOR_EMAIL=%s\nGIT_AUTHOR_DATE=%s\n",
+		sqQuote(name), sqQuote(email), sqQuote("@"+date))
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func readAuthorScript(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open '%s' for reading: %w", path, err)
+	}
+	vars := make(map[string]string)
+	for _, line := range strings.Split(string(data), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			vars[key] = sqDequote(value)
+		}
+	}
+	name, email, date := vars["GIT_AUTHOR_NAME"], vars["GIT_AUTHOR_EMAIL"], vars["GIT_AUTHOR_DATE"]
+	if name == "" || email == "" || date == "" {
+		return "", fmt.Errorf("invalid author-script")
+	}
+	if date, err = parseIdentDate(date); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s <%s> %s", name, email, date), nil
+}
+
+// rebaseCommit writes a picked commit: the original author and message
+// on a new tree and parent.
+func rebaseCommit(cfg *config, tree, parent objectID, author, message string) (objectID, error) {
+	committer, err := identity(cfg, "committer")
+	if err != nil {
+		return objectID{}, err
+	}
+	return storeObject(commitObject, serializeCommit(&commit{
+		tree:      tree,
+		parents:   []objectID{parent},
+		author:    author,
+		committer: committer,
+		message:   message,
+	}))
+}
+
+// clearRebaseStop forgets the commit the rebase stopped at.
+func clearRebaseStop() error {
+	for _, name := range rebaseStopFiles {
+		if err := os.Remove(rebaseFile(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("failed to remove %s: %w", rebaseFile(name), err)
+		}
+	}
+	if _, err := resolveRef("REBASE_HEAD"); err != nil {
+		return nil
+	}
+	tx := newRefTransaction()
+	tx.delete("REBASE_HEAD")
+	return tx.commit()
+}
+
+// requireCleanWorktree refuses to rebase over changes in the working
+// tree or the index, which the commits being picked would overwrite.
+func requireCleanWorktree(cfg *config, entries []indexEntry, head map[string]diffEntry) error {
+	files, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return err
+	}
+	// Like git, commits checked out in submodules are not in the way.
+	unstaged := false
+	for _, e := range entries {
+		if e.mode == modeGitlink {
+			continue
+		}
+		if f, ok := files[e.path]; e.stage() == 0 && (!ok || f.mode != e.mode || f.hash != e.hash) {
+			unstaged = true
+			break
+		}
+	}
+	indexed, unmerged := indexFiles(entries)
+	staged := len(unmerged) > 0 || len(diffFiles(head, indexed, nil, nil)) > 0
+
+	var problems []string
+	if unstaged {
+		problems = append(problems, "cannot rebase: You have unstaged changes.")
+	}
+	switch {
+	case staged && unstaged:
+		problems = append(problems, "additionally, your index contains uncommitted changes.")
+	case staged:
+		problems = append(problems, "cannot rebase: Your index contains uncommitted changes.")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s\nPlease commit or stash them.", strings.Join(problems, "\n"))
+	}
+	return nil
+}
+
+// resetWorktree makes the index and the working tree match files,
+// discarding conflicts and local changes to tracked files.
+func resetWorktree(cfg *config, files map[string]diffEntry) error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return err
+	}
+
+	updates := make(map[string]pathUpdate)
+	indexed := make(map[string]bool)
+	for _, e := range entries {
+		indexed[e.path] = true
+		entry := diffEntry{mode: e.mode, hash: e.hash}
+		if w, ok := work[e.path]; e.stage() != 0 || !ok || !sameFile(w, entry) || !sameFile(entry, files[e.path]) {
+			updates[e.path] = pathUpdate{file: files[e.path]}
+		}
+	}
+	for path, file := range files {
+		if !indexed[path] {
+			updates[path] = pathUpdate{file: file}
+		}
+	}
+	if entries, err = applyUpdates(entries, updates); err != nil {
+		return err
+	}
+	return writeIndex(entries)
+}
+
+// todoCommit returns the commit a todo list command picks. Only pick is
+// supported.
+func todoCommit(line string) (objectID, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "pick" && fields[0] != "p" {
+		return objectID{}, fmt.Errorf("invalid line in the todo list: %s", line)
+	}
+	return resolveCommit(fields[1])
+}
+
+// editTodoList lets the user edit the todo list with the sequence
+// editor, reordering the picks or dropping commits, and returns the
+// edited list. Emptying the list aborts the rebase.
+func editTodoList(cfg *config, todo []string, onto, head objectID) (edited []string, err error) {
+	editor, err := sequenceEditor(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	for _, line := range todo {
+		b.WriteString(line + "\n")
+	}
+	fmt.Fprintf(&b, "\n# Rebase %s..%s onto %s (%d commands)\n", shortHash(onto), shortHash(head), shortHash(onto), len(todo))
+	b.WriteString("#\n# Commands:\n" +
+		"# p, pick <commit> = use commit\n" +
+		"# d, drop <commit> = remove commit\n" +
+		"#\n# These lines can be re-ordered; they are executed from top to bottom.\n" +
+		"#\n# If you remove a line here THAT COMMIT WILL BE LOST.\n" +
+		"#\n# However, if you remove everything, the rebase will be aborted.\n#\n")
+
+	if err := os.MkdirAll(rebaseDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create rebase state: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			os.RemoveAll(rebaseDir)
+		}
+	}()
+	path := rebaseFile("git-rebase-todo")
+	if err := os.WriteFile(path, []byte(b.String()), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write rebase state: %w", err)
+	}
+	if err := launchEditor(editor, path); err != nil {
+		return nil, err
+	}
+	lines, err := readTodoList("git-rebase-todo")
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		if fields := strings.Fields(line); fields[0] == "drop" || fields[0] == "d" {
+			continue
+		}
+		if _, err := todoCommit(line); err != nil {
+			return nil, err
+		}
+		edited = append(edited, line)
+	}
+	if len(edited) == 0 {
+		return nil, fmt.Errorf("Nothing to do")
+	}
+	return edited, nil
+}
+
+// run picks the commits left in the todo list and finishes the rebase.
+func (s *rebaseState) run(cfg *config) error {
+	for len(s.todo) > 0 {
+		line := s.todo[0]
+		s.todo, s.done = s.todo[1:], append(s.done, line)
+		if err := s.write(); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Rebasing (%d/%d)\r", len(s.done), s.end)
+
+		hash, err := todoCommit(line)
+		if err != nil {
+			return err
+		}
+		if err := s.pick(cfg, hash); err != nil {
+			return err
+		}
+	}
+	return s.finish()
+}
+
+// pick applies the changes of a commit on top of HEAD by merging them
+// with the commit's parent as the base, and commits the result. Commits
+// whose changes are already in HEAD are dropped.
+func (s *rebaseState) pick(cfg *config, hash objectID) error {
+	c, err := readCommit(hash)
+	if err != nil {
+		return err
+	}
+	head, err := resolveRef("HEAD")
+	if err != nil {
+		return err
+	}
+	headFiles, err := commitFiles(head)
+	if err != nil {
+		return err
+	}
+	baseFiles := map[string]diffEntry{}
+	if len(c.parents) > 0 {
+		if baseFiles, err = commitFiles(c.parents[0]); err != nil {
+			return err
+		}
+	}
+	theirFiles, err := commitFiles(hash)
+	if err != nil {
+		return err
+	}
+	style, err := mergeConflictStyle(cfg)
+	if err != nil {
+		return err
+	}
+
+	subject := commitSubject(c.message)
+	label := fmt.Sprintf("%s (%s)", shortHash(hash), subject)
+	// What the merge says is only shown when it conflicts.
+	var out bytes.Buffer
+	m := &treeMerge{
+		opts: mergeFileOptions{
+			base:       "parent of " + label,
+			ours:       "HEAD",
+			theirs:     label,
+			style:      style,
+			markerSize: defaultConflictMarkerSize,
+		},
+		out: &out,
+	}
+	result, conflicts, err := m.mergeFiles(baseFiles, headFiles, theirFiles)
+	if err != nil {
+		return err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	if err := checkoutUpdates(cfg, entries, headFiles, mergeUpdates(headFiles, result)); err != nil {
+		return err
+	}
+	if conflicts > 0 {
+		os.Stdout.Write(out.Bytes())
+		return s.stop(hash, c)
+	}
+
+	files := make(map[string]diffEntry)
+	for path, u := range result {
+		files[path] = u.file
+	}
+	// Commits that were empty to begin with are kept.
+	if len(diffFiles(headFiles, files, nil, nil)) == 0 && len(diffFiles(baseFiles, theirFiles, nil, nil)) > 0 {
+		fmt.Fprintf(os.Stderr, "dropping %s %s -- patch contents already upstream\n", hash, subject)
+		return nil
+	}
+	tree, err := writeFilesTree(files)
+	if err != nil {
+		return err
+	}
+	picked, err := rebaseCommit(cfg, tree, head, c.author, c.message)
+	if err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	tx.updateFrom("HEAD", head, picked, "rebase (pick): "+subject)
+	return tx.commit()
+}
+
+// stop leaves the conflicts of a commit for the user to resolve, with
+// what continuing needs to commit it recorded in rebaseDir.
+func (s *rebaseState) stop(hash objectID, c *commit) error {
+	if err := writeAuthorScript(rebaseFile("author-script"), c.author); err != nil {
+		return err
+	}
+	for name, content := range map[string]string{
+		"message":     c.message,
+		"stopped-sha": hash.String() + "\n",
+	} {
+		if err := os.WriteFile(rebaseFile(name), []byte(content), 0644); err != nil {
+			return fmt.Errorf("failed to write rebase state: %w", err)
+		}
+	}
+	tx := newRefTransaction()
+	tx.update("REBASE_HEAD", hash, "")
+	if err := tx.commit(); err != nil {
+		return err
+	}
+
+	oneline := fmt.Sprintf("%s... %s", shortHash(hash), commitSubject(c.message))
+	fmt.Fprintf(os.Stderr, "error: could not apply %s\n", oneline)
+	fmt.Fprintln(os.Stderr, "hint: Resolve all conflicts manually, mark them as resolved with")
+	fmt.Fprintln(os.Stderr, `hint: "mygit add/rm <conflicted_files>", then run "mygit rebase --continue".`)
+	fmt.Fprintln(os.Stderr, `hint: You can instead skip this commit: run "mygit rebase --skip".`)
+	fmt.Fprintln(os.Stderr, `hint: To abort and get back to the state before "mygit rebase", run "mygit rebase --abort".`)
+	fmt.Fprintf(os.Stderr, "Could not apply %s\n", oneline)
+	os.Exit(1)
+	return nil
+}
+
+// finish points the rebased branch at the new commits and checks it out
+// again.
+func (s *rebaseState) finish() error {
+	head, err := resolveRef("HEAD")
+	if err != nil {
+		return err
+	}
+	if err := clearRebaseStop(); err != nil {
+		return err
+	}
+	if strings.HasPrefix(s.headName, "refs/") {
+		tx := newRefTransaction()
+		tx.updateFrom(s.headName, s.origHead, head, fmt.Sprintf("rebase (finish): %s onto %s", s.headName, s.onto))
+		tx.symref("HEAD", s.headName, "rebase (finish): returning to "+s.headName)
+		if err := tx.commit(); err != nil {
+			return err
+		}
+	}
+	if err := os.RemoveAll(rebaseDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", rebaseDir, err)
+	}
+	fmt.Fprintf(os.Stderr, "\r\033[KSuccessfully rebased and updated %s.\n", s.headName)
+	return nil
+}
+
+// continueRebase commits the resolution of the commit the rebase stopped
+// at, if it changes anything, and picks the remaining commits.
+func (s *rebaseState) continueRebase(cfg *config) error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	indexed, unmerged := indexFiles(entries)
+	if len(unmerged) > 0 {
+		return fmt.Errorf("You must edit all merge conflicts and then\nmark them as resolved using mygit add")
+	}
+
+	if _, err := os.Stat(rebaseFile("stopped-sha")); err == nil {
+		head, err := resolveRef("HEAD")
+		if err != nil {
+			return err
+		}
+		headFiles, err := commitFiles(head)
+		if err != nil {
+			return err
+		}
+		if len(diffFiles(headFiles, indexed, nil, nil)) > 0 {
+			author, err := readAuthorScript(rebaseFile("author-script"))
+			if err != nil {
+				return err
+			}
+			data, err := os.ReadFile(rebaseFile("message"))
+			if err != nil {
+				return fmt.Errorf("failed to read rebase state: %w", err)
+			}
+			message := cleanupMessage(string(data), true)
+			tree, err := writeFilesTree(indexed)
+			if err != nil {
+				return err
+			}
+			picked, err := rebaseCommit(cfg, tree, head, author, message)
+			if err != nil {
+				return err
+			}
+			tx := newRefTransaction()
+			tx.updateFrom("HEAD", head, picked, "rebase (continue): "+commitSubject(message))
+			if err := tx.commit(); err != nil {
+				return err
+			}
+			if err := printCommitSummary(cfg, picked, headFiles, false); err != nil {
+				return err
+			}
+		}
+	}
+	if err := clearRebaseStop(); err != nil {
+		return err
+	}
+	return s.run(cfg)
+}
+
+// skip drops the commit the rebase stopped at and picks the remaining
+// commits.
+func (s *rebaseState) skip(cfg *config) error {
+	head, err := headFiles()
+	if err != nil {
+		return err
+	}
+	if err := resetWorktree(cfg, head); err != nil {
+		return err
+	}
+	if err := clearRebaseStop(); err != nil {
+		return err
+	}
+	return s.run(cfg)
+}
+
+// abort returns to the branch, or commit, the rebase started from.
+func (s *rebaseState) abort(cfg *config) error {
+	files, err := commitFiles(s.origHead)
+	if err != nil {
+		return err
+	}
+	if err := resetWorktree(cfg, files); err != nil {
+		return err
+	}
+	if err := clearRebaseStop(); err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	if strings.HasPrefix(s.headName, "refs/") {
+		tx.symref("HEAD", s.headName, "rebase (abort): returning to "+s.headName)
+	} else {
+		tx.detach("HEAD", s.origHead, "rebase (abort): returning to "+s.origHead.String())
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(rebaseDir); err != nil {
+		return fmt.Errorf("failed to remove %s: %w", rebaseDir, err)
+	}
+	return nil
+}
+
+// startRebase detaches HEAD at upstream and picks the commits of the
+// current branch that upstream does not have, oldest first. Merges are
+// left out, flattening the history. An interactive rebase lets the user
+// edit the list first.
+func startRebase(cfg *config, name string, reapplyCherryPicks, interactive bool) error {
+	if _, err := os.Stat(rebaseDir); err == nil {
+		return fmt.Errorf("It seems that there is already a rebase-merge directory, and\n" +
+			"I wonder if you are in the middle of another rebase.  If that is the\n" +
+			"case, please try\n\tmygit rebase (--continue | --abort | --skip)\n" +
+			"If that is not the case, please\n\trm -fr \"" + rebaseDir + "\"\n" +
+			"and run me again.  I am stopping in case you still have something\n" +
+			"valuable there.")
+	}
+	onto, err := resolveCommit(name)
+	if err != nil {
+		return fmt.Errorf("invalid upstream '%s'", name)
+	}
+	head, err := resolveRef("HEAD")
+	if err != nil {
+		return err
+	}
+	headName, err := symrefTarget("HEAD")
+	if err != nil {
+		return err
+	}
+	if headName == "HEAD" {
+		headName = "detached HEAD"
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	headFiles, err := commitFiles(head)
+	if err != nil {
+		return err
+	}
+	if err := requireCleanWorktree(cfg, entries, headFiles); err != nil {
+		return err
+	}
+
+	if ok, err := isAncestor(onto, head); err != nil {
+		return err
+	} else if ok {
+		if branch, ok := strings.CutPrefix(headName, "refs/heads/"); ok {
+			fmt.Printf("Current branch %s is up to date.\n", branch)
+		} else {
+			fmt.Println("HEAD is up to date.")
+		}
+		return nil
+	}
+
+	excluded := make(map[objectID]bool)
+	err = walkCommits([]objectID{onto}, func(hash objectID, c *commit) error {
+		excluded[hash] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	reachable := make(map[objectID]bool)
+	var list []walkedCommit
+	err = walkCommits([]objectID{head}, func(hash objectID, c *commit) error {
+		reachable[hash] = true
+		if !excluded[hash] {
+			list = append(list, walkedCommit{hash, c})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Commits whose changes upstream already has are left out.
+	applied := make(map[objectID]bool)
+	if !reapplyCherryPicks {
+		var upstream []objectID
+		err = walkCommits([]objectID{onto}, func(hash objectID, c *commit) error {
+			if !reachable[hash] {
+				upstream = append(upstream, hash)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if applied, err = appliedCommits(list, upstream); err != nil {
+			return err
+		}
+	}
+
+	list = sortTopologically(list)
+	slices.Reverse(list)
+	s := &rebaseState{headName: headName, onto: onto, origHead: head}
+	for _, w := range list {
+		if applied[w.hash] {
+			fmt.Fprintf(os.Stderr, "warning: skipped previously applied commit %s\n", shortHash(w.hash))
+			continue
+		}
+		if len(w.commit.parents) <= 1 {
+			s.todo = append(s.todo, fmt.Sprintf("pick %s %s", w.hash, commitSubject(w.commit.message)))
+		}
+	}
+	if len(applied) > 0 {
+		fmt.Fprintln(os.Stderr, "hint: use --reapply-cherry-picks to include skipped commits")
+	}
+	if interactive {
+		if s.todo, err = editTodoList(cfg, s.todo, onto, head); err != nil {
+			return err
+		}
+	}
+	s.end = len(s.todo)
+
+	if err := writeOrigHead(head); err != nil {
+		return err
+	}
+	ontoFiles, err := commitFiles(onto)
+	if err != nil {
+		return err
+	}
+	updates := treeUpdates(headFiles, ontoFiles)
+	if err := checkWorktree(cfg, entries, headFiles, updates, "checkout"); err != nil {
+		return err
+	}
+	if entries, err = applyUpdates(entries, updates); err != nil {
+		return err
+	}
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	tx.detach("HEAD", onto, "rebase (start): checkout "+name)
+	if err := tx.commit(); err != nil {
+		return err
+	}
+
+	if err := s.write(); err != nil {
+		return err
+	}
+	return s.run(cfg)
+}
+
+func runRebase(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var action string
+	var names []string
+	reapplyCherryPicks, interactive := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "-i" || arg == "--interactive":
+			interactive = true
+		case arg == "--reapply-cherry-picks":
+			reapplyCherryPicks = true
+		case arg == "--no-reapply-cherry-picks":
+			reapplyCherryPicks = false
+		case arg == "--continue" || arg == "--skip" || arg == "--abort":
+			if action != "" && action != arg {
+				return fmt.Errorf("options '%s' and '%s' cannot be used together", action, arg)
+			}
+			action = arg
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+
+	if action == "" {
+		if len(names) != 1 {
+			return fmt.Errorf("usage: mygit rebase [-i] [--reapply-cherry-picks] <upstream>\n   or: mygit rebase (--continue | --skip | --abort)")
+		}
+		return startRebase(cfg, names[0], reapplyCherryPicks, interactive)
+	}
+	if len(names) > 0 {
+		return fmt.Errorf("%s takes no arguments", action)
+	}
+	s, err := readRebaseState()
+	if err != nil {
+		return err
+	}
+	switch action {
+	case "--continue":
+		return s.continueRebase(cfg)
+	case "--skip":
+		return s.skip(cfg)
+	}
+	return s.abort(cfg)
+}
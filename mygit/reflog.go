@@ -0,0 +1,186 @@
+package mygit
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// reflogEntry is one line of a reflog: the ref moved from old to new,
+// by ident ("Name <email> <timestamp> <tz>"), for the reason in message.
+type reflogEntry struct {
+	old     objectID
+	new     objectID
+	ident   string
+	message string
+}
+
+// shouldLogRef applies core.logAllRefUpdates to a ref that has no reflog
+// yet. By default non-bare repositories log HEAD, branches, remote-tracking
+// refs and notes; "always" logs every ref.
+func shouldLogRef(cfg *config, ref string) (bool, error) {
+	value, ok := cfg.get("core.logAllRefUpdates")
+	if !ok {
+		bare, err := cfg.getBool("core.bare", false)
+		if err != nil {
+			return false, err
+		}
+		value = strconv.FormatBool(!bare)
+	}
+	if strings.EqualFold(value, "always") {
+		return true, nil
+	}
+	enabled, err := parseConfigBool(value)
+	if err != nil {
+		return false, fmt.Errorf("bad config value '%s' for 'core.logallrefupdates'", value)
+	}
+	if !enabled {
+		return false, nil
+	}
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/", "refs/notes/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return true, nil
+		}
+	}
+	return ref == "HEAD", nil
+}
+
+// reflogIdentity is the committer identity, falling back to the login
+// name and host like git does for reflogs instead of refusing to write.
+func reflogIdentity(cfg *config) string {
+	if ident, err := identity(cfg, "committer"); err == nil {
+		return ident
+	}
+	user := os.Getenv("USER")
+	if user == "" {
+		user = "unknown"
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s <%s@%s> %s", user, user, host, formatIdentDate(time.Now()))
+}
+
+// readReflog returns the entries of ref's reflog, oldest first.
+func readReflog(ref string) ([]reflogEntry, error) {
+	return refStore().readReflog(ref)
+}
+
+// reflogTips returns every object recorded in the reflogs of HEAD and the
+// refs, so that pruning keeps recent history that no ref points at
+// anymore.
+func reflogTips() ([]objectID, error) {
+	store := refStore()
+	names, err := store.reflogNames()
+	if err != nil {
+		return nil, err
+	}
+
+	var tips []objectID
+	for _, name := range names {
+		entries, err := store.readReflog(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			for _, hash := range []objectID{e.old, e.new} {
+				if hash != (objectID{}) {
+					tips = append(tips, hash)
+				}
+			}
+		}
+	}
+	return tips, nil
+}
+
+// reflogRefName expands the argument of "reflog show" to a full ref name:
+// HEAD, a full ref, or a branch, tag or remote-tracking ref.
+func reflogRefName(name string) (string, error) {
+	if name == "HEAD" || strings.HasPrefix(name, "refs/") {
+		return name, nil
+	}
+	for _, pattern := range refSearchOrder {
+		ref := fmt.Sprintf(pattern, name)
+		if refStore().hasReflog(ref) {
+			return ref, nil
+		}
+	}
+	for _, pattern := range refSearchOrder {
+		ref := fmt.Sprintf(pattern, name)
+		if _, err := resolveRef(ref); err == nil {
+			return ref, nil
+		}
+	}
+	return "", fmt.Errorf("ambiguous argument '%s': unknown revision or path not in the working tree", name)
+}
+
+// parseReflogSelector splits "<ref>@{<n>}" into the ref, HEAD if empty,
+// and n.
+func parseReflogSelector(name string) (string, int, bool) {
+	base, rest, ok := strings.Cut(name, "@{")
+	if !ok || !strings.HasSuffix(rest, "}") {
+		return "", 0, false
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(rest, "}"))
+	if err != nil || n < 0 {
+		return "", 0, false
+	}
+	if base == "" {
+		base = "HEAD"
+	}
+	return base, n, true
+}
+
+// resolveReflogEntry returns the value ref had n updates ago.
+func resolveReflogEntry(name string, n int) (objectID, error) {
+	ref, err := reflogRefName(name)
+	if err != nil {
+		return objectID{}, err
+	}
+	entries, err := readReflog(ref)
+	if err != nil {
+		return objectID{}, err
+	}
+	if len(entries) == 0 {
+		return objectID{}, fmt.Errorf("log for '%s' is empty", name)
+	}
+	// One past the oldest entry is the value the ref had before it.
+	if n == len(entries) && entries[0].old != (objectID{}) {
+		return entries[0].old, nil
+	}
+	if n >= len(entries) {
+		return objectID{}, fmt.Errorf("log for '%s' only has %d entries", name, len(entries))
+	}
+	return entries[len(entries)-1-n].new, nil
+}
+
+func runReflog(args []string) error {
+	if len(args) > 0 && args[0] == "show" {
+		args = args[1:]
+	}
+	name := "HEAD"
+	switch len(args) {
+	case 0:
+	case 1:
+		name = args[0]
+	default:
+		return fmt.Errorf("usage: mygit reflog [show] [<ref>]")
+	}
+
+	ref, err := reflogRefName(name)
+	if err != nil {
+		return err
+	}
+	entries, err := readReflog(ref)
+	if err != nil {
+		return err
+	}
+
+	// Like git, entries are shown newest first as <name>@{<n>}, using the
+	// name as given.
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		fmt.Printf("%s %s@{%d}: %s\n", shortHash(e.new), name, len(entries)-1-i, e.message)
+	}
+	return nil
+}
@@ -0,0 +1,213 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const maxSymrefDepth = 5
+
+// gitDir holds the files of the current worktree, such as HEAD, and
+// commonDir those shared by all worktrees, such as refs. They only differ
+// in a linked worktree.
+var (
+	gitDir         = ".git"
+	commonDir      = ".git"
+	packedRefsFile = ".git/packed-refs"
+)
+
+var errRefNotFound = errors.New("ref not found")
+
+// refsMu keeps ref reads from seeing a transaction of this process half
+// committed, e.g. a loose ref deleted before packed-refs is rewritten.
+var refsMu sync.RWMutex
+
+// refValue is what a ref holds: an object hash or, for a symbolic ref, the
+// name of the ref it points to.
+type refValue struct {
+	hash   objectID
+	symref string
+}
+
+// refChange is one update in a ref transaction. logOnly changes only
+// record a reflog entry, which is how HEAD follows the branch it points
+// at.
+type refChange struct {
+	name    string
+	value   refValue
+	delete  bool
+	logOnly bool
+	// noDeref updates name itself even if it is a symbolic ref.
+	noDeref bool
+	// old is the value before the change. With verifyOld set, the
+	// transaction fails unless the ref is still at old, where zero means
+	// it must not exist.
+	old       objectID
+	verifyOld bool
+	// log and ident are filled in when the transaction is prepared.
+	log     bool
+	ident   string
+	message string
+	// reflog, if set, replaces the ref's reflog instead of adding an
+	// entry to it.
+	reflog []reflogEntry
+}
+
+// refBackend stores refs and their reflogs. The files backend keeps them
+// in loose files and packed-refs, the reftable backend in a stack of
+// reftables, as selected by extensions.refStorage.
+type refBackend interface {
+	// readRef returns the value of a single ref without following
+	// symbolic refs, or an error wrapping errRefNotFound.
+	readRef(name string) (refValue, error)
+	// refs returns every ref under refs/.
+	refs() (map[string]refValue, error)
+	// lock keeps others from updating the named refs until the returned
+	// lock is released.
+	lock(names []string) (refLock, error)
+	// readReflog returns the entries of a ref's reflog, oldest first.
+	readReflog(name string) ([]reflogEntry, error)
+	hasReflog(name string) bool
+	reflogNames() ([]string, error)
+	// pack optimizes the ref storage, as done by gc.
+	pack() error
+}
+
+// refLock is what a prepared transaction holds.
+type refLock interface {
+	// commit applies the changes and their reflog entries.
+	commit(changes []refChange) error
+	release()
+}
+
+// refStore returns the backend of the current repository.
+func refStore() refBackend {
+	if repoFormat.refStorage == "reftable" {
+		return reftableBackend{}
+	}
+	return filesBackend{}
+}
+
+// resolveRef follows symbolic refs until it reaches an object hash.
+func resolveRef(name string) (objectID, error) {
+	refsMu.RLock()
+	defer refsMu.RUnlock()
+	return followRef(refStore(), name)
+}
+
+// followRef resolves name in store, with refsMu held.
+func followRef(store refBackend, name string) (objectID, error) {
+	for depth := 0; depth < maxSymrefDepth; depth++ {
+		value, err := store.readRef(name)
+		if err != nil {
+			return objectID{}, err
+		}
+		if value.symref == "" {
+			return value.hash, nil
+		}
+		name = value.symref
+	}
+
+	return objectID{}, fmt.Errorf("symbolic ref %s nested too deeply", name)
+}
+
+// symrefTarget follows symbolic refs starting at name and returns the name
+// of the ref that ultimately holds the hash, which may not exist yet.
+func symrefTarget(name string) (string, error) {
+	refsMu.RLock()
+	defer refsMu.RUnlock()
+	store := refStore()
+	for depth := 0; depth < maxSymrefDepth; depth++ {
+		value, err := store.readRef(name)
+		if err != nil {
+			if errors.Is(err, errRefNotFound) {
+				return name, nil
+			}
+			return "", err
+		}
+		if value.symref == "" {
+			return name, nil
+		}
+		name = value.symref
+	}
+	return "", fmt.Errorf("symbolic ref %s nested too deeply", name)
+}
+
+// updateRef points name, or the ref it symbolically refers to, at hash,
+// recording the change with message in the reflogs.
+func updateRef(name string, hash objectID, message string) error {
+	tx := newRefTransaction()
+	tx.update(name, hash, message)
+	return tx.commit()
+}
+
+// writeSymref makes name a symbolic ref to target.
+func writeSymref(name, target string) error {
+	tx := newRefTransaction()
+	tx.symref(name, target, "")
+	return tx.commit()
+}
+
+// deleteRef removes a ref along with its reflog.
+func deleteRef(name string) error {
+	tx := newRefTransaction()
+	tx.delete(name)
+	return tx.commit()
+}
+
+// listRefs returns every ref under refs/ resolved to the object it points
+// at. Dangling symbolic refs are skipped.
+func listRefs() (map[string]objectID, error) {
+	refsMu.RLock()
+	defer refsMu.RUnlock()
+	store := refStore()
+	values, err := store.refs()
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string]objectID, len(values))
+	for name, value := range values {
+		if value.symref == "" {
+			refs[name] = value.hash
+			continue
+		}
+		hash, err := followRef(store, name)
+		if err != nil {
+			if errors.Is(err, errRefNotFound) {
+				// e.g. refs/remotes/origin/HEAD before a fetch.
+				continue
+			}
+			return nil, err
+		}
+		refs[name] = hash
+	}
+	return refs, nil
+}
+
+// packRefs optimizes the ref storage: loose refs are moved into
+// packed-refs, reftables are compacted into one.
+func packRefs() error {
+	return refStore().pack()
+}
+
+// peelTag follows annotated tags to the object they finally point at. ok is
+// false if hash is not a tag.
+func peelTag(hash objectID) (objectID, bool, error) {
+	peeled := hash
+	for {
+		objType, content, err := readObject(peeled)
+		if err != nil {
+			return objectID{}, false, err
+		}
+		if objType != tagObject {
+			return peeled, peeled != hash, nil
+		}
+		t, err := parseTag(content)
+		if err != nil {
+			return objectID{}, false, fmt.Errorf("corrupt tag %x: %w", peeled, err)
+		}
+		peeled = t.object
+	}
+}
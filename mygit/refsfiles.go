@@ -0,0 +1,551 @@
+package mygit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var logsDir = ".git/logs"
+
+// filesBackend is the traditional ref storage: one file per ref under
+// .git, packed-refs for refs packed by gc, and reflogs under .git/logs.
+type filesBackend struct{}
+
+// perWorktreeRef reports whether each worktree has its own ref name:
+// HEAD and the other refs outside refs/, and those used by bisect.
+func perWorktreeRef(name string) bool {
+	return !strings.HasPrefix(name, "refs/") || strings.HasPrefix(name, "refs/bisect/") ||
+		strings.HasPrefix(name, "refs/worktree/") || strings.HasPrefix(name, "refs/rewritten/")
+}
+
+// refFilePath returns the file a loose ref is stored in.
+func refFilePath(name string) string {
+	if perWorktreeRef(name) {
+		return filepath.Join(gitDir, name)
+	}
+	return filepath.Join(commonDir, name)
+}
+
+func reflogPath(ref string) string {
+	if perWorktreeRef(ref) {
+		return filepath.Join(gitDir, "logs", ref)
+	}
+	return filepath.Join(logsDir, ref)
+}
+
+// readRefFile reads a ref stored as a file under .git. Besides loose refs
+// this covers FETCH_HEAD and MERGE_HEAD, which are files with either
+// backend.
+func readRefFile(name string) (refValue, error) {
+	path := refFilePath(name)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if fi, statErr := os.Stat(path); errors.Is(err, fs.ErrNotExist) || statErr == nil && fi.IsDir() {
+			return refValue{}, fmt.Errorf("%s: %w", name, errRefNotFound)
+		}
+		return refValue{}, fmt.Errorf("failed to read ref %s: %w", name, err)
+	}
+
+	content := strings.TrimSpace(string(data))
+	if target, ok := strings.CutPrefix(content, "ref: "); ok {
+		return refValue{symref: target}, nil
+	}
+	// FETCH_HEAD and friends hold more than the hash.
+	if fields := strings.Fields(content); len(fields) > 0 {
+		content = fields[0]
+	}
+	hash, err := parseHash(content)
+	if err != nil {
+		return refValue{}, fmt.Errorf("invalid ref %s: %w", name, err)
+	}
+	return refValue{hash: hash}, nil
+}
+
+// readRef prefers the loose ref over the packed one.
+func (filesBackend) readRef(name string) (refValue, error) {
+	value, err := readRefFile(name)
+	if !errors.Is(err, errRefNotFound) {
+		return value, err
+	}
+
+	packed, err := readPackedRefs()
+	if err != nil {
+		return refValue{}, err
+	}
+	if hash, ok := packed[name]; ok {
+		return refValue{hash: hash}, nil
+	}
+	return refValue{}, fmt.Errorf("%s: %w", name, errRefNotFound)
+}
+
+func (filesBackend) refs() (map[string]refValue, error) {
+	packed, err := readPackedRefs()
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]refValue, len(packed))
+	for name, hash := range packed {
+		refs[name] = refValue{hash: hash}
+	}
+
+	root := filepath.Join(commonDir, "refs")
+	err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(commonDir, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		value, err := readRefFile(name)
+		if err != nil {
+			return err
+		}
+		refs[name] = value
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %w", err)
+	}
+	return refs, nil
+}
+
+// filesRefLock holds a lock file for each ref of a transaction. The new
+// values are written to the lock files, which are then renamed into
+// place.
+type filesRefLock struct {
+	locks map[string]*os.File
+}
+
+func (filesBackend) lock(names []string) (refLock, error) {
+	l := &filesRefLock{locks: make(map[string]*os.File)}
+	for _, name := range names {
+		path := refFilePath(name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			l.release()
+			return nil, fmt.Errorf("failed to create ref directory: %w", err)
+		}
+		f, err := os.OpenFile(path+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err != nil {
+			l.release()
+			return nil, fmt.Errorf("cannot lock ref '%s': %w", name, err)
+		}
+		l.locks[name] = f
+	}
+	return l, nil
+}
+
+// commit renames the updated refs into place only after all of them were
+// written, so that a failure leaves them untouched. Deleted refs are
+// removed from both the loose files and packed-refs.
+func (l *filesRefLock) commit(changes []refChange) error {
+	for _, c := range changes {
+		if c.delete || c.logOnly {
+			continue
+		}
+		content := fmt.Sprintf("%x\n", c.value.hash)
+		if c.value.symref != "" {
+			content = "ref: " + c.value.symref + "\n"
+		}
+		f := l.locks[c.name]
+		if _, err := f.WriteString(content); err != nil {
+			return fmt.Errorf("failed to write ref %s: %w", c.name, err)
+		}
+		if err := fsyncFile(f, fsyncReference); err != nil {
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write ref %s: %w", c.name, err)
+		}
+	}
+	for _, c := range changes {
+		if c.delete || c.logOnly {
+			continue
+		}
+		path := refFilePath(c.name)
+		if err := os.Rename(path+".lock", path); err != nil {
+			return fmt.Errorf("failed to update ref %s: %w", c.name, err)
+		}
+		delete(l.locks, c.name)
+	}
+
+	deleted := make(map[string]bool)
+	for _, c := range changes {
+		if c.delete {
+			if err := deleteLooseRef(c.name); err != nil {
+				return err
+			}
+			deleted[c.name] = true
+		}
+	}
+	if len(deleted) > 0 {
+		if err := removePackedRefs(deleted); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range changes {
+		var err error
+		switch {
+		case c.reflog != nil:
+			err = writeReflogFile(c.name, c.reflog)
+		case c.log:
+			err = appendReflogFile(c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// release removes the lock files that were not renamed into place.
+func (l *filesRefLock) release() {
+	for name, f := range l.locks {
+		f.Close()
+		os.Remove(refFilePath(name) + ".lock")
+	}
+	l.locks = nil
+}
+
+// deleteLooseRef removes the loose file and the reflog of a ref.
+func deleteLooseRef(name string) error {
+	if err := os.Remove(refFilePath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete ref %s: %w", name, err)
+	}
+	if err := os.Remove(reflogPath(name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete reflog for %s: %w", name, err)
+	}
+	return nil
+}
+
+// appendReflogFile adds the reflog entry of c to the ref's log file,
+// creating it if needed.
+func appendReflogFile(c refChange) error {
+	path := reflogPath(c.name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create reflog directory: %w", err)
+	}
+
+	line := reflogLine(reflogEntry{old: c.old, new: c.value.hash, ident: c.ident, message: c.message})
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open reflog for %s: %w", c.name, err)
+	}
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write reflog for %s: %w", c.name, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write reflog for %s: %w", c.name, err)
+	}
+	return nil
+}
+
+// reflogLine formats an entry as a line of a reflog file.
+func reflogLine(e reflogEntry) string {
+	line := fmt.Sprintf("%x %x %s", e.old, e.new, e.ident)
+	if e.message != "" {
+		line += "\t" + e.message
+	}
+	return line + "\n"
+}
+
+// writeReflogFile replaces the log file of a ref with entries.
+func writeReflogFile(name string, entries []reflogEntry) error {
+	var b strings.Builder
+	for _, e := range entries {
+		b.WriteString(reflogLine(e))
+	}
+	path := reflogPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create reflog directory: %w", err)
+	}
+	if err := os.WriteFile(path+".lock", []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write reflog for %s: %w", name, err)
+	}
+	if err := os.Rename(path+".lock", path); err != nil {
+		return fmt.Errorf("failed to write reflog for %s: %w", name, err)
+	}
+	return nil
+}
+
+func (filesBackend) readReflog(ref string) ([]reflogEntry, error) {
+	f, err := os.Open(reflogPath(ref))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open reflog for %s: %w", ref, err)
+	}
+	defer f.Close()
+
+	var entries []reflogEntry
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, message, _ := strings.Cut(scanner.Text(), "\t")
+		fields := strings.SplitN(line, " ", 3)
+		if len(fields) < 3 {
+			continue
+		}
+		old, err := parseHash(fields[0])
+		if err != nil {
+			continue
+		}
+		new, err := parseHash(fields[1])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, reflogEntry{old: old, new: new, ident: fields[2], message: message})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read reflog for %s: %w", ref, err)
+	}
+	return entries, nil
+}
+
+func (filesBackend) hasReflog(ref string) bool {
+	fi, err := os.Stat(reflogPath(ref))
+	return err == nil && !fi.IsDir()
+}
+
+// reflogNames lists the reflogs of the shared refs and those of the
+// current worktree, which are separate in a linked worktree.
+func (filesBackend) reflogNames() ([]string, error) {
+	var names []string
+	walk := func(root string, perWorktree bool) error {
+		return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if errors.Is(err, fs.ErrNotExist) {
+					return nil
+				}
+				return err
+			}
+			if d.IsDir() {
+				return nil
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			if name := filepath.ToSlash(rel); perWorktreeRef(name) == perWorktree {
+				names = append(names, name)
+			}
+			return nil
+		})
+	}
+	if err := walk(logsDir, false); err != nil {
+		return nil, fmt.Errorf("failed to read reflogs: %w", err)
+	}
+	if err := walk(filepath.Join(gitDir, "logs"), true); err != nil {
+		return nil, fmt.Errorf("failed to read reflogs: %w", err)
+	}
+	return names, nil
+}
+
+// readPackedRefs returns the refs stored in .git/packed-refs. Peeled lines
+// (^<hash>) are skipped.
+func readPackedRefs() (map[string]objectID, error) {
+	refs := make(map[string]objectID)
+
+	f, err := os.Open(packedRefsFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return refs, nil
+		}
+		return nil, fmt.Errorf("failed to open packed-refs: %w", err)
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		hexHash, name, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, fmt.Errorf("invalid packed-refs line %q", line)
+		}
+		hash, err := parseHash(hexHash)
+		if err != nil {
+			return nil, fmt.Errorf("invalid packed-refs line %q: %w", line, err)
+		}
+		refs[name] = hash
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read packed-refs: %w", err)
+	}
+
+	return refs, nil
+}
+
+// removePackedRefs drops the named refs, and their peeled lines, from
+// packed-refs.
+func removePackedRefs(names map[string]bool) error {
+	data, err := os.ReadFile(packedRefsFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("failed to read packed-refs: %w", err)
+	}
+
+	var kept []string
+	found, skipPeeled := false, false
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == '^' && skipPeeled {
+			continue
+		}
+		skipPeeled = false
+		if _, ref, ok := strings.Cut(strings.TrimSuffix(line, "\n"), " "); ok && line[0] != '#' && names[ref] {
+			found, skipPeeled = true, true
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if !found {
+		return nil
+	}
+	return writePackedRefs(strings.Join(kept, ""))
+}
+
+// writePackedRefs replaces packed-refs with data through a lock file.
+func writePackedRefs(data string) error {
+	lock := packedRefsFile + ".lock"
+	f, err := os.OpenFile(lock, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to lock packed-refs: %w", err)
+	}
+	if _, err := f.WriteString(data); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return fmt.Errorf("failed to write packed-refs: %w", err)
+	}
+	if err := fsyncFile(f, fsyncReference); err != nil {
+		f.Close()
+		os.Remove(lock)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to write packed-refs: %w", err)
+	}
+	if err := os.Rename(lock, packedRefsFile); err != nil {
+		os.Remove(lock)
+		return fmt.Errorf("failed to update packed-refs: %w", err)
+	}
+	return nil
+}
+
+// listLooseRefs returns the loose refs under refs/ that hold a hash.
+// Symbolic refs and lock files are skipped.
+func listLooseRefs() (map[string]objectID, error) {
+	refs := make(map[string]objectID)
+	root := filepath.Join(commonDir, "refs")
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() || strings.HasSuffix(path, ".lock") {
+			return nil
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash, err := parseHash(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(commonDir, path)
+		if err != nil {
+			return err
+		}
+		refs[filepath.ToSlash(rel)] = hash
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list refs: %w", err)
+	}
+	return refs, nil
+}
+
+// pack moves every loose ref into packed-refs, recording the peeled
+// value of annotated tags the way git does, and then deletes the loose
+// files. Symbolic refs stay loose.
+func (filesBackend) pack() error {
+	refs, err := readPackedRefs()
+	if err != nil {
+		return err
+	}
+	loose, err := listLooseRefs()
+	if err != nil {
+		return err
+	}
+	if len(loose) == 0 {
+		return nil
+	}
+	for name, hash := range loose {
+		refs[name] = hash
+	}
+
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# pack-refs with: peeled fully-peeled sorted \n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "%x %s\n", refs[name], name)
+		// Refs to missing objects, e.g. in a partial clone, are not peeled.
+		if peeled, ok, err := peelTag(refs[name]); err == nil && ok {
+			fmt.Fprintf(&b, "^%x\n", peeled)
+		}
+	}
+	if err := writePackedRefs(b.String()); err != nil {
+		return err
+	}
+
+	for name, hash := range loose {
+		path := refFilePath(name)
+		// Leave refs alone that were updated while packing.
+		data, err := os.ReadFile(path)
+		if err != nil || strings.TrimSpace(string(data)) != hash.String() {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove loose ref %s: %w", name, err)
+		}
+		// Remove emptied directories below refs/heads, refs/tags, etc.
+		for dir := filepath.Dir(name); strings.Count(dir, "/") >= 2; dir = filepath.Dir(dir) {
+			if os.Remove(filepath.Join(commonDir, dir)) != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
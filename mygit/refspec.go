@@ -0,0 +1,64 @@
+package mygit
+
+import (
+	"fmt"
+	"strings"
+)
+
+type refspec struct {
+	force bool
+	src   string
+	dst   string
+}
+
+func parseRefspec(s string) (refspec, error) {
+	var r refspec
+	if rest, ok := strings.CutPrefix(s, "+"); ok {
+		r.force = true
+		s = rest
+	}
+
+	r.src, r.dst, _ = strings.Cut(s, ":")
+	if strings.Count(r.src, "*") > 1 || strings.Count(r.dst, "*") > 1 ||
+		(r.dst != "" && strings.Contains(r.src, "*") != strings.Contains(r.dst, "*")) {
+		return refspec{}, fmt.Errorf("invalid refspec %q", s)
+	}
+	return r, nil
+}
+
+func (r refspec) String() string {
+	s := r.src
+	if r.dst != "" {
+		s += ":" + r.dst
+	}
+	if r.force {
+		s = "+" + s
+	}
+	return s
+}
+
+// match reports whether name matches the source side of the refspec and
+// returns the corresponding destination, expanding a single wildcard.
+func (r refspec) match(name string) (string, bool) {
+	prefix, suffix, wildcard := strings.Cut(r.src, "*")
+	if !wildcard {
+		if name == r.src || name == expandRefName(r.src) {
+			return r.dst, true
+		}
+		return "", false
+	}
+
+	if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, suffix) || len(name) < len(prefix)+len(suffix) {
+		return "", false
+	}
+	matched := name[len(prefix) : len(name)-len(suffix)]
+	return strings.Replace(r.dst, "*", matched, 1), true
+}
+
+// expandRefName turns a short branch name like "main" into its full ref.
+func expandRefName(name string) string {
+	if strings.HasPrefix(name, "refs/") || name == "HEAD" {
+		return name
+	}
+	return "refs/heads/" + name
+}
@@ -0,0 +1,423 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// reftableStack is the list of tables in tables.list, oldest first. Each
+// ref transaction adds a table; compaction merges them.
+type reftableStack []*reftableFile
+
+func readReftableList() ([]string, error) {
+	data, err := os.ReadFile(reftableListFile)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read reftable stack: %w", err)
+	}
+	return strings.Fields(string(data)), nil
+}
+
+func openReftableStack(names []string) (reftableStack, error) {
+	var s reftableStack
+	for _, name := range names {
+		t, err := openReftable(name)
+		if err != nil {
+			s.close()
+			return nil, err
+		}
+		s = append(s, t)
+	}
+	return s, nil
+}
+
+func loadReftableStack() (reftableStack, error) {
+	names, err := readReftableList()
+	if err != nil {
+		return nil, err
+	}
+	return openReftableStack(names)
+}
+
+func (s reftableStack) close() {
+	for _, t := range s {
+		t.f.Close()
+	}
+}
+
+// ref looks name up in the tables from newest to oldest.
+func (s reftableStack) ref(name string) (reftableRef, bool, error) {
+	for i := len(s) - 1; i >= 0; i-- {
+		r, found, err := s[i].lookupRef(name)
+		if err != nil || found {
+			return r, found && !r.deleted, err
+		}
+	}
+	return reftableRef{}, false, nil
+}
+
+// refs merges the ref records of the tables, newer ones taking precedence.
+// Deletions are kept if keepDeleted is set.
+func (s reftableStack) refs(keepDeleted bool) (map[string]reftableRef, error) {
+	refs := make(map[string]reftableRef)
+	for _, t := range s {
+		if err := t.allRefs(func(r reftableRef) { refs[r.name] = r }); err != nil {
+			return nil, err
+		}
+	}
+	if !keepDeleted {
+		for name, r := range refs {
+			if r.deleted {
+				delete(refs, name)
+			}
+		}
+	}
+	return refs, nil
+}
+
+// logs merges the log records of name, or of every ref if name is empty,
+// like refs.
+func (s reftableStack) logs(name string, keepDeleted bool) ([]reftableLog, error) {
+	type logKey struct {
+		name  string
+		index uint64
+	}
+	merged := make(map[logKey]reftableLog)
+	for _, t := range s {
+		err := t.logs(name, func(l reftableLog) { merged[logKey{l.name, l.updateIndex}] = l })
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	logs := make([]reftableLog, 0, len(merged))
+	for _, l := range merged {
+		if keepDeleted || !l.deleted {
+			logs = append(logs, l)
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].name != logs[j].name {
+			return logs[i].name < logs[j].name
+		}
+		return logs[i].updateIndex < logs[j].updateIndex
+	})
+	return logs, nil
+}
+
+// compact merges the tables from start to end (exclusive) into one and
+// returns the new table list. Deletions can only be dropped when the
+// oldest table is included, since otherwise they still hide older records.
+func (s reftableStack) compact(names []string, start, end int) ([]string, error) {
+	keepDeleted := start > 0
+	segment := s[start:end]
+	refs, err := segment.refs(keepDeleted)
+	if err != nil {
+		return nil, err
+	}
+	logs, err := segment.logs("", keepDeleted)
+	if err != nil {
+		return nil, err
+	}
+
+	refList := make([]reftableRef, 0, len(refs))
+	for _, r := range refs {
+		refList = append(refList, r)
+	}
+	name, err := writeReftable(segment[0].minIndex, segment[len(segment)-1].maxIndex, refList, logs)
+	if err != nil {
+		return nil, err
+	}
+	list := append(append(append([]string(nil), names[:start]...), name), names[end:]...)
+	return list, nil
+}
+
+// autoCompaction returns the range of tables to merge to keep table sizes
+// a geometric sequence with factor 2, like git does after every write, so
+// that the stack stays logarithmic in the number of updates.
+func (s reftableStack) autoCompaction() (int, int) {
+	if len(s) <= 1 {
+		return 0, 0
+	}
+	size := func(i int) int64 { return s[i].size }
+
+	// Find the newest table that is too big for its predecessor.
+	start, end := 0, 0
+	var bytes int64
+	i := len(s) - 1
+	for ; i > 0; i-- {
+		if size(i-1) < 2*size(i) {
+			end = i + 1
+			bytes = size(i)
+			break
+		}
+	}
+	// Extend the segment back while the merged size would outgrow the
+	// preceding table.
+	for ; i > 0; i-- {
+		merged := bytes
+		bytes += size(i - 1)
+		if size(i-1) < 2*merged {
+			start = i - 1
+		}
+	}
+	if end-start <= 1 {
+		return 0, 0
+	}
+	return start, end
+}
+
+// reftableBackend stores refs in a reftable stack under .git/reftable.
+type reftableBackend struct{}
+
+// reftableFileRefs are kept as files even in reftable repositories, as
+// they hold more than a ref value.
+var reftableFileRefs = map[string]bool{"FETCH_HEAD": true, "MERGE_HEAD": true}
+
+func (reftableBackend) readRef(name string) (refValue, error) {
+	if reftableFileRefs[name] {
+		return readRefFile(name)
+	}
+	s, err := loadReftableStack()
+	if err != nil {
+		return refValue{}, err
+	}
+	defer s.close()
+
+	r, found, err := s.ref(name)
+	if err != nil {
+		return refValue{}, err
+	}
+	if !found {
+		return refValue{}, fmt.Errorf("%s: %w", name, errRefNotFound)
+	}
+	return r.value, nil
+}
+
+func (reftableBackend) refs() (map[string]refValue, error) {
+	s, err := loadReftableStack()
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	records, err := s.refs(false)
+	if err != nil {
+		return nil, err
+	}
+	refs := make(map[string]refValue, len(records))
+	for name, r := range records {
+		if strings.HasPrefix(name, "refs/") {
+			refs[name] = r.value
+		}
+	}
+	return refs, nil
+}
+
+// lock takes the lock on tables.list, which covers all refs.
+func (reftableBackend) lock(names []string) (refLock, error) {
+	return lockReftableStack()
+}
+
+// commit writes all changes as a single new table, so they become visible
+// at once.
+func (l *reftableLock) commit(changes []refChange) error {
+	return l.update(func(s reftableStack, names []string) ([]string, error) {
+		updateIndex := uint64(1)
+		if len(s) > 0 {
+			updateIndex = s[len(s)-1].maxIndex + 1
+		}
+
+		maxIndex := updateIndex
+		var refs []reftableRef
+		var logs []reftableLog
+		for _, c := range changes {
+			if !c.logOnly {
+				r := reftableRef{name: c.name, updateIndex: updateIndex, value: c.value, deleted: c.delete}
+				if !c.delete && c.value.symref == "" {
+					if peeled, ok, err := peelTag(c.value.hash); err == nil && ok {
+						r.peeled = peeled
+					}
+				}
+				refs = append(refs, r)
+			}
+			if c.delete || c.reflog != nil {
+				// Deleting a ref deletes its reflog too.
+				existing, err := s.logs(c.name, false)
+				if err != nil {
+					return nil, err
+				}
+				for _, l := range existing {
+					logs = append(logs, reftableLog{name: l.name, updateIndex: l.updateIndex, deleted: true})
+				}
+			}
+			if c.log {
+				entry := reflogEntry{old: c.old, new: c.value.hash, ident: c.ident, message: c.message}
+				logs = append(logs, reftableLog{name: c.name, updateIndex: updateIndex, entry: entry})
+			}
+			// A rewritten reflog needs an update index for each entry.
+			for i, entry := range c.reflog {
+				logs = append(logs, reftableLog{name: c.name, updateIndex: updateIndex + uint64(i), entry: entry})
+				maxIndex = max(maxIndex, updateIndex+uint64(i))
+			}
+		}
+
+		name, err := writeReftable(updateIndex, maxIndex, refs, logs)
+		if err != nil {
+			return nil, err
+		}
+		t, err := openReftable(name)
+		if err != nil {
+			return nil, err
+		}
+		s = append(s, t)
+		defer t.f.Close()
+
+		names = append(names, name)
+		if start, end := s.autoCompaction(); end > start {
+			return s.compact(names, start, end)
+		}
+		return names, nil
+	})
+}
+
+func (reftableBackend) readReflog(name string) ([]reflogEntry, error) {
+	s, err := loadReftableStack()
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	logs, err := s.logs(name, false)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]reflogEntry, len(logs))
+	for i, l := range logs {
+		entries[i] = l.entry
+	}
+	return entries, nil
+}
+
+func (b reftableBackend) hasReflog(name string) bool {
+	entries, err := b.readReflog(name)
+	return err == nil && len(entries) > 0
+}
+
+func (reftableBackend) reflogNames() ([]string, error) {
+	s, err := loadReftableStack()
+	if err != nil {
+		return nil, err
+	}
+	defer s.close()
+
+	logs, err := s.logs("", false)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i, l := range logs {
+		if i == 0 || logs[i-1].name != l.name {
+			names = append(names, l.name)
+		}
+	}
+	return names, nil
+}
+
+// pack compacts the whole stack into a single table.
+func (reftableBackend) pack() error {
+	l, err := lockReftableStack()
+	if err != nil {
+		return err
+	}
+	defer l.release()
+	return l.update(func(s reftableStack, names []string) ([]string, error) {
+		if len(s) <= 1 {
+			return names, nil
+		}
+		return s.compact(names, 0, len(s))
+	})
+}
+
+// reftableLock holds tables.list.lock, which serializes writers of the
+// stack.
+type reftableLock struct {
+	f         *os.File
+	installed bool
+}
+
+func lockReftableStack() (*reftableLock, error) {
+	f, err := os.OpenFile(reftableListFile+".lock", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock reftable stack: %w", err)
+	}
+	return &reftableLock{f: f}, nil
+}
+
+// release gives up the lock unless update already installed it as the
+// new tables.list.
+func (l *reftableLock) release() {
+	if !l.installed {
+		l.f.Close()
+		os.Remove(reftableListFile + ".lock")
+	}
+}
+
+// update lets fn compute the new table list from the current stack and
+// installs it. Tables no longer listed, such as those merged by
+// compaction, are deleted afterwards.
+func (l *reftableLock) update(fn func(s reftableStack, names []string) ([]string, error)) error {
+	names, err := readReftableList()
+	if err != nil {
+		return err
+	}
+	s, err := openReftableStack(names)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	list, err := fn(s, names)
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, name := range list {
+		b.WriteString(name + "\n")
+	}
+	if _, err := l.f.WriteString(b.String()); err != nil {
+		return fmt.Errorf("failed to write reftable stack: %w", err)
+	}
+	if err := fsyncFile(l.f, fsyncReference); err != nil {
+		return err
+	}
+	if err := l.f.Close(); err != nil {
+		return fmt.Errorf("failed to write reftable stack: %w", err)
+	}
+	if err := os.Rename(reftableListFile+".lock", reftableListFile); err != nil {
+		return fmt.Errorf("failed to update reftable stack: %w", err)
+	}
+	l.installed = true
+
+	kept := make(map[string]bool, len(list))
+	for _, name := range list {
+		kept[name] = true
+	}
+	entries, err := os.ReadDir(reftableDir)
+	if err != nil {
+		return nil
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".ref") && !kept[e.Name()] {
+			os.Remove(filepath.Join(reftableDir, e.Name()))
+		}
+	}
+	return nil
+}
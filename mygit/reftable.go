@@ -0,0 +1,829 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	reftableDir      = ".git/reftable"
+	reftableListFile = ".git/reftable/tables.list"
+)
+
+const (
+	reftableMagic = "REFT"
+	// reftableBlockSize is the size ref blocks are padded to, and the
+	// limit for the uncompressed size of the other blocks.
+	reftableBlockSize = 4096
+	// reftableRestartInterval is how often a record stores its full key
+	// instead of sharing a prefix with the previous one.
+	reftableRestartInterval = 16
+	// reftableIndexThreshold is the number of blocks up to which a
+	// section is scanned instead of getting an index.
+	reftableIndexThreshold = 3
+)
+
+// Block types.
+const (
+	reftableRefBlock   = 'r'
+	reftableLogBlock   = 'g'
+	reftableIndexBlock = 'i'
+)
+
+// Value types of ref records. Log records are either deletions (0) or
+// updates (1).
+const (
+	reftableDeletion = 0
+	reftableHash     = 1
+	reftablePeeled   = 2
+	reftableSymref   = 3
+	reftableUpdate   = 1
+)
+
+// reftableHashIDs identify the hash in version 2 headers; version 1
+// tables are always SHA-1.
+var reftableHashIDs = map[string]uint32{"sha1": 0x73686131, "sha256": 0x73323536}
+
+var errReftableCorrupt = errors.New("corrupt reftable")
+
+// reftableRef is a ref record. A deleted record hides the ref in older
+// tables of the stack.
+type reftableRef struct {
+	name        string
+	updateIndex uint64
+	value       refValue
+	// peeled is the object an annotated tag points at.
+	peeled  objectID
+	deleted bool
+}
+
+// reftableLog is a reflog entry, identified by the ref name and the update
+// index that wrote it. A deleted record hides the entry in older tables.
+type reftableLog struct {
+	name        string
+	updateIndex uint64
+	entry       reflogEntry
+	deleted     bool
+}
+
+// reftableRecord is a record as stored in a block: a key, the 3-bit value
+// type and the encoded value.
+type reftableRecord struct {
+	key   string
+	typ   byte
+	value []byte
+}
+
+func reftableVersion() int {
+	if hashAlgo == sha1Algorithm {
+		return 1
+	}
+	return 2
+}
+
+func reftableHeaderSize(version int) int {
+	if version == 1 {
+		return 24
+	}
+	return 28
+}
+
+// reftableFooterSize is the size of the footer: a copy of the header, five
+// 64-bit section positions and a CRC-32.
+func reftableFooterSize(version int) int {
+	return reftableHeaderSize(version) + 5*8 + 4
+}
+
+// putReftableVarint appends v in the varint encoding git uses for pack
+// offsets, where each continuation byte also adds one to the value.
+func putReftableVarint(b []byte, v uint64) []byte {
+	var buf [10]byte
+	i := len(buf) - 1
+	buf[i] = byte(v & 0x7f)
+	for v >>= 7; v != 0; v >>= 7 {
+		v--
+		i--
+		buf[i] = 0x80 | byte(v&0x7f)
+	}
+	return append(b, buf[i:]...)
+}
+
+// readReftableVarint decodes a varint, returning the value and the number
+// of bytes read, or 0 if truncated.
+func readReftableVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	val := uint64(b[0] & 0x7f)
+	i := 1
+	for b[i-1]&0x80 != 0 {
+		if i >= len(b) || i > 9 {
+			return 0, 0
+		}
+		val = (val+1)<<7 | uint64(b[i]&0x7f)
+		i++
+	}
+	return val, i
+}
+
+func putReftableString(b []byte, s string) []byte {
+	return append(putReftableVarint(b, uint64(len(s))), s...)
+}
+
+// reftableDecoder reads consecutive fields of a record, remembering the
+// first error.
+type reftableDecoder struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (d *reftableDecoder) varint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := readReftableVarint(d.b[d.pos:])
+	if n == 0 {
+		d.err = errReftableCorrupt
+		return 0
+	}
+	d.pos += n
+	return v
+}
+
+func (d *reftableDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b)-d.pos {
+		d.err = errReftableCorrupt
+		return nil
+	}
+	b := d.b[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
+
+func (d *reftableDecoder) string() string {
+	return string(d.next(int(d.varint())))
+}
+
+func (d *reftableDecoder) hash() objectID {
+	b := d.next(hashAlgo.size)
+	if b == nil {
+		return objectID{}
+	}
+	return objectIDFromBytes(b)
+}
+
+// record encodes a ref record; update indices are stored relative to the
+// table's minimum.
+func (r reftableRef) record(minIndex uint64) reftableRecord {
+	val := putReftableVarint(nil, r.updateIndex-minIndex)
+	typ := byte(reftableHash)
+	switch {
+	case r.deleted:
+		typ = reftableDeletion
+	case r.value.symref != "":
+		typ = reftableSymref
+		val = putReftableString(val, r.value.symref)
+	case r.peeled != objectID{}:
+		typ = reftablePeeled
+		val = append(append(val, r.value.hash.bytes()...), r.peeled.bytes()...)
+	default:
+		val = append(val, r.value.hash.bytes()...)
+	}
+	return reftableRecord{key: r.name, typ: typ, value: val}
+}
+
+func parseReftableRef(rec reftableRecord, minIndex uint64) (reftableRef, error) {
+	d := reftableDecoder{b: rec.value}
+	r := reftableRef{name: rec.key, updateIndex: minIndex + d.varint()}
+	switch rec.typ {
+	case reftableDeletion:
+		r.deleted = true
+	case reftableHash:
+		r.value.hash = d.hash()
+	case reftablePeeled:
+		r.value.hash = d.hash()
+		r.peeled = d.hash()
+	case reftableSymref:
+		r.value.symref = d.string()
+	default:
+		return reftableRef{}, fmt.Errorf("%w: unknown ref value type %d", errReftableCorrupt, rec.typ)
+	}
+	return r, d.err
+}
+
+// reftableLogKey sorts log records by ref name and then newest first.
+func reftableLogKey(name string, updateIndex uint64) string {
+	return name + "\x00" + string(binary.BigEndian.AppendUint64(nil, ^updateIndex))
+}
+
+// record encodes a log record. The identity is stored split into its
+// parts, with the timezone in minutes, and the message with a trailing
+// newline like git does.
+func (l reftableLog) record() reftableRecord {
+	rec := reftableRecord{key: reftableLogKey(l.name, l.updateIndex), typ: reftableDeletion}
+	if l.deleted {
+		return rec
+	}
+	rec.typ = reftableUpdate
+
+	name, email, when := parseIdent(l.entry.ident)
+	_, offset := when.Zone()
+	message := l.entry.message
+	if message != "" {
+		message += "\n"
+	}
+	val := append(l.entry.old.bytes(), l.entry.new.bytes()...)
+	val = putReftableString(val, name)
+	val = putReftableString(val, email)
+	val = putReftableVarint(val, uint64(when.Unix()))
+	val = binary.BigEndian.AppendUint16(val, uint16(int16(offset/60)))
+	rec.value = putReftableString(val, message)
+	return rec
+}
+
+func parseReftableLog(rec reftableRecord) (reftableLog, error) {
+	name, index, ok := strings.Cut(rec.key, "\x00")
+	if !ok || len(index) != 8 {
+		return reftableLog{}, fmt.Errorf("%w: bad log key", errReftableCorrupt)
+	}
+	l := reftableLog{name: name, updateIndex: ^binary.BigEndian.Uint64([]byte(index))}
+	switch rec.typ {
+	case reftableDeletion:
+		l.deleted = true
+		return l, nil
+	case reftableUpdate:
+	default:
+		return reftableLog{}, fmt.Errorf("%w: unknown log value type %d", errReftableCorrupt, rec.typ)
+	}
+
+	d := reftableDecoder{b: rec.value}
+	l.entry.old = d.hash()
+	l.entry.new = d.hash()
+	ident := d.string()
+	email := d.string()
+	seconds := d.varint()
+	var tz int16
+	if b := d.next(2); b != nil {
+		tz = int16(binary.BigEndian.Uint16(b))
+	}
+	l.entry.message = strings.TrimSuffix(d.string(), "\n")
+
+	sign, minutes := '+', int(tz)
+	if minutes < 0 {
+		sign, minutes = '-', -minutes
+	}
+	l.entry.ident = fmt.Sprintf("%s <%s> %d %c%02d%02d", ident, email, seconds, sign, minutes/60, minutes%60)
+	return l, d.err
+}
+
+// reftableWriter builds a table in memory. Blocks are written one section
+// at a time; the first block of the file includes the file header.
+type reftableWriter struct {
+	buf        []byte
+	version    int
+	headerSize int
+
+	// The block being written: blockStart is what its restart offsets
+	// are relative to, which is the start of the file for the first
+	// block, and typeOffset is where its block header is.
+	blockType  byte
+	blockStart int
+	typeOffset int
+	restarts   []int
+	lastKey    string
+	count      int
+
+	// index has the last key and offset of every block of the section.
+	index []reftableRecord
+	// padding is owed by the previous ref block; it is only written if
+	// another block follows, so the last block is never padded.
+	padding int
+}
+
+func newReftableWriter(minIndex, maxIndex uint64) *reftableWriter {
+	w := &reftableWriter{version: reftableVersion()}
+	w.headerSize = reftableHeaderSize(w.version)
+	w.buf = append(w.buf, reftableMagic...)
+	w.buf = append(w.buf, byte(w.version), 0, 0, 0)
+	putUint24(w.buf[5:], reftableBlockSize)
+	w.buf = binary.BigEndian.AppendUint64(w.buf, minIndex)
+	w.buf = binary.BigEndian.AppendUint64(w.buf, maxIndex)
+	if w.version == 2 {
+		w.buf = binary.BigEndian.AppendUint32(w.buf, reftableHashIDs[hashAlgo.name])
+	}
+	return w
+}
+
+func putUint24(b []byte, v int) {
+	b[0], b[1], b[2] = byte(v>>16), byte(v>>8), byte(v)
+}
+
+func uint24(b []byte) int {
+	return int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+}
+
+func (w *reftableWriter) beginBlock(typ byte) {
+	w.buf = append(w.buf, make([]byte, w.padding)...)
+	w.padding = 0
+	w.blockType = typ
+	w.typeOffset = len(w.buf)
+	w.blockStart = w.typeOffset
+	if w.typeOffset == w.headerSize {
+		w.blockStart = 0
+	}
+	w.buf = append(w.buf, typ, 0, 0, 0)
+	w.restarts = w.restarts[:0]
+	w.lastKey = ""
+	w.count = 0
+}
+
+// add appends a record to the current block, starting a new block when it
+// does not fit. A record too big for any block gets a block of its own.
+func (w *reftableWriter) add(rec reftableRecord) {
+	restart := w.count%reftableRestartInterval == 0
+	enc := w.encode(rec, restart)
+	size := len(w.buf) - w.blockStart + len(enc) + 3*len(w.restarts) + 2
+	if restart {
+		size += 3
+	}
+	if w.count > 0 && size > reftableBlockSize {
+		typ := w.blockType
+		w.finishBlock()
+		w.beginBlock(typ)
+		restart = true
+		enc = w.encode(rec, true)
+	}
+
+	if restart {
+		w.restarts = append(w.restarts, len(w.buf)-w.blockStart)
+	}
+	w.buf = append(w.buf, enc...)
+	w.lastKey = rec.key
+	w.count++
+}
+
+func (w *reftableWriter) encode(rec reftableRecord, restart bool) []byte {
+	prefix := 0
+	if !restart {
+		for prefix < len(rec.key) && prefix < len(w.lastKey) && rec.key[prefix] == w.lastKey[prefix] {
+			prefix++
+		}
+	}
+	b := putReftableVarint(nil, uint64(prefix))
+	b = putReftableVarint(b, uint64(len(rec.key)-prefix)<<3|uint64(rec.typ))
+	b = append(b, rec.key[prefix:]...)
+	return append(b, rec.value...)
+}
+
+// finishBlock writes the restart table and the block length. Log blocks
+// are then compressed, ref blocks padded to the block size.
+func (w *reftableWriter) finishBlock() {
+	for _, off := range w.restarts {
+		w.buf = append(w.buf, 0, 0, 0)
+		putUint24(w.buf[len(w.buf)-3:], off)
+	}
+	w.buf = binary.BigEndian.AppendUint16(w.buf, uint16(len(w.restarts)))
+	putUint24(w.buf[w.typeOffset+1:], len(w.buf)-w.blockStart)
+	w.index = append(w.index, reftableRecord{key: w.lastKey, value: putReftableVarint(nil, uint64(w.blockStart))})
+
+	switch w.blockType {
+	case reftableLogBlock:
+		var z bytes.Buffer
+		zw := zlib.NewWriter(&z)
+		zw.Write(w.buf[w.typeOffset+4:])
+		zw.Close()
+		w.buf = append(w.buf[:w.typeOffset+4], z.Bytes()...)
+	case reftableRefBlock:
+		w.padding = max(w.blockStart+reftableBlockSize-len(w.buf), 0)
+	}
+}
+
+// writeSection writes the records as blocks of type typ followed by an
+// index if there are many blocks. It returns the position of the first
+// block and of the top-level index, 0 if there is none.
+func (w *reftableWriter) writeSection(typ byte, records []reftableRecord) (uint64, uint64) {
+	if len(records) == 0 {
+		return 0, 0
+	}
+	w.index = nil
+	w.beginBlock(typ)
+	pos := uint64(w.blockStart)
+	for _, rec := range records {
+		w.add(rec)
+	}
+	w.finishBlock()
+
+	// Index blocks get indexed in turn until a single block remains.
+	var indexPos uint64
+	for level := w.index; len(level) > reftableIndexThreshold || indexPos != 0 && len(level) > 1; level = w.index {
+		w.index = nil
+		w.beginBlock(reftableIndexBlock)
+		indexPos = uint64(w.blockStart)
+		for _, rec := range level {
+			w.add(rec)
+		}
+		w.finishBlock()
+	}
+	return pos, indexPos
+}
+
+// finish appends the footer and returns the table.
+func (w *reftableWriter) finish(refIndexPos, logPos, logIndexPos uint64) []byte {
+	start := len(w.buf)
+	w.buf = append(w.buf, w.buf[:w.headerSize]...)
+	for _, pos := range []uint64{refIndexPos, 0, 0, logPos, logIndexPos} {
+		w.buf = binary.BigEndian.AppendUint64(w.buf, pos)
+	}
+	return binary.BigEndian.AppendUint32(w.buf, crc32.ChecksumIEEE(w.buf[start:]))
+}
+
+// writeReftable writes a table with the given records into the reftable
+// directory and returns its name.
+func writeReftable(minIndex, maxIndex uint64, refs []reftableRef, logs []reftableLog) (string, error) {
+	sort.Slice(refs, func(i, j int) bool { return refs[i].name < refs[j].name })
+	refRecords := make([]reftableRecord, len(refs))
+	for i, r := range refs {
+		refRecords[i] = r.record(minIndex)
+	}
+	logRecords := make([]reftableRecord, len(logs))
+	for i, l := range logs {
+		logRecords[i] = l.record()
+	}
+	sort.Slice(logRecords, func(i, j int) bool { return logRecords[i].key < logRecords[j].key })
+
+	w := newReftableWriter(minIndex, maxIndex)
+	_, refIndexPos := w.writeSection(reftableRefBlock, refRecords)
+	logPos, logIndexPos := w.writeSection(reftableLogBlock, logRecords)
+	data := w.finish(refIndexPos, logPos, logIndexPos)
+
+	tmp, err := os.CreateTemp(reftableDir, "tmp_table_")
+	if err != nil {
+		return "", fmt.Errorf("failed to create reftable: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil || tmp.Chmod(0644) != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write reftable: %w", err)
+	}
+	if err := fsyncFile(tmp, fsyncReference); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write reftable: %w", err)
+	}
+	name := fmt.Sprintf("0x%012x-0x%012x-%08x.ref", minIndex, maxIndex, rand.Uint32())
+	if err := os.Rename(tmp.Name(), filepath.Join(reftableDir, name)); err != nil {
+		os.Remove(tmp.Name())
+		return "", fmt.Errorf("failed to write reftable: %w", err)
+	}
+	return name, nil
+}
+
+// reftableFile is an open table. Blocks are read on demand, so a lookup
+// only touches the footer, the index and the block holding the key.
+type reftableFile struct {
+	name       string
+	f          *os.File
+	size       int64
+	headerSize int
+	blockSize  int
+	minIndex   uint64
+	maxIndex   uint64
+	// end is where the footer starts.
+	end         int64
+	firstType   byte
+	refIndexPos int64
+	logPos      int64
+	logIndexPos int64
+}
+
+// reftableBlock is a decoded block. next is the position of the block
+// following it.
+type reftableBlock struct {
+	typ     byte
+	records []reftableRecord
+	next    int64
+}
+
+func openReftable(name string) (*reftableFile, error) {
+	f, err := os.Open(filepath.Join(reftableDir, name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open reftable %s: %w", name, err)
+	}
+	t, err := readReftableHeader(f, name)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return t, nil
+}
+
+func readReftableHeader(f *os.File, name string) (*reftableFile, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 28)
+	if n, _ := f.ReadAt(header, 0); n < 24 || string(header[:4]) != reftableMagic {
+		return nil, errReftableCorrupt
+	}
+	version := int(header[4])
+	if version != 1 && version != 2 {
+		return nil, fmt.Errorf("unsupported reftable version %d", version)
+	}
+	t := &reftableFile{name: name, f: f, size: fi.Size(), headerSize: reftableHeaderSize(version)}
+	footerSize := int64(reftableFooterSize(version))
+	if t.size < int64(t.headerSize)+footerSize {
+		return nil, errReftableCorrupt
+	}
+	header = header[:t.headerSize]
+	t.blockSize = uint24(header[5:])
+	t.minIndex = binary.BigEndian.Uint64(header[8:])
+	t.maxIndex = binary.BigEndian.Uint64(header[16:])
+	hashID := reftableHashIDs["sha1"]
+	if version == 2 {
+		hashID = binary.BigEndian.Uint32(header[24:])
+	}
+	if hashID != reftableHashIDs[hashAlgo.name] {
+		return nil, fmt.Errorf("reftable hash does not match the repository's object format")
+	}
+
+	t.end = t.size - footerSize
+	footer := make([]byte, footerSize)
+	if _, err := f.ReadAt(footer, t.end); err != nil {
+		return nil, err
+	}
+	crc := binary.BigEndian.Uint32(footer[len(footer)-4:])
+	if !bytes.Equal(footer[:t.headerSize], header) || crc32.ChecksumIEEE(footer[:len(footer)-4]) != crc {
+		return nil, fmt.Errorf("%w: bad footer", errReftableCorrupt)
+	}
+	positions := footer[t.headerSize:]
+	t.refIndexPos = int64(binary.BigEndian.Uint64(positions[0:]))
+	t.logPos = int64(binary.BigEndian.Uint64(positions[24:]))
+	t.logIndexPos = int64(binary.BigEndian.Uint64(positions[32:]))
+
+	if t.end > int64(t.headerSize) {
+		b := make([]byte, 1)
+		if _, err := f.ReadAt(b, int64(t.headerSize)); err != nil {
+			return nil, err
+		}
+		t.firstType = b[0]
+	}
+	return t, nil
+}
+
+// readBlock reads and decodes the block at off.
+func (t *reftableFile) readBlock(off int64) (*reftableBlock, error) {
+	typeOffset := off
+	if off == 0 {
+		typeOffset = int64(t.headerSize)
+	}
+	if typeOffset+4 > t.end {
+		return nil, errReftableCorrupt
+	}
+	header := make([]byte, 4)
+	if _, err := t.f.ReadAt(header, typeOffset); err != nil {
+		return nil, err
+	}
+	b := &reftableBlock{typ: header[0]}
+	blockLen := int64(uint24(header[1:]))
+	start := typeOffset - off + 4
+	if blockLen < start+2 || b.typ != reftableLogBlock && off+blockLen > t.end {
+		return nil, errReftableCorrupt
+	}
+
+	data := make([]byte, blockLen)
+	if b.typ == reftableLogBlock {
+		// The block length is the inflated size; the compressed
+		// stream ends wherever zlib says it does.
+		sr := io.NewSectionReader(t.f, typeOffset+4, t.end-typeOffset-4)
+		br := bufio.NewReader(sr)
+		zr, err := zlib.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(zr, data[start:]); err != nil {
+			return nil, err
+		}
+		if n, err := zr.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			return nil, fmt.Errorf("%w: bad log block", errReftableCorrupt)
+		}
+		consumed, _ := sr.Seek(0, io.SeekCurrent)
+		b.next = typeOffset + 4 + consumed - int64(br.Buffered())
+	} else {
+		if _, err := t.f.ReadAt(data[start:], typeOffset+4); err != nil {
+			return nil, err
+		}
+		// Padded blocks are followed by zeros up to the block size.
+		b.next = off + blockLen
+		pad := make([]byte, 1)
+		if b.next < t.end {
+			if _, err := t.f.ReadAt(pad, b.next); err != nil {
+				return nil, err
+			}
+			if pad[0] == 0 {
+				b.next = off + int64(t.blockSize)
+			}
+		}
+	}
+
+	restarts := int64(binary.BigEndian.Uint16(data[blockLen-2:]))
+	recordsEnd := blockLen - 2 - 3*restarts
+	if recordsEnd < start {
+		return nil, errReftableCorrupt
+	}
+	var err error
+	b.records, err = decodeReftableRecords(b.typ, data[:recordsEnd], int(start))
+	return b, err
+}
+
+func decodeReftableRecords(blockType byte, data []byte, pos int) ([]reftableRecord, error) {
+	var records []reftableRecord
+	d := reftableDecoder{b: data, pos: pos}
+	prev := ""
+	for d.pos < len(data) && d.err == nil {
+		// Lengths past the range of int wrap around to negative ones.
+		prefix := int(d.varint())
+		suffix := d.varint()
+		keyLen := int(suffix >> 3)
+		if prefix < 0 || prefix > len(prev) || keyLen < 0 {
+			return nil, errReftableCorrupt
+		}
+		rec := reftableRecord{key: prev[:prefix] + string(d.next(keyLen)), typ: byte(suffix & 7)}
+
+		// Skip over the value to find where it ends.
+		valueStart := d.pos
+		switch blockType {
+		case reftableIndexBlock:
+			d.varint()
+		case reftableRefBlock:
+			d.varint()
+			switch rec.typ {
+			case reftableHash:
+				d.next(hashAlgo.size)
+			case reftablePeeled:
+				d.next(2 * hashAlgo.size)
+			case reftableSymref:
+				d.string()
+			}
+		case reftableLogBlock:
+			if rec.typ == reftableUpdate {
+				d.next(2 * hashAlgo.size)
+				d.string()
+				d.string()
+				d.varint()
+				d.next(2)
+				d.string()
+			}
+		}
+		rec.value = data[valueStart:d.pos]
+		records = append(records, rec)
+		prev = rec.key
+	}
+	return records, d.err
+}
+
+// sectionStart returns the position of the first block of type typ.
+func (t *reftableFile) sectionStart(typ byte) (int64, bool) {
+	switch {
+	case t.firstType == typ:
+		return 0, true
+	case typ == reftableLogBlock && t.logPos > 0:
+		return t.logPos, true
+	}
+	return 0, false
+}
+
+// seekBlock returns the first block of type typ whose last key is not
+// before key, using the section index if there is one.
+func (t *reftableFile) seekBlock(typ byte, key string) (*reftableBlock, error) {
+	indexPos := t.refIndexPos
+	if typ == reftableLogBlock {
+		indexPos = t.logIndexPos
+	}
+
+	if indexPos > 0 {
+		b, err := t.readBlock(indexPos)
+		for err == nil && b.typ == reftableIndexBlock {
+			i := sort.Search(len(b.records), func(i int) bool { return b.records[i].key >= key })
+			if i == len(b.records) {
+				return nil, nil
+			}
+			off, n := readReftableVarint(b.records[i].value)
+			if n == 0 {
+				return nil, errReftableCorrupt
+			}
+			b, err = t.readBlock(int64(off))
+		}
+		if err != nil || b.typ != typ {
+			return nil, errors.Join(errReftableCorrupt, err)
+		}
+		return b, nil
+	}
+
+	off, ok := t.sectionStart(typ)
+	for ok {
+		b, err := t.readBlock(off)
+		if err != nil {
+			return nil, err
+		}
+		if b.typ != typ {
+			break
+		}
+		if len(b.records) > 0 && b.records[len(b.records)-1].key >= key {
+			return b, nil
+		}
+		off, ok = b.next, b.next < t.end
+	}
+	return nil, nil
+}
+
+// scan calls fn for the records of type typ in key order, starting at the
+// first key not before from, until fn returns false.
+func (t *reftableFile) scan(typ byte, from string, fn func(rec reftableRecord) (bool, error)) error {
+	b, err := t.seekBlock(typ, from)
+	for err == nil && b != nil && b.typ == typ {
+		for _, rec := range b.records {
+			if rec.key < from {
+				continue
+			}
+			if more, err := fn(rec); err != nil || !more {
+				return err
+			}
+		}
+		if b.next >= t.end {
+			break
+		}
+		b, err = t.readBlock(b.next)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", t.name, err)
+	}
+	return nil
+}
+
+// lookupRef returns the record for name, if the table has one.
+func (t *reftableFile) lookupRef(name string) (reftableRef, bool, error) {
+	var ref reftableRef
+	found := false
+	err := t.scan(reftableRefBlock, name, func(rec reftableRecord) (bool, error) {
+		if rec.key == name {
+			var err error
+			ref, err = parseReftableRef(rec, t.minIndex)
+			found = err == nil
+			return false, err
+		}
+		return false, nil
+	})
+	return ref, found, err
+}
+
+// allRefs calls fn for every ref record.
+func (t *reftableFile) allRefs(fn func(r reftableRef)) error {
+	return t.scan(reftableRefBlock, "", func(rec reftableRecord) (bool, error) {
+		r, err := parseReftableRef(rec, t.minIndex)
+		if err != nil {
+			return false, err
+		}
+		fn(r)
+		return true, nil
+	})
+}
+
+// logs calls fn for the log records of name, newest first, or of every ref
+// if name is empty.
+func (t *reftableFile) logs(name string, fn func(l reftableLog)) error {
+	from := ""
+	if name != "" {
+		from = name + "\x00"
+	}
+	return t.scan(reftableLogBlock, from, func(rec reftableRecord) (bool, error) {
+		if !strings.HasPrefix(rec.key, from) {
+			return false, nil
+		}
+		l, err := parseReftableLog(rec)
+		if err != nil {
+			return false, err
+		}
+		fn(l)
+		return true, nil
+	})
+}
@@ -0,0 +1,260 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Transaction states.
+const (
+	refTransactionOpen = iota
+	refTransactionPrepared
+	refTransactionClosed
+)
+
+// refTransaction applies a set of ref updates all at once. Updates are
+// queued while the transaction is open; prepare locks the refs and checks
+// their old values, commit applies the updates and abort gives up. Each
+// step is reported to the reference-transaction hook, which can veto the
+// transaction when it is prepared.
+type refTransaction struct {
+	changes []refChange
+	state   int
+	cfg     *config
+	lock    refLock
+}
+
+func newRefTransaction() *refTransaction {
+	return &refTransaction{}
+}
+
+// update queues pointing name, or the ref it symbolically refers to, at
+// hash.
+func (tx *refTransaction) update(name string, hash objectID, message string) {
+	tx.changes = append(tx.changes, refChange{name: name, value: refValue{hash: hash}, message: message})
+}
+
+// updateFrom is like update, but the transaction fails unless the ref is
+// still at old, or does not exist if old is zero.
+func (tx *refTransaction) updateFrom(name string, old, hash objectID, message string) {
+	tx.changes = append(tx.changes, refChange{
+		name: name, value: refValue{hash: hash}, old: old, verifyOld: true, message: message,
+	})
+}
+
+// symref queues making name a symbolic ref to target. With a message, the
+// move to the commit target is at is recorded in name's reflog.
+func (tx *refTransaction) symref(name, target, message string) {
+	tx.changes = append(tx.changes, refChange{name: name, value: refValue{symref: target}, message: message})
+}
+
+// detach queues pointing name itself at hash, replacing it if it is a
+// symbolic ref rather than updating the ref it refers to.
+func (tx *refTransaction) detach(name string, hash objectID, message string) {
+	tx.changes = append(tx.changes, refChange{name: name, value: refValue{hash: hash}, noDeref: true, message: message})
+}
+
+// setReflog queues replacing the reflog of name with entries, oldest
+// first, and pointing name at the newest entry.
+func (tx *refTransaction) setReflog(name string, entries []reflogEntry) {
+	tx.changes = append(tx.changes, refChange{
+		name: name, value: refValue{hash: entries[len(entries)-1].new}, reflog: entries,
+	})
+}
+
+// delete queues removing name along with its reflog.
+func (tx *refTransaction) delete(name string) {
+	tx.changes = append(tx.changes, refChange{name: name, delete: true})
+}
+
+// prepare resolves the queued updates, locks the refs and verifies their
+// old values. Updates through a symbolic ref update the ref it points to
+// and are logged in both reflogs; so are updates of the branch HEAD is on.
+func (tx *refTransaction) prepare() error {
+	if tx.state != refTransactionOpen {
+		return fmt.Errorf("ref transaction is not open")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	tx.cfg = cfg
+
+	head, err := symrefTarget("HEAD")
+	if err != nil {
+		return err
+	}
+	var changes []refChange
+	seen, logged := make(map[string]bool), make(map[string]bool)
+	for _, c := range tx.changes {
+		if c.value.symref != "" && c.message != "" {
+			if c.value.hash, err = tx.newValue(c.value.symref); err != nil {
+				return err
+			}
+		}
+		if !c.delete && c.value.symref == "" && !c.noDeref {
+			target, err := symrefTarget(c.name)
+			if err != nil {
+				return err
+			}
+			if target != c.name {
+				changes = append(changes, refChange{name: c.name, value: c.value, logOnly: true, message: c.message})
+				logged[c.name] = true
+				c.name = target
+			}
+			if c.name == head && head != "HEAD" && !logged["HEAD"] {
+				changes = append(changes, refChange{name: "HEAD", value: c.value, logOnly: true, message: c.message})
+				logged["HEAD"] = true
+			}
+		}
+		if seen[c.name] {
+			return fmt.Errorf("multiple updates for ref '%s' not allowed", c.name)
+		}
+		seen[c.name] = true
+		changes = append(changes, c)
+	}
+
+	var names []string
+	for _, c := range changes {
+		if !c.logOnly {
+			names = append(names, c.name)
+		}
+	}
+	store := refStore()
+	if tx.lock, err = store.lock(names); err != nil {
+		return err
+	}
+	if err := tx.check(store, changes); err != nil {
+		tx.lock.release()
+		tx.state = refTransactionClosed
+		return err
+	}
+	tx.changes = changes
+	tx.state = refTransactionPrepared
+
+	if err := tx.runHook("prepared"); err != nil {
+		tx.abort()
+		return fmt.Errorf("in 'prepared' phase, update aborted by the reference-transaction hook")
+	}
+	return nil
+}
+
+// newValue returns what name resolves to once the transaction is done, or
+// zero if it will not exist.
+func (tx *refTransaction) newValue(name string) (objectID, error) {
+	for _, c := range tx.changes {
+		if c.name == name && c.value.symref == "" {
+			return c.value.hash, nil
+		}
+	}
+	hash, err := resolveRef(name)
+	if errors.Is(err, errRefNotFound) {
+		return objectID{}, nil
+	}
+	return hash, err
+}
+
+// check reads the current values of the locked refs, verifying them where
+// asked to, and decides which changes get a reflog entry: those of refs
+// that have a reflog, and of new ones as core.logAllRefUpdates says.
+func (tx *refTransaction) check(store refBackend, changes []refChange) error {
+	for i := range changes {
+		c := &changes[i]
+		old, err := resolveRef(c.name)
+		if err != nil && !errors.Is(err, errRefNotFound) {
+			return err
+		}
+		if c.verifyOld && old != c.old {
+			switch {
+			case c.old == objectID{}:
+				return fmt.Errorf("cannot lock ref '%s': reference already exists", c.name)
+			case old == objectID{}:
+				return fmt.Errorf("cannot lock ref '%s': reference is missing but expected %s", c.name, c.old)
+			}
+			return fmt.Errorf("cannot lock ref '%s': is at %s but expected %s", c.name, old, c.old)
+		}
+		c.old = old
+
+		if c.delete || c.reflog != nil || c.value.symref != "" && c.message == "" {
+			continue
+		}
+		if c.log = store.hasReflog(c.name); !c.log {
+			if c.log, err = shouldLogRef(tx.cfg, c.name); err != nil {
+				return err
+			}
+		}
+		if c.log {
+			c.ident = reflogIdentity(tx.cfg)
+			// Reflog messages are a single line.
+			c.message = strings.Join(strings.Fields(c.message), " ")
+		}
+	}
+	return nil
+}
+
+// commit applies the transaction, preparing it first if needed.
+func (tx *refTransaction) commit() error {
+	if len(tx.changes) == 0 {
+		tx.state = refTransactionClosed
+		return nil
+	}
+	if tx.state == refTransactionOpen {
+		if err := tx.prepare(); err != nil {
+			return err
+		}
+	}
+	if tx.state != refTransactionPrepared {
+		return fmt.Errorf("ref transaction is not prepared")
+	}
+
+	refsMu.Lock()
+	err := tx.lock.commit(tx.changes)
+	refsMu.Unlock()
+	tx.lock.release()
+	tx.state = refTransactionClosed
+	if err != nil {
+		return err
+	}
+	// The hook can no longer change the outcome.
+	tx.runHook("committed")
+	return nil
+}
+
+// abort releases the locks of a prepared transaction without changing
+// any ref.
+func (tx *refTransaction) abort() {
+	if tx.state == refTransactionClosed {
+		return
+	}
+	if tx.state == refTransactionPrepared {
+		tx.lock.release()
+	}
+	tx.state = refTransactionClosed
+	tx.runHook("aborted")
+}
+
+// runHook runs the reference-transaction hook for state with a line
+// "<old> <new> <ref>" for every ref the transaction changes. Deleted refs
+// have a zero new value, symbolic refs show as "ref:<target>".
+func (tx *refTransaction) runHook(state string) error {
+	if tx.cfg == nil {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		tx.cfg = cfg
+	}
+	var b strings.Builder
+	for _, c := range tx.changes {
+		if c.logOnly {
+			continue
+		}
+		new := c.value.hash.String()
+		if c.value.symref != "" {
+			new = "ref:" + c.value.symref
+		}
+		fmt.Fprintf(&b, "%s %s %s\n", c.old, new, c.name)
+	}
+	return runHook(tx.cfg, "reference-transaction", b.String(), state)
+}
@@ -0,0 +1,505 @@
+package mygit
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// remoteNames lists the configured remotes in the order the configuration
+// first mentions them.
+func remoteNames(cfg *config) []string {
+	var names []string
+	for _, e := range cfg.entries {
+		if e.section == "remote" && e.subsection != "" && e.key == "url" && !slices.Contains(names, e.subsection) {
+			names = append(names, e.subsection)
+		}
+	}
+	return names
+}
+
+// remoteState compares the branches of a remote with its remote-tracking
+// refs. Branch names are shown without refs/heads/.
+type remoteState struct {
+	remote *remoteConfig
+	// queried is set once the remote itself was asked for its refs;
+	// otherwise only tracked is known, from the remote-tracking refs.
+	queried bool
+	adv     *refAdvertisement
+	// tracked branches have a remote-tracking ref and newBranches do not
+	// yet. stale are the remote-tracking refs of branches that are gone.
+	tracked     []string
+	newBranches []string
+	stale       []string
+	// head is the branch the remote's HEAD points at.
+	head string
+}
+
+// matchDst reports whether name matches the destination side of the
+// refspec and returns the source it comes from.
+func (r refspec) matchDst(name string) (string, bool) {
+	if r.dst == "" {
+		return "", false
+	}
+	return refspec{src: r.dst, dst: r.src}.match(name)
+}
+
+// loadRemoteState works out the state of the remote's branches, asking
+// the remote for its refs if query is set.
+func loadRemoteState(cfg *config, name string, query bool) (*remoteState, error) {
+	if _, ok := cfg.get("remote." + name + ".url"); !ok {
+		return nil, fmt.Errorf("No such remote '%s'", name)
+	}
+	remote, err := lookupRemote(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	values, err := refStore().refs()
+	if err != nil {
+		return nil, err
+	}
+	// Remote-tracking refs by the remote ref they track. Symbolic refs,
+	// such as the remote's HEAD, track nothing.
+	tracking := make(map[string]string)
+	for ref, value := range values {
+		if value.symref != "" {
+			continue
+		}
+		for _, spec := range remote.refspecs {
+			if src, ok := spec.matchDst(ref); ok {
+				tracking[src] = ref
+				break
+			}
+		}
+	}
+
+	s := &remoteState{remote: remote, queried: query}
+	if !query {
+		for src := range tracking {
+			s.tracked = append(s.tracked, strings.TrimPrefix(src, "refs/heads/"))
+		}
+		sort.Strings(s.tracked)
+		return s, nil
+	}
+
+	t, adv, err := openUploadPack(cfg, remote.url, []string{"HEAD", "refs/heads/"})
+	if err != nil {
+		return nil, err
+	}
+	if t != nil {
+		t.close()
+	}
+	s.adv = adv
+	if head, _, ok := remoteHead(adv); ok {
+		s.head = strings.TrimPrefix(head, "refs/heads/")
+	}
+	onRemote := make(map[string]bool)
+	for _, ref := range adv.refs {
+		if !strings.HasPrefix(ref.name, "refs/heads/") {
+			continue
+		}
+		onRemote[ref.name] = true
+		for _, spec := range remote.refspecs {
+			dst, ok := spec.match(ref.name)
+			if !ok || dst == "" {
+				continue
+			}
+			branch := strings.TrimPrefix(ref.name, "refs/heads/")
+			if _, ok := values[dst]; ok {
+				s.tracked = append(s.tracked, branch)
+			} else {
+				s.newBranches = append(s.newBranches, branch)
+			}
+			break
+		}
+	}
+	for src, ref := range tracking {
+		if !onRemote[src] {
+			s.stale = append(s.stale, ref)
+		}
+	}
+	sort.Strings(s.stale)
+	return s, nil
+}
+
+// pullBranch is a local branch that pulls from a remote.
+type pullBranch struct {
+	name   string
+	merges []string
+	rebase string
+}
+
+// remotePullBranches lists the local branches whose branch.<name>.remote
+// is the remote, by name.
+func remotePullBranches(cfg *config, remote string) []pullBranch {
+	var branches []pullBranch
+	for _, e := range cfg.entries {
+		if e.section != "branch" || e.key != "remote" || e.value != remote {
+			continue
+		}
+		if slices.ContainsFunc(branches, func(b pullBranch) bool { return b.name == e.subsection }) {
+			continue
+		}
+		b := pullBranch{name: e.subsection}
+		for _, merge := range cfg.getAll("branch." + b.name + ".merge") {
+			b.merges = append(b.merges, strings.TrimPrefix(merge, "refs/heads/"))
+		}
+		if len(b.merges) == 0 {
+			continue
+		}
+		b.rebase, _ = cfg.get("branch." + b.name + ".rebase")
+		branches = append(branches, b)
+	}
+	sort.Slice(branches, func(i, j int) bool { return branches[i].name < branches[j].name })
+	return branches
+}
+
+// pushInfo is what a push to a remote would do with one local ref.
+type pushInfo struct {
+	src, dst string
+	forced   bool
+	// status is empty when the remote was not queried.
+	status string
+}
+
+// remotePushInfo works out what pushing to the remote would do, following
+// its remote.<name>.push refspecs or else pushing the branches the remote
+// also has.
+func remotePushInfo(cfg *config, s *remoteState) ([]pushInfo, error) {
+	var specs []refspec
+	for _, value := range cfg.getAll("remote." + s.remote.name + ".push") {
+		spec, err := parseRefspec(value)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	if !s.queried {
+		if len(specs) == 0 {
+			return []pushInfo{{src: "(matching)", dst: "(matching)"}}, nil
+		}
+		var infos []pushInfo
+		for _, spec := range specs {
+			info := pushInfo{src: spec.src, dst: spec.dst, forced: spec.force}
+			switch {
+			case spec.src == "" && spec.dst == "":
+				info.src = "(matching)"
+			case spec.src == "":
+				info.src = "(delete)"
+			}
+			if info.dst == "" {
+				info.dst = info.src
+			}
+			infos = append(infos, info)
+		}
+		return infos, nil
+	}
+
+	local, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+	remoteRefs := make(map[string]objectID)
+	for _, ref := range s.adv.refs {
+		remoteRefs[ref.name] = ref.hash
+	}
+	type pushPair struct {
+		src, dst string
+		forced   bool
+	}
+	var pairs []pushPair
+	if len(specs) == 0 {
+		for _, ref := range s.adv.refs {
+			if _, ok := local[ref.name]; ok && strings.HasPrefix(ref.name, "refs/heads/") {
+				pairs = append(pairs, pushPair{ref.name, ref.name, false})
+			}
+		}
+	}
+	for _, spec := range specs {
+		if !strings.Contains(spec.src, "*") {
+			src := expandRefName(spec.src)
+			if spec.src == "" {
+				src = ""
+			}
+			dst := spec.dst
+			if dst == "" {
+				dst = src
+			}
+			pairs = append(pairs, pushPair{src, expandRefName(dst), spec.force})
+			continue
+		}
+		for name := range local {
+			if dst, ok := spec.match(name); ok {
+				pairs = append(pairs, pushPair{name, dst, spec.force})
+			}
+		}
+	}
+	sort.SliceStable(pairs, func(i, j int) bool { return pairs[i].src < pairs[j].src })
+
+	var infos []pushInfo
+	for _, p := range pairs {
+		info := pushInfo{
+			src:    strings.TrimPrefix(p.src, "refs/heads/"),
+			dst:    strings.TrimPrefix(p.dst, "refs/heads/"),
+			forced: p.forced,
+		}
+		old, exists := remoteRefs[p.dst]
+		hash, ok := local[p.src]
+		switch {
+		case p.src == "" || !ok:
+			info.src, info.status = "(none)", "delete"
+		case old == hash:
+			info.status = "up to date"
+		case !exists:
+			info.status = "create"
+		default:
+			info.status = "local out of date"
+			if hasObject(old) {
+				if ff, err := isAncestor(old, hash); err != nil {
+					return nil, err
+				} else if ff {
+					info.status = "fast-forwardable"
+				}
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// pickPlural picks the singular or plural heading for n items.
+func pickPlural(n int, one, many string) string {
+	if n == 1 {
+		return one
+	}
+	return many
+}
+
+// showRemote prints what remote show tells about the remote name.
+func showRemote(cfg *config, name string, query bool) error {
+	s, err := loadRemoteState(cfg, name, query)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("* remote %s\n", name)
+	fmt.Printf("  Fetch URL: %s\n", s.remote.url)
+	fmt.Printf("  Push  URL: %s\n", s.remote.pushURL)
+	switch {
+	case !query:
+		fmt.Println("  HEAD branch: (not queried)")
+	case s.head == "":
+		fmt.Println("  HEAD branch: (unknown)")
+	default:
+		fmt.Printf("  HEAD branch: %s\n", s.head)
+	}
+
+	type branchItem struct{ name, state string }
+	var items []branchItem
+	for _, b := range s.tracked {
+		items = append(items, branchItem{b, "tracked"})
+	}
+	for _, b := range s.newBranches {
+		items = append(items, branchItem{b, "new (next fetch will store in remotes/" + name + ")"})
+	}
+	for _, ref := range s.stale {
+		items = append(items, branchItem{ref, "stale (use 'git remote prune' to remove)"})
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].name < items[j].name })
+	if len(items) > 0 {
+		heading := pickPlural(len(items), "Remote branch:", "Remote branches:")
+		if !query {
+			heading += " (status not queried)"
+		}
+		fmt.Printf("  %s\n", heading)
+		width := 0
+		for _, item := range items {
+			width = max(width, len(item.name))
+		}
+		for _, item := range items {
+			if query {
+				fmt.Printf("    %-*s %s\n", width, item.name, item.state)
+			} else {
+				fmt.Printf("    %s\n", item.name)
+			}
+		}
+	}
+
+	pulls := remotePullBranches(cfg, name)
+	if len(pulls) > 0 {
+		fmt.Printf("  %s configured for 'git pull':\n", pickPlural(len(pulls), "Local branch", "Local branches"))
+		width, anyRebase := 0, false
+		for _, b := range pulls {
+			width = max(width, len(b.name))
+			anyRebase = anyRebase || b.rebase != "" && b.rebase != "false"
+		}
+		for _, b := range pulls {
+			fmt.Printf("    %-*s ", width, b.name)
+			also := "   and with remote"
+			switch {
+			case b.rebase == "interactive" || b.rebase == "i":
+				fmt.Printf("rebases interactively onto remote %s\n", b.merges[0])
+				continue
+			case b.rebase == "merges" || b.rebase == "m":
+				fmt.Printf("rebases interactively (with merges) onto remote %s\n", b.merges[0])
+				continue
+			case b.rebase != "" && b.rebase != "false":
+				fmt.Printf("rebases onto remote %s\n", b.merges[0])
+				continue
+			case anyRebase:
+				fmt.Printf(" merges with remote %s\n", b.merges[0])
+				also = "    and with remote"
+			default:
+				fmt.Printf("merges with remote %s\n", b.merges[0])
+			}
+			for _, merge := range b.merges[1:] {
+				fmt.Printf("    %-*s %s %s\n", width, "", also, merge)
+			}
+		}
+	}
+
+	pushes, err := remotePushInfo(cfg, s)
+	if err != nil {
+		return err
+	}
+	if len(pushes) > 0 {
+		heading := pickPlural(len(pushes), "Local ref", "Local refs") + " configured for 'git push'"
+		if !query {
+			heading += " (status not queried)"
+		}
+		fmt.Printf("  %s:\n", heading)
+		width, width2 := 0, 0
+		for _, p := range pushes {
+			width, width2 = max(width, len(p.src)), max(width2, len(p.dst))
+		}
+		for _, p := range pushes {
+			verb := "pushes to"
+			if p.forced {
+				verb = "forces to"
+			}
+			if p.status == "" {
+				fmt.Printf("    %-*s %s %s\n", width, p.src, verb, p.dst)
+			} else {
+				fmt.Printf("    %-*s %s %-*s (%s)\n", width, p.src, verb, width2, p.dst, p.status)
+			}
+		}
+	}
+	return nil
+}
+
+// pruneRemote deletes the remote-tracking refs of the remote's branches
+// that are gone, only telling which if dryRun is set.
+func pruneRemote(cfg *config, name string, dryRun bool) error {
+	s, err := loadRemoteState(cfg, name, true)
+	if err != nil {
+		return err
+	}
+	if len(s.stale) == 0 {
+		return nil
+	}
+	fmt.Printf("Pruning %s\n", name)
+	fmt.Printf("URL: %s\n", s.remote.url)
+	if !dryRun {
+		tx := newRefTransaction()
+		for _, ref := range s.stale {
+			tx.delete(ref)
+		}
+		if err := tx.commit(); err != nil {
+			return err
+		}
+	}
+	for _, ref := range s.stale {
+		if dryRun {
+			fmt.Printf(" * [would prune] %s\n", strings.TrimPrefix(ref, "refs/remotes/"))
+		} else {
+			fmt.Printf(" * [pruned] %s\n", strings.TrimPrefix(ref, "refs/remotes/"))
+		}
+	}
+
+	// Symbolic refs left pointing at a pruned ref are called out.
+	values, err := refStore().refs()
+	if err != nil {
+		return err
+	}
+	var dangling []string
+	for ref, value := range values {
+		if value.symref != "" && slices.Contains(s.stale, value.symref) {
+			dangling = append(dangling, ref)
+		}
+	}
+	sort.Strings(dangling)
+	for _, ref := range dangling {
+		if dryRun {
+			fmt.Printf(" %s will become dangling!\n", ref)
+		} else {
+			fmt.Printf(" %s has become dangling!\n", ref)
+		}
+	}
+	return nil
+}
+
+func runRemote(args []string) error {
+	verbose := false
+	if len(args) > 0 && (args[0] == "-v" || args[0] == "--verbose") {
+		verbose, args = true, args[1:]
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		for _, name := range remoteNames(cfg) {
+			if !verbose {
+				fmt.Println(name)
+				continue
+			}
+			remote, err := lookupRemote(cfg, name)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("%s\t%s (fetch)\n%s\t%s (push)\n", name, remote.url, name, remote.pushURL)
+		}
+		return nil
+	}
+
+	subcommand, query, dryRun := args[0], true, false
+	var names []string
+	for _, arg := range args[1:] {
+		switch {
+		case arg == "-n" && subcommand == "show":
+			query = false
+		case (arg == "-n" || arg == "--dry-run") && subcommand == "prune":
+			dryRun = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+	switch subcommand {
+	case "show":
+		// Without a name, show just lists the remotes.
+		if len(names) == 0 {
+			for _, name := range remoteNames(cfg) {
+				fmt.Println(name)
+			}
+		}
+		for _, name := range names {
+			if err := showRemote(cfg, name, query); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "prune":
+		if len(names) == 0 {
+			return fmt.Errorf("usage: mygit remote prune [-n | --dry-run] <name>...")
+		}
+		for _, name := range names {
+			if err := pruneRemote(cfg, name, dryRun); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown subcommand: %s", subcommand)
+}
@@ -0,0 +1,178 @@
+package mygit
+
+import (
+	"path"
+	"sort"
+)
+
+const (
+	// defaultRenameScore is the similarity, in percent, a deleted and an
+	// added file need to be paired up as a rename.
+	defaultRenameScore = 50
+	// renameChunkSize bounds the pieces files are cut into to be compared.
+	renameChunkSize = 64
+)
+
+// renamePair is a file found to be renamed or copied from another.
+type renamePair struct {
+	from, to string
+	old, new diffEntry
+	score    int
+	copied   bool
+}
+
+// similarityChunks counts the bytes of each line of data, long lines cut
+// into pieces, ignoring carriage returns before newlines.
+func similarityChunks(data []byte) map[string]int {
+	chunks := make(map[string]int)
+	start := 0
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\n' && i-start+1 < renameChunkSize && i+1 < len(data) {
+			continue
+		}
+		chunk := data[start : i+1]
+		if n := len(chunk); n > 1 && chunk[n-1] == '\n' && chunk[n-2] == '\r' {
+			chunk = append(chunk[:n-2:n-2], '\n')
+		}
+		chunks[string(chunk)] += len(chunk)
+		start = i + 1
+	}
+	return chunks
+}
+
+// similarity estimates, in percent, how much of the larger of two
+// contents is found in the other.
+func similarity(src, dst []byte, srcChunks map[string]int, minScore int) int {
+	size, delta := max(len(src), len(dst)), len(dst)-len(src)
+	if delta < 0 {
+		delta = -delta
+	}
+	// Files whose sizes are too far apart cannot reach the score.
+	if size == 0 || size*(100-minScore) < delta*100 {
+		return 0
+	}
+	copied := 0
+	for chunk, n := range similarityChunks(dst) {
+		copied += min(n, srcChunks[chunk])
+	}
+	return copied * 100 / size
+}
+
+// detectRenames pairs up the deleted and added files of pairs whose
+// contents are alike, identical ones first. With copies set, added files
+// can also be copies of modified ones, or of a renamed file's source.
+// The remaining pairs are returned with the renames.
+func detectRenames(pairs []diffPair, copies bool, minScore int) ([]diffPair, []renamePair, error) {
+	var deleted, added, sources []int
+	for i, p := range pairs {
+		switch {
+		case p.unmerged || p.old.mode == modeGitlink || p.new.mode == modeGitlink:
+		case p.new.mode == 0:
+			deleted = append(deleted, i)
+		case p.old.mode == 0:
+			added = append(added, i)
+		case copies && p.old.mode&modeTypeMask == p.new.mode&modeTypeMask:
+			sources = append(sources, i)
+		}
+	}
+	if len(added) == 0 || len(deleted) == 0 && len(sources) == 0 {
+		return pairs, nil, nil
+	}
+
+	var renames []renamePair
+	used := make(map[int]bool)
+	taken := make(map[int]bool)
+	pair := func(src, dst, score int) {
+		s, d := pairs[src], pairs[dst]
+		renames = append(renames, renamePair{from: s.path, to: d.path, old: s.old, new: d.new, score: score, copied: s.new.mode != 0})
+		used[src], taken[dst] = true, true
+	}
+
+	// Identical contents go first, a source with the same name winning.
+	for _, dst := range added {
+		if pairs[dst].new.mode&modeTypeMask != modeRegular&modeTypeMask && pairs[dst].new.mode != modeSymlink {
+			continue
+		}
+		best := -1
+		for _, src := range deleted {
+			if used[src] || pairs[src].old.hash != pairs[dst].new.hash {
+				continue
+			}
+			if best < 0 || path.Base(pairs[src].path) == path.Base(pairs[dst].path) {
+				best = src
+			}
+		}
+		if best >= 0 {
+			pair(best, dst, 100)
+		}
+	}
+
+	// Then the most similar pairs, each source renamed at most once.
+	type candidate struct{ src, dst, score int }
+	var candidates []candidate
+	contents := make(map[objectID][]byte)
+	read := func(hash objectID) ([]byte, error) {
+		if data, ok := contents[hash]; ok {
+			return data, nil
+		}
+		_, data, err := readObject(hash)
+		contents[hash] = data
+		return data, err
+	}
+	srcs := deleted
+	if copies {
+		srcs = append(append([]int(nil), deleted...), sources...)
+	}
+	for _, src := range srcs {
+		if used[src] && !copies || pairs[src].old.mode&modeTypeMask != modeRegular&modeTypeMask {
+			continue
+		}
+		srcData, err := read(pairs[src].old.hash)
+		if err != nil {
+			return nil, nil, err
+		}
+		srcChunks := similarityChunks(srcData)
+		for _, dst := range added {
+			if taken[dst] || pairs[dst].new.mode&modeTypeMask != modeRegular&modeTypeMask {
+				continue
+			}
+			dstData, err := read(pairs[dst].new.hash)
+			if err != nil {
+				return nil, nil, err
+			}
+			if score := similarity(srcData, dstData, srcChunks, minScore); score >= minScore {
+				candidates = append(candidates, candidate{src, dst, score})
+			}
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].score > candidates[j].score })
+	for _, c := range candidates {
+		if taken[c.dst] || used[c.src] && !copies {
+			continue
+		}
+		pair(c.src, c.dst, c.score)
+	}
+
+	// Paired up files are no longer reported as added or deleted.
+	var rest []diffPair
+	for i, p := range pairs {
+		if taken[i] {
+			continue
+		}
+		if used[i] && p.new.mode == 0 {
+			continue
+		}
+		rest = append(rest, p)
+	}
+	// A deleted file paired up more than once is renamed to the last path
+	// and copied to the others.
+	sort.Slice(renames, func(i, j int) bool { return renames[i].to < renames[j].to })
+	renamed := make(map[string]bool)
+	for i := len(renames) - 1; i >= 0; i-- {
+		if renamed[renames[i].from] {
+			renames[i].copied = true
+		}
+		renamed[renames[i].from] = true
+	}
+	return rest, renames, nil
+}
@@ -0,0 +1,156 @@
+package mygit
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// repackLoose packs the loose objects into a new pack, leaving existing
+// packs alone. With remove set the loose objects are deleted afterwards.
+func repackLoose(opts packOptions, remove bool) (packStats, error) {
+	loose, err := listLooseObjects()
+	if err != nil {
+		return packStats{}, err
+	}
+	if len(loose) == 0 {
+		return packStats{}, nil
+	}
+
+	tips, err := refTips()
+	if err != nil {
+		return packStats{}, err
+	}
+	names, err := reachableNames(tips, false)
+	if err != nil {
+		return packStats{}, err
+	}
+	list := make([]namedObject, len(loose))
+	for i, hash := range loose {
+		list[i] = namedObject{hash: hash, name: names[hash]}
+	}
+
+	objects, err := loadPackObjects(list, false)
+	if err != nil {
+		return packStats{}, err
+	}
+	stats := computeDeltas(objects, opts)
+	if _, err := writePackFile(objects); err != nil {
+		return packStats{}, err
+	}
+
+	if remove {
+		if err := prunePacked(loose); err != nil {
+			return packStats{}, err
+		}
+	}
+	return stats, nil
+}
+
+func runRepack(args []string) error {
+	all, remove, writeMidx, noReuse := false, false, false, false
+	writeBitmaps, bitmapsSet := false, false
+	window, depth := -1, -1
+	for _, arg := range args {
+		switch {
+		case arg == "--write-midx":
+			writeMidx = true
+		case arg == "--write-bitmap-index":
+			writeBitmaps, bitmapsSet = true, true
+		case arg == "--no-write-bitmap-index":
+			writeBitmaps, bitmapsSet = false, true
+		case strings.HasPrefix(arg, "--window="), strings.HasPrefix(arg, "--depth="):
+			name, value, _ := strings.Cut(arg, "=")
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid value for %s", name)
+			}
+			if name == "--window" {
+				window = n
+			} else {
+				depth = n
+			}
+		case strings.HasPrefix(arg, "-") && !strings.HasPrefix(arg, "--"):
+			for _, c := range arg[1:] {
+				switch c {
+				case 'a':
+					all = true
+				case 'd':
+					remove = true
+				case 'f':
+					noReuse = true
+				case 'm':
+					writeMidx = true
+				case 'b':
+					writeBitmaps, bitmapsSet = true, true
+				default:
+					return fmt.Errorf("unknown option -%c", c)
+				}
+			}
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	if remove && repoFormat.preciousObjects {
+		return fmt.Errorf("cannot delete packs in a precious-objects repo")
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	opts := packOptions{window: window, depth: depth, reuseDeltas: !noReuse}
+	if opts.window < 0 {
+		if opts.window, err = cfg.getInt("pack.window", defaultPackWindow); err != nil {
+			return err
+		}
+	}
+	if opts.depth < 0 {
+		if opts.depth, err = cfg.getInt("pack.depth", defaultPackDepth); err != nil {
+			return err
+		}
+	}
+
+	// Bitmaps are written by default only in bare repositories, where
+	// they serve clones and fetches.
+	if !bitmapsSet {
+		_, bitmapsSet = cfg.get("repack.writeBitmaps")
+		if writeBitmaps, err = cfg.getBool("repack.writeBitmaps", false); err != nil {
+			return err
+		}
+	}
+	if !bitmapsSet {
+		if writeBitmaps, err = cfg.getBool("core.bare", false); err != nil {
+			return err
+		}
+	}
+	if writeBitmaps && !all {
+		if !writeMidx && bitmapsSet {
+			return fmt.Errorf("Incremental repacks are incompatible with bitmap indexes.  Use\n" +
+				"--no-write-bitmap-index or disable the pack.writeBitmaps configuration.")
+		}
+		writeBitmaps = false
+	}
+
+	var stats packStats
+	if all {
+		stats, err = repackAll(opts, remove, writeBitmaps)
+	} else {
+		stats, err = repackLoose(opts, remove)
+	}
+	if err != nil {
+		return err
+	}
+	if stats.total == 0 {
+		fmt.Fprintln(os.Stderr, "Nothing new to pack.")
+	} else {
+		writePackSummary(os.Stderr, stats)
+	}
+
+	if writeMidx {
+		return updateMultiPackIndex(remove)
+	}
+	return nil
+}
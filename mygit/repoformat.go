@@ -0,0 +1,132 @@
+package mygit
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// maxRepositoryFormat is the newest core.repositoryFormatVersion understood.
+const maxRepositoryFormat = 1
+
+// repositoryFormat is what core.repositoryFormatVersion and the
+// extensions.* section say about the repository.
+type repositoryFormat struct {
+	version         int
+	objectFormat    *hashAlgorithm
+	refStorage      string
+	worktreeConfig  bool
+	partialClone    string
+	preciousObjects bool
+}
+
+// repoFormat is the format of the current repository, set by
+// loadRepositoryFormat.
+var repoFormat = repositoryFormat{objectFormat: sha1Algorithm, refStorage: "files"}
+
+// Extensions in v0Extensions are honored in any repository; older git
+// versions already knew about them. The others require version 1, where
+// an unknown extension means the repository must not be touched.
+var (
+	v0Extensions = map[string]bool{"noop": true, "preciousobjects": true, "partialclone": true, "worktreeconfig": true}
+	v1Extensions = map[string]bool{"noop-v1": true, "objectformat": true, "refstorage": true}
+)
+
+// loadRepositoryFormat reads and checks the repository's format and sets
+// hashAlgo accordingly. Outside a repository the defaults apply.
+func loadRepositoryFormat() error {
+	entries, _, err := readConfigFile(configFile)
+	if err != nil {
+		return err
+	}
+
+	format := repositoryFormat{objectFormat: sha1Algorithm, refStorage: "files"}
+	extensions := make(map[string]configEntry)
+	for _, e := range entries {
+		switch {
+		case e.matches("core", "", "repositoryformatversion"):
+			if format.version, err = strconv.Atoi(strings.TrimSpace(e.value)); err != nil {
+				return fmt.Errorf("bad numeric config value '%s' for 'core.repositoryformatversion'", e.value)
+			}
+		case e.section == "extensions" && e.subsection == "":
+			extensions[e.key] = e
+		}
+	}
+	if format.version > maxRepositoryFormat {
+		return fmt.Errorf("Expected git repo version <= %d, found %d", maxRepositoryFormat, format.version)
+	}
+
+	var unknown, v1Only []string
+	for key, e := range extensions {
+		switch {
+		case v0Extensions[key]:
+		case v1Extensions[key] && format.version == 0:
+			v1Only = append(v1Only, key)
+			continue
+		case v1Extensions[key]:
+		case format.version == 0:
+			// Version 0 repositories predate extensions, so whatever
+			// is set is meaningless and ignored.
+			continue
+		default:
+			unknown = append(unknown, key)
+			continue
+		}
+		if err := format.set(e); err != nil {
+			return err
+		}
+	}
+	if len(unknown) > 0 {
+		return extensionsError("unknown repository extension", unknown)
+	}
+	if len(v1Only) > 0 {
+		return extensionsError("repo version is 0, but v1-only extension", v1Only)
+	}
+
+	repoFormat = format
+	hashAlgo = format.objectFormat
+	return nil
+}
+
+func extensionsError(what string, names []string) error {
+	sort.Strings(names)
+	if len(names) > 1 {
+		what += "s"
+	}
+	return fmt.Errorf("%s found:\n\t%s", what, strings.Join(names, "\n\t"))
+}
+
+// set applies one known extension.
+func (f *repositoryFormat) set(e configEntry) error {
+	switch e.key {
+	case "objectformat":
+		algo, err := lookupHashAlgorithm(strings.ToLower(e.value))
+		if err != nil {
+			return fmt.Errorf("invalid value for 'extensions.objectformat': '%s'", e.value)
+		}
+		f.objectFormat = algo
+	case "refstorage":
+		if e.value != "files" && e.value != "reftable" {
+			return fmt.Errorf("invalid value for 'extensions.refstorage': '%s'", e.value)
+		}
+		f.refStorage = e.value
+	case "worktreeconfig", "preciousobjects":
+		value := e.value
+		if e.noValue {
+			value = "true"
+		}
+		b, err := parseConfigBool(value)
+		if err != nil {
+			return fmt.Errorf("bad boolean config value '%s' for '%s'", value, e.name())
+		}
+		if e.key == "worktreeconfig" {
+			f.worktreeConfig = b
+		} else {
+			f.preciousObjects = b
+		}
+	case "partialclone":
+		f.partialClone = e.value
+	}
+	return nil
+}
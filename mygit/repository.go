@@ -0,0 +1,152 @@
+package mygit
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ObjectID names an object by its hash. SHA-1 repositories only use the
+// first 20 bytes and leave the rest zero, so IDs can be compared and used
+// as map keys whatever the object format.
+type ObjectID objectID
+
+// ParseObjectID parses the full hex name of an object in the object
+// format of the opened repository.
+func ParseObjectID(s string) (ObjectID, error) {
+	hash, err := parseHash(s)
+	return ObjectID(hash), err
+}
+
+func (id ObjectID) String() string {
+	return objectID(id).String()
+}
+
+// ObjectInfo describes an object without its content.
+type ObjectInfo struct {
+	// Type is "blob", "tree", "commit" or "tag".
+	Type string
+	// Size is the size of the content.
+	Size int64
+}
+
+// Config is the configuration of a repository, with the values of the
+// system, global and repository files and the command line.
+type Config struct {
+	c *config
+}
+
+// Get returns the last value set for a variable such as "core.bare".
+func (c *Config) Get(name string) (string, bool) {
+	return c.c.get(name)
+}
+
+// GetAll returns every value set for a variable, in order of precedence.
+func (c *Config) GetAll(name string) []string {
+	return c.c.getAll(name)
+}
+
+// Bool returns a variable as a boolean, or def if it is not set.
+func (c *Config) Bool(name string, def bool) (bool, error) {
+	return c.c.getBool(name, def)
+}
+
+// Int returns a variable as an integer with an optional k, m or g
+// suffix, or def if it is not set.
+func (c *Config) Int(name string, def int) (int, error) {
+	return c.c.getInt(name, def)
+}
+
+// Repository reads the repository in the working directory for any number
+// of goroutines at once, so that a server can answer many requests from
+// one opened repository; all its methods are safe for concurrent use.
+// Packs are shared, and a pack retired by Reload or by a new pack stays
+// open until the reads using it are done. Refs are read under the lock
+// ref transactions of the process commit with, so no read sees one half
+// done. The configuration is read once and shared until Reload.
+//
+// The paths of the repository are those of the process, so there is one
+// Repository per process.
+type Repository struct {
+	mu  sync.RWMutex
+	cfg *Config
+}
+
+// OpenRepository opens the repository in the working directory.
+func OpenRepository() (*Repository, error) {
+	if err := setupGitDir(); err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(gitDir); err != nil || !fi.IsDir() {
+		return nil, fmt.Errorf("not a git repository: %s", gitDir)
+	}
+	if err := loadRepositoryFormat(); err != nil {
+		return nil, err
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &Repository{cfg: &Config{cfg}}, nil
+}
+
+// Config returns the configuration read last.
+func (r *Repository) Config() *Config {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cfg
+}
+
+// Reload rereads the configuration and rescans the packs, to see what
+// other processes changed since the repository was opened.
+func (r *Repository) Reload() error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	reloadPacks()
+	r.mu.Lock()
+	r.cfg = &Config{cfg}
+	r.mu.Unlock()
+	return nil
+}
+
+// HasObject tells whether the object is in the repository.
+func (r *Repository) HasObject(id ObjectID) bool {
+	return hasObject(objectID(id))
+}
+
+// ReadObject returns the type and content of an object.
+func (r *Repository) ReadObject(id ObjectID) (string, []byte, error) {
+	return readObject(objectID(id))
+}
+
+// StatObject returns the type and size of an object without reading its
+// content.
+func (r *Repository) StatObject(id ObjectID) (ObjectInfo, error) {
+	info, err := statObject(objectID(id))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Type: info.objType, Size: info.size}, nil
+}
+
+// ResolveRef returns the object a ref such as "HEAD" or "refs/heads/main"
+// points at, following symbolic refs.
+func (r *Repository) ResolveRef(name string) (ObjectID, error) {
+	hash, err := resolveRef(name)
+	return ObjectID(hash), err
+}
+
+// Refs returns every ref under refs/ with the object it points at.
+func (r *Repository) Refs() (map[string]ObjectID, error) {
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+	ids := make(map[string]ObjectID, len(refs))
+	for name, hash := range refs {
+		ids[name] = ObjectID(hash)
+	}
+	return ids, nil
+}
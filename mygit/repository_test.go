@@ -0,0 +1,126 @@
+package mygit
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// TestRepositoryConcurrentReads reads objects and refs from many
+// goroutines while another one updates refs, repacks and reloads. Run it
+// with -race.
+func TestRepositoryConcurrentReads(t *testing.T) {
+	chdirRepo(t)
+	var ids []objectID
+	var parent objectID
+	for i := 0; i < 20; i++ {
+		blob, err := storeObject(blobObject, []byte(fmt.Sprintf("content %d\n", i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tree, err := writeFilesTree(map[string]diffEntry{
+			fmt.Sprintf("d/e/f%d.txt", i): {mode: 0100644, hash: blob},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		content := fmt.Sprintf("tree %s\n", tree)
+		if i > 0 {
+			content += fmt.Sprintf("parent %s\n", parent)
+		}
+		content += "author A <a@example.com> 0 +0000\ncommitter A <a@example.com> 0 +0000\n\ncommit\n"
+		if parent, err = storeObject(commitObject, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, blob, tree, parent)
+	}
+	tx := newRefTransaction()
+	tx.update("refs/heads/main", parent, "")
+	if err := tx.commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRepack([]string{"-a", "-d"}); err != nil {
+		t.Fatal(err)
+	}
+	// Reads go to the packs, which the repacks below replace.
+	if loose, err := listLooseObjects(); err != nil || len(loose) > 0 {
+		t.Fatalf("loose objects left after repacking: %v %v", loose, err)
+	}
+
+	repo, err := OpenRepository()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for round := 0; round < 20; round++ {
+				for _, hash := range ids {
+					id := ObjectID(hash)
+					objType, content, err := repo.ReadObject(id)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if hashObjectData(objType, content) != hash {
+						errs <- fmt.Errorf("%s read back corrupt", id)
+						return
+					}
+					info, err := repo.StatObject(id)
+					if err != nil {
+						errs <- err
+						return
+					}
+					if info.Type != objType || info.Size != int64(len(content)) {
+						errs <- fmt.Errorf("%s: stat says %s of %d bytes, read %s of %d", id, info.Type, info.Size, objType, len(content))
+						return
+					}
+				}
+				refs, err := repo.Refs()
+				if err != nil {
+					errs <- err
+					return
+				}
+				if _, ok := refs["refs/heads/main"]; !ok {
+					errs <- fmt.Errorf("refs/heads/main is missing from %v", refs)
+					return
+				}
+				if _, err := repo.ResolveRef("HEAD"); err != nil {
+					errs <- err
+					return
+				}
+				repo.Config().Get("core.bare")
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			tx := newRefTransaction()
+			tx.update(fmt.Sprintf("refs/heads/b%d", i), ids[3*i+2], "")
+			if err := tx.commit(); err != nil {
+				errs <- err
+				return
+			}
+			if i%3 == 0 {
+				if err := runRepack([]string{"-a", "-d"}); err != nil {
+					errs <- err
+					return
+				}
+			}
+			if err := repo.Reload(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,190 @@
+package mygit
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// restoreIndex sets the index entries of paths to files, a zero entry
+// removing the path. The entries get no stat data, as the working tree is
+// left alone.
+func restoreIndex(entries []indexEntry, files map[string]diffEntry) ([]indexEntry, error) {
+	var result []indexEntry
+	kept := make(map[string]bool)
+	for _, e := range entries {
+		if file, ok := files[e.path]; !ok {
+			result = append(result, e)
+		} else if e.stage() == 0 && sameFile(file, diffEntry{mode: e.mode, hash: e.hash}) {
+			// Unchanged entries keep their stat data.
+			result = append(result, e)
+			kept[e.path] = true
+		}
+	}
+	for path, file := range files {
+		if kept[path] {
+			continue
+		}
+		if file.data != nil {
+			if _, err := storeObject(blobObject, file.data); err != nil {
+				return nil, err
+			}
+		}
+		if file.mode != 0 {
+			result = append(result, indexEntry{path: path, mode: file.mode, hash: file.hash})
+		}
+	}
+	return result, nil
+}
+
+// restoreWorktree writes files to the working tree, a zero entry removing
+// the path, and leaves the index as it is.
+func restoreWorktree(cfg *config, entries []indexEntry, files map[string]diffEntry) ([]indexEntry, error) {
+	indexed, unmerged := indexFiles(entries)
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return nil, err
+	}
+	updates := make(map[string]pathUpdate)
+	for path, file := range files {
+		if w, ok := work[path]; !unmerged[path] && (ok && sameFile(w, file) || !ok && file.mode == 0) {
+			continue
+		}
+		if staged := indexed[path]; sameFile(staged, file) {
+			updates[path] = pathUpdate{file: file}
+		} else {
+			updates[path] = pathUpdate{file: file, unstaged: true, staged: staged}
+		}
+	}
+	return applyUpdates(entries, updates)
+}
+
+func runRestore(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var source string
+	var paths []string
+	staged, worktree, patch := false, false, false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case arg == "-s" || arg == "--source":
+			if i+1 == len(args) {
+				return fmt.Errorf("option 'source' requires a value")
+			}
+			i++
+			source = args[i]
+		case strings.HasPrefix(arg, "--source="):
+			source = strings.TrimPrefix(arg, "--source=")
+		case arg == "-S" || arg == "--staged":
+			staged = true
+		case arg == "-W" || arg == "--worktree":
+			worktree = true
+		case arg == "-p" || arg == "--patch":
+			patch = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 && !patch {
+		return fmt.Errorf("you must specify path(s) to restore")
+	}
+	if !staged {
+		worktree = true
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	indexed, unmerged := indexFiles(entries)
+
+	// The index is restored from HEAD and the working tree from the index
+	// unless a source is given.
+	var files map[string]diffEntry
+	switch {
+	case source != "":
+		files, err = revisionFiles(source)
+	case staged:
+		files, err = headFiles()
+	default:
+		files = indexed
+	}
+	if err != nil {
+		return err
+	}
+
+	if patch {
+		var results map[string]diffEntry
+		switch {
+		case source != "" || staged && worktree:
+			return fmt.Errorf("--patch is only supported for the index or the working tree alone, from their default source")
+		case staged:
+			if results, err = runPatchMode(cfg, patchModeUnstage, diffFiles(files, indexed, unmerged, paths)); err != nil {
+				return err
+			}
+			entries, err = restoreIndex(entries, results)
+		default:
+			var work map[string]diffEntry
+			if work, err = worktreeFiles(cfg, entries); err != nil {
+				return err
+			}
+			if results, err = runPatchMode(cfg, patchModeDiscard, diffFiles(indexed, work, unmerged, paths)); err != nil {
+				return err
+			}
+			entries, err = restoreWorktree(cfg, entries, results)
+		}
+		if err != nil {
+			return err
+		}
+		return writeIndex(entries)
+	}
+
+	restored := make(map[string]diffEntry)
+	for _, p := range paths {
+		found := false
+		for path := range files {
+			found = found || matchPathspec(path, []string{p})
+		}
+		found = found || slices.ContainsFunc(entries, func(e indexEntry) bool { return matchPathspec(e.path, []string{p}) })
+		if !found {
+			return fmt.Errorf("pathspec '%s' did not match any file(s) known to git", p)
+		}
+	}
+	for path, file := range files {
+		if matchPathspec(path, paths) {
+			restored[path] = file
+		}
+	}
+	for _, e := range entries {
+		if matchPathspec(e.path, paths) {
+			if worktree && !staged && unmerged[e.path] && source == "" {
+				return fmt.Errorf("path '%s' is unmerged", e.path)
+			}
+			restored[e.path] = files[e.path]
+		}
+	}
+
+	switch {
+	case staged && worktree:
+		updates := make(map[string]pathUpdate)
+		for path, file := range restored {
+			updates[path] = pathUpdate{file: file}
+		}
+		entries, err = applyUpdates(entries, updates)
+	case staged:
+		entries, err = restoreIndex(entries, restored)
+	default:
+		entries, err = restoreWorktree(cfg, entries, restored)
+	}
+	if err != nil {
+		return err
+	}
+	return writeIndex(entries)
+}
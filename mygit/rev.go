@@ -0,0 +1,289 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const minAbbrev = 4
+
+// refSearchOrder lists the places a short ref name is looked up, in git's
+// order of precedence.
+var refSearchOrder = []string{
+	"%s",
+	"refs/%s",
+	"refs/tags/%s",
+	"refs/heads/%s",
+	"refs/remotes/%s",
+	"refs/remotes/%s/HEAD",
+}
+
+// resolveRevision turns a full or abbreviated object name, or a ref name,
+// into an object hash. <rev>:<path> names the object at a path of a
+// revision's tree, and :<path> the blob staged for it. Revisions may end
+// in any number of ~<n>, ^<n> and ^{<type>} suffixes.
+func resolveRevision(name string) (objectID, error) {
+	if hash, err := parseHash(name); err == nil {
+		return hash, nil
+	}
+	if rev, path, ok := strings.Cut(name, ":"); ok {
+		return resolveRevisionPath(rev, path)
+	}
+	if base, op, n, typ, ok := cutRevisionSuffix(name); ok {
+		return resolveRevisionSuffix(name, base, op, n, typ)
+	}
+	if base, n, ok := parseReflogSelector(name); ok {
+		return resolveReflogEntry(base, n)
+	}
+
+	if name != "" && !strings.Contains(name, "..") {
+		for _, pattern := range refSearchOrder {
+			hash, err := resolveRef(fmt.Sprintf(pattern, name))
+			if err == nil {
+				return hash, nil
+			}
+			if !errors.Is(err, errRefNotFound) {
+				return objectID{}, err
+			}
+		}
+	}
+
+	if len(name) >= minAbbrev && isHexString(name) {
+		matches, err := findObjectsByPrefix(name)
+		if err != nil {
+			return objectID{}, err
+		}
+		switch len(matches) {
+		case 0:
+		case 1:
+			return matches[0], nil
+		default:
+			return objectID{}, fmt.Errorf("short object ID %s is ambiguous", name)
+		}
+	}
+
+	return objectID{}, fmt.Errorf("unknown revision %q", name)
+}
+
+// cutRevisionSuffix splits the last suffix off a revision: ~<n> or ^<n>,
+// n being 1 when left out, or ^{<type>}. Ref names cannot hold ~ or ^, so
+// neither can be part of the name.
+func cutRevisionSuffix(name string) (base string, op byte, n int, typ string, ok bool) {
+	if strings.HasSuffix(name, "}") {
+		i := strings.LastIndex(name, "^{")
+		if i <= 0 {
+			return "", 0, 0, "", false
+		}
+		return name[:i], '{', 0, name[i+2 : len(name)-1], true
+	}
+	i := len(name)
+	for i > 0 && '0' <= name[i-1] && name[i-1] <= '9' {
+		i--
+	}
+	if i <= 1 || name[i-1] != '~' && name[i-1] != '^' {
+		return "", 0, 0, "", false
+	}
+	n = 1
+	if i < len(name) {
+		var err error
+		if n, err = strconv.Atoi(name[i:]); err != nil {
+			return "", 0, 0, "", false
+		}
+	}
+	return name[:i-1], name[i-1], n, "", true
+}
+
+// resolveRevisionSuffix resolves base and applies a suffix to it: ~<n>
+// follows first parents n times, ^<n> takes the nth parent, ^0 the commit
+// itself, and ^{<type>} peels tags, and a commit to its tree, until an
+// object of that type is found. ^{} peels tags only.
+func resolveRevisionSuffix(name, base string, op byte, n int, typ string) (objectID, error) {
+	hash, err := resolveRevision(base)
+	if err != nil {
+		return objectID{}, err
+	}
+	if op == '{' {
+		return peelRevision(name, hash, typ)
+	}
+	hash, err = peelRevision(name, hash, commitObject)
+	if err != nil {
+		return objectID{}, err
+	}
+	if op == '^' {
+		if n == 0 {
+			return hash, nil
+		}
+		c, err := readCommit(hash)
+		if err != nil {
+			return objectID{}, err
+		}
+		if n > len(c.parents) {
+			return objectID{}, fmt.Errorf("unknown revision %q", name)
+		}
+		return c.parents[n-1], nil
+	}
+	for ; n > 0; n-- {
+		c, err := readCommit(hash)
+		if err != nil {
+			return objectID{}, err
+		}
+		if len(c.parents) == 0 {
+			return objectID{}, fmt.Errorf("unknown revision %q", name)
+		}
+		hash = c.parents[0]
+	}
+	return hash, nil
+}
+
+// peelRevision peels hash to an object of type typ, for ^{<type>}. The
+// type "object" takes any object, and the empty type any but a tag.
+func peelRevision(name string, hash objectID, typ string) (objectID, error) {
+	switch typ {
+	case "", "object", blobObject, treeObject, commitObject, tagObject:
+	default:
+		return objectID{}, fmt.Errorf("unknown revision %q", name)
+	}
+	for {
+		objType, content, err := readObject(hash)
+		if err != nil {
+			return objectID{}, err
+		}
+		switch {
+		case typ == "object" || objType == typ || typ == "" && objType != tagObject:
+			return hash, nil
+		case objType == tagObject:
+			t, err := parseTag(content)
+			if err != nil {
+				return objectID{}, fmt.Errorf("corrupt tag %x: %w", hash, err)
+			}
+			hash = t.object
+		case objType == commitObject && typ == treeObject:
+			c, err := parseCommit(content)
+			if err != nil {
+				return objectID{}, fmt.Errorf("corrupt commit %x: %w", hash, err)
+			}
+			hash = c.tree
+		default:
+			return objectID{}, fmt.Errorf("%s: expected %s type, but the object dereferences to %s type", name, typ, objType)
+		}
+	}
+}
+
+// resolveRevisionPath resolves the path of <rev>:<path>, an empty path
+// naming the tree itself.
+func resolveRevisionPath(rev, path string) (objectID, error) {
+	path = strings.Trim(path, "/")
+	if rev == "" {
+		entries, err := readIndex()
+		if err != nil {
+			return objectID{}, err
+		}
+		for _, e := range entries {
+			if e.path == path && e.stage() == 0 {
+				return e.hash, nil
+			}
+		}
+		return objectID{}, fmt.Errorf("path '%s' does not exist in the index", path)
+	}
+
+	hash, err := revisionTree(rev)
+	if err != nil {
+		return objectID{}, err
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		objType, content, err := readObject(hash)
+		if err != nil {
+			return objectID{}, err
+		}
+		if objType != treeObject {
+			return objectID{}, fmt.Errorf("path '%s' does not exist in '%s'", path, rev)
+		}
+		entries, err := parseTree(content)
+		if err != nil {
+			return objectID{}, err
+		}
+		i := slices.IndexFunc(entries, func(e treeEntry) bool { return e.name == name })
+		if i < 0 {
+			return objectID{}, fmt.Errorf("path '%s' does not exist in '%s'", path, rev)
+		}
+		hash = entries[i].hash
+	}
+	return hash, nil
+}
+
+// resolveCommit resolves a revision to the commit it names or points to.
+func resolveCommit(name string) (objectID, error) {
+	hash, err := resolveRevision(name)
+	if err == nil {
+		var ok bool
+		if hash, ok, err = peelToCommit(hash); err == nil && !ok {
+			err = fmt.Errorf("not a commit")
+		}
+	}
+	if err != nil {
+		return objectID{}, fmt.Errorf("Not a valid commit name %s", name)
+	}
+	return hash, nil
+}
+
+func isHexString(s string) bool {
+	for _, c := range s {
+		if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+// findObjectsByPrefix returns every loose or packed object, local or
+// borrowed from an alternate, whose hex name starts with prefix.
+func findObjectsByPrefix(prefix string) ([]objectID, error) {
+	prefix = strings.ToLower(prefix)
+	seen := make(map[objectID]bool)
+	var matches []objectID
+	add := func(hash objectID) {
+		if !seen[hash] {
+			seen[hash] = true
+			matches = append(matches, hash)
+		}
+	}
+
+	for _, dir := range append([]string{objDir}, alternateObjectDirs()...) {
+		files, err := os.ReadDir(filepath.Join(dir, prefix[:2]))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("failed to read object directory: %w", err)
+		}
+		for _, f := range files {
+			if name := prefix[:2] + f.Name(); strings.HasPrefix(name, prefix) {
+				if hash, err := parseHash(name); err == nil {
+					add(hash)
+				}
+			}
+		}
+	}
+
+	packs, err := openPacks()
+	if err != nil {
+		return nil, err
+	}
+	packsMu.Lock()
+	packs = append(append([]*pack(nil), packs...), alternatePacks...)
+	packsMu.Unlock()
+	for _, p := range packs {
+		for i := 0; i < p.idx.count; i++ {
+			if hash := p.idx.hashAt(i); strings.HasPrefix(hash.String(), prefix) {
+				add(hash)
+			}
+		}
+	}
+
+	return matches, nil
+}
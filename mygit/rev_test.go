@@ -0,0 +1,31 @@
+package mygit
+
+import "testing"
+
+func TestCutRevisionSuffix(t *testing.T) {
+	tests := []struct {
+		name, base string
+		op         byte
+		n          int
+		typ        string
+		ok         bool
+	}{
+		{name: "HEAD~3", base: "HEAD", op: '~', n: 3, ok: true},
+		{name: "HEAD~", base: "HEAD", op: '~', n: 1, ok: true},
+		{name: "main^2", base: "main", op: '^', n: 2, ok: true},
+		{name: "HEAD^^", base: "HEAD^", op: '^', n: 1, ok: true},
+		{name: "v1^0", base: "v1", op: '^', n: 0, ok: true},
+		{name: "v1^{tree}", base: "v1", op: '{', typ: "tree", ok: true},
+		{name: "v1^{}~2", base: "v1^{}", op: '~', n: 2, ok: true},
+		{name: "main@{1}"},
+		{name: "v1.2"},
+		{name: "^"},
+		{name: "~2"},
+	}
+	for _, tt := range tests {
+		base, op, n, typ, ok := cutRevisionSuffix(tt.name)
+		if ok != tt.ok || base != tt.base || op != tt.op || n != tt.n || typ != tt.typ {
+			t.Errorf("cutRevisionSuffix(%q) = %q, %q, %d, %q, %v", tt.name, base, op, n, typ, ok)
+		}
+	}
+}
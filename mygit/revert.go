@@ -0,0 +1,271 @@
+package mygit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// stopRevert records a revert that is not committed yet, because it
+// conflicts or was asked not to: REVERT_HEAD names the reverted commit and
+// MERGE_MSG holds the message.
+func stopRevert(hash objectID, message string) error {
+	if err := os.WriteFile(mergeMsgFile, []byte(message), 0644); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	tx := newRefTransaction()
+	tx.update("REVERT_HEAD", hash, "")
+	return tx.commit()
+}
+
+// clearRevert forgets a revert in progress.
+func clearRevert(tx *refTransaction) error {
+	tx.delete("REVERT_HEAD")
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if err := os.Remove(mergeMsgFile); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to remove %s: %w", mergeMsgFile, err)
+	}
+	return nil
+}
+
+// revertCommit undoes the changes of a commit on top of HEAD by merging
+// the commit's parent with the commit as the base, and commits the result
+// unless noCommit is set. With noCommit, the changes are merged into the
+// index as it is.
+func revertCommit(cfg *config, name string, noCommit bool) error {
+	if _, err := resolveRef("REVERT_HEAD"); err == nil {
+		return fmt.Errorf("revert is already in progress")
+	}
+	hash, err := resolveCommit(name)
+	if err != nil {
+		return fmt.Errorf("bad revision '%s'", name)
+	}
+	c, err := readCommit(hash)
+	if err != nil {
+		return err
+	}
+	if len(c.parents) > 1 {
+		return fmt.Errorf("commit %s is a merge but no -m option was given.", hash)
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	indexed, unmerged := indexFiles(entries)
+	if len(unmerged) > 0 {
+		return fmt.Errorf("Reverting is not possible because you have unmerged files.")
+	}
+	head, err := resolveRef("HEAD")
+	if errors.Is(err, errRefNotFound) {
+		return fmt.Errorf("can't revert as initial commit")
+	} else if err != nil {
+		return err
+	}
+	headFiles, err := commitFiles(head)
+	if err != nil {
+		return err
+	}
+	ours := headFiles
+	if noCommit {
+		ours = indexed
+	} else if len(diffFiles(headFiles, indexed, nil, nil)) > 0 {
+		return fmt.Errorf("your local changes would be overwritten by revert.\nCommit your changes or stash them to proceed.")
+	}
+
+	baseFiles, err := commitFiles(hash)
+	if err != nil {
+		return err
+	}
+	subject := commitSubject(c.message)
+	label := fmt.Sprintf("%s (%s)", shortHash(hash), subject)
+	parentLabel := "(empty tree)"
+	theirFiles := map[string]diffEntry{}
+	if len(c.parents) > 0 {
+		parentLabel = "parent of " + label
+		if theirFiles, err = commitFiles(c.parents[0]); err != nil {
+			return err
+		}
+	}
+	style, err := mergeConflictStyle(cfg)
+	if err != nil {
+		return err
+	}
+
+	var out bytes.Buffer
+	m := &treeMerge{
+		opts: mergeFileOptions{
+			base:       label,
+			ours:       "HEAD",
+			theirs:     parentLabel,
+			style:      style,
+			markerSize: defaultConflictMarkerSize,
+		},
+		out: &out,
+	}
+	result, conflicts, err := m.mergeFiles(baseFiles, ours, theirFiles)
+	if err != nil {
+		return err
+	}
+	if err := checkoutUpdates(cfg, entries, ours, mergeUpdates(ours, result)); err != nil {
+		return err
+	}
+	os.Stdout.Write(out.Bytes())
+
+	message := fmt.Sprintf("Revert \"%s\"\n\nThis reverts commit %s.\n", subject, hash)
+	if conflicts > 0 {
+		if err := stopRevert(hash, conflictsMessage(message, result)); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "error: could not revert %s... %s\n", shortHash(hash), subject)
+		fmt.Fprintln(os.Stderr, "hint: After resolving the conflicts, mark them with")
+		fmt.Fprintln(os.Stderr, `hint: "mygit add/rm <pathspec>", then run`)
+		fmt.Fprintln(os.Stderr, `hint: "mygit revert --continue".`)
+		fmt.Fprintln(os.Stderr, `hint: You can instead skip this commit with "mygit revert --skip".`)
+		fmt.Fprintln(os.Stderr, `hint: To abort and get back to the state before "mygit revert",`)
+		fmt.Fprintln(os.Stderr, `hint: run "mygit revert --abort".`)
+		os.Exit(1)
+	}
+	if noCommit {
+		return stopRevert(hash, message)
+	}
+
+	files := make(map[string]diffEntry)
+	for path, u := range result {
+		files[path] = u.file
+	}
+	if len(diffFiles(headFiles, files, nil, nil)) == 0 {
+		return fmt.Errorf("nothing to commit, working tree clean")
+	}
+	tree, err := writeFilesTree(files)
+	if err != nil {
+		return err
+	}
+	reverted, err := commitTree(tree, []objectID{head}, message)
+	if err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	tx.updateFrom("HEAD", head, reverted, "revert: "+commitSubject(message))
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	return printCommitSummary(cfg, reverted, headFiles, false)
+}
+
+// continueRevert commits the index with the message of a revert that was
+// stopped.
+func continueRevert(cfg *config) error {
+	if _, err := resolveRef("REVERT_HEAD"); errors.Is(err, errRefNotFound) {
+		return fmt.Errorf("no cherry-pick or revert in progress")
+	} else if err != nil {
+		return err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	indexed, unmerged := indexFiles(entries)
+	if len(unmerged) > 0 {
+		return fmt.Errorf("Committing is not possible because you have unmerged files.")
+	}
+	data, err := os.ReadFile(mergeMsgFile)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", mergeMsgFile, err)
+	}
+	message := cleanupMessage(string(data), true)
+	if message == "" {
+		return fmt.Errorf("Aborting commit due to empty commit message.")
+	}
+
+	head, err := resolveRef("HEAD")
+	if err != nil {
+		return err
+	}
+	headFiles, err := commitFiles(head)
+	if err != nil {
+		return err
+	}
+	tree, err := writeFilesTree(indexed)
+	if err != nil {
+		return err
+	}
+	reverted, err := commitTree(tree, []objectID{head}, message)
+	if err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	tx.updateFrom("HEAD", head, reverted, "commit: "+commitSubject(message))
+	if err := clearRevert(tx); err != nil {
+		return err
+	}
+	return printCommitSummary(cfg, reverted, headFiles, false)
+}
+
+// abortRevert gives up on a stopped revert, resetting the index and the
+// working tree to HEAD.
+func abortRevert(cfg *config) error {
+	if _, err := resolveRef("REVERT_HEAD"); errors.Is(err, errRefNotFound) {
+		return fmt.Errorf("no cherry-pick or revert in progress")
+	} else if err != nil {
+		return err
+	}
+	head, err := resolveRef("HEAD")
+	if err != nil {
+		return err
+	}
+	files, err := commitFiles(head)
+	if err != nil {
+		return err
+	}
+	if err := resetWorktree(cfg, files); err != nil {
+		return err
+	}
+	tx := newRefTransaction()
+	tx.update("HEAD", head, "reset: moving to "+head.String())
+	return clearRevert(tx)
+}
+
+func runRevert(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var action string
+	var names []string
+	noCommit := false
+	for _, arg := range args {
+		switch {
+		case arg == "-n" || arg == "--no-commit":
+			noCommit = true
+		case arg == "--no-edit":
+		case arg == "--continue" || arg == "--skip" || arg == "--abort":
+			if action != "" && action != arg {
+				return fmt.Errorf("options '%s' and '%s' cannot be used together", action, arg)
+			}
+			action = arg
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+
+	switch {
+	case action != "" && len(names) > 0:
+		return fmt.Errorf("%s takes no arguments", action)
+	case action == "--continue":
+		return continueRevert(cfg)
+	case action != "":
+		// A single revert has nothing left to do after skipping it.
+		return abortRevert(cfg)
+	case len(names) != 1:
+		return fmt.Errorf("usage: mygit revert [--no-commit] <commit>\n   or: mygit revert (--continue | --skip | --abort)")
+	}
+	return revertCommit(cfg, names[0], noCommit)
+}
@@ -0,0 +1,328 @@
+package mygit
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// parseRevisionArgs splits revision arguments into the tips to include and
+// the ones to exclude, understanding "^<rev>" and "<a>..<b>".
+func parseRevisionArgs(args []string) (include, exclude []objectID, err error) {
+	for _, arg := range args {
+		if from, to, ok := strings.Cut(arg, ".."); ok {
+			if from == "" {
+				from = "HEAD"
+			}
+			if to == "" {
+				to = "HEAD"
+			}
+			a, err := resolveRevision(from)
+			if err != nil {
+				return nil, nil, err
+			}
+			b, err := resolveRevision(to)
+			if err != nil {
+				return nil, nil, err
+			}
+			exclude = append(exclude, a)
+			include = append(include, b)
+			continue
+		}
+
+		name, negated := strings.CutPrefix(arg, "^")
+		hash, err := resolveRevision(name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if negated {
+			exclude = append(exclude, hash)
+		} else {
+			include = append(include, hash)
+		}
+	}
+	return include, exclude, nil
+}
+
+// humanizeBytes formats a size the way git's strbuf_humanise_bytes does.
+func humanizeBytes(n int64) string {
+	switch {
+	case n > 1<<30:
+		return fmt.Sprintf("%d.%02d GiB", n>>30, (n&(1<<30-1))/10737419)
+	case n > 1<<20:
+		x := n + 5243
+		return fmt.Sprintf("%d.%02d MiB", x>>20, ((x&(1<<20-1))*100)>>20)
+	case n > 1<<10:
+		x := n + 5
+		return fmt.Sprintf("%d.%02d KiB", x>>10, ((x&(1<<10-1))*100)>>10)
+	case n == 1:
+		return "1 byte"
+	default:
+		return fmt.Sprintf("%d bytes", n)
+	}
+}
+
+type sizedObject struct {
+	namedObject
+	diskSize int64
+}
+
+func runRevList(args []string) error {
+	var revs []string
+	objects, diskUsage, human := false, false, false
+	bisect, bisectVars, bisectAll := false, false, false
+	all, count, useBitmaps := false, false, false
+	maxBlobs, maxCount := 0, -1
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--bisect":
+			bisect = true
+		case arg == "--bisect-vars":
+			bisectVars = true
+		case arg == "--bisect-all":
+			bisectAll = true
+		case arg == "--objects":
+			objects = true
+		case arg == "--disk-usage":
+			diskUsage = true
+		case arg == "--disk-usage=human":
+			diskUsage, human = true, true
+		case strings.HasPrefix(arg, "--max="):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--max="))
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid value for %s", arg)
+			}
+			maxBlobs = n
+		case arg == "--all":
+			all = true
+		case arg == "--count":
+			count = true
+		case arg == "--use-bitmap-index":
+			useBitmaps = true
+		case arg == "-n" || arg == "--max-count":
+			if i+1 == len(args) {
+				return fmt.Errorf("switch '%s' requires a value", strings.TrimLeft(arg, "-"))
+			}
+			i++
+			arg = "--max-count=" + args[i]
+			fallthrough
+		case strings.HasPrefix(arg, "--max-count=") || len(arg) > 1 && arg[0] == '-' && isDigits(arg[1:]):
+			value := strings.TrimPrefix(strings.TrimPrefix(arg, "--max-count="), "-")
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("'%s' is not an integer", value)
+			}
+			maxCount = n
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			revs = append(revs, arg)
+		}
+	}
+	if len(revs) == 0 && !bisect && !all {
+		return fmt.Errorf("usage: mygit rev-list [--objects] [--all] [--count] [--use-bitmap-index] [--max-count=<n>] [--disk-usage[=human]] [--max=<n>] [--bisect[-vars|-all]] <commit>...")
+	}
+
+	include, exclude, err := parseRevisionArgs(revs)
+	if err != nil {
+		return err
+	}
+	if all {
+		refs, err := listRefs()
+		if err != nil {
+			return err
+		}
+		for _, hash := range refs {
+			include = append(include, hash)
+		}
+		if head, err := resolveRef("HEAD"); err == nil {
+			include = append(include, head)
+		}
+	}
+	if bisect || bisectVars || bisectAll {
+		return showBisection(include, exclude, bisect, bisectVars, bisectAll)
+	}
+	// Without --objects only commits are listed and counted.
+	commitsOnly := !objects && maxBlobs == 0
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	// The bitmap lists objects in pack order and without names, so it
+	// is only used when neither matters.
+	if useBitmaps && maxCount < 0 && maxBlobs == 0 {
+		cfg, err := loadConfig()
+		if err != nil {
+			return err
+		}
+		bm, err := loadPackBitmap(cfg)
+		if err != nil {
+			return err
+		}
+		if bm != nil {
+			list, err := bm.bitmapObjects(include, exclude, commitsOnly)
+			if err != nil {
+				return err
+			}
+			return showBitmapObjects(out, list, count, diskUsage, human)
+		}
+	}
+
+	list, err := listObjectsLimited(include, exclude, maxCount, commitsOnly)
+	if err != nil {
+		return err
+	}
+
+	if count {
+		fmt.Fprintln(out, len(list))
+		return nil
+	}
+
+	if diskUsage || maxBlobs > 0 {
+		var total int64
+		var blobs []sizedObject
+		for _, obj := range list {
+			info, err := statObject(obj.hash)
+			if err != nil {
+				return err
+			}
+			total += info.diskSize
+			if info.objType == blobObject {
+				blobs = append(blobs, sizedObject{namedObject: obj, diskSize: info.diskSize})
+			}
+		}
+
+		if maxBlobs > 0 {
+			sort.Slice(blobs, func(i, j int) bool {
+				if blobs[i].diskSize != blobs[j].diskSize {
+					return blobs[i].diskSize > blobs[j].diskSize
+				}
+				return string(blobs[i].hash[:]) < string(blobs[j].hash[:])
+			})
+			for _, b := range blobs[:min(maxBlobs, len(blobs))] {
+				fmt.Fprintf(out, "%x %d %s\n", b.hash, b.diskSize, b.name)
+			}
+		}
+		if diskUsage {
+			if human {
+				fmt.Fprintln(out, humanizeBytes(total))
+			} else {
+				fmt.Fprintln(out, total)
+			}
+		}
+		return nil
+	}
+
+	for _, obj := range list {
+		if !commitsOnly {
+			info, err := statObject(obj.hash)
+			if err != nil {
+				return err
+			}
+			if info.objType != commitObject {
+				fmt.Fprintf(out, "%x %s\n", obj.hash, obj.name)
+				continue
+			}
+		}
+		fmt.Fprintf(out, "%x\n", obj.hash)
+	}
+	return nil
+}
+
+// showBitmapObjects prints what rev-list found through a bitmap: the
+// objects, their number or their total size on disk.
+func showBitmapObjects(out io.Writer, list []namedObject, count, diskUsage, human bool) error {
+	switch {
+	case count:
+		fmt.Fprintln(out, len(list))
+	case diskUsage:
+		var total int64
+		for _, obj := range list {
+			info, err := statObject(obj.hash)
+			if err != nil {
+				return err
+			}
+			total += info.diskSize
+		}
+		if human {
+			fmt.Fprintln(out, humanizeBytes(total))
+		} else {
+			fmt.Fprintln(out, total)
+		}
+	default:
+		for _, obj := range list {
+			fmt.Fprintf(out, "%x\n", obj.hash)
+		}
+	}
+	return nil
+}
+
+// showBisection prints the commit to test next when looking for the
+// first bad commit among those reachable from include but not from
+// exclude: its hash, all candidates with their distance or, with vars,
+// what the bisect porcelain needs to know. With useRefs, the commits
+// marked in refs/bisect are added to the arguments; skipped ones are
+// avoided in any case.
+func showBisection(include, exclude []objectID, useRefs, vars, all bool) error {
+	bad, good, skipped, err := bisectRefs()
+	if err != nil {
+		return err
+	}
+	if useRefs {
+		if bad != (objectID{}) {
+			include = append(include, bad)
+		}
+		exclude = append(exclude, good...)
+	}
+	if len(include) == 0 {
+		return fmt.Errorf("no bad commit to bisect from")
+	}
+	if !useRefs || bad == (objectID{}) {
+		bad = include[0]
+	}
+	list, err := bisectionCommits(include, exclude)
+	if err != nil {
+		return err
+	}
+	b := findBisection(list, all || len(skipped) > 0)
+	candidates := skipBisection(b.candidates, skipped, bad)
+	if all {
+		candidates = withoutSkipped(b.candidates, skipped)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	if all {
+		decorations, err := loadDecorations()
+		if err != nil {
+			return err
+		}
+		for _, c := range candidates {
+			d := append(slices.Clone(decorations[c.hash]), decoration{ref: fmt.Sprintf("dist=%d", c.distance)})
+			fmt.Fprintf(out, "%x%s\n", c.hash, formatDecorations(d, false, ""))
+		}
+	}
+	switch {
+	case vars:
+		if len(b.candidates) == 0 {
+			out.Flush()
+			os.Exit(1)
+		}
+		if all {
+			fmt.Fprintln(out, "------")
+		}
+		rev := ""
+		if len(candidates) > 0 {
+			rev = candidates[0].hash.String()
+		}
+		writeBisectVars(out, b, rev)
+	case !all && len(candidates) > 0:
+		fmt.Fprintf(out, "%x\n", candidates[0].hash)
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+package mygit
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// errStopWalk can be returned from a walkCommits callback to end the walk
+// early without reporting an error.
+var errStopWalk = errors.New("stop walk")
+
+type queuedCommit struct {
+	hash   objectID
+	commit *commit
+	// node stands in for commit in walks that only follow parents.
+	node *commitNode
+	time int64
+	// seq breaks ties between equal times in insertion order.
+	seq int
+}
+
+type commitQueue []queuedCommit
+
+func (q commitQueue) Len() int { return len(q) }
+func (q commitQueue) Less(i, j int) bool {
+	return q[i].time > q[j].time || q[i].time == q[j].time && q[i].seq < q[j].seq
+}
+func (q commitQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *commitQueue) Push(x any)   { *q = append(*q, x.(queuedCommit)) }
+func (q *commitQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// identTimestamp extracts the unix time from an author or committer line.
+func identTimestamp(ident string) int64 {
+	end := strings.LastIndexByte(ident, '>')
+	if end == -1 {
+		return 0
+	}
+	fields := strings.Fields(ident[end+1:])
+	if len(fields) == 0 {
+		return 0
+	}
+	ts, _ := strconv.ParseInt(fields[0], 10, 64)
+	return ts
+}
+
+// peelToCommit follows tags until it reaches a commit. ok is false if the
+// chain ends at a tree or blob.
+func peelToCommit(hash objectID) (objectID, bool, error) {
+	for {
+		objType, content, err := readObject(hash)
+		if err != nil {
+			return hash, false, err
+		}
+		switch objType {
+		case commitObject:
+			return hash, true, nil
+		case tagObject:
+			t, err := parseTag(content)
+			if err != nil {
+				return hash, false, fmt.Errorf("corrupt tag %x: %w", hash, err)
+			}
+			hash = t.object
+		default:
+			return hash, false, nil
+		}
+	}
+}
+
+type namedObject struct {
+	hash objectID
+	// name is the full path a tree or blob was reached through.
+	name string
+}
+
+// listObjects returns the objects reachable from include but not from
+// exclude: commits newest first, then tags, then trees and blobs. Like git without
+// --objects-edge-aggressive, trees and blobs are only excluded when they
+// are part of an excluded commit at the boundary of the walk.
+func listObjects(include, exclude []objectID) ([]namedObject, error) {
+	return listObjectsLimited(include, exclude, -1, false)
+}
+
+// listObjectsLimited is listObjects stopping the walk after maxCommits
+// commits, unless negative; only the trees and blobs of those commits are
+// listed. With commitsOnly, nothing but the commits is listed, which
+// lets commits found in the commit-graph go unread.
+func listObjectsLimited(include, exclude []objectID, maxCommits int, commitsOnly bool) ([]namedObject, error) {
+	shallow, err := readShallow()
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[objectID]bool)
+	var excludedTips []objectID
+	for _, hash := range exclude {
+		if !hasObject(hash) {
+			continue
+		}
+		commitHash, ok, err := peelToCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			excludedTips = append(excludedTips, commitHash)
+		} else {
+			excluded[commitHash] = true
+		}
+	}
+	err = walkCommitNodes(excludedTips, func(hash objectID, node *commitNode) error {
+		excluded[hash] = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var commits, tags, others []namedObject
+	var trees []objectID
+	seen := make(map[objectID]bool)
+	boundaryTrees := make(map[objectID]bool)
+	q := &commitQueue{}
+
+	push := func(hash objectID) error {
+		if seen[hash] {
+			return nil
+		}
+		seen[hash] = true
+		node, err := readCommitNode(hash)
+		if err != nil {
+			return err
+		}
+		if excluded[hash] {
+			boundaryTrees[node.tree] = true
+			return nil
+		}
+		heap.Push(q, queuedCommit{hash: hash, node: node, time: node.time})
+		return nil
+	}
+
+	for _, hash := range include {
+		for !seen[hash] && !excluded[hash] {
+			objType, content, err := readObject(hash)
+			if err != nil {
+				return nil, err
+			}
+			if objType == commitObject {
+				if err := push(hash); err != nil {
+					return nil, err
+				}
+				break
+			}
+			seen[hash] = true
+			if objType != tagObject {
+				if objType == treeObject {
+					trees = append(trees, hash)
+				} else {
+					others = append(others, namedObject{hash: hash})
+				}
+				break
+			}
+			t, err := parseTag(content)
+			if err != nil {
+				return nil, err
+			}
+			tags = append(tags, namedObject{hash: hash, name: t.name})
+			hash = t.object
+		}
+	}
+
+	for q.Len() > 0 && len(commits) != maxCommits {
+		item := heap.Pop(q).(queuedCommit)
+		commits = append(commits, namedObject{hash: item.hash})
+		trees = append(trees, item.node.tree)
+		if shallow[item.hash] {
+			continue
+		}
+		for _, parent := range item.node.parents {
+			if err := push(parent); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if commitsOnly {
+		return commits, nil
+	}
+	commits = append(commits, tags...)
+
+	for tree := range boundaryTrees {
+		if err := markTree(tree, excluded); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, tree := range trees {
+		if err := collectTree(tree, "", excluded, &others); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(commits, others...), nil
+}
+
+// markTree adds a tree and everything below it to set.
+func markTree(hash objectID, set map[objectID]bool) error {
+	if set[hash] {
+		return nil
+	}
+	set[hash] = true
+
+	_, content, err := readObject(hash)
+	if err != nil {
+		return err
+	}
+	entries, err := parseTree(content)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		switch {
+		case entry.mode == gitlinkMode:
+		case entry.mode == "40000":
+			if err := markTree(entry.hash, set); err != nil {
+				return err
+			}
+		default:
+			set[entry.hash] = true
+		}
+	}
+	return nil
+}
+
+// collectTree appends hash and the objects below it that are not in skip,
+// marking them in skip as it goes.
+func collectTree(hash objectID, name string, skip map[objectID]bool, out *[]namedObject) error {
+	if skip[hash] {
+		return nil
+	}
+	skip[hash] = true
+	*out = append(*out, namedObject{hash: hash, name: name})
+
+	_, content, err := readObject(hash)
+	if err != nil {
+		return err
+	}
+	entries, err := parseTree(content)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := entry.name
+		if name != "" {
+			path = name + "/" + entry.name
+		}
+		switch {
+		case entry.mode == gitlinkMode:
+		case entry.mode == "40000":
+			if err := collectTree(entry.hash, path, skip, out); err != nil {
+				return err
+			}
+		case !skip[entry.hash]:
+			skip[entry.hash] = true
+			*out = append(*out, namedObject{hash: entry.hash, name: path})
+		}
+	}
+	return nil
+}
+
+// walkCommits visits every commit reachable from tips exactly once, newest
+// committer date first. Tags are peeled and non-commit tips are ignored;
+// the walk does not continue past shallow commits.
+func walkCommits(tips []objectID, fn func(hash objectID, c *commit) error) error {
+	return walkCommitNodes(tips, func(hash objectID, node *commitNode) error {
+		c := node.commit
+		if c == nil {
+			var err error
+			if c, err = readCommit(hash); err != nil {
+				return err
+			}
+		}
+		return fn(hash, c)
+	})
+}
+
+// walkCommitNodes is walkCommits for walks that only need to know how
+// commits are linked; commits in the commit-graph are not read.
+func walkCommitNodes(tips []objectID, fn func(hash objectID, node *commitNode) error) error {
+	shallow, err := readShallow()
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[objectID]bool)
+	q := &commitQueue{}
+	push := func(hash objectID) error {
+		if seen[hash] {
+			return nil
+		}
+		seen[hash] = true
+		node, err := readCommitNode(hash)
+		if err != nil {
+			return err
+		}
+		heap.Push(q, queuedCommit{hash: hash, node: node, time: node.time})
+		return nil
+	}
+
+	for _, tip := range tips {
+		hash, ok, err := peelToCommit(tip)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			continue
+		}
+		if err := push(hash); err != nil {
+			return err
+		}
+	}
+
+	for q.Len() > 0 {
+		item := heap.Pop(q).(queuedCommit)
+		if err := fn(item.hash, item.node); err != nil {
+			if errors.Is(err, errStopWalk) {
+				return nil
+			}
+			return err
+		}
+		if shallow[item.hash] {
+			continue
+		}
+		for _, parent := range item.node.parents {
+			if err := push(parent); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// walkedCommit is a commit listed by a revision walk.
+type walkedCommit struct {
+	hash   objectID
+	commit *commit
+}
+
+// limitToAncestry keeps the commits of a walk that are an anchor, a
+// descendant of one or, for anchors within the walk, an ancestor of one,
+// answering how the anchors relate to the tips.
+func limitToAncestry(list []walkedCommit, anchors []objectID) []walkedCommit {
+	inWalk := make(map[objectID]*commit, len(list))
+	for _, w := range list {
+		inWalk[w.hash] = w.commit
+	}
+	keep := make(map[objectID]bool)
+
+	for _, anchor := range anchors {
+		keep[anchor] = true
+		// Ancestors of the anchor are found by following its parents
+		// through the walk.
+		pending := []objectID{anchor}
+		for len(pending) > 0 {
+			hash := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			c, ok := inWalk[hash]
+			if !ok {
+				continue
+			}
+			for _, parent := range c.parents {
+				if _, ok := inWalk[parent]; ok && !keep[parent] {
+					keep[parent] = true
+					pending = append(pending, parent)
+				}
+			}
+		}
+	}
+
+	// Descendants have a parent that is an anchor or a descendant. The
+	// walk is newest first, so going through it backwards mostly sees
+	// parents before children; repeat until nothing changes for the
+	// cases where commit dates are out of order.
+	descends := make(map[objectID]bool)
+	for _, anchor := range anchors {
+		descends[anchor] = true
+	}
+	for changed := true; changed; {
+		changed = false
+		for i := len(list) - 1; i >= 0; i-- {
+			w := list[i]
+			if descends[w.hash] {
+				continue
+			}
+			for _, parent := range w.commit.parents {
+				if descends[parent] {
+					descends[w.hash] = true
+					changed = true
+					break
+				}
+			}
+		}
+	}
+
+	var kept []walkedCommit
+	for _, w := range list {
+		if keep[w.hash] || descends[w.hash] {
+			kept = append(kept, w)
+		}
+	}
+	return kept
+}
+
+// simplifyByDecoration keeps the commits of a walk that are decorated,
+// root commits that add files, and merges that still join separate lines
+// of history once the commits in between are left out, like git's
+// --simplify-by-decoration.
+func simplifyByDecoration(list []walkedCommit, decorated map[objectID]bool) ([]walkedCommit, error) {
+	inWalk := make(map[objectID]*commit, len(list))
+	for _, w := range list {
+		inWalk[w.hash] = w.commit
+	}
+	emptyTree := hashObjectData(treeObject, nil)
+
+	// simplified maps a commit to the shown commits that stand for it:
+	// itself if it is shown, otherwise what its parents stand for. A
+	// commit outside the walk stands for itself.
+	simplified := make(map[objectID][]objectID)
+	var simplify func(hash objectID) ([]objectID, error)
+	simplify = func(hash objectID) ([]objectID, error) {
+		if s, ok := simplified[hash]; ok {
+			return s, nil
+		}
+		c, ok := inWalk[hash]
+		if !ok {
+			return []objectID{hash}, nil
+		}
+		var parents []objectID
+		for _, parent := range c.parents {
+			s, err := simplify(parent)
+			if err != nil {
+				return nil, err
+			}
+			for _, p := range s {
+				if !slices.Contains(parents, p) {
+					parents = append(parents, p)
+				}
+			}
+		}
+		// Parents reachable from another parent add nothing.
+		var reduced []objectID
+		for i, p := range parents {
+			redundant := false
+			for j, other := range parents {
+				if i == j {
+					continue
+				}
+				ok, err := isAncestor(p, other)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					redundant = true
+					break
+				}
+			}
+			if !redundant {
+				reduced = append(reduced, p)
+			}
+		}
+
+		s := reduced
+		if decorated[hash] || len(c.parents) == 0 && c.tree != emptyTree || len(reduced) > 1 {
+			s = []objectID{hash}
+		}
+		simplified[hash] = s
+		return s, nil
+	}
+
+	var kept []walkedCommit
+	for _, w := range list {
+		s, err := simplify(w.hash)
+		if err != nil {
+			return nil, err
+		}
+		if len(s) == 1 && s[0] == w.hash {
+			kept = append(kept, w)
+		}
+	}
+	return kept, nil
+}
+
+// sortTopologically orders the commits of a walk so that children come
+// before their parents, like git's --topo-order: starting from the tips in
+// walk order, it shows a line of history until it reaches a commit whose
+// other children are still to come, favoring the last parent of merges.
+func sortTopologically(list []walkedCommit) []walkedCommit {
+	byHash := make(map[objectID]walkedCommit, len(list))
+	indegree := make(map[objectID]int, len(list))
+	for _, w := range list {
+		byHash[w.hash] = w
+		indegree[w.hash] = 1
+	}
+	for _, w := range list {
+		for _, parent := range w.commit.parents {
+			if _, ok := indegree[parent]; ok {
+				indegree[parent]++
+			}
+		}
+	}
+
+	var stack []walkedCommit
+	for i := len(list) - 1; i >= 0; i-- {
+		if indegree[list[i].hash] == 1 {
+			stack = append(stack, list[i])
+		}
+	}
+	sorted := make([]walkedCommit, 0, len(list))
+	for len(stack) > 0 {
+		w := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		sorted = append(sorted, w)
+		for _, parent := range w.commit.parents {
+			if _, ok := indegree[parent]; !ok {
+				continue
+			}
+			if indegree[parent]--; indegree[parent] == 1 {
+				stack = append(stack, byHash[parent])
+			}
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,108 @@
+package mygit
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// shortlogGroup is the commits of one author, newest first.
+type shortlogGroup struct {
+	name     string
+	subjects []string
+}
+
+func runShortlog(args []string) error {
+	var revs []string
+	summary, numbered, email, committer := false, false, false, false
+	for _, arg := range args {
+		switch {
+		case arg == "-s" || arg == "--summary":
+			summary = true
+		case arg == "-n" || arg == "--numbered":
+			numbered = true
+		case arg == "-e" || arg == "--email":
+			email = true
+		case arg == "-c" || arg == "--committer":
+			committer = true
+		case len(arg) > 2 && arg[0] == '-' && arg[1] != '-' && strings.Trim(arg[1:], "snec") == "":
+			// Flags without values can be bundled, as in -sn.
+			summary = summary || strings.Contains(arg, "s")
+			numbered = numbered || strings.Contains(arg, "n")
+			email = email || strings.Contains(arg, "e")
+			committer = committer || strings.Contains(arg, "c")
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			revs = append(revs, arg)
+		}
+	}
+	if len(revs) == 0 {
+		revs = []string{"HEAD"}
+	}
+
+	include, exclude, err := parseRevisionArgs(revs)
+	if err != nil {
+		return err
+	}
+	excluded := make(map[objectID]bool)
+	err = walkCommits(exclude, func(hash objectID, c *commit) error {
+		excluded[hash] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	groups := make(map[string]*shortlogGroup)
+	err = walkCommits(include, func(hash objectID, c *commit) error {
+		if excluded[hash] {
+			return nil
+		}
+		ident := c.author
+		if committer {
+			ident = c.committer
+		}
+		name, mail, _ := parseIdent(ident)
+		key := name
+		if email {
+			key = fmt.Sprintf("%s <%s>", name, mail)
+		}
+		g := groups[key]
+		if g == nil {
+			g = &shortlogGroup{name: key}
+			groups[key] = g
+		}
+		g.subjects = append(g.subjects, commitSubject(c.message))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	list := make([]*shortlogGroup, 0, len(groups))
+	for _, g := range groups {
+		list = append(list, g)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+	if numbered {
+		sort.SliceStable(list, func(i, j int) bool { return len(list[i].subjects) > len(list[j].subjects) })
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	for _, g := range list {
+		if summary {
+			fmt.Fprintf(out, "%6d\t%s\n", len(g.subjects), g.name)
+			continue
+		}
+		// Each author's commits are listed oldest first.
+		fmt.Fprintf(out, "%s (%d):\n", g.name, len(g.subjects))
+		for i := len(g.subjects) - 1; i >= 0; i-- {
+			fmt.Fprintf(out, "      %s\n", g.subjects[i])
+		}
+		fmt.Fprintln(out)
+	}
+	return out.Flush()
+}
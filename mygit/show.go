@@ -0,0 +1,216 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// showOptions control how show prints each kind of object.
+type showOptions struct {
+	log         logOptions
+	diff        *diffOptions
+	noPatch     bool
+	decorations map[objectID][]decoration
+}
+
+// showObject prints an object under the name it was asked for: commits
+// with their patch, tags followed by what they point to, trees as a list
+// of names and blobs as they are. shown tells whether something was
+// printed before, which commits, tags and trees are set apart from.
+func showObject(w io.Writer, name string, hash objectID, opts *showOptions, shown *bool) error {
+	objType, content, err := readObject(hash)
+	if err != nil {
+		return err
+	}
+	switch objType {
+	case blobObject:
+		_, err := w.Write(content)
+		return err
+	case treeObject:
+		entries, err := parseTree(content)
+		if err != nil {
+			return fmt.Errorf("corrupt tree %x: %w", hash, err)
+		}
+		if *shown {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "tree %s\n\n", name)
+		for _, e := range entries {
+			if mode, _ := strconv.ParseUint(e.mode, 8, 32); mode == modeDirectory {
+				fmt.Fprintf(w, "%s/\n", e.name)
+			} else {
+				fmt.Fprintln(w, e.name)
+			}
+		}
+		*shown = true
+		return nil
+	case tagObject:
+		t, err := parseTag(content)
+		if err != nil {
+			return fmt.Errorf("corrupt tag %x: %w", hash, err)
+		}
+		if *shown {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "tag %s\n", t.name)
+		if !opts.log.oneline && t.tagger != "" {
+			name, email, when := parseIdent(t.tagger)
+			fmt.Fprintf(w, "Tagger: %s <%s>\n", name, email)
+			fmt.Fprintf(w, "Date:   %s\n", formatDate(when, opts.log.date, opts.log.now))
+		}
+		fmt.Fprintln(w)
+		if t.message != "" {
+			fmt.Fprint(w, t.message)
+			if !strings.HasSuffix(t.message, "\n") {
+				fmt.Fprintln(w)
+			}
+		}
+		*shown = true
+		return showObject(w, t.object.String(), t.object, opts, shown)
+	case commitObject:
+		c, err := parseCommit(content)
+		if err != nil {
+			return fmt.Errorf("corrupt commit %x: %w", hash, err)
+		}
+		if *shown && !opts.log.oneline {
+			fmt.Fprintln(w)
+		}
+		writeLogEntry(w, hash, c, &opts.log, opts.decorations)
+		*shown = true
+		// Like git without --cc, merges are shown without a diff.
+		if opts.noPatch || len(c.parents) > 1 {
+			return nil
+		}
+		return writeCommitDiff(w, c, opts.diff, opts.log.oneline)
+	}
+	return fmt.Errorf("unknown object type %s", objType)
+}
+
+// commitPairs lists the changes a commit makes to its parent, or to an
+// empty tree for a root commit.
+func commitPairs(c *commit) ([]diffPair, error) {
+	old := map[string]diffEntry{}
+	if len(c.parents) == 1 {
+		var err error
+		if old, err = commitFiles(c.parents[0]); err != nil {
+			return nil, err
+		}
+	}
+	files := make(map[string]diffEntry)
+	if err := treeFiles(c.tree, "", files); err != nil {
+		return nil, err
+	}
+	return diffFiles(old, files, nil, nil), nil
+}
+
+// writeCommitDiff prints the changes of a commit below the commit as
+// shown by show and log. Unless oneline, they are set apart from the
+// message by a blank line or, when a diffstat precedes the patch, by "---"
+// as in a mailed patch.
+func writeCommitDiff(w io.Writer, c *commit, opts *diffOptions, oneline bool) error {
+	pairs, err := commitPairs(c)
+	if err != nil {
+		return err
+	}
+	var diff bytes.Buffer
+	if err := writeDiff(&diff, pairs, opts); err != nil {
+		return err
+	}
+	if diff.Len() == 0 {
+		return nil
+	}
+	switch {
+	case oneline:
+	case opts.patch && opts.stat && !opts.nameOnly && !opts.nameStatus:
+		fmt.Fprintln(w, "---")
+	default:
+		fmt.Fprintln(w)
+	}
+	_, err = diff.WriteTo(w)
+	return err
+}
+
+func runShow(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	opts := showOptions{}
+	if opts.log, err = configLogOptions(cfg); err != nil {
+		return err
+	}
+	if opts.diff, err = configDiffOptions(cfg); err != nil {
+		return err
+	}
+
+	var names []string
+	for _, arg := range args {
+		switch {
+		case arg == "-s" || arg == "--no-patch":
+			opts.noPatch = true
+		case arg == "--oneline":
+			opts.log.oneline = true
+		case arg == "--decorate":
+			opts.log.decorate = decorateShort
+		case arg == "--no-decorate":
+			opts.log.decorate = decorateNo
+		case strings.HasPrefix(arg, "--decorate="):
+			if opts.log.decorate, err = parseDecorateMode(strings.TrimPrefix(arg, "--decorate=")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "--date="):
+			if opts.log.date, err = parseDateMode(strings.TrimPrefix(arg, "--date=")); err != nil {
+				return err
+			}
+		case arg == "--color":
+			opts.log.color = true
+		case arg == "--no-color":
+			opts.log.color = false
+		case strings.HasPrefix(arg, "--color="):
+			if opts.log.color, err = parseColorMode(strings.TrimPrefix(arg, "--color=")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "-"):
+			if ok, err := parseDiffFormatOption(arg, opts.diff); err != nil {
+				return err
+			} else if !ok {
+				return fmt.Errorf("unknown option %s", arg)
+			}
+		default:
+			names = append(names, arg)
+		}
+	}
+	if len(names) == 0 {
+		names = []string{"HEAD"}
+	}
+	if !opts.diff.hasFormat() {
+		opts.diff.patch = true
+	}
+
+	hashes := make([]objectID, len(names))
+	for i, name := range names {
+		if hashes[i], err = resolveRevision(name); err != nil {
+			return err
+		}
+	}
+	if opts.log.decorate != decorateNo {
+		if opts.decorations, err = loadDecorations(); err != nil {
+			return err
+		}
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	shown := false
+	for i, name := range names {
+		if err := showObject(out, name, hashes[i], &opts, &shown); err != nil {
+			return err
+		}
+	}
+	return nil
+}
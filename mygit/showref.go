@@ -0,0 +1,150 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// showRefMatches tells whether a show-ref pattern names ref: patterns
+// match whole trailing components, so "master" matches refs/heads/master
+// and refs/remotes/origin/master but not refs/heads/submaster.
+func showRefMatches(ref string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, p := range patterns {
+		if ref == p || strings.HasSuffix(ref, "/"+p) {
+			return true
+		}
+	}
+	return false
+}
+
+func runShowRef(args []string) error {
+	var patterns []string
+	quiet, verify, head, deref, heads, tags := false, false, false, false, false, false
+	hashOnly, abbrev := false, 0
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			patterns = append(patterns, args[i+1:]...)
+			i = len(args)
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case arg == "--verify":
+			verify = true
+		case arg == "--head":
+			head = true
+		case arg == "-d" || arg == "--dereference":
+			deref = true
+		case arg == "--heads":
+			heads = true
+		case arg == "--tags":
+			tags = true
+		case arg == "-s" || arg == "--hash":
+			hashOnly = true
+		case arg == "--abbrev":
+			abbrev = len(shortHash(objectID{}))
+		case strings.HasPrefix(arg, "--hash=") || strings.HasPrefix(arg, "--abbrev="):
+			name, value, _ := strings.Cut(arg, "=")
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid abbrev %q", arg)
+			}
+			hashOnly = hashOnly || name == "--hash"
+			abbrev = min(max(n, minAbbrev), hashAlgo.size*2)
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			patterns = append(patterns, arg)
+		}
+	}
+
+	printRef := func(name string, hash objectID, hashOnly bool) {
+		hex := hash.String()
+		if abbrev > 0 {
+			hex = hex[:abbrev]
+		}
+		if hashOnly {
+			fmt.Println(hex)
+		} else {
+			fmt.Printf("%s %s\n", hex, name)
+		}
+	}
+	// Annotated tags are followed by what they peel to with -d, which
+	// like git names the ref even with --hash.
+	show := func(name string, hash objectID) error {
+		if quiet {
+			return nil
+		}
+		printRef(name, hash, hashOnly)
+		if !deref {
+			return nil
+		}
+		peeled, ok, err := peelTag(hash)
+		if err == nil && ok {
+			printRef(name+"^{}", peeled, false)
+		}
+		return err
+	}
+
+	// --verify takes full ref names, each of which must exist.
+	if verify {
+		if len(patterns) == 0 {
+			return fmt.Errorf("--verify requires a reference")
+		}
+		for _, name := range patterns {
+			hash, err := resolveRef(name)
+			if errors.Is(err, errRefNotFound) || err == nil && name != "HEAD" && !strings.HasPrefix(name, "refs/") {
+				if quiet {
+					os.Exit(1)
+				}
+				return fmt.Errorf("'%s' - not a valid ref", name)
+			} else if err != nil {
+				return err
+			}
+			if err := show(name, hash); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	refs, err := listRefs()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		switch {
+		case (heads || tags) && !(heads && strings.HasPrefix(name, "refs/heads/") || tags && strings.HasPrefix(name, "refs/tags/")):
+		case showRefMatches(name, patterns):
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	found := len(names) > 0
+	if head {
+		if hash, err := resolveRef("HEAD"); err == nil {
+			found = true
+			if err := show("HEAD", hash); err != nil {
+				return err
+			}
+		} else if !errors.Is(err, errRefNotFound) {
+			return err
+		}
+	}
+	for _, name := range names {
+		if err := show(name, refs[name]); err != nil {
+			return err
+		}
+	}
+	if !found {
+		os.Exit(1)
+	}
+	return nil
+}
@@ -0,0 +1,320 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sparseCheckoutFile returns the patterns file of the current worktree.
+func sparseCheckoutFile() string {
+	return filepath.Join(gitDir, "info", "sparse-checkout")
+}
+
+// sparsePatterns decide which paths a sparse checkout keeps in the
+// working tree. In cone mode the patterns only name directories: those
+// taken whole, and their parents, of which only the files directly inside
+// are kept. Other patterns are matched like .gitignore ones, where a
+// match keeps the path.
+type sparsePatterns struct {
+	lines    []string
+	patterns []ignorePattern
+	cone     bool
+	// full is set by a "/*" pattern not followed by "!/*/".
+	full      bool
+	recursive map[string]bool
+	parents   map[string]bool
+}
+
+// loadSparsePatterns reads the sparse-checkout file. Patterns that do not
+// fit cone mode are warned about and turn it off, like git does.
+func loadSparsePatterns(cone bool) (*sparsePatterns, error) {
+	data, err := os.ReadFile(sparseCheckoutFile())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read sparse-checkout file: %w", err)
+	}
+	sp := &sparsePatterns{
+		patterns:  parseIgnorePatterns(data, ""),
+		recursive: make(map[string]bool),
+		parents:   make(map[string]bool),
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r ")
+		if line != "" && line[0] != '#' {
+			sp.lines = append(sp.lines, line)
+		}
+	}
+	if !cone {
+		return sp, nil
+	}
+
+	sp.cone = true
+	for _, line := range sp.lines {
+		if err := sp.addConePattern(line); err != nil {
+			fmt.Fprintf(os.Stderr, "warning: %v\n", err)
+			fmt.Fprintln(os.Stderr, "warning: disabling cone pattern matching")
+			sp.cone, sp.full = false, false
+			sp.recursive, sp.parents = nil, nil
+			break
+		}
+	}
+	return sp, nil
+}
+
+// addConePattern records one line of a cone mode file: "/*" and "!/*/"
+// for the files at the top, "/dir/" for a directory and "!/dir/*/"
+// after it to keep only the files directly inside.
+func (sp *sparsePatterns) addConePattern(line string) error {
+	pattern, negated := strings.CutPrefix(line, "!")
+	pattern, dirOnly := strings.CutSuffix(pattern, "/")
+	switch {
+	case pattern == "/*" && negated && dirOnly:
+		sp.full = false
+		return nil
+	case pattern == "/*" && !negated && !dirOnly:
+		sp.full = true
+		return nil
+	case len(pattern) < 2 || pattern[0] != '/' || strings.Contains(pattern, "**") || !dirOnly:
+		return fmt.Errorf("unrecognized pattern: '%s'", pattern)
+	}
+	for i := 1; i < len(pattern); i++ {
+		c := pattern[i]
+		if !strings.ContainsRune("*?[\\", rune(c)) || pattern[i-1] == '\\' {
+			continue
+		}
+		if c == '\\' && i+1 < len(pattern) && strings.ContainsRune("*?[\\", rune(pattern[i+1])) {
+			continue
+		}
+		if c == '*' && pattern[i-1] == '/' && i == len(pattern)-1 {
+			continue
+		}
+		return fmt.Errorf("unrecognized pattern: '%s'", pattern)
+	}
+
+	if dir, ok := strings.CutSuffix(pattern, "/*"); ok && len(pattern) > 2 {
+		if !negated {
+			return fmt.Errorf("unrecognized pattern: '%s'", pattern)
+		}
+		dir = unescapeConePattern(dir)
+		if !sp.recursive[dir] {
+			return fmt.Errorf("unrecognized negative pattern: '%s'", pattern)
+		}
+		delete(sp.recursive, dir)
+		sp.parents[dir] = true
+		return nil
+	}
+	if negated {
+		return fmt.Errorf("unrecognized negative pattern: '%s'", pattern)
+	}
+	dir := unescapeConePattern(pattern)
+	sp.recursive[dir] = true
+	if sp.parents[dir] {
+		return fmt.Errorf("your sparse-checkout file may have issues: pattern '%s' is repeated", pattern)
+	}
+	return nil
+}
+
+// unescapeConePattern turns "/dir" into the directory it names.
+func unescapeConePattern(pattern string) string {
+	var b strings.Builder
+	for i := 1; i < len(pattern); i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+		}
+		b.WriteByte(pattern[i])
+	}
+	return b.String()
+}
+
+// includes reports whether path is kept in the working tree.
+func (sp *sparsePatterns) includes(path string) bool {
+	if sp.cone {
+		slash := strings.LastIndexByte(path, '/')
+		if sp.full || slash == -1 || sp.parents[path[:slash]] {
+			return true
+		}
+		for dir := path[:slash]; ; {
+			if sp.recursive[dir] {
+				return true
+			}
+			i := strings.LastIndexByte(dir, '/')
+			if i == -1 {
+				return false
+			}
+			dir = dir[:i]
+		}
+	}
+
+	// The deepest of the path and its directories that a pattern
+	// matches decides.
+	for name, isDir := path, false; name != ""; isDir = true {
+		for i := len(sp.patterns) - 1; i >= 0; i-- {
+			if sp.patterns[i].matches(name, isDir) {
+				return !sp.patterns[i].negated
+			}
+		}
+		i := strings.LastIndexByte(name, '/')
+		if i == -1 {
+			break
+		}
+		name = name[:i]
+	}
+	return false
+}
+
+// printSparseWarning reports the paths a reapply had to leave as they
+// were.
+func printSparseWarning(msg string, paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	sort.Strings(paths)
+	fmt.Fprintf(os.Stderr, "warning: %s\n", msg)
+	for _, path := range paths {
+		fmt.Fprintf(os.Stderr, "\t%s\n", path)
+	}
+	fmt.Fprintln(os.Stderr, "\nAfter fixing the above paths, you may want to run `git sparse-checkout reapply`.")
+}
+
+// reapplySparsePatterns updates the working tree to the patterns: files
+// now outside them are removed and marked skip-worktree, files inside
+// them are checked out again. Files with changes and conflicts are left
+// alone, as are files in the way of ones coming back.
+func reapplySparsePatterns(cfg *config, sp *sparsePatterns) error {
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	var leaving []indexEntry
+	for _, e := range entries {
+		if e.stage() == 0 && e.extFlags&indexSkipWorktree == 0 && !sp.includes(e.path) {
+			leaving = append(leaving, e)
+		}
+	}
+	work, err := worktreeFiles(cfg, leaving)
+	if err != nil {
+		return err
+	}
+
+	var notUpToDate, unmerged, present []string
+	seenUnmerged := make(map[string]bool)
+	for i := range entries {
+		e := &entries[i]
+		in := sp.includes(e.path)
+		switch {
+		case e.stage() != 0:
+			if !in && !seenUnmerged[e.path] {
+				seenUnmerged[e.path] = true
+				unmerged = append(unmerged, e.path)
+			}
+		case !in && e.extFlags&indexSkipWorktree == 0:
+			if f, ok := work[e.path]; ok && (f.mode != e.mode || f.hash != e.hash) {
+				notUpToDate = append(notUpToDate, e.path)
+				continue
+			}
+			if err := removeWorktreeFile(e.path); err != nil {
+				return err
+			}
+			e.extFlags |= indexSkipWorktree
+		case in && e.extFlags&indexSkipWorktree != 0:
+			e.extFlags &^= indexSkipWorktree
+			if _, err := os.Lstat(e.path); err == nil {
+				present = append(present, e.path)
+				continue
+			}
+			file := diffEntry{mode: e.mode, hash: e.hash}
+			if err := writeWorktreeFile(e.path, file); err != nil {
+				return err
+			}
+			updated, err := newIndexEntry(e.path, 0, file)
+			if err != nil {
+				return err
+			}
+			*e = updated
+		}
+	}
+
+	printSparseWarning("The following paths are not up to date and were left despite sparse patterns:", notUpToDate)
+	printSparseWarning("The following paths are unmerged and were left despite sparse patterns:", unmerged)
+	printSparseWarning("The following paths were already present and thus not updated despite sparse patterns:", present)
+	return writeIndex(entries)
+}
+
+func runSparseCheckout(args []string) error {
+	if len(args) == 0 || args[0] != "reapply" && args[0] != "list" {
+		return fmt.Errorf("usage: mygit sparse-checkout (reapply [--[no-]cone] | list)")
+	}
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	sparse, err := cfg.getBool("core.sparseCheckout", false)
+	if err != nil {
+		return err
+	}
+	cone, err := cfg.getBool("core.sparseCheckoutCone", false)
+	if err != nil {
+		return err
+	}
+
+	if args[0] == "list" {
+		if len(args) > 1 {
+			return fmt.Errorf("unknown option %s", args[1])
+		}
+		if !sparse {
+			return fmt.Errorf("this worktree is not sparse")
+		}
+		if _, err := os.Stat(sparseCheckoutFile()); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: this worktree is not sparse (sparse-checkout file may not exist)")
+			return nil
+		}
+		sp, err := loadSparsePatterns(cone)
+		if err != nil {
+			return err
+		}
+		if !sp.cone {
+			for _, line := range sp.lines {
+				fmt.Println(line)
+			}
+			return nil
+		}
+		var dirs []string
+		for dir := range sp.recursive {
+			dirs = append(dirs, dir)
+		}
+		sort.Strings(dirs)
+		for _, dir := range dirs {
+			fmt.Println(dir)
+		}
+		return nil
+	}
+
+	setCone := ""
+	for _, arg := range args[1:] {
+		switch arg {
+		case "--cone":
+			cone, setCone = true, "true"
+		case "--no-cone":
+			cone, setCone = false, "false"
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+	if !sparse {
+		return fmt.Errorf("must be in a sparse-checkout to reapply sparsity patterns")
+	}
+	if setCone != "" {
+		if err := setConfigValue(configFile, "core.sparseCheckoutCone", setCone); err != nil {
+			return err
+		}
+	}
+	sp, err := loadSparsePatterns(cone)
+	if err != nil {
+		return err
+	}
+	return reapplySparsePatterns(cfg, sp)
+}
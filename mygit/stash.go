@@ -0,0 +1,630 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const stashRef = "refs/stash"
+
+// stashInfo describes a stash entry. The stash commit w holds the working
+// tree; its parents are the commit the stash was made on, a commit holding
+// the index and, if untracked files were stashed, a root commit holding
+// them.
+type stashInfo struct {
+	revision  string
+	w         objectID
+	base      objectID
+	index     objectID
+	untracked objectID
+	// entry is the position of the stash in the refs/stash reflog, or -1
+	// if revision names some other commit.
+	entry int
+}
+
+// readStash looks up a stash given as "stash@{<n>}", just <n>, or any
+// stash-like commit. The default is the latest stash.
+func readStash(args []string) (*stashInfo, error) {
+	if len(args) > 1 {
+		return nil, fmt.Errorf("Too many revisions specified: %s", strings.Join(args, " "))
+	}
+	revision := "refs/stash@{0}"
+	if len(args) == 1 {
+		revision = args[0]
+		if _, err := strconv.Atoi(revision); err == nil {
+			revision = "refs/stash@{" + revision + "}"
+		}
+	} else if _, err := resolveRef(stashRef); errors.Is(err, errRefNotFound) {
+		return nil, fmt.Errorf("No stash entries found.")
+	}
+
+	hash, err := resolveRevision(revision)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a valid reference", revision)
+	}
+	c, err := readCommit(hash)
+	if err != nil || len(c.parents) < 2 || len(c.parents) > 3 {
+		return nil, fmt.Errorf("'%s' is not a stash-like commit", revision)
+	}
+	info := &stashInfo{revision: revision, w: hash, base: c.parents[0], index: c.parents[1], entry: -1}
+	if len(c.parents) == 3 {
+		info.untracked = c.parents[2]
+	}
+	if base, n, ok := parseReflogSelector(revision); ok {
+		if ref, err := reflogRefName(base); err == nil && ref == stashRef {
+			info.entry = n
+		}
+	}
+	return info, nil
+}
+
+// dropStash removes a stash from the refs/stash reflog. The entry after it
+// then starts where the one before it ended, and refs/stash goes away
+// with the last entry.
+func dropStash(info *stashInfo, quiet bool) error {
+	if info.entry < 0 {
+		return fmt.Errorf("'%s' is not a stash reference", info.revision)
+	}
+	entries, err := readReflog(stashRef)
+	if err != nil {
+		return err
+	}
+	i := len(entries) - 1 - info.entry
+	if i < 0 {
+		return fmt.Errorf("%s is not a valid reference", info.revision)
+	}
+
+	tx := newRefTransaction()
+	if len(entries) == 1 {
+		tx.delete(stashRef)
+	} else {
+		kept := slices.Delete(entries, i, i+1)
+		if i < len(kept) {
+			kept[i].old = objectID{}
+			if i > 0 {
+				kept[i].old = kept[i-1].new
+			}
+		}
+		tx.setReflog(stashRef, kept)
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Printf("Dropped %s (%s)\n", info.revision, info.w)
+	}
+	return nil
+}
+
+// showStash prints the changes a stash records against the commit it was
+// made on, as a diffstat unless stash.showStat and stash.showPatch or the
+// options say otherwise.
+func showStash(cfg *config, args []string) error {
+	opts, err := configDiffOptions(cfg)
+	if err != nil {
+		return err
+	}
+	var revs []string
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "-") {
+			revs = append(revs, arg)
+			continue
+		}
+		if ok, err := parseDiffFormatOption(arg, opts); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+	if !opts.hasFormat() {
+		if opts.stat, err = cfg.getBool("stash.showStat", true); err != nil {
+			return err
+		}
+		if opts.patch, err = cfg.getBool("stash.showPatch", false); err != nil {
+			return err
+		}
+	}
+
+	info, err := readStash(revs)
+	if err != nil {
+		return err
+	}
+	old, err := commitFiles(info.base)
+	if err != nil {
+		return err
+	}
+	new, err := commitFiles(info.w)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+	return writeDiff(out, diffFiles(old, new, nil, nil), opts)
+}
+
+// stashBranch creates a branch at the commit a stash was made on, checks
+// it out with the stash applied and drops the stash. Changes that were
+// staged when stashing are staged again.
+func stashBranch(cfg *config, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("No branch name specified")
+	}
+	name, ref := args[0], "refs/heads/"+args[0]
+	info, err := readStash(args[1:])
+	if err != nil {
+		return err
+	}
+	if _, err := resolveRef(ref); err == nil {
+		return fmt.Errorf("a branch named '%s' already exists", name)
+	} else if !errors.Is(err, errRefNotFound) {
+		return err
+	}
+
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	head, err := headFiles()
+	if err != nil {
+		return err
+	}
+	indexed, err := commitFiles(info.index)
+	if err != nil {
+		return err
+	}
+	work, err := commitFiles(info.w)
+	if err != nil {
+		return err
+	}
+	untracked := map[string]diffEntry{}
+	if info.untracked != (objectID{}) {
+		if untracked, err = commitFiles(info.untracked); err != nil {
+			return err
+		}
+	}
+
+	// Going from HEAD straight to the stashed state is the same as
+	// checking out the stash's commit and applying the stash on it.
+	updates := make(map[string]pathUpdate)
+	for _, files := range []map[string]diffEntry{head, indexed, work} {
+		for path := range files {
+			i, w := indexed[path], work[path]
+			if sameFile(i, head[path]) && sameFile(w, head[path]) {
+				continue
+			}
+			u := pathUpdate{file: w}
+			if !sameFile(i, w) {
+				u.unstaged, u.staged = true, i
+			}
+			updates[path] = u
+		}
+	}
+	if err := checkWorktree(cfg, entries, head, updates, "checkout"); err != nil {
+		return err
+	}
+	for path := range untracked {
+		if _, err := os.Lstat(path); err == nil {
+			return fmt.Errorf("%s already exists, no checkout\ncould not restore untracked files from stash", path)
+		}
+	}
+
+	if entries, err = applyUpdates(entries, updates); err != nil {
+		return err
+	}
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+	for path, file := range untracked {
+		if err := writeWorktreeFile(path, file); err != nil {
+			return err
+		}
+	}
+
+	// The reflog names a detached HEAD by its commit.
+	from, err := symrefTarget("HEAD")
+	if err != nil {
+		return err
+	}
+	if from == "HEAD" {
+		hash, err := resolveRef("HEAD")
+		if err != nil {
+			return err
+		}
+		from = hash.String()
+	}
+	tx := newRefTransaction()
+	tx.updateFrom(ref, objectID{}, info.base, "branch: Created from "+info.base.String())
+	tx.symref("HEAD", ref, fmt.Sprintf("checkout: moving from %s to %s", strings.TrimPrefix(from, "refs/heads/"), name))
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Switched to a new branch '%s'\n", name)
+
+	if info.entry < 0 {
+		return nil
+	}
+	return dropStash(info, false)
+}
+
+// stashPush saves the index and the changes to tracked files as a new
+// stash and resets them to HEAD. With keepIndex, the index and the
+// working tree are reset to the index instead. In patch mode, only the
+// hunks the user picks are stashed and undone in the working tree.
+func stashPush(cfg *config, args []string) error {
+	var message string
+	keepIndex, quiet, patch := false, false, false
+	// Patch mode keeps the index unless told otherwise.
+	keepIndexGiven := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "-m" || arg == "--message":
+			if i+1 == len(args) {
+				return fmt.Errorf("switch 'm' requires a value")
+			}
+			i++
+			message = args[i]
+		case strings.HasPrefix(arg, "--message="):
+			message = strings.TrimPrefix(arg, "--message=")
+		case strings.HasPrefix(arg, "-m"):
+			message = strings.TrimPrefix(arg, "-m")
+		case arg == "-k" || arg == "--keep-index":
+			keepIndex, keepIndexGiven = true, true
+		case arg == "--no-keep-index":
+			keepIndex, keepIndexGiven = false, true
+		case arg == "-p" || arg == "--patch":
+			patch = true
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	head, err := resolveRef("HEAD")
+	if errors.Is(err, errRefNotFound) {
+		return fmt.Errorf("You do not have the initial commit yet")
+	} else if err != nil {
+		return err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+	indexed, unmerged := indexFiles(entries)
+	if len(unmerged) > 0 {
+		var paths []string
+		for path := range unmerged {
+			paths = append(paths, path)
+		}
+		slices.Sort(paths)
+		return fmt.Errorf("%s: needs merge\ncould not save index tree", paths[0])
+	}
+	headFiles, err := commitFiles(head)
+	if err != nil {
+		return err
+	}
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return err
+	}
+	if len(diffFiles(headFiles, indexed, nil, nil)) == 0 && len(diffFiles(indexed, work, nil, nil)) == 0 {
+		if !quiet {
+			fmt.Println("No local changes to save")
+		}
+		return nil
+	}
+
+	// In patch mode, only the picked hunks are stashed and taken out of
+	// the working tree.
+	stashed, remaining := work, map[string]diffEntry{}
+	if patch {
+		if !keepIndexGiven {
+			keepIndex = true
+		}
+		files, err := runPatchSession(cfg, patchModeStash, diffFiles(headFiles, work, nil, nil))
+		if err != nil {
+			return err
+		}
+		picked, err := patchResults(files, false)
+		if err != nil {
+			return err
+		}
+		if len(picked) == 0 {
+			return fmt.Errorf("No changes selected")
+		}
+		if remaining, err = patchResults(files, true); err != nil {
+			return err
+		}
+		stashed = make(map[string]diffEntry)
+		for path, file := range headFiles {
+			stashed[path] = file
+		}
+		for path, file := range picked {
+			if file.mode == 0 {
+				delete(stashed, path)
+			} else {
+				stashed[path] = file
+			}
+		}
+	}
+
+	c, err := readCommit(head)
+	if err != nil {
+		return err
+	}
+	branch, err := symrefTarget("HEAD")
+	if err != nil {
+		return err
+	}
+	if branch == "HEAD" {
+		branch = "(no branch)"
+	}
+	branch = strings.TrimPrefix(branch, "refs/heads/")
+	onto := fmt.Sprintf("%s: %s %s", branch, shortHash(head), commitSubject(c.message))
+
+	indexTree, err := writeFilesTree(indexed)
+	if err != nil {
+		return err
+	}
+	indexCommit, err := commitTree(indexTree, []objectID{head}, "index on "+onto+"\n")
+	if err != nil {
+		return err
+	}
+	// Changed files were only hashed so far.
+	for _, file := range stashed {
+		if file.data != nil {
+			if _, err := storeObject(blobObject, file.data); err != nil {
+				return err
+			}
+		}
+	}
+	workTree, err := writeFilesTree(stashed)
+	if err != nil {
+		return err
+	}
+	summary := "WIP on " + onto
+	if message != "" {
+		summary = fmt.Sprintf("On %s: %s", branch, message)
+	}
+	stash, err := commitTree(workTree, []objectID{head, indexCommit}, summary)
+	if err != nil {
+		return err
+	}
+
+	// Stashes are always logged, as the reflog is the stack.
+	logged, err := readReflog(stashRef)
+	if err != nil {
+		return err
+	}
+	old, err := resolveRef(stashRef)
+	if err != nil && !errors.Is(err, errRefNotFound) {
+		return err
+	}
+	tx := newRefTransaction()
+	tx.setReflog(stashRef, append(logged, reflogEntry{
+		old: old, new: stash, ident: reflogIdentity(cfg), message: strings.Join(strings.Fields(summary), " "),
+	}))
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if !quiet {
+		fmt.Printf("Saved working directory and index state %s\n", summary)
+	}
+
+	if patch {
+		if entries, err = restoreWorktree(cfg, entries, remaining); err != nil {
+			return err
+		}
+		if !keepIndex {
+			reset := make(map[string]diffEntry)
+			for path := range indexed {
+				reset[path] = headFiles[path]
+			}
+			for path, file := range headFiles {
+				reset[path] = file
+			}
+			if entries, err = restoreIndex(entries, reset); err != nil {
+				return err
+			}
+		}
+		return writeIndex(entries)
+	}
+	if keepIndex {
+		return resetWorktree(cfg, indexed)
+	}
+	return resetWorktree(cfg, headFiles)
+}
+
+// listStashes prints the stashes, latest first.
+func listStashes(args []string) error {
+	if len(args) > 0 {
+		return fmt.Errorf("unknown option %s", args[0])
+	}
+	entries, err := readReflog(stashRef)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	for i := range entries {
+		fmt.Fprintf(out, "stash@{%d}: %s\n", i, entries[len(entries)-1-i].message)
+	}
+	return out.Flush()
+}
+
+// applyStash merges the changes of a stash into the working tree, with
+// the commit it was made on as the base. The changes are left unstaged,
+// except for new files; with restoreIndex, the changes that were staged
+// are staged again. It reports whether the merge had conflicts.
+func applyStash(cfg *config, info *stashInfo, restoreIndex bool) (bool, error) {
+	entries, err := readIndex()
+	if err != nil {
+		return false, err
+	}
+	ours, unmerged := indexFiles(entries)
+	if len(unmerged) > 0 {
+		return false, fmt.Errorf("Cannot apply a stash in the middle of a merge")
+	}
+	base, err := commitFiles(info.base)
+	if err != nil {
+		return false, err
+	}
+	stashed, err := commitFiles(info.w)
+	if err != nil {
+		return false, err
+	}
+	style, err := mergeConflictStyle(cfg)
+	if err != nil {
+		return false, err
+	}
+	var out bytes.Buffer
+	m := &treeMerge{
+		opts: mergeFileOptions{
+			base:       "Stash base",
+			ours:       "Updated upstream",
+			theirs:     "Stashed changes",
+			style:      style,
+			markerSize: defaultConflictMarkerSize,
+		},
+		out: &out,
+	}
+
+	// The staged changes go into the index first, and must apply cleanly.
+	staged := ours
+	if restoreIndex && info.index != info.base {
+		indexed, err := commitFiles(info.index)
+		if err != nil {
+			return false, err
+		}
+		result, conflicts, err := m.mergeFiles(base, ours, indexed)
+		if err != nil {
+			return false, err
+		}
+		if conflicts > 0 {
+			return false, fmt.Errorf("Conflicts in index. Try without --index.")
+		}
+		staged = make(map[string]diffEntry)
+		for path, u := range result {
+			staged[path] = u.file
+		}
+		out.Reset()
+	}
+
+	untracked := map[string]diffEntry{}
+	if info.untracked != (objectID{}) {
+		if untracked, err = commitFiles(info.untracked); err != nil {
+			return false, err
+		}
+	}
+	for path := range untracked {
+		if _, err := os.Lstat(path); err == nil {
+			return false, fmt.Errorf("%s already exists, no checkout\ncould not restore untracked files from stash", path)
+		}
+	}
+
+	result, conflicts, err := m.mergeFiles(base, ours, stashed)
+	if err != nil {
+		return false, err
+	}
+	updates := mergeUpdates(ours, result)
+	if conflicts == 0 {
+		// Only new files stay in the index, unless restoring it.
+		for path, u := range updates {
+			file, ok := staged[path]
+			if !ok && !restoreIndex {
+				continue
+			}
+			if !sameFile(file, u.file) {
+				updates[path] = pathUpdate{file: u.file, unstaged: true, staged: file}
+			}
+		}
+	}
+	if err := checkoutUpdates(cfg, entries, ours, updates); err != nil {
+		return false, err
+	}
+	for path, file := range untracked {
+		if err := writeWorktreeFile(path, file); err != nil {
+			return false, err
+		}
+	}
+	if conflicts > 0 {
+		os.Stdout.Write(out.Bytes())
+	}
+	return conflicts > 0, nil
+}
+
+// runStashApply applies a stash and, for pop, drops it unless the merge
+// had conflicts.
+func runStashApply(cfg *config, args []string, pop bool) error {
+	var revs []string
+	restoreIndex, quiet := false, false
+	for _, arg := range args {
+		switch {
+		case arg == "--index":
+			restoreIndex = true
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			revs = append(revs, arg)
+		}
+	}
+	info, err := readStash(revs)
+	if err != nil {
+		return err
+	}
+	conflicts, err := applyStash(cfg, info, restoreIndex)
+	if err != nil {
+		return err
+	}
+	if conflicts {
+		if pop {
+			fmt.Fprintln(os.Stderr, "The stash entry is kept in case you need it again.")
+		}
+		os.Exit(1)
+	}
+	if !pop {
+		return nil
+	}
+	return dropStash(info, quiet)
+}
+
+func runStash(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return stashPush(cfg, args)
+	}
+	switch args[0] {
+	case "push":
+		return stashPush(cfg, args[1:])
+	case "list":
+		return listStashes(args[1:])
+	case "apply":
+		return runStashApply(cfg, args[1:], false)
+	case "pop":
+		return runStashApply(cfg, args[1:], true)
+	case "drop":
+		info, err := readStash(args[1:])
+		if err != nil {
+			return err
+		}
+		return dropStash(info, false)
+	case "show":
+		return showStash(cfg, args[1:])
+	case "branch":
+		return stashBranch(cfg, args[1:])
+	}
+	return fmt.Errorf("unknown subcommand: %s\nusage: mygit stash list\n   or: mygit stash show [<options>] [<stash>]\n"+
+		"   or: mygit stash drop [<stash>]\n   or: mygit stash (pop | apply) [--index] [<stash>]\n"+
+		"   or: mygit stash branch <branchname> [<stash>]\n   or: mygit stash [push [-k] [-q] [-m <message>]]", args[0])
+}
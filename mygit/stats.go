@@ -0,0 +1,259 @@
+package mygit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const defaultStatsTop = 10
+
+// typeStats counts the objects of one type and what they take up.
+type typeStats struct {
+	Count    int   `json:"count"`
+	Size     int64 `json:"size"`
+	DiskSize int64 `json:"disk_size"`
+}
+
+// depthBucket counts the objects whose delta chain is between Min and Max
+// deltas long.
+type depthBucket struct {
+	Min   int `json:"min"`
+	Max   int `json:"max"`
+	Count int `json:"count"`
+}
+
+type largeObject struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	Name string `json:"name,omitempty"`
+}
+
+// repoStats are the statistics reported by stats.
+type repoStats struct {
+	Objects       map[string]*typeStats `json:"objects"`
+	Total         typeStats             `json:"total"`
+	Deltas        int                   `json:"deltas"`
+	MaxDepth      int                   `json:"max_delta_depth"`
+	Depths        []depthBucket         `json:"delta_depths"`
+	LargestBlobs  []largeObject         `json:"largest_blobs"`
+	LargestTrees  []largeObject         `json:"largest_trees"`
+	Refs          map[string]int        `json:"refs"`
+	Commits       int                   `json:"commits"`
+	GraphCommits  int                   `json:"commit_graph_commits"`
+	GraphCoverage float64               `json:"commit_graph_coverage"`
+}
+
+// refCategory names the kind of ref a stats report counts it as.
+func refCategory(ref string) string {
+	switch {
+	case strings.HasPrefix(ref, "refs/heads/"):
+		return "branches"
+	case strings.HasPrefix(ref, "refs/remotes/"):
+		return "remotes"
+	case strings.HasPrefix(ref, "refs/tags/"):
+		return "tags"
+	case strings.HasPrefix(ref, "refs/notes/"):
+		return "notes"
+	case ref == stashRef:
+		return "stash"
+	}
+	return "other"
+}
+
+// depthBuckets groups delta chain lengths: no delta, one, then doubling
+// ranges up to the longest chain.
+func depthBuckets(depths map[int]int, maxDepth int) []depthBucket {
+	buckets := []depthBucket{{Min: 0, Max: 0}}
+	for lo := 1; lo <= maxDepth; lo *= 2 {
+		buckets = append(buckets, depthBucket{Min: lo, Max: 2*lo - 1})
+	}
+	for depth, n := range depths {
+		for i := range buckets {
+			if depth >= buckets[i].Min && depth <= buckets[i].Max {
+				buckets[i].Count += n
+			}
+		}
+	}
+	return buckets
+}
+
+// largest returns the top n of objects by size, biggest first.
+func largest(objects []largeObject, n int) []largeObject {
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].Size != objects[j].Size {
+			return objects[i].Size > objects[j].Size
+		}
+		return objects[i].Hash < objects[j].Hash
+	})
+	return objects[:min(n, len(objects))]
+}
+
+// collectStats gathers the statistics of every object in the repository,
+// naming the largest trees and blobs after the entry the refs reach them
+// through.
+func collectStats(top int) (*repoStats, error) {
+	s := &repoStats{Objects: make(map[string]*typeStats), Refs: make(map[string]int)}
+	for _, objType := range []string{commitObject, treeObject, blobObject, tagObject} {
+		s.Objects[objType] = &typeStats{}
+	}
+
+	tips, err := refTips()
+	if err != nil {
+		return nil, err
+	}
+	names, err := reachableNames(tips, true)
+	if err != nil {
+		return nil, err
+	}
+	graph := loadCommitGraph()
+
+	depths := make(map[int]int)
+	blobs, trees := []largeObject{}, []largeObject{}
+	err = forEachObject("", func(hash objectID, info *objectInfo) error {
+		t, ok := s.Objects[info.objType]
+		if !ok {
+			return nil
+		}
+		t.Count++
+		t.Size += info.size
+		t.DiskSize += info.diskSize
+		depths[info.deltaDepth]++
+		if info.deltaDepth > 0 {
+			s.Deltas++
+		}
+		s.MaxDepth = max(s.MaxDepth, info.deltaDepth)
+
+		obj := largeObject{Hash: hash.String(), Size: info.size, Name: names[hash]}
+		switch info.objType {
+		case blobObject:
+			blobs = append(blobs, obj)
+		case treeObject:
+			trees = append(trees, obj)
+		case commitObject:
+			if graph != nil {
+				if _, ok := graph.find(hash); ok {
+					s.GraphCommits++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, t := range s.Objects {
+		s.Total.Count += t.Count
+		s.Total.Size += t.Size
+		s.Total.DiskSize += t.DiskSize
+	}
+	s.Depths = depthBuckets(depths, s.MaxDepth)
+	s.LargestBlobs = largest(blobs, top)
+	s.LargestTrees = largest(trees, top)
+
+	refs, err := listRefs()
+	if err != nil {
+		return nil, err
+	}
+	for ref := range refs {
+		s.Refs[refCategory(ref)]++
+	}
+	s.Commits = s.Objects[commitObject].Count
+	if s.Commits > 0 {
+		s.GraphCoverage = float64(s.GraphCommits) / float64(s.Commits)
+	}
+	return s, nil
+}
+
+// printStats writes the human form of s, with sizes in bytes unless
+// human is set.
+func printStats(s *repoStats, human bool) {
+	size := func(n int64) string {
+		if human {
+			return humanizeBytes(n)
+		}
+		return strconv.FormatInt(n, 10)
+	}
+
+	fmt.Println("objects:")
+	for _, objType := range []string{commitObject, treeObject, blobObject, tagObject} {
+		t := s.Objects[objType]
+		fmt.Printf("  %ss: %d (size %s, on disk %s)\n", objType, t.Count, size(t.Size), size(t.DiskSize))
+	}
+	fmt.Printf("  total: %d (size %s, on disk %s)\n", s.Total.Count, size(s.Total.Size), size(s.Total.DiskSize))
+
+	fmt.Println("delta chains:")
+	fmt.Printf("  deltas: %d\n", s.Deltas)
+	fmt.Printf("  max depth: %d\n", s.MaxDepth)
+	for _, b := range s.Depths {
+		if b.Min == b.Max {
+			fmt.Printf("  depth %d: %d\n", b.Min, b.Count)
+		} else {
+			fmt.Printf("  depth %d-%d: %d\n", b.Min, b.Max, b.Count)
+		}
+	}
+
+	for _, list := range []struct {
+		title   string
+		objects []largeObject
+	}{{"largest blobs", s.LargestBlobs}, {"largest trees", s.LargestTrees}} {
+		fmt.Printf("%s:\n", list.title)
+		for _, obj := range list.objects {
+			fmt.Printf("  %s %s", obj.Hash, size(obj.Size))
+			if obj.Name != "" {
+				fmt.Printf(" %s", obj.Name)
+			}
+			fmt.Println()
+		}
+	}
+
+	fmt.Println("refs:")
+	var categories []string
+	for category := range s.Refs {
+		categories = append(categories, category)
+	}
+	sort.Strings(categories)
+	for _, category := range categories {
+		fmt.Printf("  %s: %d\n", category, s.Refs[category])
+	}
+
+	fmt.Println("commit-graph:")
+	fmt.Printf("  %d of %d commits (%.1f%%)\n", s.GraphCommits, s.Commits, 100*s.GraphCoverage)
+}
+
+func runStats(args []string) error {
+	asJSON, human := false, false
+	top := defaultStatsTop
+	for _, arg := range args {
+		switch {
+		case arg == "--json":
+			asJSON = true
+		case arg == "-H" || arg == "--human-readable":
+			human = true
+		case strings.HasPrefix(arg, "--top="):
+			n, err := strconv.Atoi(strings.TrimPrefix(arg, "--top="))
+			if err != nil || n < 0 {
+				return fmt.Errorf("invalid value for %s", arg)
+			}
+			top = n
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+
+	s, err := collectStats(top)
+	if err != nil {
+		return err
+	}
+	if !asJSON {
+		printStats(s, human)
+		return nil
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
@@ -0,0 +1,631 @@
+package mygit
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// statusEntry is a changed path with the two-letter code of the short
+// format: how the index differs from HEAD, then how the working tree
+// differs from the index. Unmerged paths use codes with a U or doubled
+// letters.
+type statusEntry struct {
+	path string
+	// from is the source of a rename or copy.
+	from string
+	x, y byte
+	// submodule says how a checked out submodule differs from its
+	// index entry, when submodules are looked into.
+	submodule string
+}
+
+// repoStatus is what status reports.
+type repoStatus struct {
+	// branch is the checked out branch, or "HEAD" when detached.
+	branch  string
+	head    objectID
+	merging bool
+	// tracking compares the branch to its upstream.
+	tracking *trackingInfo
+	entries  []statusEntry
+	// untracked and ignored list files, and directories with a trailing
+	// slash when all of their content is.
+	untracked []string
+	ignored   []string
+}
+
+// statusOptions select what status looks at.
+type statusOptions struct {
+	// untracked is "no", "normal" or "all".
+	untracked string
+	ignored   bool
+	renames   bool
+	copies    bool
+	// aheadBehind counts the commits the branch and its upstream have
+	// that the other does not.
+	aheadBehind bool
+	// submodules looks into checked out submodules for new commits and
+	// changes.
+	submodules bool
+}
+
+// unmergedCodes are the short codes of conflicts by the stages present:
+// 1 for the base, 2 for ours and 4 for theirs.
+var unmergedCodes = [8]string{1: "DD", 2: "AU", 3: "UD", 4: "UA", 5: "DU", 6: "AA", 7: "UU"}
+
+var unmergedLabels = map[string]string{
+	"DD": "both deleted:",
+	"AU": "added by us:",
+	"UD": "deleted by them:",
+	"UA": "added by them:",
+	"DU": "deleted by us:",
+	"AA": "both added:",
+	"UU": "both modified:",
+}
+
+var changeLabels = map[byte]string{
+	'M': "modified:",
+	'A': "new file:",
+	'D': "deleted:",
+	'R': "renamed:",
+	'C': "copied:",
+	'T': "typechange:",
+}
+
+// changeCode returns the letter for how a file changed.
+func changeCode(old, new diffEntry) byte {
+	switch {
+	case old.mode == 0:
+		return 'A'
+	case new.mode == 0:
+		return 'D'
+	case old.mode&modeTypeMask != new.mode&modeTypeMask:
+		return 'T'
+	}
+	return 'M'
+}
+
+// collapseDirs replaces the files of each topmost directory that keep
+// does not reject with the directory itself.
+func collapseDirs(files []string, keep func(dir string) bool) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, f := range files {
+		name := f
+		for i := 0; i < len(f)-1; i++ {
+			if f[i] == '/' && !keep(f[:i]) {
+				name = f[:i+1]
+				break
+			}
+		}
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// parentDirs returns the directories holding any of paths.
+func parentDirs(paths []string) map[string]bool {
+	dirs := make(map[string]bool)
+	for _, p := range paths {
+		for i := 0; i < len(p)-1; i++ {
+			if p[i] == '/' {
+				dirs[p[:i]] = true
+			}
+		}
+	}
+	return dirs
+}
+
+// collectStatus compares HEAD, the index and the working tree below paths.
+func collectStatus(cfg *config, paths []string, opts statusOptions) (*repoStatus, error) {
+	s := &repoStatus{}
+	var err error
+	if s.branch, err = symrefTarget("HEAD"); err != nil {
+		return nil, err
+	}
+	if s.head, err = resolveRef("HEAD"); err != nil && !errors.Is(err, errRefNotFound) {
+		return nil, err
+	}
+	if _, err := resolveRef("MERGE_HEAD"); err == nil {
+		s.merging = true
+	}
+	if s.tracking, err = branchTracking(cfg, s.branch, s.head, opts.aheadBehind); err != nil {
+		return nil, err
+	}
+
+	head, err := headFiles()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return nil, err
+	}
+	indexed, unmerged := indexFiles(entries)
+	work, err := worktreeFiles(cfg, entries)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]*statusEntry)
+	entry := func(path string) *statusEntry {
+		if e, ok := byPath[path]; ok {
+			return e
+		}
+		e := &statusEntry{path: path, x: ' ', y: ' '}
+		byPath[path] = e
+		return e
+	}
+	stages := make(map[string]int)
+	for _, e := range entries {
+		if e.stage() != 0 && matchPathspec(e.path, paths) {
+			stages[e.path] |= 1 << (e.stage() - 1)
+		}
+	}
+	for path, mask := range stages {
+		code := unmergedCodes[mask]
+		e := entry(path)
+		e.x, e.y = code[0], code[1]
+	}
+
+	var staged []diffPair
+	for _, p := range diffFiles(head, indexed, nil, paths) {
+		if !unmerged[p.path] {
+			staged = append(staged, p)
+		}
+	}
+	if opts.renames {
+		var renames []renamePair
+		if staged, renames, err = detectRenames(staged, opts.copies, defaultRenameScore); err != nil {
+			return nil, err
+		}
+		for _, r := range renames {
+			e := entry(r.to)
+			e.from, e.x = r.from, 'R'
+			if r.copied {
+				e.x = 'C'
+			}
+		}
+	}
+	for _, p := range staged {
+		entry(p.path).x = changeCode(p.old, p.new)
+	}
+	for _, p := range diffFiles(indexed, work, nil, paths) {
+		if !unmerged[p.path] {
+			entry(p.path).y = changeCode(p.old, p.new)
+		}
+	}
+	if opts.submodules {
+		for path, file := range indexed {
+			if file.mode != modeGitlink || work[path].mode != modeGitlink || !matchPathspec(path, paths) {
+				continue
+			}
+			code, state, err := submoduleStatus(path, file.hash)
+			if err != nil {
+				return nil, err
+			}
+			if code != ' ' {
+				e := entry(path)
+				e.y, e.submodule = code, state
+			}
+		}
+	}
+	for _, e := range byPath {
+		s.entries = append(s.entries, *e)
+	}
+	sort.Slice(s.entries, func(i, j int) bool { return s.entries[i].path < s.entries[j].path })
+
+	if opts.untracked == "no" {
+		return s, nil
+	}
+	rules, err := loadIgnoreRules(cfg)
+	if err != nil {
+		return nil, err
+	}
+	untracked, ignored, err := listUntracked(entries, paths, rules, opts.untracked == "all")
+	if err != nil {
+		return nil, err
+	}
+	if !opts.ignored {
+		ignored = nil
+	}
+	if opts.untracked == "all" {
+		sort.Strings(untracked)
+		sort.Strings(ignored)
+		s.untracked, s.ignored = untracked, ignored
+		return s, nil
+	}
+	// Directories without tracked files are shown as a whole, and so are
+	// those whose content is all ignored.
+	var trackedPaths []string
+	for _, e := range entries {
+		trackedPaths = append(trackedPaths, e.path)
+	}
+	trackedDirs := parentDirs(trackedPaths)
+	untrackedDirs := parentDirs(untracked)
+	s.untracked = collapseDirs(untracked, func(dir string) bool { return trackedDirs[dir] })
+	s.ignored = collapseDirs(ignored, func(dir string) bool { return trackedDirs[dir] || untrackedDirs[dir] })
+	return s, nil
+}
+
+// writeShortStatus prints the status in the short format, paths quoted
+// unless they are NUL-terminated.
+func writeShortStatus(w io.Writer, s *repoStatus, showBranch, nulTerminated, quoteHigh bool) {
+	end := "\n"
+	quote := func(path string) string { return quotePath(path, quoteHigh) }
+	if nulTerminated {
+		end = "\x00"
+		quote = func(path string) string { return path }
+	}
+	if showBranch {
+		switch {
+		case s.branch == "HEAD":
+			fmt.Fprint(w, "## HEAD (no branch)")
+		case s.head == (objectID{}):
+			fmt.Fprintf(w, "## No commits yet on %s", strings.TrimPrefix(s.branch, "refs/heads/"))
+		default:
+			fmt.Fprintf(w, "## %s", strings.TrimPrefix(s.branch, "refs/heads/"))
+		}
+		if t := s.tracking; s.branch != "HEAD" && t.upstream != "" {
+			fmt.Fprintf(w, "...%s", describeRef(t.upstream))
+			switch {
+			case t.gone:
+				fmt.Fprint(w, " [gone]")
+			case t.different:
+				fmt.Fprint(w, " [different]")
+			case t.ahead > 0 && t.behind > 0:
+				fmt.Fprintf(w, " [ahead %d, behind %d]", t.ahead, t.behind)
+			case t.ahead > 0:
+				fmt.Fprintf(w, " [ahead %d]", t.ahead)
+			case t.behind > 0:
+				fmt.Fprintf(w, " [behind %d]", t.behind)
+			}
+		}
+		fmt.Fprint(w, end)
+	}
+	for _, e := range s.entries {
+		switch {
+		case e.from == "":
+			fmt.Fprintf(w, "%c%c %s%s", e.x, e.y, quote(e.path), end)
+		case nulTerminated:
+			// The source follows the path, with no arrow.
+			fmt.Fprintf(w, "%c%c %s\x00%s\x00", e.x, e.y, e.path, e.from)
+		default:
+			fmt.Fprintf(w, "%c%c %s -> %s\n", e.x, e.y, quote(e.from), quote(e.path))
+		}
+	}
+	for _, path := range s.untracked {
+		fmt.Fprintf(w, "?? %s%s", quote(path), end)
+	}
+	for _, path := range s.ignored {
+		fmt.Fprintf(w, "!! %s%s", quote(path), end)
+	}
+}
+
+// writeLongStatus prints the status the way git does by default, with
+// hints on what to do unless advice.statusHints is off.
+func writeLongStatus(w io.Writer, s *repoStatus, hints, quoteHigh bool, untrackedMode string) {
+	hint := func(msg string) {
+		if hints {
+			fmt.Fprintf(w, "  (%s)\n", msg)
+		}
+	}
+	quote := func(path string) string { return quotePath(path, quoteHigh) }
+	initial := s.head == (objectID{})
+
+	if s.branch == "HEAD" {
+		fmt.Fprintf(w, "HEAD detached at %s\n", shortHash(s.head))
+	} else {
+		fmt.Fprintf(w, "On branch %s\n", strings.TrimPrefix(s.branch, "refs/heads/"))
+		if !initial && s.tracking.upstream != "" {
+			writeTrackingInfo(w, s.tracking, hint)
+			fmt.Fprintln(w)
+		}
+	}
+
+	var staged, conflicts, unstaged []statusEntry
+	for _, e := range s.entries {
+		if unmergedLabels[string([]byte{e.x, e.y})] != "" {
+			conflicts = append(conflicts, e)
+			continue
+		}
+		if e.x != ' ' {
+			staged = append(staged, e)
+		}
+		if e.y != ' ' {
+			unstaged = append(unstaged, e)
+		}
+	}
+	if s.merging {
+		if len(conflicts) > 0 {
+			fmt.Fprintln(w, "You have unmerged paths.")
+			hint(`fix conflicts and run "git commit"`)
+			hint(`use "git merge --abort" to abort the merge`)
+		} else {
+			fmt.Fprintln(w, "All conflicts fixed but you are still merging.")
+			hint(`use "git commit" to conclude merge`)
+		}
+		fmt.Fprintln(w)
+	}
+	if initial {
+		fmt.Fprint(w, "\nNo commits yet\n\n")
+	}
+
+	unstageHint := func() {
+		switch {
+		case s.merging:
+		case initial:
+			hint(`use "git rm --cached <file>..." to unstage`)
+		default:
+			hint(`use "git restore --staged <file>..." to unstage`)
+		}
+	}
+	if len(staged) > 0 {
+		fmt.Fprintln(w, "Changes to be committed:")
+		unstageHint()
+		for _, e := range staged {
+			if e.from != "" {
+				fmt.Fprintf(w, "\t%-12s%s -> %s\n", changeLabels[e.x], quote(e.from), quote(e.path))
+			} else {
+				fmt.Fprintf(w, "\t%-12s%s\n", changeLabels[e.x], quote(e.path))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	if len(conflicts) > 0 {
+		fmt.Fprintln(w, "Unmerged paths:")
+		unstageHint()
+		bothDeleted, deleteConflict, notDeleted := false, false, false
+		for _, e := range conflicts {
+			switch string([]byte{e.x, e.y}) {
+			case "DD":
+				bothDeleted = true
+			case "UD", "DU":
+				deleteConflict = true
+			default:
+				notDeleted = true
+			}
+		}
+		switch {
+		case !bothDeleted && !deleteConflict:
+			hint(`use "git add <file>..." to mark resolution`)
+		case bothDeleted && !deleteConflict && !notDeleted:
+			hint(`use "git rm <file>..." to mark resolution`)
+		default:
+			hint(`use "git add/rm <file>..." as appropriate to mark resolution`)
+		}
+		for _, e := range conflicts {
+			fmt.Fprintf(w, "\t%-17s%s\n", unmergedLabels[string([]byte{e.x, e.y})], quote(e.path))
+		}
+		fmt.Fprintln(w)
+	}
+	if len(unstaged) > 0 {
+		fmt.Fprintln(w, "Changes not staged for commit:")
+		deleted := false
+		for _, e := range unstaged {
+			deleted = deleted || e.y == 'D'
+		}
+		if deleted {
+			hint(`use "git add/rm <file>..." to update what will be committed`)
+		} else {
+			hint(`use "git add <file>..." to update what will be committed`)
+		}
+		hint(`use "git restore <file>..." to discard changes in working directory`)
+		if slices.ContainsFunc(unstaged, func(e statusEntry) bool { return strings.Contains(e.submodule, "content") }) {
+			hint("commit or discard the untracked or modified content in submodules")
+		}
+		for _, e := range unstaged {
+			if e.submodule != "" {
+				fmt.Fprintf(w, "\t%-12s%s (%s)\n", changeLabels['M'], quote(e.path), e.submodule)
+			} else {
+				fmt.Fprintf(w, "\t%-12s%s\n", changeLabels[e.y], quote(e.path))
+			}
+		}
+		fmt.Fprintln(w)
+	}
+	if len(s.untracked) > 0 {
+		fmt.Fprintln(w, "Untracked files:")
+		hint(`use "git add <file>..." to include in what will be committed`)
+		for _, path := range s.untracked {
+			fmt.Fprintf(w, "\t%s\n", quote(path))
+		}
+		fmt.Fprintln(w)
+	}
+	if len(s.ignored) > 0 {
+		fmt.Fprintln(w, "Ignored files:")
+		hint(`use "git add -f <file>..." to include in what will be committed`)
+		for _, path := range s.ignored {
+			fmt.Fprintf(w, "\t%s\n", quote(path))
+		}
+		fmt.Fprintln(w)
+	}
+
+	// Without staged changes, say why there is nothing to commit.
+	final := func(msg, advice string) {
+		if hints && advice != "" {
+			msg += " (" + advice + ")"
+		}
+		fmt.Fprintln(w, msg)
+	}
+	switch {
+	case len(staged) > 0 && untrackedMode == "no":
+		final("Untracked files not listed", "use -u option to show untracked files")
+	case len(staged) > 0:
+	case len(unstaged) > 0 || len(conflicts) > 0:
+		final("no changes added to commit", `use "git add" and/or "git commit -a"`)
+	case len(s.untracked) > 0:
+		final("nothing added to commit but untracked files present", `use "git add" to track`)
+	case initial:
+		final("nothing to commit", `create/copy files and use "git add" to track`)
+	case untrackedMode == "no":
+		final("nothing to commit", "use -u to show untracked files")
+	default:
+		final("nothing to commit, working tree clean", "")
+	}
+}
+
+// writeTrackingInfo says how the branch compares to its upstream.
+func writeTrackingInfo(w io.Writer, t *trackingInfo, hint func(msg string)) {
+	upstream := describeRef(t.upstream)
+	commits := func(n int) string {
+		if n == 1 {
+			return "1 commit"
+		}
+		return fmt.Sprintf("%d commits", n)
+	}
+	switch {
+	case t.gone:
+		fmt.Fprintf(w, "Your branch is based on '%s', but the upstream is gone.\n", upstream)
+		hint(`use "git branch --unset-upstream" to fixup`)
+	case t.different:
+		fmt.Fprintf(w, "Your branch and '%s' refer to different commits.\n", upstream)
+		hint(`use "git status --ahead-behind" for details`)
+	case t.ahead > 0 && t.behind > 0:
+		fmt.Fprintf(w, "Your branch and '%s' have diverged,\nand have %d and %d different commits each, respectively.\n",
+			upstream, t.ahead, t.behind)
+		hint(`use "git pull" to merge the remote branch into yours`)
+	case t.ahead > 0:
+		fmt.Fprintf(w, "Your branch is ahead of '%s' by %s.\n", upstream, commits(t.ahead))
+		hint(`use "git push" to publish your local commits`)
+	case t.behind > 0:
+		fmt.Fprintf(w, "Your branch is behind '%s' by %s, and can be fast-forwarded.\n", upstream, commits(t.behind))
+		hint(`use "git pull" to update your local branch`)
+	default:
+		fmt.Fprintf(w, "Your branch is up to date with '%s'.\n", upstream)
+	}
+}
+
+func runStatus(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	opts := statusOptions{untracked: "normal", renames: true}
+	if opts.aheadBehind, err = cfg.getBool("status.aheadBehind", true); err != nil {
+		return err
+	}
+	if opts.submodules, err = recurseSubmodules(cfg); err != nil {
+		return err
+	}
+	short, err := cfg.getBool("status.short", false)
+	if err != nil {
+		return err
+	}
+	showBranch, err := cfg.getBool("status.branch", false)
+	if err != nil {
+		return err
+	}
+	if value, ok := cfg.get("status.showUntrackedFiles"); ok {
+		opts.untracked = value
+	}
+	// status.renames falls back on diff.renames; both can ask for copies.
+	for _, name := range []string{"status.renames", "diff.renames"} {
+		value, ok := cfg.get(name)
+		if !ok {
+			continue
+		}
+		if value == "copies" || value == "copy" {
+			opts.copies = true
+		} else if opts.renames, err = cfg.getBool(name, true); err != nil {
+			return err
+		}
+		break
+	}
+
+	var paths []string
+	porcelain, nulTerminated := false, false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			paths = append(paths, args[i+1:]...)
+			i = len(args)
+		case arg == "-s" || arg == "--short":
+			short = true
+		case arg == "--long":
+			short, porcelain = false, false
+		case arg == "--porcelain" || arg == "--porcelain=v1":
+			porcelain = true
+		case strings.HasPrefix(arg, "--porcelain="):
+			return fmt.Errorf("unsupported porcelain version '%s'", strings.TrimPrefix(arg, "--porcelain="))
+		case arg == "-b" || arg == "--branch":
+			showBranch = true
+		case arg == "--no-branch":
+			showBranch = false
+		case arg == "-z":
+			nulTerminated = true
+		case len(arg) > 2 && arg[0] == '-' && strings.Trim(arg[1:], "sbz") == "":
+			// Flags without values can be bundled, as in -sb.
+			short = short || strings.Contains(arg, "s")
+			showBranch = showBranch || strings.Contains(arg, "b")
+			nulTerminated = nulTerminated || strings.Contains(arg, "z")
+		case arg == "--ignored" || arg == "--ignored=traditional" || arg == "--ignored=matching":
+			opts.ignored = true
+		case arg == "--ignored=no":
+			opts.ignored = false
+		case arg == "-u" || arg == "--untracked-files":
+			opts.untracked = "all"
+		case strings.HasPrefix(arg, "-u"):
+			opts.untracked = strings.TrimPrefix(arg, "-u")
+		case strings.HasPrefix(arg, "--untracked-files="):
+			opts.untracked = strings.TrimPrefix(arg, "--untracked-files=")
+		case arg == "--renames":
+			opts.renames = true
+		case arg == "--no-renames":
+			opts.renames, opts.copies = false, false
+		case arg == "--ahead-behind":
+			opts.aheadBehind = true
+		case arg == "--no-ahead-behind":
+			opts.aheadBehind = false
+		case arg == "--recurse-submodules":
+			opts.submodules = true
+		case arg == "--no-recurse-submodules":
+			opts.submodules = false
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	switch opts.untracked {
+	case "no", "normal", "all":
+	case "false":
+		opts.untracked = "no"
+	case "true":
+		opts.untracked = "normal"
+	default:
+		return fmt.Errorf("Invalid untracked files mode '%s'", opts.untracked)
+	}
+	quoteHigh, err := cfg.getBool("core.quotePath", true)
+	if err != nil {
+		return err
+	}
+	hints, err := cfg.getBool("advice.statusHints", true)
+	if err != nil {
+		return err
+	}
+
+	s, err := collectStatus(cfg, paths, opts)
+	if err != nil {
+		return err
+	}
+	out := bufio.NewWriter(os.Stdout)
+	switch {
+	case porcelain || nulTerminated:
+		writeShortStatus(out, s, showBranch, nulTerminated, quoteHigh)
+	case short:
+		writeShortStatus(out, s, showBranch, false, quoteHigh)
+	default:
+		writeLongStatus(out, s, hints, quoteHigh, opts.untracked)
+	}
+	return out.Flush()
+}
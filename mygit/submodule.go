@@ -0,0 +1,625 @@
+package mygit
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const gitmodulesFile = ".gitmodules"
+
+// submoduleFormat is how diffs show a change to a submodule: as the
+// commits it points to, as the list of commits in between or as the diff
+// of the submodule's files.
+type submoduleFormat int
+
+const (
+	submoduleShort submoduleFormat = iota
+	submoduleLog
+	submoduleDiff
+)
+
+var submoduleFormats = map[string]submoduleFormat{
+	"short": submoduleShort,
+	"log":   submoduleLog,
+	"diff":  submoduleDiff,
+}
+
+// isSubmodulePair reports whether a pair is a submodule being added,
+// removed or moved to another commit.
+func isSubmodulePair(p diffPair) bool {
+	return !p.unmerged &&
+		(p.old.mode == modeGitlink || p.old.mode == 0) &&
+		(p.new.mode == modeGitlink || p.new.mode == 0)
+}
+
+// submoduleConfig is a submodule as .gitmodules declares it.
+type submoduleConfig struct {
+	name, path, url string
+	// shallow asks for the submodule to be cloned with a depth of one.
+	shallow bool
+}
+
+// readGitmodules lists the submodules declared in the .gitmodules file of
+// the working tree, ordered by path.
+func readGitmodules() ([]submoduleConfig, error) {
+	entries, _, err := readConfigFile(gitmodulesFile)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*submoduleConfig)
+	for _, e := range entries {
+		if e.section != "submodule" || e.subsection == "" {
+			continue
+		}
+		s, ok := byName[e.subsection]
+		if !ok {
+			s = &submoduleConfig{name: e.subsection}
+			byName[e.subsection] = s
+		}
+		switch e.key {
+		case "path":
+			s.path = strings.TrimSuffix(e.value, "/")
+		case "url":
+			s.url = e.value
+		case "shallow":
+			if e.noValue {
+				s.shallow = true
+			} else if s.shallow, err = parseConfigBool(e.value); err != nil {
+				return nil, fmt.Errorf("bad boolean config value '%s' for 'submodule.%s.shallow'", e.value, e.subsection)
+			}
+		}
+	}
+	var list []submoduleConfig
+	for _, s := range byName {
+		if s.path != "" && s.url != "" {
+			list = append(list, *s)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].path < list[j].path })
+	return list, nil
+}
+
+// resolveSubmoduleURL turns a url relative to the superproject, starting
+// with ./ or ../, into one relative to the superproject's origin, or to
+// its working tree when it has no origin.
+func resolveSubmoduleURL(cfg *config, url string) (string, error) {
+	if !strings.HasPrefix(url, "./") && !strings.HasPrefix(url, "../") {
+		return url, nil
+	}
+	base, ok := cfg.get("remote.origin.url")
+	if !ok {
+		wd, err := os.Getwd()
+		if err != nil {
+			return "", err
+		}
+		base = wd
+	}
+	base = strings.TrimSuffix(base, "/")
+	for {
+		if rest, ok := strings.CutPrefix(url, "./"); ok {
+			url = rest
+			continue
+		}
+		rest, ok := strings.CutPrefix(url, "../")
+		if !ok {
+			break
+		}
+		url = rest
+		i := strings.LastIndexAny(base, "/:")
+		if i == -1 {
+			return "", fmt.Errorf("cannot strip one component off url '%s'", base)
+		}
+		// "host:repo" goes up to "host:".
+		if base[i] == ':' {
+			i++
+		}
+		base = base[:i]
+	}
+	if strings.HasSuffix(base, ":") {
+		return base + url, nil
+	}
+	return base + "/" + url, nil
+}
+
+// recurseSubmodules reads submodule.recurse, the default of the
+// --recurse-submodules option of commands.
+func recurseSubmodules(cfg *config) (bool, error) {
+	return cfg.getBool("submodule.recurse", false)
+}
+
+// submoduleCommand prepares running this program with args in the working
+// tree of the submodule at path. Commands recurse into submodules by
+// running themselves there, as each submodule is a repository of its own.
+func submoduleCommand(path string, args ...string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find executable: %w", err)
+	}
+	cmd := exec.Command(self, args...)
+	cmd.Dir = path
+	cmd.Stderr = os.Stderr
+	return cmd, nil
+}
+
+// runInSubmodule runs this program with args in the submodule at path,
+// its output going along with ours.
+func runInSubmodule(path string, args ...string) error {
+	cmd, err := submoduleCommand(path, args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = os.Stdout
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to recurse into submodule '%s'", path)
+	}
+	return nil
+}
+
+// submoduleHead returns the commit checked out in the submodule at path,
+// and false when it is not checked out.
+func submoduleHead(path string) (objectID, bool, error) {
+	if _, ok := submoduleGitDir(path); !ok {
+		return objectID{}, false, nil
+	}
+	cmd, err := submoduleCommand(path, "rev-list", "-n", "1", "HEAD")
+	if err != nil {
+		return objectID{}, false, err
+	}
+	cmd.Stderr = nil
+	out, err := cmd.Output()
+	if err != nil {
+		return objectID{}, false, nil
+	}
+	hash, err := parseHash(strings.TrimSpace(string(out)))
+	if err != nil {
+		return objectID{}, false, nil
+	}
+	return hash, true, nil
+}
+
+// submoduleGitDir returns the git directory of the submodule checked out
+// at path: its .git directory, or the one its .git file points to.
+func submoduleGitDir(path string) (string, bool) {
+	dotGit := filepath.Join(path, ".git")
+	fi, err := os.Stat(dotGit)
+	if err != nil {
+		return "", false
+	}
+	if fi.IsDir() {
+		return dotGit, true
+	}
+	data, err := os.ReadFile(dotGit)
+	if err != nil {
+		return "", false
+	}
+	dir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+	if !ok {
+		return "", false
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(path, dir)
+	}
+	return dir, true
+}
+
+// inSubmodule runs fn with objects read from the repository of the
+// submodule checked out at path, and reports false without running it if
+// there is none. Refs and the index stay those of the superproject.
+func inSubmodule(path string, fn func() error) (bool, error) {
+	dir, ok := submoduleGitDir(path)
+	if !ok {
+		return false, nil
+	}
+	saved := [4]string{objDir, packDir, midxFile, commitGraphFile}
+	objDir = filepath.Join(dir, "objects")
+	packDir = filepath.Join(objDir, "pack")
+	midxFile = filepath.Join(packDir, "multi-pack-index")
+	commitGraphFile = filepath.Join(objDir, "info", "commit-graph")
+	reloadAlternates()
+	reloadPacks()
+	reloadCommitGraph()
+	defer func() {
+		objDir, packDir, midxFile, commitGraphFile = saved[0], saved[1], saved[2], saved[3]
+		reloadAlternates()
+		reloadPacks()
+		reloadCommitGraph()
+	}()
+	return true, fn()
+}
+
+// submoduleCommit is a commit listed by --submodule=log: '>' for those
+// the submodule gained, '<' for those it lost.
+type submoduleCommit struct {
+	side    byte
+	subject string
+	when    int64
+}
+
+// firstParentsUntil lists the commits on the first-parent chain of tip
+// that the commits in stop do not reach.
+func firstParentsUntil(tip objectID, stop map[objectID]bool, side byte) ([]submoduleCommit, error) {
+	var list []submoduleCommit
+	for hash := tip; !stop[hash]; {
+		c, err := readCommit(hash)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, submoduleCommit{side, commitSubject(c.message), identTimestamp(c.committer)})
+		if len(c.parents) == 0 {
+			break
+		}
+		hash = c.parents[0]
+	}
+	return list, nil
+}
+
+// submoduleCommits lists the commits between the old and new commits of a
+// submodule, newest first. It reports whether new only adds commits to
+// old, or only drops some.
+func submoduleCommits(old, new objectID) (log []submoduleCommit, forward, backward bool, err error) {
+	reach := func(tip objectID) (map[objectID]bool, error) {
+		seen := make(map[objectID]bool)
+		err := walkCommits([]objectID{tip}, func(hash objectID, c *commit) error {
+			seen[hash] = true
+			return nil
+		})
+		return seen, err
+	}
+	fromOld, err := reach(old)
+	if err != nil {
+		return nil, false, false, err
+	}
+	fromNew, err := reach(new)
+	if err != nil {
+		return nil, false, false, err
+	}
+	lost, err := firstParentsUntil(old, fromNew, '<')
+	if err != nil {
+		return nil, false, false, err
+	}
+	gained, err := firstParentsUntil(new, fromOld, '>')
+	if err != nil {
+		return nil, false, false, err
+	}
+	log = append(gained, lost...)
+	sort.SliceStable(log, func(i, j int) bool { return log[i].when > log[j].when })
+	return log, fromNew[old], fromOld[new], nil
+}
+
+// writeSubmoduleDiff shows the change to a submodule, looking into its
+// repository: a header naming the commits, then with --submodule=log the
+// commits in between, or with --submodule=diff the changes to its files.
+func writeSubmoduleDiff(w io.Writer, p diffPair, opts *diffOptions) error {
+	var body []byte
+	var log []submoduleCommit
+	forward, backward := false, false
+	message := ""
+	switch {
+	case p.old.mode == 0:
+		message = "(new submodule)"
+	case p.new.mode == 0:
+		message = "(submodule deleted)"
+	}
+
+	found, err := inSubmodule(p.path, func() error {
+		if p.old.mode != 0 && !hasObject(p.old.hash) || p.new.mode != 0 && !hasObject(p.new.hash) {
+			if message == "" {
+				message = "(commits not present)"
+			}
+			return nil
+		}
+		if p.old.mode != 0 && p.new.mode != 0 {
+			var err error
+			if log, forward, backward, err = submoduleCommits(p.old.hash, p.new.hash); err != nil {
+				return err
+			}
+		}
+		if opts.submodule != submoduleDiff || p.new.mode == 0 {
+			return nil
+		}
+		old := map[string]diffEntry{}
+		if p.old.mode != 0 {
+			var err error
+			if old, err = commitFiles(p.old.hash); err != nil {
+				return err
+			}
+		}
+		new, err := commitFiles(p.new.hash)
+		if err != nil {
+			return err
+		}
+		// The submodule's own submodules are only named.
+		inner := *opts
+		inner.submodule = submoduleShort
+		var buf bytes.Buffer
+		for _, pair := range diffFiles(old, new, nil, nil) {
+			pair.path = p.path + "/" + pair.path
+			if err := writePatch(&buf, pair, &inner); err != nil {
+				return err
+			}
+		}
+		body = buf.Bytes()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !found && message == "" {
+		message = "(commits not present)"
+	}
+
+	separator := "..."
+	if forward || backward {
+		separator = ".."
+	}
+	header := fmt.Sprintf("Submodule %s %s%s%s", p.path, shortHash(p.old.hash), separator, shortHash(p.new.hash))
+	switch {
+	case message != "":
+		fmt.Fprintf(w, "%s %s\n", header, message)
+	case backward:
+		fmt.Fprintf(w, "%s (rewind):\n", header)
+	default:
+		fmt.Fprintf(w, "%s:\n", header)
+	}
+	if opts.submodule == submoduleLog {
+		for _, c := range log {
+			fmt.Fprintf(w, "  %c %s\n", c.side, c.subject)
+		}
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// submoduleCloneOptions tell how clone --recurse-submodules clones the
+// submodules.
+type submoduleCloneOptions struct {
+	quiet bool
+	// jobs is how many submodules are cloned at once, submodule.fetchJobs
+	// deciding when it is 0.
+	jobs int
+	// shallow clones every submodule with a depth of one and noShallow
+	// none of them; otherwise .gitmodules decides for each.
+	shallow, noShallow bool
+}
+
+// submoduleClone is a submodule being cloned, and what came of it.
+type submoduleClone struct {
+	s      submoduleConfig
+	url    string
+	commit objectID
+	output bytes.Buffer
+	err    error
+}
+
+// run clones the submodule into its path with the clone options args.
+func (c *submoduleClone) run(args []string, opts submoduleCloneOptions) error {
+	dir, err := filepath.Abs(c.s.path)
+	if err != nil {
+		return err
+	}
+	// args is shared by the clones running at once.
+	args = args[:len(args):len(args)]
+	if opts.shallow || c.s.shallow && !opts.noShallow {
+		args = append(args, "--depth=1")
+	}
+	cmd, err := submoduleCommand(".", append(args, c.url, dir)...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout, cmd.Stderr = &c.output, &c.output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("clone of '%s' into submodule path '%s' failed", c.url, c.s.path)
+	}
+	return nil
+}
+
+// cloneSubmodules registers the submodules of a freshly checked out
+// commit, whose files are given, and clones each into its path at the
+// commit recorded for it, recursively.
+func cloneSubmodules(cfg *config, files map[string]diffEntry, opts submoduleCloneOptions) error {
+	subs, err := readGitmodules()
+	if err != nil {
+		return err
+	}
+	var clones []*submoduleClone
+	for _, s := range subs {
+		file, ok := files[s.path]
+		if !ok || file.mode != modeGitlink {
+			continue
+		}
+		url, err := resolveSubmoduleURL(cfg, s.url)
+		if err != nil {
+			return err
+		}
+		if err := setConfigValue(configFile, "submodule."+s.name+".url", url); err != nil {
+			return fmt.Errorf("error writing config: %w", err)
+		}
+		if !opts.quiet {
+			fmt.Fprintf(os.Stderr, "Submodule '%s' (%s) registered for path '%s'\n", s.name, url, s.path)
+		}
+		clones = append(clones, &submoduleClone{s: s, url: url, commit: file.hash})
+	}
+
+	jobs := opts.jobs
+	if jobs == 0 {
+		if jobs, err = cfg.getInt("submodule.fetchJobs", 1); err != nil {
+			return err
+		}
+	}
+	if jobs < 1 {
+		jobs = runtime.NumCPU()
+	}
+	args := []string{"clone", "--recurse-submodules"}
+	if opts.quiet {
+		args = append(args, "-q")
+	}
+	if opts.jobs > 0 {
+		args = append(args, "--jobs="+strconv.Itoa(opts.jobs))
+	}
+	// The clones run side by side, each one's output held back so that
+	// they come out whole and in order.
+	next := make(chan *submoduleClone)
+	var wg sync.WaitGroup
+	for w := 0; w < min(jobs, len(clones)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range next {
+				c.err = c.run(args, opts)
+			}
+		}()
+	}
+	for _, c := range clones {
+		next <- c
+	}
+	close(next)
+	wg.Wait()
+	for _, c := range clones {
+		os.Stderr.Write(c.output.Bytes())
+		if c.err != nil {
+			return c.err
+		}
+	}
+
+	for _, c := range clones {
+		if err := runInSubmodule(c.s.path, "checkout", "-q", "--recurse-submodules", c.commit.String()); err != nil {
+			return fmt.Errorf("unable to checkout '%s' in submodule path '%s'", c.commit, c.s.path)
+		}
+		if !opts.quiet {
+			fmt.Printf("Submodule path '%s': checked out '%s'\n", c.s.path, c.commit)
+		}
+	}
+	return nil
+}
+
+// updateSubmodules moves the checked out submodules among files to the
+// commits recorded for them. Submodules that are not checked out are left
+// alone.
+func updateSubmodules(files map[string]diffEntry) error {
+	paths := make([]string, 0, len(files))
+	for path, file := range files {
+		if file.mode == modeGitlink {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		head, ok, err := submoduleHead(path)
+		if err != nil {
+			return err
+		}
+		if !ok || head == files[path].hash {
+			continue
+		}
+		if err := runInSubmodule(path, "checkout", "-q", "--recurse-submodules", files[path].hash.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetchSubmodules fetches in the checked out submodules: all of them, or
+// on demand only those missing a commit that the fetched refs record for
+// them. before and after are the refs around the fetch.
+func fetchSubmodules(before, after map[string]objectID, onDemand bool) error {
+	subs, err := readGitmodules()
+	if err != nil {
+		return err
+	}
+	for _, s := range subs {
+		if _, ok := submoduleGitDir(s.path); !ok {
+			continue
+		}
+		if onDemand {
+			missing := false
+			for ref, hash := range after {
+				if before[ref] == hash {
+					continue
+				}
+				files, err := commitFiles(hash)
+				if err != nil {
+					// Fetched refs may point at tags of non-commits.
+					continue
+				}
+				file, ok := files[s.path]
+				if !ok || file.mode != modeGitlink {
+					continue
+				}
+				if _, err := inSubmodule(s.path, func() error {
+					missing = missing || !hasObject(file.hash)
+					return nil
+				}); err != nil {
+					return err
+				}
+			}
+			if !missing {
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "Fetching submodule %s\n", s.path)
+		mode := "--recurse-submodules=yes"
+		if onDemand {
+			mode = "--recurse-submodules=on-demand"
+		}
+		if err := runInSubmodule(s.path, "fetch", mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// submoduleStatus looks into the submodule checked out at path, recorded
+// at commit in the index. It returns the short status code of the
+// submodule, M for new commits, m for modified content and ? for
+// untracked content, with what status says of it in full.
+func submoduleStatus(path string, commit objectID) (byte, string, error) {
+	head, ok, err := submoduleHead(path)
+	if err != nil || !ok {
+		return ' ', "", err
+	}
+	cmd, err := submoduleCommand(path, "status", "--porcelain")
+	if err != nil {
+		return ' ', "", err
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return ' ', "", fmt.Errorf("could not run 'git status' in submodule '%s'", path)
+	}
+	modified, untracked := false, false
+	for _, line := range splitLines(out) {
+		if strings.HasPrefix(line, "??") {
+			untracked = true
+		} else {
+			modified = true
+		}
+	}
+
+	var states []string
+	code := byte(' ')
+	if head != commit {
+		states = append(states, "new commits")
+		code = 'M'
+	}
+	if modified {
+		states = append(states, "modified content")
+		if code == ' ' {
+			code = 'm'
+		}
+	}
+	if untracked {
+		states = append(states, "untracked content")
+		if code == ' ' {
+			code = '?'
+		}
+	}
+	return code, strings.Join(states, ", "), nil
+}
@@ -0,0 +1,276 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+var tagEditMsgFile = ".git/TAG_EDITMSG"
+
+func serializeTag(t *tag) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "object %x\n", t.object)
+	fmt.Fprintf(&b, "type %s\n", t.objType)
+	fmt.Fprintf(&b, "tag %s\n", t.name)
+	fmt.Fprintf(&b, "tagger %s\n", t.tagger)
+	b.WriteString("\n")
+	b.WriteString(t.message)
+	return []byte(b.String())
+}
+
+// validTagName rejects the names git refuses for refs.
+func validTagName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "-") || strings.HasSuffix(name, ".lock") ||
+		strings.HasSuffix(name, "/") || strings.HasSuffix(name, ".") || name == "@" ||
+		strings.Contains(name, "..") || strings.Contains(name, "@{") || strings.Contains(name, "//") {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c == 0x7f || strings.ContainsRune("~^:?*[\\", c) {
+			return false
+		}
+	}
+	return true
+}
+
+// listTags prints the names of the tags that match one of patterns, or of
+// all tags, in order.
+func listTags(patterns []string) error {
+	refs, err := listRefs()
+	if err != nil {
+		return err
+	}
+	var names []string
+	for ref := range refs {
+		name, ok := strings.CutPrefix(ref, "refs/tags/")
+		if !ok {
+			continue
+		}
+		matched := len(patterns) == 0
+		for _, pattern := range patterns {
+			matched = matched || wildmatch(pattern, name, false)
+		}
+		if matched {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(name)
+	}
+	return nil
+}
+
+// deleteTags removes the named tags, reporting what each pointed at.
+func deleteTags(names []string) error {
+	failed := false
+	for _, name := range names {
+		hash, err := resolveRef("refs/tags/" + name)
+		if errors.Is(err, errRefNotFound) {
+			fmt.Fprintf(os.Stderr, "error: tag '%s' not found.\n", name)
+			failed = true
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := deleteRef("refs/tags/" + name); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted tag '%s' (was %s)\n", name, shortHash(hash))
+	}
+	if failed {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// tagMessage returns the message of an annotated tag from -m, -F or the
+// editor.
+func tagMessage(cfg *config, name string, messages []string, messageFile string) (string, error) {
+	switch {
+	case len(messages) > 0:
+		return cleanupMessage(strings.Join(messages, "\n\n"), false), nil
+	case messageFile == "-":
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return "", fmt.Errorf("could not read from standard input: %w", err)
+		}
+		return cleanupMessage(string(data), false), nil
+	case messageFile != "":
+		data, err := os.ReadFile(messageFile)
+		if err != nil {
+			return "", fmt.Errorf("could not open or read '%s': %w", messageFile, err)
+		}
+		return cleanupMessage(string(data), false), nil
+	}
+	edited, err := editMessage(cfg, tagEditMsgFile, "\n#\n"+
+		"# Write a message for tag:\n"+
+		"#   "+name+"\n"+
+		"# Lines starting with '#' will be ignored.\n#\n")
+	if err != nil {
+		return "", err
+	}
+	message := cleanupMessage(edited, true)
+	if message == "" {
+		return "", fmt.Errorf("no tag message?")
+	}
+	return message, nil
+}
+
+func runTag(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	var messages, rest []string
+	var messageFile, signKey string
+	annotate, list, del, force := false, false, false, false
+	sign, err := cfg.getBool("tag.gpgSign", false)
+	if err != nil {
+		return err
+	}
+	// tag.gpgSign only applies to annotated tags, as asked for by the
+	// options.
+	explicitSign := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		value := func(name string) (string, error) {
+			if i+1 == len(args) {
+				return "", fmt.Errorf("option '%s' requires a value", name)
+			}
+			i++
+			return args[i], nil
+		}
+		switch {
+		case arg == "-a" || arg == "--annotate":
+			annotate = true
+		case arg == "-s" || arg == "--sign":
+			sign, explicitSign = true, true
+		case arg == "--no-sign":
+			sign, explicitSign = false, false
+		case arg == "-u" || arg == "--local-user":
+			if signKey, err = value("local-user"); err != nil {
+				return err
+			}
+			sign, explicitSign = true, true
+		case strings.HasPrefix(arg, "--local-user="):
+			signKey = strings.TrimPrefix(arg, "--local-user=")
+			sign, explicitSign = true, true
+		case arg == "-m" || arg == "--message":
+			m, err := value("message")
+			if err != nil {
+				return err
+			}
+			messages = append(messages, m)
+		case strings.HasPrefix(arg, "--message="):
+			messages = append(messages, strings.TrimPrefix(arg, "--message="))
+		case strings.HasPrefix(arg, "-m"):
+			messages = append(messages, strings.TrimPrefix(arg, "-m"))
+		case arg == "-F" || arg == "--file":
+			if messageFile, err = value("file"); err != nil {
+				return err
+			}
+		case strings.HasPrefix(arg, "--file="):
+			messageFile = strings.TrimPrefix(arg, "--file=")
+		case arg == "-f" || arg == "--force":
+			force = true
+		case arg == "-d" || arg == "--delete":
+			del = true
+		case arg == "-l" || arg == "--list":
+			list = true
+		case arg == "--":
+			rest = append(rest, args[i+1:]...)
+			i = len(args)
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if len(messages) > 0 && messageFile != "" {
+		return fmt.Errorf("options '-m' and '-F' cannot be used together")
+	}
+	annotated := annotate || explicitSign || len(messages) > 0 || messageFile != ""
+	switch {
+	case del && list:
+		return fmt.Errorf("options '-d' and '-l' cannot be used together")
+	case del:
+		return deleteTags(rest)
+	case list || len(rest) == 0:
+		if annotated {
+			return fmt.Errorf("-a, -s, -u, -m and -F make no sense when listing tags")
+		}
+		return listTags(rest)
+	case len(rest) > 2:
+		return fmt.Errorf("too many arguments")
+	}
+
+	name := rest[0]
+	if !validTagName(name) {
+		return fmt.Errorf("'%s' is not a valid tag name.", name)
+	}
+	ref := "refs/tags/" + name
+	old, err := resolveRef(ref)
+	switch {
+	case err == nil && !force:
+		return fmt.Errorf("tag '%s' already exists", name)
+	case err != nil && !errors.Is(err, errRefNotFound):
+		return err
+	}
+	target := "HEAD"
+	if len(rest) == 2 {
+		target = rest[1]
+	}
+	object, err := resolveRevision(target)
+	if err != nil {
+		return fmt.Errorf("Failed to resolve '%s' as a valid ref.", target)
+	}
+
+	hash := object
+	if annotated {
+		info, err := statObject(object)
+		if err != nil {
+			return err
+		}
+		tagger, err := identity(cfg, "committer")
+		if err != nil {
+			return err
+		}
+		message, err := tagMessage(cfg, name, messages, messageFile)
+		if err != nil {
+			return err
+		}
+		t := &tag{object: object, objType: info.objType, name: name, tagger: tagger, message: message}
+		// The signature covers the tag before it and follows the
+		// message.
+		if sign {
+			key, err := signingKey(cfg, signKey, tagger)
+			if err != nil {
+				return err
+			}
+			signature, err := signPayload(cfg, serializeTag(t), key)
+			if err != nil {
+				return fmt.Errorf("unable to sign the tag: %w", err)
+			}
+			t.message += signature
+		}
+		if hash, err = storeObject(tagObject, serializeTag(t)); err != nil {
+			return err
+		}
+	}
+
+	tx := newRefTransaction()
+	tx.update(ref, hash, "tag: tagging "+object.String())
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	if force && old != (objectID{}) && old != hash {
+		fmt.Printf("Updated tag '%s' (was %s)\n", name, shortHash(old))
+	}
+	return nil
+}
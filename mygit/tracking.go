@@ -0,0 +1,111 @@
+package mygit
+
+import (
+	"errors"
+	"strings"
+)
+
+// branchUpstream returns the ref that branch, given by its full name,
+// tracks according to branch.<name>.remote and branch.<name>.merge: the
+// remote-tracking ref the remote's fetch refspecs map the merged ref to,
+// or a local branch for the remote ".". Branches without an upstream give
+// an empty string.
+func branchUpstream(cfg *config, branch string) (string, error) {
+	name, ok := strings.CutPrefix(branch, "refs/heads/")
+	if !ok {
+		return "", nil
+	}
+	remoteName, ok := cfg.get("branch." + name + ".remote")
+	if !ok {
+		return "", nil
+	}
+	merge, ok := cfg.get("branch." + name + ".merge")
+	if !ok {
+		return "", nil
+	}
+	if remoteName == "." {
+		return merge, nil
+	}
+	remote, err := lookupRemote(cfg, remoteName)
+	if err != nil {
+		return "", err
+	}
+	// Remotes given as a URL have no remote-tracking refs.
+	if remote.name == "" {
+		return "", nil
+	}
+	for _, spec := range remote.refspecs {
+		if dst, ok := spec.match(merge); ok && dst != "" {
+			return dst, nil
+		}
+	}
+	return "", nil
+}
+
+// aheadBehind counts the commits reachable from one but not from two, and
+// the other way around.
+func aheadBehind(one, two objectID) (ahead, behind int, err error) {
+	if one == two {
+		return 0, 0, nil
+	}
+	reachable := make(map[objectID]bool)
+	err = walkCommits([]objectID{two}, func(hash objectID, c *commit) error {
+		reachable[hash] = true
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	err = walkCommits([]objectID{one}, func(hash objectID, c *commit) error {
+		if reachable[hash] {
+			delete(reachable, hash)
+		} else {
+			ahead++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	// What is left was only reached from two.
+	return ahead, len(reachable), nil
+}
+
+// trackingInfo is how a branch compares to its upstream.
+type trackingInfo struct {
+	// upstream is the full name of the tracked ref, empty if there is none.
+	upstream string
+	// gone is set when the upstream is configured but does not exist.
+	gone          bool
+	ahead, behind int
+	// different is set instead of the counts when they were not asked
+	// for and the branch and its upstream differ.
+	different bool
+}
+
+// branchTracking compares branch, at head, to its upstream. Counting the
+// commits each side has can be skipped, as with status.aheadBehind off.
+func branchTracking(cfg *config, branch string, head objectID, count bool) (*trackingInfo, error) {
+	upstream, err := branchUpstream(cfg, branch)
+	if err != nil || upstream == "" {
+		return &trackingInfo{}, err
+	}
+	t := &trackingInfo{upstream: upstream}
+	// An unborn branch cannot be compared, and is reported like a missing
+	// upstream.
+	hash, err := resolveRef(upstream)
+	if errors.Is(err, errRefNotFound) || head == (objectID{}) {
+		t.gone = true
+		return t, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if !count {
+		t.different = hash != head
+		return t, nil
+	}
+	if t.ahead, t.behind, err = aheadBehind(head, hash); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,566 @@
+package mygit
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/codecrafters-io/git-starter-go/internal/pktline"
+)
+
+const (
+	uploadPackService  = "git-upload-pack"
+	receivePackService = "git-receive-pack"
+	userAgent          = "mygit/0.1"
+	defaultDaemonPort  = "9418"
+)
+
+// transport is a connection to a remote git service. Every transport first
+// yields the service's ref advertisement; afterwards the client sends whole
+// requests and reads the matching responses. Stateful transports (local,
+// ssh) keep a single process open while smart HTTP issues one POST per
+// request.
+type transport interface {
+	advertisement() (io.Reader, error)
+	request(body []byte) (io.Reader, error)
+	close() error
+}
+
+type remoteURL struct {
+	scheme string
+	user   string
+	host   string
+	port   string
+	path   string
+	raw    string
+}
+
+// parseRemoteURL understands URLs with an explicit scheme, scp-like
+// [user@]host:path addresses and local paths.
+func parseRemoteURL(raw string) (*remoteURL, error) {
+	if strings.Contains(raw, "://") {
+		u, err := url.Parse(raw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote url %q: %w", raw, err)
+		}
+		r := &remoteURL{scheme: u.Scheme, host: u.Hostname(), port: u.Port(), path: u.Path, raw: raw}
+		if u.User != nil {
+			r.user = u.User.Username()
+		}
+		if r.scheme == "file" {
+			r.host = ""
+		}
+		return r, nil
+	}
+
+	colon := strings.IndexByte(raw, ':')
+	slash := strings.IndexByte(raw, '/')
+	if colon > 0 && (slash == -1 || colon < slash) {
+		host, path := raw[:colon], raw[colon+1:]
+		r := &remoteURL{scheme: "ssh", path: path, raw: raw}
+		if user, h, ok := strings.Cut(host, "@"); ok {
+			r.user, r.host = user, h
+		} else {
+			r.host = host
+		}
+		return r, nil
+	}
+
+	return &remoteURL{scheme: "file", path: raw, raw: raw}, nil
+}
+
+// openTransport connects to service at rawURL. A version above 0 asks the
+// server for that protocol version; servers that do not support it answer
+// with a v0 advertisement instead.
+func openTransport(rawURL, service string, version int) (transport, error) {
+	u, err := parseRemoteURL(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var protocol string
+	if version > 0 {
+		protocol = fmt.Sprintf("version=%d", version)
+	}
+
+	switch u.scheme {
+	case "http", "https":
+		return newHTTPTransport(u, service, protocol)
+	case "ssh":
+		return newSSHTransport(u, service, protocol)
+	case "git":
+		return newDaemonTransport(u, service, protocol)
+	case "file":
+		return newLocalTransport(u, service, protocol)
+	default:
+		return nil, fmt.Errorf("unsupported protocol %q", u.scheme)
+	}
+}
+
+// processTransport speaks to a service running as a child process over its
+// stdin and stdout.
+type processTransport struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout *bufio.Reader
+}
+
+func startProcessTransport(cmd *exec.Cmd) (*processTransport, error) {
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdin: %w", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open stdout: %w", err)
+	}
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start %s: %w", cmd.Path, err)
+	}
+	return &processTransport{cmd: cmd, stdin: stdin, stdout: bufio.NewReader(stdout)}, nil
+}
+
+func (t *processTransport) advertisement() (io.Reader, error) {
+	return t.stdout, nil
+}
+
+func (t *processTransport) request(body []byte) (io.Reader, error) {
+	if _, err := t.stdin.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	return t.stdout, nil
+}
+
+func (t *processTransport) close() error {
+	// A flush tells a service still waiting for a request that there is
+	// nothing more to do; after a completed exchange it is ignored.
+	t.stdin.Write([]byte("0000"))
+	t.stdin.Close()
+	io.Copy(io.Discard, t.stdout)
+	return t.cmd.Wait()
+}
+
+// protocolEnv returns the environment for a service process, passing the
+// requested protocol version through GIT_PROTOCOL.
+func protocolEnv(protocol string) []string {
+	env := os.Environ()
+	if protocol != "" {
+		env = append(env, "GIT_PROTOCOL="+protocol)
+	}
+	return env
+}
+
+func newLocalTransport(u *remoteURL, service, protocol string) (transport, error) {
+	path, err := filepath.Abs(u.path)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository path: %w", err)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("repository %s does not exist", u.raw)
+	}
+	cmd := exec.Command(service, path)
+	cmd.Env = protocolEnv(protocol)
+	return startProcessTransport(cmd)
+}
+
+// sshVariant identifies the flavour of ssh client, which decides how the
+// port and environment are passed.
+type sshVariant int
+
+const (
+	sshOpenSSH sshVariant = iota
+	sshPlink
+	sshTortoisePlink
+	sshSimple
+)
+
+// resolveSSHCommand picks the ssh client from GIT_SSH_COMMAND, GIT_SSH or
+// core.sshCommand. Command lines from GIT_SSH_COMMAND and core.sshCommand
+// go through the shell; GIT_SSH names a program run as-is.
+func resolveSSHCommand(cfg *config) (command string, useShell bool) {
+	if command := os.Getenv("GIT_SSH_COMMAND"); command != "" {
+		return command, true
+	}
+	if command := os.Getenv("GIT_SSH"); command != "" {
+		return command, false
+	}
+	if command, ok := cfg.get("core.sshCommand"); ok && command != "" {
+		return command, true
+	}
+	return "ssh", false
+}
+
+// detectSSHVariant honours GIT_SSH_VARIANT and ssh.variant, otherwise
+// guessing from the program name.
+func detectSSHVariant(cfg *config, command string, useShell bool) (sshVariant, error) {
+	variant := os.Getenv("GIT_SSH_VARIANT")
+	if variant == "" {
+		variant, _ = cfg.get("ssh.variant")
+	}
+
+	if variant == "" || variant == "auto" {
+		program := command
+		if useShell {
+			if fields := strings.Fields(command); len(fields) > 0 {
+				program = fields[0]
+			}
+		}
+		variant = strings.TrimSuffix(strings.ToLower(filepath.Base(program)), ".exe")
+		switch variant {
+		case "plink", "putty", "tortoiseplink":
+		default:
+			variant = "ssh"
+		}
+	}
+
+	switch variant {
+	case "ssh":
+		return sshOpenSSH, nil
+	case "plink", "putty":
+		return sshPlink, nil
+	case "tortoiseplink":
+		return sshTortoisePlink, nil
+	case "simple":
+		return sshSimple, nil
+	}
+	return 0, fmt.Errorf("unknown ssh variant %q", variant)
+}
+
+func newSSHTransport(u *remoteURL, service, protocol string) (transport, error) {
+	cmd, err := sshCommand(u, service, protocol != "")
+	if err != nil {
+		return nil, err
+	}
+	cmd.Env = protocolEnv(protocol)
+	return startProcessTransport(cmd)
+}
+
+// sshCommand returns the ssh client command running program on the host
+// of u, with the path of u and then extra as its arguments. sendProtocol
+// has OpenSSH pass GIT_PROTOCOL along.
+func sshCommand(u *remoteURL, program string, sendProtocol bool, extra ...string) (*exec.Cmd, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	command, useShell := resolveSSHCommand(cfg)
+	variant, err := detectSSHVariant(cfg, command, useShell)
+	if err != nil {
+		return nil, err
+	}
+
+	var args []string
+	if sendProtocol && variant == sshOpenSSH {
+		args = append(args, "-o", "SendEnv=GIT_PROTOCOL")
+	}
+	if variant == sshTortoisePlink {
+		args = append(args, "-batch")
+	}
+	if u.port != "" {
+		switch variant {
+		case sshOpenSSH:
+			args = append(args, "-p", u.port)
+		case sshPlink, sshTortoisePlink:
+			args = append(args, "-P", u.port)
+		case sshSimple:
+			return nil, fmt.Errorf("ssh variant 'simple' does not support setting port")
+		}
+	}
+	host := u.host
+	if u.user != "" {
+		host = u.user + "@" + host
+	}
+	remote := fmt.Sprintf("%s '%s'", program, strings.ReplaceAll(u.path, "'", `'\''`))
+	if len(extra) > 0 {
+		remote += " " + strings.Join(extra, " ")
+	}
+	args = append(args, host, remote)
+
+	if useShell {
+		return shellCommand(command, args...), nil
+	}
+	return exec.Command(command, args...), nil
+}
+
+// daemonTransport speaks the anonymous git:// protocol over TCP. After the
+// initial request line the exchange is the same as with a local process.
+type daemonTransport struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newDaemonTransport(u *remoteURL, service, protocol string) (transport, error) {
+	port := u.port
+	if port == "" {
+		port = defaultDaemonPort
+	}
+	addr := net.JoinHostPort(u.host, port)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", addr, err)
+	}
+
+	// The host parameter lets virtual-hosting daemons pick a repository
+	// root; extra parameters follow after an empty field.
+	host := u.host
+	if u.port != "" {
+		host = addr
+	}
+	line := fmt.Sprintf("%s %s\x00host=%s\x00", service, u.path, host)
+	if protocol != "" {
+		line += "\x00" + protocol + "\x00"
+	}
+	if err := pktline.NewWriter(conn).WriteString(line); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to send request to %s: %w", addr, err)
+	}
+	return &daemonTransport{conn: conn, r: bufio.NewReader(conn)}, nil
+}
+
+func (t *daemonTransport) advertisement() (io.Reader, error) {
+	return t.r, nil
+}
+
+func (t *daemonTransport) request(body []byte) (io.Reader, error) {
+	if _, err := t.conn.Write(body); err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	return t.r, nil
+}
+
+func (t *daemonTransport) close() error {
+	t.conn.Write([]byte("0000"))
+	return t.conn.Close()
+}
+
+// httpTransport implements the smart HTTP protocol: the advertisement comes
+// from GET info/refs and every request is a separate POST.
+type httpTransport struct {
+	client *http.Client
+	cfg    *config
+	opts   *httpOptions
+	// cred is filled in once the server asks for authentication and
+	// approved with the helpers after its first successful use.
+	cred     *credential
+	approved bool
+	base     string
+	service  string
+	protocol string
+	body     io.ReadCloser
+}
+
+func newHTTPTransport(u *remoteURL, service, protocol string) (transport, error) {
+	cfg, err := loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	opts, err := loadHTTPOptions(cfg, u.raw)
+	if err != nil {
+		return nil, err
+	}
+	return &httpTransport{
+		client:   opts.client(),
+		cfg:      cfg,
+		opts:     opts,
+		base:     strings.TrimSuffix(u.raw, "/"),
+		service:  service,
+		protocol: protocol,
+	}, nil
+}
+
+func (t *httpTransport) setHeaders(req *http.Request) {
+	req.Header.Set("User-Agent", userAgent)
+	if t.protocol != "" {
+		req.Header.Set("Git-Protocol", t.protocol)
+	}
+	t.opts.setHeaders(req)
+	if t.cred != nil {
+		req.SetBasicAuth(t.cred.username, t.cred.password)
+	}
+}
+
+func (t *httpTransport) advertisement() (io.Reader, error) {
+	req, err := http.NewRequest("GET", t.base+"/info/refs?service="+t.service, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	t.setHeaders(req)
+
+	resp, err := t.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := readWireBody(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read advertisement: %w", err)
+	}
+
+	// Smart servers prefix the advertisement with "# service=<name>" and a
+	// flush packet, except for protocol v2 responses, which may start with
+	// the version line directly.
+	r := bufio.NewReader(bytes.NewReader(body))
+	if bytes.HasPrefix(body, []byte("000eversion 2\n")) {
+		return r, nil
+	}
+	pr := wireReader(r)
+	_, line, err := pr.ReadLine()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read advertisement: %w", err)
+	}
+	if line != "# service="+t.service {
+		return nil, fmt.Errorf("remote is not a smart http server")
+	}
+	if t, _, err := pr.ReadPacket(); err != nil || t != pktline.Flush {
+		return nil, fmt.Errorf("invalid service advertisement")
+	}
+	return r, nil
+}
+
+// gzipRequestSize is the size above which negotiation requests are sent
+// compressed, as git does.
+const gzipRequestSize = 1024
+
+func (t *httpTransport) request(body []byte) (io.Reader, error) {
+	// The haves of a negotiation compress well; packs being pushed do not.
+	gzipped := t.service == uploadPackService && len(body) > gzipRequestSize
+	if gzipped {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		body = buf.Bytes()
+	}
+	req, err := http.NewRequest("POST", t.base+"/"+t.service, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	t.setHeaders(req)
+	req.Header.Set("Content-Type", "application/x-"+t.service+"-request")
+	req.Header.Set("Accept", "application/x-"+t.service+"-result")
+	if gzipped {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	resp, err := t.do(req)
+	if err != nil {
+		return nil, err
+	}
+	t.closeBody()
+	t.body = resp.Body
+	return bufio.NewReader(resp.Body), nil
+}
+
+// closeBody closes the response being read. What little may be left of it
+// is read first, so that the connection can be reused.
+func (t *httpTransport) closeBody() error {
+	if t.body == nil {
+		return nil
+	}
+	io.CopyN(io.Discard, t.body, 64<<10)
+	err := t.body.Close()
+	t.body = nil
+	return err
+}
+
+// do sends req and checks the response status. When the server asks for
+// authentication, credentials are filled from the helpers or the user and
+// the request is retried once with them.
+func (t *httpTransport) do(req *http.Request) (*http.Response, error) {
+	resp, err := t.send(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized && t.cred == nil {
+		resp.Body.Close()
+		cred, err := credentialFromURL(t.base)
+		if err != nil {
+			return nil, err
+		}
+		if err := prepareCredential(t.cfg, cred); err != nil {
+			return nil, err
+		}
+		if err := fillCredential(t.cfg, cred); err != nil {
+			return nil, err
+		}
+		t.cred = cred
+
+		retry := req.Clone(req.Context())
+		if req.GetBody != nil {
+			if retry.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("failed to rewind request: %w", err)
+			}
+		}
+		retry.SetBasicAuth(cred.username, cred.password)
+		if resp, err = t.send(retry); err != nil {
+			return nil, err
+		}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized && t.cred != nil:
+		resp.Body.Close()
+		if err := rejectCredential(t.cfg, t.cred); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("authentication failed for '%s'", req.URL.Redacted())
+	case resp.StatusCode != http.StatusOK:
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected http status %s from %s", resp.Status, req.URL.Redacted())
+	}
+	if t.cred != nil && !t.approved {
+		if err := approveCredential(t.cfg, t.cred); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		t.approved = true
+	}
+	return resp, nil
+}
+
+// send performs a single request, aborting it if it is slower than
+// http.lowSpeedLimit allows.
+func (t *httpTransport) send(req *http.Request) (*http.Response, error) {
+	var watch *speedWatch
+	if t.opts.lowSpeedLimit > 0 && t.opts.lowSpeedTime > 0 {
+		ctx, cancel := context.WithCancel(req.Context())
+		req = req.WithContext(ctx)
+		watch = newSpeedWatch(t.opts.lowSpeedLimit, t.opts.lowSpeedTime, cancel)
+	}
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		if watch != nil {
+			watch.stop()
+			if watch.slow.Load() {
+				return nil, watch.err()
+			}
+		}
+		return nil, fmt.Errorf("failed to reach %s: %w", req.URL.Host, err)
+	}
+	if watch != nil {
+		resp.Body = &watchedBody{ReadCloser: resp.Body, watch: watch}
+	}
+	return resp, nil
+}
+
+func (t *httpTransport) close() error {
+	return t.closeBody()
+}
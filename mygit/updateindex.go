@@ -0,0 +1,313 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// updateIndexOptions are the update-index options in effect for the paths
+// that follow them.
+type updateIndexOptions struct {
+	add, remove, forceRemove, replace bool
+	infoOnly, verbose                 bool
+	// chmod is '+' or '-' to set or clear the executable bit.
+	chmod byte
+	// markValid and markSkipWorktree are 1 to set and -1 to clear the
+	// flag, which then is all that is done to the paths.
+	markValid, markSkipWorktree int
+}
+
+// setIndexEntry puts e in place of every stage of its path. Entries in
+// the way of it, files where it needs a directory or the files below it,
+// are removed with replace and an error otherwise.
+func setIndexEntry(entries []indexEntry, e indexEntry, replace bool) ([]indexEntry, error) {
+	conflicts := func(x indexEntry) bool {
+		return strings.HasPrefix(e.path, x.path+"/") || strings.HasPrefix(x.path, e.path+"/")
+	}
+	if !replace && slices.ContainsFunc(entries, conflicts) {
+		return nil, fmt.Errorf("'%s' appears as both a file and as a directory", e.path)
+	}
+	entries = slices.DeleteFunc(entries, func(x indexEntry) bool {
+		return x.path == e.path || conflicts(x)
+	})
+	return append(entries, e), nil
+}
+
+// updateIndexPath brings the entry of a path in line with the working
+// tree file, as opts allow.
+func updateIndexPath(entries []indexEntry, path string, opts *updateIndexOptions) ([]indexEntry, error) {
+	tracked := slices.ContainsFunc(entries, func(e indexEntry) bool { return e.path == path })
+	if opts.markValid != 0 || opts.markSkipWorktree != 0 {
+		if !tracked {
+			return nil, fmt.Errorf("Unable to mark file %s", path)
+		}
+		for i := range entries {
+			e := &entries[i]
+			if e.path != path {
+				continue
+			}
+			switch opts.markValid {
+			case 1:
+				e.flags |= indexFlagValid
+			case -1:
+				e.flags &^= indexFlagValid
+			}
+			switch opts.markSkipWorktree {
+			case 1:
+				e.extFlags |= indexSkipWorktree
+			case -1:
+				e.extFlags &^= indexSkipWorktree
+			}
+		}
+		return entries, nil
+	}
+
+	remove := func() []indexEntry {
+		if opts.verbose {
+			fmt.Printf("remove '%s'\n", path)
+		}
+		return slices.DeleteFunc(entries, func(e indexEntry) bool { return e.path == path })
+	}
+	if opts.forceRemove {
+		return remove(), nil
+	}
+	fi, err := os.Lstat(path)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		if !opts.remove {
+			return nil, fmt.Errorf("%s: does not exist and --remove not passed", path)
+		}
+		return remove(), nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to stat %s: %w", path, err)
+	case !tracked && !opts.add:
+		return nil, fmt.Errorf("%s: cannot add to the index - missing --add option?", path)
+	}
+
+	var file diffEntry
+	if fi.IsDir() {
+		// Submodules are recorded at the commit they have checked out.
+		head, ok, err := submoduleHead(path)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, fmt.Errorf("%s: is a directory - add files inside instead", path)
+		}
+		file = diffEntry{mode: modeGitlink, hash: head}
+	} else if file, err = readWorktreeFile(path); err != nil {
+		return nil, err
+	}
+	if !opts.infoOnly && file.data != nil {
+		if _, err := storeObject(blobObject, file.data); err != nil {
+			return nil, err
+		}
+	}
+	e, err := newIndexEntry(path, 0, file)
+	if err != nil {
+		return nil, err
+	}
+	if opts.verbose {
+		fmt.Printf("add '%s'\n", path)
+	}
+	return setIndexEntry(entries, e, opts.replace)
+}
+
+// chmodIndexPath sets or clears the executable bit of a regular file's
+// entry.
+func chmodIndexPath(entries []indexEntry, path string, flip byte, verbose bool) error {
+	found := false
+	for i := range entries {
+		e := &entries[i]
+		if e.path != path {
+			continue
+		}
+		found = true
+		if e.mode&modeTypeMask != modeRegular&modeTypeMask {
+			return fmt.Errorf("cannot chmod %cx '%s'", flip, path)
+		}
+		if flip == '+' {
+			e.mode = modeExecutable
+		} else {
+			e.mode = modeRegular
+		}
+	}
+	if !found {
+		return fmt.Errorf("cannot chmod %cx '%s'", flip, path)
+	}
+	if verbose {
+		fmt.Printf("chmod %cx '%s'\n", flip, path)
+	}
+	return nil
+}
+
+// refreshIndex updates the stat data of the entries whose files did not
+// change, so later commands need not read them. It reports the paths that
+// did change or are unmerged, unless quiet, and whether there were any.
+// Entries assumed unchanged are only looked at if really.
+func refreshIndex(cfg *config, entries []indexEntry, quiet, unmergedOK, really bool) (bool, error) {
+	check := slices.Clone(entries)
+	if really {
+		for i := range check {
+			check[i].flags &^= indexFlagValid
+		}
+	}
+	work, err := worktreeFiles(cfg, check)
+	if err != nil {
+		return false, err
+	}
+	needsUpdate := false
+	reported := make(map[string]bool)
+	for i := range entries {
+		e := &entries[i]
+		switch {
+		case e.stage() != 0:
+			if !unmergedOK && !quiet && !reported[e.path] {
+				fmt.Printf("%s: needs merge\n", e.path)
+				needsUpdate = true
+			}
+			reported[e.path] = true
+			continue
+		case e.extFlags&indexSkipWorktree != 0 || e.flags&indexFlagValid != 0 && !really:
+			continue
+		}
+		file, ok := work[e.path]
+		if !ok || file.mode != e.mode || file.hash != e.hash {
+			if !quiet {
+				fmt.Printf("%s: needs update\n", e.path)
+				needsUpdate = true
+			}
+			continue
+		}
+		if file.data == nil {
+			continue
+		}
+		refreshed, err := newIndexEntry(e.path, 0, file)
+		if err != nil {
+			return false, err
+		}
+		refreshed.flags, refreshed.extFlags = e.flags, e.extFlags
+		*e = refreshed
+	}
+	return needsUpdate, nil
+}
+
+func runUpdateIndex(args []string) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	entries, err := readIndex()
+	if err != nil {
+		return err
+	}
+
+	// Options apply to the paths after them, which are handled in turn.
+	var opts updateIndexOptions
+	update := func(path string) error {
+		path = filepath.ToSlash(filepath.Clean(path))
+		if entries, err = updateIndexPath(entries, path, &opts); err != nil {
+			return err
+		}
+		if opts.chmod != 0 {
+			return chmodIndexPath(entries, path, opts.chmod, opts.verbose)
+		}
+		return nil
+	}
+	quiet, unmergedOK, needsUpdate := false, false, false
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--":
+			for _, path := range args[i+1:] {
+				if err := update(path); err != nil {
+					return err
+				}
+			}
+			i = len(args)
+		case arg == "--add":
+			opts.add = true
+		case arg == "--remove":
+			opts.remove = true
+		case arg == "--force-remove":
+			opts.forceRemove = true
+		case arg == "--replace":
+			opts.replace = true
+		case arg == "--info-only":
+			opts.infoOnly = true
+		case arg == "-v" || arg == "--verbose":
+			opts.verbose = true
+		case arg == "-q":
+			quiet = true
+		case arg == "--unmerged":
+			unmergedOK = true
+		case arg == "--chmod=+x" || arg == "--chmod=-x":
+			opts.chmod = arg[len("--chmod=")]
+		case arg == "--assume-unchanged":
+			opts.markValid = 1
+		case arg == "--no-assume-unchanged":
+			opts.markValid = -1
+		case arg == "--skip-worktree":
+			opts.markSkipWorktree = 1
+		case arg == "--no-skip-worktree":
+			opts.markSkipWorktree = -1
+		case arg == "--refresh" || arg == "--really-refresh":
+			changed, err := refreshIndex(cfg, entries, quiet, unmergedOK, arg == "--really-refresh")
+			if err != nil {
+				return err
+			}
+			needsUpdate = needsUpdate || changed
+		case arg == "--cacheinfo":
+			// Both <mode>,<object>,<path> and the older three arguments
+			// are accepted.
+			fields := []string{}
+			if i+1 < len(args) {
+				fields = strings.SplitN(args[i+1], ",", 3)
+			}
+			if len(fields) == 3 {
+				i++
+			} else if i+3 < len(args) {
+				fields = args[i+1 : i+4]
+				i += 3
+			} else {
+				return fmt.Errorf("option 'cacheinfo' expects <mode>,<sha1>,<path>")
+			}
+			var mode uint32
+			if _, err := fmt.Sscanf(fields[0], "%o", &mode); err != nil {
+				return fmt.Errorf("--cacheinfo cannot add %s", fields[2])
+			}
+			hash, err := parseHash(fields[1])
+			if err != nil {
+				return fmt.Errorf("--cacheinfo cannot add %s", fields[2])
+			}
+			path := filepath.ToSlash(filepath.Clean(fields[2]))
+			tracked := slices.ContainsFunc(entries, func(e indexEntry) bool { return e.path == path })
+			if !tracked && !opts.add {
+				return fmt.Errorf("%s: cannot add to the index - missing --add option?", path)
+			}
+			if entries, err = setIndexEntry(entries, indexEntry{path: path, mode: mode, hash: hash}, opts.replace); err != nil {
+				return err
+			}
+			if opts.verbose {
+				fmt.Printf("add '%s'\n", path)
+			}
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			if err := update(arg); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+	if needsUpdate {
+		os.Exit(1)
+	}
+	return nil
+}
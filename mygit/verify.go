@@ -0,0 +1,124 @@
+package mygit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// splitCommitSignature separates the gpgsig header of a commit from the
+// rest of it, which is what the signature signs.
+func splitCommitSignature(content []byte) ([]byte, string, bool) {
+	headers, message, _ := bytes.Cut(content, []byte("\n\n"))
+	var payload bytes.Buffer
+	var signature strings.Builder
+	inSignature, found := false, false
+	for _, line := range strings.Split(string(headers), "\n") {
+		if value, ok := strings.CutPrefix(line, "gpgsig "); ok {
+			signature.WriteString(value + "\n")
+			inSignature, found = true, true
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, " "); ok && inSignature {
+			signature.WriteString(rest + "\n")
+			continue
+		}
+		inSignature = false
+		payload.WriteString(line + "\n")
+	}
+	payload.WriteString("\n")
+	payload.Write(message)
+	return payload.Bytes(), signature.String(), found
+}
+
+// verifyObjects checks the signature of each named object of type
+// objType, which split separates from what it signs. verbose shows the
+// signed object first.
+func verifyObjects(names []string, objType string, verbose bool, split func(content []byte) ([]byte, string, bool)) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	failed := false
+	for _, name := range names {
+		hash, err := resolveRevision(name)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %s: %v\n", name, err)
+			failed = true
+			continue
+		}
+		t, content, err := readObject(hash)
+		if err != nil {
+			return err
+		}
+		if t != objType {
+			fmt.Fprintf(os.Stderr, "error: %s: cannot verify a non-%s object of type %s.\n", name, objType, t)
+			failed = true
+			continue
+		}
+		payload, signature, ok := split(content)
+		if verbose {
+			os.Stdout.Write(payload)
+		}
+		if !ok {
+			if objType == tagObject {
+				fmt.Fprintln(os.Stderr, "error: no signature found")
+			}
+			failed = true
+			continue
+		}
+		if err := verifySignature(cfg, payload, signature); errors.Is(err, errBadSignature) {
+			failed = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+	return nil
+}
+
+// verifyArgs reads the options of verify-commit and verify-tag.
+func verifyArgs(args []string) ([]string, bool, error) {
+	var names []string
+	verbose := false
+	for _, arg := range args {
+		switch {
+		case arg == "-v" || arg == "--verbose":
+			verbose = true
+		case strings.HasPrefix(arg, "-"):
+			return nil, false, fmt.Errorf("unknown option %s", arg)
+		default:
+			names = append(names, arg)
+		}
+	}
+	if len(names) == 0 {
+		return nil, false, fmt.Errorf("usage: mygit verify-commit|verify-tag [-v] <object>...")
+	}
+	return names, verbose, nil
+}
+
+func runVerifyCommit(args []string) error {
+	names, verbose, err := verifyArgs(args)
+	if err != nil {
+		return err
+	}
+	return verifyObjects(names, commitObject, verbose, splitCommitSignature)
+}
+
+func runVerifyTag(args []string) error {
+	names, verbose, err := verifyArgs(args)
+	if err != nil {
+		return err
+	}
+	return verifyObjects(names, tagObject, verbose, func(content []byte) ([]byte, string, bool) {
+		start, ok := signatureStart(content)
+		if !ok {
+			return content, "", false
+		}
+		return content[:start], string(content[start:]), true
+	})
+}
@@ -0,0 +1,243 @@
+package mygit
+
+import "strings"
+
+// Results of wildmatch's matcher. Besides no match, a failure can tell
+// the callers up the recursion to stop trying: the text is too short for
+// any match, or a "*" cannot get past a slash so only an enclosing "**"
+// can go on.
+const (
+	wildMatch = iota
+	wildNoMatch
+	wildAbortAll
+	wildAbortToStarStar
+)
+
+func isGlobSpecial(c byte) bool {
+	return c == '*' || c == '?' || c == '[' || c == '\\'
+}
+
+// wildmatch matches text against a shell glob the way git does for
+// ignore rules, attributes and pathspecs. With pathname set, wildcards do
+// not match slashes except in "**" components: a leading "**/" matches
+// any directories, "/**/" zero or more, and a trailing "/**" everything
+// inside.
+func wildmatch(pattern, text string, pathname bool) bool {
+	return dowild(pattern, text, pathname) == wildMatch
+}
+
+// matchCharClass reports whether c is in a named POSIX class; ok is
+// false for unknown class names.
+func matchCharClass(name string, c byte) (matched, ok bool) {
+	isUpper := 'A' <= c && c <= 'Z'
+	isLower := 'a' <= c && c <= 'z'
+	isDigit := '0' <= c && c <= '9'
+	switch name {
+	case "alnum":
+		return isUpper || isLower || isDigit, true
+	case "alpha":
+		return isUpper || isLower, true
+	case "blank":
+		return c == ' ' || c == '\t', true
+	case "cntrl":
+		return c < 0x20 || c == 0x7f, true
+	case "digit":
+		return isDigit, true
+	case "graph":
+		return c > 0x20 && c < 0x7f, true
+	case "lower":
+		return isLower, true
+	case "print":
+		return c >= 0x20 && c < 0x7f, true
+	case "punct":
+		return c > 0x20 && c < 0x7f && !isUpper && !isLower && !isDigit, true
+	case "space":
+		return strings.IndexByte(" \t\n\r\v\f", c) >= 0, true
+	case "upper":
+		return isUpper, true
+	case "xdigit":
+		return isDigit || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F', true
+	}
+	return false, false
+}
+
+// dowild is a port of git's matcher, walking pattern p and text t in step.
+func dowild(p, t string, pathname bool) int {
+	pi, ti := 0, 0
+	at := func(s string, i int) byte {
+		if i < len(s) {
+			return s[i]
+		}
+		return 0
+	}
+	for ; pi < len(p); pi, ti = pi+1, ti+1 {
+		pc := p[pi]
+		tc := at(t, ti)
+		if tc == 0 && pc != '*' {
+			return wildAbortAll
+		}
+		switch pc {
+		case '\\':
+			// A backslash quotes the next character.
+			pi++
+			if at(p, pi) != tc {
+				return wildNoMatch
+			}
+			continue
+		default:
+			if tc != pc {
+				return wildNoMatch
+			}
+			continue
+		case '?':
+			if pathname && tc == '/' {
+				return wildNoMatch
+			}
+			continue
+		case '*':
+			var matchSlash bool
+			pi++
+			if at(p, pi) == '*' {
+				prev := pi - 2
+				for pi++; at(p, pi) == '*'; pi++ {
+				}
+				if (prev < 0 || p[prev] == '/') &&
+					(pi == len(p) || p[pi] == '/' || p[pi] == '\\' && at(p, pi+1) == '/') {
+					// "**/" can match no directory at all.
+					if at(p, pi) == '/' && dowild(p[pi+1:], t[ti:], pathname) == wildMatch {
+						return wildMatch
+					}
+					matchSlash = true
+				} else {
+					matchSlash = !pathname
+				}
+			} else {
+				// Without pathname, "*" is the same as "**".
+				matchSlash = !pathname
+			}
+			if pi == len(p) {
+				// A trailing "*" matches only if no slash is left.
+				if !matchSlash && strings.IndexByte(t[ti:], '/') >= 0 {
+					return wildNoMatch
+				}
+				return wildMatch
+			}
+			if !matchSlash && p[pi] == '/' {
+				// "*/" matches the next directory.
+				slash := strings.IndexByte(t[ti:], '/')
+				if slash < 0 {
+					return wildNoMatch
+				}
+				ti += slash
+				break
+			}
+			for tc != 0 {
+				// A literal after the star must be found first, and a
+				// star that cannot match slashes stops at one.
+				if !isGlobSpecial(p[pi]) {
+					for tc = at(t, ti); tc != 0 && (matchSlash || tc != '/'); tc = at(t, ti) {
+						if tc == p[pi] {
+							break
+						}
+						ti++
+					}
+					if tc != p[pi] {
+						return wildNoMatch
+					}
+				}
+				if matched := dowild(p[pi:], t[ti:], pathname); matched != wildNoMatch {
+					if !matchSlash || matched != wildAbortToStarStar {
+						return matched
+					}
+				} else if !matchSlash && tc == '/' {
+					return wildAbortToStarStar
+				}
+				ti++
+				tc = at(t, ti)
+			}
+			return wildAbortAll
+		case '[':
+			pi++
+			pc = at(p, pi)
+			if pc == '^' {
+				pc = '!'
+			}
+			negated := pc == '!'
+			if negated {
+				pi++
+				pc = at(p, pi)
+			}
+			var prev byte
+			matched := false
+			for {
+				switch {
+				case pc == 0:
+					return wildAbortAll
+				case pc == '\\':
+					pi++
+					pc = at(p, pi)
+					if pc == 0 {
+						return wildAbortAll
+					}
+					if tc == pc {
+						matched = true
+					}
+				case pc == '-' && prev != 0 && at(p, pi+1) != 0 && at(p, pi+1) != ']':
+					pi++
+					pc = p[pi]
+					if pc == '\\' {
+						pi++
+						pc = at(p, pi)
+						if pc == 0 {
+							return wildAbortAll
+						}
+					}
+					if prev <= tc && tc <= pc {
+						matched = true
+					}
+					pc = 0
+				case pc == '[' && at(p, pi+1) == ':':
+					start := pi + 2
+					end := start
+					for end < len(p) && p[end] != ']' {
+						end++
+					}
+					if end == len(p) {
+						return wildAbortAll
+					}
+					if end-start < 1 || p[end-1] != ':' {
+						// Without ":]" this is a plain '['.
+						if tc == '[' {
+							matched = true
+						}
+						pc = '['
+						break
+					}
+					inClass, ok := matchCharClass(p[start:end-1], tc)
+					if !ok {
+						return wildAbortAll
+					}
+					matched = matched || inClass
+					pi = end
+					pc = 0
+				case tc == pc:
+					matched = true
+				}
+				prev = pc
+				pi++
+				pc = at(p, pi)
+				if pc == ']' {
+					break
+				}
+			}
+			if matched == negated || pathname && tc == '/' {
+				return wildNoMatch
+			}
+			continue
+		}
+	}
+	if ti < len(t) {
+		return wildNoMatch
+	}
+	return wildMatch
+}
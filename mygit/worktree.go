@@ -0,0 +1,495 @@
+package mygit
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// worktreePaths are the files each worktree has its own copy of, by their
+// name in its git directory.
+var worktreePaths = []struct {
+	path *string
+	name string
+}{
+	{&indexFile, "index"},
+	{&commitEditMsgFile, "COMMIT_EDITMSG"},
+	{&tagEditMsgFile, "TAG_EDITMSG"},
+	{&mergeHeadFile, "MERGE_HEAD"},
+	{&mergeMsgFile, "MERGE_MSG"},
+	{&mergeModeFile, "MERGE_MODE"},
+	{&rebaseDir, "rebase-merge"},
+	{&amDir, "rebase-apply"},
+	{&bisectStartFile, "BISECT_START"},
+	{&bisectLogFile, "BISECT_LOG"},
+	{&bisectTermsFile, "BISECT_TERMS"},
+	{&bisectNamesFile, "BISECT_NAMES"},
+	{&bisectAncestorsOKFile, "BISECT_ANCESTORS_OK"},
+	{&notesMergeWorktree, "NOTES_MERGE_WORKTREE"},
+	{&patchEditFile, "addp-hunk-edit.diff"},
+}
+
+// sharedPaths are the files all worktrees use, by their name in the
+// common directory.
+var sharedPaths = []struct {
+	path *string
+	name string
+}{
+	{&configFile, "config"},
+	{&packedRefsFile, "packed-refs"},
+	{&logsDir, "logs"},
+	{&objDir, "objects"},
+	{&packDir, "objects/pack"},
+	{&midxFile, "objects/pack/multi-pack-index"},
+	{&commitGraphFile, "objects/info/commit-graph"},
+	{&infoExcludeFile, "info/exclude"},
+	{&infoAttributesFile, "info/attributes"},
+	{&lfsObjectsDir, "lfs/objects"},
+	{&reftableDir, "reftable"},
+	{&reftableListFile, "reftable/tables.list"},
+}
+
+// useGitDirs points the repository's files at the git directory dir and
+// the common directory common, as found in a linked worktree.
+func useGitDirs(dir, common string) {
+	gitDir, commonDir = dir, common
+	for _, p := range worktreePaths {
+		*p.path = filepath.Join(dir, p.name)
+	}
+	for _, p := range sharedPaths {
+		*p.path = filepath.Join(common, p.name)
+	}
+	reloadAlternates()
+	reloadPacks()
+	reloadCommitGraph()
+}
+
+// readGitFile returns the git directory a .git file points to, relative
+// paths being taken from the file's directory.
+func readGitFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	dir, ok := strings.CutPrefix(strings.TrimSpace(string(data)), "gitdir: ")
+	if !ok {
+		return "", fmt.Errorf("invalid gitfile format: %s", path)
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(filepath.Dir(path), dir)
+	}
+	return filepath.Abs(dir)
+}
+
+// setupGitDir finds the git directory of a worktree whose .git is a file,
+// as in linked worktrees and submodules, and the common directory its
+// commondir file names.
+func setupGitDir() error {
+	fi, err := os.Stat(".git")
+	if err != nil || fi.IsDir() {
+		return nil
+	}
+	dir, err := readGitFile(".git")
+	if err != nil {
+		return err
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("not a git repository: %s", dir)
+	}
+	common := dir
+	if data, err := os.ReadFile(filepath.Join(dir, "commondir")); err == nil {
+		common = strings.TrimSpace(string(data))
+		if !filepath.IsAbs(common) {
+			common = filepath.Clean(filepath.Join(dir, common))
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to read commondir: %w", err)
+	}
+	useGitDirs(dir, common)
+	return nil
+}
+
+// worktree is one working tree of the repository: the main one or one
+// added by worktree add.
+type worktree struct {
+	path string
+	// gitDir is where its HEAD and index are kept.
+	gitDir string
+	head   refValue
+	main   bool
+}
+
+// readWorktreeHead reads the HEAD of the worktree with git directory dir,
+// resolving the branch it is on.
+func readWorktreeHead(dir string) (refValue, error) {
+	data, err := os.ReadFile(filepath.Join(dir, "HEAD"))
+	if err != nil {
+		return refValue{}, fmt.Errorf("failed to read HEAD: %w", err)
+	}
+	content := strings.TrimSpace(string(data))
+	if target, ok := strings.CutPrefix(content, "ref: "); ok {
+		hash, err := resolveRef(target)
+		if err != nil && !errors.Is(err, errRefNotFound) {
+			return refValue{}, err
+		}
+		return refValue{hash: hash, symref: target}, nil
+	}
+	hash, err := parseHash(content)
+	if err != nil {
+		return refValue{}, fmt.Errorf("invalid HEAD in %s: %w", dir, err)
+	}
+	return refValue{hash: hash}, nil
+}
+
+// listWorktrees returns the main worktree followed by the linked ones,
+// sorted by the name of their directory under .git/worktrees.
+func listWorktrees() ([]worktree, error) {
+	common, err := filepath.Abs(commonDir)
+	if err != nil {
+		return nil, err
+	}
+	head, err := readWorktreeHead(common)
+	if err != nil {
+		return nil, err
+	}
+	trees := []worktree{{path: filepath.Dir(common), gitDir: common, head: head, main: true}}
+
+	entries, err := os.ReadDir(filepath.Join(common, "worktrees"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read worktrees: %w", err)
+	}
+	for _, entry := range entries {
+		dir := filepath.Join(common, "worktrees", entry.Name())
+		data, err := os.ReadFile(filepath.Join(dir, "gitdir"))
+		if err != nil {
+			continue
+		}
+		head, err := readWorktreeHead(dir)
+		if err != nil {
+			continue
+		}
+		path := filepath.Dir(strings.TrimSpace(string(data)))
+		trees = append(trees, worktree{path: path, gitDir: dir, head: head})
+	}
+	return trees, nil
+}
+
+// findWorktree returns the worktree at path.
+func findWorktree(trees []worktree, path string) (worktree, bool) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return worktree{}, false
+	}
+	for _, wt := range trees {
+		if wt.path == abs {
+			return wt, true
+		}
+	}
+	return worktree{}, false
+}
+
+// worktreeAdmin picks the name of the directory under .git/worktrees that
+// a new worktree at path is administered from: the base name of path, with
+// a number appended if it is taken.
+func worktreeAdmin(common, path string) string {
+	base := filepath.Base(path)
+	dir := filepath.Join(common, "worktrees", base)
+	for n := 1; ; n++ {
+		if _, err := os.Lstat(dir); errors.Is(err, fs.ErrNotExist) {
+			return dir
+		}
+		dir = filepath.Join(common, "worktrees", base+strconv.Itoa(n))
+	}
+}
+
+// addWorktree checks out commit in a new worktree at path, on branch if
+// one is given and detached otherwise. With newBranch set, the branch is
+// created or, with force too, reset to commit first.
+func addWorktree(path, branch string, commit objectID, newBranch, force, quiet bool) error {
+	if repoFormat.refStorage == "reftable" {
+		return fmt.Errorf("worktrees are not supported with the reftable ref format")
+	}
+	trees, err := listWorktrees()
+	if err != nil {
+		return err
+	}
+	ref := "refs/heads/" + branch
+	if branch != "" && !newBranch && !force {
+		for _, wt := range trees {
+			if wt.head.symref == ref {
+				return fmt.Errorf("'%s' is already checked out at '%s'", branch, wt.path)
+			}
+		}
+	}
+	if _, err := os.Lstat(path); err == nil {
+		if entries, err := os.ReadDir(path); err != nil || len(entries) > 0 {
+			return fmt.Errorf("'%s' already exists", path)
+		}
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	common, err := filepath.Abs(commonDir)
+	if err != nil {
+		return err
+	}
+	admin := worktreeAdmin(common, abs)
+	if err := os.MkdirAll(admin, 0755); err != nil {
+		return fmt.Errorf("could not create directory of '%s': %w", admin, err)
+	}
+	if err := os.MkdirAll(abs, 0755); err != nil {
+		return fmt.Errorf("could not create leading directories of '%s': %w", path, err)
+	}
+	files := []struct{ path, content string }{
+		{filepath.Join(admin, "gitdir"), filepath.Join(abs, ".git") + "\n"},
+		{filepath.Join(admin, "commondir"), "../..\n"},
+		{filepath.Join(admin, "HEAD"), commit.String() + "\n"},
+		{filepath.Join(abs, ".git"), "gitdir: " + admin + "\n"},
+	}
+	for _, f := range files {
+		if err := os.WriteFile(f.path, []byte(f.content), 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %w", f.path, err)
+		}
+	}
+
+	if newBranch {
+		tx := newRefTransaction()
+		tx.update(ref, commit, "branch: Created from "+commit.String())
+		if err := tx.commit(); err != nil {
+			return err
+		}
+	}
+
+	// The checkout happens from inside the new worktree, as its own HEAD
+	// and index are the ones to fill in.
+	if err := os.Chdir(abs); err != nil {
+		return err
+	}
+	useGitDirs(admin, common)
+	tx := newRefTransaction()
+	if branch != "" {
+		tx.symref("HEAD", ref, "")
+	} else {
+		tx.detach("HEAD", commit, "")
+	}
+	if err := tx.commit(); err != nil {
+		return err
+	}
+	tree, err := commitFiles(commit)
+	if err != nil {
+		return err
+	}
+	entries, err := applyUpdates(nil, treeUpdates(nil, tree))
+	if err != nil {
+		return err
+	}
+	if err := writeIndex(entries); err != nil {
+		return err
+	}
+	if quiet {
+		return nil
+	}
+	c, err := readCommit(commit)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("HEAD is now at %s %s\n", shortHash(commit), commitSubject(c.message))
+	return nil
+}
+
+func runWorktreeAdd(args []string) error {
+	var newBranch string
+	detach, force, quiet, reset := false, false, false, false
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "-b" || arg == "-B":
+			if i+1 >= len(args) {
+				return fmt.Errorf("switch '%s' requires a value", arg[1:])
+			}
+			i++
+			newBranch, reset = args[i], arg == "-B"
+		case arg == "--detach":
+			detach = true
+		case arg == "-f" || arg == "--force":
+			force = true
+		case arg == "-q" || arg == "--quiet":
+			quiet = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) == 0 || len(rest) > 2 {
+		return fmt.Errorf("usage: mygit worktree add [-f] [--detach] [-b <new-branch>] <path> [<commit-ish>]")
+	}
+	if newBranch != "" && detach {
+		return fmt.Errorf("options '-b', '-B', and '--detach' cannot be used together")
+	}
+	path, commitish := rest[0], "HEAD"
+	if len(rest) == 2 {
+		commitish = rest[1]
+	}
+
+	// Without a commit-ish a branch named after the worktree is checked
+	// out, created from HEAD unless it exists.
+	branch := ""
+	switch {
+	case newBranch != "":
+		branch = newBranch
+	case detach:
+	case len(rest) == 1:
+		branch = filepath.Base(path)
+		if _, err := resolveRef("refs/heads/" + branch); errors.Is(err, errRefNotFound) {
+			newBranch = branch
+		}
+	default:
+		if _, err := resolveRef("refs/heads/" + commitish); err == nil {
+			branch = commitish
+		}
+	}
+	if branch != "" && newBranch == "" {
+		commitish = branch
+	}
+	commit, err := resolveCommit(commitish)
+	if err != nil {
+		return fmt.Errorf("invalid reference: %s", commitish)
+	}
+
+	old, err := resolveRef("refs/heads/" + newBranch)
+	exists := newBranch != "" && err == nil
+	if exists && !reset {
+		return fmt.Errorf("a branch named '%s' already exists", newBranch)
+	}
+	if !quiet {
+		switch {
+		case exists:
+			fmt.Fprintf(os.Stderr, "Preparing worktree (resetting branch '%s'; was at %s)\n", newBranch, shortHash(old))
+		case newBranch != "":
+			fmt.Fprintf(os.Stderr, "Preparing worktree (new branch '%s')\n", newBranch)
+		case branch != "":
+			fmt.Fprintf(os.Stderr, "Preparing worktree (checking out '%s')\n", branch)
+		default:
+			fmt.Fprintf(os.Stderr, "Preparing worktree (detached HEAD %s)\n", shortHash(commit))
+		}
+	}
+	return addWorktree(path, branch, commit, newBranch != "", force, quiet)
+}
+
+func runWorktreeList(args []string) error {
+	porcelain := false
+	for _, arg := range args {
+		switch arg {
+		case "--porcelain":
+			porcelain = true
+		default:
+			return fmt.Errorf("unknown option %s", arg)
+		}
+	}
+	trees, err := listWorktrees()
+	if err != nil {
+		return err
+	}
+
+	if porcelain {
+		for _, wt := range trees {
+			fmt.Printf("worktree %s\nHEAD %s\n", wt.path, wt.head.hash)
+			if wt.head.symref != "" {
+				fmt.Printf("branch %s\n\n", wt.head.symref)
+			} else {
+				fmt.Print("detached\n\n")
+			}
+		}
+		return nil
+	}
+	width := 0
+	for _, wt := range trees {
+		width = max(width, len(wt.path))
+	}
+	for _, wt := range trees {
+		fmt.Printf("%-*s %s ", width+1, wt.path, shortHash(wt.head.hash))
+		if wt.head.symref != "" {
+			fmt.Printf("[%s]\n", strings.TrimPrefix(wt.head.symref, "refs/heads/"))
+		} else {
+			fmt.Println("(detached HEAD)")
+		}
+	}
+	return nil
+}
+
+func runWorktreeRemove(args []string) error {
+	force := false
+	var rest []string
+	for _, arg := range args {
+		switch {
+		case arg == "-f" || arg == "--force":
+			force = true
+		case strings.HasPrefix(arg, "-"):
+			return fmt.Errorf("unknown option %s", arg)
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) != 1 {
+		return fmt.Errorf("usage: mygit worktree remove [-f] <worktree>")
+	}
+	path := rest[0]
+	trees, err := listWorktrees()
+	if err != nil {
+		return err
+	}
+	wt, ok := findWorktree(trees, path)
+	switch {
+	case !ok:
+		return fmt.Errorf("'%s' is not a working tree", path)
+	case wt.main:
+		return fmt.Errorf("'%s' is a main working tree", path)
+	}
+
+	// Like git, ask status in the worktree itself whether anything would
+	// be lost.
+	if !force {
+		if _, err := os.Stat(wt.path); err == nil {
+			cmd, err := submoduleCommand(wt.path, "status", "--porcelain")
+			if err != nil {
+				return err
+			}
+			out, err := cmd.Output()
+			if err != nil {
+				return fmt.Errorf("failed to run 'git status' on '%s'", path)
+			}
+			if len(out) > 0 {
+				return fmt.Errorf("'%s' contains modified or untracked files, use --force to delete it", path)
+			}
+		}
+	}
+	if err := os.RemoveAll(wt.path); err != nil {
+		return fmt.Errorf("failed to delete '%s': %w", wt.path, err)
+	}
+	if err := os.RemoveAll(wt.gitDir); err != nil {
+		return fmt.Errorf("failed to delete '%s': %w", wt.gitDir, err)
+	}
+	return nil
+}
+
+func runWorktree(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: mygit worktree (add | list | remove) [<options>]")
+	}
+	switch args[0] {
+	case "add":
+		return runWorktreeAdd(args[1:])
+	case "list":
+		return runWorktreeList(args[1:])
+	case "remove":
+		return runWorktreeRemove(args[1:])
+	}
+	return fmt.Errorf("unknown subcommand: %s", args[0])
+}
@@ -0,0 +1,813 @@
+package mygit
+
+import "math"
+
+// The line diff below follows git's xdiff: Myers' algorithm with linear
+// space bisection, the same preprocessing of lines that cannot match, and
+// the same sliding of changes afterwards, so hunks line up with git's.
+
+const (
+	// maxEqualLimit caps how often a line may occur before it counts as
+	// too common to anchor the diff.
+	maxEqualLimit = 1024
+	// simScanWindow bounds the scan around such common lines.
+	simScanWindow = 100
+	// keptDiscardRun is the ratio of common to unmatched lines below
+	// which common lines inside a changed run are ignored.
+	keptDiscardRun = 4
+	// Past heurMinCost edits, a diagonal of snakeCount matching lines
+	// that made enough progress is accepted as a split point.
+	heurMinCost = 256
+	snakeCount  = 20
+	heurK       = 4
+	// minMaxCost is the smallest edit cost after which the search settles
+	// for the furthest reaching path instead of a minimal one.
+	minMaxCost = 256
+	// Sliding of changed blocks by indentation, see scoreSplit.
+	maxIndent                      = 200
+	maxBlanks                      = 20
+	startOfFilePenalty             = 1
+	endOfFilePenalty               = 21
+	totalBlankWeight               = -30
+	postBlankWeight                = 6
+	relativeIndentPenalty          = -4
+	relativeIndentWithBlankPenalty = 10
+	relativeOutdentPenalty         = 24
+	relativeOutdentBlankPenalty    = 17
+	relativeDedentPenalty          = 23
+	relativeDedentBlankPenalty     = 17
+	indentWeight                   = 60
+	indentMaxSliding               = 100
+)
+
+// diffFlags loosen how lines are compared, as the whitespace options of
+// diff, blame and merge ask.
+type diffFlags int
+
+const (
+	// diffIgnoreAllSpace ignores whitespace altogether (-w).
+	diffIgnoreAllSpace diffFlags = 1 << iota
+	// diffIgnoreSpaceChange ignores changes in the amount of whitespace,
+	// including whitespace at the end of a line (-b).
+	diffIgnoreSpaceChange
+	// diffIgnoreSpaceAtEOL ignores whitespace at the end of a line.
+	diffIgnoreSpaceAtEOL
+	// diffIgnoreBlankLines marks changes whose lines are all blank as
+	// ignorable, which patches leave out unless other changes are close.
+	diffIgnoreBlankLines
+
+	diffWhitespaceFlags = diffIgnoreAllSpace | diffIgnoreSpaceChange | diffIgnoreSpaceAtEOL
+)
+
+// lineChange replaces n1 lines of the old file starting at i1 with n2
+// lines of the new file starting at i2.
+type lineChange struct {
+	i1, i2 int
+	n1, n2 int
+	// ignore marks a change of blank lines only, under
+	// diffIgnoreBlankLines.
+	ignore bool
+}
+
+// diffSide is one file of a diff.
+type diffSide struct {
+	lines []string
+	// class identifies equal lines across both files.
+	class []int
+	// changed has a false sentinel on both ends: changed[i+1] is line i.
+	changed []bool
+	// dstart and dend delimit the lines left after trimming the common
+	// head and tail.
+	dstart, dend int
+	// ha and rindex are the classes and line numbers of the lines the
+	// Myers search looks at.
+	ha     []int
+	rindex []int
+}
+
+func (s *diffSide) isChanged(i int) bool {
+	return s.changed[i+1]
+}
+
+func (s *diffSide) setChanged(i int, v bool) {
+	s.changed[i+1] = v
+}
+
+// isSpace matches the bytes xdiff takes for whitespace.
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\v' || c == '\f' || c == '\r'
+}
+
+// lineKey returns what a line is compared by under flags: the line itself,
+// line terminator included, unless whitespace is to be ignored.
+func lineKey(line string, flags diffFlags) string {
+	if flags&diffWhitespaceFlags == 0 {
+		return line
+	}
+	end := len(line)
+	for end > 0 && isSpace(line[end-1]) {
+		end--
+	}
+	if flags&(diffIgnoreAllSpace|diffIgnoreSpaceChange) == 0 {
+		return line[:end]
+	}
+	var key []byte
+	for i := 0; i < end; i++ {
+		if !isSpace(line[i]) {
+			key = append(key, line[i])
+			continue
+		}
+		for i+1 < end && isSpace(line[i+1]) {
+			i++
+		}
+		if flags&diffIgnoreAllSpace == 0 {
+			key = append(key, ' ')
+		}
+	}
+	return string(key)
+}
+
+// sameLine tells whether two lines compare equal under flags.
+func sameLine(a, b string, flags diffFlags) bool {
+	return a == b || flags&diffWhitespaceFlags != 0 && lineKey(a, flags) == lineKey(b, flags)
+}
+
+// blankLine tells whether a line counts as blank for diffIgnoreBlankLines:
+// all whitespace if whitespace is ignored, and otherwise empty but for its
+// terminator.
+func blankLine(line string, flags diffFlags) bool {
+	if flags&diffWhitespaceFlags == 0 {
+		return len(line) <= 1
+	}
+	for i := 0; i < len(line); i++ {
+		if !isSpace(line[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// diffLines computes the changes turning a into b. Lines are compared
+// exactly, including their line terminators, unless flags say otherwise.
+func diffLines(a, b []string, flags diffFlags) []lineChange {
+	classes := make(map[string]int)
+	var count1, count2 []int
+	classify := func(lines []string, counts *[]int) []int {
+		ids := make([]int, len(lines))
+		for i, line := range lines {
+			key := lineKey(line, flags)
+			id, ok := classes[key]
+			if !ok {
+				id = len(classes)
+				classes[key] = id
+				count1 = append(count1, 0)
+				count2 = append(count2, 0)
+			}
+			ids[i] = id
+			(*counts)[id]++
+		}
+		return ids
+	}
+	x := &diffSide{lines: a, changed: make([]bool, len(a)+2)}
+	y := &diffSide{lines: b, changed: make([]bool, len(b)+2)}
+	x.class = classify(a, &count1)
+	y.class = classify(b, &count2)
+
+	trimEnds(x, y)
+	cleanupRecords(x, y, count1, count2)
+
+	ndiags := len(x.ha) + len(y.ha) + 3
+	d := &myers{
+		x:       x,
+		y:       y,
+		kvdf:    make([]int, ndiags),
+		kvdb:    make([]int, ndiags),
+		koff:    len(y.ha) + 1,
+		maxCost: max(bogoSqrt(ndiags), minMaxCost),
+	}
+	d.compare(0, len(x.ha), 0, len(y.ha), false)
+
+	changeCompact(x, y)
+	changeCompact(y, x)
+	changes := buildScript(x, y)
+	if flags&diffIgnoreBlankLines != 0 {
+		markBlankChanges(changes, a, b, flags)
+	}
+	return changes
+}
+
+// markBlankChanges marks the changes that only remove or add blank lines.
+func markBlankChanges(changes []lineChange, a, b []string, flags diffFlags) {
+	for i := range changes {
+		c := &changes[i]
+		c.ignore = true
+		for _, line := range a[c.i1 : c.i1+c.n1] {
+			c.ignore = c.ignore && blankLine(line, flags)
+		}
+		for _, line := range b[c.i2 : c.i2+c.n2] {
+			c.ignore = c.ignore && blankLine(line, flags)
+		}
+	}
+}
+
+// bogoSqrt is xdiff's cheap approximation of a square root.
+func bogoSqrt(n int) int {
+	i := 1
+	for ; n > 0; n >>= 2 {
+		i <<= 1
+	}
+	return i
+}
+
+// trimEnds skips the lines both files start and end with.
+func trimEnds(x, y *diffSide) {
+	limit := min(len(x.class), len(y.class))
+	i := 0
+	for i < limit && x.class[i] == y.class[i] {
+		i++
+	}
+	x.dstart, y.dstart = i, i
+
+	limit -= i
+	j := 0
+	for j < limit && x.class[len(x.class)-1-j] == y.class[len(y.class)-1-j] {
+		j++
+	}
+	x.dend = len(x.class) - j - 1
+	y.dend = len(y.class) - j - 1
+}
+
+// cleanupRecords marks lines that do not occur in the other file as
+// changed right away, as well as very common lines lost among them, and
+// leaves the rest for the Myers search.
+func cleanupRecords(x, y *diffSide, count1, count2 []int) {
+	discards := func(s *diffSide, other []int) []byte {
+		limit := min(bogoSqrt(len(s.class)), maxEqualLimit)
+		dis := make([]byte, len(s.class)+1)
+		for i := s.dstart; i <= s.dend; i++ {
+			switch n := other[s.class[i]]; {
+			case n == 0:
+				dis[i] = 0
+			case n >= limit:
+				dis[i] = 2
+			default:
+				dis[i] = 1
+			}
+		}
+		return dis
+	}
+	dis1 := discards(x, count2)
+	dis2 := discards(y, count1)
+
+	keep := func(s *diffSide, dis []byte) {
+		for i := s.dstart; i <= s.dend; i++ {
+			if dis[i] == 1 || dis[i] == 2 && !cleanMultiMatch(dis, i, s.dstart, s.dend) {
+				s.rindex = append(s.rindex, i)
+				s.ha = append(s.ha, s.class[i])
+			} else {
+				s.setChanged(i, true)
+			}
+		}
+	}
+	keep(x, dis1)
+	keep(y, dis2)
+}
+
+// cleanMultiMatch reports whether the common line i sits in a run that is
+// mostly made of lines without a match, in which case it is dropped too.
+func cleanMultiMatch(dis []byte, i, s, e int) bool {
+	s = max(s, i-simScanWindow)
+	e = min(e, i+simScanWindow)
+
+	rdis0, rpdis0 := 0, 1
+	for r := 1; i-r >= s; r++ {
+		if dis[i-r] == 0 {
+			rdis0++
+		} else if dis[i-r] == 2 {
+			rpdis0++
+		} else {
+			break
+		}
+	}
+	if rdis0 == 0 {
+		return false
+	}
+	rdis1, rpdis1 := 0, 1
+	for r := 1; i+r <= e; r++ {
+		if dis[i+r] == 0 {
+			rdis1++
+		} else if dis[i+r] == 2 {
+			rpdis1++
+		} else {
+			break
+		}
+	}
+	if rdis1 == 0 {
+		return false
+	}
+	rdis1 += rdis0
+	rpdis1 += rpdis0
+	return rpdis1*keptDiscardRun < rpdis1+rdis1
+}
+
+// myers holds the state of the bisecting search. kvdf and kvdb are the
+// furthest reaching forward and backward paths, indexed by diagonal plus
+// koff.
+type myers struct {
+	x, y       *diffSide
+	kvdf, kvdb []int
+	koff       int
+	maxCost    int
+}
+
+// compare marks the changed lines between x.ha[off1:lim1] and
+// y.ha[off2:lim2].
+func (m *myers) compare(off1, lim1, off2, lim2 int, needMin bool) {
+	ha1, ha2 := m.x.ha, m.y.ha
+	for off1 < lim1 && off2 < lim2 && ha1[off1] == ha2[off2] {
+		off1++
+		off2++
+	}
+	for off1 < lim1 && off2 < lim2 && ha1[lim1-1] == ha2[lim2-1] {
+		lim1--
+		lim2--
+	}
+
+	switch {
+	case off1 == lim1:
+		for ; off2 < lim2; off2++ {
+			m.y.setChanged(m.y.rindex[off2], true)
+		}
+	case off2 == lim2:
+		for ; off1 < lim1; off1++ {
+			m.x.setChanged(m.x.rindex[off1], true)
+		}
+	default:
+		i1, i2, minLo, minHi := m.split(off1, lim1, off2, lim2, needMin)
+		m.compare(off1, i1, off2, i2, minLo)
+		m.compare(i1, lim1, i2, lim2, minHi)
+	}
+}
+
+// split finds where to bisect the comparison by running the search from
+// both ends until the paths meet. Unless needMin is set, expensive
+// searches give up on a minimal result, which is reported through minLo
+// and minHi for each half.
+func (m *myers) split(off1, lim1, off2, lim2 int, needMin bool) (int, int, bool, bool) {
+	ha1, ha2 := m.x.ha, m.y.ha
+	kvdf := func(d int) *int { return &m.kvdf[d+m.koff] }
+	kvdb := func(d int) *int { return &m.kvdb[d+m.koff] }
+
+	dmin, dmax := off1-lim2, lim1-off2
+	fmid, bmid := off1-off2, lim1-lim2
+	odd := (fmid-bmid)&1 != 0
+	fmin, fmax := fmid, fmid
+	bmin, bmax := bmid, bmid
+
+	*kvdf(fmid) = off1
+	*kvdb(bmid) = lim1
+
+	for ec := 1; ; ec++ {
+		gotSnake := false
+
+		if fmin > dmin {
+			fmin--
+			*kvdf(fmin - 1) = -1
+		} else {
+			fmin++
+		}
+		if fmax < dmax {
+			fmax++
+			*kvdf(fmax + 1) = -1
+		} else {
+			fmax--
+		}
+		for d := fmax; d >= fmin; d -= 2 {
+			var i1 int
+			if *kvdf(d - 1) >= *kvdf(d + 1) {
+				i1 = *kvdf(d - 1) + 1
+			} else {
+				i1 = *kvdf(d + 1)
+			}
+			prev1 := i1
+			i2 := i1 - d
+			for i1 < lim1 && i2 < lim2 && ha1[i1] == ha2[i2] {
+				i1++
+				i2++
+			}
+			if i1-prev1 > snakeCount {
+				gotSnake = true
+			}
+			*kvdf(d) = i1
+			if odd && bmin <= d && d <= bmax && *kvdb(d) <= i1 {
+				return i1, i2, true, true
+			}
+		}
+
+		if bmin > dmin {
+			bmin--
+			*kvdb(bmin - 1) = math.MaxInt
+		} else {
+			bmin++
+		}
+		if bmax < dmax {
+			bmax++
+			*kvdb(bmax + 1) = math.MaxInt
+		} else {
+			bmax--
+		}
+		for d := bmax; d >= bmin; d -= 2 {
+			var i1 int
+			if *kvdb(d - 1) < *kvdb(d + 1) {
+				i1 = *kvdb(d - 1)
+			} else {
+				i1 = *kvdb(d + 1) - 1
+			}
+			prev1 := i1
+			i2 := i1 - d
+			for i1 > off1 && i2 > off2 && ha1[i1-1] == ha2[i2-1] {
+				i1--
+				i2--
+			}
+			if prev1-i1 > snakeCount {
+				gotSnake = true
+			}
+			*kvdb(d) = i1
+			if !odd && fmin <= d && d <= fmax && i1 <= *kvdf(d) {
+				return i1, i2, true, true
+			}
+		}
+
+		if needMin {
+			continue
+		}
+
+		// Accept a long enough diagonal that got far along either way.
+		if gotSnake && ec > heurMinCost {
+			best, s1, s2 := 0, 0, 0
+			for d := fmax; d >= fmin; d -= 2 {
+				dd := abs(d - fmid)
+				i1 := *kvdf(d)
+				i2 := i1 - d
+				v := (i1 - off1) + (i2 - off2) - dd
+				if v > heurK*ec && v > best &&
+					off1+snakeCount <= i1 && i1 < lim1 &&
+					off2+snakeCount <= i2 && i2 < lim2 {
+					for k := 1; ha1[i1-k] == ha2[i2-k]; k++ {
+						if k == snakeCount {
+							best, s1, s2 = v, i1, i2
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return s1, s2, true, false
+			}
+
+			for d := bmax; d >= bmin; d -= 2 {
+				dd := abs(d - bmid)
+				i1 := *kvdb(d)
+				i2 := i1 - d
+				v := (lim1 - i1) + (lim2 - i2) - dd
+				if v > heurK*ec && v > best &&
+					off1 < i1 && i1 <= lim1-snakeCount &&
+					off2 < i2 && i2 <= lim2-snakeCount {
+					for k := 0; ha1[i1+k] == ha2[i2+k]; k++ {
+						if k == snakeCount-1 {
+							best, s1, s2 = v, i1, i2
+							break
+						}
+					}
+				}
+			}
+			if best > 0 {
+				return s1, s2, false, true
+			}
+		}
+
+		// Too expensive: split at whichever path got furthest.
+		if ec >= m.maxCost {
+			fbest, fbest1 := -1, -1
+			for d := fmax; d >= fmin; d -= 2 {
+				i1 := min(*kvdf(d), lim1)
+				i2 := i1 - d
+				if lim2 < i2 {
+					i1, i2 = lim2+d, lim2
+				}
+				if fbest < i1+i2 {
+					fbest, fbest1 = i1+i2, i1
+				}
+			}
+			bbest, bbest1 := math.MaxInt, math.MaxInt
+			for d := bmax; d >= bmin; d -= 2 {
+				i1 := max(off1, *kvdb(d))
+				i2 := i1 - d
+				if i2 < off2 {
+					i1, i2 = off2+d, off2
+				}
+				if i1+i2 < bbest {
+					bbest, bbest1 = i1+i2, i1
+				}
+			}
+			if (lim1+lim2)-bbest < fbest-(off1+off2) {
+				return fbest1, fbest - fbest1, true, false
+			}
+			return bbest1, bbest - bbest1, false, true
+		}
+	}
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// diffGroup is a run of changed lines [start, end) in one file; an empty
+// group marks a position between unchanged lines.
+type diffGroup struct {
+	start, end int
+}
+
+func (s *diffSide) firstGroup() diffGroup {
+	g := diffGroup{}
+	for s.isChanged(g.end) {
+		g.end++
+	}
+	return g
+}
+
+func (s *diffSide) nextGroup(g *diffGroup) bool {
+	if g.end == len(s.lines) {
+		return false
+	}
+	g.start = g.end + 1
+	g.end = g.start
+	for s.isChanged(g.end) {
+		g.end++
+	}
+	return true
+}
+
+func (s *diffSide) previousGroup(g *diffGroup) bool {
+	if g.start == 0 {
+		return false
+	}
+	g.end = g.start - 1
+	g.start = g.end
+	for s.isChanged(g.start - 1) {
+		g.start--
+	}
+	return true
+}
+
+// slideDown moves the group one line down if the line after it equals
+// its first line, merging it with any group it then touches.
+func (s *diffSide) slideDown(g *diffGroup) bool {
+	if g.end < len(s.lines) && s.class[g.start] == s.class[g.end] {
+		s.setChanged(g.start, false)
+		s.setChanged(g.end, true)
+		g.start++
+		g.end++
+		for s.isChanged(g.end) {
+			g.end++
+		}
+		return true
+	}
+	return false
+}
+
+func (s *diffSide) slideUp(g *diffGroup) bool {
+	if g.start > 0 && s.class[g.start-1] == s.class[g.end-1] {
+		g.start--
+		g.end--
+		s.setChanged(g.start, true)
+		s.setChanged(g.end, false)
+		for s.isChanged(g.start - 1) {
+			g.start--
+		}
+		return true
+	}
+	return false
+}
+
+// changeCompact slides each changed block of s to where it reads best:
+// next to a change in the other file if possible, and otherwise where the
+// indentation suggests a natural boundary.
+func changeCompact(s, other *diffSide) {
+	g, og := s.firstGroup(), other.firstGroup()
+	for {
+		if g.end != g.start {
+			var size, earliestEnd int
+			endMatchingOther := -1
+			for {
+				size = g.end - g.start
+				endMatchingOther = -1
+
+				for s.slideUp(&g) {
+					other.previousGroup(&og)
+				}
+				earliestEnd = g.end
+				if og.end > og.start {
+					endMatchingOther = g.end
+				}
+				for s.slideDown(&g) {
+					other.nextGroup(&og)
+					if og.end > og.start {
+						endMatchingOther = g.end
+					}
+				}
+				if size == g.end-g.start {
+					break
+				}
+			}
+
+			switch {
+			case g.end == earliestEnd:
+				// The group cannot move.
+			case endMatchingOther != -1:
+				for og.end == og.start {
+					s.slideUp(&g)
+					other.previousGroup(&og)
+				}
+			default:
+				shift := max(earliestEnd, g.end-size-1, g.end-indentMaxSliding)
+				bestShift := -1
+				var best splitScore
+				for ; shift <= g.end; shift++ {
+					var score splitScore
+					score.add(s.measureSplit(shift))
+					score.add(s.measureSplit(shift - size))
+					if bestShift == -1 || score.cmp(best) <= 0 {
+						best, bestShift = score, shift
+					}
+				}
+				for g.end > bestShift {
+					s.slideUp(&g)
+					other.previousGroup(&og)
+				}
+			}
+		}
+
+		if !s.nextGroup(&g) {
+			break
+		}
+		other.nextGroup(&og)
+	}
+}
+
+// lineIndent returns the width of a line's leading whitespace with tabs
+// expanded, or -1 for a blank line.
+func lineIndent(line string) int {
+	n := 0
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; c {
+		case ' ':
+			n++
+		case '\t':
+			n += 8 - n%8
+		case '\n', '\r', '\v', '\f':
+		default:
+			return n
+		}
+		if n >= maxIndent {
+			return maxIndent
+		}
+	}
+	return -1
+}
+
+// splitMeasurement describes the lines around a possible block boundary
+// just before line split.
+type splitMeasurement struct {
+	endOfFile  bool
+	indent     int
+	preBlank   int
+	preIndent  int
+	postBlank  int
+	postIndent int
+}
+
+func (s *diffSide) measureSplit(split int) splitMeasurement {
+	var m splitMeasurement
+	if split >= len(s.lines) {
+		m.endOfFile = true
+		m.indent = -1
+	} else {
+		m.indent = lineIndent(s.lines[split])
+	}
+
+	m.preIndent = -1
+	for i := split - 1; i >= 0; i-- {
+		if m.preIndent = lineIndent(s.lines[i]); m.preIndent != -1 {
+			break
+		}
+		m.preBlank++
+		if m.preBlank == maxBlanks {
+			m.preIndent = 0
+			break
+		}
+	}
+
+	m.postIndent = -1
+	for i := split + 1; i < len(s.lines); i++ {
+		if m.postIndent = lineIndent(s.lines[i]); m.postIndent != -1 {
+			break
+		}
+		m.postBlank++
+		if m.postBlank == maxBlanks {
+			m.postIndent = 0
+			break
+		}
+	}
+	return m
+}
+
+// splitScore rates a block position; lower is better.
+type splitScore struct {
+	effectiveIndent int
+	penalty         int
+}
+
+func (s *splitScore) add(m splitMeasurement) {
+	if m.preIndent == -1 && m.preBlank == 0 {
+		s.penalty += startOfFilePenalty
+	}
+	if m.endOfFile {
+		s.penalty += endOfFilePenalty
+	}
+
+	postBlank := 0
+	if m.indent == -1 {
+		postBlank = 1 + m.postBlank
+	}
+	totalBlank := m.preBlank + postBlank
+	s.penalty += totalBlankWeight * totalBlank
+	s.penalty += postBlankWeight * postBlank
+
+	indent := m.indent
+	if indent == -1 {
+		indent = m.postIndent
+	}
+	anyBlanks := totalBlank != 0
+	s.effectiveIndent += indent
+
+	switch {
+	case indent == -1, m.preIndent == -1, indent == m.preIndent:
+	case indent > m.preIndent:
+		if anyBlanks {
+			s.penalty += relativeIndentWithBlankPenalty
+		} else {
+			s.penalty += relativeIndentPenalty
+		}
+	case m.postIndent != -1 && m.postIndent > indent:
+		if anyBlanks {
+			s.penalty += relativeOutdentBlankPenalty
+		} else {
+			s.penalty += relativeOutdentPenalty
+		}
+	default:
+		if anyBlanks {
+			s.penalty += relativeDedentBlankPenalty
+		} else {
+			s.penalty += relativeDedentPenalty
+		}
+	}
+}
+
+func (s splitScore) cmp(o splitScore) int {
+	indents := 0
+	if s.effectiveIndent > o.effectiveIndent {
+		indents = 1
+	} else if s.effectiveIndent < o.effectiveIndent {
+		indents = -1
+	}
+	return indentWeight*indents + s.penalty - o.penalty
+}
+
+// buildScript collects the changed lines of both files into changes, in
+// file order.
+func buildScript(x, y *diffSide) []lineChange {
+	var changes []lineChange
+	i1, i2 := len(x.lines), len(y.lines)
+	for i1 >= 0 || i2 >= 0 {
+		if x.isChanged(i1-1) || y.isChanged(i2-1) {
+			l1, l2 := i1, i2
+			for x.isChanged(i1 - 1) {
+				i1--
+			}
+			for y.isChanged(i2 - 1) {
+				i2--
+			}
+			changes = append(changes, lineChange{i1: i1, i2: i2, n1: l1 - i1, n2: l2 - i2})
+		}
+		i1--
+		i2--
+	}
+	for i, j := 0, len(changes)-1; i < j; i, j = i+1, j-1 {
+		changes[i], changes[j] = changes[j], changes[i]
+	}
+	return changes
+}
@@ -0,0 +1,256 @@
+package mygit
+
+import (
+	"slices"
+	"strings"
+)
+
+// The three-way merge below follows git's xmerge at its default level:
+// both sides are diffed against the base, overlapping changes that are not
+// identical become conflicts, and conflicts are then narrowed down to the
+// lines that actually differ between the two sides.
+
+const (
+	defaultConflictMarkerSize = 7
+	// Conflicts separated by no more than this many lines are joined.
+	conflictJoinDistance = 3
+)
+
+// Conflict styles, as set by merge.conflictStyle.
+const (
+	conflictStyleMerge = "merge"
+	conflictStyleDiff3 = "diff3"
+)
+
+// mergeChunk is a region of the merge result. i0, i1 and i2 start the
+// region in the base, ours and theirs, and n0, n1 and n2 are its lengths.
+type mergeChunk struct {
+	mode       int
+	i0, i1, i2 int
+	n0, n1, n2 int
+}
+
+// Chunk modes: a conflict, a change from ours or theirs, and a change made
+// identically on both sides.
+const (
+	chunkConflict = 0
+	chunkOurs     = 1
+	chunkTheirs   = 2
+	chunkBoth     = 4
+)
+
+// mergeFileOptions controls how conflicts are written: the names of the
+// sides on the markers, the conflict style and the marker length. flags
+// are the whitespace options lines are compared under.
+type mergeFileOptions struct {
+	base, ours, theirs string
+	style              string
+	markerSize         int
+	flags              diffFlags
+}
+
+// appendChunk adds a chunk, folding it into the previous one if they
+// overlap; a chunk folding two different sides together is a conflict.
+func appendChunk(chunks []mergeChunk, c mergeChunk) []mergeChunk {
+	if n := len(chunks); n > 0 {
+		m := &chunks[n-1]
+		if c.i1 <= m.i1+m.n1 || c.i2 <= m.i2+m.n2 {
+			if c.mode != m.mode {
+				m.mode = chunkConflict
+			}
+			m.n0 = c.i0 + c.n0 - m.i0
+			m.n1 = c.i1 + c.n1 - m.i1
+			m.n2 = c.i2 + c.n2 - m.i2
+			return chunks
+		}
+	}
+	return append(chunks, c)
+}
+
+// mergeChunks lines up the changes from base to ours and from base to
+// theirs. Overlapping changes are conflicts unless they are identical.
+func mergeChunks(base, ours, theirs []string, flags diffFlags) []mergeChunk {
+	x1, x2 := diffLines(base, ours, flags), diffLines(base, theirs, flags)
+	var chunks []mergeChunk
+	for len(x1) > 0 && len(x2) > 0 {
+		c1, c2 := x1[0], x2[0]
+		switch {
+		case c1.i1+c1.n1 < c2.i1:
+			chunks = appendChunk(chunks, mergeChunk{
+				mode: chunkOurs,
+				i0:   c1.i1, n0: c1.n1,
+				i1: c1.i2, n1: c1.n2,
+				i2: c2.i2 - c2.i1 + c1.i1, n2: c1.n1,
+			})
+			x1 = x1[1:]
+			continue
+		case c2.i1+c2.n1 < c1.i1:
+			chunks = appendChunk(chunks, mergeChunk{
+				mode: chunkTheirs,
+				i0:   c2.i1, n0: c2.n1,
+				i1: c1.i2 - c1.i1 + c2.i1, n1: c2.n1,
+				i2: c2.i2, n2: c2.n2,
+			})
+			x2 = x2[1:]
+			continue
+		}
+
+		if c1.i1 != c2.i1 || c1.n1 != c2.n1 || c1.n2 != c2.n2 ||
+			!slices.EqualFunc(ours[c1.i2:c1.i2+c1.n2], theirs[c2.i2:c2.i2+c2.n2], func(a, b string) bool {
+				return sameLine(a, b, flags)
+			}) {
+			// Span both changes, extending each side by the base lines
+			// the other change covers beyond it.
+			off := c1.i1 - c2.i1
+			ffo := off + c1.n1 - c2.n1
+			i0, i1, i2 := c1.i1, c1.i2, c2.i2
+			if off > 0 {
+				i0 -= off
+				i1 -= off
+			} else {
+				i2 += off
+			}
+			n0 := c1.i1 + c1.n1 - i0
+			n1 := c1.i2 + c1.n2 - i1
+			n2 := c2.i2 + c2.n2 - i2
+			if ffo < 0 {
+				n0 -= ffo
+				n1 -= ffo
+			} else {
+				n2 += ffo
+			}
+			chunks = appendChunk(chunks, mergeChunk{mode: chunkConflict, i0: i0, n0: n0, i1: i1, n1: n1, i2: i2, n2: n2})
+		}
+
+		end1, end2 := c1.i1+c1.n1, c2.i1+c2.n1
+		if end1 >= end2 {
+			x2 = x2[1:]
+		}
+		if end2 >= end1 {
+			x1 = x1[1:]
+		}
+	}
+	for _, c1 := range x1 {
+		chunks = appendChunk(chunks, mergeChunk{
+			mode: chunkOurs,
+			i0:   c1.i1, n0: c1.n1,
+			i1: c1.i2, n1: c1.n2,
+			i2: c1.i1 + len(theirs) - len(base), n2: c1.n1,
+		})
+	}
+	for _, c2 := range x2 {
+		chunks = appendChunk(chunks, mergeChunk{
+			mode: chunkTheirs,
+			i0:   c2.i1, n0: c2.n1,
+			i1: c2.i1 + len(ours) - len(base), n1: c2.n1,
+			i2: c2.i2, n2: c2.n2,
+		})
+	}
+	return chunks
+}
+
+// refineConflicts diffs the two sides of each conflict and keeps only the
+// lines that differ as conflicts. The base ranges of refined conflicts are
+// no longer meaningful, which is why diff3 output does not refine.
+func refineConflicts(chunks []mergeChunk, ours, theirs []string, flags diffFlags) []mergeChunk {
+	var refined []mergeChunk
+	for _, m := range chunks {
+		if m.mode != chunkConflict || m.n1 == 0 || m.n2 == 0 {
+			refined = append(refined, m)
+			continue
+		}
+		changes := diffLines(ours[m.i1:m.i1+m.n1], theirs[m.i2:m.i2+m.n2], flags)
+		if len(changes) == 0 {
+			m.mode = chunkBoth
+			refined = append(refined, m)
+			continue
+		}
+		for _, c := range changes {
+			refined = append(refined, mergeChunk{
+				mode: chunkConflict,
+				i0:   m.i0, n0: m.n0,
+				i1: m.i1 + c.i1, n1: c.n1,
+				i2: m.i2 + c.i2, n2: c.n2,
+			})
+		}
+	}
+	return refined
+}
+
+// joinConflicts merges conflicts that are only a few lines apart, which
+// reads better than many small ones.
+func joinConflicts(chunks []mergeChunk) []mergeChunk {
+	var joined []mergeChunk
+	for _, m := range chunks {
+		if n := len(joined); n > 0 {
+			prev := &joined[n-1]
+			if prev.mode == chunkConflict && m.mode == chunkConflict &&
+				m.i1-(prev.i1+prev.n1) <= conflictJoinDistance {
+				prev.n1 = m.i1 + m.n1 - prev.i1
+				prev.n2 = m.i2 + m.n2 - prev.i2
+				continue
+			}
+		}
+		joined = append(joined, m)
+	}
+	return joined
+}
+
+// mergeContent merges the changes from base to ours and from base to
+// theirs. Conflicting regions are written between conflict markers, and
+// the number of conflicts is returned along with the result.
+func mergeContent(base, ours, theirs []byte, opts *mergeFileOptions) ([]byte, int) {
+	b, o, t := splitLines(base), splitLines(ours), splitLines(theirs)
+	diff3 := opts.style == conflictStyleDiff3
+	chunks := mergeChunks(b, o, t, opts.flags)
+	if !diff3 {
+		chunks = joinConflicts(refineConflicts(chunks, o, t, opts.flags))
+	}
+
+	var out strings.Builder
+	// copyLines writes lines, completing the last one if it lacks a
+	// newline and a marker follows.
+	copyLines := func(lines []string, markerFollows bool) {
+		for _, line := range lines {
+			out.WriteString(line)
+		}
+		if markerFollows && len(lines) > 0 && !strings.HasSuffix(lines[len(lines)-1], "\n") {
+			out.WriteString("\n")
+		}
+	}
+	marker := func(c byte, label string) {
+		out.WriteString(strings.Repeat(string(c), opts.markerSize))
+		if label != "" {
+			out.WriteString(" " + label)
+		}
+		out.WriteString("\n")
+	}
+
+	conflicts, i := 0, 0
+	for _, m := range chunks {
+		switch m.mode {
+		case chunkConflict:
+			conflicts++
+			copyLines(o[i:m.i1], false)
+			marker('<', opts.ours)
+			copyLines(o[m.i1:m.i1+m.n1], true)
+			if diff3 {
+				marker('|', opts.base)
+				copyLines(b[m.i0:m.i0+m.n0], true)
+			}
+			marker('=', "")
+			copyLines(t[m.i2:m.i2+m.n2], true)
+			marker('>', opts.theirs)
+		case chunkOurs:
+			copyLines(o[i:m.i1+m.n1], false)
+		case chunkTheirs:
+			copyLines(o[i:m.i1], false)
+			copyLines(t[m.i2:m.i2+m.n2], false)
+		default:
+			continue
+		}
+		i = m.i1 + m.n1
+	}
+	copyLines(o[i:], false)
+	return []byte(out.String()), conflicts
+}